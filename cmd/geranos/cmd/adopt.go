@@ -1,27 +1,63 @@
 package cmd
 
 import (
+	"github.com/macvmio/geranos/pkg/duplicator"
 	"github.com/macvmio/geranos/pkg/transporter"
 	"github.com/spf13/cobra"
 )
 
 func NewCmdAdopt() *cobra.Command {
+	var (
+		flagConcurrentWorkers int
+		flagXattrs            bool
+		flagVerify            bool
+		flagMove              bool
+		flagHash              bool
+	)
+
 	var adoptCommand = &cobra.Command{
 		Use:   "adopt [dir name] [image name]",
 		Short: "Adopt a directory as an image under current local registry",
-		Long: "Provided directory can be anywhere on your disk. It will be adopted as provided reference under current local registry." +
-			"This will ensure that later it is available for use with other commands",
+		Long: "Provided directory can be anywhere on your disk. It will be adopted as provided reference under current local registry. " +
+			"This will ensure that later it is available for use with other commands. Files are hashed in place and the manifest " +
+			"and config written, so the image can be pushed and is a clone candidate of pulled images. A directory already " +
+			"at the place of the image, e.g. restored from backup, is adopted without copying.",
 		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			src := args[0]
 			ref := TheAppConfig.Override(args[1])
+			progress := make(chan transporter.ProgressUpdate)
+			defer close(progress)
 
 			opts := []transporter.Option{
 				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
+				transporter.WithContext(cmd.Context()),
+				transporter.WithWorkersCount(flagConcurrentWorkers),
+				transporter.WithXattrs(flagXattrs),
+				transporter.WithCloneVerification(flagVerify),
+				transporter.WithProgressChannel(progress),
+				transporter.WithAdoptByRename(flagMove),
+				transporter.WithHashing(flagHash),
 			}
+			go transporter.PrintProgress(progress)
 			return transporter.Adopt(src, ref, opts...)
 		},
 	}
 
+	adoptCommand.Flags().IntVar(&flagConcurrentWorkers, "concurrent-workers", duplicator.DefaultConcurrency,
+		"Specifies number of files cloned at the same time")
+
+	adoptCommand.Flags().BoolVar(&flagXattrs, "xattrs", false,
+		"Copy extended attributes of files as well")
+
+	adoptCommand.Flags().BoolVar(&flagVerify, "verify", false,
+		"Compare every cloned file with its source, to catch broken Copy-on-Write on network filesystems")
+
+	adoptCommand.Flags().BoolVar(&flagMove, "move", false,
+		"Move the directory into the local registry instead of cloning it, it must be on the same filesystem")
+
+	adoptCommand.Flags().BoolVar(&flagHash, "hash", true,
+		"Hash files and write the manifest and config of the image")
+
 	return adoptCommand
 }
@@ -2,11 +2,22 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/macvmio/geranos/pkg/duplicator"
 	"github.com/macvmio/geranos/pkg/transporter"
 	"github.com/spf13/cobra"
 )
 
 func NewCmdClone() *cobra.Command {
+	var (
+		flagConcurrentWorkers int
+		flagXattrs            bool
+		flagVerify            bool
+		flagHardlink          bool
+		flagFromStore         string
+		flagInclude           []string
+		flagExclude           []string
+	)
+
 	var cloneCmd = &cobra.Command{
 		Use:   "clone [src ref] [dst ref]",
 		Short: "Locally clone one reference to other name",
@@ -15,9 +26,29 @@ func NewCmdClone() *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			src := TheAppConfig.Override(args[0])
 			dst := TheAppConfig.Override(args[1])
+			sourceImagesPath := TheAppConfig.ImagesDirectory
+			if flagFromStore != "" {
+				dir, err := TheAppConfig.StoreDirectory(flagFromStore)
+				if err != nil {
+					fmt.Printf("error while cloning: %v", err)
+					return
+				}
+				sourceImagesPath = dir
+			}
+			progress := make(chan transporter.ProgressUpdate)
+			defer close(progress)
 			opts := []transporter.Option{
 				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
+				transporter.WithSourceImagesPath(sourceImagesPath),
+				transporter.WithContext(cmd.Context()),
+				transporter.WithWorkersCount(flagConcurrentWorkers),
+				transporter.WithXattrs(flagXattrs),
+				transporter.WithCloneVerification(flagVerify),
+				transporter.WithHardlinks(flagHardlink),
+				transporter.WithFileFilter(flagInclude, flagExclude),
+				transporter.WithProgressChannel(progress),
 			}
+			go transporter.PrintProgress(progress)
 			err := transporter.Clone(src, dst, opts...)
 			if err != nil {
 				fmt.Printf("error while cloning: %v", err)
@@ -27,5 +58,26 @@ func NewCmdClone() *cobra.Command {
 		},
 	}
 
+	cloneCmd.Flags().IntVar(&flagConcurrentWorkers, "concurrent-workers", duplicator.DefaultConcurrency,
+		"Specifies number of files cloned at the same time")
+
+	cloneCmd.Flags().BoolVar(&flagXattrs, "xattrs", false,
+		"Copy extended attributes of files as well")
+
+	cloneCmd.Flags().BoolVar(&flagVerify, "verify", false,
+		"Compare every cloned file with its source, to catch broken Copy-on-Write on network filesystems")
+
+	cloneCmd.Flags().BoolVar(&flagHardlink, "hardlink", false,
+		"Hard link files instead of cloning them; neither image may be modified afterwards")
+
+	cloneCmd.Flags().StringVar(&flagFromStore, "from-store", "",
+		"Clone the source image from another configured store into the selected one")
+
+	cloneCmd.Flags().StringSliceVar(&flagInclude, "include", nil,
+		"Clone only files matching given glob pattern (can be repeated)")
+
+	cloneCmd.Flags().StringSliceVar(&flagExclude, "exclude", nil,
+		"Skip files and directories matching given glob pattern, like logs or lock files (can be repeated)")
+
 	return cloneCmd
 }
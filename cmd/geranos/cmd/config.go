@@ -39,5 +39,5 @@ func initConfig() error {
 	if err := viper.Unmarshal(&TheAppConfig); err != nil {
 		return fmt.Errorf("error unmarshalling viper config '%v': %w", viper.ConfigFileUsed(), err)
 	}
-	return nil
+	return TheAppConfig.SelectStore()
 }
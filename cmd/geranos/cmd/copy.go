@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdCopy() *cobra.Command {
+	var flagConcurrentWorkers int
+
+	var copyCmd = &cobra.Command{
+		Use:     "copy [src ref] [dst ref]",
+		Aliases: []string{"cp"},
+		Short:   "Copy an image from one registry to another",
+		Long: `Streams blobs of a remote image, or index of images, directly from the source registry to the destination one,
+without storing the image locally, e.g. to promote it between registries of a pipeline. Blobs are verified
+against their digests, and ones the destination already has are skipped.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			src := TheAppConfig.Override(args[0])
+			dst := TheAppConfig.Override(args[1])
+			res, err := transporter.Copy(src, dst,
+				transporter.WithContext(cmd.Context()),
+				transporter.WithWorkersCount(flagConcurrentWorkers),
+				transporter.WithVerbose(TheAppConfig.Verbose))
+			if err != nil {
+				return err
+			}
+			fmt.Printf("copied %v to %v, uploaded %d bytes\n", res.Digest, dst, res.BytesUploaded)
+			return nil
+		},
+	}
+
+	copyCmd.Flags().IntVar(&flagConcurrentWorkers, "concurrent-workers", 8,
+		"Specifies number of blobs copied at the same time")
+
+	return copyCmd
+}
@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdDiskUsage() *cobra.Command {
+	var duCmd = &cobra.Command{
+		Use:   "du [image ref...]",
+		Short: "Show how much disk space local images take and would reclaim",
+		Long: `Shows for every local image, or the given ones, the apparent size of its files, the size of blocks allocated to them
+(holes of sparse files take none), and how many of those blocks belong to the image only, and would be reclaimed by removing it,
+and how many are shared with other images or the content store through Copy-on-Write clones or hard links.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			refs := make([]string, 0, len(args))
+			for _, arg := range args {
+				refs = append(refs, TheAppConfig.Override(arg))
+			}
+			return transporter.DiskUsage(refs, transporter.WithImagesPath(TheAppConfig.ImagesDirectory))
+		},
+	}
+	return duCmd
+}
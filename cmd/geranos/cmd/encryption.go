@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"crypto"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/encryption"
+	"github.com/macvmio/geranos/pkg/transporter"
+)
+
+// parseEncryption returns options of --encryption-key, encrypting layers for recipients with public keys at paths.
+func parseEncryption(paths []string) ([]transporter.Option, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	recipients := make([]crypto.PublicKey, 0, len(paths))
+	for _, p := range paths {
+		r, err := encryption.LoadRecipient(p)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load encryption key: %w", err)
+		}
+		recipients = append(recipients, r)
+	}
+	return []transporter.Option{transporter.WithEncryption(recipients...)}, nil
+}
+
+// parseDecryption returns options of --decryption-key, decrypting layers with private keys at paths.
+func parseDecryption(paths []string) ([]transporter.Option, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	keys := make([]crypto.PrivateKey, 0, len(paths))
+	for _, p := range paths {
+		k, err := encryption.LoadPrivateKey(p)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load decryption key: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	return []transporter.Option{transporter.WithDecryptionKeys(keys...)}, nil
+}
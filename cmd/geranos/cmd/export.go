@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"github.com/macvmio/geranos/pkg/duplicator"
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdExport() *cobra.Command {
+	var (
+		flagConcurrentWorkers int
+		flagXattrs            bool
+		flagVerify            bool
+		flagOCILayout         bool
+	)
+
+	var exportCmd = &cobra.Command{
+		Use:   "export [image name] [dir name]",
+		Short: "Clone files of a local image to a plain directory",
+		Long: `Clones files of a local image to a directory outside the local registry, without the manifest, config and
+other metadata files, for tools which do not expect them. The directory must not exist or be empty.
+
+With --oci-layout the image is written to a standard OCI image layout directory (index.json and blobs/sha256)
+instead, named by its tag, so it can be copied with tools like skopeo or oras, or archived. Images exported
+to the same layout share its blobs, see import for the opposite direction.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			src := TheAppConfig.Override(args[0])
+			if flagOCILayout {
+				return transporter.ExportLayout(src, args[1],
+					transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
+					transporter.WithContext(cmd.Context()))
+			}
+			progress := make(chan transporter.ProgressUpdate)
+			defer close(progress)
+			opts := []transporter.Option{
+				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
+				transporter.WithContext(cmd.Context()),
+				transporter.WithWorkersCount(flagConcurrentWorkers),
+				transporter.WithXattrs(flagXattrs),
+				transporter.WithCloneVerification(flagVerify),
+				transporter.WithProgressChannel(progress),
+			}
+			go transporter.PrintProgress(progress)
+			return transporter.Export(src, args[1], opts...)
+		},
+	}
+
+	exportCmd.Flags().IntVar(&flagConcurrentWorkers, "concurrent-workers", duplicator.DefaultConcurrency,
+		"Specifies number of files cloned at the same time")
+
+	exportCmd.Flags().BoolVar(&flagXattrs, "xattrs", false,
+		"Copy extended attributes of files as well")
+
+	exportCmd.Flags().BoolVar(&flagVerify, "verify", false,
+		"Compare every cloned file with its source, to catch broken Copy-on-Write on network filesystems")
+
+	exportCmd.Flags().BoolVar(&flagOCILayout, "oci-layout", false,
+		"Write the image to an OCI image layout directory instead of plain files")
+
+	return exportCmd
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"github.com/macvmio/geranos/pkg/layout"
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+	"time"
+)
+
+func NewCmdGC() *cobra.Command {
+	var (
+		flagDryRun      bool
+		flagGracePeriod time.Duration
+	)
+
+	var gcCmd = &cobra.Command{
+		Use:   "gc",
+		Short: "Remove local files no image needs",
+		Long: `Removes directories of the local registry which are neither images nor contain any, staging directories and
+temporary files left by interrupted operations, and blobs of the content store no image references.
+Anything younger than the grace period is left alone, as it may belong to a running operation.`,
+		Args: cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return transporter.GC(
+				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
+				transporter.WithDryRun(flagDryRun),
+				transporter.WithGCGracePeriod(flagGracePeriod),
+			)
+		},
+	}
+
+	gcCmd.Flags().BoolVar(&flagDryRun, "dry-run", false,
+		"Print what would be removed and how many bytes it would reclaim, without removing anything")
+
+	gcCmd.Flags().DurationVar(&flagGracePeriod, "grace-period", layout.DefaultGCGracePeriod,
+		"Leave temporary files, staging directories and blobs younger than this, they may belong to running operations")
+
+	return gcCmd
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdImport() *cobra.Command {
+	var flagRefName string
+
+	var importCmd = &cobra.Command{
+		Use:   "import [dir name] [image name]",
+		Short: "Import an image from an OCI image layout directory",
+		Long: `Writes an image of a standard OCI image layout directory (index.json and blobs/sha256), like one written by
+export --oci-layout, skopeo or oras, as a local image. Layouts with many images need --ref-name to choose one.
+Images of all stores are clone candidates, like for pull.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dst := TheAppConfig.Override(args[1])
+			return transporter.ImportLayout(args[0], dst, flagRefName,
+				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
+				transporter.WithContext(cmd.Context()),
+				transporter.WithCandidateRoots(TheAppConfig.StoreDirectories()...))
+		},
+	}
+
+	importCmd.Flags().StringVar(&flagRefName, "ref-name", "",
+		"Name of the image in index.json of the layout (org.opencontainers.image.ref.name annotation), usually its tag")
+
+	return importCmd
+}
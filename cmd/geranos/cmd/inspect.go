@@ -7,6 +7,10 @@ import (
 )
 
 func NewCmdInspect() *cobra.Command {
+	var (
+		flagRemote   bool
+		flagPlatform string
+	)
 	var inspectCmd = &cobra.Command{
 		Use:   "inspect [image name]",
 		Short: "Inspect details of a specific OCI image.",
@@ -18,7 +22,17 @@ func NewCmdInspect() *cobra.Command {
 				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
 				transporter.WithContext(cmd.Context()),
 			}
-			out, err := transporter.Inspect(src, opts...)
+			platformOpts, err := parsePlatform(flagPlatform)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			opts = append(opts, platformOpts...)
+			inspect := transporter.Inspect
+			if flagRemote {
+				inspect = transporter.InspectRemote
+			}
+			out, err := inspect(src, opts...)
 			if err != nil {
 				fmt.Printf("%v", err)
 			} else {
@@ -27,5 +41,11 @@ func NewCmdInspect() *cobra.Command {
 		},
 	}
 
+	inspectCmd.Flags().BoolVar(&flagRemote, "remote", false,
+		"Inspect the image in the registry instead of the local one, listing platforms of image indexes")
+
+	inspectCmd.Flags().StringVar(&flagPlatform, "platform", "",
+		"Platform like darwin/arm64 of the variant inspected with --remote when the image is an index")
+
 	return inspectCmd
 }
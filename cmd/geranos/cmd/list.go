@@ -7,6 +7,8 @@ import (
 )
 
 func NewCmdList() *cobra.Command {
+	var dedupStats bool
+	var digests bool
 	var listCmd = &cobra.Command{
 		Use:     "list",
 		Short:   "List all OCI images in a specific local registry",
@@ -16,13 +18,22 @@ func NewCmdList() *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			opts := []transporter.Option{
 				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
+				transporter.WithDigests(digests),
 			}
 			err := transporter.List(opts...)
 			if err != nil {
 				fmt.Printf("%v", err)
+				return
+			}
+			if dedupStats {
+				if err := transporter.PrintDedupStats(opts...); err != nil {
+					fmt.Printf("%v", err)
+				}
 			}
 		},
 	}
 
+	listCmd.Flags().BoolVar(&digests, "digests", false, "Print manifest digests, which refer to images as repository@digest")
+	listCmd.Flags().BoolVar(&dedupStats, "dedup-stats", false, "Print how many segments and bytes local images share")
 	return listCmd
 }
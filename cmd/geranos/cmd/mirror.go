@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdMirror() *cobra.Command {
+	var flagFilter string
+	var flagConcurrentTags int
+	var flagDryRun bool
+
+	var mirrorCmd = &cobra.Command{
+		Use:   "mirror [src repo] [dst repo]",
+		Short: "Mirror tags of a remote repository to another one",
+		Long: `Copies tags of the source repository, optionally only the ones matching --filter, to the destination repository,
+e.g. to keep an on-prem mirror of VM images. Tags already pointing at the same digest are skipped, the rest
+is copied registry to registry, without storing images locally.`,
+		Example: `  geranos mirror --filter 'v1.*' registry.example.com/vms/macos mirror.local/vms/macos`,
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			src := TheAppConfig.Override(args[0])
+			dst := TheAppConfig.Override(args[1])
+			res, err := transporter.Mirror(src, dst, flagFilter,
+				transporter.WithContext(cmd.Context()),
+				transporter.WithWorkersCount(flagConcurrentTags),
+				transporter.WithDryRun(flagDryRun),
+				transporter.WithVerbose(TheAppConfig.Verbose))
+			if err != nil {
+				return err
+			}
+			upToDate, failed := 0, 0
+			for _, t := range res.Tags {
+				switch {
+				case t.Err != nil:
+					failed++
+					fmt.Printf("%v: %v\n", t.Tag, t.Err)
+				case t.UpToDate:
+					upToDate++
+					if TheAppConfig.Verbose {
+						fmt.Printf("%v: %v up to date\n", t.Tag, t.Digest)
+					}
+				case flagDryRun:
+					fmt.Printf("%v: would copy %v\n", t.Tag, t.Digest)
+				default:
+					fmt.Printf("%v: copied %v, uploaded %d bytes\n", t.Tag, t.Digest, t.BytesUploaded)
+				}
+			}
+			fmt.Printf("%d tags: %d copied, %d up to date, %d failed, uploaded %d bytes\n",
+				len(res.Tags), res.Copied(), upToDate, failed, res.BytesUploaded())
+			if !res.OK() {
+				return errors.New("some tags could not be mirrored")
+			}
+			return nil
+		},
+	}
+
+	mirrorCmd.Flags().StringVar(&flagFilter, "filter", "",
+		"Mirror only tags matching the pattern, e.g. 'v1.*'")
+	mirrorCmd.Flags().IntVar(&flagConcurrentTags, "concurrent-tags", 4,
+		"Specifies number of tags copied at the same time")
+	mirrorCmd.Flags().BoolVar(&flagDryRun, "dry-run", false,
+		"Print tags which would be copied, without copying them")
+
+	return mirrorCmd
+}
@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdMove() *cobra.Command {
+	var mvCmd = &cobra.Command{
+		Use:     "mv [src ref] [dst ref]",
+		Short:   "Rename locally stored image to another repository or tag",
+		Long:    `Moves the image within the local registry, keeping it pinned and a clone candidate for later pulls. Destination must not exist.`,
+		Args:    cobra.ExactArgs(2),
+		Aliases: []string{"move", "rename"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			src := TheAppConfig.Override(args[0])
+			dst := TheAppConfig.Override(args[1])
+			if err := transporter.Move(src, dst, transporter.WithImagesPath(TheAppConfig.ImagesDirectory)); err != nil {
+				return err
+			}
+			fmt.Printf("moved %v to %v\n", src, dst)
+			return nil
+		},
+	}
+	return mvCmd
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdPin() *cobra.Command {
+	var pinCmd = &cobra.Command{
+		Use:   "pin [image ref]",
+		Short: "Protect locally stored image from removal",
+		Long:  `Pinned images are never removed by prune, and rm refuses to remove them until they are unpinned.`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			src := TheAppConfig.Override(args[0])
+			if err := transporter.Pin(src, transporter.WithImagesPath(TheAppConfig.ImagesDirectory)); err != nil {
+				return fmt.Errorf("unable to pin: %w", err)
+			}
+			fmt.Printf("pinned %v\n", src)
+			return nil
+		},
+	}
+	return pinCmd
+}
+
+func NewCmdUnpin() *cobra.Command {
+	var unpinCmd = &cobra.Command{
+		Use:   "unpin [image ref]",
+		Short: "Allow removing image protected with pin",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			src := TheAppConfig.Override(args[0])
+			if err := transporter.Unpin(src, transporter.WithImagesPath(TheAppConfig.ImagesDirectory)); err != nil {
+				return fmt.Errorf("unable to unpin: %w", err)
+			}
+			fmt.Printf("unpinned %v\n", src)
+			return nil
+		},
+	}
+	return unpinCmd
+}
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"github.com/macvmio/geranos/pkg/provenance"
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/pflag"
+)
+
+// secretFlags are left out of provenance, which is public
+var secretFlags = map[string]bool{"identity-token": true}
+
+// parseProvenance returns options of --provenance, recording flags set on command line as invocation parameters.
+func parseProvenance(enabled bool, builderID string, flags *pflag.FlagSet) []transporter.Option {
+	if !enabled {
+		return nil
+	}
+	params := map[string]any{}
+	flags.Visit(func(f *pflag.Flag) {
+		if !secretFlags[f.Name] {
+			params[f.Name] = f.Value.String()
+		}
+	})
+	return []transporter.Option{transporter.WithProvenance(provenance.Build{
+		BuilderID:      builderID,
+		BuilderVersion: Version,
+		InvocationID:   provenance.DefaultInvocationID(),
+		Parameters:     params,
+	})}
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"errors"
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdProxy() *cobra.Command {
+	var flagListen string
+	var flagUpstream string
+	var flagContentStore bool
+
+	var proxyCmd = &cobra.Command{
+		Use:   "proxy",
+		Short: "Serve images of a registry, caching them locally",
+		Long: `Serves the OCI distribution API backed by the upstream registry, the one of the current context by default.
+Requested images are pulled into the local store first, and served from it to every following client,
+so an image is downloaded from upstream only once, and again only when its tag changes upstream.
+Images present locally are served when upstream is unavailable.`,
+		Example: `  geranos proxy --listen :5000 --upstream ghcr.io/macvmio
+  geranos pull lab-proxy.local:5000/macos-sonoma:14.4`,
+		Args: cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			upstream := flagUpstream
+			if upstream == "" {
+				upstream = TheAppConfig.CurrentRegistry()
+			}
+			if upstream == "" {
+				return errors.New("no upstream registry, use --upstream or select a context")
+			}
+			return transporter.Proxy(flagListen, upstream,
+				transporter.WithContext(cmd.Context()),
+				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
+				transporter.WithVerbose(TheAppConfig.Verbose),
+				transporter.WithContentStore(flagContentStore),
+				transporter.WithCandidateRoots(TheAppConfig.StoreDirectories()...))
+		},
+	}
+
+	proxyCmd.Flags().StringVar(&flagListen, "listen", ":5000", "Address to listen on")
+	proxyCmd.Flags().StringVar(&flagUpstream, "upstream", "",
+		"Registry, optionally with namespace, to pull images from (default registry of the current context)")
+	proxyCmd.Flags().BoolVar(&flagContentStore, "content-store", false,
+		"Keep segments of pulled images once in a content store, see pull --content-store")
+
+	return proxyCmd
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/macvmio/geranos/pkg/layout"
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseAge parses duration like time.ParseDuration, accepting also whole days like 30d.
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age '%v'", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid age '%v', expected duration like 12h or 30d", s)
+	}
+	return d, nil
+}
+
+func NewCmdPrune() *cobra.Command {
+	var (
+		flagDryRun       bool
+		flagOlderThan    string
+		flagKeepLast     int
+		flagMaxStoreSize string
+	)
+
+	var pruneCmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Remove local images by age, count per repository, or total size",
+		Long: `Removes local images not used for a long time, all but the most recently used images of every repository,
+or the least recently used images until the rest fits into given size. Images are used when pulled, pushed, cloned or rehashed.`,
+		Args: cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			policy := layout.PrunePolicy{KeepLast: flagKeepLast}
+			if flagOlderThan != "" {
+				age, err := parseAge(flagOlderThan)
+				if err != nil {
+					return err
+				}
+				policy.OlderThan = age
+			}
+			if flagMaxStoreSize != "" {
+				size, ok := parseByteSize(flagMaxStoreSize)
+				if !ok {
+					return fmt.Errorf("invalid store size '%v', expected size like 500G", flagMaxStoreSize)
+				}
+				policy.MaxStoreSize = size
+			}
+			return transporter.Prune(
+				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
+				transporter.WithDryRun(flagDryRun),
+				transporter.WithPrunePolicy(policy),
+			)
+		},
+	}
+
+	pruneCmd.Flags().BoolVar(&flagDryRun, "dry-run", false,
+		"Print which images would be removed, without removing them")
+
+	pruneCmd.Flags().StringVar(&flagOlderThan, "older-than", "",
+		"Remove images not used for longer than given age like 72h or 30d")
+
+	pruneCmd.Flags().IntVar(&flagKeepLast, "keep-last", 0,
+		"Keep only given number of most recently used images of every repository")
+
+	pruneCmd.Flags().StringVar(&flagMaxStoreSize, "max-store-size", "",
+		"Remove least recently used images until the rest takes at most given size like 200G")
+
+	return pruneCmd
+}
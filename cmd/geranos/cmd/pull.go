@@ -1,11 +1,112 @@
 package cmd
 
 import (
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/dirimage"
 	"github.com/macvmio/geranos/pkg/transporter"
 	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
+func parsePermissionFlags(metadataMode, dataMode, owner string) ([]transporter.Option, error) {
+	res := make([]transporter.Option, 0)
+	if metadataMode != "" {
+		mode, err := strconv.ParseUint(metadataMode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata mode '%v': %w", metadataMode, err)
+		}
+		res = append(res, transporter.WithMetadataFileMode(os.FileMode(mode)))
+	}
+	if dataMode != "" {
+		mode, err := strconv.ParseUint(dataMode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data mode '%v': %w", dataMode, err)
+		}
+		res = append(res, transporter.WithDataFileMode(os.FileMode(mode)))
+	}
+	if owner != "" {
+		uidStr, gidStr, found := strings.Cut(owner, ":")
+		uid, uidErr := strconv.Atoi(uidStr)
+		gid, gidErr := strconv.Atoi(gidStr)
+		if !found || uidErr != nil || gidErr != nil {
+			return nil, fmt.Errorf("invalid owner '%v', expected uid:gid", owner)
+		}
+		res = append(res, transporter.WithOwner(uid, gid))
+	}
+	return res, nil
+}
+
+// parsePlatform parses --platform like darwin/arm64, empty meaning none.
+func parsePlatform(s string) ([]transporter.Option, error) {
+	if s == "" {
+		return nil, nil
+	}
+	platform, err := v1.ParsePlatform(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid platform '%v': %w", s, err)
+	}
+	return []transporter.Option{transporter.WithPlatform(platform)}, nil
+}
+
+// parseDecoderLimits parses sizes of --max-decoder-window and --max-decoder-memory, empty meaning the default limit.
+func parseDecoderLimits(window, memory string) ([]transporter.Option, error) {
+	if window == "" && memory == "" {
+		return nil, nil
+	}
+	var limits [2]int64
+	for i, s := range []string{window, memory} {
+		if s == "" {
+			continue
+		}
+		value, ok := parseByteSize(s)
+		if !ok {
+			return nil, fmt.Errorf("invalid decoder limit '%v', expected size like 64M", s)
+		}
+		limits[i] = value
+	}
+	return []transporter.Option{transporter.WithDecoderLimits(uint64(limits[0]), uint64(limits[1]))}, nil
+}
+
 func NewCmdPull() *cobra.Command {
+	var (
+		flagBackend         string
+		flagPlatform        string
+		flagVerifySignature string
+		flagDecryptionKeys  []string
+		flagResume          bool
+		flagStaged          bool
+		flagInclude         []string
+		flagExclude         []string
+
+		flagStallTimeout time.Duration
+		flagStallRetry   bool
+		flagFsync        bool
+
+		flagMetadataMode string
+		flagDataMode     string
+		flagOwner        string
+		flagLimitRate    string
+
+		flagRetries         int
+		flagRetryMaxElapsed time.Duration
+		flagRateLimitWait   time.Duration
+		flagRangeResumes    int
+		flagDryRun          bool
+		flagForce           bool
+		flagPreallocate     bool
+		flagDirectIO        bool
+		flagPunchHoles      bool
+		flagContentStore    bool
+		flagSparseBlockSize string
+
+		flagMaxDecoderWindow string
+		flagMaxDecoderMemory string
+	)
+
 	var pullCmd = &cobra.Command{
 		Use:   "pull [image name]",
 		Short: "Pull an OCI image from a registry and extract the file.",
@@ -13,6 +114,12 @@ func NewCmdPull() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			src := TheAppConfig.Override(args[0])
+			if flagStaged && flagResume {
+				return fmt.Errorf("--staged can not be combined with --resume, staging directory is removed when pull fails")
+			}
+			if flagStallRetry && flagStallTimeout <= 0 {
+				return fmt.Errorf("--stall-retry needs --stall-timeout")
+			}
 			progress := make(chan transporter.ProgressUpdate)
 			defer close(progress)
 
@@ -21,11 +128,151 @@ func NewCmdPull() *cobra.Command {
 				transporter.WithContext(cmd.Context()),
 				transporter.WithVerbose(TheAppConfig.Verbose),
 				transporter.WithProgressChannel(progress),
+				transporter.WithResume(flagResume),
+				transporter.WithStaging(flagStaged),
+				transporter.WithFileFilter(flagInclude, flagExclude),
+				transporter.WithStallTimeout(flagStallTimeout, flagStallRetry),
+				transporter.WithFsync(flagFsync),
+				transporter.WithRateLimitWait(flagRateLimitWait),
+				transporter.WithRangeResume(flagRangeResumes),
+				transporter.WithDryRun(flagDryRun),
+				transporter.WithDiskSpaceCheck(!flagForce),
+				transporter.WithPreallocation(flagPreallocate),
+				transporter.WithDirectIO(flagDirectIO),
+				transporter.WithHolePunching(flagPunchHoles),
+				transporter.WithContentStore(flagContentStore),
+				transporter.WithCandidateRoots(TheAppConfig.StoreDirectories()...),
+				transporter.WithBackend(flagBackend),
+			}
+			permissionOpts, err := parsePermissionFlags(flagMetadataMode, flagDataMode, flagOwner)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, permissionOpts...)
+			rateLimit, err := parseRateLimit(flagLimitRate)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, transporter.WithMaxBandwidth(rateLimit))
+			retryPolicy := dirimage.DefaultRetryPolicy()
+			retryPolicy.MaxAttempts = flagRetries + 1
+			retryPolicy.MaxElapsed = flagRetryMaxElapsed
+			opts = append(opts, transporter.WithRetryPolicy(retryPolicy))
+			decoderLimits, err := parseDecoderLimits(flagMaxDecoderWindow, flagMaxDecoderMemory)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, decoderLimits...)
+			platformOpts, err := parsePlatform(flagPlatform)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, platformOpts...)
+			policyOpts, err := parseSignaturePolicy(flagVerifySignature)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, policyOpts...)
+			decryptionOpts, err := parseDecryption(flagDecryptionKeys)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, decryptionOpts...)
+			if flagSparseBlockSize != "" {
+				blockSize, ok := parseByteSize(flagSparseBlockSize)
+				if !ok || blockSize <= 0 {
+					return fmt.Errorf("invalid sparse block size '%v', expected size like 1M", flagSparseBlockSize)
+				}
+				opts = append(opts, transporter.WithSparseBlockSize(int(blockSize)))
 			}
 			go transporter.PrintProgress(progress)
 			return transporter.Pull(src, opts...)
 		},
 	}
 
+	pullCmd.Flags().StringVar(&flagBackend, "backend", "",
+		"Pull from object storage bucket of URL instead of the registry, see push --backend")
+
+	pullCmd.Flags().StringVar(&flagPlatform, "platform", "",
+		"Platform like darwin/arm64 of the variant pulled when the image is an index (default is the current platform)")
+
+	pullCmd.Flags().StringVar(&flagVerifySignature, "verify-signature", "",
+		"Refuse to pull images without signature by signer trusted for the repository in given policy file")
+
+	pullCmd.Flags().StringArrayVar(&flagDecryptionKeys, "decryption-key", nil,
+		"Private key in PEM file decrypting encrypted segments, can be repeated")
+
+	pullCmd.Flags().BoolVar(&flagResume, "resume", false,
+		"Persist progress in the image directory and continue an interrupted pull where it left off")
+
+	pullCmd.Flags().BoolVar(&flagStaged, "staged", false,
+		"Download into a staging directory and swap it into place only when the pull succeeds")
+
+	pullCmd.Flags().StringSliceVar(&flagInclude, "include", nil,
+		"Pull only files matching given glob pattern (can be repeated)")
+
+	pullCmd.Flags().StringSliceVar(&flagExclude, "exclude", nil,
+		"Skip files matching given glob pattern (can be repeated)")
+
+	pullCmd.Flags().DurationVar(&flagStallTimeout, "stall-timeout", 0,
+		"Report a stall when no bytes have moved for given duration, e.g. 1m (disabled by default)")
+
+	pullCmd.Flags().BoolVar(&flagStallRetry, "stall-retry", false,
+		"Interrupt and retry download of a segment which stalled, needs --stall-timeout")
+
+	pullCmd.Flags().BoolVar(&flagFsync, "fsync", false,
+		"Flush written files to stable storage, so the image survives sudden power loss")
+
+	pullCmd.Flags().StringVar(&flagLimitRate, "limit-rate", "",
+		"Limit download rate in bytes per second, with optional K, M or G suffix (e.g. 10M)")
+
+	pullCmd.Flags().IntVar(&flagRetries, "retries", dirimage.DefaultRetryPolicy().MaxAttempts-1,
+		"Retry download of a segment which failed with transient error up to given number of times")
+
+	pullCmd.Flags().DurationVar(&flagRetryMaxElapsed, "retry-max-elapsed", 0,
+		"Stop retrying a segment once given time has passed since its first attempt (0 means no limit)")
+
+	pullCmd.Flags().DurationVar(&flagRateLimitWait, "rate-limit-wait", 5*time.Minute,
+		"Longest time a request waits when the registry rate limits it (0 fails immediately)")
+
+	pullCmd.Flags().IntVar(&flagRangeResumes, "range-resumes", 5,
+		"Continue an interrupted blob download from where it stopped up to given number of times (0 restarts the segment)")
+
+	pullCmd.Flags().BoolVar(&flagDryRun, "dry-run", false,
+		"Print which segments would be cloned, which are present and which would be downloaded, without pulling")
+
+	pullCmd.Flags().BoolVar(&flagForce, "force", false,
+		"Pull even when the destination filesystem seems to lack free space for the image")
+
+	pullCmd.Flags().BoolVar(&flagPreallocate, "preallocate", false,
+		"Reserve disk blocks for whole files before downloading to avoid fragmentation (files are not sparse then)")
+
+	pullCmd.Flags().BoolVar(&flagDirectIO, "direct-io", false,
+		"Bypass the page cache when writing segments, so large pulls do not slow down other processes")
+
+	pullCmd.Flags().BoolVar(&flagPunchHoles, "punch-holes", false,
+		"Deallocate disk blocks of local files where the pulled image has zeros, reclaiming zeroed space")
+
+	pullCmd.Flags().BoolVar(&flagContentStore, "content-store", false,
+		"Keep segments of local images once in a content store and materialize images from it with reflinks")
+
+	pullCmd.Flags().StringVar(&flagSparseBlockSize, "sparse-block-size", "",
+		"Size of blocks compared with existing content of files like 1M, larger blocks cost less CPU on huge sparse images (default 64K)")
+
+	pullCmd.Flags().StringVar(&flagMetadataMode, "metadata-mode", "",
+		"Octal permissions of written manifest and config files (default 0644)")
+
+	pullCmd.Flags().StringVar(&flagDataMode, "data-mode", "",
+		"Octal permissions applied to image files (default 0644 for new files)")
+
+	pullCmd.Flags().StringVar(&flagOwner, "owner", "",
+		"Change owner of written files, in uid:gid format")
+
+	pullCmd.Flags().StringVar(&flagMaxDecoderWindow, "max-decoder-window", "",
+		"Reject segments needing zstd window larger than given size like 64M (default: window declared by the segment, up to 256M)")
+
+	pullCmd.Flags().StringVar(&flagMaxDecoderMemory, "max-decoder-memory", "",
+		"Limit memory used for decompressing each segment to given size like 256M (default 512M)")
+
 	return pullCmd
 }
@@ -3,14 +3,59 @@ package cmd
 import (
 	"fmt"
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/provenance"
+	"github.com/macvmio/geranos/pkg/signing"
 	"github.com/macvmio/geranos/pkg/transporter"
 	"github.com/spf13/cobra"
+	"os"
+	"runtime"
+	"time"
 )
 
 func NewCmdPush() *cobra.Command {
 	var (
-		flagMountedReference  string // Declares a variable to hold the value of the "--mountable-image" flag.
-		flagConcurrentWorkers int
+		flagBackend            string
+		flagMountedReference   string // Declares a variable to hold the value of the "--mountable-image" flag.
+		flagConcurrentWorkers  int
+		flagExistenceWorkers   int
+		flagTOC                bool
+		flagPreserveMetadata   bool
+		flagXattrs             bool
+		flagRecursive          bool
+		flagExclude            []string
+		flagElideZeros         bool
+		flagLimitRate          string
+		flagRateLimitWait      time.Duration
+		flagDryRun             bool
+		flagHashWorkers        int
+		flagDigestCache        bool
+		flagIncremental        bool
+		flagChunkSizeRules     []string
+		flagMaxSegments        int
+		flagDigestAlgorithm    string
+		flagCompression        string
+		flagCompressionRules   []string
+		flagSkipIncompressible bool
+		flagCompressionLevel   int
+		flagZstdWindow         string
+		flagSeekableZstd       string
+		flagEncoderConcurrency int
+		flagCompressionCPUs    int
+		flagZstdDictionary     string
+		flagStream             bool
+		flagUploadChunkSize    string
+		flagPlatform           string
+		flagSign               bool
+		flagKey                string
+		flagIdentityToken      string
+		flagFulcioURL          string
+		flagRekorURL           string
+		flagTlogUpload         bool
+		flagProvenance         bool
+		flagBuilderID          string
+		flagEncryptionKeys     []string
 	)
 
 	var pushCmd = &cobra.Command{
@@ -24,6 +69,109 @@ func NewCmdPush() *cobra.Command {
 				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
 				transporter.WithContext(cmd.Context()),
 				transporter.WithWorkersCount(flagConcurrentWorkers),
+				transporter.WithExistenceCheckWorkers(flagExistenceWorkers),
+				transporter.WithTOC(flagTOC),
+				transporter.WithFileMetadata(flagPreserveMetadata || flagXattrs, flagXattrs),
+				transporter.WithRecursive(flagRecursive),
+				transporter.WithExcludePatterns(flagExclude...),
+				transporter.WithZeroElision(flagElideZeros),
+				transporter.WithRateLimitWait(flagRateLimitWait),
+				transporter.WithDryRun(flagDryRun),
+				transporter.WithHashWorkersCount(flagHashWorkers),
+				transporter.WithDigestCache(flagDigestCache),
+				transporter.WithIncrementalRehash(flagIncremental),
+				transporter.WithAdaptiveChunkSize(flagMaxSegments),
+				transporter.WithDigestAlgorithm(flagDigestAlgorithm),
+				transporter.WithStreamingPush(flagStream),
+			}
+
+			rateLimit, err := parseRateLimit(flagLimitRate)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			opts = append(opts, transporter.WithMaxBandwidth(rateLimit))
+
+			chunkSizeRules, err := parseChunkSizeRules(flagChunkSizeRules)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			opts = append(opts, transporter.WithChunkSizeRules(chunkSizeRules...))
+
+			compression, err := filesegment.ParseCompression(flagCompression)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			compressionRules, err := parseCompressionRules(flagCompressionRules)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			opts = append(opts, transporter.WithCompression(compression, compressionRules...))
+			if flagCompressionLevel != 0 {
+				opts = append(opts, transporter.WithCompressionLevel(flagCompressionLevel))
+			}
+			if flagEncoderConcurrency > 0 {
+				opts = append(opts, transporter.WithEncoderConcurrency(flagEncoderConcurrency))
+			}
+			if flagCompressionCPUs > 0 {
+				opts = append(opts, transporter.WithCompressionCPUBudget(flagCompressionCPUs))
+			}
+			if flagZstdWindow != "" {
+				window, ok := parseByteSize(flagZstdWindow)
+				if !ok {
+					fmt.Printf("invalid zstd window size '%v'\n", flagZstdWindow)
+					return
+				}
+				opts = append(opts, transporter.WithZstdWindowSize(int(window)))
+			}
+			if flagSeekableZstd != "" {
+				frameSize, ok := parseByteSize(flagSeekableZstd)
+				if !ok {
+					fmt.Printf("invalid seekable zstd frame size '%v'\n", flagSeekableZstd)
+					return
+				}
+				opts = append(opts, transporter.WithSeekableZstd(int(frameSize)))
+			}
+			if flagZstdDictionary != "" {
+				maxFileSize, ok := parseByteSize(flagZstdDictionary)
+				if !ok {
+					fmt.Printf("invalid zstd dictionary file size '%v'\n", flagZstdDictionary)
+					return
+				}
+				opts = append(opts, transporter.WithZstdDictionary(maxFileSize))
+			}
+			platformOpts, err := parsePlatform(flagPlatform)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			opts = append(opts, platformOpts...)
+			signingOpts, err := parseSigning(flagSign, flagKey, flagIdentityToken, flagFulcioURL, flagRekorURL, flagTlogUpload)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			opts = append(opts, signingOpts...)
+			opts = append(opts, parseProvenance(flagProvenance, flagBuilderID, cmd.Flags())...)
+			encryptionOpts, err := parseEncryption(flagEncryptionKeys)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			opts = append(opts, encryptionOpts...)
+			if flagUploadChunkSize != "" {
+				chunkSize, ok := parseByteSize(flagUploadChunkSize)
+				if !ok {
+					fmt.Printf("invalid upload chunk size '%v'\n", flagUploadChunkSize)
+					return
+				}
+				opts = append(opts, transporter.WithUploadChunkSize(chunkSize))
+			}
+			if flagSkipIncompressible {
+				opts = append(opts, transporter.WithSkipIncompressible(dirimage.DefaultMinCompressionSavings))
 			}
 
 			// Since mountedReference is directly bound to the flag,
@@ -37,15 +185,21 @@ func NewCmdPush() *cobra.Command {
 				opts = append(opts, transporter.WithMountedReference(ref))
 			}
 
-			err := transporter.Push(src, opts...)
+			if flagBackend != "" {
+				opts = append(opts, transporter.WithBackend(flagBackend))
+			}
+			err = transporter.Push(src, opts...)
 			if err != nil {
 				fmt.Println(err)
-			} else {
+			} else if !flagDryRun {
 				fmt.Println("push has completed successfully")
 			}
 		},
 	}
 
+	pushCmd.Flags().StringVar(&flagBackend, "backend", "",
+		"Push to object storage bucket of URL instead of the registry, like s3://bucket/prefix, gs://bucket/prefix, azblob://account/container or file:///path")
+
 	// Binding the "--mountable-image" flag directly to the mountedReference variable.
 	pushCmd.Flags().StringVar(&flagMountedReference, "mount", "",
 		"Specifies an image reference that can be mounted to avoid uploading layers that exists in the registry")
@@ -53,5 +207,116 @@ func NewCmdPush() *cobra.Command {
 	pushCmd.Flags().IntVar(&flagConcurrentWorkers, "concurrent-workers", 8,
 		"Specifies number of concurrent workers to use when uploading layers to a registry")
 
+	pushCmd.Flags().IntVar(&flagExistenceWorkers, "existence-check-workers", 32,
+		"Specifies number of concurrent requests checking which layers exist in the registry before uploading")
+
+	pushCmd.Flags().IntVar(&flagHashWorkers, "hash-workers", runtime.NumCPU(),
+		"Specifies number of segments hashed and compressed concurrently before uploading")
+
+	pushCmd.Flags().BoolVar(&flagDigestCache, "digest-cache", false,
+		"Remember segment digests next to the image, so unchanged files are not hashed again on the next push")
+
+	pushCmd.Flags().BoolVar(&flagIncremental, "incremental", false,
+		"Hash only files modified since the image was last pulled or pushed, reusing the local manifest for the rest")
+
+	pushCmd.Flags().StringArrayVar(&flagChunkSizeRules, "chunk-size", nil,
+		"Split files matching pattern into segments of given size, like '*.img=128M' or '*.json=whole' (can be repeated, first match wins)")
+
+	pushCmd.Flags().IntVar(&flagMaxSegments, "max-segments-per-file", 0,
+		"Grow segment size of large files so none is split into more segments (0 keeps fixed segment size)")
+
+	pushCmd.Flags().StringVar(&flagDigestAlgorithm, "digest-algorithm", filesegment.DefaultDigestAlgorithm,
+		"Algorithm of segment digests: sha256 or sha512")
+
+	pushCmd.Flags().StringVar(&flagCompression, "compression", string(filesegment.CompressionZstd),
+		"Compression of segments: zstd, gzip or none")
+
+	pushCmd.Flags().StringArrayVar(&flagCompressionRules, "compression-rule", nil,
+		"Compress files matching pattern differently, like '*.qcow2=none' (can be repeated, first match wins)")
+
+	pushCmd.Flags().BoolVar(&flagSkipIncompressible, "skip-incompressible", false,
+		"Upload segments uncompressed when compressing a sample of them saves less than 5%")
+
+	pushCmd.Flags().IntVar(&flagCompressionLevel, "compression-level", 0,
+		"Level of zstd compression from 1 (the default, fastest) to 22, higher levels trade CPU time for smaller uploads")
+
+	pushCmd.Flags().IntVar(&flagEncoderConcurrency, "encoder-concurrency", 0,
+		"Number of goroutines compressing each segment, 1 by default")
+
+	pushCmd.Flags().IntVar(&flagCompressionCPUs, "compression-cpus", 0,
+		"Number of CPUs to spread among segments compressed at the same time, e.g. all of them with $(nproc)")
+
+	pushCmd.Flags().StringVar(&flagZstdWindow, "zstd-window", "",
+		"Window of zstd compression like 128M, finding repetitions further apart in large segments (power of two up to 512M)")
+
+	pushCmd.Flags().StringVar(&flagSeekableZstd, "seekable-zstd", "",
+		"Compress segments as seekable zstd with frames of given size like 1M, so byte ranges can be fetched on their own")
+
+	pushCmd.Flags().BoolVar(&flagStream, "stream", false,
+		"Hash segments while uploading them instead of before, reading each of them from disk once")
+
+	pushCmd.Flags().StringVar(&flagPlatform, "platform", "",
+		"Push the image as variant of platform like darwin/arm64 into image index of the tag, replacing previous variant of the platform")
+
+	pushCmd.Flags().BoolVar(&flagSign, "sign", false,
+		"Sign the pushed image like cosign does, with --key or keylessly with certificate for OIDC identity, and attach the signature as referrer")
+
+	pushCmd.Flags().StringVar(&flagKey, "key", "",
+		"Private key signing the image, encrypted keys generated by cosign are decrypted with password from COSIGN_PASSWORD")
+
+	pushCmd.Flags().StringVar(&flagIdentityToken, "identity-token", os.Getenv("SIGSTORE_ID_TOKEN"),
+		"OIDC identity token keyless signatures are issued for, SIGSTORE_ID_TOKEN by default")
+
+	pushCmd.Flags().StringVar(&flagFulcioURL, "fulcio-url", signing.DefaultFulcioURL,
+		"Fulcio certificate authority issuing certificates of keyless signatures")
+
+	pushCmd.Flags().StringVar(&flagRekorURL, "rekor-url", signing.DefaultRekorURL,
+		"Rekor transparency log signatures are recorded in")
+
+	pushCmd.Flags().BoolVar(&flagTlogUpload, "tlog-upload", true,
+		"Record signatures in the transparency log")
+
+	pushCmd.Flags().BoolVar(&flagProvenance, "provenance", false,
+		"Attach SLSA provenance of the image with builder, hash of the directory and flags of push, signed when --sign is set")
+
+	pushCmd.Flags().StringVar(&flagBuilderID, "builder-id", provenance.DefaultBuilderID(),
+		"URI of the builder recorded in provenance, the GitHub Actions workflow when running in one")
+
+	pushCmd.Flags().StringArrayVar(&flagEncryptionKeys, "encryption-key", nil,
+		"Encrypt segments in ocicrypt format for recipient with public key or certificate in PEM file, can be repeated")
+
+	pushCmd.Flags().StringVar(&flagUploadChunkSize, "upload-chunk-size", "",
+		"Upload layers in chunks of given size like 256M, resuming interrupted pushes from the last chunk (tuned to measured throughput by default)")
+
+	pushCmd.Flags().StringVar(&flagZstdDictionary, "zstd-dictionary", "",
+		"Compress files up to given size like 64K with zstd dictionary trained on them and shipped in the manifest")
+
+	pushCmd.Flags().BoolVar(&flagTOC, "toc", false,
+		"Append geranos table of contents to uploaded layers, it is not readable by zstd:chunked or eStargz clients")
+
+	pushCmd.Flags().BoolVar(&flagPreserveMetadata, "preserve-metadata", false,
+		"Record file modes and modification times, so they are restored on pull")
+
+	pushCmd.Flags().BoolVar(&flagXattrs, "xattrs", false,
+		"Record extended attributes of files as well (implies --preserve-metadata)")
+
+	pushCmd.Flags().BoolVar(&flagRecursive, "recursive", false,
+		"Include subdirectories, so nested bundle layouts with empty directories round-trip")
+
+	pushCmd.Flags().StringSliceVar(&flagExclude, "exclude", nil,
+		"Glob patterns of files to leave out of the image, matched against relative path or base name (e.g. '*.lock')")
+
+	pushCmd.Flags().BoolVar(&flagElideZeros, "elide-zeros", false,
+		"Upload segments containing only zeros as empty blobs, which saves time and bandwidth for sparse disks")
+
+	pushCmd.Flags().StringVar(&flagLimitRate, "limit-rate", "",
+		"Limit upload rate in bytes per second, with optional K, M or G suffix (e.g. 10M)")
+
+	pushCmd.Flags().DurationVar(&flagRateLimitWait, "rate-limit-wait", 5*time.Minute,
+		"Longest time a request waits when the registry rate limits it (0 fails immediately)")
+
+	pushCmd.Flags().BoolVar(&flagDryRun, "dry-run", false,
+		"Hash the image and print how many bytes would be uploaded and how many are already in the registry, without pushing")
+
 	return pushCmd
 }
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseByteSize parses number of bytes, optionally with K, M or G suffix (powers of 1024).
+func parseByteSize(s string) (int64, bool) {
+	multiplier := int64(1)
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	switch {
+	case strings.HasSuffix(number, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(number, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(number, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		number = number[:len(number)-1]
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, false
+	}
+	return int64(value * float64(multiplier)), true
+}
+
+// parseRateLimit parses transfer rate in bytes per second, optionally with K, M or G suffix (powers of 1024)
+// like curl's --limit-rate. Empty string means no limit.
+func parseRateLimit(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	value, ok := parseByteSize(s)
+	if !ok {
+		return 0, fmt.Errorf("invalid rate limit '%v', expected bytes per second like 500K or 10M", s)
+	}
+	return value, nil
+}
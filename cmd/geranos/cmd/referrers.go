@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+	"strings"
+)
+
+// parseArtifactFiles parses --file values like path or path:media-type.
+func parseArtifactFiles(values []string) []transporter.ArtifactFile {
+	res := make([]transporter.ArtifactFile, 0, len(values))
+	for _, v := range values {
+		path, mediaType, _ := strings.Cut(v, ":")
+		res = append(res, transporter.ArtifactFile{Path: path, MediaType: mediaType})
+	}
+	return res
+}
+
+// parseAnnotations parses --annotation values like key=value.
+func parseAnnotations(values []string) (map[string]string, error) {
+	res := make(map[string]string, len(values))
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid annotation '%v', expected key=value", v)
+		}
+		res[key] = value
+	}
+	return res, nil
+}
+
+func NewCmdReferrers() *cobra.Command {
+	var referrersCmd = &cobra.Command{
+		Use:       "referrers",
+		Short:     "Attach artifacts to remote images and list them",
+		Long:      `Attach artifacts like signatures, SBOMs or metadata to images in the registry, and list artifacts attached to them.`,
+		ValidArgs: []string{"attach", "ls"},
+		Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+		Run: func(cmd *cobra.Command, args []string) {
+		},
+	}
+
+	var (
+		flagArtifactType string
+		flagFiles        []string
+		flagAnnotations  []string
+		flagJSON         bool
+	)
+
+	var attachCmd = &cobra.Command{
+		Use:   "attach <ref>",
+		Short: "Attach artifact to a remote image",
+		Long: `Pushes artifact of given type with the files, referring to the image with the OCI 1.1 referrers API.
+Registries without the API list the artifact in the index tagged with digest of the image.`,
+		Example: `  geranos referrers attach --artifact-type application/spdx+json --file sbom.json:application/spdx+json macos-sonoma:14`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ref := TheAppConfig.Override(args[0])
+			annotations, err := parseAnnotations(flagAnnotations)
+			if err != nil {
+				return err
+			}
+			digest, err := transporter.Attach(ref, flagArtifactType, parseArtifactFiles(flagFiles), annotations,
+				transporter.WithContext(cmd.Context()))
+			if err != nil {
+				return err
+			}
+			fmt.Printf("attached %v to %v\n", digest, ref)
+			return nil
+		},
+	}
+	attachCmd.Flags().StringVar(&flagArtifactType, "artifact-type", "", "Media type of the artifact, e.g. application/spdx+json")
+	attachCmd.Flags().StringArrayVar(&flagFiles, "file", nil,
+		"File attached as layer of the artifact, optionally with media type like sbom.json:application/spdx+json (can be repeated)")
+	attachCmd.Flags().StringArrayVar(&flagAnnotations, "annotation", nil,
+		"Annotation of the artifact in key=value format (can be repeated)")
+	_ = attachCmd.MarkFlagRequired("artifact-type")
+
+	var listCmd = &cobra.Command{
+		Use:   "ls <ref>",
+		Short: "List artifacts attached to a remote image",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ref := TheAppConfig.Override(args[0])
+			referrers, err := transporter.ListReferrers(ref, flagArtifactType, transporter.WithContext(cmd.Context()))
+			if err != nil {
+				return err
+			}
+			if flagJSON {
+				out, err := json.MarshalIndent(referrers, "", "\t")
+				if err != nil {
+					return fmt.Errorf("unable to marshal result to json: %w", err)
+				}
+				fmt.Println(string(out))
+				return nil
+			}
+			for _, r := range referrers {
+				fmt.Printf("%v\t%v\t%d\n", r.Digest, r.ArtifactType, r.Size)
+			}
+			return nil
+		},
+	}
+	listCmd.Flags().StringVar(&flagArtifactType, "artifact-type", "", "List only artifacts of the media type")
+	listCmd.Flags().BoolVar(&flagJSON, "json", false, "Print machine-readable result")
+
+	referrersCmd.AddCommand(attachCmd)
+	referrersCmd.AddCommand(listCmd)
+	return referrersCmd
+}
@@ -1,10 +1,8 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
-	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/name"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/macvmio/geranos/pkg/transporter"
 	"github.com/spf13/cobra"
 )
@@ -15,59 +13,61 @@ func NewCmdRemoteRepos() *cobra.Command {
 		Use:       "remote",
 		Short:     "Manipulate remote repositories",
 		Long:      `Manipulate remote repositories`,
-		ValidArgs: []string{"catalog", "images", "tag"},
+		ValidArgs: []string{"repos", "ls", "tag", "rm"},
 		Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
 		Run: func(cmd *cobra.Command, args []string) {
 		},
 	}
 
+	var flagRegexp, flagSemver string
+	var flagJSON bool
+	addFilterFlags := func(c *cobra.Command, what string) {
+		c.Flags().StringVar(&flagRegexp, "regexp", "", "List only "+what+" matching the regular expression")
+		c.Flags().StringVar(&flagSemver, "semver", "",
+			"List only "+what+" which are semantic versions satisfying the constraint, e.g. '>=14, <15', sorted by version")
+		c.Flags().BoolVar(&flagJSON, "json", false, "Print machine-readable result")
+	}
+
 	var catalogCmd = &cobra.Command{
-		Use:   "catalog [remote name]",
-		Short: "List remote repositories",
-		Long:  `List remote repositories`,
-		Args:  cobra.MaximumNArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
+		Use:     "repos [remote name]",
+		Aliases: []string{"catalog"},
+		Short:   "List remote repositories",
+		Long:    `List repositories of the remote registry, the current one by default. The registry must support the catalog API.`,
+		Args:    cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) == 0 {
 				args = append(args, TheAppConfig.CurrentRegistry())
 			}
-			reg, err := name.NewRegistry(args[0])
+			repos, err := transporter.ListRemoteRepos(args[0],
+				transporter.NameFilter{Regexp: flagRegexp, Semver: flagSemver},
+				transporter.WithContext(cmd.Context()))
 			if err != nil {
-				fmt.Println("Error parsing registry name:", err)
-				return
-			}
-			catalog, err := remote.Catalog(cmd.Context(), reg, remote.WithAuthFromKeychain(authn.DefaultKeychain))
-			if err != nil {
-				fmt.Println("Error fetching catalog:", err)
-				return
-			}
-			for _, repo := range catalog {
-				fmt.Println(repo)
+				return err
 			}
+			return printNames(repos, flagJSON, map[string]any{"registry": args[0], "repositories": repos})
 		},
 	}
+	addFilterFlags(catalogCmd, "repositories")
 
 	var listImages = &cobra.Command{
-		Use:   "images [full qualified repo name]",
-		Short: "List remote images in a remote repository",
-		Long:  `List remote images in a remote repository`,
-		Args:  cobra.ExactArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
-			args[0] = TheAppConfig.Override(args[0])
-			repo, err := name.NewRepository(args[0])
+		Use:     "ls [full qualified repo name]",
+		Aliases: []string{"images"},
+		Short:   "List remote images in a remote repository",
+		Long:    `List tags of images in a remote repository`,
+		Example: `  geranos remote ls --semver '>=14.4' macos-sonoma`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			repo := TheAppConfig.Override(args[0])
+			tags, err := transporter.ListRemoteTags(repo,
+				transporter.NameFilter{Regexp: flagRegexp, Semver: flagSemver},
+				transporter.WithContext(cmd.Context()))
 			if err != nil {
-				fmt.Println("Error parsing registry name:", err)
-				return
-			}
-			images, err := remote.List(repo, remote.WithAuthFromKeychain(authn.DefaultKeychain))
-			if err != nil {
-				fmt.Println("Error fetching repos:", err)
-				return
-			}
-			for _, image := range images {
-				fmt.Println(image)
+				return err
 			}
+			return printNames(tags, flagJSON, map[string]any{"name": repo, "tags": tags})
 		},
 	}
+	addFilterFlags(listImages, "tags")
 
 	var tagImage = &cobra.Command{
 		Use:   "tag <srcRef> <dstRef>",
@@ -84,8 +84,48 @@ func NewCmdRemoteRepos() *cobra.Command {
 		},
 	}
 
+	var flagDigest bool
+	var removeImage = &cobra.Command{
+		Use:     "rm <ref>",
+		Aliases: []string{"delete"},
+		Short:   "Delete remote tag or manifest",
+		Long: `Deletes the tag, or manifest given by digest, from the registry. With --digest the manifest the tag points at
+is deleted, with every other tag of it, for registries which do not support deleting tags alone.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ref := TheAppConfig.Override(args[0])
+			digest, err := transporter.RemoveRemotely(ref, flagDigest, transporter.WithContext(cmd.Context()))
+			if err != nil {
+				return err
+			}
+			if flagDigest {
+				fmt.Printf("deleted %v (%v) and its tags\n", ref, digest)
+			} else {
+				fmt.Printf("deleted %v (%v)\n", ref, digest)
+			}
+			return nil
+		},
+	}
+	removeImage.Flags().BoolVar(&flagDigest, "digest", false, "Delete the manifest the tag points at")
+
 	remoteReposCmd.AddCommand(catalogCmd)
 	remoteReposCmd.AddCommand(listImages)
 	remoteReposCmd.AddCommand(tagImage)
+	remoteReposCmd.AddCommand(removeImage)
 	return remoteReposCmd
 }
+
+func printNames(names []string, asJSON bool, v any) error {
+	if !asJSON {
+		for _, n := range names {
+			fmt.Println(n)
+		}
+		return nil
+	}
+	out, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return fmt.Errorf("unable to marshal result to json: %w", err)
+	}
+	fmt.Println(string(out))
+	return nil
+}
@@ -10,9 +10,9 @@ func NewCmdRemove() *cobra.Command {
 	var removeCommand = &cobra.Command{
 		Use:     "rm [image ref]",
 		Short:   "Remove locally stored image",
-		Long:    ``,
+		Long:    `Removes the reference of a locally stored image. Content shared with images tagged from it stays with them.`,
 		Args:    cobra.ExactArgs(1),
-		Aliases: []string{"delete"},
+		Aliases: []string{"delete", "untag"},
 		Run: func(cmd *cobra.Command, args []string) {
 			src := TheAppConfig.Override(args[0])
 			opts := []transporter.Option{
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdRepair() *cobra.Command {
+	var repairCmd = &cobra.Command{
+		Use:   "repair [image name]",
+		Short: "Re-download only corrupted segments of a local image.",
+		Long:  `Compares local segments against the remote manifest and fetches only the segments whose digests do not match.`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			src := TheAppConfig.Override(args[0])
+			progress := make(chan transporter.ProgressUpdate)
+			defer close(progress)
+
+			go transporter.PrintProgress(progress)
+			res, err := transporter.Repair(src,
+				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
+				transporter.WithContext(cmd.Context()),
+				transporter.WithVerbose(TheAppConfig.Verbose),
+				transporter.WithProgressChannel(progress))
+			if err != nil {
+				return err
+			}
+			fmt.Printf("repaired %d of %d segments\n", res.SegmentsRepaired, res.SegmentsChecked)
+			return nil
+		},
+	}
+
+	return repairCmd
+}
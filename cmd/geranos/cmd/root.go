@@ -39,20 +39,45 @@ It relies on sparse files and Copy-on-Write filesystem features to optimize disk
 	// Bind the verbose flag to Viper
 	viper.BindPFlag("verbose", rootCmd.PersistentFlags().Lookup("verbose"))
 
+	// --store, or GERANOS_STORE, selects the images directory of a store configured in stores
+	rootCmd.PersistentFlags().String("store", "", "name of the configured store to work with (default is images_directory)")
+	viper.BindPFlag("store", rootCmd.PersistentFlags().Lookup("store"))
+
 	rootCmd.AddCommand(
 		NewCmdPull(),
 		NewCmdPush(),
 		NewCmdInspect(),
 		NewCmdList(),
 		NewCmdAdopt(),
+		NewCmdExport(),
+		NewCmdImport(),
+		NewCmdSave(),
+		NewCmdLoad(),
 		NewCmdClone(),
+		NewCmdTag(),
+		NewCmdMove(),
 		NewCmdRemove(),
 		NewCmdAuthLogin(),
 		NewCmdAuthLogout(),
 		NewCmdVersion(),
 		NewCmdRemoteRepos(),
+		NewCmdCopy(),
+		NewCmdMirror(),
+		NewCmdWatch(),
+		NewCmdProxy(),
+		NewCmdServe(),
+		NewCmdReferrers(),
 		NewCmdContext(),
 		NewCmdRehash(),
+		NewCmdVerify(),
+		NewCmdRepair(),
+		NewCmdGC(),
+		NewCmdPrune(),
+		NewCmdPin(),
+		NewCmdUnpin(),
+		NewCmdDiskUsage(),
+		NewCmdStore(),
+		NewCmdSelfUpdate(),
 	)
 
 	return rootCmd
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"strings"
+)
+
+// parseChunkSizeRules parses rules like "*.img=64M" or "*.json=whole", the latter keeping whole file in one segment.
+func parseChunkSizeRules(values []string) ([]dirimage.ChunkSizeRule, error) {
+	res := make([]dirimage.ChunkSizeRule, 0, len(values))
+	for _, v := range values {
+		pattern, size, ok := strings.Cut(v, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid chunk size rule '%v', expected pattern=size like *.img=64M", v)
+		}
+		rule := dirimage.ChunkSizeRule{Pattern: pattern, ChunkSize: dirimage.WholeFileChunkSize}
+		if size != "whole" {
+			chunkSize, ok := parseByteSize(size)
+			if !ok || chunkSize == 0 {
+				return nil, fmt.Errorf("invalid chunk size '%v' in rule '%v'", size, v)
+			}
+			rule.ChunkSize = chunkSize
+		}
+		res = append(res, rule)
+	}
+	return res, nil
+}
+
+// parseCompressionRules parses rules like "*.qcow2=none".
+func parseCompressionRules(values []string) ([]dirimage.CompressionRule, error) {
+	res := make([]dirimage.CompressionRule, 0, len(values))
+	for _, v := range values {
+		pattern, name, ok := strings.Cut(v, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid compression rule '%v', expected pattern=compression like *.qcow2=none", v)
+		}
+		c, err := filesegment.ParseCompression(name)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, dirimage.CompressionRule{Pattern: pattern, Compression: c})
+	}
+	return res, nil
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+)
+
+func NewCmdSave() *cobra.Command {
+	var flagOutput string
+
+	var saveCmd = &cobra.Command{
+		Use:   "save [image name]",
+		Short: "Save a local image to a tar archive",
+		Long: `Writes a local image to a single tar archive with its manifest, config and segment blobs, for moving it where
+no registry is reachable. The archive is written to standard output unless --output is given, and is never staged
+on disk, so it can be piped, e.g. through ssh into geranos load.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			src := TheAppConfig.Override(args[0])
+			var w io.Writer = os.Stdout
+			if flagOutput != "-" {
+				f, err := os.Create(flagOutput)
+				if err != nil {
+					return fmt.Errorf("unable to create archive: %w", err)
+				}
+				defer f.Close()
+				w = f
+			}
+			return transporter.Save(src, w,
+				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
+				transporter.WithContext(cmd.Context()))
+		},
+	}
+
+	saveCmd.Flags().StringVarP(&flagOutput, "output", "o", "-",
+		"File to write the archive to, - for standard output")
+
+	return saveCmd
+}
+
+func NewCmdLoad() *cobra.Command {
+	var flagInput string
+
+	var loadCmd = &cobra.Command{
+		Use:   "load [image name]",
+		Short: "Load a local image from a tar archive of save",
+		Long: `Writes the image of a tar archive written by save as a local image. The archive is read from standard input
+unless --input is given, and segments are written as they arrive, so it never has to be staged on disk.
+Segments matching local content are skipped, and images of all stores are clone candidates, like for pull.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dst := TheAppConfig.Override(args[0])
+			var r io.Reader = os.Stdin
+			if flagInput != "-" {
+				f, err := os.Open(flagInput)
+				if err != nil {
+					return fmt.Errorf("unable to open archive: %w", err)
+				}
+				defer f.Close()
+				r = f
+			}
+			return transporter.Load(r, dst,
+				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
+				transporter.WithContext(cmd.Context()),
+				transporter.WithCandidateRoots(TheAppConfig.StoreDirectories()...))
+		},
+	}
+
+	loadCmd.Flags().StringVarP(&flagInput, "input", "i", "-",
+		"File to read the archive from, - for standard input")
+
+	return loadCmd
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/selfupdate"
+	"github.com/spf13/cobra"
+	"log"
+)
+
+// SelfUpdateEndpoint and SelfUpdatePublicKey (base64 encoded ed25519 key) can be set via:
+// -ldflags="-X 'github.com/macvmio/geranos/cmd/geranos/cmd.SelfUpdateEndpoint=$URL'"
+// Released binaries have them set by .goreleaser.yml, channels are published by cmd/release-channel.
+// Both can be overridden in the self_update section of the config file.
+var (
+	SelfUpdateEndpoint  string
+	SelfUpdatePublicKey string
+)
+
+func NewCmdSelfUpdate() *cobra.Command {
+	var (
+		flagChannel string
+		flagCheck   bool
+		flagForce   bool
+	)
+
+	var selfUpdateCmd = &cobra.Command{
+		Use:   "self-update",
+		Short: "Update geranos to the latest release.",
+		Long:  `Checks the release endpoint for the latest version of the selected channel, verifies signature of the binary and atomically replaces the running executable.`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg := TheAppConfig.SelfUpdate
+			endpoint := SelfUpdateEndpoint
+			if cfg.Endpoint != "" {
+				endpoint = cfg.Endpoint
+			}
+			if endpoint == "" {
+				return errors.New("release endpoint is not configured, set self_update.endpoint in config")
+			}
+			channel := flagChannel
+			if !cmd.Flags().Changed("channel") && cfg.Channel != "" {
+				channel = cfg.Channel
+			}
+			opts := []selfupdate.Option{
+				selfupdate.WithChannel(channel),
+				selfupdate.WithForce(flagForce),
+			}
+			if TheAppConfig.Verbose {
+				opts = append(opts, selfupdate.WithLogFunction(log.Printf))
+			}
+
+			if flagCheck {
+				release, err := selfupdate.Check(cmd.Context(), endpoint, opts...)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("current version: %v, latest %v version: %v\n", Version, channel, release.Version)
+				return nil
+			}
+
+			publicKey := SelfUpdatePublicKey
+			if cfg.PublicKey != "" {
+				publicKey = cfg.PublicKey
+			}
+			if publicKey == "" {
+				return selfupdate.ErrNoPublicKey
+			}
+			key, err := selfupdate.ParsePublicKey(publicKey)
+			if err != nil {
+				return err
+			}
+			res, err := selfupdate.Update(cmd.Context(), endpoint, Version, append(opts, selfupdate.WithPublicKey(key))...)
+			if err != nil {
+				return err
+			}
+			if !res.Updated {
+				fmt.Printf("geranos is up to date (%v)\n", res.Version)
+				return nil
+			}
+			fmt.Printf("geranos updated from %v to %v\n", res.PreviousVersion, res.Version)
+			return nil
+		},
+	}
+
+	selfUpdateCmd.Flags().StringVar(&flagChannel, "channel", selfupdate.ChannelStable,
+		"Release channel to update from (stable or beta)")
+
+	selfUpdateCmd.Flags().BoolVar(&flagCheck, "check", false,
+		"Only print the latest available version")
+
+	selfUpdateCmd.Flags().BoolVar(&flagForce, "force", false,
+		"Reinstall even if the latest version is already installed, or downgrade to it when it is older")
+
+	return selfUpdateCmd
+}
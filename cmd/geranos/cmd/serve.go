@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdServe() *cobra.Command {
+	var flagListen string
+	var flagNamespace string
+	var flagReadWrite bool
+
+	var serveCmd = &cobra.Command{
+		Use:   "serve",
+		Short: "Serve local images to peers over the registry API",
+		Long: `Serves images of the local store with the OCI distribution API, so peers on the same network can pull them
+directly from this machine, without a central registry. Repositories are served without --namespace, which
+is the registry of the current context by default. With --read-write peers can push images into the store.
+There is no authentication, so by default only this machine can connect. Listen on other interfaces,
+e.g. --listen :5000, only on trusted networks.`,
+		Example: `  geranos serve --listen :5000
+  geranos pull workstation.local:5000/macos-sonoma:14.4`,
+		Args: cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			namespace := flagNamespace
+			if !cmd.Flags().Changed("namespace") {
+				namespace = TheAppConfig.CurrentRegistry()
+			}
+			return transporter.Serve(flagListen, namespace, flagReadWrite,
+				transporter.WithContext(cmd.Context()),
+				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
+				transporter.WithVerbose(TheAppConfig.Verbose),
+				transporter.WithCandidateRoots(TheAppConfig.StoreDirectories()...))
+		},
+	}
+
+	serveCmd.Flags().StringVar(&flagListen, "listen", "127.0.0.1:5000", "Address to listen on")
+	serveCmd.Flags().StringVar(&flagNamespace, "namespace", "",
+		"Prefix of local repositories omitted by peers, e.g. ghcr.io (default registry of the current context)")
+	serveCmd.Flags().BoolVar(&flagReadWrite, "read-write", false,
+		"Accept images pushed by peers")
+
+	return serveCmd
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/macvmio/geranos/pkg/signing"
+	"github.com/macvmio/geranos/pkg/transporter"
+	"os"
+)
+
+// parseSigning returns options of --sign: signing with private key at keyPath, decrypted with password from
+// COSIGN_PASSWORD, or keylessly with Fulcio certificate for OIDC identity token when there is no key.
+func parseSigning(sign bool, keyPath, identityToken, fulcioURL, rekorURL string, tlogUpload bool) ([]transporter.Option, error) {
+	if !sign {
+		return nil, nil
+	}
+	cfg := signing.Config{FulcioURL: fulcioURL}
+	if tlogUpload {
+		cfg.RekorURL = rekorURL
+	}
+	if keyPath != "" {
+		key, err := signing.LoadPrivateKey(keyPath, []byte(os.Getenv("COSIGN_PASSWORD")))
+		if err != nil {
+			return nil, fmt.Errorf("unable to load signing key: %w", err)
+		}
+		cfg.Key = key
+	} else {
+		if identityToken == "" {
+			return nil, fmt.Errorf("keyless signing needs --identity-token or SIGSTORE_ID_TOKEN, or sign with --key")
+		}
+		cfg.IdentityToken = identityToken
+	}
+	return []transporter.Option{transporter.WithSigning(cfg)}, nil
+}
+
+// parseSignaturePolicy returns options of --verify-signature with policy file at path, empty meaning no verification.
+func parseSignaturePolicy(path string) ([]transporter.Option, error) {
+	if path == "" {
+		return nil, nil
+	}
+	policy, err := signing.LoadPolicy(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load signature policy: %w", err)
+	}
+	return []transporter.Option{transporter.WithSignaturePolicy(policy)}, nil
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdStore() *cobra.Command {
+	storeCmd := &cobra.Command{
+		Use:   "store",
+		Short: "Manage stores of local images",
+		Long: `Stores are images directories configured in the stores list of the config file, besides images_directory,
+which is the store named default. Commands work with the store selected with --store or GERANOS_STORE,
+and images of all stores are clone candidates of pulled images.`,
+	}
+
+	var storeListCmd = &cobra.Command{
+		Use:     "list",
+		Short:   "List configured stores",
+		Args:    cobra.ExactArgs(0),
+		Aliases: []string{"ls"},
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Printf("%-20s %-8s %s\n", "NAME", "SELECTED", "DIRECTORY")
+			for _, s := range TheAppConfig.AllStores() {
+				selected := ""
+				if s.Directory == TheAppConfig.ImagesDirectory {
+					selected = "*"
+				}
+				fmt.Printf("%-20s %-8s %s\n", s.Name, selected, s.Directory)
+			}
+		},
+	}
+
+	var flagDryRun bool
+	var storeMigrateCmd = &cobra.Command{
+		Use:   "migrate",
+		Short: "Upgrade layout of the selected store",
+		Long: `Upgrades the selected store to the current layout version. Manifests and configs kept under legacy names are
+renamed, files of every image are verified against its manifest, and segments of verified images are added
+to the content store. Images failing verification keep the store at its layout version, repair or remove them
+and run migrate again.`,
+		Args: cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return transporter.Migrate(
+				transporter.WithContext(cmd.Context()),
+				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
+				transporter.WithVerbose(TheAppConfig.Verbose),
+				transporter.WithDryRun(flagDryRun),
+			)
+		},
+	}
+	storeMigrateCmd.Flags().BoolVar(&flagDryRun, "dry-run", false,
+		"Print what would be renamed and verify images, without changing anything")
+
+	storeCmd.AddCommand(storeListCmd, storeMigrateCmd)
+	return storeCmd
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdTag() *cobra.Command {
+	var tagCmd = &cobra.Command{
+		Use:   "tag [src ref] [dst ref]",
+		Short: "Locally tag image with another reference without copying it",
+		Long: `Creates reference dst for the locally stored image src, replacing image dst had before. Files are shared with
+Copy-on-Write, or hard linked on filesystems without it, so no content is copied. Use rm (or untag) to remove a reference.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			src := TheAppConfig.Override(args[0])
+			dst := TheAppConfig.Override(args[1])
+			err := transporter.TagLocally(src, dst,
+				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
+				transporter.WithContext(cmd.Context()),
+			)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("tagged %v as %v\n", src, dst)
+			return nil
+		},
+	}
+	return tagCmd
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+)
+
+func printVerificationResult(res *dirimage.VerificationResult) {
+	for _, f := range res.MissingFiles {
+		fmt.Printf("missing file %d: %v\n", f.File, f.Filename)
+	}
+	for _, m := range res.SizeMismatches {
+		fmt.Printf("size mismatch of file %d: %v: expected %d bytes, got %d\n", m.File, m.Filename, m.ExpectedSize, m.ActualSize)
+	}
+	for _, m := range res.MismatchedSegments {
+		fmt.Printf("corrupted %v: %v[%d-%d]\n", m.ID, m.Filename, m.Start, m.Stop)
+	}
+	fmt.Printf("checked %d segments of %v\n", res.SegmentsChecked, res.ManifestDigest)
+}
+
+func NewCmdVerify() *cobra.Command {
+	var flagJSON bool
+
+	var verifyCmd = &cobra.Command{
+		Use:   "verify [image name]",
+		Short: "Verify local image files against the stored manifest.",
+		Long:  `Re-hashes every segment of a local OCI image and reports corrupted ranges, missing files and size discrepancies.`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			src := TheAppConfig.Override(args[0])
+			res, err := transporter.Verify(src,
+				transporter.WithContext(cmd.Context()),
+				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
+				transporter.WithVerbose(TheAppConfig.Verbose))
+			if err != nil {
+				return err
+			}
+			if flagJSON {
+				out, err := json.MarshalIndent(res, "", "\t")
+				if err != nil {
+					return fmt.Errorf("unable to marshal result to json: %w", err)
+				}
+				fmt.Println(string(out))
+			} else {
+				printVerificationResult(res)
+			}
+			if !res.OK() {
+				return errors.New("image verification failed")
+			}
+			return nil
+		},
+	}
+
+	verifyCmd.Flags().BoolVar(&flagJSON, "json", false, "Print machine-readable result")
+
+	return verifyCmd
+}
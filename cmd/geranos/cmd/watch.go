@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/transporter"
+	"github.com/spf13/cobra"
+	"os"
+	"os/exec"
+	"time"
+)
+
+func NewCmdWatch() *cobra.Command {
+	var (
+		flagInterval time.Duration
+		flagExec     string
+		flagJSON     bool
+		flagStaged   bool
+	)
+
+	var watchCmd = &cobra.Command{
+		Use:   "watch [image ref or pattern]",
+		Short: "Pull new versions of an image as they are pushed",
+		Long: `Polls the registry for new digests of the image, or of every tag matching the pattern, like macos-sonoma:14.*,
+and pulls them as they appear, until interrupted. Every pulled digest and every error is printed as an event,
+and --exec runs a shell command for it with GERANOS_EVENT, GERANOS_REF, GERANOS_DIGEST and GERANOS_ERROR
+set in its environment.`,
+		Example: `  geranos watch --interval 10m --exec 'systemctl restart ci-runner' macos-sonoma:14.*`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if flagInterval <= 0 {
+				return fmt.Errorf("invalid interval %v", flagInterval)
+			}
+			pattern := TheAppConfig.Override(args[0])
+			onEvent := func(e transporter.WatchEvent) {
+				printWatchEvent(e, flagJSON)
+				if flagExec != "" {
+					runWatchHook(flagExec, e)
+				}
+			}
+			return transporter.Watch(pattern, flagInterval, onEvent,
+				transporter.WithImagesPath(TheAppConfig.ImagesDirectory),
+				transporter.WithContext(cmd.Context()),
+				transporter.WithVerbose(TheAppConfig.Verbose),
+				transporter.WithStaging(flagStaged),
+				transporter.WithCandidateRoots(TheAppConfig.StoreDirectories()...))
+		},
+	}
+
+	watchCmd.Flags().DurationVar(&flagInterval, "interval", 5*time.Minute,
+		"Time between checks of the registry")
+	watchCmd.Flags().StringVar(&flagExec, "exec", "",
+		"Shell command run for every event")
+	watchCmd.Flags().BoolVar(&flagJSON, "json", false,
+		"Print events as JSON lines")
+	watchCmd.Flags().BoolVar(&flagStaged, "staged", false,
+		"Pull into a staging directory and swap it into place only when the pull succeeds")
+
+	return watchCmd
+}
+
+func printWatchEvent(e transporter.WatchEvent, asJSON bool) {
+	if asJSON {
+		out, err := json.Marshal(e)
+		if err == nil {
+			fmt.Println(string(out))
+			return
+		}
+	}
+	ts := e.Time.Format(time.RFC3339)
+	if e.Type == transporter.WatchEventError {
+		fmt.Printf("%v %v: %v\n", ts, e.Ref, e.Error)
+	} else {
+		fmt.Printf("%v %v: %v %v\n", ts, e.Ref, e.Type, e.Digest)
+	}
+}
+
+func runWatchHook(command string, e transporter.WatchEvent) {
+	c := exec.Command("sh", "-c", command)
+	c.Stdout, c.Stderr = os.Stdout, os.Stderr
+	c.Env = append(os.Environ(),
+		"GERANOS_EVENT="+string(e.Type),
+		"GERANOS_REF="+e.Ref,
+		"GERANOS_DIGEST="+e.Digest,
+		"GERANOS_ERROR="+e.Error)
+	if err := c.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "hook for %v failed: %v\n", e.Ref, err)
+	}
+}
@@ -0,0 +1,78 @@
+// Command release-channel prints channel file of a release, <channel>.json read by geranos self-update,
+// with binaries signed by ed25519 key in SELF_UPDATE_SIGNING_KEY (base64 encoded private key or seed).
+//
+//	release-channel -version 1.2.0 -channel stable -url-prefix https://example.com/1.2.0/ darwin/arm64=dist/geranos_darwin_arm64
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/selfupdate"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func signingKey() (ed25519.PrivateKey, error) {
+	encoded := strings.TrimSpace(os.Getenv("SELF_UPDATE_SIGNING_KEY"))
+	if encoded == "" {
+		return nil, errors.New("SELF_UPDATE_SIGNING_KEY is not set")
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode signing key: %w", err)
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return key, nil
+	}
+	return nil, fmt.Errorf("invalid signing key size: %d", len(key))
+}
+
+func run(version, channel, urlPrefix string, binaries []string) error {
+	key, err := signingKey()
+	if err != nil {
+		return err
+	}
+	release := selfupdate.Release{Version: version, Assets: make(map[string]selfupdate.Asset, len(binaries))}
+	for _, b := range binaries {
+		platform, path, ok := strings.Cut(b, "=")
+		if !ok {
+			return fmt.Errorf("invalid binary '%v', expected os/arch=path", b)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		asset, err := selfupdate.NewAsset(key, version, channel, platform, urlPrefix+filepath.Base(path), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		release.Assets[platform] = asset
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(release)
+}
+
+func main() {
+	version := flag.String("version", "", "Version of the release, as printed by geranos version")
+	channel := flag.String("channel", selfupdate.ChannelStable, "Channel of the release (stable or beta)")
+	urlPrefix := flag.String("url-prefix", "", "URL binaries are downloaded from, followed by their filenames")
+	flag.Parse()
+	if *version == "" || *urlPrefix == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(*version, *channel, *urlPrefix, flag.Args()); err != nil {
+		log.Fatal(err)
+	}
+}
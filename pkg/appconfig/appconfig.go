@@ -12,11 +12,79 @@ type Context struct {
 	Password string `mapstructure:"password"`
 }
 
+type SelfUpdate struct {
+	Endpoint  string `mapstructure:"endpoint"`
+	Channel   string `mapstructure:"channel"`
+	PublicKey string `mapstructure:"public_key"`
+}
+
+// Store is an additional images directory, e.g. a fast scratch disk next to a big archive one.
+type Store struct {
+	Name      string `mapstructure:"name"`
+	Directory string `mapstructure:"directory"`
+}
+
+// DefaultStoreName is the name of the store of ImagesDirectory.
+const DefaultStoreName = "default"
+
 type Config struct {
-	ImagesDirectory string    `mapstructure:"images_directory"`
-	Contexts        []Context `mapstructure:"contexts"`
-	CurrentContext  string    `mapstructure:"current_context"`
-	Verbose         bool      `mapstructure:"verbose"`
+	ImagesDirectory string     `mapstructure:"images_directory"`
+	Stores          []Store    `mapstructure:"stores"`
+	Store           string     `mapstructure:"store"`
+	Contexts        []Context  `mapstructure:"contexts"`
+	CurrentContext  string     `mapstructure:"current_context"`
+	Verbose         bool       `mapstructure:"verbose"`
+	SelfUpdate      SelfUpdate `mapstructure:"self_update"`
+
+	// defaultDirectory is ImagesDirectory before SelectStore replaced it
+	defaultDirectory string
+}
+
+func (c *Config) defaultStoreDirectory() string {
+	if c.defaultDirectory != "" {
+		return c.defaultDirectory
+	}
+	return c.ImagesDirectory
+}
+
+// SelectStore makes ImagesDirectory the directory of the store named by Store, so commands work with it.
+// The original ImagesDirectory stays the store named DefaultStoreName.
+func (c *Config) SelectStore() error {
+	dir, err := c.StoreDirectory(c.Store)
+	if err != nil {
+		return err
+	}
+	c.defaultDirectory = c.defaultStoreDirectory()
+	c.ImagesDirectory = dir
+	return nil
+}
+
+// StoreDirectory returns directory of the store with given name, the original ImagesDirectory for DefaultStoreName
+// or empty name.
+func (c *Config) StoreDirectory(name string) (string, error) {
+	if name == "" || name == DefaultStoreName {
+		return c.defaultStoreDirectory(), nil
+	}
+	for _, s := range c.Stores {
+		if s.Name == name {
+			return s.Directory, nil
+		}
+	}
+	return "", fmt.Errorf("unknown store '%v'", name)
+}
+
+// AllStores returns all stores, the one of ImagesDirectory first, named DefaultStoreName.
+func (c *Config) AllStores() []Store {
+	return append([]Store{{Name: DefaultStoreName, Directory: c.defaultStoreDirectory()}}, c.Stores...)
+}
+
+// StoreDirectories returns directories of all stores, see AllStores.
+func (c *Config) StoreDirectories() []string {
+	res := make([]string, 0, len(c.Stores)+1)
+	for _, s := range c.AllStores() {
+		res = append(res, s.Directory)
+	}
+	return res
 }
 
 func (c *Config) findCurrentContext() (*Context, error) {
@@ -0,0 +1,18 @@
+package cas
+
+import "github.com/macvmio/geranos/pkg/sysenv"
+
+type Option func(s *Store)
+
+func WithFileSystem(fsys sysenv.FS) Option {
+	return func(s *Store) {
+		s.fs = fsys
+	}
+}
+
+// WithRangeCloneFunction replaces the function cloning ranges between blobs and files of images.
+func WithRangeCloneFunction(cloneRange func(src, dst string, srcOffset, dstOffset, length int64) error) Option {
+	return func(s *Store) {
+		s.cloneRange = cloneRange
+	}
+}
@@ -0,0 +1,219 @@
+package cas
+
+import (
+	"errors"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/duplicator"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"os"
+	"path/filepath"
+)
+
+// Store keeps raw content of segments once, in blob files named by their diff IDs. Image directories are
+// materialized by cloning blobs into files of the image, and their new segments are ingested by cloning them
+// back, so on filesystems with reflinks all images and the store share a single copy of every segment.
+// Elsewhere the content is copied, and the store costs as much space as the images it came from.
+type Store struct {
+	dir        string
+	fs         sysenv.FS
+	cloneRange func(src, dst string, srcOffset, dstOffset, length int64) error
+}
+
+func NewStore(dir string, opts ...Option) *Store {
+	s := &Store{
+		dir:        dir,
+		fs:         sysenv.OS,
+		cloneRange: duplicator.CloneRangeAt,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+// Dir returns the directory of the store.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Exists reports whether the store was created with Init.
+func (s *Store) Exists() bool {
+	info, err := s.fs.Stat(s.dir)
+	return err == nil && info.IsDir()
+}
+
+// Init creates the store, if it does not exist yet.
+func (s *Store) Init() error {
+	if err := s.fs.MkdirAll(s.dir, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create content store: %w", err)
+	}
+	return nil
+}
+
+// BlobPath returns path of the blob with given diff ID, whether it is stored or not.
+func (s *Store) BlobPath(diffID v1.Hash) string {
+	return filepath.Join(s.dir, "blobs", diffID.Algorithm, diffID.Hex)
+}
+
+// Has reports whether blob with given diff ID and length is stored.
+func (s *Store) Has(diffID v1.Hash, length int64) bool {
+	info, err := s.fs.Stat(s.BlobPath(diffID))
+	return err == nil && info.Mode().IsRegular() && info.Size() == length
+}
+
+// stored reports whether segment has content kept by the store. Zero segments are holes of sparse files,
+// which need no content.
+func (s *Store) stored(d *filesegment.Descriptor) bool {
+	return !d.IsZero() && s.Has(d.DiffID(), d.Length())
+}
+
+// Ingest adds segments of image in imageDir missing in the store, cloning them out of files of the image,
+// and returns number of bytes added. Segments must have diff IDs.
+func (s *Store) Ingest(imageDir string, segments []*filesegment.Descriptor) (int64, error) {
+	ingested := int64(0)
+	for _, d := range segments {
+		if d.IsZero() || s.Has(d.DiffID(), d.Length()) {
+			continue
+		}
+		if d.DiffID() == (v1.Hash{}) {
+			return ingested, fmt.Errorf("missing diff ID of %v", d)
+		}
+		blobPath := s.BlobPath(d.DiffID())
+		if err := s.fs.MkdirAll(filepath.Dir(blobPath), os.ModePerm); err != nil {
+			return ingested, fmt.Errorf("unable to create blob directory: %w", err)
+		}
+		// blob is cloned into temporary file first, so a partial blob is never taken as stored
+		tmpPath := blobPath + ".tmp"
+		f, err := s.fs.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+		if err != nil {
+			return ingested, fmt.Errorf("unable to create blob: %w", err)
+		}
+		if err := f.Close(); err != nil {
+			return ingested, err
+		}
+		src := filepath.Join(imageDir, filepath.FromSlash(d.Filename()))
+		if err := s.cloneRange(src, tmpPath, d.Start(), 0, d.Length()); err != nil {
+			_ = s.fs.Remove(tmpPath)
+			return ingested, fmt.Errorf("unable to ingest %v: %w", d, err)
+		}
+		if err := s.fs.Rename(tmpPath, blobPath); err != nil {
+			return ingested, fmt.Errorf("unable to store blob: %w", err)
+		}
+		ingested += d.Length()
+	}
+	return ingested, nil
+}
+
+// Materialize creates files of image in imageDir out of stored blobs, and returns number of bytes cloned.
+// Only files missing in imageDir which have at least one stored segment are created. Segments
+// the store lacks are left as holes, to be downloaded and verified with the rest by dirimage.
+func (s *Store) Materialize(imageDir string, segments []*filesegment.Descriptor) (int64, error) {
+	files := make(map[string][]*filesegment.Descriptor)
+	order := make([]string, 0)
+	for _, d := range segments {
+		if _, ok := files[d.Filename()]; !ok {
+			order = append(order, d.Filename())
+		}
+		files[d.Filename()] = append(files[d.Filename()], d)
+	}
+	cloned := int64(0)
+	for _, filename := range order {
+		n, err := s.materializeFile(filepath.Join(imageDir, filepath.FromSlash(filename)), files[filename])
+		cloned += n
+		if err != nil {
+			return cloned, err
+		}
+	}
+	return cloned, nil
+}
+
+func (s *Store) materializeFile(filePath string, segments []*filesegment.Descriptor) (int64, error) {
+	if _, err := s.fs.Stat(filePath); !errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	size := int64(0)
+	anyStored := false
+	for _, d := range segments {
+		size = max(size, d.Stop()+1)
+		anyStored = anyStored || s.stored(d)
+	}
+	if !anyStored {
+		return 0, nil
+	}
+	if err := s.fs.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return 0, fmt.Errorf("unable to create directory of '%v': %w", filePath, err)
+	}
+	f, err := s.fs.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create '%v': %w", filePath, err)
+	}
+	err = f.Truncate(size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unable to resize '%v': %w", filePath, err)
+	}
+	cloned := int64(0)
+	for _, d := range segments {
+		if !s.stored(d) {
+			continue
+		}
+		if err := s.cloneRange(s.BlobPath(d.DiffID()), filePath, 0, d.Start(), d.Length()); err != nil {
+			return cloned, fmt.Errorf("unable to materialize %v: %w", d, err)
+		}
+		cloned += d.Length()
+	}
+	return cloned, nil
+}
+
+// Blob is content of one segment kept by the store.
+type Blob struct {
+	DiffID v1.Hash
+	Path   string
+	Size   int64
+}
+
+// Blobs lists all blobs of the store. Files which are not complete blobs, like temporary ones, are left out.
+func (s *Store) Blobs() ([]Blob, error) {
+	res := make([]Blob, 0)
+	root := filepath.Join(s.dir, "blobs")
+	algorithms, err := s.fs.ReadDir(root)
+	if errors.Is(err, os.ErrNotExist) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to list blobs: %w", err)
+	}
+	for _, a := range algorithms {
+		if !a.IsDir() {
+			continue
+		}
+		entries, err := s.fs.ReadDir(filepath.Join(root, a.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("unable to list blobs: %w", err)
+		}
+		for _, e := range entries {
+			diffID, err := v1.NewHash(a.Name() + ":" + e.Name())
+			if err != nil || !e.Type().IsRegular() {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				return nil, fmt.Errorf("unable to stat blob: %w", err)
+			}
+			res = append(res, Blob{DiffID: diffID, Path: filepath.Join(root, a.Name(), e.Name()), Size: info.Size()})
+		}
+	}
+	return res, nil
+}
+
+// Remove deletes blob with given diff ID, if it is stored.
+func (s *Store) Remove(diffID v1.Hash) error {
+	if err := s.fs.Remove(s.BlobPath(diffID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to remove blob %v: %w", diffID, err)
+	}
+	return nil
+}
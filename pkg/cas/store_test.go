@@ -0,0 +1,91 @@
+package cas
+
+import (
+	"context"
+	"crypto/rand"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readSegments(t *testing.T, dir string) []*filesegment.Descriptor {
+	t.Helper()
+	img, err := dirimage.Read(context.Background(), dir, dirimage.WithChunkSize(4096))
+	require.NoError(t, err)
+	manifest, err := img.Manifest()
+	require.NoError(t, err)
+	configFile, err := img.ConfigFile()
+	require.NoError(t, err)
+	res := make([]*filesegment.Descriptor, 0)
+	for i, l := range manifest.Layers {
+		d, err := filesegment.ParseDescriptor(l, configFile.RootFS.DiffIDs[i])
+		require.NoError(t, err)
+		res = append(res, d)
+	}
+	return res
+}
+
+func TestStore_IngestAndMaterialize(t *testing.T) {
+	imageDir := filepath.Join(t.TempDir(), "image")
+	require.NoError(t, os.MkdirAll(imageDir, os.ModePerm))
+	content := make([]byte, 3*4096+100)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(imageDir, "disk.img"), content, 0o644))
+	segments := readSegments(t, imageDir)
+	require.Len(t, segments, 4)
+
+	s := NewStore(filepath.Join(t.TempDir(), "cas"))
+	assert.False(t, s.Exists())
+	require.NoError(t, s.Init())
+	assert.True(t, s.Exists())
+
+	ingested, err := s.Ingest(imageDir, segments)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), ingested)
+	for _, d := range segments {
+		assert.True(t, s.Has(d.DiffID(), d.Length()))
+	}
+	assert.False(t, s.Has(v1.Hash{Algorithm: "sha256", Hex: "00"}, 1))
+
+	t.Run("stored segments are not ingested again", func(t *testing.T) {
+		ingested, err := s.Ingest(imageDir, segments)
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), ingested)
+	})
+
+	t.Run("materialized file matches the image", func(t *testing.T) {
+		dstDir := filepath.Join(t.TempDir(), "copy")
+		cloned, err := s.Materialize(dstDir, segments)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(content)), cloned)
+		data, err := os.ReadFile(filepath.Join(dstDir, "disk.img"))
+		require.NoError(t, err)
+		assert.Equal(t, content, data)
+	})
+
+	t.Run("missing segments are left as holes", func(t *testing.T) {
+		require.NoError(t, os.Remove(s.BlobPath(segments[1].DiffID())))
+		dstDir := filepath.Join(t.TempDir(), "partial")
+		cloned, err := s.Materialize(dstDir, segments)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(content)-4096), cloned)
+		data, err := os.ReadFile(filepath.Join(dstDir, "disk.img"))
+		require.NoError(t, err)
+		require.Len(t, data, len(content))
+		assert.Equal(t, content[:4096], data[:4096])
+		assert.Equal(t, make([]byte, 4096), data[4096:2*4096])
+		assert.Equal(t, content[2*4096:], data[2*4096:])
+	})
+
+	t.Run("existing files are left alone", func(t *testing.T) {
+		cloned, err := s.Materialize(imageDir, segments)
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), cloned)
+	})
+}
@@ -0,0 +1,374 @@
+// Package digestdb keeps the digest database of a local store: every segment of local images by its digest
+// and diff ID, which images reference it and where it lives. It is persisted with bbolt, so lookups read
+// only the entries they need, instead of every manifest of the store.
+package digestdb
+
+import (
+	"encoding/json"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Filename is the name of the database file, in the index directory of the root directory.
+const Filename = "digests.db"
+
+// OpenTimeout is how long Open waits for other processes using the database to close it.
+const OpenTimeout = time.Minute
+
+var (
+	imagesBucket    = []byte("images")
+	digestsBucket   = []byte("digests")
+	diffIDsBucket   = []byte("diffids")
+	manifestsBucket = []byte("manifests")
+)
+
+// Image is the record of a local image, made from its manifest and config.
+type Image struct {
+	Directory      string  `json:"-"`
+	ManifestDigest v1.Hash `json:"manifestDigest"`
+	// ModTime and Size of the manifest the record was made from, telling whether it is current
+	ModTime  int64     `json:"modTime"`
+	Size     int64     `json:"size"`
+	Segments []Segment `json:"segments"`
+}
+
+// Segment is a segment of local image, kept in File at Start-Stop.
+type Segment struct {
+	Digest v1.Hash `json:"digest"`
+	DiffID v1.Hash `json:"diffID"`
+	File   string  `json:"file"`
+	Start  int64   `json:"start"`
+	Stop   int64   `json:"stop"`
+}
+
+// SegmentLocation tells where local image in Directory keeps a segment: in File, at Start-Stop.
+type SegmentLocation struct {
+	Directory string `json:"directory"`
+	File      string `json:"file"`
+	Start     int64  `json:"start"`
+	Stop      int64  `json:"stop"`
+}
+
+// Length returns number of bytes of the segment.
+func (sl SegmentLocation) Length() int64 {
+	return sl.Stop - sl.Start + 1
+}
+
+// DedupStats summarizes how much content local images share. SegmentsCount and BytesCount count every segment
+// of every image, unique counts take each digest once, and shared counts only digests kept in more than one place.
+type DedupStats struct {
+	ImagesCount         int
+	SegmentsCount       int64
+	UniqueSegmentsCount int64
+	BytesCount          int64
+	UniqueBytesCount    int64
+	SharedSegmentsCount int64
+	SharedBytesCount    int64
+}
+
+// DB is the digest database of root directory. Directories of images are stored relative to it,
+// so the root directory can be moved with its database.
+type DB struct {
+	rootDir string
+	db      *bolt.DB
+}
+
+// Open opens the database of rootDir kept in indexDir, creating it when it does not exist. Only one process
+// can have it open, others wait for up to OpenTimeout. The database has to be closed.
+func Open(rootDir string, indexDir string) (*DB, error) {
+	if err := os.MkdirAll(indexDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("unable to create index directory: %w", err)
+	}
+	db, err := bolt.Open(filepath.Join(indexDir, Filename), 0o644, &bolt.Options{Timeout: OpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open digest database: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{imagesBucket, digestsBucket, diffIDsBucket, manifestsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to initialize digest database: %w", err)
+	}
+	return &DB{rootDir: rootDir, db: db}, nil
+}
+
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+func (d *DB) relPath(dir string) (string, error) {
+	rel, err := filepath.Rel(d.rootDir, dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("'%v' is not a directory within the root directory", dir)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func (d *DB) absPath(rel string) string {
+	return filepath.Join(d.rootDir, filepath.FromSlash(rel))
+}
+
+// Put records img, replacing any previous record of its directory.
+func (d *DB) Put(img *Image) error {
+	rel, err := d.relPath(img.Directory)
+	if err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		if err := deleteImage(tx, rel); err != nil {
+			return err
+		}
+		return putImage(tx, rel, img)
+	})
+}
+
+// Delete forgets images in dir and its subdirectories.
+func (d *DB) Delete(dir string) error {
+	rel, err := d.relPath(dir)
+	if err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		rels := make([]string, 0)
+		c := tx.Bucket(imagesBucket).Cursor()
+		for k, _ := c.Seek([]byte(rel)); k != nil && strings.HasPrefix(string(k), rel); k, _ = c.Next() {
+			if string(k) == rel || strings.HasPrefix(string(k), rel+"/") {
+				rels = append(rels, string(k))
+			}
+		}
+		for _, r := range rels {
+			if err := deleteImage(tx, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Image returns record of image in dir, nil when there is none.
+func (d *DB) Image(dir string) (*Image, error) {
+	rel, err := d.relPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	var res *Image
+	err = d.db.View(func(tx *bolt.Tx) error {
+		res, err = getImage(tx, rel)
+		if res != nil {
+			res.Directory = dir
+		}
+		return err
+	})
+	return res, err
+}
+
+// Images returns directories of all recorded images, sorted.
+func (d *DB) Images() ([]string, error) {
+	res := make([]string, 0)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(imagesBucket).ForEach(func(k, _ []byte) error {
+			res = append(res, d.absPath(string(k)))
+			return nil
+		})
+	})
+	sort.Strings(res)
+	return res, err
+}
+
+// Locations returns every place of local images keeping segment with given digest, nil when there is none.
+func (d *DB) Locations(digest v1.Hash) ([]SegmentLocation, error) {
+	var res []SegmentLocation
+	err := d.db.View(func(tx *bolt.Tx) error {
+		if err := get(tx.Bucket(digestsBucket), digest.String(), &res); err != nil {
+			return err
+		}
+		for i := range res {
+			res[i].Directory = d.absPath(res[i].Directory)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// References returns directories of local images having segment with given diff ID, sorted.
+// Content without references, like blobs of the content store, may be removed.
+func (d *DB) References(diffID v1.Hash) ([]string, error) {
+	return d.dirs(diffIDsBucket, diffID)
+}
+
+// ImagesWithManifest returns directories of local images with manifest of given digest, sorted.
+func (d *DB) ImagesWithManifest(digest v1.Hash) ([]string, error) {
+	return d.dirs(manifestsBucket, digest)
+}
+
+func (d *DB) dirs(bucket []byte, h v1.Hash) ([]string, error) {
+	var rels []string
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return get(tx.Bucket(bucket), h.String(), &rels)
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(rels))
+	for _, rel := range rels {
+		res = append(res, d.absPath(rel))
+	}
+	return res, nil
+}
+
+// Stats returns deduplication statistics of recorded images.
+func (d *DB) Stats() (DedupStats, error) {
+	var st DedupStats
+	err := d.db.View(func(tx *bolt.Tx) error {
+		st.ImagesCount = tx.Bucket(imagesBucket).Stats().KeyN
+		return tx.Bucket(digestsBucket).ForEach(func(_, v []byte) error {
+			var locations []SegmentLocation
+			if err := json.Unmarshal(v, &locations); err != nil {
+				return fmt.Errorf("invalid locations in digest database: %w", err)
+			}
+			if len(locations) == 0 {
+				return nil
+			}
+			st.UniqueSegmentsCount++
+			st.UniqueBytesCount += locations[0].Length()
+			for _, l := range locations {
+				st.SegmentsCount++
+				st.BytesCount += l.Length()
+			}
+			if len(locations) > 1 {
+				st.SharedSegmentsCount++
+				st.SharedBytesCount += locations[0].Length()
+			}
+			return nil
+		})
+	})
+	return st, err
+}
+
+func get(b *bolt.Bucket, key string, v any) error {
+	raw := b.Get([]byte(key))
+	if raw == nil {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("invalid entry '%v' in digest database: %w", key, err)
+	}
+	return nil
+}
+
+func put(b *bolt.Bucket, key string, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), raw)
+}
+
+func getImage(tx *bolt.Tx, rel string) (*Image, error) {
+	var res *Image
+	if err := get(tx.Bucket(imagesBucket), rel, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func putImage(tx *bolt.Tx, rel string, img *Image) error {
+	if err := put(tx.Bucket(imagesBucket), rel, img); err != nil {
+		return err
+	}
+	if err := addDir(tx.Bucket(manifestsBucket), img.ManifestDigest, rel); err != nil {
+		return err
+	}
+	for _, s := range img.Segments {
+		var locations []SegmentLocation
+		if err := get(tx.Bucket(digestsBucket), s.Digest.String(), &locations); err != nil {
+			return err
+		}
+		locations = append(locations, SegmentLocation{Directory: rel, File: s.File, Start: s.Start, Stop: s.Stop})
+		if err := put(tx.Bucket(digestsBucket), s.Digest.String(), locations); err != nil {
+			return err
+		}
+		if s.DiffID != (v1.Hash{}) {
+			if err := addDir(tx.Bucket(diffIDsBucket), s.DiffID, rel); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteImage removes image at rel and every entry referring to it.
+func deleteImage(tx *bolt.Tx, rel string) error {
+	img, err := getImage(tx, rel)
+	if err != nil || img == nil {
+		return err
+	}
+	if err := removeDir(tx.Bucket(manifestsBucket), img.ManifestDigest, rel); err != nil {
+		return err
+	}
+	for _, s := range img.Segments {
+		var locations []SegmentLocation
+		if err := get(tx.Bucket(digestsBucket), s.Digest.String(), &locations); err != nil {
+			return err
+		}
+		kept := locations[:0]
+		for _, l := range locations {
+			if l.Directory != rel {
+				kept = append(kept, l)
+			}
+		}
+		if err := putOrDelete(tx.Bucket(digestsBucket), s.Digest.String(), kept, len(kept)); err != nil {
+			return err
+		}
+		if err := removeDir(tx.Bucket(diffIDsBucket), s.DiffID, rel); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(imagesBucket).Delete([]byte(rel))
+}
+
+func addDir(b *bolt.Bucket, h v1.Hash, rel string) error {
+	var rels []string
+	if err := get(b, h.String(), &rels); err != nil {
+		return err
+	}
+	i := sort.SearchStrings(rels, rel)
+	if i < len(rels) && rels[i] == rel {
+		return nil
+	}
+	rels = append(rels[:i], append([]string{rel}, rels[i:]...)...)
+	return put(b, h.String(), rels)
+}
+
+func removeDir(b *bolt.Bucket, h v1.Hash, rel string) error {
+	var rels []string
+	if err := get(b, h.String(), &rels); err != nil {
+		return err
+	}
+	kept := rels[:0]
+	for _, r := range rels {
+		if r != rel {
+			kept = append(kept, r)
+		}
+	}
+	return putOrDelete(b, h.String(), kept, len(kept))
+}
+
+func putOrDelete(b *bolt.Bucket, key string, v any, n int) error {
+	if n == 0 {
+		return b.Delete([]byte(key))
+	}
+	return put(b, key, v)
+}
@@ -0,0 +1,116 @@
+package digestdb
+
+import (
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+func testHash(prefix string, i int) v1.Hash {
+	return v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%s%063d", prefix, i)}
+}
+
+// testImage returns record of image in dir with segments of disk.img, ten bytes each, with digests i to i+count-1.
+func testImage(dir string, manifest int, i, count int) *Image {
+	img := &Image{Directory: dir, ManifestDigest: testHash("f", manifest)}
+	for n := 0; n < count; n++ {
+		img.Segments = append(img.Segments, Segment{
+			Digest: testHash("a", i+n),
+			DiffID: testHash("b", i+n),
+			File:   "disk.img",
+			Start:  int64(n * 10),
+			Stop:   int64(n*10 + 9),
+		})
+	}
+	return img
+}
+
+func TestDB(t *testing.T) {
+	rootDir := t.TempDir()
+	indexDir := filepath.Join(rootDir, ".geranos")
+	db, err := Open(rootDir, indexDir)
+	require.NoError(t, err)
+	a, b, c := filepath.Join(rootDir, "repo", "a:v1"), filepath.Join(rootDir, "repo", "b:v1"), filepath.Join(rootDir, "other", "c:v1")
+	require.NoError(t, db.Put(testImage(a, 1, 0, 3)))
+	require.NoError(t, db.Put(testImage(b, 1, 1, 3)))
+	require.NoError(t, db.Put(testImage(c, 2, 10, 2)))
+
+	images, err := db.Images()
+	require.NoError(t, err)
+	assert.Equal(t, []string{c, a, b}, images)
+	locations, err := db.Locations(testHash("a", 1))
+	require.NoError(t, err)
+	assert.Equal(t, []SegmentLocation{
+		{Directory: a, File: "disk.img", Start: 10, Stop: 19},
+		{Directory: b, File: "disk.img", Start: 0, Stop: 9},
+	}, locations)
+	assert.Equal(t, int64(10), locations[0].Length())
+	refs, err := db.References(testHash("b", 2))
+	require.NoError(t, err)
+	assert.Equal(t, []string{a, b}, refs)
+	refs, err = db.References(testHash("b", 99))
+	require.NoError(t, err)
+	assert.Empty(t, refs)
+	dirs, err := db.ImagesWithManifest(testHash("f", 1))
+	require.NoError(t, err)
+	assert.Equal(t, []string{a, b}, dirs)
+
+	st, err := db.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, DedupStats{
+		ImagesCount:         3,
+		SegmentsCount:       8,
+		UniqueSegmentsCount: 6,
+		BytesCount:          80,
+		UniqueBytesCount:    60,
+		SharedSegmentsCount: 2,
+		SharedBytesCount:    20,
+	}, st)
+
+	t.Run("put replaces previous record", func(t *testing.T) {
+		require.NoError(t, db.Put(testImage(b, 3, 20, 1)))
+		refs, err := db.References(testHash("b", 2))
+		require.NoError(t, err)
+		assert.Equal(t, []string{a}, refs)
+		dirs, err := db.ImagesWithManifest(testHash("f", 1))
+		require.NoError(t, err)
+		assert.Equal(t, []string{a}, dirs)
+		img, err := db.Image(b)
+		require.NoError(t, err)
+		assert.Equal(t, testImage(b, 3, 20, 1), img)
+	})
+
+	t.Run("delete forgets images in subdirectories", func(t *testing.T) {
+		require.NoError(t, db.Delete(filepath.Join(rootDir, "repo")))
+		images, err := db.Images()
+		require.NoError(t, err)
+		assert.Equal(t, []string{c}, images)
+		locations, err := db.Locations(testHash("a", 1))
+		require.NoError(t, err)
+		assert.Empty(t, locations)
+		img, err := db.Image(a)
+		require.NoError(t, err)
+		assert.Nil(t, img)
+	})
+
+	t.Run("persisted", func(t *testing.T) {
+		require.NoError(t, db.Close())
+		moved := t.TempDir()
+		reopened, err := Open(moved, indexDir)
+		require.NoError(t, err)
+		defer reopened.Close()
+		refs, err := reopened.References(testHash("b", 10))
+		require.NoError(t, err)
+		assert.Equal(t, []string{filepath.Join(moved, "other", "c:v1")}, refs, "directories are relative to the root directory")
+	})
+
+	t.Run("directory outside root directory", func(t *testing.T) {
+		reopened, err := Open(rootDir, indexDir)
+		require.NoError(t, err)
+		defer reopened.Close()
+		assert.Error(t, reopened.Put(testImage(t.TempDir(), 1, 0, 1)))
+	})
+}
@@ -0,0 +1,117 @@
+package dirimage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"golang.org/x/text/cases"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrCaseConflict = errors.New("image contains files differing only by case, which cannot be written to case-insensitive filesystem")
+
+// findCaseConflicts returns groups of paths of the image which would collide on a case-insensitive filesystem.
+// Files, symlinks and directories are compared, along with every directory on their paths, so A/x and a/y
+// conflict as well. Paths are compared with Unicode case folding, like case-insensitive filesystems do.
+// Conflicts below a conflicting directory are not reported again.
+func findCaseConflicts(segmentDescriptors []*filesegment.Descriptor, symlinks []Symlink, directories []string) [][]string {
+	fold := cases.Fold()
+	groups := make(map[string]map[string]struct{})
+	add := func(name string) {
+		// the path and each of its parent directories
+		for i := 0; i <= len(name); i++ {
+			if i < len(name) && name[i] != '/' {
+				continue
+			}
+			p := name[:i]
+			key := fold.String(p)
+			if groups[key] == nil {
+				groups[key] = make(map[string]struct{})
+			}
+			groups[key][p] = struct{}{}
+		}
+	}
+	for _, d := range segmentDescriptors {
+		add(d.Filename())
+	}
+	for _, l := range symlinks {
+		add(l.Name)
+	}
+	for _, d := range directories {
+		add(d)
+	}
+	conflicting := func(key string) bool {
+		return len(groups[key]) > 1
+	}
+	res := make([][]string, 0)
+	for key, names := range groups {
+		if !conflicting(key) {
+			continue
+		}
+		parentConflicts := false
+		for dir := path.Dir(key); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if conflicting(dir) {
+				parentConflicts = true
+				break
+			}
+		}
+		if parentConflicts {
+			continue
+		}
+		conflict := make([]string, 0, len(names))
+		for n := range names {
+			conflict = append(conflict, n)
+		}
+		sort.Strings(conflict)
+		res = append(res, conflict)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i][0] < res[j][0] })
+	return res
+}
+
+// isCaseInsensitive probes the filesystem of dir by creating a lowercase file and looking it up in uppercase.
+func isCaseInsensitive(dir string, opts *options) (bool, error) {
+	probeName := ".geranos-case-probe-" + strconv.FormatInt(opts.rand.Int63(), 36)
+	probePath := filepath.Join(dir, probeName)
+	f, err := opts.fs.OpenFile(probePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return false, fmt.Errorf("unable to create case sensitivity probe in '%v': %w", dir, err)
+	}
+	f.Close()
+	defer opts.fs.Remove(probePath)
+
+	_, err = opts.fs.Stat(filepath.Join(dir, strings.ToUpper(probeName)))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("unable to probe case sensitivity of '%v': %w", dir, err)
+}
+
+// checkCaseConflicts fails early if the image cannot be written to destinationDir without
+// one file silently overwriting another.
+func (di *DirImage) checkCaseConflicts(destinationDir string, opts *options) error {
+	conflicts := findCaseConflicts(di.segmentDescriptors, di.symlinks, di.directories)
+	if len(conflicts) == 0 {
+		return nil
+	}
+	insensitive, err := isCaseInsensitive(destinationDir, opts)
+	if err != nil {
+		return err
+	}
+	if !insensitive {
+		return nil
+	}
+	formatted := make([]string, 0, len(conflicts))
+	for _, c := range conflicts {
+		formatted = append(formatted, strings.Join(c, ", "))
+	}
+	return fmt.Errorf("%w: [%s]", ErrCaseConflict, strings.Join(formatted, "], ["))
+}
@@ -0,0 +1,75 @@
+package dirimage
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"path"
+)
+
+// WholeFileChunkSize makes ChunkSizeRule keep the whole file in one segment.
+const WholeFileChunkSize int64 = math.MaxInt64
+
+// ChunkSizeRule sets chunk size for files matching Pattern (as understood by path.Match), which is matched
+// against the filename as well as against its base name, like in FileFilter.
+type ChunkSizeRule struct {
+	Pattern   string
+	ChunkSize int64
+}
+
+// WithChunkSizeRules makes Read split files matching one of the rules into chunks of its size instead of
+// the one given by WithChunkSize. The first matching rule wins.
+func WithChunkSizeRules(rules ...ChunkSizeRule) Option {
+	return func(o *options) {
+		o.chunkSizeRules = append(o.chunkSizeRules, rules...)
+	}
+}
+
+func validateChunkSizeRules(rules []ChunkSizeRule) error {
+	for _, r := range rules {
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid chunk size pattern '%v': %w", r.Pattern, err)
+		}
+		if r.ChunkSize <= 0 {
+			return fmt.Errorf("invalid chunk size %d for pattern '%v'", r.ChunkSize, r.Pattern)
+		}
+	}
+	return nil
+}
+
+// WithAdaptiveChunkSize makes Read grow chunk size of large files, so none of them is split into more than
+// maxSegments segments. Chunk size is doubled from the one given by WithChunkSize until the file fits,
+// so it only changes when file size crosses one of the thresholds, and smaller files are split as before.
+// Rules given by WithChunkSizeRules take precedence.
+func WithAdaptiveChunkSize(maxSegments int) Option {
+	return func(o *options) {
+		o.maxSegmentsPerFile = maxSegments
+	}
+}
+
+// adaptiveChunkSize returns the smallest power of two multiple of chunkSize splitting size into at most maxSegments.
+func adaptiveChunkSize(chunkSize int64, size int64, maxSegments int) int64 {
+	if maxSegments <= 0 || chunkSize <= 0 {
+		return chunkSize
+	}
+	needed := (size + int64(maxSegments) - 1) / int64(maxSegments)
+	if needed <= chunkSize {
+		return chunkSize
+	}
+	multiple := uint64((needed + chunkSize - 1) / chunkSize)
+	shift := bits.Len64(multiple - 1)
+	if shift >= bits.LeadingZeros64(uint64(chunkSize)) {
+		return WholeFileChunkSize
+	}
+	return chunkSize << shift
+}
+
+// chunkSizeFor returns size of segments name of given size is split into.
+func (o *options) chunkSizeFor(name string, size int64) int64 {
+	for _, r := range o.chunkSizeRules {
+		if matchesAny([]string{r.Pattern}, name) {
+			return r.ChunkSize
+		}
+	}
+	return adaptiveChunkSize(o.chunkSize, size, o.maxSegmentsPerFile)
+}
@@ -0,0 +1,48 @@
+package dirimage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdaptiveChunkSize(t *testing.T) {
+	const mib = 1 << 20
+	tests := []struct {
+		name        string
+		size        int64
+		maxSegments int
+		expected    int64
+	}{
+		{name: "disabled", size: 1 << 40, maxSegments: 0, expected: 64 * mib},
+		{name: "small file keeps chunk size", size: 100 * mib, maxSegments: 1024, expected: 64 * mib},
+		{name: "file at the threshold keeps chunk size", size: 1024 * 64 * mib, maxSegments: 1024, expected: 64 * mib},
+		{name: "file above the threshold doubles it", size: 1024*64*mib + 1, maxSegments: 1024, expected: 128 * mib},
+		{name: "2 TB disk", size: 2 << 40, maxSegments: 1024, expected: 2048 * mib},
+		{name: "huge file is not split", size: 1<<62 + 1, maxSegments: 1, expected: WholeFileChunkSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, adaptiveChunkSize(64*mib, tt.size, tt.maxSegments))
+		})
+	}
+}
+
+func TestRead_AdaptiveChunkSize(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "disk.img"), 1000))
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "nvram.bin"), 300))
+
+	di, err := Read(context.Background(), dir, WithChunkSize(100), WithAdaptiveChunkSize(4))
+	require.NoError(t, err)
+	layers, err := di.Layers()
+	require.NoError(t, err)
+	lengths := make(map[string][]int64)
+	for _, l := range layers {
+		lengths[layerFilename(l)] = append(lengths[layerFilename(l)], l.(hasLength).Length())
+	}
+	assert.Equal(t, []int64{400, 400, 200}, lengths["disk.img"])
+	assert.Equal(t, []int64{100, 100, 100}, lengths["nvram.bin"])
+}
@@ -0,0 +1,133 @@
+package dirimage
+
+import (
+	"fmt"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/zstd"
+	"path"
+)
+
+// CompressionRule selects compression for files matching Pattern, matched like patterns of ChunkSizeRule.
+type CompressionRule struct {
+	Pattern     string
+	Compression filesegment.Compression
+}
+
+// WithCompression sets compression of segments created by Read, zstd is used by default.
+// Already compressed or encrypted files are better stored with filesegment.CompressionNone.
+func WithCompression(c filesegment.Compression) Option {
+	return func(o *options) {
+		o.compression = c
+	}
+}
+
+// WithCompressionRules makes Read compress files matching one of the rules with its compression instead of
+// the one given by WithCompression. The first matching rule wins.
+func WithCompressionRules(rules ...CompressionRule) Option {
+	return func(o *options) {
+		o.compressionRules = append(o.compressionRules, rules...)
+	}
+}
+
+// DefaultMinCompressionSavings is a reasonable threshold for WithSkipIncompressible.
+const DefaultMinCompressionSavings = 0.05
+
+// WithSkipIncompressible makes Read store segments uncompressed, when compressing samples of them saves
+// less than minSavings fraction of their size. Zero disables sampling.
+func WithSkipIncompressible(minSavings float64) Option {
+	return func(o *options) {
+		o.minSavings = minSavings
+	}
+}
+
+// WithCompressionLevel sets level of zstd compression used by Read, from 1 (the default) to zstd.MaxLevel.
+// Higher levels spend more CPU time for smaller uploads. Segments compressed otherwise are not affected.
+func WithCompressionLevel(level int) Option {
+	return func(o *options) {
+		o.compressionLevel = level
+	}
+}
+
+// WithSeekableZstd makes Read compress segments as seekable zstd with frames of frameSize uncompressed bytes,
+// so byte ranges of segments can be fetched and decompressed on their own. It can not be combined with WithTOC.
+func WithSeekableZstd(frameSize int) Option {
+	return func(o *options) {
+		o.seekableFrameSize = frameSize
+	}
+}
+
+// WithEncoderConcurrency sets how many goroutines compress each segment with zstd at the same time,
+// on top of segments being hashed in parallel (see WithHashWorkersCount). Digests do not depend on it.
+func WithEncoderConcurrency(n int) Option {
+	return func(o *options) {
+		o.encoderConcurrency = n
+	}
+}
+
+// WithCompressionCPUBudget spreads given number of CPUs among hash workers, each compressing its segment
+// with a share of them, unless WithEncoderConcurrency is given. Segments are compressed one goroutine each by default.
+func WithCompressionCPUBudget(cpus int) Option {
+	return func(o *options) {
+		o.compressionCPUs = cpus
+	}
+}
+
+func (o *options) zstdConcurrency() int {
+	if o.encoderConcurrency > 0 {
+		return o.encoderConcurrency
+	}
+	if o.compressionCPUs > 0 {
+		return max(o.compressionCPUs/o.hashWorkers(), 1)
+	}
+	return 1
+}
+
+// WithZstdWindowSize makes Read compress segments with larger zstd window, so repetitions further apart
+// within large segments (like VM disks) are found. It has to be a power of two up to zstd.MaxWindowSize.
+func WithZstdWindowSize(size int) Option {
+	return func(o *options) {
+		o.zstdWindowSize = size
+	}
+}
+
+// WithDecoderLimits makes Write reject segments needing zstd window larger than maxWindow bytes, and limits
+// memory allocated for decompressing each segment to about maxMemory bytes. Images from untrusted registries
+// cannot force large allocations per worker then. Zero keeps the default limit, see
+// filesegment.DefaultMaxDecoderWindow and filesegment.DefaultMaxDecoderMemory.
+func WithDecoderLimits(maxWindow, maxMemory uint64) Option {
+	return func(o *options) {
+		o.decoderMaxWindow = maxWindow
+		o.decoderMaxMemory = maxMemory
+	}
+}
+
+// decodeOptions translates options relevant for decompressing segments of image shipping given dictionary.
+func (o *options) decodeOptions(dict *zstd.Dictionary) []filesegment.DecodeOpt {
+	res := []filesegment.DecodeOpt{filesegment.WithDecoderLimits(o.decoderMaxWindow, o.decoderMaxMemory)}
+	if dict != nil {
+		res = append(res, filesegment.WithDictionaries(dict))
+	}
+	return res
+}
+
+func validateCompressionRules(rules []CompressionRule) error {
+	for _, r := range rules {
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid compression pattern '%v': %w", r.Pattern, err)
+		}
+		if _, err := filesegment.ParseCompression(string(r.Compression)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compressionFor returns compression of segments of name.
+func (o *options) compressionFor(name string) filesegment.Compression {
+	for _, r := range o.compressionRules {
+		if matchesAny([]string{r.Pattern}, name) {
+			return r.Compression
+		}
+	}
+	return o.compression
+}
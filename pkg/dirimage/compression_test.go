@@ -0,0 +1,191 @@
+package dirimage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadWrite_Compression(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "disk.img"), 1000))
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "nvram.bin"), 300))
+	// content looking like gzip must not be mistaken for compressed blob
+	archive := append([]byte{0x1f, 0x8b, 0x08, 0x00}, bytes.Repeat([]byte("not really gzip"), 20)...)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "disk.qcow2"), archive, 0o644))
+
+	di, err := Read(context.Background(), dir, WithChunkSize(100), WithCompression(filesegment.CompressionGzip),
+		WithCompressionRules(CompressionRule{Pattern: "*.qcow2", Compression: filesegment.CompressionNone}))
+	require.NoError(t, err)
+
+	manifest, err := di.Manifest()
+	require.NoError(t, err)
+	mediaTypes := make(map[string]types.MediaType)
+	for _, l := range manifest.Layers {
+		mediaTypes[l.Annotations[filesegment.FilenameAnnotationKey]] = l.MediaType
+	}
+	assert.Equal(t, filesegment.GzipMediaType, mediaTypes["disk.img"])
+	assert.Equal(t, filesegment.GzipMediaType, mediaTypes["nvram.bin"])
+	assert.Equal(t, filesegment.UncompressedMediaType, mediaTypes["disk.qcow2"])
+
+	converted, err := Convert(di)
+	require.NoError(t, err)
+	pulled := t.TempDir()
+	require.NoError(t, converted.Write(context.Background(), pulled))
+	for _, name := range []string{"disk.img", "nvram.bin", "disk.qcow2"} {
+		expected, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		actual, err := os.ReadFile(filepath.Join(pulled, name))
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual, name)
+	}
+
+	_, err = Read(context.Background(), dir, WithCompression("lz4"))
+	assert.ErrorContains(t, err, "unsupported compression 'lz4'")
+}
+
+func TestRead_SkipIncompressible(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "disk.img"), 300*1024))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), bytes.Repeat([]byte(`{"disk_size": 4096}`), 1000), 0o644))
+
+	di, err := Read(context.Background(), dir, WithChunkSize(100*1024), WithSkipIncompressible(DefaultMinCompressionSavings))
+	require.NoError(t, err)
+	manifest, err := di.Manifest()
+	require.NoError(t, err)
+	for _, l := range manifest.Layers {
+		switch l.Annotations[filesegment.FilenameAnnotationKey] {
+		case "disk.img":
+			assert.Equal(t, filesegment.UncompressedMediaType, l.MediaType)
+			assert.Equal(t, int64(100*1024), l.Size)
+		case "config.json":
+			assert.Equal(t, filesegment.MediaType, l.MediaType)
+		}
+	}
+
+	converted, err := Convert(di)
+	require.NoError(t, err)
+	pulled := t.TempDir()
+	require.NoError(t, converted.Write(context.Background(), pulled))
+	expected, err := os.ReadFile(filepath.Join(dir, "disk.img"))
+	require.NoError(t, err)
+	actual, err := os.ReadFile(filepath.Join(pulled, "disk.img"))
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestRead_ZstdDictionary(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "disk.img"), 10*1024))
+	for i, name := range []string{"config.json", "machine.json", "display.json"} {
+		content := fmt.Sprintf(`{"cpuCount": %d, "memorySize": 8589934592, "displays": [{"width": 1920, "height": 1080}], "name": %q}`, i, name)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+
+	di, err := Read(context.Background(), dir, WithZstdDictionary(1024))
+	require.NoError(t, err)
+	manifest, err := di.Manifest()
+	require.NoError(t, err)
+	require.Contains(t, manifest.Annotations, DictionaryAnnotationKey)
+	for _, l := range manifest.Layers {
+		_, ok := l.Annotations[filesegment.ZstdDictionaryAnnotationKey]
+		assert.Equal(t, l.Annotations[filesegment.FilenameAnnotationKey] != "disk.img", ok)
+	}
+
+	again, err := Read(context.Background(), dir, WithZstdDictionary(1024))
+	require.NoError(t, err)
+	againManifest, err := again.Manifest()
+	require.NoError(t, err)
+	assert.Equal(t, manifest.Layers, againManifest.Layers, "dictionary has to be reproducible")
+
+	converted, err := Convert(di)
+	require.NoError(t, err)
+	pulled := t.TempDir()
+	require.NoError(t, converted.Write(context.Background(), pulled))
+	for _, name := range []string{"disk.img", "config.json", "machine.json", "display.json"} {
+		expected, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		actual, err := os.ReadFile(filepath.Join(pulled, name))
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual, name)
+	}
+
+	// pulled directory keeps the dictionary in its manifest
+	local, err := Read(context.Background(), pulled, WithOmitLayersContent())
+	require.NoError(t, err)
+	localManifest, err := local.Manifest()
+	require.NoError(t, err)
+	assert.Equal(t, manifest.Annotations[DictionaryAnnotationKey], localManifest.Annotations[DictionaryAnnotationKey])
+}
+
+func TestOptions_zstdConcurrency(t *testing.T) {
+	assert.Equal(t, 1, makeOptions().zstdConcurrency())
+	assert.Equal(t, 3, makeOptions(WithEncoderConcurrency(3), WithCompressionCPUBudget(64)).zstdConcurrency())
+	assert.Equal(t, 4, makeOptions(WithHashWorkersCount(4), WithCompressionCPUBudget(16)).zstdConcurrency())
+	assert.Equal(t, 1, makeOptions(WithHashWorkersCount(8), WithCompressionCPUBudget(4)).zstdConcurrency())
+}
+
+func TestWrite_DecoderLimits(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "disk.img"), 2<<20))
+	di, err := Read(context.Background(), dir, WithZstdWindowSize(16<<20))
+	require.NoError(t, err)
+	converted, err := Convert(di)
+	require.NoError(t, err)
+
+	err = converted.Write(context.Background(), t.TempDir(), WithDecoderLimits(1<<20, 0),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+	require.ErrorContains(t, err, "window size exceeded")
+
+	pulled := t.TempDir()
+	require.NoError(t, converted.Write(context.Background(), pulled, WithDecoderLimits(16<<20, 64<<20)))
+	expected, err := os.ReadFile(filepath.Join(dir, "disk.img"))
+	require.NoError(t, err)
+	actual, err := os.ReadFile(filepath.Join(pulled, "disk.img"))
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestRead_SeekableZstd(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "disk.img"), 5000))
+	di, err := Read(context.Background(), dir, WithSeekableZstd(1024))
+	require.NoError(t, err)
+	layers, err := di.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	manifest, err := di.Manifest()
+	require.NoError(t, err)
+	assert.Equal(t, "1024", manifest.Layers[0].Annotations[filesegment.ZstdSeekableAnnotationKey])
+
+	rc, err := layers[0].Compressed()
+	require.NoError(t, err)
+	blob, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	table, err := zstd.ReadSeekTable(bytes.NewReader(blob), int64(len(blob)))
+	require.NoError(t, err)
+	assert.Len(t, table.Frames, 5)
+
+	converted, err := Convert(di)
+	require.NoError(t, err)
+	pulled := t.TempDir()
+	require.NoError(t, converted.Write(context.Background(), pulled))
+	expected, err := os.ReadFile(filepath.Join(dir, "disk.img"))
+	require.NoError(t, err)
+	actual, err := os.ReadFile(filepath.Join(pulled, "disk.img"))
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	_, err = Read(context.Background(), dir, WithSeekableZstd(1024), WithTOC(true))
+	assert.ErrorContains(t, err, "can not be combined")
+}
@@ -33,10 +33,26 @@ func Convert(img v1.Image) (*DirImage, error) {
 		}
 		segmentDescriptors = append(segmentDescriptors, d)
 	}
+	filesegment.AssignIDs(segmentDescriptors)
+	symlinks, err := parseSymlinks(manifest.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	directories, err := parseDirectories(manifest.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	dictionary, err := parseDictionary(manifest.Annotations)
+	if err != nil {
+		return nil, err
+	}
 	return &DirImage{
 		Image:              img,
 		BytesReadCount:     atomic.Int64{},
 		directory:          "",
 		segmentDescriptors: segmentDescriptors,
+		symlinks:           symlinks,
+		directories:        directories,
+		dictionary:         dictionary,
 	}, nil
 }
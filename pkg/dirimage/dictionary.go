@@ -0,0 +1,78 @@
+package dirimage
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/zstd"
+	"path/filepath"
+)
+
+// DictionaryAnnotationKey is the manifest annotation carrying base64-encoded zstd dictionary of the image.
+// Segments compressed with it refer to it by filesegment.ZstdDictionaryAnnotationKey.
+const DictionaryAnnotationKey = "online.jarosik.tomasz.geranos.zstd.dictionary"
+
+// WithZstdDictionary makes Read train zstd dictionary on content of files up to maxFileSize bytes, and compress
+// them with it. Small files, like configs, compress poorly on their own, but share a lot with each other.
+// The dictionary is shipped in the manifest. It has no effect together with WithTOC.
+func WithZstdDictionary(maxFileSize int64) Option {
+	return func(o *options) {
+		o.dictionaryFileSize = maxFileSize
+	}
+}
+
+// usesDictionary reports whether file of given size is compressed with the dictionary, as a single segment.
+func (o *options) usesDictionary(name string, size int64) bool {
+	return o.dictionaryFileSize > 0 && !o.toc && size > 0 && size <= o.dictionaryFileSize &&
+		size <= o.chunkSizeFor(name, size) && o.compressionFor(name) == filesegment.CompressionZstd
+}
+
+// trainDictionary builds dictionary out of files which are going to use it. Files are taken in order of the tree,
+// so the same content always results in the same dictionary, and in the same digests of segments.
+func trainDictionary(dir string, tree *dirTree, opts *options) (*zstd.Dictionary, error) {
+	samples := make([][]byte, 0)
+	for _, name := range tree.files {
+		fullPath := filepath.Join(dir, filepath.FromSlash(name))
+		info, err := opts.fs.Stat(fullPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to stat '%v': %w", name, err)
+		}
+		if !opts.usesDictionary(name, info.Size()) {
+			continue
+		}
+		data, err := opts.fs.ReadFile(fullPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read '%v': %w", name, err)
+		}
+		samples = append(samples, data)
+	}
+	dict := zstd.TrainDictionary(samples, zstd.MaxDictionarySize)
+	if dict != nil {
+		opts.printf("trained zstd dictionary of %d bytes on %d files", len(dict.Content), len(samples))
+	}
+	return dict, nil
+}
+
+func parseDictionary(annotations map[string]string) (*zstd.Dictionary, error) {
+	raw, ok := annotations[DictionaryAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	content, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid zstd dictionary annotation: %w", err)
+	}
+	return zstd.NewDictionary(content), nil
+}
+
+// addDictionaryAnnotation adds dictionary to manifest annotations, creating them if needed.
+func addDictionaryAnnotation(annotations map[string]string, dict *zstd.Dictionary) map[string]string {
+	if dict == nil {
+		return annotations
+	}
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[DictionaryAnnotationKey] = base64.StdEncoding.EncodeToString(dict.Content)
+	return annotations
+}
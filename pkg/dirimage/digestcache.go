@@ -0,0 +1,146 @@
+package dirimage
+
+import (
+	"encoding/json"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"os"
+	"path/filepath"
+)
+
+// DigestCacheFilename is the file in image directory remembering digests of segments computed by Read.
+// It starts with a dot, so it is never part of the image itself.
+const DigestCacheFilename = ".geranos-digests.json"
+
+// digestCacheFormat changes whenever options affecting digests change, discarding the whole cache.
+func digestCacheFormat(opts *options) string {
+	return fmt.Sprintf("v1;%v;zero=%v;skip=%v;level=%v;window=%v;seekable=%v", opts.digestAlgorithm, opts.zeroElision,
+		opts.minSavings, opts.compressionLevel, opts.zstdWindowSize, opts.seekableFrameSize)
+}
+
+type digestCacheEntry struct {
+	File     string `json:"file"`
+	Offset   int64  `json:"offset"`
+	Length   int64  `json:"length"`
+	FileSize int64  `json:"fileSize"`
+	ModTime  int64  `json:"mtime"`
+	// Compression of the segment, which the digest depends on
+	Compression filesegment.Compression `json:"compression,omitempty"`
+	// Dictionary is ID of zstd dictionary the segment was compressed with, which changes with content of other files
+	Dictionary uint32 `json:"dictionary,omitempty"`
+	filesegment.Hashes
+}
+
+type digestCacheFile struct {
+	Format  string             `json:"format"`
+	Entries []digestCacheEntry `json:"entries"`
+}
+
+type segmentKey struct {
+	file   string
+	offset int64
+	length int64
+}
+
+// digestCache maps segments of files to their hashes, as long as size and modification time
+// of the file stay the same as when they were computed.
+type digestCache struct {
+	entries map[segmentKey]digestCacheEntry
+	// stats are recorded before hashing, so a file modified meanwhile is hashed again next time.
+	stats map[string]os.FileInfo
+}
+
+func loadDigestCache(dir string, opts *options) *digestCache {
+	res := &digestCache{
+		entries: make(map[segmentKey]digestCacheEntry),
+		stats:   make(map[string]os.FileInfo),
+	}
+	data, err := opts.fs.ReadFile(filepath.Join(dir, DigestCacheFilename))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			opts.printf("unable to read digest cache: %v", err)
+		}
+		return res
+	}
+	var f digestCacheFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		opts.printf("ignoring invalid digest cache: %v", err)
+		return res
+	}
+	if f.Format != digestCacheFormat(opts) {
+		return res
+	}
+	for _, e := range f.Entries {
+		res.entries[segmentKey{file: e.File, offset: e.Offset, length: e.Length}] = e
+	}
+	return res
+}
+
+// restore sets cached hashes on layers of unchanged files, and returns layers which still need hashing.
+func (c *digestCache) restore(dir string, layers []v1.Layer, opts *options) ([]v1.Layer, error) {
+	pending := make([]v1.Layer, 0, len(layers))
+	for _, l := range layers {
+		fl, ok := l.(*filesegment.Layer)
+		if !ok {
+			pending = append(pending, l)
+			continue
+		}
+		name := fl.Filename()
+		info, ok := c.stats[name]
+		if !ok {
+			var err error
+			info, err = opts.fs.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+			if err != nil {
+				return nil, fmt.Errorf("unable to stat '%v': %w", name, err)
+			}
+			c.stats[name] = info
+		}
+		e, ok := c.entries[segmentKey{file: name, offset: fl.Start(), length: fl.Length()}]
+		if !ok || e.FileSize != info.Size() || e.ModTime != info.ModTime().UnixNano() || e.Compression != fl.Compression() ||
+			e.Dictionary != fl.ZstdDictionaryID() {
+			pending = append(pending, l)
+			continue
+		}
+		fl.RestoreHashes(e.Hashes)
+	}
+	if restored := len(layers) - len(pending); restored > 0 {
+		opts.printf("reusing cached digests of %d out of %d segments", restored, len(layers))
+	}
+	return pending, nil
+}
+
+// save replaces the cache file with hashes of all layers. Layers whose digest is not known yet
+// (see WithDeferredDigests) are left out, instead of reading them just to compute it.
+func (c *digestCache) save(dir string, layers []v1.Layer, opts *options) error {
+	f := digestCacheFile{Format: digestCacheFormat(opts), Entries: make([]digestCacheEntry, 0, len(layers))}
+	for _, l := range layers {
+		fl, ok := l.(*filesegment.Layer)
+		if !ok {
+			continue
+		}
+		info, ok := c.stats[fl.Filename()]
+		if !ok || !fl.DigestKnown() {
+			continue
+		}
+		h, err := fl.Hashes()
+		if err != nil {
+			return err
+		}
+		f.Entries = append(f.Entries, digestCacheEntry{
+			File:        fl.Filename(),
+			Offset:      fl.Start(),
+			Length:      fl.Length(),
+			FileSize:    info.Size(),
+			ModTime:     info.ModTime().UnixNano(),
+			Compression: fl.Compression(),
+			Dictionary:  fl.ZstdDictionaryID(),
+			Hashes:      h,
+		})
+	}
+	data, err := json.Marshal(&f)
+	if err != nil {
+		return err
+	}
+	return opts.fs.WriteFile(filepath.Join(dir, DigestCacheFilename), data, opts.metadataFileMode)
+}
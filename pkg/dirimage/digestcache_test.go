@@ -0,0 +1,62 @@
+package dirimage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRead_DigestCache(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "disk.img"), 1000))
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "nvram.bin"), 300))
+
+	clock := WithClock(fixedClock{now: time.Now()})
+	read := func(opt ...Option) *DirImage {
+		di, err := Read(context.Background(), dir, append(opt, WithChunkSize(100), clock)...)
+		require.NoError(t, err)
+		return di
+	}
+	digest := func(di *DirImage) string {
+		d, err := di.Digest()
+		require.NoError(t, err)
+		return d.String()
+	}
+
+	first := read(WithDigestCache(true))
+	assert.Equal(t, int64(2*1300), first.BytesReadCount.Load())
+	assert.FileExists(t, filepath.Join(dir, DigestCacheFilename))
+
+	t.Run("unchanged files are not hashed again", func(t *testing.T) {
+		second := read(WithDigestCache(true))
+		assert.Equal(t, int64(0), second.BytesReadCount.Load())
+		assert.Equal(t, digest(first), digest(second))
+	})
+
+	t.Run("files with different modification time are hashed again", func(t *testing.T) {
+		require.NoError(t, generateRandomFile(filepath.Join(dir, "nvram.bin"), 300))
+		later := time.Now().Add(time.Hour)
+		require.NoError(t, os.Chtimes(filepath.Join(dir, "nvram.bin"), later, later))
+
+		cached := read(WithDigestCache(true))
+		assert.Equal(t, int64(2*300), cached.BytesReadCount.Load())
+		assert.Equal(t, digest(read()), digest(cached))
+	})
+
+	t.Run("files with different size are hashed again", func(t *testing.T) {
+		require.NoError(t, generateRandomFile(filepath.Join(dir, "disk.img"), 1050))
+
+		cached := read(WithDigestCache(true))
+		assert.Equal(t, int64(2*1050), cached.BytesReadCount.Load())
+		assert.Equal(t, digest(read()), digest(cached))
+	})
+
+	t.Run("cache of different format is discarded", func(t *testing.T) {
+		cached := read(WithDigestCache(true), WithZeroElision(true))
+		assert.Equal(t, int64(2*1350), cached.BytesReadCount.Load())
+	})
+}
@@ -4,7 +4,9 @@ import (
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/zstd"
 	"sync/atomic"
+	"time"
 )
 
 // https://opencontainers.org/posts/blog/2024-03-13-image-and-distribution-1-1/
@@ -21,7 +23,13 @@ type DirImage struct {
 	BytesSkippedCount atomic.Int64
 
 	directory          string
+	readAt             time.Time
 	segmentDescriptors []*filesegment.Descriptor
+	symlinks           []Symlink
+	directories        []string
+	dictionary         *zstd.Dictionary
+	// layers are the segments read from directory by Read
+	layers []v1.Layer
 }
 
 var _ v1.Image = (*DirImage)(nil)
@@ -33,6 +41,27 @@ func New(dir string, img v1.Image) *DirImage {
 	}
 }
 
+// DeferredLayers returns segments read from the directory whose digests were not computed yet,
+// see WithDeferredDigests. Of segments sharing a blob only the one computing its digest is returned.
+func (di *DirImage) DeferredLayers() []*filesegment.Layer {
+	res := make([]*filesegment.Layer, 0)
+	seen := make(map[string]bool)
+	for _, l := range di.layers {
+		fl, ok := l.(*filesegment.Layer)
+		if !ok || fl.DigestKnown() {
+			continue
+		}
+		if key, err := fl.BlobKey(); err == nil && key != "" {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		res = append(res, fl)
+	}
+	return res
+}
+
 func (di *DirImage) Length() int64 {
 	res := int64(0)
 	for _, d := range di.segmentDescriptors {
@@ -0,0 +1,216 @@
+package dirimage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"path"
+)
+
+// FileFilter selects files of an image by glob patterns (as understood by path.Match).
+// Patterns are matched against the filename as well as against its base name.
+// Empty Include selects all files; Exclude takes precedence over Include.
+type FileFilter struct {
+	Include []string
+	Exclude []string
+}
+
+func (ff FileFilter) IsEmpty() bool {
+	return len(ff.Include) == 0 && len(ff.Exclude) == 0
+}
+
+func matchesAny(patterns []string, filename string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, filename); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, path.Base(filename)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (ff FileFilter) Matches(filename string) bool {
+	if len(ff.Include) > 0 && !matchesAny(ff.Include, filename) {
+		return false
+	}
+	return !matchesAny(ff.Exclude, filename)
+}
+
+// Validate reports malformed patterns, which would otherwise never match anything.
+func (ff FileFilter) Validate() error {
+	for _, p := range append(append([]string{}, ff.Include...), ff.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid file pattern '%v': %w", p, err)
+		}
+	}
+	return nil
+}
+
+// applyFileFilter narrows the image to the selected files, so after Write it describes what is on disk.
+func (di *DirImage) applyFileFilter(filter FileFilter) error {
+	img, err := FilterFiles(di.Image, filter)
+	if err != nil {
+		return err
+	}
+	filtered, err := Convert(img)
+	if err != nil {
+		return err
+	}
+	di.Image = filtered.Image
+	di.segmentDescriptors = filtered.segmentDescriptors
+	di.symlinks = filtered.symlinks
+	di.directories = filtered.directories
+	return nil
+}
+
+type filteredImage struct {
+	v1.Image
+	rawManifest []byte
+	rawConfig   []byte
+	layers      []v1.Hash
+}
+
+var _ v1.Image = (*filteredImage)(nil)
+
+// FilterFiles returns image containing only segments of files selected by the filter.
+// Manifest and config are rewritten accordingly, so the result describes exactly what will be written locally.
+func FilterFiles(img v1.Image, filter FileFilter) (v1.Image, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get manifest: %w", err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get config file: %w", err)
+	}
+	diffIDs := cfg.RootFS.DiffIDs
+	if len(diffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("mismatch between diffIDs (%d) and manifest layers (%d)", len(diffIDs), len(manifest.Layers))
+	}
+	filteredManifest := manifest.DeepCopy()
+	filteredManifest.Layers = make([]v1.Descriptor, 0)
+	filteredCfg := cfg.DeepCopy()
+	filteredCfg.RootFS.DiffIDs = make([]v1.Hash, 0)
+	keepHistory := len(cfg.History) == len(manifest.Layers)
+	if keepHistory {
+		filteredCfg.History = make([]v1.History, 0)
+	}
+	res := &filteredImage{Image: img, layers: make([]v1.Hash, 0)}
+	for i, l := range manifest.Layers {
+		d, err := filesegment.ParseDescriptor(l, diffIDs[i])
+		if err != nil {
+			return nil, err
+		}
+		if !filter.Matches(d.Filename()) {
+			continue
+		}
+		filteredManifest.Layers = append(filteredManifest.Layers, l)
+		filteredCfg.RootFS.DiffIDs = append(filteredCfg.RootFS.DiffIDs, diffIDs[i])
+		if keepHistory {
+			filteredCfg.History = append(filteredCfg.History, cfg.History[i])
+		}
+		res.layers = append(res.layers, l.Digest)
+	}
+	symlinks, err := parseSymlinks(manifest.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	filteredSymlinks := make([]Symlink, 0)
+	for _, l := range symlinks {
+		if filter.Matches(l.Name) {
+			filteredSymlinks = append(filteredSymlinks, l)
+		}
+	}
+	directories, err := parseDirectories(manifest.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	filteredDirectories := make([]string, 0)
+	for _, d := range directories {
+		if filter.Matches(d) {
+			filteredDirectories = append(filteredDirectories, d)
+		}
+	}
+	delete(filteredManifest.Annotations, SymlinksAnnotationKey)
+	delete(filteredManifest.Annotations, DirectoriesAnnotationKey)
+	treeAnnotations, err := manifestAnnotations(filteredSymlinks, filteredDirectories)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range treeAnnotations {
+		if filteredManifest.Annotations == nil {
+			filteredManifest.Annotations = make(map[string]string)
+		}
+		filteredManifest.Annotations[k] = v
+	}
+	if len(filteredManifest.Annotations) == 0 {
+		filteredManifest.Annotations = nil
+	}
+	res.rawConfig, err = json.Marshal(filteredCfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal config file: %w", err)
+	}
+	filteredManifest.Config.Digest, filteredManifest.Config.Size, err = v1.SHA256(bytes.NewReader(res.rawConfig))
+	if err != nil {
+		return nil, err
+	}
+	res.rawManifest, err = json.Marshal(filteredManifest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal manifest: %w", err)
+	}
+	return res, nil
+}
+
+func (fi *filteredImage) RawManifest() ([]byte, error) {
+	return fi.rawManifest, nil
+}
+
+func (fi *filteredImage) Manifest() (*v1.Manifest, error) {
+	return v1.ParseManifest(bytes.NewReader(fi.rawManifest))
+}
+
+func (fi *filteredImage) RawConfigFile() ([]byte, error) {
+	return fi.rawConfig, nil
+}
+
+func (fi *filteredImage) ConfigFile() (*v1.ConfigFile, error) {
+	return v1.ParseConfigFile(bytes.NewReader(fi.rawConfig))
+}
+
+func (fi *filteredImage) ConfigName() (v1.Hash, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(fi.rawConfig))
+	return h, err
+}
+
+func (fi *filteredImage) Digest() (v1.Hash, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(fi.rawManifest))
+	return h, err
+}
+
+func (fi *filteredImage) Size() (int64, error) {
+	return int64(len(fi.rawManifest)), nil
+}
+
+func (fi *filteredImage) MediaType() (types.MediaType, error) {
+	return fi.Image.MediaType()
+}
+
+func (fi *filteredImage) Layers() ([]v1.Layer, error) {
+	res := make([]v1.Layer, 0, len(fi.layers))
+	for _, h := range fi.layers {
+		l, err := fi.Image.LayerByDigest(h)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, l)
+	}
+	return res, nil
+}
@@ -0,0 +1,139 @@
+package dirimage
+
+import (
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// manifestHashes are hashes of segments recorded in the local manifest, which was written at modTime.
+type manifestHashes struct {
+	modTime  time.Time
+	sizes    map[string]int64
+	segments map[segmentKey]manifestSegment
+}
+
+type manifestSegment struct {
+	hashes     filesegment.Hashes
+	descriptor *filesegment.Descriptor
+}
+
+func loadManifestHashes(dir string, opts *options) (*manifestHashes, error) {
+	info, err := opts.fs.Stat(filepath.Join(dir, LocalManifestFilename))
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readManifest(opts.fs, filepath.Join(dir, LocalManifestFilename))
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := prepareConfigFile(dir, true, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.Layers) != len(cfg.RootFS.DiffIDs) {
+		return nil, fmt.Errorf("mismatch between number of layers in manifest and diff IDs in config")
+	}
+	res := &manifestHashes{
+		modTime:  info.ModTime(),
+		sizes:    make(map[string]int64),
+		segments: make(map[segmentKey]manifestSegment),
+	}
+	for i, l := range manifest.Layers {
+		d, err := filesegment.ParseDescriptor(l, cfg.RootFS.DiffIDs[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse descriptor: %w", err)
+		}
+		res.sizes[d.Filename()] = max(res.sizes[d.Filename()], d.Stop()+1)
+		if d.DiffID().Algorithm != opts.digestAlgorithm {
+			continue
+		}
+		zero := d.IsZero()
+		if !zero && opts.zeroElision {
+			// the image could have been made without zero elision
+			zeroDiffID, err := filesegment.ZeroDiffID(d.Length())
+			if err != nil {
+				return nil, err
+			}
+			if zeroDiffID == d.DiffID() {
+				continue
+			}
+		}
+		if zero && !opts.zeroElision {
+			continue
+		}
+		res.segments[segmentKey{file: d.Filename(), offset: d.Start(), length: d.Length()}] = manifestSegment{
+			hashes: filesegment.Hashes{
+				DiffID: d.DiffID(),
+				Digest: d.Digest(),
+				Size:   l.Size,
+				Zero:   zero,
+			},
+			descriptor: d,
+		}
+	}
+	return res, nil
+}
+
+// restoreFromManifest reuses hashes recorded in the local manifest for files which have the expected size
+// and were not modified after the manifest was written. It returns layers which still need hashing.
+func restoreFromManifest(dir string, layers []v1.Layer, opts *options) []v1.Layer {
+	mh, err := loadManifestHashes(dir, opts)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			opts.printf("unable to reuse hashes of local manifest: %v", err)
+		}
+		return layers
+	}
+	unchanged := make(map[string]bool)
+	pending := make([]v1.Layer, 0, len(layers))
+	for _, l := range layers {
+		fl, ok := l.(*filesegment.Layer)
+		if !ok {
+			pending = append(pending, l)
+			continue
+		}
+		name := fl.Filename()
+		ok, seen := unchanged[name]
+		if !seen {
+			info, err := opts.fs.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+			ok = err == nil && info.Size() == mh.sizes[name] && !info.ModTime().After(mh.modTime)
+			unchanged[name] = ok
+		}
+		seg, found := mh.segments[segmentKey{file: name, offset: fl.Start(), length: fl.Length()}]
+		if !ok || !found {
+			pending = append(pending, l)
+			continue
+		}
+		h := seg.hashes
+		// content stored uncompressed could have been found incompressible
+		skipped := !h.Zero && opts.minSavings > 0 && seg.descriptor.Compression() == filesegment.CompressionNone
+		if skipped {
+			h.Compression = filesegment.CompressionNone
+		} else if !fl.SameEncoder(seg.descriptor) {
+			pending = append(pending, l)
+			continue
+		}
+		fl.RestoreHashes(h)
+	}
+	if restored := len(layers) - len(pending); restored > 0 {
+		opts.printf("reusing hashes of %d out of %d segments from local manifest", restored, len(layers))
+	}
+	return pending
+}
+
+// RecordManifest writes config and manifest of image returned by Read into its directory, dated back to when
+// reading started, so WithIncrementalRehash does not trust files modified while they were being hashed.
+func (di *DirImage) RecordManifest(opt ...Option) error {
+	if di.directory == "" || di.readAt.IsZero() {
+		return fmt.Errorf("image was not read from a directory")
+	}
+	opts := makeOptions(opt...)
+	if err := di.writeConfigAndManifest(di.directory, opts); err != nil {
+		return err
+	}
+	return opts.fs.Chtimes(filepath.Join(di.directory, LocalManifestFilename), di.readAt, di.readAt)
+}
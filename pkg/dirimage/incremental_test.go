@@ -0,0 +1,71 @@
+package dirimage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRead_IncrementalRehash(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "disk.img"), 1000))
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "nvram.bin"), 300))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "empty.img"), make([]byte, 200), 0o644))
+
+	clock := WithClock(fixedClock{now: time.Now()})
+	read := func(dir string, opt ...Option) *DirImage {
+		di, err := Read(context.Background(), dir, append(opt, WithChunkSize(100), clock)...)
+		require.NoError(t, err)
+		return di
+	}
+	digest := func(di *DirImage) string {
+		d, err := di.Digest()
+		require.NoError(t, err)
+		return d.String()
+	}
+
+	t.Run("without local manifest everything is hashed", func(t *testing.T) {
+		di := read(dir, WithIncrementalRehash(true))
+		// both zero segments of empty.img are the same blob, which is compressed once
+		assert.Equal(t, int64(2*1500-100), di.BytesReadCount.Load())
+		require.NoError(t, di.RecordManifest())
+	})
+
+	t.Run("unchanged files are not hashed again", func(t *testing.T) {
+		full := read(dir)
+		incremental := read(dir, WithIncrementalRehash(true))
+		assert.Equal(t, int64(0), incremental.BytesReadCount.Load())
+		assert.Equal(t, digest(full), digest(incremental))
+	})
+
+	t.Run("modified files are hashed again", func(t *testing.T) {
+		require.NoError(t, generateRandomFile(filepath.Join(dir, "nvram.bin"), 300))
+		later := time.Now().Add(time.Hour)
+		require.NoError(t, os.Chtimes(filepath.Join(dir, "nvram.bin"), later, later))
+
+		incremental := read(dir, WithIncrementalRehash(true))
+		assert.Equal(t, int64(2*300), incremental.BytesReadCount.Load())
+		assert.Equal(t, digest(read(dir)), digest(incremental))
+	})
+
+	t.Run("zero segments are hashed again when zero elision changes", func(t *testing.T) {
+		incremental := read(dir, WithIncrementalRehash(true), WithZeroElision(true))
+		assert.Equal(t, int64(2*(200+300)-100), incremental.BytesReadCount.Load())
+		assert.Equal(t, digest(read(dir, WithZeroElision(true))), digest(incremental))
+	})
+
+	t.Run("pulled directory is not hashed again", func(t *testing.T) {
+		pulled := t.TempDir()
+		converted, err := Convert(read(dir))
+		require.NoError(t, err)
+		require.NoError(t, converted.Write(context.Background(), pulled))
+
+		incremental := read(pulled, WithIncrementalRehash(true))
+		assert.Equal(t, int64(0), incremental.BytesReadCount.Load())
+		assert.Equal(t, digest(read(dir)), digest(incremental))
+	})
+}
@@ -0,0 +1,46 @@
+package dirimage
+
+import (
+	"fmt"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"path/filepath"
+)
+
+// restoreMetadata applies file attributes recorded in the manifest. Modification time is restored last,
+// because every other change would update it.
+func restoreMetadata(destinationDir string, segmentDescriptors []*filesegment.Descriptor, opts *options) error {
+	for _, d := range segmentDescriptors {
+		m := d.Metadata()
+		if m == nil {
+			continue
+		}
+		path := filepath.Join(destinationDir, d.Filename())
+		if m.Mode != nil && !opts.enforceDataFileMode {
+			if err := opts.fs.Chmod(path, *m.Mode); err != nil {
+				return fmt.Errorf("unable to restore mode of '%v': %w", d.Filename(), err)
+			}
+		}
+		if len(m.Xattrs) > 0 {
+			xfs, ok := opts.fs.(sysenv.XattrFS)
+			if !ok {
+				opts.printf("extended attributes of '%v' not restored: not supported by filesystem\n", d.Filename())
+			}
+			for name, value := range m.Xattrs {
+				if !ok {
+					break
+				}
+				// some attributes are reserved by the system, which should not fail the whole write
+				if err := xfs.SetXattr(path, name, value); err != nil {
+					opts.printf("unable to restore extended attribute '%v' of '%v': %v\n", name, d.Filename(), err)
+				}
+			}
+		}
+		if m.ModTime != nil {
+			if err := opts.fs.Chtimes(path, *m.ModTime, *m.ModTime); err != nil {
+				return fmt.Errorf("unable to restore modification time of '%v': %w", d.Filename(), err)
+			}
+		}
+	}
+	return nil
+}
@@ -1,32 +1,100 @@
 package dirimage
 
 import (
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"github.com/macvmio/geranos/pkg/throttle"
 	"log"
+	"os"
 	"runtime"
+	"sync"
+	"time"
 )
 
 type options struct {
-	workersCount             int
-	chunkSize                int64
-	printf                   func(fmt string, argv ...any)
-	networkFailureRetryCount int
-	progress                 chan<- ProgressUpdate
-	omitLayersContent        bool
+	workersCount        int
+	hashWorkersCount    int
+	chunkSize           int64
+	chunkSizeRules      []ChunkSizeRule
+	maxSegmentsPerFile  int
+	printf              func(fmt string, argv ...any)
+	retryPolicy         RetryPolicy
+	diskSpaceCheck      bool
+	preallocate         bool
+	directIO            bool
+	punchHoles          bool
+	sparseBlockSize     int
+	progress            chan<- ProgressUpdate
+	progressFunc        func(ProgressUpdate)
+	omitLayersContent   bool
+	resume              bool
+	staging             bool
+	fileFilter          FileFilter
+	trustedFiles        map[string]struct{}
+	stallTimeout        time.Duration
+	stallRetry          bool
+	toc                 bool
+	fsync               bool
+	metadataFileMode    os.FileMode
+	dataFileMode        os.FileMode
+	enforceDataFileMode bool
+	owner               *fileOwner
+	fileMetadata        bool
+	xattrs              bool
+	recursive           bool
+	excludePatterns     []string
+	zeroElision         bool
+	digestCache         bool
+	deferDigests        bool
+	incrementalRehash   bool
+	digestAlgorithm     string
+	compression         filesegment.Compression
+	compressionRules    []CompressionRule
+	minSavings          float64
+	compressionLevel    int
+	zstdWindowSize      int
+	seekableFrameSize   int
+	encoderConcurrency  int
+	compressionCPUs     int
+	decoderMaxWindow    uint64
+	decoderMaxMemory    uint64
+	dictionaryFileSize  int64
+	maxBandwidth        int64
+	limiter             *throttle.Limiter
+	fs                  sysenv.FS
+	clock               sysenv.Clock
+	rand                sysenv.Rand
 }
 
 type Option func(opts *options)
 
+type fileOwner struct {
+	uid int
+	gid int
+}
+
 func makeOptions(opts ...Option) *options {
 	res := &options{
-		workersCount:             min(8, runtime.NumCPU()),
-		chunkSize:                64 * 1024 * 1024,
-		printf:                   log.Printf,
-		networkFailureRetryCount: 3,
+		workersCount:     min(8, runtime.NumCPU()),
+		chunkSize:        64 * 1024 * 1024,
+		digestAlgorithm:  filesegment.DefaultDigestAlgorithm,
+		compression:      filesegment.CompressionZstd,
+		printf:           log.Printf,
+		retryPolicy:      DefaultRetryPolicy(),
+		diskSpaceCheck:   true,
+		metadataFileMode: 0o644,
+		dataFileMode:     0o644,
+		fs:               sysenv.OS,
+		clock:            sysenv.SystemClock,
+		rand:             sysenv.SystemRand,
 	}
 
 	for _, o := range opts {
 		o(res)
 	}
+	if res.maxBandwidth > 0 {
+		res.limiter = throttle.NewLimiter(res.maxBandwidth, res.clock)
+	}
 
 	return res
 }
@@ -55,8 +123,300 @@ func WithProgressChannel(progress chan<- ProgressUpdate) Option {
 	}
 }
 
+// WithProgressFunc sets function receiving every progress update. Unlike with WithProgressChannel,
+// no update is ever dropped. The function is called synchronously, one update at a time,
+// so it should return quickly, as it holds back the operation reporting progress.
+func WithProgressFunc(progress func(ProgressUpdate)) Option {
+	var mu sync.Mutex
+	return func(o *options) {
+		o.progressFunc = func(u ProgressUpdate) {
+			mu.Lock()
+			defer mu.Unlock()
+			progress(u)
+		}
+	}
+}
+
 func WithOmitLayersContent() Option {
 	return func(o *options) {
 		o.omitLayersContent = true
 	}
 }
+
+// WithTrustedFiles makes Write take local content of given files as matching the image without reading it,
+// e.g. for files cloned from identical files of another image. Other files are verified as usual.
+func WithTrustedFiles(filenames []string) Option {
+	return func(o *options) {
+		o.trustedFiles = make(map[string]struct{}, len(filenames))
+		for _, f := range filenames {
+			o.trustedFiles[f] = struct{}{}
+		}
+	}
+}
+
+// WithResume enables persisting progress of Write in the destination directory,
+// so an interrupted write of the same image can continue where it left off.
+func WithResume(resume bool) Option {
+	return func(o *options) {
+		o.resume = resume
+	}
+}
+
+// WithStaging makes Write download into a staging directory next to the destination,
+// which replaces the destination only after all segments were written successfully.
+// It can not be combined with WithResume.
+func WithStaging(staging bool) Option {
+	return func(o *options) {
+		o.staging = staging
+	}
+}
+
+// WithFileFilter limits Write to segments of files selected by the filter.
+// Manifest and config written to the destination describe only the selected files.
+func WithFileFilter(filter FileFilter) Option {
+	return func(o *options) {
+		o.fileFilter = filter
+	}
+}
+
+// WithStallTimeout makes Write report a stall (see ProgressUpdate.Stalled) when no bytes have moved
+// for given duration, overall or within a segment. With retry enabled, the stalled segment download
+// is interrupted and started again. Zero timeout disables stall detection.
+func WithStallTimeout(timeout time.Duration, retry bool) Option {
+	return func(o *options) {
+		o.stallTimeout = timeout
+		o.stallRetry = retry
+	}
+}
+
+// WithTOC makes Read produce layers ending with table of contents, see filesegment.WithTOC. It is geranos
+// specific, zstd:chunked and eStargz clients cannot read it.
+func WithTOC(toc bool) Option {
+	return func(o *options) {
+		o.toc = toc
+	}
+}
+
+// WithFsync makes Write flush every segment file to stable storage after writing it,
+// and write manifest and config through synced temporary files.
+func WithFsync(fsync bool) Option {
+	return func(o *options) {
+		o.fsync = fsync
+	}
+}
+
+// WithMetadataFileMode sets permissions of written manifest and config files.
+func WithMetadataFileMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.metadataFileMode = mode
+	}
+}
+
+// WithDataFileMode sets permissions of written image files, including ones which already existed.
+func WithDataFileMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.dataFileMode = mode
+		o.enforceDataFileMode = true
+	}
+}
+
+// WithOwner makes Write change owner of written data and metadata files.
+func WithOwner(uid, gid int) Option {
+	return func(o *options) {
+		o.owner = &fileOwner{uid: uid, gid: gid}
+	}
+}
+
+// WithFileMetadata makes Read record mode bits and modification times of files (and extended attributes
+// if xattrs is set) in the manifest, so Write can restore them.
+func WithFileMetadata(enabled bool, xattrs bool) Option {
+	return func(o *options) {
+		o.fileMetadata = enabled
+		o.xattrs = xattrs
+	}
+}
+
+// WithRecursive makes Read include subdirectories, recording files under their relative paths
+// and empty directories in manifest annotations. Without it subdirectories are skipped.
+func WithRecursive(recursive bool) Option {
+	return func(o *options) {
+		o.recursive = recursive
+	}
+}
+
+// WithExcludePatterns makes Read leave out files, symlinks and directories matching any of the glob
+// patterns (as understood by path.Match), tested against the relative path as well as the base name.
+func WithExcludePatterns(patterns ...string) Option {
+	return func(o *options) {
+		o.excludePatterns = append(o.excludePatterns, patterns...)
+	}
+}
+
+// WithZeroElision makes Read represent segments containing only zeros with empty zero segment blobs,
+// so sparse disks do not have their zeros compressed and uploaded.
+func WithZeroElision(enabled bool) Option {
+	return func(o *options) {
+		o.zeroElision = enabled
+	}
+}
+
+// WithMaxBandwidth limits the rate at which Write reads layer content, in bytes per second,
+// shared by all workers. Zero means no limit.
+func WithMaxBandwidth(bytesPerSecond int64) Option {
+	return func(o *options) {
+		o.maxBandwidth = bytesPerSecond
+	}
+}
+
+// WithRetryPolicy controls how failed segment downloads are retried, see RetryPolicy.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(o *options) {
+		o.retryPolicy = policy
+	}
+}
+
+// WithDiskSpaceCheck controls whether Write fails early with ErrInsufficientSpace when the destination
+// filesystem has less free space than the image may need. Enabled by default.
+func WithDiskSpaceCheck(enabled bool) Option {
+	return func(o *options) {
+		o.diskSpaceCheck = enabled
+	}
+}
+
+// WithPreallocation makes Write reserve blocks for whole files before writing segments, so files do not fragment
+// as segments land out of order. Files are not sparse then, which suits images without large runs of zeros.
+func WithPreallocation(enabled bool) Option {
+	return func(o *options) {
+		o.preallocate = enabled
+	}
+}
+
+// WithDirectIO keeps written segments out of the page cache, so large pulls do not evict data of other processes.
+// macOS writes with F_NOCACHE, Linux flushes every segment and drops it from the cache right after writing it.
+func WithDirectIO(enabled bool) Option {
+	return func(o *options) {
+		o.directIO = enabled
+	}
+}
+
+// WithHolePunching makes Write deallocate blocks of existing files where pulled segments replace data with zeros,
+// so space zeroed in the image is reclaimed locally, see sparsefile.WithHolePunching.
+func WithHolePunching(enabled bool) Option {
+	return func(o *options) {
+		o.punchHoles = enabled
+	}
+}
+
+// WithSparseBlockSize sets size of blocks Write compares with existing content of files, see sparsefile.WithBlockSize.
+func WithSparseBlockSize(size int) Option {
+	return func(o *options) {
+		o.sparseBlockSize = size
+	}
+}
+
+// WithHashWorkersCount sets how many segments Read hashes at the same time, across files and within them.
+// Hashing includes compression, so it is bound by CPU rather than by network like writing. Defaults to WithWorkersCount.
+func WithHashWorkersCount(count int) Option {
+	return func(o *options) {
+		o.hashWorkersCount = count
+	}
+}
+
+// hashWorkers returns how many segments Read hashes at the same time.
+func (o *options) hashWorkers() int {
+	if o.hashWorkersCount > 0 {
+		return o.hashWorkersCount
+	}
+	return max(o.workersCount, 1)
+}
+
+func WithFileSystem(fsys sysenv.FS) Option {
+	return func(o *options) {
+		o.fs = fsys
+	}
+}
+
+// FileSystem returns filesystem configured by WithFileSystem, so code driving dirimage can write where it does.
+func FileSystem(opt ...Option) sysenv.FS {
+	return makeOptions(opt...).fs
+}
+
+func WithClock(clock sysenv.Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+func WithRandSource(rand sysenv.Rand) Option {
+	return func(o *options) {
+		o.rand = rand
+	}
+}
+
+// WithDigestCache makes Read remember digests of segments in DigestCacheFilename, and reuse them
+// for files whose size and modification time did not change since, instead of hashing them again.
+// It has no effect together with WithTOC, as table of contents needs the content anyway.
+func WithDigestCache(enabled bool) Option {
+	return func(o *options) {
+		o.digestCache = enabled
+	}
+}
+
+// WithDeferredDigests makes Read compute only DiffIDs of segments, leaving digests of compressed blobs
+// to be computed when first needed. Uploading with filesegment.Layer's StreamCompressed computes them
+// on the way, so content is not read and compressed once more just to hash it.
+func WithDeferredDigests(enabled bool) Option {
+	return func(o *options) {
+		o.deferDigests = enabled
+	}
+}
+
+// WithIncrementalRehash makes Read reuse hashes recorded in the local manifest of the directory for files
+// which kept their size and were not modified after the manifest was written, so only changed files are hashed.
+func WithIncrementalRehash(enabled bool) Option {
+	return func(o *options) {
+		o.incrementalRehash = enabled
+	}
+}
+
+// WithDigestAlgorithm selects algorithm of DiffIDs and digests of segments created by Read.
+// Write always verifies segments with the algorithm declared by the manifest.
+func WithDigestAlgorithm(algorithm string) Option {
+	return func(o *options) {
+		o.digestAlgorithm = algorithm
+	}
+}
+
+// layerOptions translates options relevant for reading and writing segments.
+func (o *options) layerOptions() []filesegment.LayerOpt {
+	res := []filesegment.LayerOpt{
+		filesegment.WithLogFunction(o.printf),
+		filesegment.WithFileSystem(o.fs),
+		filesegment.WithDigestAlgorithm(o.digestAlgorithm),
+	}
+	if o.toc {
+		res = append(res, filesegment.WithTOC())
+	}
+	if o.fileMetadata {
+		res = append(res, filesegment.WithFileMetadata(o.xattrs))
+	}
+	if o.zeroElision {
+		res = append(res, filesegment.WithZeroDetection())
+	}
+	if o.compressionLevel > 0 {
+		res = append(res, filesegment.WithZstdLevel(o.compressionLevel))
+	}
+	if c := o.zstdConcurrency(); c > 1 {
+		res = append(res, filesegment.WithZstdConcurrency(c))
+	}
+	if o.zstdWindowSize > 0 {
+		res = append(res, filesegment.WithZstdWindowSize(o.zstdWindowSize))
+	}
+	if o.seekableFrameSize > 0 {
+		res = append(res, filesegment.WithSeekableZstd(o.seekableFrameSize))
+	}
+	if o.minSavings > 0 {
+		res = append(res, filesegment.WithSkipIncompressible(o.minSavings))
+	}
+	return res
+}
@@ -6,8 +6,8 @@ import (
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/sysenv"
 	"io"
-	"os"
 	"path/filepath"
 )
 
@@ -56,8 +56,8 @@ func (l *placeholderLayer) Annotations() map[string]string {
 	return l.annotations
 }
 
-func readManifest(filePath string) (*v1.Manifest, error) {
-	data, err := os.ReadFile(filePath)
+func readManifest(fsys sysenv.FS, filePath string) (*v1.Manifest, error) {
+	data, err := fsys.ReadFile(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("unable to read manifest file: %w", err)
 	}
@@ -71,10 +71,10 @@ func readManifest(filePath string) (*v1.Manifest, error) {
 	return &manifest, nil
 }
 
-func prepareLayersFromManifestAndConfig(dir string, cfgFile *v1.ConfigFile) ([]v1.Layer, error) {
+func prepareLayersFromManifestAndConfig(fsys sysenv.FS, dir string, cfgFile *v1.ConfigFile) ([]v1.Layer, error) {
 	// Read the manifest file
 	manifestPath := filepath.Join(dir, LocalManifestFilename)
-	manifest, err := readManifest(manifestPath)
+	manifest, err := readManifest(fsys, manifestPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read manifest file: %w", err)
 	}
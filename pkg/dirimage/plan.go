@@ -0,0 +1,100 @@
+package dirimage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/filesegment"
+)
+
+// SegmentAction says how Write would get a segment in place.
+type SegmentAction string
+
+const (
+	// SegmentPresent segments already match local content.
+	SegmentPresent SegmentAction = "present"
+	// SegmentCloned segments come with a file cloned from another local image.
+	SegmentCloned SegmentAction = "cloned"
+	// SegmentZero segments contain only zeros and are materialized locally.
+	SegmentZero SegmentAction = "zero"
+	// SegmentDownload segments have to be downloaded.
+	SegmentDownload SegmentAction = "download"
+)
+
+// PlannedSegment describes single segment of WritePlan. Source is the file it is cloned from, if any.
+type PlannedSegment struct {
+	ID       filesegment.SegmentID `json:"id"`
+	Filename string                `json:"filename"`
+	Start    int64                 `json:"start"`
+	Stop     int64                 `json:"stop"`
+	Digest   v1.Hash               `json:"digest"`
+	Action   SegmentAction         `json:"action"`
+	Source   string                `json:"source,omitempty"`
+}
+
+func (ps *PlannedSegment) Length() int64 {
+	return ps.Stop - ps.Start + 1
+}
+
+// WritePlan lists what Write would do with every segment of the image.
+type WritePlan struct {
+	Segments []PlannedSegment `json:"segments"`
+}
+
+// Count returns number of segments and their total length for given action.
+func (wp *WritePlan) Count(action SegmentAction) (segments int, bytes int64) {
+	for i := range wp.Segments {
+		if wp.Segments[i].Action == action {
+			segments++
+			bytes += wp.Segments[i].Length()
+		}
+	}
+	return segments, bytes
+}
+
+// Plan reports what Write would do with destinationDir, without changing anything. It reads only local files
+// and descriptors of the image, so no layer content is accessed.
+func (di *DirImage) Plan(ctx context.Context, destinationDir string, opt ...Option) (*WritePlan, error) {
+	if di.Image == nil {
+		return nil, errors.New("invalid image")
+	}
+	opts := makeOptions(opt...)
+	if !opts.fileFilter.IsEmpty() {
+		if err := di.applyFileFilter(opts.fileFilter); err != nil {
+			return nil, err
+		}
+	}
+	zeroSegments, err := findZeroSegments(di.segmentDescriptors, opts)
+	if err != nil {
+		return nil, err
+	}
+	mismatched, err := di.findMismatchedSegments(ctx, destinationDir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify segments: %w", err)
+	}
+	isMismatched := make(map[int]bool, len(mismatched))
+	for _, idx := range mismatched {
+		isMismatched[idx] = true
+	}
+	res := &WritePlan{Segments: make([]PlannedSegment, 0, len(di.segmentDescriptors))}
+	for i, d := range di.segmentDescriptors {
+		action := SegmentPresent
+		switch {
+		case !isMismatched[i]:
+		case zeroSegments[i]:
+			action = SegmentZero
+		default:
+			action = SegmentDownload
+		}
+		res.Segments = append(res.Segments, PlannedSegment{
+			ID:       d.ID(),
+			Filename: d.Filename(),
+			Start:    d.Start(),
+			Stop:     d.Stop(),
+			Digest:   d.Digest(),
+			Action:   action,
+		})
+	}
+	return res, nil
+}
@@ -1,6 +1,141 @@
 package dirimage
 
+import (
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"sync"
+	"time"
+)
+
+// Phase names the kind of work a ProgressUpdate reports on.
+type Phase string
+
+const (
+	PhaseHashing     Phase = "hashing"
+	PhaseCloning     Phase = "cloning"
+	PhaseDownloading Phase = "downloading"
+	PhaseVerifying   Phase = "verifying"
+)
+
 type ProgressUpdate struct {
 	BytesProcessed int64
 	BytesTotal     int64
+	// Phase is the kind of work being done. BytesProcessed and BytesTotal cover the whole operation,
+	// e.g. hashing during Read, or verifying and downloading during Write.
+	Phase Phase
+	// Filename is the file the update is about, with FileBytesProcessed out of FileBytesTotal of it done
+	// so far. SegmentID identifies the segment within the image, when known.
+	Filename           string
+	SegmentID          *filesegment.SegmentID
+	FileBytesProcessed int64
+	FileBytesTotal     int64
+	// Stalled is set on updates reporting that no bytes have moved for StalledFor.
+	// StalledSegment names the stalled segment and StalledSegmentID identifies it;
+	// both are empty when the whole transfer stalled.
+	Stalled          bool
+	StalledFor       time.Duration
+	StalledSegment   string
+	StalledSegmentID *filesegment.SegmentID
+}
+
+// ReportProgress delivers update to the progress consumer configured by options, if any.
+// It lets code driving dirimage (like sketching in layout) report phases happening outside of it.
+func ReportProgress(update ProgressUpdate, opt ...Option) {
+	makeOptions(opt...).reportProgress(update)
+}
+
+// LogFunction returns function logging messages, configured by WithLogFunction.
+// Like ReportProgress, it lets code driving dirimage log the way dirimage does.
+func LogFunction(opt ...Option) func(fmt string, args ...any) {
+	return makeOptions(opt...).printf
+}
+
+// reportProgress calls progress function, and offers the update to progress channel unless
+// the consumer is not keeping up, in which case it is dropped.
+func (o *options) reportProgress(update ProgressUpdate) {
+	if o.progressFunc != nil {
+		o.progressFunc(update)
+	}
+	select {
+	case o.progress <- update:
+	default:
+	}
+}
+
+type fileProgress struct {
+	processed int64
+	total     int64
+}
+
+// progressTracker counts bytes processed by an operation, overall and per file. Updates are reported
+// while holding the lock, so the consumer sees BytesProcessed in the order it was counted.
+type progressTracker struct {
+	opts      *options
+	mu        sync.Mutex
+	processed int64
+	total     int64
+	files     map[string]*fileProgress
+}
+
+func newProgressTracker(opts *options) *progressTracker {
+	return &progressTracker{
+		opts:  opts,
+		files: make(map[string]*fileProgress),
+	}
+}
+
+// Expect adds length bytes of filename to the totals. All calls have to happen before counting starts.
+func (pt *progressTracker) Expect(filename string, length int64) {
+	fp, ok := pt.files[filename]
+	if !ok {
+		fp = &fileProgress{}
+		pt.files[filename] = fp
+	}
+	fp.total += length
+	pt.total += length
+}
+
+// Start reports the totals before anything was processed.
+func (pt *progressTracker) Start(phase Phase) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.opts.reportProgress(ProgressUpdate{BytesTotal: pt.total, Phase: phase})
+}
+
+// Add counts n bytes of the file as processed in given phase, and reports it.
+// Negative n takes back bytes of failed attempt, which will be processed again.
+func (pt *progressTracker) Add(phase Phase, filename string, id *filesegment.SegmentID, n int64) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.processed += n
+	u := ProgressUpdate{
+		BytesProcessed: pt.processed,
+		BytesTotal:     pt.total,
+		Phase:          phase,
+		Filename:       filename,
+		SegmentID:      id,
+	}
+	if fp, ok := pt.files[filename]; ok {
+		fp.processed += n
+		u.FileBytesProcessed = fp.processed
+		u.FileBytesTotal = fp.total
+	}
+	if n > 0 {
+		pt.opts.reportProgress(u)
+	}
+}
+
+// AddSegment is Add for the whole segment.
+func (pt *progressTracker) AddSegment(phase Phase, d *filesegment.Descriptor) {
+	id := d.ID()
+	pt.Add(phase, d.Filename(), &id, d.Length())
+}
+
+func (pt *progressTracker) Processed() int64 {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return pt.processed
+}
+
+func (pt *progressTracker) Total() int64 {
+	return pt.total
 }
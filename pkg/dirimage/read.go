@@ -11,7 +11,6 @@ import (
 	"golang.org/x/sync/errgroup"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -24,21 +23,105 @@ type hasLength interface {
 	Length() int64
 }
 
-func precomputeHashes(ctx context.Context, layers []v1.Layer, workersCount int) (bytesReadCount int64, err error) {
-	jobs := make(chan v1.Layer, workersCount)
-	g, ctx := errgroup.WithContext(ctx)
+type hasFilename interface {
+	Filename() string
+}
+
+func layerFilename(l v1.Layer) string {
+	if fl, ok := l.(hasFilename); ok {
+		return fl.Filename()
+	}
+	return ""
+}
+
+// precomputeHashes computes DiffIDs of pending layers, and their digests unless deferDigests is set.
+// Segments of the same blob share its digest, see shareBlobs, so each blob is compressed once.
+func precomputeHashes(ctx context.Context, layers []v1.Layer, pending []v1.Layer, workersCount int, deferDigests bool, progress *progressTracker) (bytesReadCount int64, err error) {
+	for _, l := range pending {
+		if hl, ok := l.(hasLength); ok {
+			progress.Expect(layerFilename(l), hl.Length())
+		}
+	}
+	progress.Start(PhaseHashing)
 
 	var aBytesReadCount atomic.Int64
+	err = forEachLayer(ctx, pending, workersCount, func(l v1.Layer) error {
+		if _, err := l.DiffID(); err != nil {
+			return fmt.Errorf("unable to hash '%v': %w", layerFilename(l), err)
+		}
+		hl, ok := l.(hasLength)
+		if !ok {
+			return fmt.Errorf("layer does not implement Length() method")
+		}
+		aBytesReadCount.Add(hl.Length())
+		progress.Add(PhaseHashing, layerFilename(l), nil, hl.Length())
+		return nil
+	})
+	if err != nil {
+		return aBytesReadCount.Load(), err
+	}
+	shared, err := shareBlobs(layers)
+	if err != nil || deferDigests {
+		return aBytesReadCount.Load(), err
+	}
+	compressed := make([]v1.Layer, 0, len(pending))
+	for _, l := range pending {
+		if !shared[l] {
+			compressed = append(compressed, l)
+		}
+	}
+	err = forEachLayer(ctx, compressed, workersCount, func(l v1.Layer) error {
+		if _, err := l.Digest(); err != nil {
+			return fmt.Errorf("unable to hash compressed '%v': %w", layerFilename(l), err)
+		}
+		if hl, ok := l.(hasLength); ok {
+			aBytesReadCount.Add(hl.Length())
+		}
+		return nil
+	})
+	return aBytesReadCount.Load(), err
+}
+
+// shareBlobs makes segments with the same content and encoder settings, like duplicated partitions,
+// take their digest from the first of them. It returns segments which got it this way.
+func shareBlobs(layers []v1.Layer) (map[v1.Layer]bool, error) {
+	first := make(map[string]*filesegment.Layer)
+	shared := make(map[v1.Layer]bool)
+	for _, l := range layers {
+		fl, ok := l.(*filesegment.Layer)
+		if !ok {
+			continue
+		}
+		key, err := fl.BlobKey()
+		if err != nil {
+			return nil, fmt.Errorf("unable to hash '%v': %w", fl.Filename(), err)
+		}
+		if key == "" {
+			continue
+		}
+		source, ok := first[key]
+		if !ok {
+			first[key] = fl
+			continue
+		}
+		if !fl.DigestKnown() {
+			fl.ShareBlob(source)
+			shared[l] = true
+		}
+	}
+	return shared, nil
+}
+
+// forEachLayer calls fn for layers using workersCount goroutines, stopping at the first error.
+func forEachLayer(ctx context.Context, layers []v1.Layer, workersCount int, fn func(l v1.Layer) error) error {
+	jobs := make(chan v1.Layer, workersCount)
+	g, ctx := errgroup.WithContext(ctx)
 	for w := 0; w < workersCount; w++ {
 		g.Go(func() error {
 			for l := range jobs {
-				_, _ = l.DiffID()
-				_, _ = l.Digest()
-				hl, ok := l.(hasLength)
-				if !ok {
-					return fmt.Errorf("layer does not implement Length() method")
+				if err := fn(l); err != nil {
+					return err
 				}
-				aBytesReadCount.Add(2 * hl.Length())
 			}
 			return nil
 		})
@@ -54,17 +137,10 @@ func precomputeHashes(ctx context.Context, layers []v1.Layer, workersCount int)
 		}
 		return nil
 	})
-
-	err = g.Wait()
-	return aBytesReadCount.Load(), err
+	return g.Wait()
 }
 
-func prepareLayers(dir string, cfgFile *v1.ConfigFile, opts *options) ([]v1.Layer, error) {
-	dirEntries, err := os.ReadDir(dir)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read directory: '%v': %w", dir, err)
-	}
-
+func prepareLayers(dir string, tree *dirTree, cfgFile *v1.ConfigFile, opts *options) ([]v1.Layer, error) {
 	layers := make([]v1.Layer, 0)
 	if opts.omitLayersContent {
 		// Use the RootFS from the config file
@@ -72,20 +148,30 @@ func prepareLayers(dir string, cfgFile *v1.ConfigFile, opts *options) ([]v1.Laye
 			return nil, fmt.Errorf("config file must contain RootFS when omitting layer content")
 		}
 		// Read manifest and config files to reconstruct layers without content
-		return prepareLayersFromManifestAndConfig(dir, cfgFile)
+		return prepareLayersFromManifestAndConfig(opts.fs, dir, cfgFile)
 	}
 
-	for _, entry := range dirEntries {
-		if entry.IsDir() {
-			opts.printf("unexpected subdirectory '%v', skipping", entry.Name())
-			continue
+	if err := validateChunkSizeRules(opts.chunkSizeRules); err != nil {
+		return nil, err
+	}
+	if err := validateCompressionRules(opts.compressionRules); err != nil {
+		return nil, err
+	}
+	for _, name := range tree.files {
+		fullPath := filepath.Join(dir, filepath.FromSlash(name))
+		var size int64
+		if opts.maxSegmentsPerFile > 0 || tree.dictionary != nil {
+			info, err := opts.fs.Stat(fullPath)
+			if err != nil {
+				return nil, fmt.Errorf("unable to stat '%v': %w", name, err)
+			}
+			size = info.Size()
 		}
-		if strings.HasPrefix(entry.Name(), ".") {
-			opts.printf("skipping file '%v' because it starts with a dot", entry.Name())
-			continue
+		layerOpts := append(opts.layerOptions(), filesegment.WithFilename(name), filesegment.WithCompression(opts.compressionFor(name)))
+		if tree.dictionary != nil && opts.usesDictionary(name, size) {
+			layerOpts = append(layerOpts, filesegment.WithZstdDictionary(tree.dictionary))
 		}
-
-		fileLayers, err := filesegment.Split(filepath.Join(dir, entry.Name()), opts.chunkSize, filesegment.WithLogFunction(opts.printf))
+		fileLayers, err := filesegment.Split(fullPath, opts.chunkSizeFor(name, size), layerOpts...)
 		if err != nil {
 			return nil, err
 		}
@@ -97,6 +183,41 @@ func prepareLayers(dir string, cfgFile *v1.ConfigFile, opts *options) ([]v1.Laye
 	return layers, nil
 }
 
+// prepareTree scans dir, or takes symlinks, empty directories and dictionary from the stored manifest
+// when omitting layers content.
+func prepareTree(dir string, opts *options) (*dirTree, error) {
+	if !opts.omitLayersContent {
+		tree, err := scanDirectory(dir, opts)
+		if err != nil {
+			return nil, err
+		}
+		if opts.dictionaryFileSize > 0 && !opts.toc {
+			tree.dictionary, err = trainDictionary(dir, tree, opts)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return tree, nil
+	}
+	manifest, err := readManifest(opts.fs, filepath.Join(dir, LocalManifestFilename))
+	if err != nil {
+		return nil, err
+	}
+	symlinks, err := parseSymlinks(manifest.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	directories, err := parseDirectories(manifest.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	dictionary, err := parseDictionary(manifest.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	return &dirTree{symlinks: symlinks, directories: directories, dictionary: dictionary}, nil
+}
+
 func prepareAddendums(layers []v1.Layer) ([]mutate.Addendum, error) {
 	addendums := make([]mutate.Addendum, 0)
 	for _, l := range layers {
@@ -145,19 +266,20 @@ func prepareImage(cfg *v1.ConfigFile, addendums []mutate.Addendum) (v1.Image, er
 	return img, nil
 }
 
-func prepareConfigFile(dir string, requireFile bool) (*v1.ConfigFile, error) {
+func prepareConfigFile(dir string, requireFile bool, opts *options) (*v1.ConfigFile, error) {
 	configFilePath := filepath.Join(dir, LocalConfigFilename)
 
-	data, err := os.ReadFile(configFilePath)
+	data, err := opts.fs.ReadFile(configFilePath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			if requireFile {
 				return nil, fmt.Errorf("config file is required when skipVerification is true")
 			}
 			// File does not exist, return a new config
+			now := opts.clock.Now()
 			return &v1.ConfigFile{
 				Container: "geranos",
-				Created:   v1.Time{Time: time.Now()},
+				Created:   v1.Time{Time: now},
 				Config: v1.Config{
 					Labels: map[string]string{
 						"org.opencontainers.image.title":       "geranos",
@@ -166,7 +288,7 @@ func prepareConfigFile(dir string, requireFile bool) (*v1.ConfigFile, error) {
 						"org.opencontainers.image.url":         "https://github.com/macvmio/geranos",
 						"org.opencontainers.image.source":      "https://github.com/macvmio/geranos",
 						//"org.opencontainers.image.version":     "", // Replace with your actual version
-						"org.opencontainers.image.created":  time.Now().Format(time.RFC3339),
+						"org.opencontainers.image.created":  now.Format(time.RFC3339),
 						"org.opencontainers.image.licenses": "Apache-2.0", // Replace with your license
 					},
 				},
@@ -184,8 +306,9 @@ func prepareConfigFile(dir string, requireFile bool) (*v1.ConfigFile, error) {
 	return cfg, nil
 }
 
-func computeRootFS(ctx context.Context, layers []v1.Layer, opts *options) (v1.RootFS, int64, error) {
-	bytesReadCount, err := precomputeHashes(ctx, layers, opts.workersCount)
+// computeRootFS hashes pending layers, which are all layers unless some hashes were restored from the digest cache.
+func computeRootFS(ctx context.Context, layers []v1.Layer, pending []v1.Layer, opts *options) (v1.RootFS, int64, error) {
+	bytesReadCount, err := precomputeHashes(ctx, layers, pending, opts.hashWorkers(), opts.deferDigests, newProgressTracker(opts))
 	if err != nil {
 		return v1.RootFS{}, bytesReadCount, fmt.Errorf("error occurrent while precomputing hashes: %w", err)
 	}
@@ -202,20 +325,42 @@ func computeRootFS(ctx context.Context, layers []v1.Layer, opts *options) (v1.Ro
 
 func Read(ctx context.Context, dir string, opt ...Option) (*DirImage, error) {
 	opts := makeOptions(opt...)
-	cfgFile, err := prepareConfigFile(dir, opts.omitLayersContent)
+	readAt := opts.clock.Now()
+	cfgFile, err := prepareConfigFile(dir, opts.omitLayersContent, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare config file: %w", err)
 	}
 
-	layers, err := prepareLayers(dir, cfgFile, opts)
+	tree, err := prepareTree(dir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan directory: %w", err)
+	}
+	layers, err := prepareLayers(dir, tree, cfgFile, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare layers: %w", err)
 	}
+	pending := layers
+	var cache *digestCache
+	if opts.digestCache && !opts.omitLayersContent && !opts.toc {
+		cache = loadDigestCache(dir, opts)
+		pending, err = cache.restore(dir, layers, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore cached digests: %w", err)
+		}
+	}
+	if opts.incrementalRehash && !opts.omitLayersContent && !opts.toc {
+		pending = restoreFromManifest(dir, pending, opts)
+	}
 	var bytesReadCount int64
-	cfgFile.RootFS, bytesReadCount, err = computeRootFS(ctx, layers, opts)
+	cfgFile.RootFS, bytesReadCount, err = computeRootFS(ctx, layers, pending, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to compute root filesystem: %w", err)
 	}
+	if cache != nil {
+		if err := cache.save(dir, layers, opts); err != nil {
+			opts.printf("unable to save digest cache: %v", err)
+		}
+	}
 
 	addendums, err := prepareAddendums(layers)
 	if err != nil {
@@ -225,10 +370,23 @@ func Read(ctx context.Context, dir string, opt ...Option) (*DirImage, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare image: %w", err)
 	}
+	annotations, err := manifestAnnotations(tree.symlinks, tree.directories)
+	if err != nil {
+		return nil, err
+	}
+	annotations = addDictionaryAnnotation(annotations, tree.dictionary)
+	if annotations != nil {
+		img = mutate.Annotations(img, annotations).(v1.Image)
+	}
 	res := &DirImage{
 		Image:          img,
 		BytesReadCount: atomic.Int64{},
 		directory:      dir,
+		readAt:         readAt,
+		symlinks:       tree.symlinks,
+		directories:    tree.directories,
+		dictionary:     tree.dictionary,
+		layers:         layers,
 		// TODO: Descriptors
 	}
 	res.BytesReadCount.Store(bytesReadCount)
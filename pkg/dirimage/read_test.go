@@ -19,7 +19,7 @@ import (
 // TestPrepareConfigFile_NewConfig tests prepareConfigFile when the config file does not exist.
 func TestPrepareConfigFile_NewConfig(t *testing.T) {
 	dir := t.TempDir() // Create a temporary directory
-	cfg, err := prepareConfigFile(dir, false)
+	cfg, err := prepareConfigFile(dir, false, makeOptions())
 	if err != nil {
 		t.Fatalf("prepareConfigFile returned error: %v", err)
 	}
@@ -59,7 +59,7 @@ func TestPrepareConfigFile_ExistingConfig(t *testing.T) {
 		t.Fatalf("Failed to write config file: %v", err)
 	}
 
-	cfg, err := prepareConfigFile(dir, false)
+	cfg, err := prepareConfigFile(dir, false, makeOptions())
 	if err != nil {
 		t.Fatalf("prepareConfigFile returned error: %v", err)
 	}
@@ -99,7 +99,9 @@ func TestPrepareLayers(t *testing.T) {
 		// Create a dummy config file (not required in this case but included for completeness)
 		cfgFile := &v1.ConfigFile{}
 
-		layers, err := prepareLayers(dir, cfgFile, opts)
+		tree, err := prepareTree(dir, opts)
+		require.NoError(t, err)
+		layers, err := prepareLayers(dir, tree, cfgFile, opts)
 		require.NoError(t, err, "prepareLayers returned error")
 
 		// Since files are split into chunks, we need to calculate the expected number of layers
@@ -171,10 +173,12 @@ func TestPrepareLayers(t *testing.T) {
 		require.NoError(t, err, "Failed to write manifest file")
 
 		// Read the config file back (to simulate real usage)
-		cfgFileRead, err := prepareConfigFile(dir, true)
+		cfgFileRead, err := prepareConfigFile(dir, true, makeOptions())
 		require.NoError(t, err, "prepareConfigFile returned error")
 
-		layers, err := prepareLayers(dir, cfgFileRead, opts)
+		tree, err := prepareTree(dir, opts)
+		require.NoError(t, err)
+		layers, err := prepareLayers(dir, tree, cfgFileRead, opts)
 		require.NoError(t, err, "prepareLayers returned error")
 
 		expectedLayerCount := len(cfgFile.RootFS.DiffIDs)
@@ -366,7 +370,7 @@ func TestComputeRootFS(t *testing.T) {
 	opts := makeOptions()
 
 	// Call computeRootFS
-	rootFS, bytesReadCount, err := computeRootFS(ctx, layers, opts)
+	rootFS, bytesReadCount, err := computeRootFS(ctx, layers, layers, opts)
 	require.NoError(t, err, "computeRootFS returned an error")
 
 	// Expected bytes read: sum of content lengths * 2 (for DiffID and Digest)
@@ -670,3 +674,104 @@ func TestReadWriteReadOmitLayers(t *testing.T) {
 	configFile2.Created = configFile1.Created
 	assert.Equal(t, configFile1, configFile2, "Config files should be equal")
 }
+
+func TestRead_ExcludePatterns(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "Caches", "blobs"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "Logs"), 0o755))
+	for _, name := range []string{"disk.img", "disk.img.lock", filepath.Join("Caches", "blobs", "a.bin"), filepath.Join("Logs", "vm.log")} {
+		require.NoError(t, generateRandomFile(filepath.Join(dir, name), 10))
+	}
+
+	img, err := Read(context.Background(), dir, WithRecursive(true), WithExcludePatterns("*.lock", "Caches", "Logs/*.log"))
+	require.NoError(t, err)
+	manifest, err := img.Manifest()
+	require.NoError(t, err)
+	require.Len(t, manifest.Layers, 1)
+	assert.Equal(t, "disk.img", manifest.Layers[0].Annotations[filesegment.FilenameAnnotationKey])
+	assert.JSONEq(t, `["Logs"]`, manifest.Annotations[DirectoriesAnnotationKey])
+
+	_, err = Read(context.Background(), dir, WithExcludePatterns("["))
+	assert.Error(t, err)
+}
+
+func TestRead_HashWorkersCount(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "disk.img"), 1000))
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "nvram.bin"), 300))
+
+	clock := WithClock(fixedClock{now: time.Now()})
+	sequential, err := Read(context.Background(), dir, WithChunkSize(100), WithHashWorkersCount(1), clock)
+	require.NoError(t, err)
+	expected, err := sequential.Digest()
+	require.NoError(t, err)
+
+	var last ProgressUpdate
+	parallel, err := Read(context.Background(), dir, WithChunkSize(100), WithHashWorkersCount(6), clock,
+		WithProgressFunc(func(u ProgressUpdate) {
+			last = u
+		}))
+	require.NoError(t, err)
+	digest, err := parallel.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, expected, digest)
+	assert.Equal(t, PhaseHashing, last.Phase)
+	assert.Equal(t, int64(1300), last.BytesProcessed)
+	assert.Equal(t, int64(1300), last.BytesTotal)
+}
+
+func TestRead_SharedBlobs(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "disk.img"), 300))
+	content, err := os.ReadFile(filepath.Join(dir, "disk.img"))
+	require.NoError(t, err)
+	// duplicated partition: the same content in another file, and again within the file
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "copy.img"), append(content[:100:100], content[:100]...), 0o644))
+
+	di, err := Read(context.Background(), dir, WithChunkSize(100))
+	require.NoError(t, err)
+	// uncompressed content is hashed fully, but of 5 segments only 3 distinct blobs are compressed
+	assert.Equal(t, int64(500+300), di.BytesReadCount.Load())
+	layers, err := di.Layers()
+	require.NoError(t, err)
+	digests := make(map[v1.Hash]int)
+	for _, l := range layers {
+		digest, err := l.Digest()
+		require.NoError(t, err)
+		digests[digest]++
+	}
+	assert.Len(t, digests, 3)
+
+	expected, err := filesegment.NewLayer(filepath.Join(dir, "copy.img"), filesegment.WithRange(100, 199))
+	require.NoError(t, err)
+	expectedDigest, err := expected.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, 3, digests[expectedDigest])
+}
+
+func TestRead_ChunkSizeRules(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "disk.img"), 1000))
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "nvram.bin"), 300))
+	require.NoError(t, generateRandomFile(filepath.Join(dir, "config.json"), 250))
+
+	di, err := Read(context.Background(), dir, WithChunkSize(100), WithChunkSizeRules(
+		ChunkSizeRule{Pattern: "*.img", ChunkSize: 400},
+		ChunkSizeRule{Pattern: "*.json", ChunkSize: WholeFileChunkSize},
+		ChunkSizeRule{Pattern: "disk.*", ChunkSize: 10},
+	))
+	require.NoError(t, err)
+	layers, err := di.Layers()
+	require.NoError(t, err)
+	ranges := make(map[string][]string)
+	for _, l := range layers {
+		annotations := l.(hasAnnotations).Annotations()
+		ranges[annotations[filesegment.FilenameAnnotationKey]] = append(ranges[annotations[filesegment.FilenameAnnotationKey]], annotations[filesegment.RangeAnnotationKey])
+	}
+	assert.Equal(t, []string{"0-399", "400-799", "800-999"}, ranges["disk.img"])
+	assert.Equal(t, []string{"0-249"}, ranges["config.json"])
+	assert.Equal(t, []string{"0-99", "100-199", "200-299"}, ranges["nvram.bin"])
+
+	_, err = Read(context.Background(), dir, WithChunkSizeRules(ChunkSizeRule{Pattern: "[", ChunkSize: 10}))
+	assert.ErrorContains(t, err, "invalid chunk size pattern")
+}
@@ -0,0 +1,106 @@
+package dirimage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"golang.org/x/sync/errgroup"
+	"sort"
+	"sync"
+)
+
+type RepairResult struct {
+	SegmentsChecked  int                     `json:"segmentsChecked"`
+	SegmentsRepaired int                     `json:"segmentsRepaired"`
+	RepairedIDs      []filesegment.SegmentID `json:"repairedIDs"`
+}
+
+// findMismatchedSegments returns sorted indices of segments whose local content does not match the image.
+func (di *DirImage) findMismatchedSegments(ctx context.Context, destinationDir string, opts *options) ([]int, error) {
+	var mu sync.Mutex
+	res := make([]int, 0)
+	g, groupCtx := errgroup.WithContext(ctx)
+	g.SetLimit(opts.workersCount)
+	layerOpts := opts.layerOptions()
+	for i, d := range di.segmentDescriptors {
+		if groupCtx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			if err := groupCtx.Err(); err != nil {
+				return err
+			}
+			if filesegment.Matches(d, destinationDir, layerOpts...) {
+				return nil
+			}
+			opts.printf("segment %v does not match\n", d)
+			mu.Lock()
+			defer mu.Unlock()
+			res = append(res, i)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Ints(res)
+	return res, nil
+}
+
+// Repair compares segments stored in destinationDir with the image and downloads only those which do not match.
+// Unlike Write, it never clones or truncates more than needed, so it is meant for directories holding the image already.
+func (di *DirImage) Repair(ctx context.Context, destinationDir string, opt ...Option) (*RepairResult, error) {
+	if di.Image == nil {
+		return nil, errors.New("invalid image")
+	}
+	opts := makeOptions(opt...)
+	info, err := opts.fs.Stat(destinationDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to repair '%v': %w", destinationDir, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("unable to repair '%v': not a directory", destinationDir)
+	}
+	if err := di.checkCaseConflicts(destinationDir, opts); err != nil {
+		return nil, err
+	}
+
+	mismatched, err := di.findMismatchedSegments(ctx, destinationDir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify segments: %w", err)
+	}
+	res := &RepairResult{
+		SegmentsChecked:  len(di.segmentDescriptors),
+		SegmentsRepaired: len(mismatched),
+		RepairedIDs:      make([]filesegment.SegmentID, 0, len(mismatched)),
+	}
+	for _, idx := range mismatched {
+		res.RepairedIDs = append(res.RepairedIDs, di.segmentDescriptors[idx].ID())
+	}
+	if len(mismatched) > 0 {
+		// manifest must not claim image is complete while segments are being rewritten
+		if err := di.deleteManifest(destinationDir, opts); err != nil {
+			return nil, fmt.Errorf("failed to delete manifest: %w", err)
+		}
+		if err := truncateFiles(destinationDir, di.segmentDescriptors, opts); err != nil {
+			return nil, err
+		}
+		if err := di.writeSegments(ctx, destinationDir, mismatched, false, nil, opts); err != nil {
+			return nil, err
+		}
+	}
+	if err := restoreMetadata(destinationDir, di.segmentDescriptors, opts); err != nil {
+		return nil, err
+	}
+	if err := createSymlinks(destinationDir, di.symlinks, opts); err != nil {
+		return nil, err
+	}
+	if err := createDirectories(destinationDir, di.directories, opts); err != nil {
+		return nil, err
+	}
+	return res, di.writeConfigAndManifest(destinationDir, opts)
+}
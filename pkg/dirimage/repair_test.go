@@ -0,0 +1,52 @@
+package dirimage
+
+import (
+	"context"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(srcDir, "disk.img"), 100))
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(10))
+	require.NoError(t, err)
+	di, err := Convert(srcImg)
+	require.NoError(t, err)
+	require.NoError(t, di.Write(context.Background(), dstDir))
+
+	f, err := os.OpenFile(filepath.Join(dstDir, "disk.img"), os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("xx"), 42)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	repaired, err := Convert(srcImg)
+	require.NoError(t, err)
+	res, err := repaired.Repair(context.Background(), dstDir)
+	require.NoError(t, err)
+	assert.Equal(t, &RepairResult{
+		SegmentsChecked:  10,
+		SegmentsRepaired: 1,
+		RepairedIDs:      []filesegment.SegmentID{{File: 0, Segment: 4}},
+	}, res)
+	assert.Equal(t, int64(10), repaired.BytesReadCount.Load())
+
+	expected, err := os.ReadFile(filepath.Join(srcDir, "disk.img"))
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(dstDir, "disk.img"))
+	require.NoError(t, err)
+	assert.Equal(t, expected, content)
+
+	verification, err := Verify(context.Background(), dstDir)
+	require.NoError(t, err)
+	assert.True(t, verification.OK())
+
+	_, err = repaired.Repair(context.Background(), filepath.Join(dstDir, "missing"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,147 @@
+package dirimage
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const LocalResumeStateFilename = ".oci.resume.json"
+
+// resumeFlushInterval is how often completed segments are persisted. Rewriting the state on every segment
+// would cost quadratic time over a pull, segments completed since the last flush are only verified again.
+const resumeFlushInterval = time.Second
+
+// resumeState is persisted in the destination directory while Write is running with WithResume(true).
+// It records which segments of the image identified by ManifestDigest were already written and verified.
+type resumeState struct {
+	ManifestDigest    string `json:"manifestDigest"`
+	CompletedSegments []int  `json:"completedSegments"`
+}
+
+type resumeTracker struct {
+	mu             sync.Mutex
+	fs             sysenv.FS
+	clock          sysenv.Clock
+	path           string
+	manifestDigest string
+	completed      map[int]struct{}
+	dirty          bool
+	flushedAt      time.Time
+}
+
+// loadResumeTracker reads the resume state from destinationDir. A missing, unreadable or outdated
+// state file (belonging to a different manifest) results in an empty tracker.
+func loadResumeTracker(fsys sysenv.FS, clock sysenv.Clock, destinationDir string, manifestDigest string, printf func(fmt string, args ...any)) *resumeTracker {
+	rt := &resumeTracker{
+		fs:             fsys,
+		clock:          clock,
+		path:           filepath.Join(destinationDir, LocalResumeStateFilename),
+		manifestDigest: manifestDigest,
+		completed:      make(map[int]struct{}),
+		flushedAt:      clock.Now(),
+	}
+	data, err := rt.fs.ReadFile(rt.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			printf("unable to read resume state '%v', starting from scratch: %v\n", rt.path, err)
+		}
+		return rt
+	}
+	var state resumeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		printf("unable to parse resume state '%v', starting from scratch: %v\n", rt.path, err)
+		return rt
+	}
+	if state.ManifestDigest != manifestDigest {
+		printf("resume state belongs to different manifest '%v', starting from scratch\n", state.ManifestDigest)
+		return rt
+	}
+	for _, idx := range state.CompletedSegments {
+		rt.completed[idx] = struct{}{}
+	}
+	printf("resuming with %d segments already completed\n", len(rt.completed))
+	return rt
+}
+
+func (rt *resumeTracker) IsCompleted(idx int) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	_, ok := rt.completed[idx]
+	return ok
+}
+
+// MarkCompleted records the segment as done, its data must be synced to disk already. The state is persisted
+// at most every resumeFlushInterval, so it survives a crash, see Flush.
+func (rt *resumeTracker) MarkCompleted(idx int) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.completed[idx] = struct{}{}
+	rt.dirty = true
+	if rt.clock.Now().Sub(rt.flushedAt) < resumeFlushInterval {
+		return nil
+	}
+	return rt.save()
+}
+
+// Flush persists segments completed since the state was saved last time.
+func (rt *resumeTracker) Flush() error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if !rt.dirty {
+		return nil
+	}
+	return rt.save()
+}
+
+func (rt *resumeTracker) save() error {
+	state := resumeState{
+		ManifestDigest:    rt.manifestDigest,
+		CompletedSegments: make([]int, 0, len(rt.completed)),
+	}
+	for idx := range rt.completed {
+		state.CompletedSegments = append(state.CompletedSegments, idx)
+	}
+	sort.Ints(state.CompletedSegments)
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("unable to marshal resume state: %w", err)
+	}
+	// write to temporary file first, so a crash while saving never leaves truncated state behind
+	dir, name := filepath.Split(rt.path)
+	f, err := sysenv.CreateTemp(rt.fs, dir, name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to write resume state: %w", err)
+	}
+	tmpPath := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = rt.fs.Rename(tmpPath, rt.path)
+	}
+	if err != nil {
+		_ = rt.fs.Remove(tmpPath)
+		return fmt.Errorf("unable to save resume state: %w", err)
+	}
+	rt.dirty = false
+	rt.flushedAt = rt.clock.Now()
+	return nil
+}
+
+func deleteResumeState(fsys sysenv.FS, destinationDir string) error {
+	err := fsys.Remove(filepath.Join(destinationDir, LocalResumeStateFilename))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
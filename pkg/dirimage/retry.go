@@ -0,0 +1,128 @@
+package dirimage
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy decides whether and when a failed segment download is attempted again.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// InitialBackoff is the delay before the second attempt, growing by Multiplier up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter randomizes every delay by up to given fraction of it (0.2 means ±20%),
+	// so workers which failed together do not retry together.
+	Jitter float64
+	// MaxElapsed stops retrying once given time has passed since the first attempt. Zero means no limit.
+	MaxElapsed time.Duration
+	// Retryable classifies errors, IsRetryableError is used when nil.
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy returns the policy used by Write unless WithRetryPolicy is given.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// IsRetryableError reports errors which are likely to go away when trying again: dropped connections,
+// timeouts, TLS failures in the middle of a transfer and 5xx responses of the registry.
+func IsRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &recordErr) {
+		return true
+	}
+	var alertErr tls.AlertError
+	if errors.As(err, &alertErr) {
+		return true
+	}
+	var transportErr *transport.Error
+	if errors.As(err, &transportErr) && transportErr.StatusCode >= http.StatusInternalServerError {
+		return true
+	}
+	return false
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryableError(err)
+}
+
+// backoff returns delay before attempt number attempt (counting from 1), which has to be greater than 1.
+func (p RetryPolicy) backoff(attempt int, rand sysenv.Rand) time.Duration {
+	delay := float64(p.InitialBackoff) * math.Pow(max(p.Multiplier, 1), float64(attempt-2))
+	if p.MaxBackoff > 0 {
+		delay = min(delay, float64(p.MaxBackoff))
+	}
+	if p.Jitter > 0 {
+		// uniformly distributed in [-Jitter, +Jitter)
+		r := float64(rand.Int63())/float64(math.MaxInt64)*2 - 1
+		delay += delay * p.Jitter * r
+	}
+	return time.Duration(max(delay, 0))
+}
+
+// retrier tracks attempts of one operation according to the policy.
+type retrier struct {
+	policy  RetryPolicy
+	opts    *options
+	started time.Time
+	attempt int
+}
+
+func (o *options) newRetrier() *retrier {
+	return &retrier{policy: o.retryPolicy, opts: o, started: o.clock.Now()}
+}
+
+// Next waits before the next attempt and reports whether it should happen. Error of previous attempt
+// decides, nil err means the attempt was interrupted on purpose (e.g. because of a stall) and is always retried.
+func (r *retrier) Next(ctx context.Context, err error) bool {
+	r.attempt++
+	if r.attempt == 1 {
+		return true
+	}
+	if ctx.Err() != nil || r.attempt > max(r.policy.MaxAttempts, 1) {
+		return false
+	}
+	if err != nil && !r.policy.retryable(err) {
+		return false
+	}
+	delay := r.policy.backoff(r.attempt, r.opts.rand)
+	if r.policy.MaxElapsed > 0 && r.opts.clock.Now().Add(delay).Sub(r.started) > r.policy.MaxElapsed {
+		return false
+	}
+	return sysenv.Sleep(ctx, r.opts.clock, delay) == nil
+}
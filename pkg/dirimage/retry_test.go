@@ -0,0 +1,123 @@
+package dirimage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingImage fails first failures accesses of layer content with err.
+type failingImage struct {
+	v1.Image
+	err      error
+	failures int32
+	accessed atomic.Int32
+}
+
+func (fi *failingImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := fi.Image.LayerByDigest(h)
+	return &failingLayer{Layer: l, image: fi}, err
+}
+
+type failingLayer struct {
+	v1.Layer
+	image *failingImage
+}
+
+// Compressed fails, zstd segments are decompressed from it within decoder limits.
+func (fl *failingLayer) Compressed() (io.ReadCloser, error) {
+	if fl.image.accessed.Add(1) <= fl.image.failures {
+		return nil, fl.image.err
+	}
+	return fl.Layer.Compressed()
+}
+
+// constRand always returns the same value, so jitter is predictable.
+type constRand int64
+
+func (r constRand) Int63() int64 {
+	return int64(r)
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Multiplier: 2}
+	assert.Equal(t, time.Second, p.backoff(2, constRand(0)))
+	assert.Equal(t, 2*time.Second, p.backoff(3, constRand(0)))
+	assert.Equal(t, 4*time.Second, p.backoff(4, constRand(0)))
+	assert.Equal(t, 5*time.Second, p.backoff(5, constRand(0)))
+
+	p.Jitter = 0.5
+	assert.Equal(t, 500*time.Millisecond, p.backoff(2, constRand(0)))
+	assert.InDelta(t, float64(1500*time.Millisecond), float64(p.backoff(2, constRand(1<<63-1))), float64(time.Millisecond))
+}
+
+func TestIsRetryableError(t *testing.T) {
+	assert.True(t, IsRetryableError(fmt.Errorf("read: %w", syscall.ECONNRESET)))
+	assert.True(t, IsRetryableError(io.ErrUnexpectedEOF))
+	assert.True(t, IsRetryableError(context.DeadlineExceeded))
+	assert.True(t, IsRetryableError(&transport.Error{StatusCode: http.StatusBadGateway}))
+	assert.False(t, IsRetryableError(&transport.Error{StatusCode: http.StatusNotFound}))
+	assert.False(t, IsRetryableError(context.Canceled))
+	assert.False(t, IsRetryableError(os.ErrPermission))
+	assert.False(t, IsRetryableError(nil))
+}
+
+func TestWrite_RetryPolicy(t *testing.T) {
+	srcDir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(srcDir, "disk.img"), 100))
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(100))
+	require.NoError(t, err)
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, Multiplier: 2}
+	clock := fixedClock{now: time.Now()}
+
+	t.Run("transient errors are retried", func(t *testing.T) {
+		failing := &failingImage{Image: srcImg, err: &transport.Error{StatusCode: http.StatusServiceUnavailable}, failures: 2}
+		di, err := Convert(failing)
+		require.NoError(t, err)
+		require.NoError(t, di.Write(context.Background(), t.TempDir(), WithRetryPolicy(policy), WithClock(clock)))
+		assert.Equal(t, int32(3), failing.accessed.Load())
+	})
+
+	t.Run("last error is returned once attempts run out", func(t *testing.T) {
+		failing := &failingImage{Image: srcImg, err: syscall.ECONNRESET, failures: 3}
+		di, err := Convert(failing)
+		require.NoError(t, err)
+		err = di.Write(context.Background(), t.TempDir(), WithRetryPolicy(policy), WithClock(clock))
+		assert.ErrorIs(t, err, syscall.ECONNRESET)
+		assert.Equal(t, int32(3), failing.accessed.Load())
+	})
+
+	t.Run("other errors are not retried", func(t *testing.T) {
+		failing := &failingImage{Image: srcImg, err: errors.New("manifest unknown"), failures: 1}
+		di, err := Convert(failing)
+		require.NoError(t, err)
+		err = di.Write(context.Background(), t.TempDir(), WithRetryPolicy(policy), WithClock(clock))
+		assert.ErrorContains(t, err, "manifest unknown")
+		assert.Equal(t, int32(1), failing.accessed.Load())
+	})
+
+	t.Run("max elapsed time limits retries", func(t *testing.T) {
+		failing := &failingImage{Image: srcImg, err: syscall.ECONNRESET, failures: 3}
+		di, err := Convert(failing)
+		require.NoError(t, err)
+		// the clock does not move, so the third attempt is refused only because of the 2s delay before it
+		limited := policy
+		limited.MaxElapsed = 1500 * time.Millisecond
+		err = di.Write(context.Background(), t.TempDir(), WithRetryPolicy(limited), WithClock(clock))
+		assert.ErrorIs(t, err, syscall.ECONNRESET)
+		assert.Equal(t, int32(2), failing.accessed.Load())
+	})
+}
@@ -0,0 +1,61 @@
+package dirimage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"path/filepath"
+)
+
+// ErrInsufficientSpace is returned by Write when destination filesystem cannot hold the image.
+var ErrInsufficientSpace = errors.New("insufficient disk space")
+
+// requiredSpace estimates how many bytes writing the segments may allocate in destinationDir, in the worst case.
+// Zero segments stay holes, so they are not counted unless files are preallocated. Files already present, including those cloned from other
+// images, are overwritten in place, so only the part of a file beyond its current size is counted.
+func requiredSpace(destinationDir string, segmentDescriptors []*filesegment.Descriptor, zeroSegments map[int]bool, opts *options) int64 {
+	content := make(map[string]int64)
+	for i, d := range segmentDescriptors {
+		if !zeroSegments[i] || opts.preallocate {
+			content[d.Filename()] += d.Length()
+		}
+	}
+	required := int64(0)
+	for filename, length := range content {
+		if info, err := opts.fs.Stat(filepath.Join(destinationDir, filepath.FromSlash(filename))); err == nil {
+			length -= info.Size()
+		}
+		required += max(length, 0)
+	}
+	return required
+}
+
+// checkDiskSpace fails when the filesystem of destinationDir has less free space than the image may need.
+// Filesystems unable to report free space are not checked.
+func checkDiskSpace(destinationDir string, segmentDescriptors []*filesegment.Descriptor, opts *options) error {
+	if !opts.diskSpaceCheck {
+		return nil
+	}
+	sfs, ok := opts.fs.(sysenv.SpaceFS)
+	if !ok {
+		return nil
+	}
+	zeroSegments, err := findZeroSegments(segmentDescriptors, opts)
+	if err != nil {
+		return err
+	}
+	required := requiredSpace(destinationDir, segmentDescriptors, zeroSegments, opts)
+	if required == 0 {
+		return nil
+	}
+	free, err := sfs.FreeSpace(destinationDir)
+	if err != nil {
+		opts.printf("unable to check free space of '%v': %v\n", destinationDir, err)
+		return nil
+	}
+	if required > free {
+		return fmt.Errorf("%w: writing to '%v' may need up to %d bytes, but only %d bytes are available", ErrInsufficientSpace, destinationDir, required, free)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package dirimage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/duplicator"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// oldKind names sibling directory holding previous image while swapDirs replaces it.
+const oldKind = "old"
+
+// siblingDir returns a hidden directory name next to dir. Names starting with a dot
+// are never valid references, so such directories are not visible as images.
+func siblingDir(dir string, kind string, opts *options) string {
+	suffix := strconv.FormatInt(opts.rand.Int63(), 36)
+	return filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+"."+kind+"-"+suffix)
+}
+
+// prepareStagingDir creates staging directory with clones of files from destinationDir which are part of the image,
+// so unchanged segments do not have to be downloaded again.
+func (di *DirImage) prepareStagingDir(destinationDir string, stagingDir string, opts *options) error {
+	err := opts.fs.MkdirAll(stagingDir, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("unable to create staging directory '%v': %w", stagingDir, err)
+	}
+	cloneFile := duplicator.CloneFile
+	if opts.fs != sysenv.OS {
+		cloneFile = func(src, dst string) error {
+			return duplicator.CopyFile(opts.fs, src, dst)
+		}
+	}
+	sizes := expectedFileSizes(di.segmentDescriptors)
+	sources := make([]string, 0)
+	progress := newProgressTracker(opts)
+	for _, d := range di.segmentDescriptors {
+		if _, ok := progress.files[d.Filename()]; ok {
+			continue
+		}
+		info, err := opts.fs.Stat(filepath.Join(destinationDir, filepath.FromSlash(d.Filename())))
+		if err != nil || info.IsDir() {
+			continue
+		}
+		sources = append(sources, d.Filename())
+		progress.Expect(d.Filename(), sizes[d.Filename()])
+	}
+	progress.Start(PhaseCloning)
+	for _, filename := range sources {
+		src := filepath.Join(destinationDir, filepath.FromSlash(filename))
+		if err := createParentDir(stagingDir, filename, opts); err != nil {
+			return err
+		}
+		err = cloneFile(src, filepath.Join(stagingDir, filepath.FromSlash(filename)))
+		if err != nil {
+			return fmt.Errorf("unable to clone '%v' into staging directory: %w", src, err)
+		}
+		progress.Add(PhaseCloning, filename, nil, sizes[filename])
+	}
+	return nil
+}
+
+// swapDirs atomically replaces destinationDir with stagingDir, exchanging them in a single step where
+// the filesystem supports it. Elsewhere previous content is moved aside first, and restored if the staging
+// directory could not be moved into place, or by recoverSwap after a crash in between.
+func swapDirs(destinationDir string, stagingDir string, opts *options) error {
+	_, err := opts.fs.Stat(destinationDir)
+	if os.IsNotExist(err) {
+		return opts.fs.Rename(stagingDir, destinationDir)
+	}
+	if efs, ok := opts.fs.(sysenv.ExchangeFS); ok {
+		err := efs.Exchange(stagingDir, destinationDir)
+		if err == nil {
+			// staging directory holds the previous image now
+			if err := opts.fs.RemoveAll(stagingDir); err != nil {
+				opts.printf("unable to remove previous image at '%v': %v\n", stagingDir, err)
+			}
+			return nil
+		}
+		opts.printf("unable to exchange '%v' with staging directory, renaming instead: %v\n", destinationDir, err)
+	}
+	oldDir := siblingDir(destinationDir, oldKind, opts)
+	err = opts.fs.Rename(destinationDir, oldDir)
+	if err != nil {
+		return fmt.Errorf("unable to move previous image aside: %w", err)
+	}
+	err = opts.fs.Rename(stagingDir, destinationDir)
+	if err != nil {
+		if restoreErr := opts.fs.Rename(oldDir, destinationDir); restoreErr != nil {
+			return errors.Join(fmt.Errorf("unable to move staging directory into place: %w", err),
+				fmt.Errorf("unable to restore previous image from '%v': %w", oldDir, restoreErr))
+		}
+		return fmt.Errorf("unable to move staging directory into place: %w", err)
+	}
+	err = opts.fs.RemoveAll(oldDir)
+	if err != nil {
+		opts.printf("unable to remove previous image at '%v': %v\n", oldDir, err)
+	}
+	return nil
+}
+
+// recoverSwap moves previous image back to destinationDir, when swapDirs was interrupted after moving it
+// aside, so there is no image at destinationDir. Leftovers of completed swaps are removed by garbage collection.
+func recoverSwap(destinationDir string, opts *options) error {
+	if _, err := opts.fs.Lstat(destinationDir); !os.IsNotExist(err) {
+		return nil
+	}
+	entries, err := opts.fs.ReadDir(filepath.Dir(destinationDir))
+	if err != nil {
+		return nil
+	}
+	prefix := "." + filepath.Base(destinationDir) + "." + oldKind + "-"
+	var latest string
+	var latestTime time.Time
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if latest == "" || info.ModTime().After(latestTime) {
+			latest, latestTime = e.Name(), info.ModTime()
+		}
+	}
+	if latest == "" {
+		return nil
+	}
+	oldDir := filepath.Join(filepath.Dir(destinationDir), latest)
+	if err := opts.fs.Rename(oldDir, destinationDir); err != nil {
+		return fmt.Errorf("unable to restore previous image from '%v': %w", oldDir, err)
+	}
+	opts.printf("restored previous image from '%v' after interrupted swap\n", oldDir)
+	return nil
+}
+
+func (di *DirImage) writeStaged(ctx context.Context, destinationDir string, prepare PrepareFunc, opts *options) (err error) {
+	stagingDir := siblingDir(destinationDir, "staging", opts)
+	defer func() {
+		if err == nil {
+			return
+		}
+		if removeErr := opts.fs.RemoveAll(stagingDir); removeErr != nil {
+			opts.printf("unable to remove staging directory '%v': %v\n", stagingDir, removeErr)
+		}
+	}()
+	err = di.prepareStagingDir(destinationDir, stagingDir, opts)
+	if err != nil {
+		return err
+	}
+	if err = applyPrepare(stagingDir, prepare, opts); err != nil {
+		return err
+	}
+	err = di.write(ctx, stagingDir, opts)
+	if err != nil {
+		return err
+	}
+	return swapDirs(destinationDir, stagingDir, opts)
+}
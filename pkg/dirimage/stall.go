@@ -0,0 +1,185 @@
+package dirimage
+
+import (
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stallDetector tracks when bytes last moved, overall and for every segment being downloaded.
+type stallDetector struct {
+	opts     *options
+	progress *progressTracker
+
+	mu              sync.Mutex
+	lastActivity    time.Time
+	overallReported bool
+	watches         map[*segmentWatch]struct{}
+}
+
+type segmentWatch struct {
+	detector     *stallDetector
+	name         string
+	filename     string
+	id           filesegment.SegmentID
+	lastActivity time.Time
+	reported     bool
+	closer       io.Closer
+	stalled      atomic.Bool
+	bytesRead    atomic.Int64
+}
+
+func newStallDetector(opts *options, progress *progressTracker) *stallDetector {
+	return &stallDetector{
+		opts:         opts,
+		progress:     progress,
+		lastActivity: opts.clock.Now(),
+		watches:      make(map[*segmentWatch]struct{}),
+	}
+}
+
+func (sd *stallDetector) touch() {
+	sd.lastActivity = sd.opts.clock.Now()
+	sd.overallReported = false
+}
+
+func (sd *stallDetector) Touch() {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	sd.touch()
+}
+
+// Watch starts tracking a segment download, which has to be finished with Done.
+func (sd *stallDetector) Watch(d *filesegment.Descriptor) *segmentWatch {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	w := &segmentWatch{detector: sd, name: d.String(), filename: d.Filename(), id: d.ID(), lastActivity: sd.opts.clock.Now()}
+	sd.watches[w] = struct{}{}
+	return w
+}
+
+func (sd *stallDetector) Done(w *segmentWatch) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	delete(sd.watches, w)
+}
+
+// Run checks for stalls until stop is closed.
+func (sd *stallDetector) Run(stop <-chan struct{}) {
+	interval := max(sd.opts.stallTimeout/4, time.Millisecond)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-sd.opts.clock.After(interval):
+		}
+		for _, u := range sd.check() {
+			sd.opts.printf("no progress for %v on %v\n", u.StalledFor, stalledName(u.StalledSegment))
+			if sd.opts.progressFunc != nil {
+				sd.opts.progressFunc(u)
+			}
+			if sd.opts.progress == nil {
+				continue
+			}
+			// stall events are not dropped like regular updates, so consumers can rely on them
+			select {
+			case sd.opts.progress <- u:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+func stalledName(segment string) string {
+	if segment == "" {
+		return "transfer"
+	}
+	return "segment " + segment
+}
+
+func (sd *stallDetector) check() []ProgressUpdate {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	now := sd.opts.clock.Now()
+	res := make([]ProgressUpdate, 0)
+	makeUpdate := func(w *segmentWatch, stalledFor time.Duration) ProgressUpdate {
+		u := ProgressUpdate{
+			BytesProcessed: sd.progress.Processed(),
+			BytesTotal:     sd.progress.Total(),
+			Phase:          PhaseDownloading,
+			Stalled:        true,
+			StalledFor:     stalledFor,
+		}
+		if w != nil {
+			id := w.id
+			u.StalledSegment = w.name
+			u.StalledSegmentID = &id
+		}
+		return u
+	}
+	for w := range sd.watches {
+		stalledFor := now.Sub(w.lastActivity)
+		if w.reported || stalledFor < sd.opts.stallTimeout {
+			continue
+		}
+		w.reported = true
+		res = append(res, makeUpdate(w, stalledFor))
+		if sd.opts.stallRetry && w.closer != nil {
+			// closing the source unblocks pending read, so the segment is retried
+			w.stalled.Store(true)
+			_ = w.closer.Close()
+		}
+	}
+	stalledFor := now.Sub(sd.lastActivity)
+	if !sd.overallReported && stalledFor >= sd.opts.stallTimeout {
+		sd.overallReported = true
+		res = append(res, makeUpdate(nil, stalledFor))
+	}
+	return res
+}
+
+// Wrap returns reader recording activity of the segment download.
+func (w *segmentWatch) Wrap(rc io.ReadCloser) io.ReadCloser {
+	w.detector.mu.Lock()
+	defer w.detector.mu.Unlock()
+	w.closer = rc
+	return &activityReader{rc: rc, watch: w}
+}
+
+// Stalled reports whether the download was interrupted because of a stall.
+func (w *segmentWatch) Stalled() bool {
+	return w.stalled.Load()
+}
+
+// BytesRead returns number of bytes which went through the wrapped reader.
+func (w *segmentWatch) BytesRead() int64 {
+	return w.bytesRead.Load()
+}
+
+type activityReader struct {
+	rc    io.ReadCloser
+	watch *segmentWatch
+}
+
+func (ar *activityReader) Read(p []byte) (int, error) {
+	n, err := ar.rc.Read(p)
+	if n > 0 {
+		ar.watch.bytesRead.Add(int64(n))
+		sd := ar.watch.detector
+		sd.mu.Lock()
+		ar.watch.lastActivity = sd.opts.clock.Now()
+		ar.watch.reported = false
+		sd.touch()
+		sd.mu.Unlock()
+		// progress grows as bytes actually arrive, so it moves smoothly during large segment downloads
+		sd.progress.Add(PhaseDownloading, ar.watch.filename, &ar.watch.id, int64(n))
+	}
+	return n, err
+}
+
+func (ar *activityReader) Close() error {
+	return ar.rc.Close()
+}
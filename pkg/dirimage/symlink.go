@@ -0,0 +1,100 @@
+package dirimage
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SymlinksAnnotationKey is the manifest annotation listing symbolic links of the image as JSON array.
+const SymlinksAnnotationKey = "online.jarosik.tomasz.geranos.symlinks"
+
+type Symlink struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+}
+
+func parseSymlinks(annotations map[string]string) ([]Symlink, error) {
+	raw, ok := annotations[SymlinksAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	var res []Symlink
+	if err := json.Unmarshal([]byte(raw), &res); err != nil {
+		return nil, fmt.Errorf("invalid symlinks annotation: %w", err)
+	}
+	for _, l := range res {
+		if err := validateSymlinkName(l.Name); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func validateSymlinkName(name string) error {
+	if err := filesegment.ValidateFilename(name); err != nil {
+		return fmt.Errorf("invalid symlink name: %w", err)
+	}
+	return nil
+}
+
+// manifestAnnotations returns annotations of image manifest describing the symlinks and empty directories,
+// nil if there are none.
+func manifestAnnotations(symlinks []Symlink, directories []string) (map[string]string, error) {
+	if len(symlinks) == 0 && len(directories) == 0 {
+		return nil, nil
+	}
+	res := make(map[string]string)
+	if len(symlinks) > 0 {
+		sorted := append([]Symlink{}, symlinks...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].Name < sorted[j].Name
+		})
+		raw, err := json.Marshal(sorted)
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal symlinks: %w", err)
+		}
+		res[SymlinksAnnotationKey] = string(raw)
+	}
+	if len(directories) > 0 {
+		sorted := append([]string{}, directories...)
+		sort.Strings(sorted)
+		raw, err := json.Marshal(sorted)
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal directories: %w", err)
+		}
+		res[DirectoriesAnnotationKey] = string(raw)
+	}
+	return res, nil
+}
+
+// createSymlinks recreates symbolic links in destinationDir, replacing whatever is in their place.
+func createSymlinks(destinationDir string, symlinks []Symlink, opts *options) error {
+	for _, l := range symlinks {
+		if err := validateSymlinkName(l.Name); err != nil {
+			return err
+		}
+		if err := createParentDir(destinationDir, l.Name, opts); err != nil {
+			return err
+		}
+		path := filepath.Join(destinationDir, filepath.FromSlash(l.Name))
+		info, err := opts.fs.Lstat(path)
+		if err == nil {
+			if info.Mode()&os.ModeSymlink != 0 {
+				if target, err := opts.fs.Readlink(path); err == nil && target == l.Target {
+					continue
+				}
+			}
+			if err := opts.fs.RemoveAll(path); err != nil {
+				return fmt.Errorf("unable to replace '%v' with symlink: %w", l.Name, err)
+			}
+		}
+		if err := opts.fs.Symlink(l.Target, path); err != nil {
+			return fmt.Errorf("unable to create symlink '%v': %w", l.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package dirimage
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/zstd"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DirectoriesAnnotationKey is the manifest annotation listing empty directories of the image as JSON array.
+// Directories containing files or symlinks are implied by their paths and are not listed.
+const DirectoriesAnnotationKey = "online.jarosik.tomasz.geranos.directories"
+
+// dirTree describes content of image directory. All paths are slash-separated and relative to the image directory.
+type dirTree struct {
+	files       []string
+	symlinks    []Symlink
+	directories []string
+	exclude     FileFilter
+	// dictionary is the zstd dictionary of small files, if any, see WithZstdDictionary
+	dictionary *zstd.Dictionary
+}
+
+// scanDirectory lists files, symlinks and empty directories of dir. Subdirectories are only descended into
+// with WithRecursive(true), otherwise they are skipped as before. Entries matching WithExcludePatterns are left out.
+func scanDirectory(dir string, opts *options) (*dirTree, error) {
+	tree := &dirTree{
+		files:       make([]string, 0),
+		symlinks:    make([]Symlink, 0),
+		directories: make([]string, 0),
+		exclude:     FileFilter{Exclude: opts.excludePatterns},
+	}
+	if err := tree.exclude.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := tree.scan(dir, "", opts); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// scan adds entries of subdirectory rel to the tree and returns how many of them were included.
+func (t *dirTree) scan(dir string, rel string, opts *options) (int, error) {
+	fullPath := filepath.Join(dir, filepath.FromSlash(rel))
+	dirEntries, err := opts.fs.ReadDir(fullPath)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read directory: '%v': %w", fullPath, err)
+	}
+	included := 0
+	for _, entry := range dirEntries {
+		name := path.Join(rel, entry.Name())
+		if strings.HasPrefix(entry.Name(), ".") {
+			opts.printf("skipping '%v' because it starts with a dot", name)
+			continue
+		}
+		if !t.exclude.Matches(name) {
+			opts.printf("skipping '%v' because it matches exclude pattern", name)
+			continue
+		}
+		switch {
+		case entry.Type()&os.ModeSymlink != 0:
+			target, err := opts.fs.Readlink(filepath.Join(dir, filepath.FromSlash(name)))
+			if err != nil {
+				return 0, fmt.Errorf("unable to read symlink '%v': %w", name, err)
+			}
+			t.symlinks = append(t.symlinks, Symlink{Name: name, Target: target})
+		case entry.IsDir():
+			if !opts.recursive {
+				opts.printf("unexpected subdirectory '%v', skipping", name)
+				continue
+			}
+			count, err := t.scan(dir, name, opts)
+			if err != nil {
+				return 0, err
+			}
+			if count == 0 {
+				t.directories = append(t.directories, name)
+			}
+		default:
+			t.files = append(t.files, name)
+		}
+		included++
+	}
+	return included, nil
+}
+
+func parseDirectories(annotations map[string]string) ([]string, error) {
+	raw, ok := annotations[DirectoriesAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	var res []string
+	if err := json.Unmarshal([]byte(raw), &res); err != nil {
+		return nil, fmt.Errorf("invalid directories annotation: %w", err)
+	}
+	for _, d := range res {
+		if err := filesegment.ValidateFilename(d); err != nil {
+			return nil, fmt.Errorf("invalid directory: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// createParentDir makes sure the directory containing name exists in destinationDir.
+func createParentDir(destinationDir string, name string, opts *options) error {
+	parent := path.Dir(name)
+	if parent == "." {
+		return nil
+	}
+	if err := opts.fs.MkdirAll(filepath.Join(destinationDir, filepath.FromSlash(parent)), os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create directory '%v': %w", parent, err)
+	}
+	return nil
+}
+
+// createDirectories recreates empty directories of the image in destinationDir.
+func createDirectories(destinationDir string, directories []string, opts *options) error {
+	for _, d := range directories {
+		if err := filesegment.ValidateFilename(d); err != nil {
+			return err
+		}
+		if err := opts.fs.MkdirAll(filepath.Join(destinationDir, filepath.FromSlash(d)), os.ModePerm); err != nil {
+			return fmt.Errorf("unable to create directory '%v': %w", d, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package dirimage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"golang.org/x/sync/errgroup"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+type SegmentMismatch struct {
+	ID             filesegment.SegmentID `json:"id"`
+	Filename       string                `json:"filename"`
+	Start          int64                 `json:"start"`
+	Stop           int64                 `json:"stop"`
+	ExpectedDiffID string                `json:"expectedDiffID"`
+}
+
+type MissingFile struct {
+	File     int    `json:"file"`
+	Filename string `json:"filename"`
+}
+
+type SizeMismatch struct {
+	File         int    `json:"file"`
+	Filename     string `json:"filename"`
+	ExpectedSize int64  `json:"expectedSize"`
+	ActualSize   int64  `json:"actualSize"`
+}
+
+// VerificationResult describes differences between local files and the stored local manifest.
+type VerificationResult struct {
+	Directory          string            `json:"directory"`
+	ManifestDigest     string            `json:"manifestDigest"`
+	SegmentsChecked    int               `json:"segmentsChecked"`
+	MismatchedSegments []SegmentMismatch `json:"mismatchedSegments"`
+	MissingFiles       []MissingFile     `json:"missingFiles"`
+	SizeMismatches     []SizeMismatch    `json:"sizeMismatches"`
+}
+
+func (vr *VerificationResult) OK() bool {
+	return len(vr.MismatchedSegments) == 0 && len(vr.MissingFiles) == 0 && len(vr.SizeMismatches) == 0
+}
+
+// readLocalDescriptors parses LocalManifestFilename and LocalConfigFilename stored in dir.
+func readLocalDescriptors(dir string, opts *options) (v1.Hash, []*filesegment.Descriptor, error) {
+	rawManifest, err := opts.fs.ReadFile(filepath.Join(dir, LocalManifestFilename))
+	if err != nil {
+		return v1.Hash{}, nil, fmt.Errorf("unable to read manifest file: %w", err)
+	}
+	manifestDigest, _, err := v1.SHA256(bytes.NewReader(rawManifest))
+	if err != nil {
+		return v1.Hash{}, nil, err
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+		return v1.Hash{}, nil, fmt.Errorf("unable to parse manifest file: %w", err)
+	}
+	cfg, err := prepareConfigFile(dir, true, opts)
+	if err != nil {
+		return v1.Hash{}, nil, err
+	}
+	if len(manifest.Layers) != len(cfg.RootFS.DiffIDs) {
+		return v1.Hash{}, nil, fmt.Errorf("mismatch between number of layers in manifest and diff IDs in config")
+	}
+	descriptors := make([]*filesegment.Descriptor, 0, len(manifest.Layers))
+	for i, l := range manifest.Layers {
+		d, err := filesegment.ParseDescriptor(l, cfg.RootFS.DiffIDs[i])
+		if err != nil {
+			return v1.Hash{}, nil, fmt.Errorf("failed to parse descriptor: %w", err)
+		}
+		descriptors = append(descriptors, d)
+	}
+	filesegment.AssignIDs(descriptors)
+	return manifestDigest, descriptors, nil
+}
+
+func expectedFileSizes(segmentDescriptors []*filesegment.Descriptor) map[string]int64 {
+	res := make(map[string]int64)
+	for _, d := range segmentDescriptors {
+		res[d.Filename()] = max(res[d.Filename()], d.Stop()+1)
+	}
+	return res
+}
+
+// Verify re-hashes every segment of the image stored in dir and compares it with the local manifest.
+// Returned error means verification could not be performed, differences are reported in the result.
+func Verify(ctx context.Context, dir string, opt ...Option) (*VerificationResult, error) {
+	opts := makeOptions(opt...)
+	manifestDigest, descriptors, err := readLocalDescriptors(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	res := &VerificationResult{
+		Directory:          dir,
+		ManifestDigest:     manifestDigest.String(),
+		MismatchedSegments: make([]SegmentMismatch, 0),
+		MissingFiles:       make([]MissingFile, 0),
+		SizeMismatches:     make([]SizeMismatch, 0),
+	}
+
+	fileIDs := make(map[string]int)
+	for _, d := range descriptors {
+		fileIDs[d.Filename()] = d.ID().File
+	}
+	missing := make(map[string]struct{})
+	for filename, expectedSize := range expectedFileSizes(descriptors) {
+		info, err := opts.fs.Stat(filepath.Join(dir, filename))
+		if os.IsNotExist(err) {
+			missing[filename] = struct{}{}
+			res.MissingFiles = append(res.MissingFiles, MissingFile{File: fileIDs[filename], Filename: filename})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to stat '%v': %w", filename, err)
+		}
+		if info.Size() != expectedSize {
+			res.SizeMismatches = append(res.SizeMismatches, SizeMismatch{
+				File:         fileIDs[filename],
+				Filename:     filename,
+				ExpectedSize: expectedSize,
+				ActualSize:   info.Size(),
+			})
+		}
+	}
+
+	var mu sync.Mutex
+	g, groupCtx := errgroup.WithContext(ctx)
+	g.SetLimit(opts.workersCount)
+	layerOpts := opts.layerOptions()
+	for _, d := range descriptors {
+		if _, ok := missing[d.Filename()]; ok {
+			continue
+		}
+		if groupCtx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			if err := groupCtx.Err(); err != nil {
+				return err
+			}
+			ok := filesegment.Matches(d, dir, layerOpts...)
+			mu.Lock()
+			defer mu.Unlock()
+			res.SegmentsChecked++
+			if !ok {
+				opts.printf("segment %v does not match\n", d)
+				res.MismatchedSegments = append(res.MismatchedSegments, SegmentMismatch{
+					ID:             d.ID(),
+					Filename:       d.Filename(),
+					Start:          d.Start(),
+					Stop:           d.Stop(),
+					ExpectedDiffID: d.DiffID().String(),
+				})
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(res.MissingFiles, func(i, j int) bool {
+		return res.MissingFiles[i].File < res.MissingFiles[j].File
+	})
+	sort.Slice(res.SizeMismatches, func(i, j int) bool {
+		return res.SizeMismatches[i].File < res.SizeMismatches[j].File
+	})
+	sort.Slice(res.MismatchedSegments, func(i, j int) bool {
+		return res.MismatchedSegments[i].ID.Segment < res.MismatchedSegments[j].ID.Segment
+	})
+	return res, nil
+}
@@ -0,0 +1,51 @@
+package dirimage
+
+import (
+	"context"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	for _, name := range []string{"disk.img", "aux.img", "nvram.bin"} {
+		require.NoError(t, generateRandomFile(filepath.Join(srcDir, name), 100))
+	}
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(10))
+	require.NoError(t, err)
+	di, err := Convert(srcImg)
+	require.NoError(t, err)
+	require.NoError(t, di.Write(context.Background(), dstDir))
+
+	res, err := Verify(context.Background(), dstDir)
+	require.NoError(t, err)
+	assert.True(t, res.OK())
+	assert.Equal(t, 30, res.SegmentsChecked)
+
+	f, err := os.OpenFile(filepath.Join(dstDir, "disk.img"), os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("corrupted"), 25)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.Truncate(filepath.Join(dstDir, "aux.img"), 95))
+	require.NoError(t, os.Remove(filepath.Join(dstDir, "nvram.bin")))
+
+	res, err = Verify(context.Background(), dstDir)
+	require.NoError(t, err)
+	assert.False(t, res.OK())
+	assert.Equal(t, []MissingFile{{File: 2, Filename: "nvram.bin"}}, res.MissingFiles)
+	assert.Equal(t, []SizeMismatch{{File: 0, Filename: "aux.img", ExpectedSize: 100, ActualSize: 95}}, res.SizeMismatches)
+	require.Len(t, res.MismatchedSegments, 3)
+	assert.Equal(t, "aux.img", res.MismatchedSegments[0].Filename)
+	assert.Equal(t, int64(90), res.MismatchedSegments[0].Start)
+	assert.Equal(t, filesegment.SegmentID{File: 0, Segment: 9}, res.MismatchedSegments[0].ID)
+	assert.Equal(t, "disk.img", res.MismatchedSegments[1].Filename)
+	assert.Equal(t, int64(20), res.MismatchedSegments[1].Start)
+	assert.Equal(t, filesegment.SegmentID{File: 1, Segment: 12}, res.MismatchedSegments[1].ID)
+	assert.Equal(t, int64(30), res.MismatchedSegments[2].Start)
+}
@@ -7,132 +7,431 @@ import (
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/macvmio/geranos/pkg/filesegment"
 	"github.com/macvmio/geranos/pkg/sparsefile"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"github.com/macvmio/geranos/pkg/zstd"
 	"golang.org/x/sync/errgroup"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"syscall"
 )
 
-func writeToSegment(destinationDir string, segment *filesegment.Descriptor, src io.ReadCloser) (written int64, skipped int64, err error) {
+func writeToSegment(destinationDir string, segment *filesegment.Descriptor, src io.ReadCloser, opts *options) (written int64, skipped int64, err error) {
 	// Here: we have io.ReadCloser dumping to a file at given location
-	f, err := filesegment.NewWriter(destinationDir, segment)
+	f, err := filesegment.NewWriterFS(opts.fs, destinationDir, segment)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	defer func(f *os.File) {
+	defer func(f sysenv.File) {
 		err := f.Close()
 		if err != nil {
-			log.Printf("error while closing file %v, got %v", segment.Filename(), err)
+			log.Printf("error while closing %v, got %v", segment, err)
 		}
 	}(f)
+	if opts.directIO {
+		if err := sysenv.NoCache(f); err != nil {
+			opts.printf("unable to bypass page cache for %v: %v\n", segment, err)
+		}
+	}
 
-	written, skipped, err = sparsefile.Overwrite(f, src)
+	overwriteOpts := []sparsefile.Option{sparsefile.WithBlockSize(opts.sparseBlockSize)}
+	if opts.punchHoles {
+		overwriteOpts = append(overwriteOpts, sparsefile.WithHolePunching())
+	}
+	written, skipped, err = sparsefile.Overwrite(f, src, overwriteOpts...)
+	if err != nil {
+		return written, skipped, fmt.Errorf("unable to write %v: %w", segment, err)
+	}
 	if written+skipped != segment.Length() {
-		return written, skipped, fmt.Errorf("invalid numer of bytes written+skipped: segment length: %d, written+skipped: %d", segment.Length(), written+skipped)
+		return written, skipped, fmt.Errorf("invalid numer of bytes written+skipped for %v: segment length: %d, written+skipped: %d", segment, segment.Length(), written+skipped)
 	}
-	return written, skipped, err
+	// resumed pull skips segments recorded as completed, so they must not be lost in page cache by a crash
+	if opts.fsync || opts.resume {
+		if err := f.Sync(); err != nil {
+			return written, skipped, fmt.Errorf("unable to sync %v: %w", segment, err)
+		}
+	}
+	if opts.directIO {
+		if err := sysenv.DropCache(f, segment.Start(), segment.Length()); err != nil {
+			return written, skipped, fmt.Errorf("unable to drop %v from page cache: %w", segment, err)
+		}
+	}
+	return written, skipped, nil
 }
 
-func writeLayer(destinationDir string, segment *filesegment.Descriptor, layer v1.Layer) (written int64, skipped int64, err error) {
+// syncSegment flushes file of the segment to disk.
+func syncSegment(destinationDir string, segment *filesegment.Descriptor, opts *options) error {
+	f, err := opts.fs.Open(filepath.Join(destinationDir, filepath.FromSlash(segment.Filename())))
+	if err != nil {
+		return fmt.Errorf("unable to sync %v: %w", segment, err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("unable to sync %v: %w", segment, err)
+	}
+	return nil
+}
+
+// writeLayer writes content of the layer into the segment. Segments known to contain only zeros are
+// materialized locally, without accessing layer content. Segments compressed with zstd dictionary need dict.
+func writeLayer(ctx context.Context, destinationDir string, segment *filesegment.Descriptor, layer v1.Layer, zero bool, dict *zstd.Dictionary, opts *options, watch *segmentWatch) (written int64, skipped int64, err error) {
 	if layer == nil {
 		return 0, 0, errors.New("nil layer provided")
 	}
 
-	rc, err := layer.Uncompressed()
-	if err != nil {
-		return 0, 0, fmt.Errorf("failed to access uncompressed layer: %w", err)
+	var rc io.ReadCloser
+	if zero {
+		// nothing to download, zeros already present (e.g. as hole after truncation) are skipped by Overwrite
+		rc = filesegment.Zeros(segment.Length())
+	} else {
+		rc, err = filesegment.Uncompressed(layer, segment, opts.decodeOptions(dict)...)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to access uncompressed layer: %w", err)
+		}
+		rc = opts.limiter.Reader(ctx, rc)
+	}
+	if watch != nil {
+		rc = watch.Wrap(rc)
 	}
 	defer rc.Close()
-	return writeToSegment(destinationDir, segment, rc)
+	return writeToSegment(destinationDir, segment, rc, opts)
 }
 
-func truncateFiles(destinationDir string, segmentDescriptors []*filesegment.Descriptor) error {
-	fileSizesMap := make(map[string]int64)
+// findZeroSegments returns segments known to contain only zeros: zero segments, and regular segments
+// whose DiffID is that of zeros, for each chunk size used by the image or configured by WithChunkSize
+// and WithChunkSizeRules.
+func findZeroSegments(segmentDescriptors []*filesegment.Descriptor, opts *options) (map[int]bool, error) {
+	fileSizes := expectedFileSizes(segmentDescriptors)
+	chunkSizes := map[int64]struct{}{opts.chunkSize: {}}
+	for _, r := range opts.chunkSizeRules {
+		chunkSizes[r.ChunkSize] = struct{}{}
+	}
 	for _, d := range segmentDescriptors {
-		size, present := fileSizesMap[d.Filename()]
-		if !present {
-			size = d.Stop() + 1
+		// every segment except the last one of a file is exactly chunk size long
+		if d.Stop()+1 < fileSizes[d.Filename()] {
+			chunkSizes[d.Length()] = struct{}{}
+		}
+	}
+	res := make(map[int]bool)
+	for i, d := range segmentDescriptors {
+		if d.IsZero() {
+			res[i] = true
+			continue
+		}
+		if _, ok := chunkSizes[d.Length()]; !ok {
+			continue
+		}
+		zeroDiffID, err := filesegment.ZeroDiffID(d.Length())
+		if err != nil {
+			return nil, fmt.Errorf("unable to compute digest of zero segment: %w", err)
+		}
+		if d.DiffID() == zeroDiffID {
+			res[i] = true
 		}
-		size = max(size, d.Stop()+1)
-		fileSizesMap[d.Filename()] = size
 	}
+	return res, nil
+}
 
-	for filename, size := range fileSizesMap {
-		fpath := filepath.Join(destinationDir, filename)
-		f, err := os.OpenFile(fpath, os.O_CREATE|os.O_RDWR, 0644)
+func truncateFiles(destinationDir string, segmentDescriptors []*filesegment.Descriptor, opts *options) error {
+	for filename, size := range expectedFileSizes(segmentDescriptors) {
+		if err := createParentDir(destinationDir, filename, opts); err != nil {
+			return err
+		}
+		fpath := filepath.Join(destinationDir, filepath.FromSlash(filename))
+		f, err := opts.fs.OpenFile(fpath, os.O_CREATE|os.O_RDWR, opts.dataFileMode)
+		if os.IsPermission(err) {
+			// file may have been restored as read-only by previous write, make it writable again
+			if info, statErr := opts.fs.Stat(fpath); statErr == nil && opts.fs.Chmod(fpath, info.Mode().Perm()|0o200) == nil {
+				f, err = opts.fs.OpenFile(fpath, os.O_RDWR, opts.dataFileMode)
+			}
+		}
 		if err != nil {
 			return fmt.Errorf("error opening file '%s': %w", filename, err)
 		}
 		defer f.Close()
-		err = os.Truncate(fpath, size)
+		if !opts.preallocate {
+			// needed on Windows for the truncated file to stay unallocated, elsewhere files are sparse anyway
+			if err := sparsefile.SetSparse(f); err != nil {
+				opts.printf("unable to make '%v' sparse: %v\n", filename, err)
+			}
+		}
+		err = opts.fs.Truncate(fpath, size)
 		if err != nil {
 			return fmt.Errorf("error while truncating file '%v': %w", filename, err)
 		}
+		if err := preallocateFile(fpath, size, opts); err != nil {
+			return fmt.Errorf("unable to preallocate '%v': %w", filename, err)
+		}
+		if opts.enforceDataFileMode {
+			if err := opts.fs.Chmod(fpath, opts.dataFileMode); err != nil {
+				return fmt.Errorf("unable to change mode of '%v': %w", filename, err)
+			}
+		}
+		if err := applyOwner(fpath, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// preallocateFile reserves blocks for the file when enabled by WithPreallocation. Filesystems not supporting it
+// are written as usual, only running out of space is an error.
+func preallocateFile(path string, size int64, opts *options) error {
+	if !opts.preallocate {
+		return nil
+	}
+	pfs, ok := opts.fs.(sysenv.PreallocateFS)
+	if !ok {
+		opts.printf("preallocation is not supported, skipping '%v'\n", path)
+		return nil
+	}
+	err := pfs.Preallocate(path, size)
+	if errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+	if err != nil {
+		opts.printf("unable to preallocate '%v', skipping: %v\n", path, err)
 	}
 	return nil
 }
 
-func sendProgressUpdate(progressChan chan<- ProgressUpdate, current, total int64) {
-	select {
-	case progressChan <- ProgressUpdate{
-		BytesProcessed: current,
-		BytesTotal:     total,
-	}:
-	default:
+func applyOwner(path string, opts *options) error {
+	if opts.owner == nil {
+		return nil
 	}
+	if err := opts.fs.Chown(path, opts.owner.uid, opts.owner.gid); err != nil {
+		return fmt.Errorf("unable to change owner of '%v': %w", path, err)
+	}
+	return nil
 }
 
 func (di *DirImage) Write(ctx context.Context, destinationDir string, opt ...Option) error {
+	return di.WritePrepared(ctx, destinationDir, nil, opt...)
+}
+
+// PrepareFunc places content into dir before the image is written there, returning options of writing.
+type PrepareFunc func(dir string) ([]Option, error)
+
+// WritePrepared is Write calling prepare first with the directory the image is written into: the staging
+// directory with WithStaging, destinationDir otherwise. So whatever prepare places there, like clones of
+// files of other images, is visible in destinationDir only once the image is complete.
+func (di *DirImage) WritePrepared(ctx context.Context, destinationDir string, prepare PrepareFunc, opt ...Option) error {
 	if di.Image == nil {
 		return errors.New("invalid image")
 	}
-	if err := di.deleteManifest(destinationDir); err != nil {
+	opts := makeOptions(opt...)
+	if opts.staging && opts.resume {
+		return errors.New("staged write can not be resumed, staging directory is removed when it fails")
+	}
+	if err := recoverSwap(destinationDir, opts); err != nil {
+		return err
+	}
+	if !opts.fileFilter.IsEmpty() {
+		if err := di.applyFileFilter(opts.fileFilter); err != nil {
+			return err
+		}
+	}
+	if opts.staging {
+		return di.writeStaged(ctx, destinationDir, prepare, opts)
+	}
+	if err := opts.fs.MkdirAll(destinationDir, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create directory for writing: %w", err)
+	}
+	if err := applyPrepare(destinationDir, prepare, opts); err != nil {
+		return err
+	}
+	return di.write(ctx, destinationDir, opts)
+}
+
+func applyPrepare(dir string, prepare PrepareFunc, opts *options) error {
+	if prepare == nil {
+		return nil
+	}
+	extra, err := prepare(dir)
+	if err != nil {
+		return err
+	}
+	for _, o := range extra {
+		o(opts)
+	}
+	return nil
+}
+
+func (di *DirImage) write(ctx context.Context, destinationDir string, opts *options) error {
+	if err := di.deleteManifest(destinationDir, opts); err != nil {
 		return fmt.Errorf("failed to delete manifest: %w", err)
 	}
-	opts := makeOptions(opt...)
 
+	if err := di.checkCaseConflicts(destinationDir, opts); err != nil {
+		return err
+	}
+
+	if err := checkDiskSpace(destinationDir, di.segmentDescriptors, opts); err != nil {
+		return err
+	}
+
+	// Create & truncate the files to correct sizes, so we only have to overwrite parts that are different
+	err := truncateFiles(destinationDir, di.segmentDescriptors, opts)
+	if err != nil {
+		return err
+	}
+
+	var resume *resumeTracker
+	if opts.resume {
+		manifestDigest, err := di.Image.Digest()
+		if err != nil {
+			return fmt.Errorf("failed to get manifest digest: %w", err)
+		}
+		resume = loadResumeTracker(opts.fs, opts.clock, destinationDir, manifestDigest.String(), opts.printf)
+	}
+
+	indices := make([]int, len(di.segmentDescriptors))
+	for i := range indices {
+		indices[i] = i
+	}
+	err = di.writeSegments(ctx, destinationDir, indices, true, resume, opts)
+	if err != nil {
+		if resume != nil {
+			// keep what was done for the next attempt
+			if flushErr := resume.Flush(); flushErr != nil {
+				opts.printf("unable to save resume state: %v\n", flushErr)
+			}
+		}
+		return err
+	}
+	err = restoreMetadata(destinationDir, di.segmentDescriptors, opts)
+	if err != nil {
+		return err
+	}
+	err = createSymlinks(destinationDir, di.symlinks, opts)
+	if err != nil {
+		return err
+	}
+	err = createDirectories(destinationDir, di.directories, opts)
+	if err != nil {
+		return err
+	}
+
+	err = di.writeConfigAndManifest(destinationDir, opts)
+	if err != nil {
+		return err
+	}
+	// all segments are in place, so there is nothing to resume anymore
+	return deleteResumeState(opts.fs, destinationDir)
+}
+
+// writeSegments downloads segments with given indices using pool of workers. With verifyExisting,
+// segments already matching local content are skipped.
+func (di *DirImage) writeSegments(ctx context.Context, destinationDir string, indices []int, verifyExisting bool, resume *resumeTracker, opts *options) error {
 	type Job struct {
+		Index      int
 		Descriptor filesegment.Descriptor
 		Layer      v1.Layer
+		Zero       bool
 	}
-	bytesTotal := di.Length()
-	sendProgressUpdate(opts.progress, 0, bytesTotal)
-
-	// Create & truncate the files to correct sizes, so we only have to overwrite parts that are different
-	err := truncateFiles(destinationDir, di.segmentDescriptors)
+	zeroSegments, err := findZeroSegments(di.segmentDescriptors, opts)
 	if err != nil {
 		return err
 	}
+	progress := newProgressTracker(opts)
+	for _, idx := range indices {
+		progress.Expect(di.segmentDescriptors[idx].Filename(), di.segmentDescriptors[idx].Length())
+	}
+	initialPhase := PhaseDownloading
+	if verifyExisting {
+		initialPhase = PhaseVerifying
+	}
+	progress.Start(initialPhase)
+	stalls := newStallDetector(opts, progress)
+	if opts.stallTimeout > 0 {
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			stalls.Run(stop)
+		}()
+		// caller may close progress channel once Write returns, so detector has to be gone by then
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+	}
 
 	jobs := make(chan Job, opts.workersCount)
 	g, groupCtx := errgroup.WithContext(ctx)
-	layerOpts := []filesegment.LayerOpt{filesegment.WithLogFunction(opts.printf)}
+	layerOpts := opts.layerOptions()
 	for w := 0; w < opts.workersCount; w++ {
 		g.Go(func() error {
 			for job := range jobs {
-				di.BytesReadCount.Add(job.Descriptor.Length())
-				sendProgressUpdate(opts.progress, di.BytesReadCount.Load(), bytesTotal)
-				if filesegment.Matches(&job.Descriptor, destinationDir, layerOpts...) {
+				_, trusted := opts.trustedFiles[job.Descriptor.Filename()]
+				if !trusted {
+					di.BytesReadCount.Add(job.Descriptor.Length())
+				}
+				if resume != nil && resume.IsCompleted(job.Index) {
+					opts.printf("resumed layer: %v was already completed\n", &job.Descriptor)
+					progress.AddSegment(PhaseVerifying, &job.Descriptor)
+					continue
+				}
+				if verifyExisting && (trusted || filesegment.Matches(&job.Descriptor, destinationDir, layerOpts...)) {
 					opts.printf("existing layer: %v matches %v\n", &job.Descriptor, job.Descriptor)
+					stalls.Touch()
+					progress.AddSegment(PhaseVerifying, &job.Descriptor)
+					if resume != nil {
+						// content may have been cloned or written by a crashed pull, and not reached the disk yet
+						if err := syncSegment(destinationDir, &job.Descriptor, opts); err != nil {
+							return err
+						}
+						if err := resume.MarkCompleted(job.Index); err != nil {
+							return err
+						}
+					}
 					continue
 				}
 
-				for i := 0; i < opts.networkFailureRetryCount; i++ {
-					written, skipped, err := writeLayer(destinationDir, &job.Descriptor, job.Layer)
-					opts.printf("downloaded layer: %v, written=%d, skipped=%d\n", &job.Descriptor, written, skipped)
+				retry := opts.newRetrier()
+				var lastErr, retryErr error
+				written := false
+				for !written && retry.Next(groupCtx, retryErr) {
+					watch := stalls.Watch(&job.Descriptor)
+					bytesWritten, bytesSkipped, err := writeLayer(groupCtx, destinationDir, &job.Descriptor, job.Layer, job.Zero, di.dictionary, opts, watch)
+					stalls.Done(watch)
+					if job.Zero {
+						opts.printf("materialized zero layer: %v, written=%d, skipped=%d\n", &job.Descriptor, bytesWritten, bytesSkipped)
+					} else {
+						opts.printf("downloaded layer: %v, written=%d, skipped=%d\n", &job.Descriptor, bytesWritten, bytesSkipped)
+					}
 
-					di.BytesWrittenCount.Add(written)
-					di.BytesSkippedCount.Add(skipped)
-					if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+					di.BytesWrittenCount.Add(bytesWritten)
+					di.BytesSkippedCount.Add(bytesSkipped)
+					if err == nil {
+						if resume != nil {
+							if err := resume.MarkCompleted(job.Index); err != nil {
+								return err
+							}
+						}
+						written = true
 						continue
 					}
-					if err == nil {
-						break
+					// bytes of failed attempt will arrive again on retry
+					id := job.Descriptor.ID()
+					progress.Add(PhaseDownloading, job.Descriptor.Filename(), &id, -watch.BytesRead())
+					lastErr, retryErr = err, err
+					if watch.Stalled() {
+						// interrupted on purpose, so it is retried regardless of the error it ended with
+						opts.printf("retrying stalled layer: %v\n", &job.Descriptor)
+						retryErr = nil
+						continue
 					}
-					opts.printf("failed writing to file '%v' at offset '%v': %v\n", job.Descriptor.Filename(), job.Descriptor.Start(), err)
+					opts.printf("failed writing %v: %v\n", &job.Descriptor, err)
+				}
+				if !written {
+					if groupCtx.Err() != nil {
+						return groupCtx.Err()
+					}
+					return fmt.Errorf("unable to write %v: %w", &job.Descriptor, lastErr)
 				}
 			}
 			return nil
@@ -141,7 +440,8 @@ func (di *DirImage) Write(ctx context.Context, destinationDir string, opt ...Opt
 
 	g.Go(func() error {
 		defer close(jobs)
-		for _, d := range di.segmentDescriptors {
+		for _, i := range indices {
+			d := di.segmentDescriptors[i]
 			l, err := di.Image.LayerByDigest(d.Digest())
 			if err != nil {
 				return err
@@ -149,21 +449,20 @@ func (di *DirImage) Write(ctx context.Context, destinationDir string, opt ...Opt
 			select {
 			case <-groupCtx.Done():
 				return groupCtx.Err() // Early return on context cancellation.
-			case jobs <- Job{Descriptor: *d, Layer: l}:
+			case jobs <- Job{Index: i, Descriptor: *d, Layer: l, Zero: zeroSegments[i]}:
 			}
 		}
 		return nil
 	})
 
-	err = g.Wait()
-	if err != nil {
-		return err
-	}
+	return g.Wait()
+}
 
-	return di.WriteConfigAndManifest(destinationDir)
+func (di *DirImage) WriteConfigAndManifest(destinationDir string, opt ...Option) error {
+	return di.writeConfigAndManifest(destinationDir, makeOptions(opt...))
 }
 
-func (di *DirImage) WriteConfigAndManifest(destinationDir string) error {
+func (di *DirImage) writeConfigAndManifest(destinationDir string, opts *options) error {
 	rawManifest, err := di.Image.RawManifest()
 	if err != nil {
 		return fmt.Errorf("failed to get raw manifest: %w", err)
@@ -172,17 +471,69 @@ func (di *DirImage) WriteConfigAndManifest(destinationDir string) error {
 	if err != nil {
 		return fmt.Errorf("failed to get raw config: %w", err)
 	}
-	err = os.WriteFile(filepath.Join(destinationDir, LocalConfigFilename), rawConfig, 0777)
+	err = writeMetadataFile(filepath.Join(destinationDir, LocalConfigFilename), rawConfig, opts)
 	if err != nil {
 		return fmt.Errorf("failed to write config file: %w", err)
 	}
-	return os.WriteFile(filepath.Join(destinationDir, LocalManifestFilename), rawManifest, 0o777)
+	return writeMetadataFile(filepath.Join(destinationDir, LocalManifestFilename), rawManifest, opts)
+}
+
+// writeMetadataFile writes data to path with configured mode and owner. With fsync enabled, data goes
+// to a synced temporary file first, which is then renamed over path, so the file is either old or complete after power loss.
+func writeMetadataFile(path string, data []byte, opts *options) error {
+	if !opts.fsync {
+		if err := opts.fs.WriteFile(path, data, opts.metadataFileMode); err != nil {
+			return err
+		}
+		// WriteFile keeps mode of already existing file
+		if err := opts.fs.Chmod(path, opts.metadataFileMode); err != nil {
+			return err
+		}
+		return applyOwner(path, opts)
+	}
+	tmpPath := path + ".tmp-" + strconv.FormatInt(opts.rand.Int63(), 36)
+	f, err := opts.fs.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, opts.metadataFileMode)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = opts.fs.Chmod(tmpPath, opts.metadataFileMode)
+	}
+	if err == nil {
+		err = applyOwner(tmpPath, opts)
+	}
+	if err == nil {
+		err = opts.fs.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = opts.fs.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(path), opts)
+	return nil
+}
+
+// syncDir persists directory entries after rename. It is best effort, as not every platform allows syncing directories.
+func syncDir(dir string, opts *options) {
+	d, err := opts.fs.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	_ = d.Sync()
 }
 
-func (di *DirImage) deleteManifest(destinationDir string) error {
+func (di *DirImage) deleteManifest(destinationDir string, opts *options) error {
 	manifestPath := filepath.Join(destinationDir, LocalManifestFilename)
 
-	err := os.Remove(manifestPath)
+	err := opts.fs.Remove(manifestPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
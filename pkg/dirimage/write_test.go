@@ -1,15 +1,28 @@
 package dirimage
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/json"
 	"errors"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestWrite_ContextCancelledDuringWork(t *testing.T) {
@@ -66,7 +79,7 @@ func TestDirImage_deleteManifest(t *testing.T) {
 		}
 
 		// Call the deleteManifest function
-		err := di.deleteManifest(tempDir)
+		err := di.deleteManifest(tempDir, makeOptions())
 		if err != nil {
 			t.Fatalf("Expected no error, but got: %v", err)
 		}
@@ -85,9 +98,920 @@ func TestDirImage_deleteManifest(t *testing.T) {
 		}
 
 		// Call the deleteManifest function
-		err := di.deleteManifest(tempDir)
+		err := di.deleteManifest(tempDir, makeOptions())
 		if err != nil {
 			t.Fatalf("Expected no error when file does not exist, but got: %v", err)
 		}
 	})
 }
+
+func TestWrite_Resume(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+
+	err := generateRandomFile(filepath.Join(srcDir, "disk.img"), 100)
+	require.NoError(t, err)
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(10))
+	require.NoError(t, err)
+	di, err := Convert(srcImg)
+	require.NoError(t, err)
+	manifestDigest, err := di.Digest()
+	require.NoError(t, err)
+
+	err = di.Write(context.Background(), dstDir, WithResume(true))
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dstDir, LocalResumeStateFilename))
+	require.True(t, os.IsNotExist(err), "resume state must be removed after successful write")
+
+	corruptFirstSegment := func() {
+		f, err := os.OpenFile(filepath.Join(dstDir, "disk.img"), os.O_RDWR, 0o644)
+		require.NoError(t, err)
+		defer f.Close()
+		_, err = f.WriteAt([]byte("corrupted!"), 0)
+		require.NoError(t, err)
+	}
+	writeState := func(digest string, completed ...int) {
+		data, err := json.Marshal(resumeState{ManifestDigest: digest, CompletedSegments: completed})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dstDir, LocalResumeStateFilename), data, 0o644))
+	}
+	readFirstSegment := func() string {
+		data, err := os.ReadFile(filepath.Join(dstDir, "disk.img"))
+		require.NoError(t, err)
+		return string(data[:10])
+	}
+
+	t.Run("completed segments are not verified again", func(t *testing.T) {
+		corruptFirstSegment()
+		writeState(manifestDigest.String(), 0)
+		writtenBefore := di.BytesWrittenCount.Load()
+		err := di.Write(context.Background(), dstDir, WithResume(true))
+		require.NoError(t, err)
+		assert.Equal(t, "corrupted!", readFirstSegment())
+		assert.Equal(t, writtenBefore, di.BytesWrittenCount.Load())
+	})
+
+	t.Run("state of different manifest is ignored", func(t *testing.T) {
+		corruptFirstSegment()
+		writeState("sha256:0000", 0)
+		err := di.Write(context.Background(), dstDir, WithResume(true))
+		require.NoError(t, err)
+		assert.NotEqual(t, "corrupted!", readFirstSegment())
+	})
+
+	t.Run("state is ignored without resume", func(t *testing.T) {
+		corruptFirstSegment()
+		writeState(manifestDigest.String(), 0)
+		err := di.Write(context.Background(), dstDir)
+		require.NoError(t, err)
+		assert.NotEqual(t, "corrupted!", readFirstSegment())
+		_, err = os.Stat(filepath.Join(dstDir, LocalResumeStateFilename))
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestResumeTracker_Flush(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	noLog := func(string, ...any) {}
+	rt := loadResumeTracker(sysenv.OS, fixedClock{now: start}, dir, "sha256:1234", noLog)
+	loaded := func() map[int]struct{} {
+		return loadResumeTracker(sysenv.OS, fixedClock{now: start}, dir, "sha256:1234", noLog).completed
+	}
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, rt.MarkCompleted(i))
+	}
+	assert.Empty(t, loaded(), "state is not rewritten for every segment")
+
+	rt.clock = fixedClock{now: start.Add(resumeFlushInterval)}
+	require.NoError(t, rt.MarkCompleted(100))
+	assert.Len(t, loaded(), 101)
+
+	require.NoError(t, rt.MarkCompleted(101))
+	require.NoError(t, rt.Flush())
+	assert.Len(t, loaded(), 102)
+
+	leftovers, err := filepath.Glob(filepath.Join(dir, LocalResumeStateFilename+".*.tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
+
+type recordingFS struct {
+	sysenv.FS
+	mu      sync.Mutex
+	written []string
+}
+
+func (r *recordingFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	r.mu.Lock()
+	r.written = append(r.written, filepath.Base(name))
+	r.mu.Unlock()
+	return r.FS.WriteFile(name, data, perm)
+}
+
+type fixedClock struct {
+	now time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.now
+}
+
+func (c fixedClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- c.now.Add(d)
+	return ch
+}
+
+func TestReadWrite_InjectedEnvironment(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	err := generateRandomFile(filepath.Join(srcDir, "disk.img"), 100)
+	require.NoError(t, err)
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	fsys := &recordingFS{FS: sysenv.OS}
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(30), WithFileSystem(fsys), WithClock(fixedClock{now: created}))
+	require.NoError(t, err)
+	cfg, err := srcImg.ConfigFile()
+	require.NoError(t, err)
+	assert.True(t, created.Equal(cfg.Created.Time))
+	assert.Equal(t, created.Format(time.RFC3339), cfg.Config.Labels["org.opencontainers.image.created"])
+
+	di, err := Convert(srcImg)
+	require.NoError(t, err)
+	err = di.Write(context.Background(), dstDir, WithFileSystem(fsys))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{LocalConfigFilename, LocalManifestFilename}, fsys.written)
+}
+
+func TestWrite_Staging(t *testing.T) {
+	srcDir := t.TempDir()
+	rootDir := t.TempDir()
+	dstDir := filepath.Join(rootDir, "image")
+
+	err := generateRandomFile(filepath.Join(srcDir, "disk.img"), 100)
+	require.NoError(t, err)
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(10))
+	require.NoError(t, err)
+	di, err := Convert(srcImg)
+	require.NoError(t, err)
+
+	require.NoError(t, os.MkdirAll(dstDir, 0o777))
+	require.NoError(t, os.WriteFile(filepath.Join(dstDir, "disk.img"), []byte("previous content"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dstDir, LocalManifestFilename), []byte("{}"), 0o644))
+
+	onlyImageDirLeft := func() {
+		entries, err := os.ReadDir(rootDir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "image", entries[0].Name())
+	}
+
+	t.Run("failed write leaves previous image intact", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := di.Write(ctx, dstDir, WithStaging(true))
+		require.ErrorIs(t, err, context.Canceled)
+
+		content, err := os.ReadFile(filepath.Join(dstDir, "disk.img"))
+		require.NoError(t, err)
+		assert.Equal(t, "previous content", string(content))
+		_, err = os.Stat(filepath.Join(dstDir, LocalManifestFilename))
+		assert.NoError(t, err)
+		onlyImageDirLeft()
+	})
+
+	t.Run("successful write replaces previous image", func(t *testing.T) {
+		err := di.Write(context.Background(), dstDir, WithStaging(true))
+		require.NoError(t, err)
+
+		expected, err := os.ReadFile(filepath.Join(srcDir, "disk.img"))
+		require.NoError(t, err)
+		content, err := os.ReadFile(filepath.Join(dstDir, "disk.img"))
+		require.NoError(t, err)
+		assert.Equal(t, expected, content)
+		onlyImageDirLeft()
+	})
+
+	t.Run("swap without atomic exchange replaces previous image", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(dstDir, "disk.img"), []byte("previous content"), 0o644))
+		err := di.Write(context.Background(), dstDir, WithStaging(true), WithFileSystem(renamingFS{sysenv.OS}))
+		require.NoError(t, err)
+
+		expected, err := os.ReadFile(filepath.Join(srcDir, "disk.img"))
+		require.NoError(t, err)
+		content, err := os.ReadFile(filepath.Join(dstDir, "disk.img"))
+		require.NoError(t, err)
+		assert.Equal(t, expected, content)
+		onlyImageDirLeft()
+	})
+
+	t.Run("previous image moved aside by interrupted swap is restored", func(t *testing.T) {
+		oldDir := filepath.Join(rootDir, ".image.old-1")
+		require.NoError(t, os.Rename(dstDir, oldDir))
+		require.NoError(t, recoverSwap(dstDir, makeOptions()))
+		assert.FileExists(t, filepath.Join(dstDir, LocalManifestFilename))
+		onlyImageDirLeft()
+	})
+
+	t.Run("staged write can not be resumed", func(t *testing.T) {
+		err := di.Write(context.Background(), dstDir, WithStaging(true), WithResume(true))
+		assert.ErrorContains(t, err, "staged write can not be resumed")
+	})
+}
+
+// renamingFS is filesystem without atomic exchange of directories
+type renamingFS struct {
+	sysenv.FS
+}
+
+// caseInsensitiveFS emulates case-insensitive filesystem by lowercasing every accessed filename
+type caseInsensitiveFS struct {
+	sysenv.FS
+}
+
+func (c caseInsensitiveFS) fold(name string) string {
+	return filepath.Join(filepath.Dir(name), strings.ToLower(filepath.Base(name)))
+}
+
+func (c caseInsensitiveFS) OpenFile(name string, flag int, perm os.FileMode) (sysenv.File, error) {
+	return c.FS.OpenFile(c.fold(name), flag, perm)
+}
+
+func (c caseInsensitiveFS) Stat(name string) (os.FileInfo, error) {
+	return c.FS.Stat(c.fold(name))
+}
+
+func (c caseInsensitiveFS) Remove(name string) error {
+	return c.FS.Remove(c.fold(name))
+}
+
+func TestWrite_CaseConflicts(t *testing.T) {
+	img := empty.Image
+	srcDir := t.TempDir()
+	for _, name := range []string{"Disk.img", "disk.img", "other.img"} {
+		err := generateRandomFile(filepath.Join(srcDir, name), 10)
+		require.NoError(t, err)
+		layer, err := filesegment.NewLayer(filepath.Join(srcDir, name))
+		require.NoError(t, err)
+		img, err = mutate.Append(img, mutate.Addendum{Layer: layer, Annotations: layer.Annotations()})
+		require.NoError(t, err)
+	}
+	di, err := Convert(img)
+	require.NoError(t, err)
+
+	assert.Equal(t, [][]string{{"Disk.img", "disk.img"}}, findCaseConflicts(di.segmentDescriptors, nil, nil))
+
+	t.Run("case-insensitive destination fails early", func(t *testing.T) {
+		dstDir := t.TempDir()
+		err := di.Write(context.Background(), dstDir, WithFileSystem(caseInsensitiveFS{FS: sysenv.OS}))
+		require.ErrorIs(t, err, ErrCaseConflict)
+		entries, err := os.ReadDir(dstDir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("case-sensitive destination is written", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("default filesystem might be case-insensitive")
+		}
+		err := di.Write(context.Background(), t.TempDir())
+		require.NoError(t, err)
+	})
+}
+
+func TestFindCaseConflicts(t *testing.T) {
+	segments := func(names ...string) []*filesegment.Descriptor {
+		res := make([]*filesegment.Descriptor, 0, len(names))
+		for _, n := range names {
+			res = append(res, filesegment.NewDescriptor(n, 0, 9, v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("0", 64)}))
+		}
+		return res
+	}
+
+	// parent directories differing by case, reported once rather than for every file below them
+	assert.Equal(t, [][]string{{"Data", "data"}},
+		findCaseConflicts(segments("Data/x.img", "data/y.img", "data/z.img", "Data/z.img"), nil, nil))
+	// symlinks and directories collide with files
+	assert.Equal(t, [][]string{{"Disk.img", "disk.img"}, {"Logs", "logs"}},
+		findCaseConflicts(segments("disk.img"), []Symlink{{Name: "Disk.img", Target: "disk.img"}}, []string{"Logs", "logs"}))
+	// Unicode case folding, not only ASCII lowercase
+	assert.Equal(t, [][]string{{"STRASSE.img", "straße.img"}},
+		findCaseConflicts(segments("straße.img", "STRASSE.img"), nil, nil))
+	assert.Empty(t, findCaseConflicts(segments("a/x.img", "b/x.img"), nil, []string{"c"}))
+}
+
+func TestWrite_FileFilter(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	for _, name := range []string{"disk.img", "aux.img", "config.json"} {
+		require.NoError(t, generateRandomFile(filepath.Join(srcDir, name), 100))
+	}
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(30))
+	require.NoError(t, err)
+	di, err := Convert(srcImg)
+	require.NoError(t, err)
+
+	err = di.Write(context.Background(), dstDir, WithFileFilter(FileFilter{Include: []string{"*.img"}, Exclude: []string{"aux*"}}))
+	require.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(dstDir, "disk.img"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dstDir, "aux.img"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dstDir, "config.json"))
+	assert.True(t, os.IsNotExist(err))
+
+	// local manifest describes selected files only, so reading it back yields the same image
+	localImg, err := Read(context.Background(), dstDir, WithChunkSize(30))
+	require.NoError(t, err)
+	expectedDigest, err := di.Digest()
+	require.NoError(t, err)
+	localDigest, err := localImg.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, expectedDigest, localDigest)
+	assert.Equal(t, int64(100), di.Length())
+
+	err = di.Write(context.Background(), dstDir, WithFileFilter(FileFilter{Include: []string{"["}}))
+	assert.Error(t, err)
+}
+
+// stallingImage serves layers, whose first download blocks until it is closed
+type stallingImage struct {
+	v1.Image
+	attempts atomic.Int32
+}
+
+func (si *stallingImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := si.Image.LayerByDigest(h)
+	return &stallingLayer{Layer: l, image: si}, err
+}
+
+type stallingLayer struct {
+	v1.Layer
+	image *stallingImage
+}
+
+func (sl *stallingLayer) Compressed() (io.ReadCloser, error) {
+	if sl.image.attempts.Add(1) == 1 {
+		return &blockingReader{closed: make(chan struct{})}, nil
+	}
+	return sl.Layer.Compressed()
+}
+
+type blockingReader struct {
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (br *blockingReader) Read(p []byte) (int, error) {
+	<-br.closed
+	return 0, errors.New("read on closed reader")
+}
+
+func (br *blockingReader) Close() error {
+	br.once.Do(func() { close(br.closed) })
+	return nil
+}
+
+func TestWrite_StallRetry(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(srcDir, "disk.img"), 100))
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(100))
+	require.NoError(t, err)
+	di, err := Convert(&stallingImage{Image: srcImg})
+	require.NoError(t, err)
+
+	progress := make(chan ProgressUpdate, 100)
+	err = di.Write(context.Background(), dstDir,
+		WithWorkersCount(1),
+		WithProgressChannel(progress),
+		WithStallTimeout(20*time.Millisecond, true))
+	require.NoError(t, err)
+	close(progress)
+
+	expected, err := os.ReadFile(filepath.Join(srcDir, "disk.img"))
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(dstDir, "disk.img"))
+	require.NoError(t, err)
+	assert.Equal(t, expected, content)
+
+	stalledSegments := make([]string, 0)
+	stalledIDs := make([]filesegment.SegmentID, 0)
+	last := ProgressUpdate{}
+	for p := range progress {
+		if p.Stalled {
+			stalledSegments = append(stalledSegments, p.StalledSegment)
+			if p.StalledSegmentID != nil {
+				stalledIDs = append(stalledIDs, *p.StalledSegmentID)
+			}
+			assert.GreaterOrEqual(t, p.StalledFor, 20*time.Millisecond)
+			continue
+		}
+		last = p
+	}
+	assert.Contains(t, stalledSegments, di.segmentDescriptors[0].String())
+	assert.Equal(t, []filesegment.SegmentID{{File: 0, Segment: 0}}, stalledIDs)
+	assert.Equal(t, int64(100), last.BytesProcessed)
+	assert.Equal(t, int64(100), last.BytesTotal)
+}
+
+// syncRecordingFS records names of files which were synced
+type syncRecordingFS struct {
+	sysenv.FS
+	mu     sync.Mutex
+	synced map[string]int
+}
+
+type syncRecordingFile struct {
+	sysenv.File
+	fsys *syncRecordingFS
+}
+
+func (f *syncRecordingFile) Sync() error {
+	f.fsys.mu.Lock()
+	name := filepath.Base(f.Name())
+	if strings.Contains(name, ".tmp-") {
+		name = name[:strings.Index(name, ".tmp-")]
+	}
+	f.fsys.synced[name]++
+	f.fsys.mu.Unlock()
+	return f.File.Sync()
+}
+
+func (s *syncRecordingFS) OpenFile(name string, flag int, perm os.FileMode) (sysenv.File, error) {
+	f, err := s.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &syncRecordingFile{File: f, fsys: s}, nil
+}
+
+func TestWrite_Fsync(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(srcDir, "disk.img"), 100))
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(30))
+	require.NoError(t, err)
+	di, err := Convert(srcImg)
+	require.NoError(t, err)
+
+	fsys := &syncRecordingFS{FS: sysenv.OS, synced: make(map[string]int)}
+	require.NoError(t, di.Write(context.Background(), dstDir, WithFileSystem(fsys), WithFsync(true)))
+	assert.Equal(t, map[string]int{"disk.img": 4, LocalManifestFilename: 1, LocalConfigFilename: 1}, fsys.synced)
+
+	entries, err := os.ReadDir(dstDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3, "temporary files should be renamed into place")
+	res, err := Verify(context.Background(), dstDir)
+	require.NoError(t, err)
+	assert.True(t, res.OK())
+}
+
+func TestWrite_FileModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping because Windows does not support unix permissions")
+	}
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(srcDir, "disk.img"), 100))
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(30))
+	require.NoError(t, err)
+	di, err := Convert(srcImg)
+	require.NoError(t, err)
+
+	mode := func(name string) os.FileMode {
+		info, err := os.Stat(filepath.Join(dstDir, name))
+		require.NoError(t, err)
+		return info.Mode().Perm()
+	}
+
+	require.NoError(t, di.Write(context.Background(), dstDir))
+	assert.Equal(t, os.FileMode(0o644), mode(LocalManifestFilename))
+	assert.Equal(t, os.FileMode(0o644), mode(LocalConfigFilename))
+
+	for _, fsync := range []bool{false, true} {
+		err = di.Write(context.Background(), dstDir, WithMetadataFileMode(0o600), WithDataFileMode(0o640), WithFsync(fsync))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), mode(LocalManifestFilename))
+		assert.Equal(t, os.FileMode(0o600), mode(LocalConfigFilename))
+		assert.Equal(t, os.FileMode(0o640), mode("disk.img"))
+		require.NoError(t, os.Chmod(filepath.Join(dstDir, LocalManifestFilename), 0o644))
+	}
+}
+
+func TestReadWrite_FileMetadata(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	srcFile := filepath.Join(srcDir, "run.sh")
+	require.NoError(t, generateRandomFile(srcFile, 100))
+	require.NoError(t, os.Chmod(srcFile, 0o755))
+	modTime := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	require.NoError(t, os.Chtimes(srcFile, modTime, modTime))
+	xfs, _ := sysenv.OS.(sysenv.XattrFS)
+	withXattr := xfs != nil && xfs.SetXattr(srcFile, "user.geranos.test", []byte("value")) == nil
+
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(30), WithFileMetadata(true, true))
+	require.NoError(t, err)
+	manifest, err := srcImg.Manifest()
+	require.NoError(t, err)
+	require.Len(t, manifest.Layers, 4)
+	assert.Equal(t, modTime.Format(time.RFC3339Nano), manifest.Layers[0].Annotations[filesegment.ModTimeAnnotationKey])
+	for _, l := range manifest.Layers[1:] {
+		assert.NotContains(t, l.Annotations, filesegment.ModTimeAnnotationKey)
+		assert.NotContains(t, l.Annotations, filesegment.FileModeAnnotationKey)
+	}
+
+	di, err := Convert(srcImg)
+	require.NoError(t, err)
+	require.NoError(t, di.Write(context.Background(), dstDir))
+
+	dstFile := filepath.Join(dstDir, "run.sh")
+	info, err := os.Stat(dstFile)
+	require.NoError(t, err)
+	assert.True(t, modTime.Equal(info.ModTime()))
+	if runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0o755), info.Mode().Perm())
+	}
+	if withXattr {
+		attrs, err := xfs.ListXattrs(dstFile)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("value"), attrs["user.geranos.test"])
+	}
+
+	// restored file produces the same image, and placeholder layers keep the annotations as well
+	for _, opts := range [][]Option{{WithChunkSize(30), WithFileMetadata(true, true)}, {WithOmitLayersContent()}} {
+		localImg, err := Read(context.Background(), dstDir, opts...)
+		require.NoError(t, err)
+		expectedDigest, err := srcImg.Digest()
+		require.NoError(t, err)
+		localDigest, err := localImg.Digest()
+		require.NoError(t, err)
+		assert.Equal(t, expectedDigest, localDigest)
+	}
+}
+
+func TestReadWrite_Symlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping because creating symlinks on Windows requires elevated privileges")
+	}
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(srcDir, "disk.img"), 100))
+	require.NoError(t, os.Symlink("disk.img", filepath.Join(srcDir, "current.img")))
+	require.NoError(t, os.Symlink("/nonexistent/target", filepath.Join(srcDir, "dangling")))
+
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(30))
+	require.NoError(t, err)
+	manifest, err := srcImg.Manifest()
+	require.NoError(t, err)
+	require.Len(t, manifest.Layers, 4, "symlinks must not be materialized")
+	assert.JSONEq(t, `[{"name":"current.img","target":"disk.img"},{"name":"dangling","target":"/nonexistent/target"}]`,
+		manifest.Annotations[SymlinksAnnotationKey])
+
+	// previously materialized file is replaced with the link
+	require.NoError(t, os.WriteFile(filepath.Join(dstDir, "current.img"), []byte("stale copy"), 0o644))
+	di, err := Convert(srcImg)
+	require.NoError(t, err)
+	require.NoError(t, di.Write(context.Background(), dstDir))
+
+	target, err := os.Readlink(filepath.Join(dstDir, "current.img"))
+	require.NoError(t, err)
+	assert.Equal(t, "disk.img", target)
+	target, err = os.Readlink(filepath.Join(dstDir, "dangling"))
+	require.NoError(t, err)
+	assert.Equal(t, "/nonexistent/target", target)
+
+	for _, opts := range [][]Option{{WithChunkSize(30)}, {WithOmitLayersContent()}} {
+		localImg, err := Read(context.Background(), dstDir, opts...)
+		require.NoError(t, err)
+		expectedDigest, err := srcImg.Digest()
+		require.NoError(t, err)
+		localDigest, err := localImg.Digest()
+		require.NoError(t, err)
+		assert.Equal(t, expectedDigest, localDigest)
+	}
+
+	filtered, err := FilterFiles(srcImg, FileFilter{Exclude: []string{"dangling"}})
+	require.NoError(t, err)
+	filteredManifest, err := filtered.Manifest()
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"name":"current.img","target":"disk.img"}]`, filteredManifest.Annotations[SymlinksAnnotationKey])
+}
+
+func TestReadWrite_Subdirectories(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "Contents", "Resources"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "Contents", "Empty", "Nested"), 0o755))
+	require.NoError(t, generateRandomFile(filepath.Join(srcDir, "disk.img"), 100))
+	require.NoError(t, generateRandomFile(filepath.Join(srcDir, "Contents", "Resources", "nvram%1.bin"), 50))
+
+	flatImg, err := Read(context.Background(), srcDir, WithChunkSize(30))
+	require.NoError(t, err)
+	flatManifest, err := flatImg.Manifest()
+	require.NoError(t, err)
+	assert.Len(t, flatManifest.Layers, 4, "subdirectories are skipped unless recursive")
+
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(30), WithRecursive(true))
+	require.NoError(t, err)
+	manifest, err := srcImg.Manifest()
+	require.NoError(t, err)
+	require.Len(t, manifest.Layers, 6)
+	assert.Equal(t, "Contents/Resources/nvram%251.bin", manifest.Layers[0].Annotations[filesegment.FilenameAnnotationKey])
+	assert.JSONEq(t, `["Contents/Empty/Nested"]`, manifest.Annotations[DirectoriesAnnotationKey])
+
+	di, err := Convert(srcImg)
+	require.NoError(t, err)
+	require.NoError(t, di.Write(context.Background(), dstDir))
+
+	for _, name := range []string{"disk.img", filepath.Join("Contents", "Resources", "nvram%1.bin")} {
+		expected, err := os.ReadFile(filepath.Join(srcDir, name))
+		require.NoError(t, err)
+		content, err := os.ReadFile(filepath.Join(dstDir, name))
+		require.NoError(t, err)
+		assert.Equal(t, expected, content, name)
+	}
+	info, err := os.Stat(filepath.Join(dstDir, "Contents", "Empty", "Nested"))
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	for _, opts := range [][]Option{{WithChunkSize(30), WithRecursive(true)}, {WithOmitLayersContent()}} {
+		localImg, err := Read(context.Background(), dstDir, opts...)
+		require.NoError(t, err)
+		expectedDigest, err := srcImg.Digest()
+		require.NoError(t, err)
+		localDigest, err := localImg.Digest()
+		require.NoError(t, err)
+		assert.Equal(t, expectedDigest, localDigest)
+	}
+}
+
+func TestReadWrite_ZeroElision(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	content := make([]byte, 100)
+	_, err := rand.Read(content[:30])
+	require.NoError(t, err)
+	_, err = rand.Read(content[90:])
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "disk.img"), content, 0o644))
+
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(30), WithZeroElision(true))
+	require.NoError(t, err)
+	manifest, err := srcImg.Manifest()
+	require.NoError(t, err)
+	require.Len(t, manifest.Layers, 4)
+	mediaTypes := make([]types.MediaType, 0)
+	for _, l := range manifest.Layers {
+		mediaTypes = append(mediaTypes, l.MediaType)
+	}
+	assert.Equal(t, []types.MediaType{filesegment.MediaType, filesegment.ZeroMediaType, filesegment.ZeroMediaType, filesegment.MediaType}, mediaTypes)
+	assert.Equal(t, manifest.Layers[1].Digest, manifest.Layers[2].Digest, "zero segments share descriptor")
+	assert.Equal(t, int64(0), manifest.Layers[1].Size)
+
+	// stale data in place of zeros is overwritten without downloading anything
+	require.NoError(t, os.WriteFile(filepath.Join(dstDir, "disk.img"), bytes.Repeat([]byte{1}, 100), 0o644))
+	di, err := Convert(srcImg)
+	require.NoError(t, err)
+	require.NoError(t, di.Write(context.Background(), dstDir))
+	written, err := os.ReadFile(filepath.Join(dstDir, "disk.img"))
+	require.NoError(t, err)
+	assert.Equal(t, content, written)
+
+	localImg, err := Read(context.Background(), dstDir, WithChunkSize(30), WithZeroElision(true))
+	require.NoError(t, err)
+	expectedDigest, err := srcImg.Digest()
+	require.NoError(t, err)
+	localDigest, err := localImg.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, expectedDigest, localDigest)
+}
+
+// countingImage records how many times content of its layers was accessed.
+type countingImage struct {
+	v1.Image
+	accessed atomic.Int32
+}
+
+func (ci *countingImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := ci.Image.LayerByDigest(h)
+	return &countingLayer{Layer: l, image: ci}, err
+}
+
+type countingLayer struct {
+	v1.Layer
+	image *countingImage
+}
+
+func (cl *countingLayer) Compressed() (io.ReadCloser, error) {
+	cl.image.accessed.Add(1)
+	return cl.Layer.Compressed()
+}
+
+func TestWrite_SkipsDownloadingZeroSegments(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	content := make([]byte, 100)
+	_, err := rand.Read(content[60:])
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "disk.img"), content, 0o644))
+
+	// image pushed without zero elision has regular segments of zeros
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(30))
+	require.NoError(t, err)
+	counting := &countingImage{Image: srcImg}
+	di, err := Convert(counting)
+	require.NoError(t, err)
+	require.NoError(t, di.Write(context.Background(), dstDir, WithChunkSize(1000)))
+
+	written, err := os.ReadFile(filepath.Join(dstDir, "disk.img"))
+	require.NoError(t, err)
+	assert.Equal(t, content, written)
+	assert.Equal(t, int32(2), counting.accessed.Load(), "only segments with data are downloaded")
+}
+
+func TestReadWrite_ProgressPhasesAndFiles(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(srcDir, "disk.img"), 100))
+	require.NoError(t, generateRandomFile(filepath.Join(srcDir, "nvram.bin"), 40))
+	// disk.img is already in place, so only nvram.bin has to be downloaded
+	data, err := os.ReadFile(filepath.Join(srcDir, "disk.img"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dstDir, "disk.img"), data, 0o644))
+
+	collect := func(run func(progress chan<- ProgressUpdate)) []ProgressUpdate {
+		progress := make(chan ProgressUpdate, 1000)
+		run(progress)
+		close(progress)
+		res := make([]ProgressUpdate, 0)
+		for u := range progress {
+			res = append(res, u)
+		}
+		return res
+	}
+	var srcImg *DirImage
+	readUpdates := collect(func(progress chan<- ProgressUpdate) {
+		srcImg, err = Read(context.Background(), srcDir, WithChunkSize(30), WithWorkersCount(1), WithProgressChannel(progress))
+		require.NoError(t, err)
+	})
+	last := readUpdates[len(readUpdates)-1]
+	assert.Equal(t, PhaseHashing, last.Phase)
+	assert.Equal(t, int64(140), last.BytesProcessed)
+	assert.Equal(t, int64(140), last.BytesTotal)
+	assert.Equal(t, "nvram.bin", last.Filename)
+	assert.Equal(t, int64(40), last.FileBytesTotal)
+	assert.Equal(t, int64(40), last.FileBytesProcessed)
+
+	di, err := Convert(srcImg)
+	require.NoError(t, err)
+	writeUpdates := collect(func(progress chan<- ProgressUpdate) {
+		require.NoError(t, di.Write(context.Background(), dstDir, WithWorkersCount(1), WithProgressChannel(progress)))
+	})
+	files := make(map[string]ProgressUpdate)
+	phases := make(map[string]map[Phase]struct{})
+	for _, u := range writeUpdates {
+		assert.Equal(t, int64(140), u.BytesTotal)
+		if u.Filename == "" {
+			continue
+		}
+		require.NotNil(t, u.SegmentID)
+		files[u.Filename] = u
+		if phases[u.Filename] == nil {
+			phases[u.Filename] = make(map[Phase]struct{})
+		}
+		phases[u.Filename][u.Phase] = struct{}{}
+	}
+	assert.Equal(t, map[Phase]struct{}{PhaseVerifying: {}}, phases["disk.img"])
+	assert.Equal(t, map[Phase]struct{}{PhaseDownloading: {}}, phases["nvram.bin"])
+	assert.Equal(t, int64(100), files["disk.img"].FileBytesProcessed)
+	assert.Equal(t, int64(40), files["nvram.bin"].FileBytesProcessed)
+	assert.Equal(t, int64(40), files["nvram.bin"].FileBytesTotal)
+	assert.Equal(t, filesegment.SegmentID{File: 1, Segment: 5}, *files["nvram.bin"].SegmentID)
+}
+
+func TestWrite_ProgressFunc(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(srcDir, "disk.img"), 2000))
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(10))
+	require.NoError(t, err)
+	di, err := Convert(srcImg)
+	require.NoError(t, err)
+
+	// no locking here, as the function is never called concurrently
+	updates := make([]ProgressUpdate, 0)
+	require.NoError(t, di.Write(context.Background(), dstDir, WithWorkersCount(4), WithProgressFunc(func(u ProgressUpdate) {
+		updates = append(updates, u)
+	})))
+
+	require.Greater(t, len(updates), 200, "every segment is reported")
+	for i := 1; i < len(updates); i++ {
+		assert.GreaterOrEqual(t, updates[i].BytesProcessed, updates[i-1].BytesProcessed)
+	}
+	assert.Equal(t, int64(2000), updates[len(updates)-1].BytesProcessed)
+	assert.Equal(t, int64(2000), updates[len(updates)-1].BytesTotal)
+}
+
+// limitedSpaceFS reports fixed amount of free space.
+type limitedSpaceFS struct {
+	sysenv.FS
+	free int64
+}
+
+func (l *limitedSpaceFS) FreeSpace(path string) (int64, error) {
+	return l.free, nil
+}
+
+func TestWrite_DiskSpaceCheck(t *testing.T) {
+	srcDir := t.TempDir()
+	content := make([]byte, 100)
+	_, err := rand.Read(content[:40])
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "disk.img"), content, 0o644))
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(20), WithZeroElision(true))
+	require.NoError(t, err)
+
+	t.Run("fails early without enough space", func(t *testing.T) {
+		dstDir := t.TempDir()
+		di, err := Convert(srcImg)
+		require.NoError(t, err)
+		err = di.Write(context.Background(), dstDir, WithFileSystem(&limitedSpaceFS{FS: sysenv.OS, free: 39}))
+		assert.ErrorIs(t, err, ErrInsufficientSpace)
+		assert.NoFileExists(t, filepath.Join(dstDir, "disk.img"))
+	})
+
+	t.Run("zero segments need no space", func(t *testing.T) {
+		di, err := Convert(srcImg)
+		require.NoError(t, err)
+		require.NoError(t, di.Write(context.Background(), t.TempDir(), WithFileSystem(&limitedSpaceFS{FS: sysenv.OS, free: 40})))
+	})
+
+	t.Run("existing content is overwritten in place", func(t *testing.T) {
+		dstDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dstDir, "disk.img"), make([]byte, 30), 0o644))
+		di, err := Convert(srcImg)
+		require.NoError(t, err)
+		require.NoError(t, di.Write(context.Background(), dstDir, WithFileSystem(&limitedSpaceFS{FS: sysenv.OS, free: 10})))
+	})
+
+	t.Run("check can be disabled", func(t *testing.T) {
+		di, err := Convert(srcImg)
+		require.NoError(t, err)
+		require.NoError(t, di.Write(context.Background(), t.TempDir(),
+			WithFileSystem(&limitedSpaceFS{FS: sysenv.OS, free: 0}), WithDiskSpaceCheck(false)))
+	})
+}
+
+// preallocationRecordingFS records sizes files were preallocated to.
+type preallocationRecordingFS struct {
+	sysenv.FS
+	mu    sync.Mutex
+	sizes map[string]int64
+}
+
+func (p *preallocationRecordingFS) Preallocate(name string, size int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sizes[filepath.Base(name)] = size
+	return nil
+}
+
+func TestWrite_Preallocation(t *testing.T) {
+	srcDir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(srcDir, "disk.img"), 100))
+	require.NoError(t, generateRandomFile(filepath.Join(srcDir, "nvram.bin"), 10))
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(30))
+	require.NoError(t, err)
+
+	for _, enabled := range []bool{true, false} {
+		di, err := Convert(srcImg)
+		require.NoError(t, err)
+		fsys := &preallocationRecordingFS{FS: sysenv.OS, sizes: map[string]int64{}}
+		require.NoError(t, di.Write(context.Background(), t.TempDir(), WithFileSystem(fsys), WithPreallocation(enabled)))
+		if enabled {
+			assert.Equal(t, map[string]int64{"disk.img": 100, "nvram.bin": 10}, fsys.sizes)
+		} else {
+			assert.Empty(t, fsys.sizes)
+		}
+	}
+}
+
+func TestWrite_DirectIO(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	require.NoError(t, generateRandomFile(filepath.Join(srcDir, "disk.img"), 100))
+	srcImg, err := Read(context.Background(), srcDir, WithChunkSize(30))
+	require.NoError(t, err)
+	di, err := Convert(srcImg)
+	require.NoError(t, err)
+
+	require.NoError(t, di.Write(context.Background(), dstDir, WithDirectIO(true)))
+	res, err := Verify(context.Background(), dstDir)
+	require.NoError(t, err)
+	assert.True(t, res.OK())
+}
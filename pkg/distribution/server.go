@@ -0,0 +1,406 @@
+// Package distribution serves images over the OCI distribution API, so registry clients, geranos included,
+// can pull them from a Store.
+package distribution
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrNotFound is returned by Store for images and repositories it does not have.
+var ErrNotFound = errors.New("not found")
+
+// Store provides images served by Server.
+type Store interface {
+	// Image returns image of repository repo, by tag or digest reference, ErrNotFound when missing.
+	Image(ctx context.Context, repo string, reference string) (v1.Image, error)
+	// Tags returns tags of repository repo, ErrNotFound when missing.
+	Tags(ctx context.Context, repo string) ([]string, error)
+	// Images returns images of repository repo the store already has, without fetching any,
+	// so blobs can be found in them. It returns ErrNotFound or no images when there are none.
+	Images(ctx context.Context, repo string) ([]v1.Image, error)
+}
+
+// maxCachedImages is how many recently served images Server keeps, to find their blobs without the store.
+const maxCachedImages = 16
+
+// blobEntry is a blob found by Server, of size bytes, with content opened by open.
+type blobEntry struct {
+	size int64
+	open func() (io.ReadCloser, error)
+}
+
+// cachedImage is an image served recently in repo.
+type cachedImage struct {
+	repo     string
+	digest   v1.Hash
+	img      v1.Image
+	manifest *v1.Manifest
+}
+
+// Server is http.Handler of the OCI distribution API: manifests, blobs and tag lists, and pushes with WithUploads.
+// Blobs are found in images of the repository, recently served ones first, and in blobs uploaded before.
+// Single range requests of blobs are supported, so interrupted downloads can be resumed.
+type Server struct {
+	store     Store
+	logf      func(format string, args ...any)
+	uploadDir string
+
+	mu     sync.Mutex
+	images []cachedImage
+}
+
+type Option func(s *Server)
+
+// WithLogFunction sets function logging served requests, nothing is logged by default.
+func WithLogFunction(logf func(format string, args ...any)) Option {
+	return func(s *Server) {
+		s.logf = logf
+	}
+}
+
+func NewServer(store Store, opt ...Option) *Server {
+	s := &Server{
+		store: store,
+		logf:  func(format string, args ...any) {},
+	}
+	for _, f := range opt {
+		f(s)
+	}
+	return s
+}
+
+// apiError is an error response of the distribution API.
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func newAPIError(status int, code string, format string, args ...any) *apiError {
+	return &apiError{status: status, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.logf("%v %v", r.Method, r.URL.Path)
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if err := s.serve(w, r); err != nil {
+		s.logf("%v %v: %v", r.Method, r.URL.Path, err)
+		writeError(w, err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var aerr *apiError
+	if !errors.As(err, &aerr) {
+		aerr = newAPIError(http.StatusInternalServerError, "UNKNOWN", "%v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(aerr.status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]string{{"code": aerr.code, "message": aerr.message}},
+	})
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) error {
+	path := r.URL.Path
+	if path == "/v2/" || path == "/v2" {
+		w.Header().Set("Content-Type", "application/json")
+		_, err := w.Write([]byte("{}"))
+		return err
+	}
+	if !strings.HasPrefix(path, "/v2/") {
+		return newAPIError(http.StatusNotFound, "NOT_FOUND", "unknown path %v", path)
+	}
+	path = strings.TrimPrefix(path, "/v2/")
+	if repo, ok := strings.CutSuffix(path, "/tags/list"); ok {
+		return s.serveTags(w, r, repo)
+	}
+	if i := strings.LastIndex(path, "/manifests/"); i > 0 {
+		if r.Method == http.MethodPut {
+			return s.putManifest(w, r, path[:i], path[i+len("/manifests/"):])
+		}
+		return s.serveManifest(w, r, path[:i], path[i+len("/manifests/"):])
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i > 0 {
+		if id, ok := isUploadPath(path[i+len("/blobs/"):]); ok {
+			return s.serveUpload(w, r, path[:i], id)
+		}
+		return s.serveBlob(w, r, path[:i], path[i+len("/blobs/"):])
+	}
+	return newAPIError(http.StatusNotFound, "NOT_FOUND", "unknown path %v", r.URL.Path)
+}
+
+func readOnly(r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return newAPIError(http.StatusMethodNotAllowed, "UNSUPPORTED", "method %v is not supported", r.Method)
+	}
+	return nil
+}
+
+func storeError(err error, code string, what string) error {
+	if errors.Is(err, ErrNotFound) {
+		return newAPIError(http.StatusNotFound, code, "%v: %v", what, err)
+	}
+	return err
+}
+
+func (s *Server) serveTags(w http.ResponseWriter, r *http.Request, repo string) error {
+	if err := readOnly(r); err != nil {
+		return err
+	}
+	tags, err := s.store.Tags(r.Context(), repo)
+	if err != nil {
+		return storeError(err, "NAME_UNKNOWN", repo)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]any{"name": repo, "tags": tags})
+}
+
+func (s *Server) serveManifest(w http.ResponseWriter, r *http.Request, repo string, reference string) error {
+	if err := readOnly(r); err != nil {
+		return err
+	}
+	img, err := s.store.Image(r.Context(), repo, reference)
+	if err != nil {
+		return storeError(err, "MANIFEST_UNKNOWN", repo+":"+reference)
+	}
+	raw, err := img.RawManifest()
+	if err != nil {
+		return err
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	if h, err := v1.NewHash(reference); err == nil && h != digest {
+		return newAPIError(http.StatusNotFound, "MANIFEST_UNKNOWN", "%v@%v changed to %v", repo, reference, digest)
+	}
+	if err := s.cacheImage(repo, img); err != nil {
+		return err
+	}
+	etag := `"` + digest.String() + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Docker-Content-Digest", digest.String())
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	w.Header().Set("Content-Type", string(mediaType))
+	w.Header().Set("Content-Length", fmt.Sprint(len(raw)))
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err = w.Write(raw)
+	return err
+}
+
+// cacheImage keeps img of repo as the most recently served one, dropping the least recently served
+// one when there are more than maxCachedImages.
+func (s *Server) cacheImage(repo string, img v1.Image) error {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.images = slices.DeleteFunc(s.images, func(c cachedImage) bool {
+		return c.repo == repo && c.digest == digest
+	})
+	s.images = append(s.images, cachedImage{repo: repo, digest: digest, img: img, manifest: manifest})
+	if len(s.images) > maxCachedImages {
+		s.images = slices.Delete(s.images, 0, len(s.images)-maxCachedImages)
+	}
+	return nil
+}
+
+// cachedBlob returns blob with digest of images of repo served recently.
+func (s *Server) cachedBlob(repo string, digest v1.Hash) (blobEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.images) - 1; i >= 0; i-- {
+		if c := s.images[i]; c.repo == repo {
+			if b, ok := imageBlob(c.img, c.manifest, digest); ok {
+				return b, true
+			}
+		}
+	}
+	return blobEntry{}, false
+}
+
+// imageBlob returns config or layer of img with digest.
+func imageBlob(img v1.Image, manifest *v1.Manifest, digest v1.Hash) (blobEntry, bool) {
+	if manifest.Config.Digest == digest {
+		return blobEntry{
+			size: manifest.Config.Size,
+			open: func() (io.ReadCloser, error) {
+				rawConfig, err := img.RawConfigFile()
+				if err != nil {
+					return nil, err
+				}
+				return io.NopCloser(bytes.NewReader(rawConfig)), nil
+			},
+		}, true
+	}
+	for _, desc := range manifest.Layers {
+		if desc.Digest == digest {
+			return blobEntry{
+				size: desc.Size,
+				open: func() (io.ReadCloser, error) {
+					l, err := img.LayerByDigest(digest)
+					if err != nil {
+						return nil, err
+					}
+					return l.Compressed()
+				},
+			}, true
+		}
+	}
+	return blobEntry{}, false
+}
+
+// blob finds blob with digest of repo: uploaded, of images served recently or of other images of the store.
+func (s *Server) blob(ctx context.Context, repo string, digest v1.Hash) (blobEntry, error) {
+	if b, ok := s.uploadedBlob(digest); ok {
+		return b, nil
+	}
+	if b, ok := s.cachedBlob(repo, digest); ok {
+		return b, nil
+	}
+	images, err := s.store.Images(ctx, repo)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return blobEntry{}, err
+	}
+	for _, img := range images {
+		manifest, err := img.Manifest()
+		if err != nil {
+			return blobEntry{}, err
+		}
+		if b, ok := imageBlob(img, manifest, digest); ok {
+			if err := s.cacheImage(repo, img); err != nil {
+				return blobEntry{}, err
+			}
+			return b, nil
+		}
+	}
+	return blobEntry{}, newAPIError(http.StatusNotFound, "BLOB_UNKNOWN", "blob %v not found in %v", digest, repo)
+}
+
+func (s *Server) serveBlob(w http.ResponseWriter, r *http.Request, repo string, digestStr string) error {
+	if err := readOnly(r); err != nil {
+		return err
+	}
+	digest, err := v1.NewHash(digestStr)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "DIGEST_INVALID", "invalid digest %v", digestStr)
+	}
+	blob, err := s.blob(r.Context(), repo, digest)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest.String())
+	w.Header().Set("Accept-Ranges", "bytes")
+	start, length, partial, err := byteRange(r.Header.Get("Range"), blob.size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", blob.size))
+		return newAPIError(http.StatusRequestedRangeNotSatisfiable, "BLOB_UNKNOWN", "%v of blob %v", err, digest)
+	}
+	status := http.StatusOK
+	if partial {
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, blob.size))
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(length))
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return nil
+	}
+	rc, err := blob.open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := skip(rc, start); err != nil {
+		return err
+	}
+	// once headers are sent errors can only break the connection, which clients detect by the length
+	w.WriteHeader(status)
+	if _, err := io.CopyN(w, rc, length); err != nil {
+		s.logf("%v %v: %v", r.Method, r.URL.Path, err)
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+// byteRange returns start and length of the range of blob of size requested with Range header,
+// and whether it is a part of the blob. Only single ranges are supported, the whole blob is served otherwise.
+func byteRange(header string, size int64) (int64, int64, bool, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, size, false, nil
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, size, false, nil
+	}
+	if first == "" {
+		// suffix of the blob, bytes=-n
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, size, false, nil
+		}
+		start := max(size-n, 0)
+		return start, size - start, true, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, size, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, size, false, nil
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, false, fmt.Errorf("range %v is beyond %d bytes", spec, size)
+	}
+	return start, end - start + 1, true, nil
+}
+
+// skip skips n bytes of r, by seeking when it can, as compressed layers are produced on the fly.
+func skip(r io.Reader, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err := seeker.Seek(n, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
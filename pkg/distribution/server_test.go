@@ -0,0 +1,179 @@
+package distribution
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type memoryStore map[string]v1.Image
+
+func (m memoryStore) Image(_ context.Context, repo string, reference string) (v1.Image, error) {
+	for ref, img := range m {
+		digest, err := img.Digest()
+		if err != nil {
+			return nil, err
+		}
+		if ref == repo+":"+reference || strings.HasPrefix(ref, repo+":") && digest.String() == reference {
+			return img, nil
+		}
+	}
+	return nil, fmt.Errorf("%v:%v: %w", repo, reference, ErrNotFound)
+}
+
+func (m memoryStore) Tags(_ context.Context, repo string) ([]string, error) {
+	res := make([]string, 0)
+	for ref := range m {
+		if tag, ok := strings.CutPrefix(ref, repo+":"); ok {
+			res = append(res, tag)
+		}
+	}
+	if len(res) == 0 {
+		return nil, ErrNotFound
+	}
+	return res, nil
+}
+
+func (m memoryStore) Images(_ context.Context, repo string) ([]v1.Image, error) {
+	res := make([]v1.Image, 0)
+	for ref, img := range m {
+		if strings.HasPrefix(ref, repo+":") {
+			res = append(res, img)
+		}
+	}
+	return res, nil
+}
+
+func TestServer(t *testing.T) {
+	img, err := random.Image(1024, 3)
+	require.NoError(t, err)
+	s := httptest.NewServer(NewServer(memoryStore{"vms/a:v1": img}))
+	defer s.Close()
+	host := strings.TrimPrefix(s.URL, "http://")
+
+	ref, err := name.ParseReference(host + "/vms/a:v1")
+	require.NoError(t, err)
+	pulled, err := remote.Image(ref)
+	require.NoError(t, err)
+	require.NoError(t, validate.Image(pulled))
+
+	digest, err := img.Digest()
+	require.NoError(t, err)
+	byDigest, err := name.ParseReference(host + "/vms/a@" + digest.String())
+	require.NoError(t, err)
+	desc, err := remote.Head(byDigest)
+	require.NoError(t, err)
+	assert.Equal(t, digest, desc.Digest)
+
+	tags, err := remote.List(ref.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v1"}, tags)
+
+	resp, err := http.Get(s.URL + "/v2/vms/a/manifests/v2")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Get(s.URL + "/v2/vms/b/blobs/" + digest.String())
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "blobs are served only in repositories of their images")
+
+	resp, err = http.Post(s.URL+"/v2/vms/a/blobs/uploads/", "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	t.Run("blobs without manifest fetched before", func(t *testing.T) {
+		restarted := httptest.NewServer(NewServer(memoryStore{"vms/a:v1": img}))
+		defer restarted.Close()
+		layers, err := img.Layers()
+		require.NoError(t, err)
+		layerDigest, err := layers[1].Digest()
+		require.NoError(t, err)
+		compressed, err := layers[1].Compressed()
+		require.NoError(t, err)
+		content, err := io.ReadAll(compressed)
+		require.NoError(t, err)
+
+		resp, err := http.Head(restarted.URL + "/v2/vms/a/blobs/" + layerDigest.String())
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, int64(len(content)), resp.ContentLength)
+
+		req, err := http.NewRequest(http.MethodGet, restarted.URL+"/v2/vms/a/blobs/"+layerDigest.String(), nil)
+		require.NoError(t, err)
+		req.Header.Set("Range", "bytes=100-")
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, fmt.Sprintf("bytes 100-%d/%d", len(content)-1, len(content)), resp.Header.Get("Content-Range"))
+		assert.Equal(t, content[100:], body)
+
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(content)))
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	})
+}
+
+func TestServer_cachedImages(t *testing.T) {
+	store := memoryStore{}
+	for i := 0; i < maxCachedImages+2; i++ {
+		img, err := random.Image(16, 1)
+		require.NoError(t, err)
+		store[fmt.Sprintf("vms/a:v%d", i)] = img
+	}
+	srv := NewServer(store)
+	s := httptest.NewServer(srv)
+	defer s.Close()
+	for i := 0; i < maxCachedImages+2; i++ {
+		resp, err := http.Get(fmt.Sprintf("%v/v2/vms/a/manifests/v%d", s.URL, i))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Len(t, srv.images, maxCachedImages, "images served before are not kept forever")
+}
+
+func TestByteRange(t *testing.T) {
+	for _, tc := range []struct {
+		header        string
+		start, length int64
+		partial       bool
+		err           bool
+	}{
+		{header: "", start: 0, length: 10},
+		{header: "bytes=2-", start: 2, length: 8, partial: true},
+		{header: "bytes=2-4", start: 2, length: 3, partial: true},
+		{header: "bytes=2-100", start: 2, length: 8, partial: true},
+		{header: "bytes=-3", start: 7, length: 3, partial: true},
+		{header: "bytes=0-1,4-5", start: 0, length: 10},
+		{header: "bytes=x-", start: 0, length: 10},
+		{header: "bytes=10-", err: true},
+	} {
+		start, length, partial, err := byteRange(tc.header, 10)
+		if tc.err {
+			assert.Error(t, err, tc.header)
+			continue
+		}
+		require.NoError(t, err, tc.header)
+		assert.Equal(t, []any{tc.start, tc.length, tc.partial}, []any{start, length, partial}, tc.header)
+	}
+}
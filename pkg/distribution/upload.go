@@ -0,0 +1,345 @@
+package distribution
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxManifestSize limits size of pushed manifests, which are read into memory.
+const maxManifestSize = 16 << 20
+
+// WritableStore is Store accepting pushed images.
+type WritableStore interface {
+	Store
+	// WriteImage stores img as repository repo with tag, or by digest when reference is a digest.
+	WriteImage(ctx context.Context, repo string, reference string, img v1.Image) error
+}
+
+// WithUploads makes Server accept pushes of images, when its store is WritableStore. Blobs are uploaded
+// into dir until manifest referring to them is pushed and the image is written to the store.
+func WithUploads(dir string) Option {
+	return func(s *Server) {
+		s.uploadDir = dir
+	}
+}
+
+func (s *Server) writable() (WritableStore, error) {
+	ws, ok := s.store.(WritableStore)
+	if !ok || s.uploadDir == "" {
+		return nil, newAPIError(http.StatusMethodNotAllowed, "UNSUPPORTED", "the registry is read-only")
+	}
+	return ws, nil
+}
+
+func (s *Server) uploadPath(id string) string {
+	return filepath.Join(s.uploadDir, "uploads", id)
+}
+
+func (s *Server) blobPath(digest v1.Hash) string {
+	return filepath.Join(s.uploadDir, "blobs", digest.Algorithm, digest.Hex)
+}
+
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validUploadID rejects IDs which could escape the upload directory.
+func validUploadID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return err == nil && id != ""
+}
+
+// serveUpload handles requests of blob uploads: POST starts an upload, PATCH appends a chunk to it,
+// PUT completes it with the digest of the blob, and DELETE cancels it.
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request, repo string, id string) error {
+	if _, err := s.writable(); err != nil {
+		return err
+	}
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		return s.startUpload(w, r, repo)
+	case !validUploadID(id):
+		return newAPIError(http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "unknown upload %v", id)
+	case r.Method == http.MethodPatch:
+		size, err := s.appendUpload(id, r.Body)
+		if err != nil {
+			return err
+		}
+		return uploadAccepted(w, repo, id, size)
+	case r.Method == http.MethodPut:
+		if _, err := s.appendUpload(id, r.Body); err != nil {
+			return err
+		}
+		return s.completeUpload(w, r, repo, id)
+	case r.Method == http.MethodDelete:
+		_ = os.Remove(s.uploadPath(id))
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return newAPIError(http.StatusMethodNotAllowed, "UNSUPPORTED", "method %v is not supported", r.Method)
+}
+
+func uploadAccepted(w http.ResponseWriter, repo string, id string, size int64) error {
+	w.Header().Set("Location", fmt.Sprintf("/v2/%v/blobs/uploads/%v", repo, id))
+	w.Header().Set("Docker-Upload-UUID", id)
+	w.Header().Set("Range", fmt.Sprintf("0-%d", max(size-1, 0)))
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// startUpload starts an upload, completing it at once when the request has digest of its body.
+// Cross-repository mounts are not supported, so they start an upload too.
+func (s *Server) startUpload(w http.ResponseWriter, r *http.Request, repo string) error {
+	id, err := newUploadID()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.uploadPath(id)), 0o755); err != nil {
+		return err
+	}
+	size, err := s.appendUpload(id, r.Body)
+	if err != nil {
+		return err
+	}
+	if r.URL.Query().Get("digest") != "" {
+		return s.completeUpload(w, r, repo, id)
+	}
+	return uploadAccepted(w, repo, id, size)
+}
+
+// appendUpload appends r to upload id and returns its size.
+func (s *Server) appendUpload(id string, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(s.uploadPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	return info.Size(), f.Close()
+}
+
+// completeUpload verifies the uploaded blob against digest of the request and makes it available in repo.
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, repo string, id string) error {
+	digest, err := v1.NewHash(r.URL.Query().Get("digest"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "DIGEST_INVALID", "invalid digest: %v", err)
+	}
+	path := s.uploadPath(id)
+	f, err := os.Open(path)
+	if err != nil {
+		return newAPIError(http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "unknown upload %v", id)
+	}
+	h, err := v1.Hasher(digest.Algorithm)
+	if err != nil {
+		f.Close()
+		return newAPIError(http.StatusBadRequest, "DIGEST_INVALID", "%v", err)
+	}
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != digest.Hex {
+		_ = os.Remove(path)
+		return newAPIError(http.StatusBadRequest, "DIGEST_INVALID", "uploaded content has digest %v:%v, expected %v",
+			digest.Algorithm, actual, digest)
+	}
+	blobPath := s.blobPath(digest)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(path, blobPath); err != nil {
+		return err
+	}
+	w.Header().Set("Location", fmt.Sprintf("/v2/%v/blobs/%v", repo, digest))
+	w.Header().Set("Docker-Content-Digest", digest.String())
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// uploadedBlob returns blob with digest uploaded to the server. Uploaded blobs are not bound to repositories.
+func (s *Server) uploadedBlob(digest v1.Hash) (blobEntry, bool) {
+	if s.uploadDir == "" {
+		return blobEntry{}, false
+	}
+	path := s.blobPath(digest)
+	info, err := os.Stat(path)
+	if err != nil {
+		return blobEntry{}, false
+	}
+	return blobEntry{
+		size: info.Size(),
+		open: func() (io.ReadCloser, error) {
+			return os.Open(path)
+		},
+	}, true
+}
+
+// putManifest writes image of the pushed manifest, whose blobs must have been uploaded to repo,
+// or served from it, before.
+func (s *Server) putManifest(w http.ResponseWriter, r *http.Request, repo string, reference string) error {
+	ws, err := s.writable()
+	if err != nil {
+		return err
+	}
+	raw, err := io.ReadAll(io.LimitReader(r.Body, maxManifestSize+1))
+	if err != nil {
+		return err
+	}
+	if len(raw) > maxManifestSize {
+		return newAPIError(http.StatusRequestEntityTooLarge, "MANIFEST_INVALID", "manifest is larger than %d bytes", maxManifestSize)
+	}
+	mediaType := types.MediaType(r.Header.Get("Content-Type"))
+	if mediaType.IsIndex() {
+		return newAPIError(http.StatusBadRequest, "MANIFEST_INVALID", "indexes are not supported, push images of platforms")
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "MANIFEST_INVALID", "unable to parse manifest: %v", err)
+	}
+	digest, _, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	if h, err := v1.NewHash(reference); err == nil && h != digest {
+		return newAPIError(http.StatusBadRequest, "DIGEST_INVALID", "manifest has digest %v, pushed as %v", digest, h)
+	}
+	img := &uploadedImage{rawManifest: raw, manifest: manifest}
+	if mediaType == "" {
+		mediaType = manifest.MediaType
+	}
+	img.mediaType = mediaType
+	img.blobs = make(map[v1.Hash]blobEntry, len(manifest.Layers)+1)
+	for _, desc := range append([]v1.Descriptor{manifest.Config}, manifest.Layers...) {
+		b, err := s.blob(r.Context(), repo, desc.Digest)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "BLOB_UNKNOWN", "blob %v was not uploaded", desc.Digest)
+		}
+		img.blobs[desc.Digest] = b
+	}
+	if img.rawConfig, err = img.readBlob(manifest.Config.Digest); err != nil {
+		return err
+	}
+	full, err := partial.CompressedToImage(img)
+	if err != nil {
+		return err
+	}
+	if err := ws.WriteImage(r.Context(), repo, reference, full); err != nil {
+		return fmt.Errorf("unable to write %v:%v: %w", repo, reference, err)
+	}
+	if err := s.cacheImage(repo, full); err != nil {
+		return err
+	}
+	w.Header().Set("Location", fmt.Sprintf("/v2/%v/manifests/%v", repo, digest))
+	w.Header().Set("Docker-Content-Digest", digest.String())
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// Close removes blobs uploaded to the server.
+func (s *Server) Close() error {
+	if s.uploadDir == "" {
+		return nil
+	}
+	return os.RemoveAll(s.uploadDir)
+}
+
+// uploadedImage is image of pushed manifest, with blobs found by the server.
+type uploadedImage struct {
+	blobs       map[v1.Hash]blobEntry
+	rawManifest []byte
+	rawConfig   []byte
+	manifest    *v1.Manifest
+	mediaType   types.MediaType
+}
+
+func (i *uploadedImage) readBlob(digest v1.Hash) ([]byte, error) {
+	rc, err := i.blobs[digest].open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func (i *uploadedImage) RawConfigFile() ([]byte, error) {
+	return i.rawConfig, nil
+}
+
+func (i *uploadedImage) MediaType() (types.MediaType, error) {
+	return i.mediaType, nil
+}
+
+func (i *uploadedImage) RawManifest() ([]byte, error) {
+	return i.rawManifest, nil
+}
+
+func (i *uploadedImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	for _, desc := range i.manifest.Layers {
+		if desc.Digest == h {
+			return &uploadedLayer{image: i, desc: desc}, nil
+		}
+	}
+	return nil, fmt.Errorf("layer %v not found in manifest", h)
+}
+
+type uploadedLayer struct {
+	image *uploadedImage
+	desc  v1.Descriptor
+}
+
+func (l *uploadedLayer) Digest() (v1.Hash, error) {
+	return l.desc.Digest, nil
+}
+
+func (l *uploadedLayer) Compressed() (io.ReadCloser, error) {
+	return l.image.blobs[l.desc.Digest].open()
+}
+
+func (l *uploadedLayer) Size() (int64, error) {
+	return l.desc.Size, nil
+}
+
+func (l *uploadedLayer) MediaType() (types.MediaType, error) {
+	return l.desc.MediaType, nil
+}
+
+// isUploadPath reports whether path below repository is of blob uploads, and returns upload ID of it.
+func isUploadPath(path string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, "uploads")
+	if !ok {
+		return "", false
+	}
+	if rest == "" || rest == "/" {
+		return "", true
+	}
+	if id, ok := strings.CutPrefix(rest, "/"); ok && !strings.Contains(id, "/") {
+		return id, true
+	}
+	return "", false
+}
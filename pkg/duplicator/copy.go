@@ -0,0 +1,126 @@
+package duplicator
+
+import (
+	"fmt"
+	"github.com/macvmio/geranos/pkg/sparsefile"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"io"
+	"os"
+)
+
+// CopyFile copies content of srcFile to dstFile through provided filesystem.
+// It does not rely on any Copy-on-Write capabilities, so it works with virtual filesystems too.
+// Holes of sparse files are preserved, and files of the host filesystem are copied in kernel where supported,
+// see CopyRange.
+func CopyFile(fsys sysenv.FS, srcFile, dstFile string) error {
+	return copyFile(fsys, srcFile, dstFile, func(int64) {})
+}
+
+// copyFile is CopyFile calling progress with the number of bytes copied since its previous call.
+func copyFile(fsys sysenv.FS, srcFile, dstFile string, progress func(n int64)) error {
+	src, err := fsys.Open(srcFile)
+	if err != nil {
+		return fmt.Errorf("unable to open source file '%v': %w", srcFile, err)
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to stat source file '%v': %w", srcFile, err)
+	}
+
+	dst, err := fsys.OpenFile(dstFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open destination file '%v': %w", dstFile, err)
+	}
+	defer dst.Close()
+
+	err = copySparse(dst, src, info.Size(), func(offset, length int64) error {
+		return copyRange(dst, src, offset, length)
+	}, progress)
+	if err != nil {
+		return fmt.Errorf("unable to copy '%v' to '%v': %w", srcFile, dstFile, err)
+	}
+	return nil
+}
+
+// copySparse copies data extents of src with copyExtent, and truncates dst to size, so holes of src
+// stay unallocated in dst instead of being written as zeros. dst is expected to be empty.
+// Extents are copied in pieces of at most progressChunkSize bytes, each reported to progress once copied.
+func copySparse(dst, src sysenv.File, size int64, copyExtent func(offset, length int64) error, progress func(n int64)) error {
+	if err := sparsefile.SetSparse(dst); err != nil {
+		return err
+	}
+	extents, err := sparsefile.DataExtents(src, 0, size)
+	if err != nil {
+		return err
+	}
+	for _, e := range extents {
+		for offset := e.Offset; offset < e.Offset+e.Length; offset += progressChunkSize {
+			length := min(progressChunkSize, e.Offset+e.Length-offset)
+			if err := copyExtent(offset, length); err != nil {
+				return err
+			}
+			progress(length)
+		}
+	}
+	return dst.Truncate(size)
+}
+
+// CopyRange copies length bytes at offset of srcFile to the same offset of existing dstFile, like a segment
+// of a sibling image. Files of the host filesystem are copied with copy_file_range or sendfile on Linux,
+// without passing data through user space, other files with a buffered copy.
+func CopyRange(fsys sysenv.FS, srcFile, dstFile string, offset, length int64) error {
+	return CopyRangeAt(fsys, srcFile, dstFile, offset, offset, length)
+}
+
+// CopyRangeAt is CopyRange copying to dstOffset of dstFile, which is extended when shorter.
+func CopyRangeAt(fsys sysenv.FS, srcFile, dstFile string, srcOffset, dstOffset, length int64) error {
+	src, err := fsys.Open(srcFile)
+	if err != nil {
+		return fmt.Errorf("unable to open source file '%v': %w", srcFile, err)
+	}
+	defer src.Close()
+
+	dst, err := fsys.OpenFile(dstFile, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("unable to open destination file '%v': %w", dstFile, err)
+	}
+	defer dst.Close()
+
+	if err := copyRangeAt(dst, src, srcOffset, dstOffset, length); err != nil {
+		return fmt.Errorf("unable to copy range %d-%d of '%v' to '%v': %w", srcOffset, srcOffset+length-1, srcFile, dstFile, err)
+	}
+	return nil
+}
+
+func copyRange(dst, src sysenv.File, offset, length int64) error {
+	return copyRangeAt(dst, src, offset, offset, length)
+}
+
+func copyRangeAt(dst, src sysenv.File, srcOffset, dstOffset, length int64) error {
+	copied := int64(0)
+	if d, ok := dst.(*os.File); ok {
+		if s, ok := src.(*os.File); ok {
+			n, err := copyInKernel(d, s, srcOffset, dstOffset, length)
+			if err != nil {
+				return err
+			}
+			copied = n
+		}
+	}
+	if copied == length {
+		return nil
+	}
+	// the rest, when copying in kernel is not supported
+	if _, err := dst.Seek(dstOffset+copied, io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.Copy(dst, io.NewSectionReader(src, srcOffset+copied, length-copied))
+	if err != nil {
+		return err
+	}
+	if copied+n != length {
+		return fmt.Errorf("copied %d bytes instead of %d", copied+n, length)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+//go:build linux
+
+package duplicator
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyInKernel copies length bytes at srcOffset of src to dstOffset of dst with copy_file_range,
+// or sendfile when it is not supported, e.g. across filesystems on older kernels. It returns how many bytes
+// were copied before neither of them could continue, leaving the rest to the caller.
+func copyInKernel(dst, src *os.File, srcOffset, dstOffset, length int64) (int64, error) {
+	copied := int64(0)
+	useSendfile := false
+	for copied < length {
+		chunk := int(min(length-copied, 1<<30))
+		var n int
+		var err error
+		if !useSendfile {
+			roff, woff := srcOffset+copied, dstOffset+copied
+			n, err = unix.CopyFileRange(int(src.Fd()), &roff, int(dst.Fd()), &woff, chunk, 0)
+			if isUnsupported(err) {
+				useSendfile = true
+				continue
+			}
+		} else {
+			if _, err = dst.Seek(dstOffset+copied, io.SeekStart); err != nil {
+				return copied, err
+			}
+			roff := srcOffset + copied
+			n, err = unix.Sendfile(int(dst.Fd()), int(src.Fd()), &roff, chunk)
+			if isUnsupported(err) {
+				return copied, nil
+			}
+		}
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return copied, err
+		}
+		if n == 0 {
+			// source is shorter than expected, let the caller report it
+			return copied, nil
+		}
+		copied += int64(n)
+	}
+	return copied, nil
+}
+
+func isUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EINVAL) ||
+		errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EPERM)
+}
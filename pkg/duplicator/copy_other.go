@@ -0,0 +1,10 @@
+//go:build !linux
+
+package duplicator
+
+import "os"
+
+// copyInKernel is not supported here, all content is left to the buffered copy.
+func copyInKernel(dst, src *os.File, srcOffset, dstOffset, length int64) (int64, error) {
+	return 0, nil
+}
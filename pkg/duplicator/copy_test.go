@@ -0,0 +1,96 @@
+package duplicator
+
+import (
+	"bytes"
+	"errors"
+	"github.com/macvmio/geranos/pkg/sparsefile"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("geranos"), 100000)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "src.img"), content, 0o644))
+
+	require.NoError(t, CopyFile(sysenv.OS, filepath.Join(dir, "src.img"), filepath.Join(dir, "dst.img")))
+	copied, err := os.ReadFile(filepath.Join(dir, "dst.img"))
+	require.NoError(t, err)
+	require.Equal(t, content, copied)
+}
+
+func TestCopyRange(t *testing.T) {
+	dir := t.TempDir()
+	src := bytes.Repeat([]byte{1}, 3000)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "src.img"), src, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "dst.img"), make([]byte, 3000), 0o644))
+
+	require.NoError(t, CopyRange(sysenv.OS, filepath.Join(dir, "src.img"), filepath.Join(dir, "dst.img"), 1000, 1000))
+	dst, err := os.ReadFile(filepath.Join(dir, "dst.img"))
+	require.NoError(t, err)
+	expected := make([]byte, 3000)
+	copy(expected[1000:2000], src)
+	require.Equal(t, expected, dst)
+
+	err = CopyRange(sysenv.OS, filepath.Join(dir, "src.img"), filepath.Join(dir, "dst.img"), 2500, 1000)
+	require.ErrorContains(t, err, "copied 500 bytes instead of 1000")
+}
+
+func TestCloneFile(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("geranos"), 100000)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "src.img"), content, 0o644))
+
+	// reflink when the filesystem supports it, copy otherwise, either way with the same content
+	require.NoError(t, CloneFile(filepath.Join(dir, "src.img"), filepath.Join(dir, "dst.img")))
+	cloned, err := os.ReadFile(filepath.Join(dir, "dst.img"))
+	require.NoError(t, err)
+	require.Equal(t, content, cloned)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "range.img"), make([]byte, len(content)), 0o644))
+	require.NoError(t, CloneRange(filepath.Join(dir, "src.img"), filepath.Join(dir, "range.img"), 4096, 8192))
+	cloned, err = os.ReadFile(filepath.Join(dir, "range.img"))
+	require.NoError(t, err)
+	expected := make([]byte, len(content))
+	copy(expected[4096:4096+8192], content[4096:])
+	require.Equal(t, expected, cloned)
+}
+
+func TestCopyFile_Sparse(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "src.img"))
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(16<<20))
+	_, err = f.WriteAt([]byte("data"), 8<<20)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	for _, s := range DefaultStrategies() {
+		t.Run(s.Name, func(t *testing.T) {
+			dst := filepath.Join(dir, s.Name+".img")
+			err := s.Clone(filepath.Join(dir, "src.img"), dst, func(int64) {})
+			if errors.Is(err, ErrStrategyUnsupported) {
+				t.Skipf("%v is not supported here", s.Name)
+			}
+			require.NoError(t, err)
+			content, err := os.ReadFile(dst)
+			require.NoError(t, err)
+			expected := make([]byte, 16<<20)
+			copy(expected[8<<20:], "data")
+			require.Equal(t, expected, content)
+
+			if runtime.GOOS == "linux" {
+				out, err := os.Open(dst)
+				require.NoError(t, err)
+				defer out.Close()
+				hole, err := sparsefile.IsHole(out, 0, 4<<20)
+				require.NoError(t, err)
+				require.True(t, hole, "hole of source was allocated")
+			}
+		})
+	}
+}
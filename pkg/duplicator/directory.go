@@ -1,42 +1,147 @@
 package duplicator
 
 import (
+	"context"
 	"fmt"
+	"golang.org/x/sync/errgroup"
 	"os"
+	"path"
 	"path/filepath"
 )
 
-func CloneDirectory(srcDir, dstDir string, recursive bool) error {
+// cloneJob is a file or directory CloneDirectory clones.
+type cloneJob struct {
+	srcPath string
+	dstPath string
+	info    os.FileInfo
+}
+
+// cloneList lists what CloneDirectory clones, directories in order of creation.
+type cloneList struct {
+	files       []cloneJob
+	directories []cloneJob
+}
+
+// CloneDirectory clones files of srcDir into dstDir, descending into subdirectories when recursive is set.
+// Files are cloned concurrently, see WithConcurrency, and cloning stops when ctx is done.
+// Directories are listed before cloning starts, so progress (see WithProgressFunc) knows the totals.
+// Symlinks are recreated, and cloned entries keep modes and modification times of their sources.
+func CloneDirectory(ctx context.Context, srcDir, dstDir string, recursive bool, opt ...Option) error {
+	opts := makeOptions(opt...)
+	if err := opts.validateFilter(); err != nil {
+		return err
+	}
+	info, err := opts.fs.Stat(srcDir)
+	if err != nil {
+		return fmt.Errorf("unable to stat dir '%v': %w", srcDir, err)
+	}
+	list := &cloneList{
+		files:       make([]cloneJob, 0),
+		directories: []cloneJob{{srcPath: srcDir, dstPath: dstDir, info: info}},
+	}
+	if err := listDirectory(ctx, srcDir, dstDir, "", recursive, list, opts); err != nil {
+		return err
+	}
+	progress := &progressTracker{report: opts.progress}
+	progress.state.FilesTotal = len(list.files)
+	for _, job := range list.files {
+		progress.state.BytesTotal += job.info.Size()
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(opts.concurrency, 1))
+	for _, job := range list.files {
+		if gctx.Err() != nil {
+			break
+		}
+		// this blocks while all workers are busy
+		g.Go(func() error {
+			if err := gctx.Err(); err != nil {
+				return err
+			}
+			fp := progress.file(job.srcPath, job.info.Size())
+			if opts.hardlinks && hardlink(job.srcPath, job.dstPath, opts) {
+				fp.done()
+				return nil
+			}
+			if err := opts.cloneFile(job.srcPath, job.dstPath, fp.add); err != nil {
+				return fmt.Errorf("failed to clone src file '%v' to destination '%v': %w", job.srcPath, job.dstPath, err)
+			}
+			if opts.verify {
+				if err := VerifyClone(opts.fs, job.srcPath, job.dstPath); err != nil {
+					return err
+				}
+			}
+			if err := copyMetadata(job.srcPath, job.dstPath, job.info, opts); err != nil {
+				return err
+			}
+			fp.done()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// files created in directories update their modification times, so the deepest ones go first
+	for i := len(list.directories) - 1; i >= 0; i-- {
+		d := list.directories[i]
+		if err := copyMetadata(d.srcPath, d.dstPath, d.info, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listDirectory creates directories and symlinks of srcDir in dstDir, and adds its files to list.
+// rel is the slash-separated path of srcDir relative to the directory being cloned, which filters match.
+func listDirectory(ctx context.Context, srcDir, dstDir, rel string, recursive bool, list *cloneList, opts *options) error {
 	// Read the contents of the source directory
-	entries, err := os.ReadDir(srcDir)
+	entries, err := opts.fs.ReadDir(srcDir)
 	if err != nil {
 		return fmt.Errorf("unable to read dir '%v': %w", srcDir, err)
 	}
 
-	err = os.MkdirAll(dstDir, os.ModePerm)
+	err = opts.fs.MkdirAll(dstDir, os.ModePerm)
 	if err != nil {
 		return fmt.Errorf("failed to create dst directory '%v': %w", dstDir, err)
 	}
 
 	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		srcPath := filepath.Join(srcDir, entry.Name())
 		dstPath := filepath.Join(dstDir, entry.Name())
+		entryRel := path.Join(rel, entry.Name())
+		if opts.excluded(entryRel, entry.IsDir()) {
+			continue
+		}
 
+		if entry.Type()&os.ModeSymlink != 0 {
+			if err := cloneSymlink(srcPath, dstPath, opts); err != nil {
+				return err
+			}
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("unable to stat '%v': %w", srcPath, err)
+		}
 		if entry.IsDir() {
 			if recursive {
 				// If the entry is a directory, recursively clone it
-				err = CloneDirectory(srcPath, dstPath, recursive)
+				list.directories = append(list.directories, cloneJob{srcPath: srcPath, dstPath: dstPath, info: info})
+				err = listDirectory(ctx, srcPath, dstPath, entryRel, recursive, list, opts)
 				if err != nil {
 					return fmt.Errorf("failed to clone src directory '%v' to destination '%v': %w", srcPath, dstPath, err)
 				}
 			}
-		} else {
-			// If the entry is a file, clone it
-			err = CloneFile(srcPath, dstPath)
-			if err != nil {
-				return fmt.Errorf("failed to clone src file '%v' to destination '%v': %w", srcPath, dstPath, err)
-			}
+			continue
 		}
+		list.files = append(list.files, cloneJob{srcPath: srcPath, dstPath: dstPath, info: info})
 	}
 
 	return nil
@@ -0,0 +1,153 @@
+package duplicator
+
+import (
+	"context"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCloneDirectory(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "sub"), os.ModePerm))
+	for i := 0; i < 20; i++ {
+		require.NoError(t, os.WriteFile(filepath.Join(src, fmt.Sprintf("file%d", i)), []byte{byte(i)}, 0o644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(src, "sub", "nested"), []byte("nested"), 0o644))
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	require.NoError(t, CloneDirectory(context.Background(), src, dst, true, WithConcurrency(3)))
+	for i := 0; i < 20; i++ {
+		content, err := os.ReadFile(filepath.Join(dst, fmt.Sprintf("file%d", i)))
+		require.NoError(t, err)
+		assert.Equal(t, []byte{byte(i)}, content)
+	}
+	content, err := os.ReadFile(filepath.Join(dst, "sub", "nested"))
+	require.NoError(t, err)
+	assert.Equal(t, "nested", string(content))
+
+	t.Run("progress", func(t *testing.T) {
+		updates := make([]Progress, 0)
+		err := CloneDirectory(context.Background(), src, filepath.Join(t.TempDir(), "dst"), true,
+			WithProgressFunc(func(p Progress) {
+				updates = append(updates, p)
+			}))
+		require.NoError(t, err)
+		require.NotEmpty(t, updates)
+		last := updates[len(updates)-1]
+		assert.Equal(t, 21, last.FilesDone)
+		assert.Equal(t, 21, last.FilesTotal)
+		assert.Equal(t, int64(26), last.BytesCloned)
+		assert.Equal(t, int64(26), last.BytesTotal)
+		for i := 1; i < len(updates); i++ {
+			assert.GreaterOrEqual(t, updates[i].BytesCloned, updates[i-1].BytesCloned)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		var cloned atomic.Int32
+		err := CloneDirectory(ctx, src, filepath.Join(t.TempDir(), "dst"), true, WithCloneFunction(func(src, dst string) error {
+			cloned.Add(1)
+			return nil
+		}))
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, int32(0), cloned.Load())
+	})
+
+	t.Run("first error stops cloning", func(t *testing.T) {
+		err := CloneDirectory(context.Background(), src, filepath.Join(t.TempDir(), "dst"), false, WithConcurrency(1),
+			WithCloneFunction(func(src, dst string) error {
+				return os.ErrPermission
+			}))
+		assert.ErrorIs(t, err, os.ErrPermission)
+	})
+}
+
+func TestCloneDirectory_Metadata(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes and symlinks need unix")
+	}
+	src := t.TempDir()
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "sub"), os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "sub", "run.sh"), []byte("#!/bin/sh"), 0o644))
+	require.NoError(t, os.Chmod(filepath.Join(src, "sub", "run.sh"), 0o750))
+	require.NoError(t, os.Chtimes(filepath.Join(src, "sub", "run.sh"), modTime, modTime))
+	require.NoError(t, os.Symlink("sub/run.sh", filepath.Join(src, "link")))
+	require.NoError(t, os.Chtimes(filepath.Join(src, "sub"), modTime, modTime))
+	xfs := sysenv.OS.(sysenv.XattrFS)
+	hasXattrs := xfs.SetXattr(filepath.Join(src, "sub", "run.sh"), "user.geranos.test", []byte("value")) == nil
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	require.NoError(t, CloneDirectory(context.Background(), src, dst, true, WithXattrs(true)))
+
+	info, err := os.Stat(filepath.Join(dst, "sub", "run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o750), info.Mode().Perm())
+	assert.True(t, modTime.Equal(info.ModTime()))
+	info, err = os.Stat(filepath.Join(dst, "sub"))
+	require.NoError(t, err)
+	assert.True(t, modTime.Equal(info.ModTime()))
+	target, err := os.Readlink(filepath.Join(dst, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "sub/run.sh", target)
+	if hasXattrs {
+		attrs, err := xfs.ListXattrs(filepath.Join(dst, "sub", "run.sh"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("value"), attrs["user.geranos.test"])
+	}
+}
+
+func TestCloneDirectory_Filter(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "logs"), os.ModePerm))
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "data"), os.ModePerm))
+	for _, name := range []string{"disk.img", "vm.lock", "logs/vm.log", "data/nvram.bin", "data/run.lock"} {
+		require.NoError(t, os.WriteFile(filepath.Join(src, filepath.FromSlash(name)), []byte(name), 0o644))
+	}
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	require.NoError(t, CloneDirectory(context.Background(), src, dst, true, WithFileFilter(nil, []string{"*.lock", "logs"})))
+	assert.FileExists(t, filepath.Join(dst, "disk.img"))
+	assert.FileExists(t, filepath.Join(dst, "data", "nvram.bin"))
+	assert.NoFileExists(t, filepath.Join(dst, "vm.lock"))
+	assert.NoFileExists(t, filepath.Join(dst, "data", "run.lock"))
+	assert.NoDirExists(t, filepath.Join(dst, "logs"))
+
+	dst = filepath.Join(t.TempDir(), "dst")
+	require.NoError(t, CloneDirectory(context.Background(), src, dst, true, WithFileFilter([]string{"data/*"}, []string{"*.lock"})))
+	assert.FileExists(t, filepath.Join(dst, "data", "nvram.bin"))
+	assert.NoFileExists(t, filepath.Join(dst, "data", "run.lock"))
+	assert.NoFileExists(t, filepath.Join(dst, "disk.img"))
+
+	err := CloneDirectory(context.Background(), src, dst, true, WithFileFilter(nil, []string{"["}))
+	assert.ErrorContains(t, err, "invalid file pattern")
+}
+
+func TestCloneDirectory_Hardlinks(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "disk.img"), []byte("content"), 0o644))
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	cloned := 0
+	err := CloneDirectory(context.Background(), src, dst, false, WithHardlinks(true), WithCloneFunction(func(src, dst string) error {
+		cloned++
+		return CopyFile(sysenv.OS, src, dst)
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 0, cloned)
+	srcInfo, err := os.Stat(filepath.Join(src, "disk.img"))
+	require.NoError(t, err)
+	dstInfo, err := os.Stat(filepath.Join(dst, "disk.img"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(srcInfo, dstInfo))
+}
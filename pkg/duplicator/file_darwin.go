@@ -1,16 +1,40 @@
 package duplicator
 
 import (
-	"os/exec"
+	"errors"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"os"
+
+	"golang.org/x/sys/unix"
 )
 
-// CloneFile attempts to clone a file using 'cp -c'
-func CloneFile(srcFile, dstFile string) error {
-	// Execute 'cp -c' to attempt efficient cloning
-	cmd := exec.Command("/bin/cp", "-c", srcFile, dstFile)
-	if err := cmd.Run(); err != nil {
-		return err
-	}
+func platformStrategies() []Strategy {
+	return []Strategy{{Name: "clonefile", Clone: clonefile, SameFilesystem: true}}
+}
 
+// clonefile clones a file with clonefile(2), sharing its blocks on APFS. Existing dstFile is replaced.
+func clonefile(srcFile, dstFile string, _ func(n int64)) error {
+	if err := os.Remove(dstFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to replace '%v': %w", dstFile, err)
+	}
+	err := unix.Clonefile(srcFile, dstFile, unix.CLONE_NOFOLLOW)
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EXDEV) {
+		return fmt.Errorf("%w: %v", ErrStrategyUnsupported, err)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to clone '%v' to '%v': %w", srcFile, dstFile, err)
+	}
 	return nil
 }
+
+// CloneRange copies length bytes at offset of srcFile to the same offset of existing dstFile.
+// APFS clones only whole files, so the range is copied.
+func CloneRange(srcFile, dstFile string, offset, length int64) error {
+	return CopyRange(sysenv.OS, srcFile, dstFile, offset, length)
+}
+
+// CloneRangeAt is CloneRange copying to dstOffset of dstFile, which is extended when shorter.
+func CloneRangeAt(srcFile, dstFile string, srcOffset, dstOffset, length int64) error {
+	return CopyRangeAt(sysenv.OS, srcFile, dstFile, srcOffset, dstOffset, length)
+}
@@ -3,21 +3,115 @@ package duplicator
 import (
 	"errors"
 	"fmt"
-	"os/exec"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"os"
+
+	"golang.org/x/sys/unix"
 )
 
-// CloneFile attempts to clone a file using cp with --reflink=auto.
-func CloneFile(srcFile, dstFile string) error {
-	// Ensure the command is supported on the platform (Linux-specific)
-	if _, err := exec.LookPath("cp"); err != nil {
-		return errors.New("cp command not found, ensure it's installed and available on PATH")
+func platformStrategies() []Strategy {
+	return []Strategy{
+		{Name: "ficlone", Clone: ficlone, SameFilesystem: true},
+		{Name: "copy_file_range", Clone: copyFileRange},
 	}
+}
 
-	// Execute cp with --reflink=auto to attempt efficient cloning
-	cmd := exec.Command("cp", "--reflink=auto", srcFile, dstFile)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("command '%v' failed: %w", cmd, err)
+// openForClone opens srcFile, and creates dstFile with the same permissions.
+func openForClone(srcFile, dstFile string) (src, dst *os.File, size int64, err error) {
+	src, err = os.Open(srcFile)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("unable to open source file '%v': %w", srcFile, err)
+	}
+	info, err := src.Stat()
+	if err != nil {
+		src.Close()
+		return nil, nil, 0, fmt.Errorf("unable to stat source file '%v': %w", srcFile, err)
 	}
+	dst, err = os.OpenFile(dstFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		src.Close()
+		return nil, nil, 0, fmt.Errorf("unable to open destination file '%v': %w", dstFile, err)
+	}
+	return src, dst, info.Size(), nil
+}
 
+// ficlone clones a file with FICLONE, sharing its extents on btrfs, XFS and bcachefs.
+func ficlone(srcFile, dstFile string, _ func(n int64)) error {
+	src, dst, _, err := openForClone(srcFile, dstFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	defer dst.Close()
+	err = unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+	if isUnsupported(err) || errors.Is(err, unix.ENOTTY) {
+		return fmt.Errorf("%w: %v", ErrStrategyUnsupported, err)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to clone '%v' to '%v': %w", srcFile, dstFile, err)
+	}
 	return nil
 }
+
+// copyFileRange copies a file in kernel, which some filesystems, like NFS, turn into server side copy.
+func copyFileRange(srcFile, dstFile string, progress func(n int64)) error {
+	src, dst, size, err := openForClone(srcFile, dstFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	defer dst.Close()
+	probed := false
+	err = copySparse(dst, src, size, func(offset, length int64) error {
+		copied, err := copyInKernel(dst, src, offset, offset, length)
+		if err != nil {
+			return err
+		}
+		if copied == 0 && !probed {
+			return ErrStrategyUnsupported
+		}
+		probed = true
+		return copyRange(dst, src, offset+copied, length-copied)
+	}, progress)
+	if errors.Is(err, ErrStrategyUnsupported) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("unable to copy '%v' to '%v': %w", srcFile, dstFile, err)
+	}
+	return nil
+}
+
+// CloneRange clones length bytes at offset of srcFile to the same offset of existing dstFile with FICLONERANGE.
+// Ranges not aligned to filesystem blocks, and filesystems without reflinks, get the content copied instead.
+func CloneRange(srcFile, dstFile string, offset, length int64) error {
+	return CloneRangeAt(srcFile, dstFile, offset, offset, length)
+}
+
+// CloneRangeAt is CloneRange cloning to dstOffset of dstFile, which is extended when shorter.
+func CloneRangeAt(srcFile, dstFile string, srcOffset, dstOffset, length int64) error {
+	src, err := os.Open(srcFile)
+	if err != nil {
+		return fmt.Errorf("unable to open source file '%v': %w", srcFile, err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(dstFile, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("unable to open destination file '%v': %w", dstFile, err)
+	}
+	defer dst.Close()
+
+	err = unix.IoctlFileCloneRange(int(dst.Fd()), &unix.FileCloneRange{
+		Src_fd:      int64(src.Fd()),
+		Src_offset:  uint64(srcOffset),
+		Src_length:  uint64(length),
+		Dest_offset: uint64(dstOffset),
+	})
+	if err == nil {
+		return nil
+	}
+	if !isUnsupported(err) && !errors.Is(err, unix.ENOTTY) {
+		return fmt.Errorf("unable to clone range %d-%d of '%v' to '%v': %w", srcOffset, srcOffset+length-1, srcFile, dstFile, err)
+	}
+	return CopyRangeAt(sysenv.OS, srcFile, dstFile, srcOffset, dstOffset, length)
+}
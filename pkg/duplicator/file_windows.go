@@ -3,33 +3,15 @@ package duplicator
 import (
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"unsafe"
 
+	"github.com/macvmio/geranos/pkg/sysenv"
 	"golang.org/x/sys/windows"
 )
 
 const fsctlDuplicateExtentsToFile = 0x00094CF4
 
-func CloneFileFallback(srcFile, dstFile string) error {
-	fmt.Printf("CloneFileFallback: %v -> %v\n", srcFile, dstFile)
-	src, err := os.Open(srcFile)
-	if err != nil {
-		return err
-	}
-	defer src.Close()
-
-	dst, err := os.Create(dstFile)
-	if err != nil {
-		return err
-	}
-	defer dst.Close()
-
-	_, err = io.Copy(dst, src)
-	return err
-}
-
 // duplicateExtentsToFile clones data blocks from the source file handle to the destination file handle.
 func duplicateExtentsToFile(dst, src windows.Handle, srcLength int64) error {
 	type DuplicateExtentsData struct {
@@ -58,8 +40,12 @@ func duplicateExtentsToFile(dst, src windows.Handle, srcLength int64) error {
 	)
 }
 
-// CloneFile efficiently clones a file from srcFile to dstFile on Windows.
-func CloneFile(srcFile, dstFile string) error {
+func platformStrategies() []Strategy {
+	return []Strategy{{Name: "duplicate-extents", Clone: duplicateExtents, SameFilesystem: true}}
+}
+
+// duplicateExtents clones a file with FSCTL_DUPLICATE_EXTENTS_TO_FILE, sharing its clusters on ReFS.
+func duplicateExtents(srcFile, dstFile string, _ func(n int64)) error {
 	srcHandle, err := windows.CreateFile(windows.StringToUTF16Ptr(srcFile),
 		windows.GENERIC_READ, windows.FILE_SHARE_READ, nil,
 		windows.OPEN_EXISTING, windows.FILE_ATTRIBUTE_NORMAL, 0)
@@ -81,16 +67,20 @@ func CloneFile(srcFile, dstFile string) error {
 	}
 	srcFileSize := srcFileInfo.Size()
 
-	// Attempt to clone using duplicate extents
 	err = duplicateExtentsToFile(dstHandle, srcHandle, srcFileSize)
-	if err != nil {
-		windows.Close(srcHandle)
-		windows.Close(dstHandle)
-		if errors.Is(err, windows.ERROR_ACCESS_DENIED) || errors.Is(err, windows.ERROR_NOT_SUPPORTED) {
-			// Fallback to traditional file copy if access is denied or operation is not supported
-			return CloneFileFallback(srcFile, dstFile)
-		}
-		return err
+	if errors.Is(err, windows.ERROR_ACCESS_DENIED) || errors.Is(err, windows.ERROR_NOT_SUPPORTED) ||
+		errors.Is(err, windows.ERROR_INVALID_FUNCTION) {
+		return fmt.Errorf("%w: %v", ErrStrategyUnsupported, err)
 	}
-	return nil
+	return err
+}
+
+// CloneRange copies length bytes at offset of srcFile to the same offset of existing dstFile.
+func CloneRange(srcFile, dstFile string, offset, length int64) error {
+	return CopyRange(sysenv.OS, srcFile, dstFile, offset, length)
+}
+
+// CloneRangeAt is CloneRange copying to dstOffset of dstFile, which is extended when shorter.
+func CloneRangeAt(srcFile, dstFile string, srcOffset, dstOffset, length int64) error {
+	return CopyRangeAt(sysenv.OS, srcFile, dstFile, srcOffset, dstOffset, length)
 }
@@ -0,0 +1,48 @@
+package duplicator
+
+import (
+	"fmt"
+	"path"
+)
+
+// WithFileFilter makes CloneDirectory clone only files matching include patterns, when there are any,
+// and skip files and directories matching exclude patterns, like volatile logs or lock files.
+// Patterns follow path.Match and are matched against slash-separated paths relative to the source directory,
+// and against base names.
+func WithFileFilter(include []string, exclude []string) Option {
+	return func(o *options) {
+		o.include = include
+		o.exclude = exclude
+	}
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, path.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validateFilter reports malformed patterns, which would otherwise never match anything.
+func (o *options) validateFilter() error {
+	for _, p := range append(append([]string{}, o.include...), o.exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid file pattern '%v': %w", p, err)
+		}
+	}
+	return nil
+}
+
+// excluded reports whether entry rel of the source directory is left out. Directories are only subject
+// to exclude patterns, so include patterns may select files within them.
+func (o *options) excluded(rel string, isDir bool) bool {
+	if matchesAny(o.exclude, rel) {
+		return true
+	}
+	return !isDir && len(o.include) > 0 && !matchesAny(o.include, rel)
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+
+package duplicator
+
+import "path/filepath"
+
+// filesystemID identifies filesystem holding path by its volume. It falls back to the path itself,
+// and reports false, when there is no volume.
+func filesystemID(path string) (string, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path, false
+	}
+	if v := filepath.VolumeName(abs); v != "" {
+		return v, true
+	}
+	return abs, false
+}
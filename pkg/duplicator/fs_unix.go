@@ -0,0 +1,23 @@
+//go:build linux || darwin
+
+package duplicator
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// filesystemID identifies filesystem holding path by its device. It falls back to the path itself,
+// and reports false, when the filesystem can not be told.
+func filesystemID(path string) (string, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return path, false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return path, false
+	}
+	return strconv.FormatUint(uint64(st.Dev), 10), true
+}
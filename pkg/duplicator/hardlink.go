@@ -0,0 +1,30 @@
+package duplicator
+
+import (
+	"errors"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"os"
+)
+
+// WithHardlinks makes CloneDirectory hard link files instead of cloning them, so no space or time is spent on
+// copies even without Copy-on-Write. Linked files share content and metadata with their sources, so callers
+// opting in must guarantee neither side is ever modified, e.g. for read-only sharing of an image.
+// Files which can not be linked, like ones on another filesystem, are cloned.
+func WithHardlinks(enabled bool) Option {
+	return func(o *options) {
+		o.hardlinks = enabled
+	}
+}
+
+// hardlink links dst to src, replacing existing dst. It reports false when the filesystem
+// can not link them, leaving the file to be cloned.
+func hardlink(src, dst string, opts *options) bool {
+	lfs, ok := opts.fs.(sysenv.LinkFS)
+	if !ok {
+		return false
+	}
+	if err := opts.fs.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	return lfs.Link(src, dst) == nil
+}
@@ -0,0 +1,55 @@
+package duplicator
+
+import (
+	"errors"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"os"
+)
+
+// WithXattrs makes CloneDirectory copy extended attributes of files and directories, on filesystems supporting them.
+func WithXattrs(enabled bool) Option {
+	return func(o *options) {
+		o.xattrs = enabled
+	}
+}
+
+// copyMetadata gives dst the mode and modification time of src described by info, and its extended attributes
+// with WithXattrs. Modification time is set last, because every other change would update it.
+func copyMetadata(src, dst string, info os.FileInfo, opts *options) error {
+	if opts.xattrs {
+		if xfs, ok := opts.fs.(sysenv.XattrFS); ok {
+			attrs, err := xfs.ListXattrs(src)
+			if err != nil {
+				return fmt.Errorf("unable to list extended attributes of '%v': %w", src, err)
+			}
+			for name, value := range attrs {
+				if err := xfs.SetXattr(dst, name, value); err != nil {
+					return fmt.Errorf("unable to set extended attribute '%v' of '%v': %w", name, dst, err)
+				}
+			}
+		}
+	}
+	if err := opts.fs.Chmod(dst, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("unable to set mode of '%v': %w", dst, err)
+	}
+	if err := opts.fs.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+		return fmt.Errorf("unable to set modification time of '%v': %w", dst, err)
+	}
+	return nil
+}
+
+// cloneSymlink creates symlink dst pointing where symlink src does, replacing existing dst.
+func cloneSymlink(src, dst string, opts *options) error {
+	target, err := opts.fs.Readlink(src)
+	if err != nil {
+		return fmt.Errorf("unable to read symlink '%v': %w", src, err)
+	}
+	if err := opts.fs.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to replace '%v': %w", dst, err)
+	}
+	if err := opts.fs.Symlink(target, dst); err != nil {
+		return fmt.Errorf("unable to create symlink '%v': %w", dst, err)
+	}
+	return nil
+}
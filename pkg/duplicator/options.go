@@ -0,0 +1,65 @@
+package duplicator
+
+import (
+	"github.com/macvmio/geranos/pkg/sysenv"
+)
+
+type options struct {
+	fs          sysenv.FS
+	cloneFile   func(src, dst string, progress func(n int64)) error
+	concurrency int
+	progress    func(Progress)
+	xattrs      bool
+	include     []string
+	exclude     []string
+	verify      bool
+	hardlinks   bool
+}
+
+type Option func(opts *options)
+
+// DefaultConcurrency is the number of files CloneDirectory clones at the same time, unless set with WithConcurrency.
+const DefaultConcurrency = 4
+
+func makeOptions(opts ...Option) *options {
+	res := &options{
+		fs:          sysenv.OS,
+		cloneFile:   CloneFileWithProgress,
+		concurrency: DefaultConcurrency,
+	}
+	for _, o := range opts {
+		o(res)
+	}
+	return res
+}
+
+// WithFileSystem makes directory traversal go through provided filesystem.
+// Files are still cloned with platform specific CloneFile, unless WithCloneFunction is used as well.
+func WithFileSystem(fsys sysenv.FS) Option {
+	return func(o *options) {
+		o.fs = fsys
+	}
+}
+
+// WithCloneFunction replaces the function cloning files. Progress of each file is reported once it is cloned.
+func WithCloneFunction(cloneFile func(src, dst string) error) Option {
+	return func(o *options) {
+		o.cloneFile = func(src, dst string, _ func(n int64)) error {
+			return cloneFile(src, dst)
+		}
+	}
+}
+
+// WithCloner makes files cloned with given Cloner, so strategies it finds are shared with other users of it.
+func WithCloner(c *Cloner) Option {
+	return func(o *options) {
+		o.cloneFile = c.CloneFileWithProgress
+	}
+}
+
+// WithConcurrency sets how many files CloneDirectory clones at the same time.
+func WithConcurrency(n int) Option {
+	return func(o *options) {
+		o.concurrency = n
+	}
+}
@@ -0,0 +1,78 @@
+package duplicator
+
+import (
+	"sync"
+)
+
+// progressChunkSize is the most bytes copied between two progress reports, so copying a large file
+// without Copy-on-Write does not look stuck.
+const progressChunkSize = 16 << 20
+
+// Progress is reported by CloneDirectory as files are cloned.
+type Progress struct {
+	// Filename is the source file the update is about, with FileBytesCloned out of FileBytesTotal of it done.
+	Filename        string
+	FileBytesCloned int64
+	FileBytesTotal  int64
+	// BytesCloned and FilesDone count all files cloned so far, out of BytesTotal and FilesTotal.
+	BytesCloned int64
+	BytesTotal  int64
+	FilesDone   int
+	FilesTotal  int
+}
+
+// WithProgressFunc sets function called by CloneDirectory whenever more bytes are cloned and when a file is done.
+// Calls are never concurrent, so it does not need to synchronize.
+func WithProgressFunc(progress func(Progress)) Option {
+	return func(o *options) {
+		o.progress = progress
+	}
+}
+
+// progressTracker sums bytes cloned by concurrent workers of CloneDirectory.
+type progressTracker struct {
+	report func(Progress)
+
+	mu    sync.Mutex
+	state Progress
+}
+
+// file starts counting bytes cloned of srcFile.
+func (pt *progressTracker) file(srcFile string, size int64) *fileProgress {
+	return &fileProgress{tracker: pt, filename: srcFile, size: size}
+}
+
+// fileProgress counts bytes cloned of one file, so the ones its clone function did not report
+// are reported once it is done.
+type fileProgress struct {
+	tracker  *progressTracker
+	filename string
+	size     int64
+	cloned   int64
+}
+
+func (fp *fileProgress) add(n int64) {
+	fp.tracker.update(fp, n, false)
+}
+
+// done reports the file as cloned, together with bytes the clone function did not report.
+func (fp *fileProgress) done() {
+	fp.tracker.update(fp, max(fp.size-fp.cloned, 0), true)
+}
+
+func (pt *progressTracker) update(fp *fileProgress, n int64, done bool) {
+	if pt.report == nil {
+		return
+	}
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	fp.cloned += n
+	pt.state.BytesCloned += n
+	if done {
+		pt.state.FilesDone++
+	}
+	pt.state.Filename = fp.filename
+	pt.state.FileBytesCloned = fp.cloned
+	pt.state.FileBytesTotal = fp.size
+	pt.report(pt.state)
+}
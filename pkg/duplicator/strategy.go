@@ -0,0 +1,147 @@
+package duplicator
+
+import (
+	"errors"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrStrategyUnsupported is returned by Strategy which can not clone given files,
+// e.g. because their filesystem lacks the feature it relies on.
+var ErrStrategyUnsupported = errors.New("clone strategy is not supported")
+
+// Strategy is one way of cloning files, from sharing extents to plain copying.
+type Strategy struct {
+	Name string
+	// Clone clones srcFile to dstFile, or returns ErrStrategyUnsupported to let the next strategy try.
+	// Strategies copying content call progress with the number of bytes copied since the previous call;
+	// it is never nil.
+	Clone func(srcFile, dstFile string, progress func(n int64)) error
+	// SameFilesystem is set on strategies sharing extents, which only works within one filesystem.
+	// Cloner skips them for files on different filesystems instead of having them fail with EXDEV.
+	SameFilesystem bool
+}
+
+// CopyStrategy copies content of files preserving their holes, working everywhere.
+var CopyStrategy = Strategy{Name: "sparse-copy", Clone: func(srcFile, dstFile string, progress func(n int64)) error {
+	return copyFile(sysenv.OS, srcFile, dstFile, progress)
+}}
+
+// DefaultStrategies returns strategies of the platform, from the cheapest one, ending with CopyStrategy.
+func DefaultStrategies() []Strategy {
+	return append(platformStrategies(), CopyStrategy)
+}
+
+// SharingStrategies returns strategies of the platform sharing extents, which never copy content.
+func SharingStrategies() []Strategy {
+	res := make([]Strategy, 0)
+	for _, s := range platformStrategies() {
+		if s.SameFilesystem {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// Cloner clones files with the first strategy supporting them. The strategy found for a pair of source
+// and destination filesystems is remembered, so probing the ones before it happens only once per pair.
+type Cloner struct {
+	strategies []Strategy
+
+	mu     sync.Mutex
+	chosen map[string]int
+	used   map[string]int64
+}
+
+// NewCloner returns Cloner trying given strategies in order, or DefaultStrategies when none are given.
+func NewCloner(strategies ...Strategy) *Cloner {
+	if len(strategies) == 0 {
+		strategies = DefaultStrategies()
+	}
+	return &Cloner{
+		strategies: strategies,
+		chosen:     make(map[string]int),
+		used:       make(map[string]int64),
+	}
+}
+
+var defaultCloner = NewCloner()
+
+// CloneFile clones srcFile to dstFile with the cheapest strategy the platform and filesystem support,
+// see DefaultStrategies.
+func CloneFile(srcFile, dstFile string) error {
+	return defaultCloner.CloneFile(srcFile, dstFile)
+}
+
+// CloneFileWithProgress is CloneFile calling progress with the number of bytes cloned since its previous call,
+// see Cloner.CloneFileWithProgress.
+func CloneFileWithProgress(srcFile, dstFile string, progress func(n int64)) error {
+	return defaultCloner.CloneFileWithProgress(srcFile, dstFile, progress)
+}
+
+// CloneFile clones srcFile to dstFile with the first strategy supporting them.
+func (c *Cloner) CloneFile(srcFile, dstFile string) error {
+	return c.CloneFileWithProgress(srcFile, dstFile, nil)
+}
+
+// CloneFileWithProgress clones srcFile to dstFile like CloneFile, calling progress with the number of bytes
+// cloned since its previous call. Strategies sharing extents are done at once, so they report the whole file
+// when finished, while copies report as they go. Nil progress is ignored.
+func (c *Cloner) CloneFileWithProgress(srcFile, dstFile string, progress func(n int64)) error {
+	if progress == nil {
+		progress = func(int64) {}
+	}
+	srcFS, srcKnown := filesystemID(filepath.Dir(srcFile))
+	dstFS, dstKnown := filesystemID(filepath.Dir(dstFile))
+	// filesystems which can not be told apart are assumed to be the same, letting strategies decide
+	crossFilesystem := srcKnown && dstKnown && srcFS != dstFS
+	key := srcFS + "->" + dstFS
+	c.mu.Lock()
+	start, found := c.chosen[key]
+	c.mu.Unlock()
+	for i := start; i < len(c.strategies); i++ {
+		s := c.strategies[i]
+		if s.SameFilesystem && crossFilesystem {
+			if !found {
+				log.Printf("'%v' and '%v' are on different filesystems, not cloning with %v\n", srcFile, dstFile, s.Name)
+			}
+			continue
+		}
+		reported := int64(0)
+		err := s.Clone(srcFile, dstFile, func(n int64) {
+			reported += n
+			progress(n)
+		})
+		if errors.Is(err, ErrStrategyUnsupported) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to clone with %v: %w", s.Name, err)
+		}
+		if info, err := os.Stat(srcFile); err == nil && info.Size() > reported {
+			progress(info.Size() - reported)
+		}
+		c.mu.Lock()
+		c.chosen[key] = i
+		c.used[s.Name]++
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("no clone strategy supports '%v' and '%v'", srcFile, dstFile)
+}
+
+// Strategies returns how many files were cloned with each strategy, by its name,
+// so callers can tell whether Copy-on-Write actually happened.
+func (c *Cloner) Strategies() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := make(map[string]int64, len(c.used))
+	for k, v := range c.used {
+		res[k] = v
+	}
+	return res
+}
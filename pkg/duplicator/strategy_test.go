@@ -0,0 +1,101 @@
+package duplicator
+
+import (
+	"errors"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCloner(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "src.img"), []byte("content"), 0o644))
+
+	probed := 0
+	unsupported := Strategy{Name: "unsupported", Clone: func(src, dst string, _ func(int64)) error {
+		probed++
+		return ErrStrategyUnsupported
+	}}
+	c := NewCloner(unsupported, CopyStrategy)
+	require.NoError(t, c.CloneFile(filepath.Join(dir, "src.img"), filepath.Join(dir, "a.img")))
+	require.NoError(t, c.CloneFile(filepath.Join(dir, "src.img"), filepath.Join(dir, "b.img")))
+	// strategy found for the filesystem is used right away for the next file
+	assert.Equal(t, 1, probed)
+	assert.Equal(t, map[string]int64{"sparse-copy": 2}, c.Strategies())
+	content, err := os.ReadFile(filepath.Join(dir, "b.img"))
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(content))
+
+	failing := Strategy{Name: "failing", Clone: func(src, dst string, _ func(int64)) error {
+		return errors.New("broken")
+	}}
+	err = NewCloner(failing, CopyStrategy).CloneFile(filepath.Join(dir, "src.img"), filepath.Join(dir, "c.img"))
+	assert.ErrorContains(t, err, "unable to clone with failing: broken")
+
+	err = NewCloner(unsupported).CloneFile(filepath.Join(dir, "src.img"), filepath.Join(dir, "c.img"))
+	assert.ErrorContains(t, err, "no clone strategy supports")
+}
+
+func TestDefaultStrategies(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "src.img"), []byte("content"), 0o644))
+	c := NewCloner()
+	require.NoError(t, c.CloneFile(filepath.Join(dir, "src.img"), filepath.Join(dir, "dst.img")))
+	content, err := os.ReadFile(filepath.Join(dir, "dst.img"))
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(content))
+	assert.Len(t, c.Strategies(), 1)
+}
+
+func TestCloner_Progress(t *testing.T) {
+	dir := t.TempDir()
+	content := make([]byte, progressChunkSize+100)
+	content[0] = 1
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "src.img"), content, 0o644))
+
+	reports := make([]int64, 0)
+	err := NewCloner(CopyStrategy).CloneFileWithProgress(filepath.Join(dir, "src.img"), filepath.Join(dir, "dst.img"),
+		func(n int64) {
+			reports = append(reports, n)
+		})
+	require.NoError(t, err)
+	// copies report every chunk
+	assert.Equal(t, []int64{progressChunkSize, 100}, reports)
+
+	instant := Strategy{Name: "instant", Clone: func(src, dst string, _ func(int64)) error {
+		return CopyFile(sysenv.OS, src, dst)
+	}}
+	reports = reports[:0]
+	err = NewCloner(instant).CloneFileWithProgress(filepath.Join(dir, "src.img"), filepath.Join(dir, "dst.img"),
+		func(n int64) {
+			reports = append(reports, n)
+		})
+	require.NoError(t, err)
+	// strategies not reporting progress have the whole file reported once done
+	assert.Equal(t, []int64{progressChunkSize + 100}, reports)
+}
+
+func TestCloner_CrossFilesystem(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir, err := os.MkdirTemp("/dev/shm", "geranos-test")
+	if err != nil {
+		t.Skip("no second filesystem available")
+	}
+	defer os.RemoveAll(dstDir)
+	srcFS, _ := filesystemID(srcDir)
+	dstFS, _ := filesystemID(dstDir)
+	if srcFS == dstFS {
+		t.Skip("no second filesystem available")
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "src.img"), []byte("content"), 0o644))
+
+	sharing := Strategy{Name: "sharing", SameFilesystem: true, Clone: func(src, dst string, _ func(int64)) error {
+		return errors.New("EXDEV")
+	}}
+	c := NewCloner(sharing, CopyStrategy)
+	require.NoError(t, c.CloneFile(filepath.Join(srcDir, "src.img"), filepath.Join(dstDir, "dst.img")))
+	assert.Equal(t, map[string]int64{"sparse-copy": 1}, c.Strategies())
+}
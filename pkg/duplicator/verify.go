@@ -0,0 +1,79 @@
+package duplicator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"io"
+)
+
+// verifyBlockSize is the size of blocks VerifyClone compares at once.
+const verifyBlockSize = 1 << 20
+
+// MismatchError is returned when a clone differs from its source, as seen with broken Copy-on-Write
+// on some network filesystems. Offset is the first differing byte, or the shorter size when sizes differ.
+type MismatchError struct {
+	Source      string
+	Destination string
+	Offset      int64
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("clone '%v' differs from source '%v' at offset %d", e.Destination, e.Source, e.Offset)
+}
+
+// WithVerification makes CloneDirectory read every cloned file back and compare it with its source,
+// failing with *MismatchError on the first difference. It doubles the reads, so it is off by default.
+func WithVerification(enabled bool) Option {
+	return func(o *options) {
+		o.verify = enabled
+	}
+}
+
+// VerifyClone compares content of dstFile with srcFile, returning *MismatchError when they differ.
+func VerifyClone(fsys sysenv.FS, srcFile, dstFile string) error {
+	src, err := fsys.Open(srcFile)
+	if err != nil {
+		return fmt.Errorf("unable to open source file '%v': %w", srcFile, err)
+	}
+	defer src.Close()
+	dst, err := fsys.Open(dstFile)
+	if err != nil {
+		return fmt.Errorf("unable to open destination file '%v': %w", dstFile, err)
+	}
+	defer dst.Close()
+
+	srcBuf := make([]byte, verifyBlockSize)
+	dstBuf := make([]byte, verifyBlockSize)
+	offset := int64(0)
+	for {
+		n, srcErr := io.ReadFull(src, srcBuf)
+		m, dstErr := io.ReadFull(dst, dstBuf)
+		if srcErr != nil && !isEOF(srcErr) {
+			return fmt.Errorf("unable to read source file '%v': %w", srcFile, srcErr)
+		}
+		if dstErr != nil && !isEOF(dstErr) {
+			return fmt.Errorf("unable to read destination file '%v': %w", dstFile, dstErr)
+		}
+		common := min(n, m)
+		if !bytes.Equal(srcBuf[:common], dstBuf[:common]) {
+			for i := 0; i < common; i++ {
+				if srcBuf[i] != dstBuf[i] {
+					return &MismatchError{Source: srcFile, Destination: dstFile, Offset: offset + int64(i)}
+				}
+			}
+		}
+		if n != m {
+			return &MismatchError{Source: srcFile, Destination: dstFile, Offset: offset + int64(common)}
+		}
+		if srcErr != nil {
+			return nil
+		}
+		offset += int64(n)
+	}
+}
+
+func isEOF(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,48 @@
+package duplicator
+
+import (
+	"context"
+	"errors"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyClone(t *testing.T) {
+	dir := t.TempDir()
+	content := make([]byte, verifyBlockSize+10)
+	content[verifyBlockSize+5] = 1
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "src.img"), content, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "same.img"), content, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "short.img"), content[:100], 0o644))
+	broken := append([]byte{}, content...)
+	broken[verifyBlockSize+5] = 0
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.img"), broken, 0o644))
+
+	assert.NoError(t, VerifyClone(sysenv.OS, filepath.Join(dir, "src.img"), filepath.Join(dir, "same.img")))
+
+	var mismatch *MismatchError
+	err := VerifyClone(sysenv.OS, filepath.Join(dir, "src.img"), filepath.Join(dir, "broken.img"))
+	require.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, int64(verifyBlockSize+5), mismatch.Offset)
+
+	err = VerifyClone(sysenv.OS, filepath.Join(dir, "src.img"), filepath.Join(dir, "short.img"))
+	require.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, int64(100), mismatch.Offset)
+
+	t.Run("CloneDirectory", func(t *testing.T) {
+		truncating := WithCloneFunction(func(src, dst string) error {
+			if err := CopyFile(sysenv.OS, src, dst); err != nil {
+				return err
+			}
+			return os.Truncate(dst, 1)
+		})
+		err := CloneDirectory(context.Background(), dir, filepath.Join(t.TempDir(), "dst"), false, truncating)
+		assert.NoError(t, err)
+		err = CloneDirectory(context.Background(), dir, filepath.Join(t.TempDir(), "dst"), false, truncating, WithVerification(true))
+		assert.True(t, errors.As(err, &mismatch))
+	})
+}
@@ -0,0 +1,108 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"hash"
+	"io"
+	"os"
+)
+
+// ErrHMACMismatch means decrypted blob is not the one encrypted, it was modified or the key is wrong.
+var ErrHMACMismatch = errors.New("HMAC of encrypted blob does not match")
+
+// ctrReader encrypts or decrypts r with AES-256-CTR, computing HMAC-SHA256 of the ciphertext with the same key,
+// like the AES_256_CTR_HMAC_SHA256 block cipher of ocicrypt.
+type ctrReader struct {
+	r       io.Reader
+	stream  cipher.Stream
+	mac     hash.Hash
+	encrypt bool
+}
+
+func newCTRReader(r io.Reader, key, nonce []byte, encrypt bool) (*ctrReader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aes.BlockSize {
+		return nil, errors.New("invalid nonce size")
+	}
+	return &ctrReader{
+		r:       r,
+		stream:  cipher.NewCTR(block, nonce),
+		mac:     hmac.New(sha256.New, key),
+		encrypt: encrypt,
+	}, nil
+}
+
+func (cr *ctrReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if n > 0 {
+		if cr.encrypt {
+			cr.stream.XORKeyStream(p[:n], p[:n])
+			cr.mac.Write(p[:n])
+		} else {
+			cr.mac.Write(p[:n])
+			cr.stream.XORKeyStream(p[:n], p[:n])
+		}
+	}
+	return n, err
+}
+
+// hmac returns HMAC of ciphertext read so far.
+func (cr *ctrReader) hmac() []byte {
+	return cr.mac.Sum(nil)
+}
+
+// bufferVerified copies ciphertext of r into a temporary file in dir and verifies its HMAC, so no byte of
+// a modified blob is ever decrypted. The file is rewound and removed once it is closed.
+func bufferVerified(fsys sysenv.FS, dir string, r io.Reader, key, expected []byte) (*bufferFile, error) {
+	if err := fsys.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("unable to create directory for decryption: %w", err)
+	}
+	// temporary files of geranos start with a dot, so gc removes them if geranos is killed meanwhile
+	f, err := sysenv.CreateTemp(fsys, dir, ".decrypt-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("unable to buffer encrypted blob: %w", err)
+	}
+	bf := &bufferFile{File: f, fs: fsys}
+	mac := hmac.New(sha256.New, key)
+	if _, err := io.Copy(io.MultiWriter(f, mac), r); err != nil {
+		bf.Close()
+		return nil, err
+	}
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		bf.Close()
+		return nil, ErrHMACMismatch
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		bf.Close()
+		return nil, err
+	}
+	return bf, nil
+}
+
+// bufferFile is temporary file removed when closed.
+type bufferFile struct {
+	sysenv.File
+	fs sysenv.FS
+}
+
+func (bf *bufferFile) Close() error {
+	err := bf.File.Close()
+	if removeErr := bf.fs.Remove(bf.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,435 @@
+// Package encryption encrypts layers of images in the format of ocicrypt, so confidential images can be kept in
+// shared registries and still be decrypted by other OCI tooling like skopeo or containerd imgcrypt. Every layer
+// blob is encrypted with AES-256-CTR under its own random key, which is wrapped in JWE for each recipient and
+// kept in annotations of the layer. Configs, annotations and zero segments, which have no blob, stay in clear.
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// MediaTypeSuffix marks media types of encrypted layers, like application/vnd.oci.image.layer.v1.tar+gzip+encrypted
+	MediaTypeSuffix = "+encrypted"
+
+	// KeysAnnotation holds key of the layer wrapped for its recipients in JWE
+	KeysAnnotation = "org.opencontainers.image.enc.keys.jwe"
+	// PublicOptionsAnnotation holds cipher and HMAC of the encrypted blob
+	PublicOptionsAnnotation = "org.opencontainers.image.enc.pubopts"
+
+	annotationPrefix = "org.opencontainers.image.enc."
+	cipherType       = "AES_256_CTR_HMAC_SHA256"
+	nonceOption      = "nonce"
+)
+
+var (
+	// ErrEncrypted is returned when layers of image are encrypted, but no decryption key is given.
+	ErrEncrypted = errors.New("image is encrypted")
+	// ErrNoMatchingKey means the layer is not encrypted for any of the decryption keys.
+	ErrNoMatchingKey = errors.New("no decryption key matches recipients of the layer")
+)
+
+// publicOptions are options of layer cipher everybody can see, they are in PublicOptionsAnnotation.
+type publicOptions struct {
+	Cipher        string            `json:"cipher"`
+	HMAC          []byte            `json:"hmac"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// privateOptions are options of layer cipher only recipients can see, they are wrapped in KeysAnnotation.
+type privateOptions struct {
+	SymmetricKey []byte `json:"symkey"`
+	// Digest is digest of the blob before encryption
+	Digest        v1.Hash           `json:"digest"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// IsEncrypted returns whether layer of media type mt is encrypted.
+func IsEncrypted(mt types.MediaType) bool {
+	return strings.HasSuffix(string(mt), MediaTypeSuffix)
+}
+
+// rewrittenImage is img with other manifest.
+type rewrittenImage struct {
+	v1.Image
+	manifest      *v1.Manifest
+	rawManifest   []byte
+	layerByDigest func(h v1.Hash) (v1.Layer, error)
+}
+
+func newRewrittenImage(img v1.Image, manifest *v1.Manifest, layerByDigest func(h v1.Hash) (v1.Layer, error)) (*rewrittenImage, error) {
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &rewrittenImage{Image: img, manifest: manifest, rawManifest: raw, layerByDigest: layerByDigest}, nil
+}
+
+func (ri *rewrittenImage) Manifest() (*v1.Manifest, error) {
+	return ri.manifest.DeepCopy(), nil
+}
+
+func (ri *rewrittenImage) RawManifest() ([]byte, error) {
+	return ri.rawManifest, nil
+}
+
+func (ri *rewrittenImage) Digest() (v1.Hash, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(ri.rawManifest))
+	return h, err
+}
+
+func (ri *rewrittenImage) Size() (int64, error) {
+	return int64(len(ri.rawManifest)), nil
+}
+
+func (ri *rewrittenImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	return ri.layerByDigest(h)
+}
+
+func (ri *rewrittenImage) Layers() ([]v1.Layer, error) {
+	res := make([]v1.Layer, 0, len(ri.manifest.Layers))
+	for _, d := range ri.manifest.Layers {
+		l, err := ri.layerByDigest(d.Digest)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, l)
+	}
+	return res, nil
+}
+
+// EncryptImage returns img with layers encrypted for recipients, RSA or EC public keys. Blobs are encrypted
+// once upfront to compute their digests, by workers layers at the same time, and again when they are read.
+func EncryptImage(ctx context.Context, img v1.Image, recipients []crypto.PublicKey, workers int) (v1.Image, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients to encrypt layers for")
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	res := manifest.DeepCopy()
+	encrypted := make([]*encryptedLayer, len(res.Layers))
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(workers, 1))
+	for i, d := range manifest.Layers {
+		if d.MediaType == filesegment.ZeroMediaType || IsEncrypted(d.MediaType) {
+			continue
+		}
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			l, err := img.LayerByDigest(d.Digest)
+			if err != nil {
+				return err
+			}
+			el, err := encryptLayer(l, d, recipients)
+			if err != nil {
+				return fmt.Errorf("unable to encrypt layer %v: %w", d.Digest, err)
+			}
+			encrypted[i] = el
+			res.Layers[i] = el.desc
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	byDigest := make(map[v1.Hash]*encryptedLayer, len(encrypted))
+	for _, el := range encrypted {
+		if el != nil {
+			byDigest[el.desc.Digest] = el
+		}
+	}
+	return newRewrittenImage(img, res, func(h v1.Hash) (v1.Layer, error) {
+		if el, ok := byDigest[h]; ok {
+			return el, nil
+		}
+		return img.LayerByDigest(h)
+	})
+}
+
+// encryptedLayer is layer l encrypted with key and nonce, described by desc.
+type encryptedLayer struct {
+	l     v1.Layer
+	desc  v1.Descriptor
+	key   []byte
+	nonce []byte
+}
+
+func encryptLayer(l v1.Layer, d v1.Descriptor, recipients []crypto.PublicKey) (*encryptedLayer, error) {
+	el := &encryptedLayer{l: l, key: make([]byte, 32), nonce: make([]byte, aes.BlockSize)}
+	if _, err := rand.Read(el.key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(el.nonce); err != nil {
+		return nil, err
+	}
+	private, err := json.Marshal(privateOptions{
+		SymmetricKey:  el.key,
+		Digest:        d.Digest,
+		CipherOptions: map[string][]byte{nonceOption: el.nonce},
+	})
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := wrapKeys(private, recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := l.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	cr, err := newCTRReader(rc, el.key, el.nonce, true)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, cr)
+	if err != nil {
+		return nil, err
+	}
+	public, err := json.Marshal(publicOptions{Cipher: cipherType, HMAC: cr.hmac(), CipherOptions: map[string][]byte{}})
+	if err != nil {
+		return nil, err
+	}
+
+	el.desc = d
+	el.desc.MediaType = d.MediaType + MediaTypeSuffix
+	el.desc.Digest = v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))}
+	el.desc.Size = size
+	el.desc.Annotations = make(map[string]string, len(d.Annotations)+2)
+	for k, v := range d.Annotations {
+		el.desc.Annotations[k] = v
+	}
+	el.desc.Annotations[KeysAnnotation] = base64.StdEncoding.EncodeToString(wrapped)
+	el.desc.Annotations[PublicOptionsAnnotation] = base64.StdEncoding.EncodeToString(public)
+	return el, nil
+}
+
+func (el *encryptedLayer) Digest() (v1.Hash, error) {
+	return el.desc.Digest, nil
+}
+
+func (el *encryptedLayer) DiffID() (v1.Hash, error) {
+	return el.l.DiffID()
+}
+
+func (el *encryptedLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := el.l.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	cr, err := newCTRReader(rc, el.key, el.nonce, true)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return readCloser{Reader: cr, Closer: rc}, nil
+}
+
+func (el *encryptedLayer) Uncompressed() (io.ReadCloser, error) {
+	return nil, errors.New("encrypted layer has no uncompressed content")
+}
+
+func (el *encryptedLayer) Size() (int64, error) {
+	return el.desc.Size, nil
+}
+
+func (el *encryptedLayer) MediaType() (types.MediaType, error) {
+	return el.desc.MediaType, nil
+}
+
+// DecryptOption configures DecryptImage.
+type DecryptOption func(*decryptOptions)
+
+type decryptOptions struct {
+	fs  sysenv.FS
+	dir string
+}
+
+// WithFileSystem makes decrypted layers buffer their ciphertext through fsys.
+func WithFileSystem(fsys sysenv.FS) DecryptOption {
+	return func(o *decryptOptions) {
+		o.fs = fsys
+	}
+}
+
+// WithBufferDir makes decrypted layers buffer their ciphertext, until it is verified, in dir rather than
+// in the temporary directory of the system. It should be on the filesystem the image is written to,
+// as a whole segment is kept there.
+func WithBufferDir(dir string) DecryptOption {
+	return func(o *decryptOptions) {
+		o.dir = dir
+	}
+}
+
+// DecryptImage returns img with encrypted layers decrypted with one of keys, RSA or EC private keys. The manifest
+// is the one the image had before encryption, so it matches local images pushed encrypted. Images without
+// encrypted layers are returned as they are.
+func DecryptImage(img v1.Image, keys []crypto.PrivateKey, opt ...DecryptOption) (v1.Image, error) {
+	opts := &decryptOptions{fs: sysenv.OS, dir: os.TempDir()}
+	for _, o := range opt {
+		o(opts)
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	res := manifest.DeepCopy()
+	byDigest := make(map[v1.Hash]*decryptedLayer)
+	for i, d := range manifest.Layers {
+		if !IsEncrypted(d.MediaType) {
+			continue
+		}
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("%w, decryption key is needed", ErrEncrypted)
+		}
+		dl, err := decryptionOf(d, keys)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt layer %v: %w", d.Digest, err)
+		}
+		res.Layers[i] = dl.desc
+		byDigest[dl.desc.Digest] = dl
+	}
+	if len(byDigest) == 0 {
+		return img, nil
+	}
+	return newRewrittenImage(img, res, func(h v1.Hash) (v1.Layer, error) {
+		dl, ok := byDigest[h]
+		if !ok {
+			return img.LayerByDigest(h)
+		}
+		l, err := img.LayerByDigest(dl.encrypted)
+		if err != nil {
+			return nil, err
+		}
+		res := *dl
+		res.l = l
+		res.opts = opts
+		return partial.CompressedToLayer(&res)
+	})
+}
+
+// decryptedLayer is encrypted layer l decrypted, described by desc.
+type decryptedLayer struct {
+	l         v1.Layer
+	desc      v1.Descriptor
+	encrypted v1.Hash
+	private   privateOptions
+	hmac      []byte
+	opts      *decryptOptions
+}
+
+// decryptionOf returns layer of encrypted d decrypted with one of keys, but without content yet.
+func decryptionOf(d v1.Descriptor, keys []crypto.PrivateKey) (*decryptedLayer, error) {
+	rawPublic, err := base64.StdEncoding.DecodeString(d.Annotations[PublicOptionsAnnotation])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v: %w", PublicOptionsAnnotation, err)
+	}
+	var public publicOptions
+	if err := json.Unmarshal(rawPublic, &public); err != nil {
+		return nil, fmt.Errorf("invalid %v: %w", PublicOptionsAnnotation, err)
+	}
+	if public.Cipher != cipherType {
+		return nil, fmt.Errorf("unsupported cipher %v", public.Cipher)
+	}
+	wrapped, ok := d.Annotations[KeysAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("layer has no keys wrapped in JWE")
+	}
+	var private []byte
+	err = ErrNoMatchingKey
+	// there are wrapped keys of every run of the encryption for other recipients, separated by commas
+	for _, encoded := range strings.Split(wrapped, ",") {
+		jwe, decodeErr := base64.StdEncoding.DecodeString(encoded)
+		if decodeErr != nil {
+			return nil, fmt.Errorf("invalid %v: %w", KeysAnnotation, decodeErr)
+		}
+		if private, err = unwrapKeys(jwe, keys); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	dl := &decryptedLayer{encrypted: d.Digest, hmac: public.HMAC}
+	if err := json.Unmarshal(private, &dl.private); err != nil {
+		return nil, fmt.Errorf("invalid private options: %w", err)
+	}
+	if len(dl.private.SymmetricKey) != 32 || len(dl.private.CipherOptions[nonceOption]) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid private options")
+	}
+	dl.desc = d
+	dl.desc.MediaType = types.MediaType(strings.TrimSuffix(string(d.MediaType), MediaTypeSuffix))
+	dl.desc.Digest = dl.private.Digest
+	dl.desc.Annotations = make(map[string]string, len(d.Annotations))
+	for k, v := range d.Annotations {
+		if !strings.HasPrefix(k, annotationPrefix) {
+			dl.desc.Annotations[k] = v
+		}
+	}
+	if len(dl.desc.Annotations) == 0 {
+		dl.desc.Annotations = nil
+	}
+	return dl, nil
+}
+
+func (dl *decryptedLayer) Digest() (v1.Hash, error) {
+	return dl.desc.Digest, nil
+}
+
+func (dl *decryptedLayer) DiffID() (v1.Hash, error) {
+	return dl.l.DiffID()
+}
+
+// Compressed returns blob before encryption. Ciphertext is buffered until its HMAC is verified, so a modified
+// blob fails with ErrHMACMismatch before any of its plaintext is returned.
+func (dl *decryptedLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := dl.l.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	f, err := bufferVerified(dl.opts.fs, dl.opts.dir, rc, dl.private.SymmetricKey, dl.hmac)
+	if err != nil {
+		return nil, err
+	}
+	cr, err := newCTRReader(f, dl.private.SymmetricKey, dl.private.CipherOptions[nonceOption], false)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return readCloser{Reader: cr, Closer: f}, nil
+}
+
+func (dl *decryptedLayer) Size() (int64, error) {
+	return dl.desc.Size, nil
+}
+
+func (dl *decryptedLayer) MediaType() (types.MediaType, error) {
+	return dl.desc.MediaType, nil
+}
@@ -0,0 +1,164 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"io"
+	"os"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAESKeyWrap(t *testing.T) {
+	// test vector of RFC 3394 4.6, 256 bits of key data with 256-bit KEK
+	kek, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F")
+	key, _ := hex.DecodeString("00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F")
+	expected, _ := hex.DecodeString("28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21")
+
+	wrapped, err := aesKeyWrap(kek, key)
+	require.NoError(t, err)
+	assert.Equal(t, expected, wrapped)
+	unwrapped, err := aesKeyUnwrap(kek, wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, key, unwrapped)
+
+	wrapped[3] ^= 1
+	_, err = aesKeyUnwrap(kek, wrapped)
+	assert.Error(t, err)
+}
+
+func TestWrapKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+
+	jwe, err := wrapKeys([]byte("secret options"), []crypto.PublicKey{rsaKey.Public(), ecKey.Public()})
+	require.NoError(t, err)
+	for _, key := range []crypto.PrivateKey{rsaKey, ecKey} {
+		payload, err := unwrapKeys(jwe, []crypto.PrivateKey{otherKey, key})
+		require.NoError(t, err)
+		assert.Equal(t, "secret options", string(payload))
+	}
+	_, err = unwrapKeys(jwe, []crypto.PrivateKey{otherKey})
+	assert.ErrorIs(t, err, ErrNoMatchingKey)
+}
+
+func readLayer(t *testing.T, l v1.Layer) ([]byte, error) {
+	rc, err := l.Compressed()
+	require.NoError(t, err)
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func TestEncryptImage(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	img, err := random.Image(1024, 3)
+	require.NoError(t, err)
+
+	encrypted, err := EncryptImage(context.Background(), img, []crypto.PublicKey{key.Public()}, 2)
+	require.NoError(t, err)
+	manifest, err := encrypted.Manifest()
+	require.NoError(t, err)
+	original, err := img.Manifest()
+	require.NoError(t, err)
+	for i, d := range manifest.Layers {
+		assert.True(t, IsEncrypted(d.MediaType))
+		assert.NotEqual(t, original.Layers[i].Digest, d.Digest)
+		l, err := encrypted.LayerByDigest(d.Digest)
+		require.NoError(t, err)
+		ciphertext, err := readLayer(t, l)
+		require.NoError(t, err)
+		digest, _, err := v1.SHA256(bytes.NewReader(ciphertext))
+		require.NoError(t, err)
+		assert.Equal(t, d.Digest, digest, "blob is encrypted the same way every time it is read")
+	}
+
+	_, err = DecryptImage(encrypted, nil)
+	assert.ErrorIs(t, err, ErrEncrypted)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, err = DecryptImage(encrypted, []crypto.PrivateKey{otherKey})
+	assert.ErrorIs(t, err, ErrNoMatchingKey)
+
+	decrypted, err := DecryptImage(encrypted, []crypto.PrivateKey{key})
+	require.NoError(t, err)
+	originalDigest, err := img.Digest()
+	require.NoError(t, err)
+	decryptedDigest, err := decrypted.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, originalDigest, decryptedDigest, "decryption restores the manifest")
+	for _, d := range original.Layers {
+		l, err := decrypted.LayerByDigest(d.Digest)
+		require.NoError(t, err)
+		plaintext, err := readLayer(t, l)
+		require.NoError(t, err)
+		expected, err := img.LayerByDigest(d.Digest)
+		require.NoError(t, err)
+		expectedContent, err := readLayer(t, expected)
+		require.NoError(t, err)
+		assert.Equal(t, expectedContent, plaintext)
+	}
+}
+
+// tamperedImage flips a byte in blobs of img.
+type tamperedImage struct {
+	v1.Image
+}
+
+func (ti tamperedImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := ti.Image.LayerByDigest(h)
+	return tamperedLayer{l}, err
+}
+
+type tamperedLayer struct {
+	v1.Layer
+}
+
+func (tl tamperedLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := tl.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	b[0] ^= 1
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func TestDecryptImage_tampered(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	encrypted, err := EncryptImage(context.Background(), img, []crypto.PublicKey{key.Public()}, 1)
+	require.NoError(t, err)
+
+	bufferDir := t.TempDir()
+	decrypted, err := DecryptImage(tamperedImage{encrypted}, []crypto.PrivateKey{key}, WithBufferDir(bufferDir))
+	require.NoError(t, err)
+	layers, err := decrypted.Layers()
+	require.NoError(t, err)
+	// nothing of the blob is returned before its HMAC is verified
+	_, err = layers[0].Compressed()
+	assert.ErrorIs(t, err, ErrHMACMismatch)
+	entries, err := os.ReadDir(bufferDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
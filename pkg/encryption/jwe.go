@@ -0,0 +1,338 @@
+package encryption
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+)
+
+const (
+	algRSAOAEP       = "RSA-OAEP"
+	algRSAOAEP256    = "RSA-OAEP-256"
+	algECDHESA256KW  = "ECDH-ES+A256KW"
+	encA256GCM       = "A256GCM"
+	contentKeyLength = 32
+)
+
+var b64 = base64.RawURLEncoding
+
+// jwe is JWE in general JSON serialization, in which ocicrypt wraps keys of layers for recipients.
+type jwe struct {
+	Protected  string         `json:"protected"`
+	Recipients []jweRecipient `json:"recipients"`
+	IV         string         `json:"iv"`
+	Ciphertext string         `json:"ciphertext"`
+	Tag        string         `json:"tag"`
+}
+
+type jweRecipient struct {
+	Header       jweHeader `json:"header"`
+	EncryptedKey string    `json:"encrypted_key"`
+}
+
+type jweHeader struct {
+	Alg string `json:"alg,omitempty"`
+	Enc string `json:"enc,omitempty"`
+	EPK *jwk   `json:"epk,omitempty"`
+}
+
+// jwk is public EC key, the ephemeral key of ECDH-ES key agreement.
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// wrapKeys encrypts payload for recipients, RSA keys with RSA-OAEP and EC keys with ECDH-ES+A256KW.
+func wrapKeys(payload []byte, recipients []crypto.PublicKey) ([]byte, error) {
+	cek := make([]byte, contentKeyLength)
+	if _, err := rand.Read(cek); err != nil {
+		return nil, err
+	}
+	protected, err := json.Marshal(jweHeader{Enc: encA256GCM})
+	if err != nil {
+		return nil, err
+	}
+	res := jwe{Protected: b64.EncodeToString(protected)}
+	for _, r := range recipients {
+		recipient, err := wrapContentKey(cek, r)
+		if err != nil {
+			return nil, err
+		}
+		res.Recipients = append(res.Recipients, recipient)
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nil, iv, payload, []byte(res.Protected))
+	tagStart := len(sealed) - gcm.Overhead()
+	res.IV = b64.EncodeToString(iv)
+	res.Ciphertext = b64.EncodeToString(sealed[:tagStart])
+	res.Tag = b64.EncodeToString(sealed[tagStart:])
+	return json.Marshal(res)
+}
+
+func wrapContentKey(cek []byte, recipient crypto.PublicKey) (jweRecipient, error) {
+	switch k := recipient.(type) {
+	case *rsa.PublicKey:
+		encrypted, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, k, cek, nil)
+		if err != nil {
+			return jweRecipient{}, err
+		}
+		return jweRecipient{Header: jweHeader{Alg: algRSAOAEP}, EncryptedKey: b64.EncodeToString(encrypted)}, nil
+	case *ecdsa.PublicKey:
+		pub, err := k.ECDH()
+		if err != nil {
+			return jweRecipient{}, err
+		}
+		ephemeral, err := pub.Curve().GenerateKey(rand.Reader)
+		if err != nil {
+			return jweRecipient{}, err
+		}
+		kek, err := agreeKey(ephemeral, pub)
+		if err != nil {
+			return jweRecipient{}, err
+		}
+		wrapped, err := aesKeyWrap(kek, cek)
+		if err != nil {
+			return jweRecipient{}, err
+		}
+		epk, err := newJWK(ephemeral.PublicKey(), k.Curve)
+		if err != nil {
+			return jweRecipient{}, err
+		}
+		return jweRecipient{Header: jweHeader{Alg: algECDHESA256KW, EPK: epk}, EncryptedKey: b64.EncodeToString(wrapped)}, nil
+	}
+	return jweRecipient{}, fmt.Errorf("unsupported recipient key %T", recipient)
+}
+
+// unwrapKeys decrypts payload of JWE with one of keys.
+func unwrapKeys(data []byte, keys []crypto.PrivateKey) ([]byte, error) {
+	var j jwe
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, fmt.Errorf("invalid JWE: %w", err)
+	}
+	rawProtected, err := b64.DecodeString(j.Protected)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWE: %w", err)
+	}
+	var protected jweHeader
+	if err := json.Unmarshal(rawProtected, &protected); err != nil {
+		return nil, fmt.Errorf("invalid JWE: %w", err)
+	}
+	if protected.Enc != encA256GCM {
+		return nil, fmt.Errorf("unsupported JWE encryption %v", protected.Enc)
+	}
+	for _, r := range j.Recipients {
+		header := r.Header
+		// with single recipient, its algorithm can be in the protected header
+		if header.Alg == "" {
+			header.Alg = protected.Alg
+			header.EPK = protected.EPK
+		}
+		encryptedKey, err := b64.DecodeString(r.EncryptedKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWE: %w", err)
+		}
+		for _, key := range keys {
+			cek, err := unwrapContentKey(header, encryptedKey, key)
+			if err != nil || len(cek) != contentKeyLength {
+				continue
+			}
+			if payload, err := openJWE(&j, cek); err == nil {
+				return payload, nil
+			}
+		}
+	}
+	return nil, ErrNoMatchingKey
+}
+
+func unwrapContentKey(header jweHeader, encryptedKey []byte, key crypto.PrivateKey) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var h hash.Hash
+		switch header.Alg {
+		case algRSAOAEP:
+			h = sha1.New()
+		case algRSAOAEP256:
+			h = sha256.New()
+		default:
+			return nil, fmt.Errorf("unsupported algorithm %v for RSA key", header.Alg)
+		}
+		return rsa.DecryptOAEP(h, nil, k, encryptedKey, nil)
+	case *ecdsa.PrivateKey:
+		if header.Alg != algECDHESA256KW || header.EPK == nil {
+			return nil, fmt.Errorf("unsupported algorithm %v for EC key", header.Alg)
+		}
+		priv, err := k.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		epk, err := header.EPK.publicKey(k.Curve)
+		if err != nil {
+			return nil, err
+		}
+		kek, err := agreeKey(priv, epk)
+		if err != nil {
+			return nil, err
+		}
+		return aesKeyUnwrap(kek, encryptedKey)
+	}
+	return nil, fmt.Errorf("unsupported key %T", key)
+}
+
+func openJWE(j *jwe, cek []byte) ([]byte, error) {
+	iv, err := b64.DecodeString(j.IV)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := b64.DecodeString(j.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := b64.DecodeString(j.Tag)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, iv, append(ciphertext, tag...), []byte(j.Protected))
+}
+
+// agreeKey derives key encrypting key of ECDH-ES+A256KW with Concat KDF, without party info (RFC 7518 4.6.2).
+func agreeKey(priv *ecdh.PrivateKey, pub *ecdh.PublicKey) ([]byte, error) {
+	z, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	otherInfo := lengthPrefixed([]byte(algECDHESA256KW))
+	otherInfo = append(otherInfo, lengthPrefixed(nil)...)
+	otherInfo = append(otherInfo, lengthPrefixed(nil)...)
+	otherInfo = binary.BigEndian.AppendUint32(otherInfo, contentKeyLength*8)
+	h := sha256.New()
+	h.Write([]byte{0, 0, 0, 1})
+	h.Write(z)
+	h.Write(otherInfo)
+	return h.Sum(nil)[:contentKeyLength], nil
+}
+
+func lengthPrefixed(b []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(b))), b...)
+}
+
+func newJWK(pub *ecdh.PublicKey, curve elliptic.Curve) (*jwk, error) {
+	// uncompressed point: 0x04 || x || y
+	point := pub.Bytes()
+	size := (len(point) - 1) / 2
+	return &jwk{
+		Kty: "EC",
+		Crv: curve.Params().Name,
+		X:   b64.EncodeToString(point[1 : 1+size]),
+		Y:   b64.EncodeToString(point[1+size:]),
+	}, nil
+}
+
+func (k *jwk) publicKey(curve elliptic.Curve) (*ecdh.PublicKey, error) {
+	if k.Kty != "EC" || k.Crv != curve.Params().Name {
+		return nil, fmt.Errorf("ephemeral key of other curve %v", k.Crv)
+	}
+	x, err := b64.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := b64.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	return pub.ECDH()
+}
+
+var keyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// aesKeyWrap wraps key with kek (RFC 3394).
+func aesKeyWrap(kek, key []byte) ([]byte, error) {
+	if len(key)%8 != 0 {
+		return nil, errors.New("wrapped key must be multiple of 8 bytes")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(key) / 8
+	res := make([]byte, 8+len(key))
+	copy(res, keyWrapIV)
+	copy(res[8:], key)
+	buf := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf, res[:8])
+			copy(buf[8:], res[i*8:i*8+8])
+			block.Encrypt(buf, buf)
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(res[:8], binary.BigEndian.Uint64(buf[:8])^t)
+			copy(res[i*8:], buf[8:])
+		}
+	}
+	return res, nil
+}
+
+// aesKeyUnwrap unwraps key wrapped with kek (RFC 3394).
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, errors.New("invalid wrapped key")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(wrapped)/8 - 1
+	res := make([]byte, len(wrapped))
+	copy(res, wrapped)
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(buf[:8], binary.BigEndian.Uint64(res[:8])^t)
+			copy(buf[8:], res[i*8:i*8+8])
+			block.Decrypt(buf, buf)
+			copy(res[:8], buf[:8])
+			copy(res[i*8:], buf[8:])
+		}
+	}
+	if subtle.ConstantTimeCompare(res[:8], keyWrapIV) != 1 {
+		return nil, errors.New("invalid wrapped key")
+	}
+	return res[8:], nil
+}
@@ -0,0 +1,339 @@
+package filesegment
+
+import (
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/klauspost/compress/gzip"
+	"github.com/macvmio/geranos/pkg/zstd"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Compression names the algorithm segment blob is compressed with, which is declared by its media type.
+type Compression string
+
+const (
+	CompressionZstd Compression = "zstd"
+	CompressionGzip Compression = "gzip"
+	CompressionNone Compression = "none"
+)
+
+// GzipMediaType and UncompressedMediaType mark segments compressed with gzip and stored as they are.
+// Segments of MediaType are compressed with zstd.
+const (
+	GzipMediaType         = MediaType + ".gzip"
+	UncompressedMediaType = MediaType + ".none"
+)
+
+// WithCompression selects compression of the layer blob, zstd is used by default.
+func WithCompression(c Compression) LayerOpt {
+	return func(l *Layer) {
+		l.compression = c
+	}
+}
+
+// WithZstdWindowSize sets window of zstd compression (see zstd.WithWindowSize), letting large segments
+// reference repetitions further apart. Zero keeps the default window.
+func WithZstdWindowSize(size int) LayerOpt {
+	return func(l *Layer) {
+		l.zstdWindowSize = size
+	}
+}
+
+// WithZstdLevel sets level of zstd compression, trading CPU time for size of the blob.
+// Zero keeps zstd.DefaultLevel.
+func WithZstdLevel(level int) LayerOpt {
+	return func(l *Layer) {
+		l.zstdLevel = level
+	}
+}
+
+// WithZstdConcurrency sets how many goroutines compress the layer blob with zstd, see zstd.WithConcurrency.
+func WithZstdConcurrency(n int) LayerOpt {
+	return func(l *Layer) {
+		l.zstdConcurrency = n
+	}
+}
+
+// WithSeekableZstd makes the layer blob seekable zstd: independent frames of frameSize uncompressed bytes
+// followed by seek table (see zstd.SeekableReadCloser), so byte ranges of the segment can be fetched
+// and decompressed without the rest of it. Zero keeps a single stream.
+func WithSeekableZstd(frameSize int) LayerOpt {
+	return func(l *Layer) {
+		l.seekableFrameSize = frameSize
+	}
+}
+
+// WithZstdDictionary makes the layer compress with given zstd dictionary, which decompressing then needs as well.
+// Nil dictionary is ignored.
+func WithZstdDictionary(d *zstd.Dictionary) LayerOpt {
+	return func(l *Layer) {
+		l.zstdDictionary = d
+	}
+}
+
+// ZstdWindowAnnotationKey records window size of zstd compression, when other than default.
+// Decoders need that much memory, and the same window is needed to reproduce the blob.
+const ZstdWindowAnnotationKey = "online.jarosik.tomasz.geranos.zstd.window"
+
+// ZstdLevelAnnotationKey records level of zstd compression, when other than default,
+// as the same level is needed to reproduce the blob.
+const ZstdLevelAnnotationKey = "online.jarosik.tomasz.geranos.zstd.level"
+
+// ZstdSeekableAnnotationKey records uncompressed size of frames of seekable zstd blob, see WithSeekableZstd.
+const ZstdSeekableAnnotationKey = "online.jarosik.tomasz.geranos.zstd.seekable"
+
+// ZstdDictionaryAnnotationKey records ID of the zstd dictionary the blob was compressed with.
+// The dictionary itself is shipped by the image, see Uncompressed.
+const ZstdDictionaryAnnotationKey = "online.jarosik.tomasz.geranos.zstd.dictionary.id"
+
+// encoderAnnotations describe settings of zstd encoder, which are not implied by the media type.
+func (pfl *Layer) encoderAnnotations() map[string]string {
+	res := make(map[string]string)
+	if pfl.zstdLevel > 0 && pfl.zstdLevel != zstd.DefaultLevel {
+		res[ZstdLevelAnnotationKey] = strconv.Itoa(pfl.zstdLevel)
+	}
+	if pfl.zstdWindowSize > 0 {
+		res[ZstdWindowAnnotationKey] = strconv.Itoa(pfl.zstdWindowSize)
+	}
+	if pfl.seekableFrameSize > 0 {
+		res[ZstdSeekableAnnotationKey] = strconv.Itoa(pfl.seekableFrameSize)
+	}
+	if pfl.zstdDictionary != nil {
+		res[ZstdDictionaryAnnotationKey] = strconv.FormatUint(uint64(pfl.zstdDictionary.ID), 10)
+	}
+	return res
+}
+
+// SameEncoder reports whether blob of d was compressed with the same settings the layer would use,
+// so digests recorded by d can be reused for the layer.
+func (pfl *Layer) SameEncoder(d *Descriptor) bool {
+	if d.IsZero() {
+		return true
+	}
+	if d.Compression() != pfl.compression {
+		return false
+	}
+	if d.Compression() != CompressionZstd {
+		return true
+	}
+	expected := pfl.encoderAnnotations()
+	actual := d.Annotations()
+	for _, k := range []string{ZstdLevelAnnotationKey, ZstdWindowAnnotationKey, ZstdSeekableAnnotationKey, ZstdDictionaryAnnotationKey} {
+		if expected[k] != actual[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// zstdCompress returns reader of u compressed with zstd as configured for the layer.
+func (pfl *Layer) zstdCompress(u io.ReadCloser) io.ReadCloser {
+	level := zstd.DefaultLevel
+	if pfl.zstdLevel > 0 {
+		level = pfl.zstdLevel
+	}
+	opts := []zstd.Option{zstd.WithLevel(level), zstd.WithWindowSize(pfl.zstdWindowSize), zstd.WithDictionary(pfl.zstdDictionary)}
+	if pfl.seekableFrameSize > 0 {
+		return zstd.SeekableReadCloser(u, pfl.seekableFrameSize, opts...)
+	}
+	return zstd.ReadCloserWithOptions(u, append(opts, zstd.WithConcurrency(pfl.zstdConcurrency))...)
+}
+
+// ZstdDictionaryID returns ID of the dictionary configured by WithZstdDictionary, or zero without one.
+func (pfl *Layer) ZstdDictionaryID() uint32 {
+	if pfl.zstdDictionary == nil {
+		return 0
+	}
+	return pfl.zstdDictionary.ID
+}
+
+// ParseCompression validates name of compression algorithm.
+func ParseCompression(name string) (Compression, error) {
+	switch c := Compression(name); c {
+	case CompressionZstd, CompressionGzip, CompressionNone:
+		return c, nil
+	}
+	return "", fmt.Errorf("unsupported compression '%v', expected zstd, gzip or none", name)
+}
+
+func (c Compression) mediaType() types.MediaType {
+	switch c {
+	case CompressionGzip:
+		return GzipMediaType
+	case CompressionNone:
+		return UncompressedMediaType
+	}
+	return MediaType
+}
+
+// compressionOf returns compression declared by media type of segment. Besides media types of geranos,
+// compressed layer types of other OCI tooling (like tar+gzip) are accepted, so their segments can be pulled.
+func compressionOf(mt types.MediaType) (Compression, bool) {
+	switch mt {
+	case MediaType, ZeroMediaType:
+		return CompressionZstd, true
+	case GzipMediaType:
+		return CompressionGzip, true
+	case UncompressedMediaType:
+		return CompressionNone, true
+	}
+	s := string(mt)
+	switch {
+	case strings.HasSuffix(s, "+gzip"), strings.HasSuffix(s, ".gzip"), mt == "application/gzip":
+		return CompressionGzip, true
+	case strings.HasSuffix(s, "+zstd"), strings.HasSuffix(s, ".zstd"), mt == "application/zstd":
+		return CompressionZstd, true
+	}
+	return "", false
+}
+
+// Compression returns algorithm requested for the layer blob. With WithSkipIncompressible, the blob can
+// end up uncompressed anyway, which is declared by MediaType.
+func (pfl *Layer) Compression() Compression {
+	return pfl.compression
+}
+
+type decodeOptions struct {
+	dicts     []*zstd.Dictionary
+	maxWindow uint64
+	maxMemory uint64
+}
+
+// DecodeOpt configures decompression done by Uncompressed.
+type DecodeOpt func(*decodeOptions)
+
+// WithDictionaries provides zstd dictionaries shipped by the image, which segments may be compressed with.
+func WithDictionaries(dicts ...*zstd.Dictionary) DecodeOpt {
+	return func(o *decodeOptions) {
+		o.dicts = append(o.dicts, dicts...)
+	}
+}
+
+// Default limits of decompressing zstd segments, so hostile images cannot make every worker allocate gigabytes.
+// By default a segment may use the window it declares with ZstdWindowAnnotationKey, up to DefaultMaxDecoderWindow,
+// and segments which declare none the largest default window of the encoder.
+const (
+	DefaultMaxDecoderWindow = 256 << 20
+	DefaultMaxDecoderMemory = 512 << 20
+)
+
+// defaultEncoderWindow is the largest window the zstd encoder uses without WithZstdWindowSize, at any level.
+const defaultEncoderWindow = 8 << 20
+
+// defaultDecoderWindow returns window limit of segment described by d, when none is set with WithDecoderLimits.
+func defaultDecoderWindow(d *Descriptor) uint64 {
+	window := uint64(defaultEncoderWindow)
+	if raw, ok := d.extraAnnotations[ZstdWindowAnnotationKey]; ok {
+		if n, err := strconv.ParseUint(raw, 10, 64); err == nil {
+			window = n
+		}
+	}
+	return min(window, DefaultMaxDecoderWindow)
+}
+
+// WithDecoderLimits rejects zstd segments needing window larger than maxWindow bytes, and limits memory
+// the decoder allocates to about maxMemory bytes. Zero keeps the default limit, see DefaultMaxDecoderWindow
+// and DefaultMaxDecoderMemory.
+func WithDecoderLimits(maxWindow, maxMemory uint64) DecodeOpt {
+	return func(o *decodeOptions) {
+		o.maxWindow = maxWindow
+		o.maxMemory = maxMemory
+	}
+}
+
+// Uncompressed returns content of layer l described by d, decompressing it as declared by its media type.
+// zstd segments are decompressed within decoder limits, with dictionary they were compressed with, which
+// has to be provided. Segments of MediaType are decompressed by the layer itself, which detects compression
+// of the blob.
+func Uncompressed(l v1.Layer, d *Descriptor, opts ...DecodeOpt) (io.ReadCloser, error) {
+	var o decodeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.maxWindow == 0 {
+		o.maxWindow = defaultDecoderWindow(d)
+	}
+	if o.maxMemory == 0 {
+		o.maxMemory = DefaultMaxDecoderMemory
+	}
+	raw, withDict := d.extraAnnotations[ZstdDictionaryAnnotationKey]
+	if d.compression == CompressionZstd {
+		decoderOpts := []zstd.DecoderOption{zstd.WithMaxWindow(o.maxWindow), zstd.WithMaxMemory(o.maxMemory)}
+		if withDict {
+			dict, err := findDictionary(raw, o.dicts)
+			if err != nil {
+				return nil, fmt.Errorf("unable to decompress %v: %w", d, err)
+			}
+			decoderOpts = append(decoderOpts, zstd.WithDecoderDictionary(dict))
+		}
+		rc, err := l.Compressed()
+		if err != nil {
+			return nil, err
+		}
+		return zstd.NewReader(rc, decoderOpts...)
+	}
+	switch d.compression {
+	case CompressionNone:
+		return l.Compressed()
+	case CompressionGzip:
+		rc, err := l.Compressed()
+		if err != nil {
+			return nil, err
+		}
+		zr, err := gzip.NewReader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("unable to decompress %v: %w", d, err)
+		}
+		return &gzipReadCloser{Reader: zr, rc: rc}, nil
+	}
+	return l.Uncompressed()
+}
+
+func findDictionary(raw string, dicts []*zstd.Dictionary) (*zstd.Dictionary, error) {
+	id, err := strconv.ParseUint(raw, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid zstd dictionary id '%v'", raw)
+	}
+	for _, dict := range dicts {
+		if dict != nil && uint64(dict.ID) == id {
+			return dict, nil
+		}
+	}
+	return nil, fmt.Errorf("zstd dictionary %v is not available", id)
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	rc io.ReadCloser
+}
+
+func (g *gzipReadCloser) Close() error {
+	err := g.Reader.Close()
+	if cerr := g.rc.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// gzipCompress returns reader of r compressed with gzip, closing r when done.
+func gzipCompress(r io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer r.Close()
+		zw, err := gzip.NewWriterLevel(pw, gzip.BestSpeed)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(zw, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(zw.Close())
+	}()
+	return pr
+}
@@ -18,6 +18,14 @@ type Descriptor struct {
 	stop     int64
 	digest   v1.Hash
 	diffID   v1.Hash
+	id       *SegmentID
+	zero     bool
+	// compression is declared by media type of the layer, which is kept as found in the manifest
+	compression Compression
+	mediaType   types.MediaType
+	// extraAnnotations are annotations other than filename and range, preserved as found in the manifest
+	extraAnnotations map[string]string
+	metadata         *FileMetadata
 }
 
 func (d *Descriptor) Filename() string {
@@ -38,22 +46,61 @@ func (d *Descriptor) Digest() v1.Hash {
 
 func (d *Descriptor) DiffID() v1.Hash { return d.diffID }
 
+// ID returns identifier assigned by AssignIDs, or zero SegmentID if none was assigned.
+func (d *Descriptor) ID() SegmentID {
+	if d.id == nil {
+		return SegmentID{}
+	}
+	return *d.id
+}
+
 func (d *Descriptor) Length() int64 {
 	return d.stop - d.start + 1
 }
 
 func (d *Descriptor) Annotations() map[string]string {
-	return map[string]string{
-		FilenameAnnotationKey: d.filename,
+	res := map[string]string{
+		FilenameAnnotationKey: EncodeFilename(d.filename),
 		RangeAnnotationKey:    fmt.Sprintf("%d-%d", d.start, d.stop),
 	}
+	for k, v := range d.extraAnnotations {
+		res[k] = v
+	}
+	return res
+}
+
+// Metadata returns file attributes recorded on this segment, or nil if there are none.
+func (d *Descriptor) Metadata() *FileMetadata {
+	return d.metadata
 }
 
 func (d *Descriptor) MediaType() types.MediaType {
-	return MediaType
+	if d.zero {
+		return ZeroMediaType
+	}
+	if d.mediaType != "" {
+		return d.mediaType
+	}
+	return d.compression.mediaType()
+}
+
+// Compression returns algorithm the segment blob is compressed with.
+func (d *Descriptor) Compression() Compression {
+	if d.compression == "" {
+		return CompressionZstd
+	}
+	return d.compression
+}
+
+// IsZero reports whether the segment consists only of zeros and has no content to download, see ZeroMediaType.
+func (d *Descriptor) IsZero() bool {
+	return d.zero
 }
 
 func (d *Descriptor) String() string {
+	if d.id != nil {
+		return fmt.Sprintf("descriptor (%v) filename=%s[%d-%d]", d.id, d.filename, d.start, d.stop)
+	}
 	return fmt.Sprintf("descriptor filename=%s[%d-%d]", d.filename, d.start, d.stop)
 }
 
@@ -87,13 +134,18 @@ func NewDescriptor(filename string, start, stop int64, digest v1.Hash) *Descript
 }
 
 func ParseDescriptor(d v1.Descriptor, diffID v1.Hash) (*Descriptor, error) {
-	if d.MediaType != MediaType {
+	compression, ok := compressionOf(d.MediaType)
+	if !ok {
 		return nil, errors.New("unsupported layer type")
 	}
-	filename, present := d.Annotations[FilenameAnnotationKey]
+	encodedFilename, present := d.Annotations[FilenameAnnotationKey]
 	if !present {
 		return nil, errors.New("missing filename annotation")
 	}
+	filename := DecodeFilename(encodedFilename)
+	if err := ValidateFilename(filename); err != nil {
+		return nil, err
+	}
 	rangeString, present := d.Annotations[RangeAnnotationKey]
 	if !present {
 		return nil, errors.New("missing range annotation")
@@ -102,11 +154,26 @@ func ParseDescriptor(d v1.Descriptor, diffID v1.Hash) (*Descriptor, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid range: %w", err)
 	}
+	metadata, err := parseFileMetadata(d.Annotations)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata of '%v': %w", filename, err)
+	}
+	extraAnnotations := make(map[string]string)
+	for k, v := range d.Annotations {
+		if k != FilenameAnnotationKey && k != RangeAnnotationKey {
+			extraAnnotations[k] = v
+		}
+	}
 	return &Descriptor{
-		filename: filename,
-		start:    start,
-		stop:     stop,
-		digest:   d.Digest,
-		diffID:   diffID,
+		filename:         filename,
+		start:            start,
+		stop:             stop,
+		digest:           d.Digest,
+		diffID:           diffID,
+		zero:             d.MediaType == ZeroMediaType,
+		compression:      compression,
+		mediaType:        d.MediaType,
+		extraAnnotations: extraAnnotations,
+		metadata:         metadata,
 	}, nil
 }
@@ -1,8 +1,15 @@
 package filesegment
 
 import (
+	"bytes"
+	"compress/gzip"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"runtime"
 	"testing"
 )
 
@@ -76,3 +83,78 @@ func TestParseDescriptor(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func TestAssignIDs(t *testing.T) {
+	descriptors := []*Descriptor{
+		NewDescriptor("disk.img", 0, 9, v1.Hash{}),
+		NewDescriptor("disk.img", 10, 19, v1.Hash{}),
+		NewDescriptor("nvram.bin", 0, 9, v1.Hash{}),
+		NewDescriptor("disk.img", 20, 29, v1.Hash{}),
+	}
+	assert.Equal(t, "descriptor filename=disk.img[0-9]", descriptors[0].String())
+
+	AssignIDs(descriptors)
+	assert.Equal(t, SegmentID{File: 0, Segment: 1}, descriptors[1].ID())
+	assert.Equal(t, SegmentID{File: 1, Segment: 2}, descriptors[2].ID())
+	assert.Equal(t, SegmentID{File: 0, Segment: 3}, descriptors[3].ID())
+	assert.Equal(t, "descriptor (file 1, segment 2) filename=nvram.bin[0-9]", descriptors[2].String())
+}
+
+func TestParseDescriptor_Filename(t *testing.T) {
+	for encoded, expected := range map[string]string{
+		"disk.img":                  "disk.img",
+		"Contents/nvram%251.bin":    "Contents/nvram%1.bin",
+		"Contents/back%5Cslash.img": "Contents/back\\slash.img",
+	} {
+		d, err := ParseDescriptor(v1.Descriptor{
+			MediaType:   MediaType,
+			Annotations: map[string]string{FilenameAnnotationKey: encoded, RangeAnnotationKey: "0-9"},
+		}, v1.Hash{})
+		if expected == "Contents/back\\slash.img" && runtime.GOOS == "windows" {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err, encoded)
+		assert.Equal(t, expected, d.Filename())
+		assert.Equal(t, encoded, d.Annotations()[FilenameAnnotationKey])
+	}
+	// unknown escape sequences come from images created before escaping and are taken literally
+	assert.Equal(t, "legacy%name.img", DecodeFilename("legacy%name.img"))
+	for _, invalid := range []string{"", "/etc/passwd", "../outside", "Contents/../../outside", "./disk.img", "Contents/"} {
+		_, err := ParseDescriptor(v1.Descriptor{
+			MediaType:   MediaType,
+			Annotations: map[string]string{FilenameAnnotationKey: invalid, RangeAnnotationKey: "0-9"},
+		}, v1.Hash{})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestUncompressed_foreignGzip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte("content of segment"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	layer := static.NewLayer(buf.Bytes(), types.OCILayer)
+	digest, err := layer.Digest()
+	require.NoError(t, err)
+
+	d, err := ParseDescriptor(v1.Descriptor{
+		MediaType: types.OCILayer,
+		Digest:    digest,
+		Annotations: map[string]string{
+			FilenameAnnotationKey: "config.json",
+			RangeAnnotationKey:    "0-17",
+		},
+	}, v1.Hash{Algorithm: "sha256", Hex: "abc123"})
+	require.NoError(t, err)
+	assert.Equal(t, CompressionGzip, d.Compression())
+	assert.Equal(t, types.OCILayer, d.MediaType(), "media type has to be kept as found")
+
+	rc, err := Uncompressed(layer, d)
+	require.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, "content of segment", string(data))
+}
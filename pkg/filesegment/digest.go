@@ -0,0 +1,44 @@
+package filesegment
+
+import (
+	"encoding/hex"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"io"
+)
+
+// DefaultDigestAlgorithm is used for DiffID and digest of layers unless WithDigestAlgorithm is given.
+const DefaultDigestAlgorithm = "sha256"
+
+// WithDigestAlgorithm selects algorithm of DiffID and digest of the layer. Only algorithms supported by
+// v1.Hasher, sha256 and sha512, can be used, as descriptors of the image have to be parsed by go-containerregistry again.
+// Faster algorithms like BLAKE3 are rejected for that reason, pull of such image would fail on its manifest.
+func WithDigestAlgorithm(algorithm string) LayerOpt {
+	return func(l *Layer) {
+		l.algorithm = algorithm
+	}
+}
+
+// ValidateDigestAlgorithm reports algorithms which cannot be used for segments.
+func ValidateDigestAlgorithm(algorithm string) error {
+	if _, err := v1.Hasher(algorithm); err != nil {
+		return fmt.Errorf("unsupported digest algorithm '%v': %w", algorithm, err)
+	}
+	return nil
+}
+
+// computeHash is v1.SHA256 for any algorithm supported by v1.Hasher.
+func computeHash(algorithm string, r io.Reader) (v1.Hash, int64, error) {
+	if algorithm == DefaultDigestAlgorithm {
+		return v1.SHA256(r)
+	}
+	hasher, err := v1.Hasher(algorithm)
+	if err != nil {
+		return v1.Hash{}, 0, err
+	}
+	n, err := io.Copy(hasher, r)
+	if err != nil {
+		return v1.Hash{}, 0, err
+	}
+	return v1.Hash{Algorithm: algorithm, Hex: hex.EncodeToString(hasher.Sum(nil))}, n, nil
+}
@@ -0,0 +1,93 @@
+package filesegment
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Hashes are the values computed by reading content of a layer. They can be restored with RestoreHashes
+// for layer with the same content, instead of reading it again.
+type Hashes struct {
+	DiffID v1.Hash `json:"diffID"`
+	Digest v1.Hash `json:"digest"`
+	Size   int64   `json:"size"`
+	Zero   bool    `json:"zero,omitempty"`
+	// Compression the blob is stored with, when it differs from the requested one
+	Compression Compression `json:"compression,omitempty"`
+}
+
+// Hashes returns DiffID, Digest and compressed Size of the layer, computing them if needed.
+func (pfl *Layer) Hashes() (Hashes, error) {
+	diffID, err := pfl.DiffID()
+	if err != nil {
+		return Hashes{}, err
+	}
+	digest, err := pfl.Digest()
+	if err != nil {
+		return Hashes{}, err
+	}
+	res := Hashes{DiffID: diffID, Digest: digest, Size: pfl.size, Zero: pfl.IsZero()}
+	if c := pfl.effectiveCompression(); c != pfl.compression {
+		res.Compression = c
+	}
+	return res, nil
+}
+
+// RestoreHashes sets hashes computed earlier for the same content, so the layer does not read it to compute them.
+// It has no effect on hashes which were computed already.
+func (pfl *Layer) RestoreHashes(h Hashes) {
+	pfl.uncompressedOnce.Do(func() {
+		pfl.diffID = h.DiffID
+		pfl.zero = h.Zero
+	})
+	pfl.compressedOnce.Do(func() {
+		pfl.hash = h.Digest
+		pfl.size = h.Size
+		pfl.digestKnown.Store(true)
+	})
+	pfl.effectiveOnce.Do(func() {
+		pfl.effective = pfl.compression
+		if h.Compression != "" {
+			pfl.effective = h.Compression
+		}
+	})
+}
+
+// BlobKey returns key of the compressed blob of the layer: layers with the same content and encoder settings
+// have the same key, and the same Digest. It computes DiffID if needed. Layers with table of contents
+// record their position in the blob, and return empty key, as they share it with no other layer.
+func (pfl *Layer) BlobKey() (string, error) {
+	if pfl.withTOC {
+		return "", nil
+	}
+	diffID, err := pfl.DiffID()
+	if err != nil {
+		return "", err
+	}
+	if pfl.zero {
+		return "zero;" + diffID.String(), nil
+	}
+	encoder := pfl.encoderAnnotations()
+	keys := make([]string, 0, len(encoder))
+	for k := range encoder {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v;%v;%v", diffID, pfl.compression, pfl.minSavings)
+	for _, k := range keys {
+		fmt.Fprintf(&b, ";%v=%v", k, encoder[k])
+	}
+	return b.String(), nil
+}
+
+// ShareBlob makes the layer take its Digest and Size from source, which has the same BlobKey,
+// so the same content is not compressed again. It has no effect when the digest was computed already.
+func (pfl *Layer) ShareBlob(source *Layer) {
+	if source != pfl && !pfl.DigestKnown() {
+		pfl.blobSource = source
+	}
+}
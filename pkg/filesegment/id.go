@@ -0,0 +1,28 @@
+package filesegment
+
+import "fmt"
+
+// SegmentID identifies a segment by its position in the manifest: File is the index of its file
+// in order of first appearance, Segment is the index of the segment among all segments of the image.
+// Both are stable for given manifest, so they can be referenced across runs and in machine-readable output.
+type SegmentID struct {
+	File    int `json:"file"`
+	Segment int `json:"segment"`
+}
+
+func (id SegmentID) String() string {
+	return fmt.Sprintf("file %d, segment %d", id.File, id.Segment)
+}
+
+// AssignIDs sets IDs of descriptors listed in manifest order.
+func AssignIDs(descriptors []*Descriptor) {
+	files := make(map[string]int)
+	for i, d := range descriptors {
+		fileIdx, ok := files[d.filename]
+		if !ok {
+			fileIdx = len(files)
+			files[d.filename] = fileIdx
+		}
+		d.id = &SegmentID{File: fileIdx, Segment: i}
+	}
+}
@@ -0,0 +1,71 @@
+package filesegment
+
+import (
+	"github.com/macvmio/geranos/pkg/zstd"
+	"io"
+)
+
+const (
+	compressionSamples    = 4
+	compressionSampleSize = 64 * 1024
+)
+
+// WithSkipIncompressible makes the layer store its content uncompressed (see UncompressedMediaType), when
+// compressing samples of it saves less than minSavings fraction of their size (0.05 means 5%).
+// It saves CPU time on already compressed or encrypted content, which does not get any smaller anyway.
+func WithSkipIncompressible(minSavings float64) LayerOpt {
+	return func(l *Layer) {
+		l.minSavings = minSavings
+	}
+}
+
+// effectiveCompression returns compression the layer blob is actually stored with, which differs from
+// Compression when skipping incompressible content.
+func (pfl *Layer) effectiveCompression() Compression {
+	pfl.effectiveOnce.Do(func() {
+		pfl.effective = pfl.compression
+		if pfl.minSavings <= 0 || pfl.compression == CompressionNone || pfl.withTOC {
+			return
+		}
+		savings, err := pfl.sampleSavings()
+		if err != nil {
+			pfl.log("%v: unable to sample content, keeping %v compression: %v", pfl, pfl.compression, err)
+			return
+		}
+		if savings < pfl.minSavings {
+			pfl.log("%v: compression saves only %.1f%%, storing uncompressed", pfl, savings*100)
+			pfl.effective = CompressionNone
+		}
+	})
+	return pfl.effective
+}
+
+// sampleSavings compresses samples spread evenly over the segment, and returns fraction of bytes it saved.
+func (pfl *Layer) sampleSavings() (float64, error) {
+	f, err := pfl.fs.Open(pfl.filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	length := pfl.Length()
+	sampleSize := min(int64(compressionSampleSize), length)
+	step := max((length-sampleSize)/max(compressionSamples-1, 1), 1)
+	buf := make([]byte, sampleSize)
+	var original, compressed int
+	for i := int64(0); i < compressionSamples && i*step+sampleSize <= length; i++ {
+		n, err := f.ReadAt(buf, pfl.start+i*step)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		c, err := zstd.Compress(buf[:n])
+		if err != nil {
+			return 0, err
+		}
+		original += n
+		compressed += len(c)
+	}
+	if original == 0 {
+		return 1, nil
+	}
+	return 1 - float64(compressed)/float64(original), nil
+}
@@ -1,67 +1,129 @@
 package filesegment
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/macvmio/geranos/pkg/sysenv"
 	"github.com/macvmio/geranos/pkg/zstd"
 	"io"
 	"log"
-	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 )
 
 const MediaType = types.MediaType("application/online.jarosik.tomasz.geranos.segment")
 
 type Layer struct {
 	filePath  string
+	name      string
 	start     int64
 	stop      int64
-	mediaType types.MediaType
 	diffID    v1.Hash
+	diffIDErr error
+	algorithm string
+
+	compression   Compression
+	minSavings    float64
+	effectiveOnce sync.Once
+	effective     Compression
+
+	zstdLevel       int
+	zstdWindowSize  int
+	zstdDictionary  *zstd.Dictionary
+	zstdConcurrency int
+
+	seekableFrameSize int
 
 	hash             v1.Hash
 	size             int64
 	hashSizeError    error
 	compressedOnce   sync.Once
 	uncompressedOnce sync.Once
+	digestKnown      atomic.Bool
+	// blobSource is the layer of the same blob Digest and Size are taken from, see ShareBlob
+	blobSource *Layer
 
 	log func(fmt string, args ...any)
+	fs  sysenv.FS
+
+	withMetadata bool
+	withXattrs   bool
+	metadata     *FileMetadata
+
+	detectZero bool
+	zero       bool
+
+	withTOC bool
+	// tocFrame and tocAnnotations are set by calcSizeHash
+	tocFrame       []byte
+	tocAnnotations map[string]string
 }
 
 var _ v1.Layer = (*Layer)(nil)
 
 func (pfl *Layer) DiffID() (v1.Hash, error) {
 	pfl.uncompressedOnce.Do(func() {
+		if pfl.inHole() {
+			pfl.diffID, pfl.diffIDErr = zeroHash(pfl.algorithm, pfl.Length())
+			pfl.zero = true
+			pfl.log("%v: segment is a hole, using hash of zeros", pfl)
+			return
+		}
 		rc, err := pfl.Uncompressed()
 		if err != nil {
+			pfl.diffIDErr = err
 			return
 		}
 		defer rc.Close()
-		cfgHash, _, err := v1.SHA256(rc)
+		checker := &zeroChecker{r: rc}
+		cfgHash, _, err := computeHash(pfl.algorithm, checker)
 		if err != nil {
+			pfl.diffIDErr = err
 			return
 		}
 		pfl.log("%v: calculated uncompressed layer hash", pfl)
 		pfl.diffID = cfgHash
+		pfl.zero = !checker.nonZero
 	})
-	return pfl.diffID, nil
+	return pfl.diffID, pfl.diffIDErr
 }
 
 // Uncompressed implements v1.Layer
 func (pfl *Layer) Uncompressed() (io.ReadCloser, error) {
-	return newPartialFileReader(pfl.filePath, pfl.start, pfl.stop)
+	return newPartialFileReader(pfl.fs, pfl.filePath, pfl.start, pfl.stop)
 }
 
 // Compressed implements v1.Layer
 func (pfl *Layer) Compressed() (io.ReadCloser, error) {
+	if pfl.IsZero() {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if pfl.withTOC {
+		// table of contents is known only after the segment was compressed and hashed once
+		pfl.calcSizeHash()
+		if pfl.hashSizeError != nil {
+			return nil, pfl.hashSizeError
+		}
+	}
 	u, err := pfl.Uncompressed()
 	if err != nil {
 		return nil, err
 	}
-	return zstd.ReadCloser(u), nil
+	switch pfl.effectiveCompression() {
+	case CompressionNone:
+		return u, nil
+	case CompressionGzip:
+		return gzipCompress(u), nil
+	}
+	rc := pfl.zstdCompress(u)
+	if pfl.withTOC {
+		return &multiReadCloser{Reader: io.MultiReader(rc, bytes.NewReader(pfl.tocFrame)), Closer: rc}, nil
+	}
+	return rc, nil
 }
 
 // Digest implements v1.Layer
@@ -72,19 +134,35 @@ func (pfl *Layer) Digest() (v1.Hash, error) {
 
 func (pfl *Layer) calcSizeHash() {
 	pfl.compressedOnce.Do(func() {
+		if src := pfl.blobSource; src != nil {
+			pfl.hash, pfl.hashSizeError = src.Digest()
+			pfl.size = src.size
+			pfl.digestKnown.Store(pfl.hashSizeError == nil)
+			return
+		}
+		if pfl.withTOC && !pfl.IsZero() {
+			pfl.hash, pfl.size, pfl.hashSizeError = pfl.hashWithTOC()
+			pfl.digestKnown.Store(pfl.hashSizeError == nil)
+			pfl.log("%v: calculated compressed layer hash", pfl)
+			return
+		}
 		var r io.ReadCloser
 		r, pfl.hashSizeError = pfl.Compressed()
 		if pfl.hashSizeError != nil {
 			return
 		}
 		defer r.Close()
-		pfl.hash, pfl.size, pfl.hashSizeError = v1.SHA256(r)
+		pfl.hash, pfl.size, pfl.hashSizeError = computeHash(pfl.algorithm, r)
+		pfl.digestKnown.Store(pfl.hashSizeError == nil)
 		pfl.log("%v: calculated compressed layer hash", pfl)
 	})
 }
 
 func (pfl *Layer) MediaType() (types.MediaType, error) {
-	return pfl.mediaType, nil
+	if pfl.IsZero() {
+		return ZeroMediaType, nil
+	}
+	return pfl.effectiveCompression().mediaType(), nil
 }
 
 func (pfl *Layer) Size() (int64, error) {
@@ -93,7 +171,16 @@ func (pfl *Layer) Size() (int64, error) {
 }
 
 func (pfl *Layer) String() string {
-	return fmt.Sprintf("layer from '%v' range[%v-%v]", filepath.Base(pfl.filePath), pfl.start, pfl.stop)
+	return fmt.Sprintf("layer from '%v' range[%v-%v]", pfl.Filename(), pfl.start, pfl.stop)
+}
+
+// Filename returns path of the file relative to the image directory, as set by WithFilename,
+// or the base name of the file otherwise.
+func (pfl *Layer) Filename() string {
+	if pfl.name != "" {
+		return pfl.name
+	}
+	return filepath.Base(pfl.filePath)
 }
 
 func (pfl *Layer) Start() int64 {
@@ -105,10 +192,25 @@ func (pfl *Layer) Stop() int64 {
 }
 
 func (pfl *Layer) Annotations() map[string]string {
-	return map[string]string{
-		FilenameAnnotationKey: filepath.Base(pfl.filePath),
+	res := map[string]string{
+		FilenameAnnotationKey: EncodeFilename(pfl.Filename()),
 		RangeAnnotationKey:    fmt.Sprintf("%d-%d", pfl.start, pfl.stop),
 	}
+	for k, v := range pfl.metadata.annotations() {
+		res[k] = v
+	}
+	if !pfl.IsZero() && pfl.effectiveCompression() == CompressionZstd {
+		for k, v := range pfl.encoderAnnotations() {
+			res[k] = v
+		}
+	}
+	if pfl.withTOC && !pfl.IsZero() {
+		pfl.calcSizeHash()
+		for k, v := range pfl.tocAnnotations {
+			res[k] = v
+		}
+	}
+	return res
 }
 
 func (pfl *Layer) Length() int64 {
@@ -116,17 +218,20 @@ func (pfl *Layer) Length() int64 {
 }
 
 func NewLayer(filePath string, opts ...LayerOpt) (*Layer, error) {
-	info, err := os.Stat(filePath)
+	fsys := resolveFileSystem(opts...)
+	info, err := fsys.Stat(filePath)
 	if err != nil {
 		return nil, err
 	}
 
 	pfl := &Layer{
-		filePath:  filePath,
-		start:     0,
-		stop:      info.Size() - 1,
-		mediaType: MediaType,
-		log:       log.Printf,
+		filePath:    filePath,
+		start:       0,
+		stop:        info.Size() - 1,
+		algorithm:   DefaultDigestAlgorithm,
+		compression: CompressionZstd,
+		log:         log.Printf,
+		fs:          fsys,
 	}
 	for _, o := range opts {
 		o(pfl)
@@ -137,5 +242,36 @@ func NewLayer(filePath string, opts ...LayerOpt) (*Layer, error) {
 	if pfl.start < 0 || pfl.start > pfl.stop {
 		return nil, errors.New("provided 'start' index is out of range")
 	}
+	if err := ValidateDigestAlgorithm(pfl.algorithm); err != nil {
+		return nil, err
+	}
+	if _, err := ParseCompression(string(pfl.compression)); err != nil {
+		return nil, err
+	}
+	if pfl.zstdLevel != 0 {
+		if err := zstd.ValidateLevel(pfl.zstdLevel); err != nil {
+			return nil, err
+		}
+	}
+	if err := zstd.ValidateWindowSize(pfl.zstdWindowSize); err != nil {
+		return nil, err
+	}
+	if pfl.withTOC && pfl.compression != CompressionZstd {
+		return nil, errors.New("table of contents requires zstd compression")
+	}
+	if pfl.seekableFrameSize != 0 {
+		if err := zstd.ValidateSeekableFrameSize(pfl.seekableFrameSize); err != nil {
+			return nil, err
+		}
+		if pfl.withTOC {
+			return nil, errors.New("seekable zstd can not be combined with table of contents")
+		}
+	}
+	if pfl.withMetadata && pfl.start == 0 {
+		pfl.metadata, err = readFileMetadata(fsys, filePath, info, pfl.withXattrs)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return pfl, nil
 }
@@ -6,8 +6,12 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/macvmio/geranos/pkg/zstd"
 	"github.com/stretchr/testify/require"
+	"io"
+	"os"
 	"runtime"
+	"strconv"
 	"testing"
 )
 
@@ -130,3 +134,176 @@ func TestLayer_Functionality(t *testing.T) {
 		t.Errorf("unable to append layer: %v", err)
 	}
 }
+
+func TestLayer_DigestAlgorithm(t *testing.T) {
+	defaultLayer, err := NewLayer("testdata/disk.img", WithRange(0, 99))
+	require.NoError(t, err)
+	expected, err := defaultLayer.DiffID()
+	require.NoError(t, err)
+	require.Equal(t, DefaultDigestAlgorithm, expected.Algorithm)
+
+	explicit, err := NewLayer("testdata/disk.img", WithRange(0, 99), WithDigestAlgorithm("sha256"))
+	require.NoError(t, err)
+	diffID, err := explicit.DiffID()
+	require.NoError(t, err)
+	require.Equal(t, expected, diffID)
+
+	_, err = NewLayer("testdata/disk.img", WithDigestAlgorithm("md5"))
+	require.ErrorContains(t, err, "unsupported digest algorithm 'md5'")
+	_, err = NewLayer("testdata/disk.img", WithDigestAlgorithm("blake3"))
+	require.ErrorContains(t, err, "unsupported digest algorithm 'blake3'")
+
+	sha512Layer, err := NewLayer("testdata/disk.img", WithRange(0, 99), WithDigestAlgorithm("sha512"))
+	require.NoError(t, err)
+	sha512DiffID, err := sha512Layer.DiffID()
+	require.NoError(t, err)
+	require.Equal(t, "sha512", sha512DiffID.Algorithm)
+	sha512Digest, err := sha512Layer.Digest()
+	require.NoError(t, err)
+	require.Equal(t, "sha512", sha512Digest.Algorithm)
+	// descriptors have to be parsed by go-containerregistry again
+	_, err = v1.NewHash(sha512Digest.String())
+	require.NoError(t, err)
+
+	// verification uses algorithm of the descriptor rather than the one of options
+	d := NewDescriptor("disk.img", 0, 99, v1.Hash{})
+	d.diffID = expected
+	require.True(t, Matches(d, "testdata", WithDigestAlgorithm("md5")))
+	d.diffID = v1.Hash{Algorithm: "md5", Hex: expected.Hex}
+	require.False(t, Matches(d, "testdata"))
+}
+
+func TestLayer_ZstdWindowSize(t *testing.T) {
+	l, err := NewLayer("testdata/disk.img", WithRange(0, 99), WithZstdWindowSize(16<<20))
+	require.NoError(t, err)
+	require.Equal(t, "16777216", l.Annotations()[ZstdWindowAnnotationKey])
+
+	digest, err := l.Digest()
+	require.NoError(t, err)
+	diffID, err := l.DiffID()
+	require.NoError(t, err)
+	mt, err := l.MediaType()
+	require.NoError(t, err)
+	d, err := ParseDescriptor(v1.Descriptor{MediaType: mt, Digest: digest, Annotations: l.Annotations()}, diffID)
+	require.NoError(t, err)
+	require.True(t, l.SameEncoder(d))
+	require.Equal(t, uint64(16<<20), defaultDecoderWindow(d))
+	d.extraAnnotations[ZstdWindowAnnotationKey] = strconv.Itoa(1 << 30)
+	require.Equal(t, uint64(DefaultMaxDecoderWindow), defaultDecoderWindow(d))
+
+	defaultLayer, err := NewLayer("testdata/disk.img", WithRange(0, 99))
+	require.NoError(t, err)
+	require.NotContains(t, defaultLayer.Annotations(), ZstdWindowAnnotationKey)
+	require.False(t, defaultLayer.SameEncoder(d))
+	delete(d.extraAnnotations, ZstdWindowAnnotationKey)
+	require.Equal(t, uint64(defaultEncoderWindow), defaultDecoderWindow(d))
+
+	_, err = NewLayer("testdata/disk.img", WithZstdWindowSize(1000))
+	require.ErrorContains(t, err, "invalid zstd window size")
+}
+
+func TestLayer_ZstdLevel(t *testing.T) {
+	l, err := NewLayer("testdata/disk.img", WithZstdLevel(19))
+	require.NoError(t, err)
+	require.Equal(t, "19", l.Annotations()[ZstdLevelAnnotationKey])
+	digest, err := l.Digest()
+	require.NoError(t, err)
+	diffID, err := l.DiffID()
+	require.NoError(t, err)
+	d, err := ParseDescriptor(v1.Descriptor{MediaType: MediaType, Digest: digest, Annotations: l.Annotations()}, diffID)
+	require.NoError(t, err)
+	require.True(t, l.SameEncoder(d))
+
+	defaultLayer, err := NewLayer("testdata/disk.img", WithZstdLevel(zstd.DefaultLevel))
+	require.NoError(t, err)
+	require.NotContains(t, defaultLayer.Annotations(), ZstdLevelAnnotationKey)
+	require.False(t, defaultLayer.SameEncoder(d))
+
+	_, err = NewLayer("testdata/disk.img", WithZstdLevel(23))
+	require.ErrorContains(t, err, "invalid zstd compression level")
+}
+
+func TestLayer_ZstdDictionary(t *testing.T) {
+	content, err := os.ReadFile("testdata/disk.img")
+	require.NoError(t, err)
+	dict := zstd.TrainDictionary([][]byte{content}, zstd.MaxDictionarySize)
+	l, err := NewLayer("testdata/disk.img", WithZstdDictionary(dict))
+	require.NoError(t, err)
+	require.Equal(t, strconv.FormatUint(uint64(dict.ID), 10), l.Annotations()[ZstdDictionaryAnnotationKey])
+
+	digest, err := l.Digest()
+	require.NoError(t, err)
+	diffID, err := l.DiffID()
+	require.NoError(t, err)
+	mt, err := l.MediaType()
+	require.NoError(t, err)
+	d, err := ParseDescriptor(v1.Descriptor{MediaType: mt, Digest: digest, Annotations: l.Annotations()}, diffID)
+	require.NoError(t, err)
+	require.True(t, l.SameEncoder(d))
+
+	defaultLayer, err := NewLayer("testdata/disk.img")
+	require.NoError(t, err)
+	require.False(t, defaultLayer.SameEncoder(d))
+
+	rc, err := Uncompressed(l, d, WithDictionaries(dict))
+	require.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, content, data)
+
+	_, err = Uncompressed(l, d)
+	require.ErrorContains(t, err, "is not available")
+}
+
+func TestLayer_StreamCompressed(t *testing.T) {
+	expected, err := NewLayer("testdata/disk.img")
+	require.NoError(t, err)
+	digest, err := expected.Digest()
+	require.NoError(t, err)
+	size, err := expected.Size()
+	require.NoError(t, err)
+
+	l, err := NewLayer("testdata/disk.img")
+	require.NoError(t, err)
+	require.False(t, l.DigestKnown())
+	rc, err := l.StreamCompressed()
+	require.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.True(t, l.DigestKnown())
+	require.Equal(t, size, int64(len(data)))
+
+	streamedDigest, err := l.Digest()
+	require.NoError(t, err)
+	require.Equal(t, digest, streamedDigest)
+	streamedSize, err := l.Size()
+	require.NoError(t, err)
+	require.Equal(t, size, streamedSize)
+}
+
+func TestLayer_SparseFile(t *testing.T) {
+	name := t.TempDir() + "/sparse.img"
+	f, err := os.Create(name)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(8<<20))
+	_, err = f.WriteAt([]byte("data"), 4<<20)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	hole, err := NewLayer(name, WithRange(0, 1<<20-1), WithZeroDetection())
+	require.NoError(t, err)
+	diffID, err := hole.DiffID()
+	require.NoError(t, err)
+	expected, err := ZeroDiffID(1 << 20)
+	require.NoError(t, err)
+	require.Equal(t, expected, diffID)
+	require.True(t, hole.IsZero())
+
+	data, err := NewLayer(name, WithRange(4<<20, 5<<20-1), WithZeroDetection())
+	require.NoError(t, err)
+	_, err = data.DiffID()
+	require.NoError(t, err)
+	require.False(t, data.IsZero())
+}
@@ -4,9 +4,14 @@ import (
 	"path/filepath"
 )
 
+// Matches reports whether the segment in dir has DiffID of the descriptor, computed with its algorithm.
 func Matches(d *Descriptor, dir string, opt ...LayerOpt) bool {
 	fname := filepath.Join(dir, d.filename)
-	l, err := NewLayer(fname, append(opt, WithRange(d.start, d.stop))...)
+	opt = append(opt, WithRange(d.start, d.stop))
+	if d.diffID.Algorithm != "" {
+		opt = append(opt, WithDigestAlgorithm(d.diffID.Algorithm))
+	}
+	l, err := NewLayer(fname, opt...)
 	if err != nil {
 		return false
 	}
@@ -0,0 +1,114 @@
+package filesegment
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Annotations describing the file itself, present only on the first segment of each file.
+const (
+	FileModeAnnotationKey = "filemode"
+	ModTimeAnnotationKey  = "mtime"
+	XattrAnnotationPrefix = "xattr."
+)
+
+// FileMetadata holds file attributes preserved in the manifest. Nil fields were not recorded.
+type FileMetadata struct {
+	Mode    *os.FileMode
+	ModTime *time.Time
+	Xattrs  map[string][]byte
+}
+
+// WithFileMetadata records mode bits and modification time (and extended attributes if xattrs is set)
+// in annotations of the layer starting at offset 0.
+func WithFileMetadata(xattrs bool) LayerOpt {
+	return func(l *Layer) {
+		l.withMetadata = true
+		l.withXattrs = xattrs
+	}
+}
+
+func readFileMetadata(fsys sysenv.FS, path string, info os.FileInfo, xattrs bool) (*FileMetadata, error) {
+	mode := info.Mode().Perm()
+	modTime := info.ModTime()
+	res := &FileMetadata{Mode: &mode, ModTime: &modTime}
+	if !xattrs {
+		return res, nil
+	}
+	xfs, ok := fsys.(sysenv.XattrFS)
+	if !ok {
+		return res, nil
+	}
+	attrs, err := xfs.ListXattrs(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read extended attributes of '%v': %w", path, err)
+	}
+	if len(attrs) > 0 {
+		res.Xattrs = attrs
+	}
+	return res, nil
+}
+
+func (m *FileMetadata) annotations() map[string]string {
+	res := make(map[string]string)
+	if m == nil {
+		return res
+	}
+	if m.Mode != nil {
+		res[FileModeAnnotationKey] = fmt.Sprintf("%04o", uint32(*m.Mode))
+	}
+	if m.ModTime != nil {
+		res[ModTimeAnnotationKey] = m.ModTime.UTC().Format(time.RFC3339Nano)
+	}
+	for k, v := range m.Xattrs {
+		res[XattrAnnotationPrefix+k] = base64.StdEncoding.EncodeToString(v)
+	}
+	return res
+}
+
+// parseFileMetadata returns nil if annotations do not describe any file metadata.
+func parseFileMetadata(annotations map[string]string) (*FileMetadata, error) {
+	var res *FileMetadata
+	get := func() *FileMetadata {
+		if res == nil {
+			res = &FileMetadata{}
+		}
+		return res
+	}
+	if s, ok := annotations[FileModeAnnotationKey]; ok {
+		v, err := strconv.ParseUint(s, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file mode '%v': %w", s, err)
+		}
+		mode := os.FileMode(v).Perm()
+		get().Mode = &mode
+	}
+	if s, ok := annotations[ModTimeAnnotationKey]; ok {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modification time '%v': %w", s, err)
+		}
+		get().ModTime = &t
+	}
+	for k, v := range annotations {
+		name, ok := strings.CutPrefix(k, XattrAnnotationPrefix)
+		if !ok {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of extended attribute '%v': %w", name, err)
+		}
+		m := get()
+		if m.Xattrs == nil {
+			m.Xattrs = make(map[string][]byte)
+		}
+		m.Xattrs[name] = value
+	}
+	return res, nil
+}
@@ -1,5 +1,7 @@
 package filesegment
 
+import "github.com/macvmio/geranos/pkg/sysenv"
+
 type LayerOpt func(*Layer)
 
 func WithRange(start, stop int64) LayerOpt {
@@ -9,8 +11,31 @@ func WithRange(start, stop int64) LayerOpt {
 	}
 }
 
+// WithFilename sets slash-separated path of the file relative to the image directory,
+// which is recorded in the filename annotation instead of the base name.
+func WithFilename(name string) LayerOpt {
+	return func(l *Layer) {
+		l.name = name
+	}
+}
+
 func WithLogFunction(log func(fmt string, args ...any)) LayerOpt {
 	return func(l *Layer) {
 		l.log = log
 	}
 }
+
+func WithFileSystem(fsys sysenv.FS) LayerOpt {
+	return func(l *Layer) {
+		l.fs = fsys
+	}
+}
+
+// resolveFileSystem returns the filesystem selected by opts, before the layer itself can be constructed.
+func resolveFileSystem(opts ...LayerOpt) sysenv.FS {
+	probe := &Layer{fs: sysenv.OS}
+	for _, o := range opts {
+		o(probe)
+	}
+	return probe.fs
+}
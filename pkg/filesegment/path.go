@@ -0,0 +1,45 @@
+package filesegment
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Filenames of segments are paths relative to the image directory, always separated by '/'.
+// Characters which could be mistaken for a separator on some platform are percent-escaped
+// in the filename annotation, so the annotation decodes to the same path everywhere.
+var filenameEscaper = strings.NewReplacer("%", "%25", "\\", "%5C")
+var filenameUnescaper = strings.NewReplacer("%25", "%", "%5C", "\\", "%5c", "\\")
+
+// EncodeFilename converts relative, slash-separated path into the form stored in the filename annotation.
+func EncodeFilename(name string) string {
+	return filenameEscaper.Replace(name)
+}
+
+// DecodeFilename reverses EncodeFilename. Unknown escape sequences are kept as they are,
+// so filenames of images created before escaping was introduced decode unchanged.
+func DecodeFilename(encoded string) string {
+	return filenameUnescaper.Replace(encoded)
+}
+
+// ValidateFilename rejects paths which would escape the image directory or cannot be represented on this platform.
+func ValidateFilename(name string) error {
+	if name == "" || name == "." || path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return fmt.Errorf("invalid filename '%v'", name)
+	}
+	if path.Clean(name) != name {
+		return fmt.Errorf("filename '%v' is not a clean relative path", name)
+	}
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return fmt.Errorf("filename '%v' points outside of the image directory", name)
+		}
+	}
+	if runtime.GOOS == "windows" && strings.ContainsAny(name, "\\:") {
+		return fmt.Errorf("filename '%v' cannot be represented on this platform", name)
+	}
+	return nil
+}
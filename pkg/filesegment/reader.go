@@ -3,21 +3,21 @@ package filesegment
 import (
 	"bufio"
 	"fmt"
+	"github.com/macvmio/geranos/pkg/sysenv"
 	"io"
-	"os"
 )
 
 type partialFileReader struct {
-	f *os.File
+	f sysenv.File
 	r *bufio.Reader
 }
 
-func newPartialFileReader(filepath string, start, stop int64) (*partialFileReader, error) {
+func newPartialFileReader(fsys sysenv.FS, filepath string, start, stop int64) (*partialFileReader, error) {
 	size := stop - start + 1
 	if size <= 0 {
 		return nil, fmt.Errorf("invalid range: start (%d) must be less than or equal to stop (%d)", start, stop)
 	}
-	f, err := os.Open(filepath)
+	f, err := fsys.Open(filepath)
 	if err != nil {
 		return nil, err
 	}
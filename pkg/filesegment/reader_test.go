@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/macvmio/geranos/pkg/sysenv"
 	"github.com/stretchr/testify/require"
 )
 
@@ -75,7 +76,7 @@ func TestPartialFileReader(t *testing.T) {
 		tc := tc // Capture range variable
 		t.Run(tc.name, func(t *testing.T) {
 			// Create a new partialFileReader
-			pfr, err := newPartialFileReader(filePath, tc.start, tc.stop)
+			pfr, err := newPartialFileReader(sysenv.OS, filePath, tc.start, tc.stop)
 			if tc.expectError {
 				require.Error(t, err, "Expected error for invalid range")
 				return
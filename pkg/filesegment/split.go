@@ -2,11 +2,10 @@ package filesegment
 
 import (
 	"fmt"
-	"os"
 )
 
 func Split(fullpath string, chunkSize int64, opt ...LayerOpt) ([]*Layer, error) {
-	f, err := os.Stat(fullpath)
+	f, err := resolveFileSystem(opt...).Stat(fullpath)
 	if err != nil {
 		return nil, fmt.Errorf("faild to stat file '%v': %w", fullpath, err)
 	}
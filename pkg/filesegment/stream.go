@@ -0,0 +1,58 @@
+package filesegment
+
+import (
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// DigestKnown reports whether Digest and Size return without reading the content, because they were
+// computed, restored or recorded by StreamCompressed already.
+func (pfl *Layer) DigestKnown() bool {
+	return pfl.digestKnown.Load() || (pfl.blobSource != nil && pfl.blobSource.DigestKnown())
+}
+
+// StreamCompressed returns reader of the compressed blob, which computes its digest and size on the way.
+// Once it is read to the end, Digest and Size return them without reading the content again, so the blob
+// can be uploaded before its digest is known.
+func (pfl *Layer) StreamCompressed() (io.ReadCloser, error) {
+	hasher, err := v1.Hasher(pfl.algorithm)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := pfl.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	return &digestingReader{layer: pfl, rc: rc, hasher: hasher}, nil
+}
+
+type digestingReader struct {
+	layer  *Layer
+	rc     io.ReadCloser
+	hasher hash.Hash
+	size   int64
+}
+
+func (dr *digestingReader) Read(p []byte) (int, error) {
+	n, err := dr.rc.Read(p)
+	dr.hasher.Write(p[:n])
+	dr.size += int64(n)
+	if errors.Is(err, io.EOF) {
+		pfl := dr.layer
+		pfl.compressedOnce.Do(func() {
+			pfl.hash = v1.Hash{Algorithm: pfl.algorithm, Hex: hex.EncodeToString(dr.hasher.Sum(nil))}
+			pfl.size = dr.size
+			pfl.digestKnown.Store(true)
+			pfl.log("%v: calculated compressed layer hash while streaming", pfl)
+		})
+	}
+	return n, err
+}
+
+func (dr *digestingReader) Close() error {
+	return dr.rc.Close()
+}
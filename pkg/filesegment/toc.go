@@ -0,0 +1,141 @@
+package filesegment
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/zstd"
+	"io"
+)
+
+// Annotations locating table of contents within a blob. The table of contents is geranos' own, modelled on
+// zstd:chunked but not compatible with it: segment payload is raw file content rather than a tar stream,
+// and there is no footer, so zstd:chunked and eStargz clients cannot use it and must not be told it is theirs.
+const (
+	TOCChecksumAnnotationKey = "online.jarosik.tomasz.geranos.toc.checksum"
+	TOCPositionAnnotationKey = "online.jarosik.tomasz.geranos.toc.position"
+)
+
+// tocManifestType is the type of JSON table of contents, as in zstd:chunked.
+const tocManifestType = 1
+
+type tocEntry struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size,omitempty"`
+	Offset      int64  `json:"offset"`
+	EndOffset   int64  `json:"endOffset"`
+	Digest      string `json:"digest,omitempty"`
+	ChunkOffset int64  `json:"chunkOffset,omitempty"`
+	ChunkSize   int64  `json:"chunkSize"`
+	ChunkDigest string `json:"chunkDigest"`
+}
+
+type toc struct {
+	Version int        `json:"version"`
+	Entries []tocEntry `json:"entries"`
+}
+
+// WithTOC makes the compressed layer end with table of contents in a skippable frame, located by TOC annotations.
+// Segment payload is raw file content, so the entry describes the segment as a chunk of the file. Only geranos
+// reads it, see TOCChecksumAnnotationKey.
+func WithTOC() LayerOpt {
+	return func(l *Layer) {
+		l.withTOC = true
+	}
+}
+
+// hashWithTOC compresses the segment once, recording where compressed data ends while hashing it, and then
+// hashes table of contents appended at that offset, so Digest, Size and TOC all come from a single pass.
+func (pfl *Layer) hashWithTOC() (v1.Hash, int64, error) {
+	diffID, err := pfl.DiffID()
+	if err != nil {
+		return v1.Hash{}, 0, err
+	}
+	if diffID == (v1.Hash{}) {
+		return v1.Hash{}, 0, fmt.Errorf("unable to calculate diffID of %v", pfl)
+	}
+	u, err := pfl.Uncompressed()
+	if err != nil {
+		return v1.Hash{}, 0, err
+	}
+	r := pfl.zstdCompress(u)
+	defer r.Close()
+	return computeHash(pfl.algorithm, &tocAppender{data: r, build: func(dataSize int64) ([]byte, error) {
+		return pfl.buildTOC(diffID, dataSize)
+	}})
+}
+
+// buildTOC returns skippable frame with table of contents of compressed data of dataSize bytes, and records
+// it with its annotations.
+func (pfl *Layer) buildTOC(diffID v1.Hash, dataSize int64) ([]byte, error) {
+	entryType := "reg"
+	if pfl.start > 0 {
+		entryType = "chunk"
+	}
+	raw, err := json.Marshal(toc{
+		Version: 1,
+		Entries: []tocEntry{{
+			Type:        entryType,
+			Name:        pfl.Filename(),
+			Size:        pfl.Length(),
+			Offset:      0,
+			EndOffset:   dataSize,
+			Digest:      diffID.String(),
+			ChunkOffset: pfl.start,
+			ChunkSize:   pfl.Length(),
+			ChunkDigest: diffID.String(),
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := zstd.Compress(raw)
+	if err != nil {
+		return nil, err
+	}
+	checksum, _, err := v1.SHA256(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	pfl.tocFrame = zstd.SkippableFrame(compressed)
+	pfl.tocAnnotations = map[string]string{
+		TOCChecksumAnnotationKey: checksum.String(),
+		// payload of skippable frame starts after its 8 bytes header
+		TOCPositionAnnotationKey: fmt.Sprintf("%d:%d:%d:%d", dataSize+8, len(compressed), len(raw), tocManifestType),
+	}
+	return pfl.tocFrame, nil
+}
+
+// tocAppender reads data, followed by table of contents built once it is known where data ends.
+type tocAppender struct {
+	data  io.Reader
+	size  int64
+	build func(dataSize int64) ([]byte, error)
+	toc   *bytes.Reader
+}
+
+func (ta *tocAppender) Read(p []byte) (int, error) {
+	if ta.toc == nil {
+		n, err := ta.data.Read(p)
+		ta.size += int64(n)
+		if err != io.EOF {
+			return n, err
+		}
+		frame, err := ta.build(ta.size)
+		if err != nil {
+			return n, err
+		}
+		ta.toc = bytes.NewReader(frame)
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return ta.toc.Read(p)
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,98 @@
+package filesegment
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	kzstd "github.com/klauspost/compress/zstd"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestLayer_TOC(t *testing.T) {
+	layer, err := NewLayer("testdata/disk.img", WithRange(10, 29), WithTOC())
+	require.NoError(t, err)
+
+	rc, err := layer.Compressed()
+	require.NoError(t, err)
+	blob, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+
+	// table of contents is in skippable frame, so decompressed content is unaffected
+	dec, err := kzstd.NewReader(bytes.NewReader(blob))
+	require.NoError(t, err)
+	defer dec.Close()
+	content, err := io.ReadAll(dec)
+	require.NoError(t, err)
+	file, err := os.ReadFile("testdata/disk.img")
+	require.NoError(t, err)
+	assert.Equal(t, file[10:30], content)
+
+	annotations := layer.Annotations()
+	var offset, length, uncompressedLength, manifestType int
+	_, err = fmt.Sscanf(annotations[TOCPositionAnnotationKey], "%d:%d:%d:%d", &offset, &length, &uncompressedLength, &manifestType)
+	require.NoError(t, err)
+	assert.Equal(t, 1, manifestType)
+	require.Equal(t, len(blob), offset+length)
+
+	compressedTOC := blob[offset : offset+length]
+	checksum, _, err := v1.SHA256(bytes.NewReader(compressedTOC))
+	require.NoError(t, err)
+	assert.Equal(t, checksum.String(), annotations[TOCChecksumAnnotationKey])
+
+	raw, err := dec.DecodeAll(compressedTOC, nil)
+	require.NoError(t, err)
+	assert.Len(t, raw, uncompressedLength)
+	var parsed toc
+	require.NoError(t, json.Unmarshal(raw, &parsed))
+	require.Len(t, parsed.Entries, 1)
+	diffID, err := layer.DiffID()
+	require.NoError(t, err)
+	assert.Equal(t, "chunk", parsed.Entries[0].Type)
+	assert.Equal(t, int64(10), parsed.Entries[0].ChunkOffset)
+	assert.Equal(t, int64(20), parsed.Entries[0].ChunkSize)
+	assert.Equal(t, diffID.String(), parsed.Entries[0].ChunkDigest)
+
+	size, err := layer.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(blob)), size)
+}
+
+// openCountingFS counts files opened.
+type openCountingFS struct {
+	sysenv.FS
+	opened int
+}
+
+func (ofs *openCountingFS) Open(name string) (sysenv.File, error) {
+	ofs.opened++
+	return ofs.FS.Open(name)
+}
+
+func TestLayer_TOCSinglePass(t *testing.T) {
+	opens := func(opts ...LayerOpt) int {
+		fsys := &openCountingFS{FS: sysenv.OS}
+		layer, err := NewLayer("testdata/disk.img", append(opts, WithFileSystem(fsys))...)
+		require.NoError(t, err)
+		// config of the image has DiffID of every layer, TOC includes it as well
+		_, err = layer.DiffID()
+		require.NoError(t, err)
+		_, err = layer.Digest()
+		require.NoError(t, err)
+		layer.Annotations()
+		rc, err := layer.Compressed()
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		return fsys.opened
+	}
+	// table of contents is built while hashing, not by compressing the segment once more
+	assert.Equal(t, opens(), opens(WithTOC()))
+}
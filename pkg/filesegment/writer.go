@@ -2,6 +2,7 @@ package filesegment
 
 import (
 	"fmt"
+	"github.com/macvmio/geranos/pkg/sysenv"
 	"io"
 	"os"
 	"path/filepath"
@@ -19,3 +20,18 @@ func NewWriter(dir string, d *Descriptor) (*os.File, error) {
 	}
 	return f, nil
 }
+
+// NewWriterFS works like NewWriter, but opens the file through provided filesystem.
+func NewWriterFS(fsys sysenv.FS, dir string, d *Descriptor) (sysenv.File, error) {
+	f, err := fsys.OpenFile(filepath.Join(dir, d.filename), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file '%v': %w", filepath.Join(dir, d.filename), err)
+	}
+
+	_, err = f.Seek(d.start, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error while seeking to position '%d': %w", d.start, err)
+	}
+	return f, nil
+}
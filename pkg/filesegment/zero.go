@@ -0,0 +1,95 @@
+package filesegment
+
+import (
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/sparsefile"
+	"io"
+	"sync"
+)
+
+// ZeroMediaType marks segment consisting only of zero bytes. Its blob is empty, so all such segments share
+// one descriptor digest regardless of their length, which is taken from the range annotation.
+const ZeroMediaType = MediaType + ".zero"
+
+// WithZeroDetection makes the layer check its content while computing DiffID, and turn into a zero segment
+// (see ZeroMediaType) when all bytes are zero, instead of compressing and uploading them.
+func WithZeroDetection() LayerOpt {
+	return func(l *Layer) {
+		l.detectZero = true
+	}
+}
+
+// IsZero reports whether layer was detected to contain only zeros. It is known only after DiffID was computed.
+func (pfl *Layer) IsZero() bool {
+	if !pfl.detectZero {
+		return false
+	}
+	_, _ = pfl.DiffID()
+	return pfl.zero
+}
+
+// zeroChecker passes data through while remembering whether any non-zero byte was seen.
+type zeroChecker struct {
+	r       io.Reader
+	nonZero bool
+}
+
+func (zc *zeroChecker) Read(p []byte) (int, error) {
+	n, err := zc.r.Read(p)
+	if !zc.nonZero {
+		zc.nonZero = !sparsefile.IsZero(p[:n])
+	}
+	return n, err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// Zeros returns reader of length zero bytes, used to materialize zero segments without downloading anything.
+func Zeros(length int64) io.ReadCloser {
+	return io.NopCloser(io.LimitReader(zeroReader{}, length))
+}
+
+var zeroDiffIDs sync.Map
+
+// ZeroDiffID returns DiffID of segment of given length consisting only of zeros. Results are cached,
+// as images typically have many segments of the same length.
+func ZeroDiffID(length int64) (v1.Hash, error) {
+	if h, ok := zeroDiffIDs.Load(length); ok {
+		return h.(v1.Hash), nil
+	}
+	h, _, err := v1.SHA256(io.LimitReader(zeroReader{}, length))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	zeroDiffIDs.Store(length, h)
+	return h, nil
+}
+
+// zeroHash returns hash of length zero bytes with given algorithm.
+func zeroHash(algorithm string, length int64) (v1.Hash, error) {
+	if algorithm == DefaultDigestAlgorithm {
+		return ZeroDiffID(length)
+	}
+	h, _, err := computeHash(algorithm, io.LimitReader(zeroReader{}, length))
+	return h, err
+}
+
+// inHole reports whether the whole range of the layer is a hole of a sparse file, so it is known to be zero
+// without reading it. Any error is left to reading the content.
+func (pfl *Layer) inHole() bool {
+	f, err := pfl.fs.Open(pfl.filePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.Size() <= pfl.stop {
+		return false
+	}
+	hole, err := sparsefile.IsHole(f, pfl.start, pfl.stop+1)
+	return err == nil && hole
+}
@@ -0,0 +1,46 @@
+package layout
+
+import (
+	"errors"
+	"github.com/google/go-containerregistry/pkg/name"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// AccessFilename is the hidden file of image directory whose modification time tells when geranos last used
+// the image. Files starting with a dot are not part of images, so it is never pushed.
+const AccessFilename = ".geranos-access"
+
+// touch records that image in dir was used just now. Last access is only a hint for Prune,
+// so failing to record it is ignored.
+func (lm *Mapper) touch(dir string) {
+	path := filepath.Join(dir, AccessFilename)
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); errors.Is(err, os.ErrNotExist) {
+		if f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o644); err == nil {
+			_ = f.Close()
+		}
+	}
+}
+
+// LastAccess returns when the image of ref was last written, read, cloned or rehashed. For images
+// not used since access is tracked, modification time of their directory is returned instead.
+func (lm *Mapper) LastAccess(ref name.Reference) (time.Time, error) {
+	ref, err := lm.Resolve(ref)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return lastAccess(lm.refToDir(ref))
+}
+
+func lastAccess(dir string) (time.Time, error) {
+	if info, err := os.Stat(filepath.Join(dir, AccessFilename)); err == nil {
+		return info.ModTime(), nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
@@ -0,0 +1,213 @@
+package layout
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/digestdb"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/sketch"
+	"os"
+	"path/filepath"
+)
+
+// ErrImageNotFound is returned when no local image matches a digest reference.
+var ErrImageNotFound = errors.New("image not found")
+
+// Resolve returns reference of the local image ref refers to. Digest references, like repo@sha256:...,
+// refer to an image of the same repository whose manifest has that digest, as recorded in the digest database,
+// unless an image was stored under the digest reference itself, e.g. when it was pulled by digest.
+// Other references are returned as they are.
+func (lm *Mapper) Resolve(ref name.Reference) (name.Reference, error) {
+	refs, err := lm.resolveAll(ref)
+	if err != nil {
+		return nil, err
+	}
+	return refs[0], nil
+}
+
+// resolveAll is Resolve returning all images a digest reference refers to, sorted by their directories.
+func (lm *Mapper) resolveAll(ref name.Reference) ([]name.Reference, error) {
+	digest, ok := ref.(name.Digest)
+	if !ok {
+		return []name.Reference{ref}, nil
+	}
+	if info, err := os.Stat(lm.refToDir(ref)); err == nil && info.IsDir() {
+		return []name.Reference{ref}, nil
+	}
+	h, err := v1.NewHash(digest.DigestStr())
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest of %v: %w", ref, err)
+	}
+	db, err := lm.DigestDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	dirs, err := db.ImagesWithManifest(h)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up digest database: %w", err)
+	}
+	res := make([]name.Reference, 0)
+	for _, dir := range dirs {
+		r, err := lm.dirToRef(dir)
+		if err != nil || r.Context().String() != digest.Context().String() {
+			continue
+		}
+		res = append(res, r)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("%w: no local image of %v has digest %v", ErrImageNotFound, digest.Context(), digest.DigestStr())
+	}
+	return res, nil
+}
+
+// DigestDB opens the digest database of the root directory, after bringing it up to date with local images.
+// It tells where each segment is kept and which images reference it. The database has to be closed.
+func (lm *Mapper) DigestDB() (*digestdb.DB, error) {
+	images, err := lm.imageDirs()
+	if err != nil {
+		return nil, err
+	}
+	return lm.openDigestDB(images)
+}
+
+// openDigestDB opens the digest database and records images, which have to be all local images.
+func (lm *Mapper) openDigestDB(images []string) (*digestdb.DB, error) {
+	db, err := digestdb.Open(lm.rootDir, filepath.Join(lm.rootDir, sketch.IndexDirectory))
+	if err != nil {
+		return nil, err
+	}
+	if err := lm.syncDigestDB(db, images); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// syncDigestDB records images in db and forgets images which no longer exist. Only images whose manifests
+// changed since they were recorded are read, updateIndex records them as they are written, so it is mostly
+// about changes made by other tools.
+func (lm *Mapper) syncDigestDB(db *digestdb.DB, images []string) error {
+	recorded, err := db.Images()
+	if err != nil {
+		return fmt.Errorf("unable to list images of digest database: %w", err)
+	}
+	current := make(map[string]struct{}, len(images))
+	for _, dir := range images {
+		current[dir] = struct{}{}
+		if err := recordImage(db, dir); err != nil {
+			return err
+		}
+	}
+	for _, dir := range recorded {
+		if _, ok := current[dir]; !ok {
+			if err := db.Delete(dir); err != nil {
+				return fmt.Errorf("unable to update digest database: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// recordImage updates record of image in dir, unless its manifest did not change since it was recorded.
+// Directories without manifest, like adopted or removed images, are forgotten.
+func recordImage(db *digestdb.DB, dir string) error {
+	manifestPath := filepath.Join(dir, dirimage.LocalManifestFilename)
+	info, err := os.Stat(manifestPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return db.Delete(dir)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to stat manifest of '%v': %w", dir, err)
+	}
+	recorded, err := db.Image(dir)
+	if err != nil {
+		return err
+	}
+	if recorded != nil && recorded.ModTime == info.ModTime().UnixNano() && recorded.Size == info.Size() {
+		return nil
+	}
+	img, err := readImageRecord(dir, info)
+	if err != nil {
+		// references of the image cannot be told, so no decision should be made without them
+		return fmt.Errorf("unable to read image '%v': %w", dir, err)
+	}
+	if err := db.Put(img); err != nil {
+		return fmt.Errorf("unable to update digest database: %w", err)
+	}
+	return nil
+}
+
+// readImageRecord makes record of image in dir out of its manifest, described by info, and its config.
+// Images without config are recorded without diff IDs.
+func readImageRecord(dir string, info os.FileInfo) (*digestdb.Image, error) {
+	data, err := os.ReadFile(filepath.Join(dir, dirimage.LocalManifestFilename))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read manifest: %w", err)
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse manifest: %w", err)
+	}
+	manifestDigest, _, err := v1.SHA256(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	diffIDs := make([]v1.Hash, len(manifest.Layers))
+	configFile, err := os.Open(filepath.Join(dir, dirimage.LocalConfigFilename))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("unable to open config: %w", err)
+	}
+	if err == nil {
+		defer configFile.Close()
+		config, err := v1.ParseConfigFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse config: %w", err)
+		}
+		diffIDs = config.RootFS.DiffIDs
+	}
+	descriptors, err := segments(manifest, diffIDs)
+	if err != nil {
+		return nil, err
+	}
+	img := &digestdb.Image{
+		Directory:      dir,
+		ManifestDigest: manifestDigest,
+		ModTime:        info.ModTime().UnixNano(),
+		Size:           info.Size(),
+		Segments:       make([]digestdb.Segment, 0, len(descriptors)),
+	}
+	for _, d := range descriptors {
+		img.Segments = append(img.Segments, digestdb.Segment{
+			Digest: d.Digest(),
+			DiffID: d.DiffID(),
+			File:   d.Filename(),
+			Start:  d.Start(),
+			Stop:   d.Stop(),
+		})
+	}
+	return img, nil
+}
+
+// updateDigestDB records images in dirs after they were changed. The database is created by DigestDB,
+// until then there is nothing to update.
+func (lm *Mapper) updateDigestDB(dirs ...string) error {
+	indexDir := filepath.Join(lm.rootDir, sketch.IndexDirectory)
+	if _, err := os.Stat(filepath.Join(indexDir, digestdb.Filename)); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	db, err := digestdb.Open(lm.rootDir, indexDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, dir := range dirs {
+		if err := recordImage(db, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
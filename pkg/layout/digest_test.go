@@ -0,0 +1,97 @@
+package layout
+
+import (
+	"bytes"
+	"context"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayoutMapper_Resolve(t *testing.T) {
+	ctx := context.Background()
+	lm := NewMapper(t.TempDir())
+	src := mustParseRef(t, "oci.jarosik.online/testrepo/a:v1")
+	require.NoError(t, os.MkdirAll(lm.refToDir(src), os.ModePerm))
+	require.NoError(t, generateRandomFile(filepath.Join(lm.refToDir(src), "disk.img"), 1024))
+	require.NoError(t, lm.Rehash(ctx, src))
+	tagged := mustParseRef(t, "oci.jarosik.online/testrepo/a:latest")
+	_, err := lm.Tag(ctx, src, tagged)
+	require.NoError(t, err)
+
+	props, err := lm.List()
+	require.NoError(t, err)
+	require.Len(t, props, 2)
+	digest := props[0].Digest
+	assert.Equal(t, digest, props[1].Digest)
+	byDigest, err := name.NewDigest("oci.jarosik.online/testrepo/a@"+digest.String(), name.StrictValidation)
+	require.NoError(t, err)
+
+	resolved, err := lm.Resolve(byDigest)
+	require.NoError(t, err)
+	assert.Equal(t, "oci.jarosik.online/testrepo/a:latest", resolved.String())
+	_, err = lm.Read(ctx, byDigest)
+	require.NoError(t, err)
+	_, err = lm.Verify(ctx, byDigest)
+	require.NoError(t, err)
+	clone := mustParseRef(t, "oci.jarosik.online/testrepo/b:v1")
+	require.NoError(t, lm.Clone(ctx, byDigest, clone))
+	assert.FileExists(t, filepath.Join(lm.refToDir(clone), "disk.img"))
+
+	t.Run("other repository does not match", func(t *testing.T) {
+		other, err := name.NewDigest("oci.jarosik.online/testrepo/c@"+digest.String(), name.StrictValidation)
+		require.NoError(t, err)
+		_, err = lm.Resolve(other)
+		assert.ErrorIs(t, err, ErrImageNotFound)
+	})
+
+	t.Run("remove by digest removes all tags with it", func(t *testing.T) {
+		require.NoError(t, lm.Remove(byDigest))
+		assert.NoDirExists(t, lm.refToDir(src))
+		assert.NoDirExists(t, lm.refToDir(tagged))
+		assert.DirExists(t, lm.refToDir(clone))
+	})
+}
+
+func TestLayoutMapper_DigestDB(t *testing.T) {
+	ctx := context.Background()
+	lm := NewMapper(t.TempDir())
+	createDigestDB(t, lm)
+	a, b := mustParseRef(t, "oci.jarosik.online/testrepo/a:v1"), mustParseRef(t, "oci.jarosik.online/testrepo/b:v1")
+	for _, ref := range []name.Reference{a, b} {
+		require.NoError(t, os.MkdirAll(lm.refToDir(ref), os.ModePerm))
+		require.NoError(t, generateRandomFile(filepath.Join(lm.refToDir(ref), "disk.img"), 1024))
+		require.NoError(t, lm.Rehash(ctx, ref))
+	}
+	require.Equal(t, []string{lm.refToDir(a), lm.refToDir(b)}, recordedImages(t, lm))
+
+	// changes made behind its back are picked up when the database is opened
+	require.NoError(t, os.RemoveAll(lm.refToDir(a)))
+	manifest, err := os.ReadFile(filepath.Join(lm.refToDir(b), dirimage.LocalManifestFilename))
+	require.NoError(t, err)
+	manifestDigest, _, err := v1.SHA256(bytes.NewReader(manifest))
+	require.NoError(t, err)
+	c := mustParseRef(t, "oci.jarosik.online/testrepo/c:v1")
+	require.NoError(t, os.CopyFS(lm.refToDir(c), os.DirFS(lm.refToDir(b))))
+
+	db, err := lm.DigestDB()
+	require.NoError(t, err)
+	defer db.Close()
+	images, err := db.Images()
+	require.NoError(t, err)
+	assert.Equal(t, []string{lm.refToDir(b), lm.refToDir(c)}, images)
+	dirs, err := db.ImagesWithManifest(manifestDigest)
+	require.NoError(t, err)
+	assert.Equal(t, []string{lm.refToDir(b), lm.refToDir(c)}, dirs)
+	img, err := db.Image(lm.refToDir(c))
+	require.NoError(t, err)
+	require.NotEmpty(t, img.Segments)
+	refs, err := db.References(img.Segments[0].DiffID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{lm.refToDir(b), lm.refToDir(c)}, refs)
+}
@@ -0,0 +1,37 @@
+package layout
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/macvmio/geranos/pkg/duplicator"
+	"os"
+)
+
+// metadataPattern matches files geranos keeps in image directories, like the manifest and config, and never
+// their content, as files starting with a dot are not part of images.
+const metadataPattern = ".*"
+
+// Export clones files of local image of ref into dir, outside the root directory, leaving out the manifest,
+// config and other metadata files, so tools confused by them get a plain bundle. dir must not exist or be
+// empty, and files are copied when it is on another filesystem.
+func (lm *Mapper) Export(ctx context.Context, ref name.Reference, dir string, opt ...duplicator.Option) error {
+	ref, err := lm.Resolve(ref)
+	if err != nil {
+		return err
+	}
+	srcDir := lm.refToDir(ref)
+	if info, err := os.Stat(srcDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("image %v not found", ref)
+	}
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("directory '%v' is not empty", dir)
+	}
+	defer lm.touch(srcDir)
+	opt = append([]duplicator.Option{duplicator.WithCloner(lm.cloner), lm.reportCloned()}, opt...)
+	opt = append(opt, duplicator.WithFileFilter(nil, []string{metadataPattern}))
+	if err := duplicator.CloneDirectory(ctx, srcDir, dir, true, opt...); err != nil {
+		return fmt.Errorf("unable to export %v to '%v': %w", ref, dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package layout
+
+import (
+	"context"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayoutMapper_Export(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	lm := NewMapper(filepath.Join(tempDir, "images"))
+	ref := mustParseRef(t, "oci.jarosik.online/testrepo/a:v1")
+	imageDir := lm.refToDir(ref)
+	require.NoError(t, os.MkdirAll(filepath.Join(imageDir, "nvram"), os.ModePerm))
+	require.NoError(t, generateRandomFile(filepath.Join(imageDir, "disk.img"), 1024))
+	require.NoError(t, generateRandomFile(filepath.Join(imageDir, "nvram", "efi.bin"), 64))
+	require.NoError(t, lm.Rehash(ctx, ref))
+
+	dst := filepath.Join(tempDir, "bundle")
+	require.NoError(t, lm.Export(ctx, ref, dst))
+	assert.FileExists(t, filepath.Join(dst, "disk.img"))
+	assert.FileExists(t, filepath.Join(dst, "nvram", "efi.bin"))
+	assert.NoFileExists(t, filepath.Join(dst, dirimage.LocalManifestFilename))
+	assert.NoFileExists(t, filepath.Join(dst, dirimage.LocalConfigFilename))
+	assert.NoFileExists(t, filepath.Join(dst, AccessFilename))
+
+	assert.Error(t, lm.Export(ctx, ref, dst), "non-empty directory is not overwritten")
+}
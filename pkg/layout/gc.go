@@ -0,0 +1,193 @@
+package layout
+
+import (
+	"fmt"
+	"github.com/macvmio/geranos/pkg/sketch"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultGCGracePeriod is how old temporary files and directories must be before CollectGarbage removes them,
+// so files of operations still running are left alone.
+const DefaultGCGracePeriod = time.Hour
+
+// Garbage is a file or directory of the root directory CollectGarbage removes.
+type Garbage struct {
+	Path   string
+	Reason string
+	// Size is the apparent size of the content, space shared with reflinks is reclaimed only with its last user
+	Size int64
+}
+
+// CollectGarbage removes what no image needs: directories which are neither images nor contain any,
+// staging directories and temporary files older than gracePeriod left by interrupted operations,
+// and with the content store, blobs older than gracePeriod no image with manifest references.
+// With dryRun nothing is removed.
+// It returns the garbage found, sorted by path.
+func (lm *Mapper) CollectGarbage(dryRun bool, gracePeriod time.Duration) ([]Garbage, error) {
+	garbage, err := lm.findGarbage(time.Now().Add(-gracePeriod))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(garbage, func(i, j int) bool {
+		return garbage[i].Path < garbage[j].Path
+	})
+	if dryRun {
+		return garbage, nil
+	}
+	for _, g := range garbage {
+		if err := os.RemoveAll(g.Path); err != nil {
+			return nil, fmt.Errorf("unable to remove '%v': %w", g.Path, err)
+		}
+	}
+	return garbage, nil
+}
+
+// imageDirs returns directories of all local images, with manifest or not.
+func (lm *Mapper) imageDirs() ([]string, error) {
+	images := make([]string, 0)
+	err := filepath.WalkDir(lm.rootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || path == lm.rootDir {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if _, err := lm.dirToRef(path); err == nil {
+			images = append(images, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list images: %w", err)
+	}
+	return images, nil
+}
+
+func (lm *Mapper) findGarbage(cutoff time.Time) ([]Garbage, error) {
+	images, err := lm.imageDirs()
+	if err != nil {
+		return nil, err
+	}
+	containsImage := func(dir string) bool {
+		for _, img := range images {
+			if strings.HasPrefix(img, dir+string(filepath.Separator)) {
+				return true
+			}
+		}
+		return false
+	}
+	stale := func(path string) bool {
+		info, err := os.Lstat(path)
+		return err == nil && info.ModTime().Before(cutoff)
+	}
+
+	res := make([]Garbage, 0)
+	add := func(path string, reason string) {
+		size, err := directorySize(path)
+		if err != nil {
+			size = 0
+		}
+		res = append(res, Garbage{Path: path, Reason: reason, Size: size})
+	}
+	// temporary files of geranos start with a dot, files of images never do, except in the index directory
+	addTemporary := func(dir string, anyName bool) error {
+		return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if (anyName || strings.HasPrefix(d.Name(), ".")) && strings.HasSuffix(d.Name(), ".tmp") && stale(path) {
+				add(path, "temporary file")
+			}
+			return nil
+		})
+	}
+	err = filepath.WalkDir(lm.rootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == lm.rootDir {
+			return nil
+		}
+		if !d.IsDir() {
+			if strings.HasPrefix(d.Name(), ".") && strings.HasSuffix(d.Name(), ".tmp") && stale(path) {
+				add(path, "temporary file")
+			}
+			return nil
+		}
+		if lm.isIndexDir(path) {
+			// content store and index of the root directory, only their temporary files are garbage
+			return skipDir(addTemporary(path, true))
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if (strings.Contains(d.Name(), ".staging-") || strings.Contains(d.Name(), ".old-")) && stale(path) {
+				add(path, "staging directory")
+			}
+			return filepath.SkipDir
+		}
+		if _, err := lm.dirToRef(path); err == nil {
+			// directories within the image are its content, whatever their names
+			return skipDir(addTemporary(path, false))
+		}
+		if containsImage(path) {
+			return nil
+		}
+		add(path, "not an image")
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to look for garbage: %w", err)
+	}
+
+	blobs, err := lm.unreferencedBlobs(images, stale)
+	if err != nil {
+		return nil, err
+	}
+	return append(res, blobs...), nil
+}
+
+// skipDir returns err, or filepath.SkipDir when there is none.
+func skipDir(err error) error {
+	if err != nil {
+		return err
+	}
+	return filepath.SkipDir
+}
+
+// isIndexDir reports whether path is within sketch.IndexDirectory of the root directory.
+func (lm *Mapper) isIndexDir(path string) bool {
+	rel, err := filepath.Rel(filepath.Join(lm.rootDir, sketch.IndexDirectory), path)
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
+
+// unreferencedBlobs returns stale blobs of the content store which no image with manifest references,
+// as recorded in the digest database. Images without manifest, like adopted ones, are not in the store anyway.
+// Blobs which are not stale may belong to images being pulled, not yet moved out of their staging directories.
+func (lm *Mapper) unreferencedBlobs(images []string, stale func(path string) bool) ([]Garbage, error) {
+	store := lm.ContentStore()
+	if store == nil {
+		return nil, nil
+	}
+	db, err := lm.openDigestDB(images)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	blobs, err := store.Blobs()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Garbage, 0)
+	for _, b := range blobs {
+		refs, err := db.References(b.DiffID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to look up digest database: %w", err)
+		}
+		if len(refs) == 0 && stale(b.Path) {
+			res = append(res, Garbage{Path: b.Path, Reason: "unreferenced blob", Size: b.Size})
+		}
+	}
+	return res, nil
+}
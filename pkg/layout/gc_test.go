@@ -0,0 +1,127 @@
+package layout
+
+import (
+	"context"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLayoutMapper_CollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	repoDir := filepath.Join(tempDir, "oci.jarosik.online", "testrepo")
+	imageDir := portableFilepath(filepath.Join(repoDir, "a:v1"))
+	adoptedDir := portableFilepath(filepath.Join(repoDir, "b:v1"))
+	old := time.Now().Add(-2 * DefaultGCGracePeriod)
+	mkdir := func(path string) string {
+		require.NoError(t, os.MkdirAll(path, os.ModePerm))
+		return path
+	}
+	writeFile := func(path string, size int64, modTime time.Time) string {
+		require.NoError(t, generateRandomFile(path, size))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+		return path
+	}
+	mkdir(imageDir)
+	mkdir(adoptedDir)
+	writeFile(filepath.Join(imageDir, "disk.img"), 100, time.Now())
+	// nested directories are content of the image too
+	mkdir(filepath.Join(imageDir, "Contents", "Resources"))
+	writeFile(filepath.Join(imageDir, "Contents", "Resources", "nvram.bin"), 30, time.Now())
+	// files of images are kept, whatever their names
+	writeFile(filepath.Join(imageDir, "disk.tmp"), 100, old)
+	writeFile(filepath.Join(adoptedDir, "disk.img"), 100, time.Now())
+
+	lm := NewMapper(tempDir, dirimage.WithChunkSize(10), dirimage.WithRecursive(true))
+	require.NoError(t, lm.EnableContentStore())
+	require.NoError(t, lm.Rehash(ctx, mustParseRef(t, "oci.jarosik.online/testrepo/a:v1")))
+
+	emptyDir := mkdir(filepath.Join(repoDir, "empty"))
+	staleStaging := mkdir(portableFilepath(filepath.Join(repoDir, ".a:v1.staging-1")))
+	writeFile(filepath.Join(staleStaging, "disk.img"), 50, time.Now())
+	require.NoError(t, os.Chtimes(staleStaging, old, old))
+	mkdir(portableFilepath(filepath.Join(repoDir, ".a:v1.staging-2")))
+	staleTmp := writeFile(filepath.Join(imageDir, ".oci.resume.json.tmp"), 10, old)
+	writeFile(filepath.Join(imageDir, ".oci.resume.json.tmp2"), 10, old)
+	unreferenced := lm.ContentStore().BlobPath(v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("0", 64)})
+	writeFile(unreferenced, 20, old)
+	// blob of an image being pulled, still in its staging directory
+	pulled := lm.ContentStore().BlobPath(v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("1", 64)})
+	writeFile(pulled, 20, time.Now())
+
+	expected := []Garbage{
+		{Path: staleStaging, Reason: "staging directory", Size: 50},
+		{Path: staleTmp, Reason: "temporary file", Size: 10},
+		{Path: emptyDir, Reason: "not an image", Size: 0},
+		{Path: unreferenced, Reason: "unreferenced blob", Size: 20},
+	}
+	expectedPaths := func(garbage []Garbage) []string {
+		res := make([]string, 0)
+		for _, g := range garbage {
+			res = append(res, g.Path)
+		}
+		return res
+	}
+
+	garbage, err := lm.CollectGarbage(true, DefaultGCGracePeriod)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, expected, garbage)
+	for _, p := range expectedPaths(expected) {
+		_, err := os.Stat(p)
+		assert.NoError(t, err)
+	}
+
+	garbage, err = lm.CollectGarbage(false, DefaultGCGracePeriod)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, expected, garbage)
+	for _, p := range expectedPaths(expected) {
+		_, err := os.Stat(p)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+	blobs, err := lm.ContentStore().Blobs()
+	require.NoError(t, err)
+	assert.Len(t, blobs, 24)
+	assert.FileExists(t, pulled)
+	assert.FileExists(t, filepath.Join(imageDir, "disk.tmp"))
+	assert.FileExists(t, filepath.Join(imageDir, "Contents", "Resources", "nvram.bin"))
+	assert.FileExists(t, filepath.Join(adoptedDir, "disk.img"))
+
+	garbage, err = lm.CollectGarbage(false, DefaultGCGracePeriod)
+	require.NoError(t, err)
+	assert.Empty(t, garbage)
+}
+
+func TestLayoutMapper_CollectGarbageUnreadableImage(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	imageDir := portableFilepath(filepath.Join(tempDir, "oci.jarosik.online", "testrepo", "a:v1"))
+	require.NoError(t, os.MkdirAll(imageDir, os.ModePerm))
+	require.NoError(t, generateRandomFile(filepath.Join(imageDir, "disk.img"), 100))
+
+	lm := NewMapper(tempDir, dirimage.WithChunkSize(10))
+	require.NoError(t, lm.EnableContentStore())
+	require.NoError(t, lm.Rehash(ctx, mustParseRef(t, "oci.jarosik.online/testrepo/a:v1")))
+	old := time.Now().Add(-2 * DefaultGCGracePeriod)
+	blobs, err := lm.ContentStore().Blobs()
+	require.NoError(t, err)
+	for _, b := range blobs {
+		require.NoError(t, os.Chtimes(b.Path, old, old))
+	}
+	// image changed since it was recorded, so it has to be read again
+	require.NoError(t, os.WriteFile(filepath.Join(imageDir, dirimage.LocalConfigFilename), []byte("{"), 0o644))
+	changed := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(filepath.Join(imageDir, dirimage.LocalManifestFilename), changed, changed))
+
+	_, err = lm.CollectGarbage(false, DefaultGCGracePeriod)
+	require.ErrorContains(t, err, "unable to read image")
+	after, err := lm.ContentStore().Blobs()
+	require.NoError(t, err)
+	assert.Len(t, after, len(blobs))
+}
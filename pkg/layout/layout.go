@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/cas"
 	"github.com/macvmio/geranos/pkg/dirimage"
 	"github.com/macvmio/geranos/pkg/duplicator"
+	"github.com/macvmio/geranos/pkg/filesegment"
 	"github.com/macvmio/geranos/pkg/sketch"
 	"io/fs"
 	"os"
@@ -19,8 +21,11 @@ import (
 const OSWindows = "windows"
 
 type Mapper struct {
-	rootDir  string
-	sketcher *sketch.Sketcher
+	rootDir        string
+	sketcher       *sketch.Sketcher
+	cloner         *duplicator.Cloner
+	store          *cas.Store
+	candidateRoots []string
 
 	opts  []dirimage.Option
 	stats Statistics
@@ -33,11 +38,96 @@ type Layout struct {
 }
 
 func NewMapper(rootDir string, opts ...dirimage.Option) *Mapper {
-	return &Mapper{
-		rootDir:  rootDir,
-		sketcher: sketch.NewSketcher(rootDir, dirimage.LocalManifestFilename),
-		opts:     opts,
+	lm := &Mapper{
+		rootDir: rootDir,
+		cloner:  duplicator.NewCloner(),
+		store:   cas.NewStore(filepath.Join(rootDir, sketch.IndexDirectory, ContentStoreDirectory)),
+		opts:    opts,
 	}
+	lm.sketcher = lm.newSketcher()
+	return lm
+}
+
+func (lm *Mapper) newSketcher() *sketch.Sketcher {
+	reportCloned := func(filename string, fileBytesCloned int64, fileSize int64, bytesCloned int64, bytesTotal int64) {
+		dirimage.ReportProgress(dirimage.ProgressUpdate{
+			BytesProcessed:     bytesCloned,
+			BytesTotal:         bytesTotal,
+			Phase:              dirimage.PhaseCloning,
+			Filename:           filename,
+			FileBytesProcessed: fileBytesCloned,
+			FileBytesTotal:     fileSize,
+		}, lm.opts...)
+	}
+	return sketch.NewSketcher(lm.rootDir, dirimage.LocalManifestFilename,
+		sketch.WithProgressFunction(reportCloned), sketch.WithCloner(lm.cloner), sketch.WithCandidateIndex(true),
+		sketch.WithCandidateRoots(lm.candidateRoots...))
+}
+
+// AddCandidateRoots makes images of other root directories, like other stores, clone candidates of images
+// written to the root directory. The root directory itself is ignored, so all stores can be given.
+func (lm *Mapper) AddCandidateRoots(dirs ...string) {
+	for _, dir := range dirs {
+		if filepath.Clean(dir) != filepath.Clean(lm.rootDir) {
+			lm.candidateRoots = append(lm.candidateRoots, dir)
+		}
+	}
+	lm.sketcher = lm.newSketcher()
+}
+
+// ContentStoreDirectory is the directory of the content store within sketch.IndexDirectory of the root directory.
+const ContentStoreDirectory = "cas"
+
+// EnableContentStore creates the content store of the root directory. Once it exists, segments of every
+// written or rehashed image are kept in it once, and files of written images are materialized from it
+// before sketching, so tags sharing content share it even when the clone heuristic would not find it.
+func (lm *Mapper) EnableContentStore() error {
+	return lm.store.Init()
+}
+
+// ContentStore returns the content store of the root directory, nil unless it was enabled.
+func (lm *Mapper) ContentStore() *cas.Store {
+	if !lm.store.Exists() {
+		return nil
+	}
+	return lm.store
+}
+
+// segments returns descriptors of all layers of manifest, with their diff IDs.
+func segments(manifest *v1.Manifest, diffIDs []v1.Hash) ([]*filesegment.Descriptor, error) {
+	if len(diffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("mismatch between diffIDs (%d) and manifest layers (%d)", len(diffIDs), len(manifest.Layers))
+	}
+	res := make([]*filesegment.Descriptor, 0, len(manifest.Layers))
+	for i, l := range manifest.Layers {
+		d, err := filesegment.ParseDescriptor(l, diffIDs[i])
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse descriptor: %w", err)
+		}
+		res = append(res, d)
+	}
+	return res, nil
+}
+
+// ingest adds segments of image in dir to the content store, when it is enabled.
+func (lm *Mapper) ingest(dir string, manifest *v1.Manifest, diffIDs []v1.Hash) error {
+	store := lm.ContentStore()
+	if store == nil {
+		return nil
+	}
+	descriptors, err := segments(manifest, diffIDs)
+	if err != nil {
+		return err
+	}
+	if _, err := store.Ingest(dir, descriptors); err != nil {
+		return fmt.Errorf("unable to add '%v' to content store: %w", dir, err)
+	}
+	return nil
+}
+
+// Dir returns directory of image ref.
+func (lm *Mapper) Dir(ref name.Reference) string {
+	return lm.refToDir(ref)
 }
 
 func (lm *Mapper) refToDir(ref name.Reference) string {
@@ -67,6 +157,8 @@ func (lm *Mapper) WriteIfNotPresent(ctx context.Context, img v1.Image, ref name.
 		localDigest, err := localImg.Digest()
 		if err == nil && localDigest == originalDigest {
 			fmt.Println("skipped writing because digests are the same")
+			lm.touch(lm.refToDir(ref))
+			lm.updateIndex(lm.refToDir(ref))
 			return nil
 		}
 	}
@@ -78,10 +170,13 @@ func (lm *Mapper) Write(ctx context.Context, img v1.Image, ref name.Reference) e
 		return errors.New("nil image provided")
 	}
 	destinationDir := lm.refToDir(ref)
-	err := os.MkdirAll(destinationDir, 0o777)
+	// the image directory itself is created by Write, in place or by swapping staging directory into place
+	err := os.MkdirAll(filepath.Dir(destinationDir), 0o777)
 	if err != nil {
 		return fmt.Errorf("unable to create directory for writing: %w", err)
 	}
+	defer lm.updateIndex(destinationDir)
+	defer lm.touch(destinationDir)
 
 	manifest, err := img.Manifest()
 	if err != nil {
@@ -104,35 +199,141 @@ func (lm *Mapper) Write(ctx context.Context, img v1.Image, ref name.Reference) e
 		lm.stats.Add(&st)
 	}
 
-	bytesClonedCount, matchedSegmentsCount, err := lm.sketcher.Sketch(destinationDir, *manifest, diffIDs)
+	// content is materialized and cloned into the directory being written, which is the staging directory
+	// of staged write, so the destination never holds a partial image
+	prepare := func(dir string) ([]dirimage.Option, error) {
+		if store := lm.ContentStore(); store != nil {
+			descriptors, err := segments(manifest, diffIDs)
+			if err != nil {
+				return nil, err
+			}
+			bytesMaterialized, err := store.Materialize(dir, descriptors)
+			if err != nil {
+				return nil, fmt.Errorf("unable to materialize from content store: %w", err)
+			}
+			st := Statistics{}
+			st.BytesClonedCount.Store(bytesMaterialized)
+			lm.stats.Add(&st)
+		}
+
+		bytesClonedCount, matchedSegmentsCount, identicalFiles, err := lm.sketcher.Sketch(dir, *manifest, diffIDs)
+		if err != nil {
+			return nil, err
+		}
+		st := Statistics{}
+		st.BytesClonedCount.Store(bytesClonedCount)
+		st.MatchedSegmentsCount.Store(matchedSegmentsCount)
+		st.IdenticalFilesCount.Store(int64(len(identicalFiles)))
+		lm.stats.Add(&st)
+		// files cloned from identical ones are known to match, so Write does not read them back
+		return []dirimage.Option{dirimage.WithTrustedFiles(identicalFiles)}, nil
+	}
+
+	convertedImage, err := dirimage.Convert(img)
 	if err != nil {
-		// TODO: ensure we don't delete anything useful _ = os.RemoveAll(destinationDir)
-		return err
+		return fmt.Errorf("unable to convert to dirimage: %w", err)
+	}
+	err = convertedImage.WritePrepared(ctx, destinationDir, prepare, lm.opts...)
+	if err != nil {
+		return fmt.Errorf("unable to write dirimage to '%v': %w", destinationDir, err)
 	}
+
 	st := Statistics{}
-	st.BytesClonedCount.Store(bytesClonedCount)
-	st.MatchedSegmentsCount.Store(matchedSegmentsCount)
+	st.BytesWrittenCount.Store(convertedImage.BytesWrittenCount.Load())
+	st.BytesSkippedCount.Store(convertedImage.BytesSkippedCount.Load())
+	st.BytesReadCount.Store(convertedImage.BytesReadCount.Load())
 	lm.stats.Add(&st)
+	return lm.ingest(destinationDir, manifest, diffIDs)
+}
 
+// Plan reports what Write would do for ref without changing anything: which segments are already present,
+// which would come with files cloned from other local images, and which would be downloaded.
+// Only manifest and config of img are accessed.
+func (lm *Mapper) Plan(ctx context.Context, img v1.Image, ref name.Reference) (*dirimage.WritePlan, error) {
+	if img == nil {
+		return nil, errors.New("nil image provided")
+	}
+	destinationDir := lm.refToDir(ref)
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get manifest: %w", err)
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get config file: %w", err)
+	}
+	clonePlans, err := lm.sketcher.Plan(destinationDir, *manifest, configFile.RootFS.DiffIDs)
+	if err != nil {
+		return nil, err
+	}
 	convertedImage, err := dirimage.Convert(img)
 	if err != nil {
-		return fmt.Errorf("unable to convert to dirimage: %w", err)
+		return nil, fmt.Errorf("unable to convert to dirimage: %w", err)
 	}
-	err = convertedImage.Write(ctx, destinationDir, lm.opts...)
+	plan, err := convertedImage.Plan(ctx, destinationDir, lm.opts...)
 	if err != nil {
-		return fmt.Errorf("unable to write dirimage to '%v': %w", destinationDir, err)
+		return nil, fmt.Errorf("unable to plan writing dirimage to '%v': %w", destinationDir, err)
 	}
 
-	st = Statistics{}
+	// cloned file brings segments its source has at the same range
+	type sourceSegment struct {
+		filename    string
+		start, stop int64
+		digest      v1.Hash
+	}
+	cloned := make(map[sourceSegment]string)
+	for _, cp := range clonePlans {
+		for _, d := range cp.Descriptors {
+			cloned[sourceSegment{cp.Filename, d.Start(), d.Stop(), d.Digest()}] = cp.Source
+		}
+		for _, r := range cp.Ranges {
+			cloned[sourceSegment{cp.Filename, r.Segment.Start(), r.Segment.Stop(), r.Segment.Digest()}] = r.Source
+		}
+	}
+	for i := range plan.Segments {
+		ps := &plan.Segments[i]
+		if ps.Action == dirimage.SegmentPresent {
+			continue
+		}
+		if src, ok := cloned[sourceSegment{ps.Filename, ps.Start, ps.Stop, ps.Digest}]; ok {
+			ps.Action = dirimage.SegmentCloned
+			ps.Source = src
+		}
+	}
+	return plan, nil
+}
+
+// Repair re-downloads only segments of locally stored image which do not match img.
+func (lm *Mapper) Repair(ctx context.Context, img v1.Image, ref name.Reference) (*dirimage.RepairResult, error) {
+	if img == nil {
+		return nil, errors.New("nil image provided")
+	}
+	convertedImage, err := dirimage.Convert(img)
+	if err != nil {
+		return nil, fmt.Errorf("unable to convert to dirimage: %w", err)
+	}
+	destinationDir := lm.refToDir(ref)
+	defer lm.updateIndex(destinationDir)
+	res, err := convertedImage.Repair(ctx, destinationDir, lm.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to repair dirimage in '%v': %w", destinationDir, err)
+	}
+	st := Statistics{}
 	st.BytesWrittenCount.Store(convertedImage.BytesWrittenCount.Load())
 	st.BytesSkippedCount.Store(convertedImage.BytesSkippedCount.Load())
 	st.BytesReadCount.Store(convertedImage.BytesReadCount.Load())
 	lm.stats.Add(&st)
-	return nil
+	return res, nil
 }
 
 func (lm *Mapper) Rehash(ctx context.Context, ref name.Reference) error {
+	ref, err := lm.Resolve(ref)
+	if err != nil {
+		return err
+	}
 	refStr := lm.refToDir(ref)
+	defer lm.updateIndex(refStr)
+	defer lm.touch(refStr)
 	img, err := dirimage.Read(ctx, refStr, lm.opts...)
 	if err != nil {
 		return fmt.Errorf("unable to read dirimage: %w", err)
@@ -140,11 +341,37 @@ func (lm *Mapper) Rehash(ctx context.Context, ref name.Reference) error {
 	st := Statistics{}
 	st.BytesReadCount.Store(img.BytesReadCount.Load())
 	lm.stats.Add(&st)
-	return img.WriteConfigAndManifest(refStr)
+	if err := img.WriteConfigAndManifest(refStr); err != nil {
+		return err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return fmt.Errorf("unable to get manifest: %w", err)
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("failed to get config file: %w", err)
+	}
+	return lm.ingest(refStr, manifest, configFile.RootFS.DiffIDs)
+}
+
+func (lm *Mapper) Verify(ctx context.Context, ref name.Reference) (*dirimage.VerificationResult, error) {
+	ref, err := lm.Resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+	return dirimage.Verify(ctx, lm.refToDir(ref), lm.opts...)
 }
 
 func (lm *Mapper) Read(ctx context.Context, ref name.Reference) (v1.Image, error) {
+	ref, err := lm.Resolve(ref)
+	if err != nil {
+		return nil, err
+	}
 	refStr := lm.refToDir(ref)
+	// reading may store digests of the image, see dirimage.WithDigestCache
+	defer lm.updateIndex(refStr)
+	defer lm.touch(refStr)
 	img, err := dirimage.Read(ctx, refStr, lm.opts...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to read dirimage: %w", err)
@@ -182,7 +409,14 @@ func IsDirWithOnlyFiles(path string) (bool, error) {
 	return true, nil // No subdirectories found, only files
 }
 
-func (lm *Mapper) Adopt(src string, ref name.Reference, failIfContainsSubdirectories bool) error {
+// Adopt clones directory src as the image of ref. A directory already at the place of the image, like one
+// restored from backup, is adopted as it is. Files are not hashed, see Rehash.
+func (lm *Mapper) Adopt(ctx context.Context, src string, ref name.Reference, failIfContainsSubdirectories bool, opt ...duplicator.Option) error {
+	if lm.isImageDir(src, ref) {
+		lm.touch(lm.refToDir(ref))
+		lm.updateIndex(lm.refToDir(ref))
+		return nil
+	}
 	isFlatDir, err := IsDirWithOnlyFiles(src)
 	if err != nil {
 		return fmt.Errorf("unable to verify if directory is flat: %w", err)
@@ -193,7 +427,46 @@ func (lm *Mapper) Adopt(src string, ref name.Reference, failIfContainsSubdirecto
 	if failIfContainsSubdirectories {
 		fmt.Printf("warning: subdirectories will be ignored")
 	}
-	return duplicator.CloneDirectory(src, lm.refToDir(ref), false)
+	opt = append([]duplicator.Option{duplicator.WithCloner(lm.cloner), lm.reportCloned()}, opt...)
+	defer lm.updateIndex(lm.refToDir(ref))
+	defer lm.touch(lm.refToDir(ref))
+	return duplicator.CloneDirectory(ctx, src, lm.refToDir(ref), false, opt...)
+}
+
+// AdoptByRename moves directory src into the root directory as the image of ref, which must not exist yet, so
+// nothing is copied. src must be on the filesystem of the root directory.
+func (lm *Mapper) AdoptByRename(src string, ref name.Reference) error {
+	dstDir := lm.refToDir(ref)
+	if lm.isImageDir(src, ref) {
+		lm.touch(dstDir)
+		lm.updateIndex(dstDir)
+		return nil
+	}
+	if info, err := os.Stat(src); err != nil || !info.IsDir() {
+		return fmt.Errorf("directory '%v' not found", src)
+	}
+	if _, err := os.Lstat(dstDir); err == nil {
+		return fmt.Errorf("image %v already exists", ref)
+	}
+	if err := os.MkdirAll(filepath.Dir(dstDir), os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create directory for adopting: %w", err)
+	}
+	if err := os.Rename(src, dstDir); err != nil {
+		return fmt.Errorf("unable to move '%v' to %v: %w", src, ref, err)
+	}
+	lm.touch(dstDir)
+	lm.updateIndex(dstDir)
+	return nil
+}
+
+// isImageDir reports whether dir is the directory of image of ref.
+func (lm *Mapper) isImageDir(dir string, ref name.Reference) bool {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	absImageDir, err := filepath.Abs(lm.refToDir(ref))
+	return err == nil && absDir == absImageDir
 }
 
 type Properties struct {
@@ -201,6 +474,9 @@ type Properties struct {
 	DiskUsage   string
 	Size        int64
 	HasManifest bool
+	Pinned      bool
+	// Digest is the digest of the manifest, which can refer to the image as repository@digest
+	Digest v1.Hash
 }
 
 func directorySize(path string) (int64, error) {
@@ -217,17 +493,29 @@ func directorySize(path string) (int64, error) {
 	return size, err
 }
 
-func (lm *Mapper) containsManifest(ref name.Reference) bool {
-	_, err := dirimage.Read(context.Background(), lm.refToDir(ref), dirimage.WithOmitLayersContent())
-	return err == nil
+// manifestDigest returns digest of the manifest of image of ref, false when it has none.
+func (lm *Mapper) manifestDigest(ref name.Reference) (v1.Hash, bool) {
+	img, err := dirimage.Read(context.Background(), lm.refToDir(ref), dirimage.WithOmitLayersContent())
+	if err != nil {
+		return v1.Hash{}, false
+	}
+	digest, err := img.Digest()
+	return digest, err == nil
 }
 
 func (lm *Mapper) List() ([]Properties, error) {
+	pins, err := lm.loadPins()
+	if err != nil {
+		return nil, err
+	}
 	res := make([]Properties, 0)
-	err := filepath.WalkDir(lm.rootDir, func(path string, d fs.DirEntry, argErr error) error {
+	err = filepath.WalkDir(lm.rootDir, func(path string, d fs.DirEntry, argErr error) error {
 		if d == nil || !d.IsDir() {
 			return nil
 		}
+		if path != lm.rootDir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
 
 		ref, err := lm.dirToRef(path)
 		if err != nil {
@@ -242,19 +530,64 @@ func (lm *Mapper) List() ([]Properties, error) {
 		if err != nil {
 			return err
 		}
+		digest, hasManifest := lm.manifestDigest(ref)
 		res = append(res, Properties{
 			Ref:         ref,
 			DiskUsage:   diskUsage,
 			Size:        dirSize,
-			HasManifest: lm.containsManifest(ref),
+			HasManifest: hasManifest,
+			Pinned:      isPinned(pins, ref),
+			Digest:      digest,
 		})
 		return nil
 	})
 	return res, err
 }
 
-func (lm *Mapper) Clone(src name.Reference, dst name.Reference) error {
-	return duplicator.CloneDirectory(lm.refToDir(src), lm.refToDir(dst), true)
+// reportCloned reports progress of duplicator.CloneDirectory in the cloning phase, to consumer set by options of lm.
+func (lm *Mapper) reportCloned() duplicator.Option {
+	return duplicator.WithProgressFunc(func(p duplicator.Progress) {
+		dirimage.ReportProgress(dirimage.ProgressUpdate{
+			BytesProcessed:     p.BytesCloned,
+			BytesTotal:         p.BytesTotal,
+			Phase:              dirimage.PhaseCloning,
+			Filename:           p.Filename,
+			FileBytesProcessed: p.FileBytesCloned,
+			FileBytesTotal:     p.FileBytesTotal,
+		}, lm.opts...)
+	})
+}
+
+// Clone clones image directory of src to dst, passing opt to duplicator.CloneDirectory.
+func (lm *Mapper) Clone(ctx context.Context, src name.Reference, dst name.Reference, opt ...duplicator.Option) error {
+	return lm.CloneFrom(ctx, lm, src, dst, opt...)
+}
+
+// CloneFrom is Clone with src in root directory of from, like another store. Files are copied when
+// the stores are on different filesystems.
+func (lm *Mapper) CloneFrom(ctx context.Context, from *Mapper, src name.Reference, dst name.Reference, opt ...duplicator.Option) error {
+	src, err := from.Resolve(src)
+	if err != nil {
+		return err
+	}
+	opt = append([]duplicator.Option{duplicator.WithCloner(lm.cloner), lm.reportCloned()}, opt...)
+	// using src counts as access as well, deferred calls run in reverse, so dst is indexed before src changes
+	defer from.updateIndex(from.refToDir(src))
+	defer from.touch(from.refToDir(src))
+	defer lm.updateIndex(lm.refToDir(dst))
+	defer lm.touch(lm.refToDir(dst))
+	return duplicator.CloneDirectory(ctx, from.refToDir(src), lm.refToDir(dst), true, opt...)
+}
+
+// updateIndex refreshes candidate index of the sketcher and the digest database after images in dirs were changed.
+// Both are brought up to date again when they are used, so failing to update them does not fail the operation.
+func (lm *Mapper) updateIndex(dirs ...string) {
+	if err := lm.sketcher.UpdateIndex(dirs...); err != nil {
+		dirimage.LogFunction(lm.opts...)("warning: unable to update candidate index: %v", err)
+	}
+	if err := lm.updateDigestDB(dirs...); err != nil {
+		dirimage.LogFunction(lm.opts...)("warning: unable to update digest database: %v", err)
+	}
 }
 
 func (lm *Mapper) Remove(src name.Reference) error {
@@ -262,7 +595,29 @@ func (lm *Mapper) Remove(src name.Reference) error {
 	if err != nil {
 		return fmt.Errorf("unable to valid reference: %w", err)
 	}
-	return os.RemoveAll(lm.refToDir(ref))
+	// digest reference removes every tag of the repository with that digest
+	refs, err := lm.resolveAll(ref)
+	if err != nil {
+		return err
+	}
+	dirs := make([]string, 0, len(refs))
+	for _, r := range refs {
+		pinned, err := lm.IsPinned(r)
+		if err != nil {
+			return err
+		}
+		if pinned {
+			return fmt.Errorf("unable to remove %v: %w, unpin it first", r, ErrPinned)
+		}
+		dirs = append(dirs, lm.refToDir(r))
+	}
+	defer lm.updateIndex(dirs...)
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (lm *Mapper) Stats() ImmutableStatistics {
@@ -274,5 +629,7 @@ func (lm *Mapper) Stats() ImmutableStatistics {
 		BytesClonedCount:     lm.stats.BytesClonedCount.Load(),
 		CompressedBytesCount: lm.stats.CompressedBytesCount.Load(),
 		MatchedSegmentsCount: lm.stats.MatchedSegmentsCount.Load(),
+		IdenticalFilesCount:  lm.stats.IdenticalFilesCount.Load(),
+		CloneStrategies:      lm.cloner.Strategies(),
 	}
 }
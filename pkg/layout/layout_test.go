@@ -8,9 +8,11 @@ import (
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/validate"
+	"github.com/macvmio/geranos/pkg/digestdb"
 	"github.com/macvmio/geranos/pkg/dirimage"
 	"github.com/macvmio/geranos/pkg/duplicator"
 	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/sketch"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"io"
@@ -167,7 +169,7 @@ func TestLayoutMapper_Write_MustOptimizeDiskSpace(t *testing.T) {
 		r := mustParseRef(t, dir)
 		err = lm.Write(ctx, img1, r)
 		require.NoErrorf(t, err, "unable to write image %d: %v", i, err)
-		err = duplicator.CloneDirectory(portableFilepath(path.Join(testRepoDir, "a:v1")),
+		err = duplicator.CloneDirectory(ctx, portableFilepath(path.Join(testRepoDir, "a:v1")),
 			portableFilepath(path.Join(optimalRepoDir, fmt.Sprintf("a:v%d", i))), false)
 		require.NoErrorf(t, err, "unable to clone directory: %v", err)
 		assert.Equal(t, hashBefore, hashFromFile(t, portableFilepath(filepath.Join(testRepoDir, fmt.Sprintf("a:v%d", i), "disk.img"))))
@@ -219,14 +221,45 @@ func TestLayoutMapper_Write_MustAvoidWritingSameContent(t *testing.T) {
 	err = lm.Write(ctx, img1, destRef3)
 	require.NoErrorf(t, err, "unable to write image %v: %v", destRef, err)
 	assert.Equal(t, int64(0), lm.stats.BytesWrittenCount.Load())
-	assert.Equal(t, int64(1000), lm.stats.BytesReadCount.Load())
+	// disk.img is cloned from identical file, so it is not read back
+	assert.Equal(t, int64(0), lm.stats.BytesReadCount.Load())
 	assert.Equal(t, int64(1000), lm.stats.BytesClonedCount.Load())
 	assert.Equal(t, int64(100), lm.stats.MatchedSegmentsCount.Load())
+	assert.Equal(t, int64(1), lm.stats.IdenticalFilesCount.Load())
 
 	afterHash := hashFromFile(t, portableFilepath(path.Join(tempDir, "oci.jarosik.online/testrepo/a:v3/disk.img")))
 	assert.Equal(t, beforeHash, afterHash)
 }
 
+func TestLayoutMapper_Write_ContentStore(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	testRepoDir := path.Join(tempDir, "oci.jarosik.online/testrepo")
+	err := os.MkdirAll(portableFilepath(path.Join(testRepoDir, "a:v1")), os.ModePerm)
+	require.NoErrorf(t, err, "unable to create directory: %v", err)
+	const chunkSize = 10
+	lm := NewMapper(tempDir, dirimage.WithChunkSize(chunkSize))
+	assert.Nil(t, lm.ContentStore())
+	require.NoError(t, lm.EnableContentStore())
+	require.NotNil(t, lm.ContentStore())
+	err = generateRandomFile(path.Join(testRepoDir, "a:v1/disk.img"), 100*chunkSize)
+	require.NoErrorf(t, err, "unable to generate file: %v", err)
+	beforeHash := hashFromFile(t, path.Join(testRepoDir, "a:v1/disk.img"))
+	img1, err := lm.Read(ctx, mustParseRef(t, "oci.jarosik.online/testrepo/a:v1"))
+	require.NoErrorf(t, err, "unable to read disk image: %v", err)
+
+	require.NoError(t, lm.Write(ctx, img1, mustParseRef(t, "oci.jarosik.online/testrepo/a:v2")))
+	// the only clone candidate is gone, but its segments stay in the store
+	require.NoError(t, lm.Remove(mustParseRef(t, "oci.jarosik.online/testrepo/a:v2")))
+	lm.stats.Clear()
+
+	require.NoError(t, lm.Write(ctx, img1, mustParseRef(t, "oci.jarosik.online/testrepo/a:v3")))
+	assert.Equal(t, int64(0), lm.stats.BytesWrittenCount.Load())
+	assert.Equal(t, int64(1000), lm.stats.BytesClonedCount.Load())
+	assert.Equal(t, int64(0), lm.stats.MatchedSegmentsCount.Load())
+	assert.Equal(t, beforeHash, hashFromFile(t, portableFilepath(path.Join(testRepoDir, "a:v3/disk.img"))))
+}
+
 func TestLayoutMapper_Write_MustOnlyWriteContentThatDiffersFromAlreadyWritten(t *testing.T) {
 	ctx := context.Background()
 	tempDir := t.TempDir()
@@ -283,6 +316,7 @@ func TestLayoutMapper_Write_MustOnlyWriteContentThatDiffersFromAlreadyWritten(t
 	assert.Equal(t, int64(1020), lm.stats.BytesReadCount.Load())
 	assert.Equal(t, int64(1020), lm.stats.BytesClonedCount.Load())
 	assert.Equal(t, int64(100), lm.stats.MatchedSegmentsCount.Load())
+	assert.Equal(t, int64(0), lm.stats.IdenticalFilesCount.Load())
 }
 
 func TestLayoutMapper_Write_MultipleConcurrentWorkers(t *testing.T) {
@@ -317,6 +351,38 @@ func TestLayoutMapper_Write_MultipleConcurrentWorkers(t *testing.T) {
 	}
 }
 
+func TestLayoutMapper_Write_Staged(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	testRepoDir := path.Join(tempDir, "oci.jarosik.online/testrepo")
+	for _, dir := range []string{"a:v1", "a:v2"} {
+		require.NoError(t, os.MkdirAll(portableFilepath(path.Join(testRepoDir, dir)), os.ModePerm))
+	}
+	const chunkSize = 10
+	lm := NewMapper(tempDir, dirimage.WithChunkSize(chunkSize), dirimage.WithStaging(true), dirimage.WithLogFunction(func(string, ...any) {}))
+	require.NoError(t, generateRandomFile(path.Join(testRepoDir, "a:v1/disk.img"), 10*chunkSize))
+	require.NoError(t, os.WriteFile(portableFilepath(path.Join(testRepoDir, "a:v2/notes.txt")), []byte("previous content"), 0o644))
+	beforeHash := hashFromFile(t, path.Join(testRepoDir, "a:v1/disk.img"))
+	img1, err := lm.Read(ctx, mustParseRef(t, "oci.jarosik.online/testrepo/a:v1"))
+	require.NoError(t, err)
+	// writing in place keeps the content and adds the manifest, so a:v1 becomes clone candidate
+	require.NoError(t, lm.Write(ctx, img1, mustParseRef(t, "oci.jarosik.online/testrepo/a:v1")))
+	require.Zero(t, lm.Stats().BytesWrittenCount)
+
+	require.NoError(t, lm.Write(ctx, img1, mustParseRef(t, "oci.jarosik.online/testrepo/a:v2")))
+	assert.Equal(t, beforeHash, hashFromFile(t, path.Join(testRepoDir, "a:v2/disk.img")))
+	// content was cloned into the staging directory, which replaced the previous image
+	assert.Zero(t, lm.Stats().BytesWrittenCount)
+	assert.NoFileExists(t, portableFilepath(path.Join(testRepoDir, "a:v2/notes.txt")))
+	entries, err := os.ReadDir(portableFilepath(testRepoDir))
+	require.NoError(t, err)
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.ElementsMatch(t, []string{"a:v1", "a:v2"}, names)
+}
+
 func TestLayoutMapper_Write_MustOverwriteBiggerFileIfAlreadyExist(t *testing.T) {
 	ctx := context.Background()
 	tempDir := t.TempDir()
@@ -358,6 +424,25 @@ func mustParseRef(t *testing.T, ref string) name.Reference {
 	return srcRef
 }
 
+// createDigestDB creates the digest database of lm, which its operations keep up to date from then on.
+func createDigestDB(t *testing.T, lm *Mapper) {
+	t.Helper()
+	db, err := lm.DigestDB()
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
+
+// recordedImages returns images recorded in the digest database of lm, as they were left by its operations.
+func recordedImages(t *testing.T, lm *Mapper) []string {
+	t.Helper()
+	db, err := digestdb.Open(lm.rootDir, filepath.Join(lm.rootDir, sketch.IndexDirectory))
+	require.NoError(t, err)
+	defer db.Close()
+	images, err := db.Images()
+	require.NoError(t, err)
+	return images
+}
+
 func TestLayoutMapper_WriteIfNotPresent(t *testing.T) {
 	ctx := context.Background()
 	tempDir, err := os.MkdirTemp("", "layout-mapper-*")
@@ -606,3 +691,37 @@ func TestLayoutMapper_Rehash(t *testing.T) {
 		assert.Contains(t, err.Error(), "unable to read dirimage")
 	})
 }
+
+func TestLayoutMapper_Adopt(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("InPlace", func(t *testing.T) {
+		lm := NewMapper(t.TempDir())
+		createDigestDB(t, lm)
+		ref := mustParseRef(t, "testrepo/restored:v1")
+		imageDir := lm.refToDir(ref)
+		require.NoError(t, os.MkdirAll(imageDir, os.ModePerm))
+		require.NoError(t, generateRandomFile(filepath.Join(imageDir, "disk.img"), 1024))
+
+		require.NoError(t, lm.Adopt(ctx, imageDir, ref, false))
+		require.NoError(t, lm.Rehash(ctx, ref))
+		assert.FileExists(t, filepath.Join(imageDir, dirimage.LocalManifestFilename))
+		assert.Equal(t, []string{imageDir}, recordedImages(t, lm))
+	})
+
+	t.Run("ByRename", func(t *testing.T) {
+		tempDir := t.TempDir()
+		lm := NewMapper(filepath.Join(tempDir, "images"))
+		ref := mustParseRef(t, "testrepo/moved:v1")
+		src := filepath.Join(tempDir, "vm")
+		require.NoError(t, os.MkdirAll(src, os.ModePerm))
+		require.NoError(t, generateRandomFile(filepath.Join(src, "disk.img"), 1024))
+
+		require.NoError(t, lm.AdoptByRename(src, ref))
+		assert.NoDirExists(t, src)
+		assert.FileExists(t, filepath.Join(lm.refToDir(ref), "disk.img"))
+
+		require.NoError(t, os.MkdirAll(src, os.ModePerm))
+		assert.Error(t, lm.AdoptByRename(src, ref), "existing image is not replaced")
+	})
+}
@@ -0,0 +1,296 @@
+package layout
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/sketch"
+	"os"
+	"path/filepath"
+)
+
+// LayoutFilename is the file of sketch.IndexDirectory recording the layout version of the root directory.
+const LayoutFilename = "layout.json"
+
+const (
+	// LayoutVersionFlat is the layout of root directories without LayoutFilename, where every image directory
+	// alone keeps its content.
+	LayoutVersionFlat = 1
+	// LayoutVersionContentStore keeps segments of all images in the content store as well, see EnableContentStore.
+	LayoutVersionContentStore = 2
+	// CurrentLayoutVersion is the layout Migrate upgrades root directories to.
+	CurrentLayoutVersion = LayoutVersionContentStore
+)
+
+type layoutFile struct {
+	Version int `json:"version"`
+}
+
+// legacyMetadataFilename is a plain name a metadata file may be kept under, with the name it has now.
+type legacyMetadataFilename struct {
+	legacy  string
+	current string
+}
+
+// legacyMetadataFilenames are renamed in this order, the manifest first, as it tells which config is the image's.
+var legacyMetadataFilenames = []legacyMetadataFilename{
+	{legacy: "manifest.json", current: dirimage.LocalManifestFilename},
+	{legacy: "config.json", current: dirimage.LocalConfigFilename},
+}
+
+// MigratedImage is what Migrate did, or would do, to a local image.
+type MigratedImage struct {
+	Ref name.Reference
+	// Renamed are legacy metadata files renamed to their current names
+	Renamed []string
+	// NoManifest reports the image has no manifest, so there was nothing to verify or add to the content store
+	NoManifest bool
+	// Verification is nil when the image was not verified, in a dry run with metadata files still to be renamed
+	Verification *dirimage.VerificationResult
+	// Ingested reports segments of the image were added to the content store
+	Ingested bool
+	Err      error
+}
+
+// Migration is the result of Migrate.
+type Migration struct {
+	From   int
+	To     int
+	Images []MigratedImage
+}
+
+// OK reports whether every image was migrated.
+func (m *Migration) OK() bool {
+	for _, img := range m.Images {
+		if img.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (lm *Mapper) layoutPath() string {
+	return filepath.Join(lm.rootDir, sketch.IndexDirectory, LayoutFilename)
+}
+
+// LayoutVersion returns the layout version of the root directory, LayoutVersionFlat unless a migration recorded one.
+func (lm *Mapper) LayoutVersion() (int, error) {
+	data, err := os.ReadFile(lm.layoutPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return LayoutVersionFlat, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unable to read layout version: %w", err)
+	}
+	var lf layoutFile
+	if err := json.Unmarshal(data, &lf); err != nil {
+		return 0, fmt.Errorf("invalid layout file: %w", err)
+	}
+	return lf.Version, nil
+}
+
+func (lm *Mapper) saveLayoutVersion(version int) error {
+	data, err := json.MarshalIndent(layoutFile{Version: version}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(lm.layoutPath()), os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create index directory: %w", err)
+	}
+	tmpPath := lm.layoutPath() + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("unable to write layout version: %w", err)
+	}
+	if err := os.Rename(tmpPath, lm.layoutPath()); err != nil {
+		return fmt.Errorf("unable to replace layout version: %w", err)
+	}
+	return nil
+}
+
+// Migrate upgrades the root directory to CurrentLayoutVersion. Metadata files of every image kept under legacy
+// names get current ones, files are verified against the manifest, and segments of verified images are added
+// to the content store. Images failing verification are left alone and keep the layout version from being
+// recorded, so Migrate can be run again once they are repaired or removed. With dryRun nothing is changed.
+func (lm *Mapper) Migrate(ctx context.Context, dryRun bool) (*Migration, error) {
+	from, err := lm.LayoutVersion()
+	if err != nil {
+		return nil, err
+	}
+	if from > CurrentLayoutVersion {
+		return nil, fmt.Errorf("layout version %d is newer than supported %d", from, CurrentLayoutVersion)
+	}
+	res := &Migration{From: from, To: from}
+	if from == CurrentLayoutVersion {
+		return res, nil
+	}
+	dirs, err := lm.imageDirs()
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		if err := lm.EnableContentStore(); err != nil {
+			return nil, fmt.Errorf("unable to create content store: %w", err)
+		}
+	}
+	renamedDirs := make([]string, 0)
+	for _, dir := range dirs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		ref, err := lm.dirToRef(dir)
+		if err != nil {
+			return nil, err
+		}
+		img := lm.migrateImage(ctx, dir, dryRun)
+		img.Ref = ref
+		if len(img.Renamed) > 0 && !dryRun {
+			renamedDirs = append(renamedDirs, dir)
+		}
+		res.Images = append(res.Images, img)
+	}
+	if len(renamedDirs) > 0 {
+		lm.updateIndex(renamedDirs...)
+	}
+	if dryRun || !res.OK() {
+		return res, nil
+	}
+	if err := lm.saveLayoutVersion(CurrentLayoutVersion); err != nil {
+		return nil, err
+	}
+	res.To = CurrentLayoutVersion
+	return res, nil
+}
+
+func (lm *Mapper) migrateImage(ctx context.Context, dir string, dryRun bool) MigratedImage {
+	img := MigratedImage{}
+	renamed, err := renameLegacyMetadata(dir, dryRun)
+	img.Renamed = renamed
+	if err != nil {
+		img.Err = err
+		return img
+	}
+	if dryRun && len(renamed) > 0 {
+		return img
+	}
+	if _, err := os.Stat(filepath.Join(dir, dirimage.LocalManifestFilename)); errors.Is(err, os.ErrNotExist) {
+		img.NoManifest = true
+		return img
+	}
+	img.Verification, err = dirimage.Verify(ctx, dir, lm.opts...)
+	if err != nil {
+		img.Err = fmt.Errorf("unable to verify: %w", err)
+		return img
+	}
+	if !img.Verification.OK() {
+		img.Err = errors.New("verification failed")
+		return img
+	}
+	if dryRun {
+		return img
+	}
+	manifest, configFile, err := readLocalMetadata(dir)
+	if err != nil {
+		img.Err = err
+		return img
+	}
+	if err := lm.ingest(dir, manifest, configFile.RootFS.DiffIDs); err != nil {
+		img.Err = err
+		return img
+	}
+	img.Ingested = true
+	return img
+}
+
+// renameLegacyMetadata gives metadata files of image in dir kept under legacy names their current names, and
+// returns the legacy names. Plain names are common in image content, e.g. config.json of VM bundles, so
+// the manifest is renamed only when it describes files of dir, and the config only when the manifest refers to it.
+func renameLegacyMetadata(dir string, dryRun bool) ([]string, error) {
+	res := make([]string, 0)
+	manifestPath := filepath.Join(dir, dirimage.LocalManifestFilename)
+	var manifest *v1.Manifest
+	for _, f := range legacyMetadataFilenames {
+		legacyPath, currentPath := filepath.Join(dir, f.legacy), filepath.Join(dir, f.current)
+		if _, err := os.Stat(currentPath); err == nil {
+			continue
+		}
+		data, err := os.ReadFile(legacyPath)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return res, err
+		}
+		if f.current == dirimage.LocalManifestFilename {
+			if manifest = legacyManifest(dir, data); manifest == nil {
+				continue
+			}
+		} else {
+			if manifest == nil {
+				if manifestData, err := os.ReadFile(manifestPath); err == nil {
+					manifest, _ = v1.ParseManifest(bytes.NewReader(manifestData))
+				}
+			}
+			digest, _, err := v1.SHA256(bytes.NewReader(data))
+			if err != nil {
+				return res, err
+			}
+			if manifest == nil || manifest.Config.Digest != digest {
+				continue
+			}
+		}
+		if !dryRun {
+			if err := os.Rename(legacyPath, currentPath); err != nil {
+				return res, fmt.Errorf("unable to rename '%v': %w", legacyPath, err)
+			}
+		}
+		res = append(res, f.legacy)
+	}
+	return res, nil
+}
+
+// legacyManifest returns manifest parsed from data when it is a manifest of file segments all present in dir.
+func legacyManifest(dir string, data []byte) *v1.Manifest {
+	manifest, err := v1.ParseManifest(bytes.NewReader(data))
+	if err != nil || len(manifest.Layers) == 0 {
+		return nil
+	}
+	for _, l := range manifest.Layers {
+		d, err := filesegment.ParseDescriptor(l, v1.Hash{})
+		if err != nil {
+			return nil
+		}
+		if _, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(d.Filename()))); err != nil {
+			return nil
+		}
+	}
+	return manifest
+}
+
+// readLocalMetadata parses LocalManifestFilename and LocalConfigFilename of image in dir.
+func readLocalMetadata(dir string) (*v1.Manifest, *v1.ConfigFile, error) {
+	manifestFile, err := os.Open(filepath.Join(dir, dirimage.LocalManifestFilename))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open manifest: %w", err)
+	}
+	defer manifestFile.Close()
+	manifest, err := v1.ParseManifest(manifestFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse manifest: %w", err)
+	}
+	configFile, err := os.Open(filepath.Join(dir, dirimage.LocalConfigFilename))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open config: %w", err)
+	}
+	defer configFile.Close()
+	config, err := v1.ParseConfigFile(configFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse config: %w", err)
+	}
+	return manifest, config, nil
+}
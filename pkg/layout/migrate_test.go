@@ -0,0 +1,80 @@
+package layout
+
+import (
+	"context"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayoutMapper_Migrate(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	lm := NewMapper(tempDir, dirimage.WithChunkSize(256))
+	legacy := mustParseRef(t, "oci.jarosik.online/testrepo/a:v1")
+	bundle := mustParseRef(t, "oci.jarosik.online/testrepo/b:v1")
+	legacyDir, bundleDir := lm.refToDir(legacy), lm.refToDir(bundle)
+	for _, dir := range []string{legacyDir, bundleDir} {
+		require.NoError(t, os.MkdirAll(dir, os.ModePerm))
+		require.NoError(t, generateRandomFile(filepath.Join(dir, "disk.img"), 1024))
+	}
+	require.NoError(t, lm.Rehash(ctx, legacy))
+	require.NoError(t, os.Rename(filepath.Join(legacyDir, dirimage.LocalManifestFilename), filepath.Join(legacyDir, "manifest.json")))
+	require.NoError(t, os.Rename(filepath.Join(legacyDir, dirimage.LocalConfigFilename), filepath.Join(legacyDir, "config.json")))
+	// config.json of image content is not taken for metadata
+	require.NoError(t, os.WriteFile(filepath.Join(bundleDir, "config.json"), []byte(`{"cpus": 2}`), 0o644))
+	require.NoError(t, lm.Rehash(ctx, bundle))
+
+	version, err := lm.LayoutVersion()
+	require.NoError(t, err)
+	assert.Equal(t, LayoutVersionFlat, version)
+
+	res, err := lm.Migrate(ctx, true)
+	require.NoError(t, err)
+	require.Len(t, res.Images, 2)
+	assert.Equal(t, []string{"manifest.json", "config.json"}, res.Images[0].Renamed)
+	assert.FileExists(t, filepath.Join(legacyDir, "manifest.json"), "dry run changes nothing")
+	assert.Nil(t, lm.ContentStore())
+
+	res, err = lm.Migrate(ctx, false)
+	require.NoError(t, err)
+	require.True(t, res.OK())
+	assert.Equal(t, CurrentLayoutVersion, res.To)
+	assert.FileExists(t, filepath.Join(legacyDir, dirimage.LocalManifestFilename))
+	assert.FileExists(t, filepath.Join(bundleDir, "config.json"))
+	assert.Empty(t, res.Images[1].Renamed)
+	for _, img := range res.Images {
+		assert.True(t, img.Ingested)
+		assert.True(t, img.Verification.OK())
+	}
+	require.NotNil(t, lm.ContentStore())
+	blobs, err := lm.ContentStore().Blobs()
+	require.NoError(t, err)
+	assert.NotEmpty(t, blobs)
+	version, err = lm.LayoutVersion()
+	require.NoError(t, err)
+	assert.Equal(t, CurrentLayoutVersion, version)
+	_, err = lm.Read(ctx, legacy)
+	require.NoError(t, err)
+
+	t.Run("corrupted image keeps the version", func(t *testing.T) {
+		other := NewMapper(t.TempDir(), dirimage.WithChunkSize(256))
+		ref := mustParseRef(t, "oci.jarosik.online/testrepo/c:v1")
+		dir := other.refToDir(ref)
+		require.NoError(t, os.MkdirAll(dir, os.ModePerm))
+		require.NoError(t, generateRandomFile(filepath.Join(dir, "disk.img"), 1024))
+		require.NoError(t, other.Rehash(ctx, ref))
+		require.NoError(t, generateRandomFile(filepath.Join(dir, "disk.img"), 1024))
+
+		res, err := other.Migrate(ctx, false)
+		require.NoError(t, err)
+		assert.False(t, res.OK())
+		assert.Equal(t, LayoutVersionFlat, res.To)
+		version, err := other.LayoutVersion()
+		require.NoError(t, err)
+		assert.Equal(t, LayoutVersionFlat, version)
+	})
+}
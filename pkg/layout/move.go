@@ -0,0 +1,52 @@
+package layout
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"os"
+	"path/filepath"
+)
+
+// Move relocates local image of src to dst, which must not exist yet, renaming its directory so nothing is
+// copied. Pin of src moves along, and the candidate index is updated for both references at once,
+// so the image stays a clone candidate under its new name.
+func (lm *Mapper) Move(src name.Reference, dst name.Reference) error {
+	src, err := lm.Resolve(src)
+	if err != nil {
+		return err
+	}
+	srcDir, dstDir := lm.refToDir(src), lm.refToDir(dst)
+	if srcDir == dstDir {
+		return fmt.Errorf("%v and %v are the same image", src, dst)
+	}
+	if info, err := os.Stat(srcDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("image %v not found", src)
+	}
+	if _, err := os.Lstat(dstDir); err == nil {
+		return fmt.Errorf("image %v already exists", dst)
+	}
+	pins, err := lm.loadPins()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dstDir), os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create directory for moving: %w", err)
+	}
+	if err := os.Rename(srcDir, dstDir); err != nil {
+		return fmt.Errorf("unable to move %v to %v: %w", src, dst, err)
+	}
+	if isPinned(pins, src) {
+		delete(pins, src.String())
+		pins[dst.String()] = struct{}{}
+		if err := lm.savePins(pins); err != nil {
+			if restoreErr := os.Rename(dstDir, srcDir); restoreErr != nil {
+				return errors.Join(err, fmt.Errorf("unable to move %v back to %v, image is left at %v: %w", dst, src, dstDir, restoreErr))
+			}
+			return err
+		}
+	}
+	lm.touch(dstDir)
+	lm.updateIndex(srcDir, dstDir)
+	return nil
+}
@@ -0,0 +1,46 @@
+package layout
+
+import (
+	"context"
+	"github.com/macvmio/geranos/pkg/digestdb"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/sketch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayoutMapper_Move(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	lm := NewMapper(tempDir, dirimage.WithChunkSize(256))
+	createDigestDB(t, lm)
+	src := mustParseRef(t, "oci.jarosik.online/testrepo/a:v1")
+	dst := mustParseRef(t, "oci.jarosik.online/other/b:v2")
+	srcDir, dstDir := lm.refToDir(src), lm.refToDir(dst)
+	require.NoError(t, os.MkdirAll(srcDir, os.ModePerm))
+	require.NoError(t, generateRandomFile(filepath.Join(srcDir, "disk.img"), 1024))
+	require.NoError(t, lm.Rehash(ctx, src))
+	require.NoError(t, lm.Pin(src))
+	require.Equal(t, []string{srcDir}, recordedImages(t, lm))
+
+	require.NoError(t, lm.Move(src, dst))
+	assert.NoDirExists(t, srcDir)
+	assert.FileExists(t, filepath.Join(dstDir, "disk.img"))
+	pinned, err := lm.IsPinned(dst)
+	require.NoError(t, err)
+	assert.True(t, pinned, "pin moves with the image")
+	assert.FileExists(t, filepath.Join(tempDir, sketch.IndexDirectory, digestdb.Filename), "digest database is updated, not dropped")
+	assert.Equal(t, []string{dstDir}, recordedImages(t, lm))
+	_, err = lm.Read(ctx, dst)
+	require.NoError(t, err)
+
+	t.Run("existing destination", func(t *testing.T) {
+		other := mustParseRef(t, "oci.jarosik.online/testrepo/c:v1")
+		require.NoError(t, os.MkdirAll(lm.refToDir(other), os.ModePerm))
+		assert.Error(t, lm.Move(other, dst))
+		assert.DirExists(t, lm.refToDir(other))
+	})
+}
@@ -0,0 +1,130 @@
+package layout
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/macvmio/geranos/pkg/sketch"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// PinsFilename is the file of sketch.IndexDirectory listing pinned images, which Prune and Remove leave alone.
+const PinsFilename = "pins.json"
+
+// ErrPinned is returned when removing a pinned image.
+var ErrPinned = errors.New("image is pinned")
+
+func (lm *Mapper) pinsPath() string {
+	return filepath.Join(lm.rootDir, sketch.IndexDirectory, PinsFilename)
+}
+
+func (lm *Mapper) loadPins() (map[string]struct{}, error) {
+	res := make(map[string]struct{})
+	data, err := os.ReadFile(lm.pinsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pins: %w", err)
+	}
+	var refs []string
+	if err := json.Unmarshal(data, &refs); err != nil {
+		return nil, fmt.Errorf("invalid pins file: %w", err)
+	}
+	for _, r := range refs {
+		res[r] = struct{}{}
+	}
+	return res, nil
+}
+
+func (lm *Mapper) savePins(pins map[string]struct{}) error {
+	refs := make([]string, 0, len(pins))
+	for r := range pins {
+		refs = append(refs, r)
+	}
+	sort.Strings(refs)
+	data, err := json.MarshalIndent(refs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(lm.pinsPath()), os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create index directory: %w", err)
+	}
+	// every writer has its own temporary file, so concurrent ones never write to the same
+	f, err := sysenv.CreateTemp(sysenv.OS, filepath.Dir(lm.pinsPath()), PinsFilename+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to write pins: %w", err)
+	}
+	tmpPath := f.Name()
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0o644)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("unable to write pins: %w", err)
+	}
+	if err := os.Rename(tmpPath, lm.pinsPath()); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("unable to replace pins: %w", err)
+	}
+	return nil
+}
+
+// Pin protects local image of ref from Prune and Remove, until Unpin.
+func (lm *Mapper) Pin(ref name.Reference) error {
+	ref, err := lm.Resolve(ref)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(lm.refToDir(ref)); err != nil || !info.IsDir() {
+		return fmt.Errorf("image %v not found", ref)
+	}
+	pins, err := lm.loadPins()
+	if err != nil {
+		return err
+	}
+	pins[ref.String()] = struct{}{}
+	return lm.savePins(pins)
+}
+
+// Unpin removes protection of Pin from image of ref.
+func (lm *Mapper) Unpin(ref name.Reference) error {
+	ref, err := lm.Resolve(ref)
+	if err != nil {
+		return err
+	}
+	pins, err := lm.loadPins()
+	if err != nil {
+		return err
+	}
+	if _, ok := pins[ref.String()]; !ok {
+		return fmt.Errorf("image %v is not pinned", ref)
+	}
+	delete(pins, ref.String())
+	return lm.savePins(pins)
+}
+
+// IsPinned reports whether image of ref is pinned.
+func (lm *Mapper) IsPinned(ref name.Reference) (bool, error) {
+	if resolved, err := lm.Resolve(ref); err == nil {
+		ref = resolved
+	}
+	pins, err := lm.loadPins()
+	if err != nil {
+		return false, err
+	}
+	return isPinned(pins, ref), nil
+}
+
+func isPinned(pins map[string]struct{}, ref name.Reference) bool {
+	_, ok := pins[ref.String()]
+	return ok
+}
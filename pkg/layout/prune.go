@@ -0,0 +1,126 @@
+package layout
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"sort"
+	"time"
+)
+
+// PrunePolicy selects local images Prune removes. Zero values disable the respective rule,
+// and an image is removed when any rule selects it. Pinned images are never selected.
+type PrunePolicy struct {
+	// OlderThan removes images not used for longer than that, see Mapper.LastAccess
+	OlderThan time.Duration
+	// KeepLast removes all but given number of most recently used images of every repository
+	KeepLast int
+	// MaxStoreSize removes least recently used images until the rest takes at most that many bytes
+	MaxStoreSize int64
+}
+
+// PrunedImage is a local image selected by PrunePolicy.
+type PrunedImage struct {
+	Ref        name.Reference
+	LastAccess time.Time
+	// Size is the apparent size of the image, space shared with other images is not reclaimed
+	Size   int64
+	Reason string
+}
+
+type prunableImage struct {
+	PrunedImage
+	dir    string
+	pinned bool
+}
+
+// Prune removes local images selected by policy, least recently used first, and returns them.
+// With dryRun nothing is removed. Segments of removed images stay in the content store until CollectGarbage.
+func (lm *Mapper) Prune(policy PrunePolicy, dryRun bool) ([]PrunedImage, error) {
+	images, err := lm.prunableImages()
+	if err != nil {
+		return nil, err
+	}
+	// most recently used first, which is the order KeepLast and MaxStoreSize keep them in
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].LastAccess.After(images[j].LastAccess)
+	})
+	selected := make(map[string]string)
+	now := time.Now()
+	kept := make(map[string]int)
+	for _, img := range images {
+		repo := img.Ref.Context().String()
+		switch {
+		case img.pinned:
+			// pinned images are kept on top of KeepLast ones
+		case policy.OlderThan > 0 && now.Sub(img.LastAccess) > policy.OlderThan:
+			selected[img.dir] = fmt.Sprintf("not used for %v", now.Sub(img.LastAccess).Round(time.Second))
+		case policy.KeepLast > 0 && kept[repo] >= policy.KeepLast:
+			selected[img.dir] = fmt.Sprintf("more than %d images of %v", policy.KeepLast, repo)
+		default:
+			kept[repo]++
+		}
+	}
+	if policy.MaxStoreSize > 0 {
+		total := int64(0)
+		for _, img := range images {
+			if _, ok := selected[img.dir]; !ok {
+				total += img.Size
+			}
+		}
+		for i := len(images) - 1; i >= 0 && total > policy.MaxStoreSize; i-- {
+			if _, ok := selected[images[i].dir]; !ok && !images[i].pinned {
+				selected[images[i].dir] = fmt.Sprintf("store larger than %d bytes", policy.MaxStoreSize)
+				total -= images[i].Size
+			}
+		}
+	}
+
+	res := make([]PrunedImage, 0)
+	for i := len(images) - 1; i >= 0; i-- {
+		reason, ok := selected[images[i].dir]
+		if !ok {
+			continue
+		}
+		if !dryRun {
+			if err := lm.Remove(images[i].Ref); err != nil {
+				return res, fmt.Errorf("unable to remove %v: %w", images[i].Ref, err)
+			}
+		}
+		img := images[i].PrunedImage
+		img.Reason = reason
+		res = append(res, img)
+	}
+	return res, nil
+}
+
+func (lm *Mapper) prunableImages() ([]prunableImage, error) {
+	dirs, err := lm.imageDirs()
+	if err != nil {
+		return nil, err
+	}
+	pins, err := lm.loadPins()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]prunableImage, 0, len(dirs))
+	for _, dir := range dirs {
+		ref, err := lm.dirToRef(dir)
+		if err != nil {
+			return nil, err
+		}
+		accessed, err := lastAccess(dir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get last access of %v: %w", ref, err)
+		}
+		size, err := directorySize(dir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get size of %v: %w", ref, err)
+		}
+		res = append(res, prunableImage{
+			PrunedImage: PrunedImage{Ref: ref, LastAccess: accessed, Size: size},
+			dir:         dir,
+			pinned:      isPinned(pins, ref),
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,95 @@
+package layout
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLayoutMapper_Prune(t *testing.T) {
+	prepare := func(t *testing.T) *Mapper {
+		tempDir := t.TempDir()
+		now := time.Now()
+		// a:v1 was used 4 days ago, a:v4 today, b:v1 10 days ago
+		images := map[string]time.Duration{
+			"oci.jarosik.online/testrepo/a:v1": 4 * 24 * time.Hour,
+			"oci.jarosik.online/testrepo/a:v2": 3 * 24 * time.Hour,
+			"oci.jarosik.online/testrepo/a:v3": 2 * 24 * time.Hour,
+			"oci.jarosik.online/testrepo/a:v4": 0,
+			"oci.jarosik.online/testrepo/b:v1": 10 * 24 * time.Hour,
+		}
+		lm := NewMapper(tempDir)
+		for ref, age := range images {
+			dir := lm.refToDir(mustParseRef(t, ref))
+			require.NoError(t, os.MkdirAll(dir, os.ModePerm))
+			require.NoError(t, generateRandomFile(filepath.Join(dir, "disk.img"), 100))
+			lm.touch(dir)
+			accessed := now.Add(-age)
+			require.NoError(t, os.Chtimes(filepath.Join(dir, AccessFilename), accessed, accessed))
+		}
+		return lm
+	}
+	refs := func(pruned []PrunedImage) []string {
+		res := make([]string, 0)
+		for _, p := range pruned {
+			res = append(res, p.Ref.String())
+		}
+		return res
+	}
+
+	t.Run("older than", func(t *testing.T) {
+		lm := prepare(t)
+		pruned, err := lm.Prune(PrunePolicy{OlderThan: 72*time.Hour + time.Minute}, false)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"oci.jarosik.online/testrepo/b:v1", "oci.jarosik.online/testrepo/a:v1"}, refs(pruned))
+		assert.NoDirExists(t, lm.refToDir(mustParseRef(t, "oci.jarosik.online/testrepo/b:v1")))
+		assert.DirExists(t, lm.refToDir(mustParseRef(t, "oci.jarosik.online/testrepo/a:v2")))
+	})
+
+	t.Run("keep last per repository", func(t *testing.T) {
+		lm := prepare(t)
+		pruned, err := lm.Prune(PrunePolicy{KeepLast: 2}, true)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"oci.jarosik.online/testrepo/a:v1", "oci.jarosik.online/testrepo/a:v2"}, refs(pruned))
+		assert.DirExists(t, lm.refToDir(mustParseRef(t, "oci.jarosik.online/testrepo/a:v1")), "dry run must not remove anything")
+	})
+
+	t.Run("max store size", func(t *testing.T) {
+		lm := prepare(t)
+		pruned, err := lm.Prune(PrunePolicy{MaxStoreSize: 250}, false)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"oci.jarosik.online/testrepo/b:v1", "oci.jarosik.online/testrepo/a:v1", "oci.jarosik.online/testrepo/a:v2"}, refs(pruned))
+		assert.Equal(t, "store larger than 250 bytes", pruned[0].Reason)
+	})
+
+	t.Run("pinned images are kept", func(t *testing.T) {
+		lm := prepare(t)
+		pinned := mustParseRef(t, "oci.jarosik.online/testrepo/b:v1")
+		require.NoError(t, lm.Pin(pinned))
+		pruned, err := lm.Prune(PrunePolicy{OlderThan: 72*time.Hour + time.Minute, MaxStoreSize: 250}, false)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"oci.jarosik.online/testrepo/a:v1", "oci.jarosik.online/testrepo/a:v2", "oci.jarosik.online/testrepo/a:v3"}, refs(pruned))
+		assert.DirExists(t, lm.refToDir(pinned))
+		assert.ErrorIs(t, lm.Remove(pinned), ErrPinned)
+
+		require.NoError(t, lm.Unpin(pinned))
+		leftovers, err := filepath.Glob(lm.pinsPath() + ".*.tmp")
+		require.NoError(t, err)
+		assert.Empty(t, leftovers)
+		require.NoError(t, lm.Remove(pinned))
+		assert.NoDirExists(t, lm.refToDir(pinned))
+	})
+
+	t.Run("using image refreshes its last access", func(t *testing.T) {
+		lm := prepare(t)
+		_, err := lm.Read(context.Background(), mustParseRef(t, "oci.jarosik.online/testrepo/b:v1"))
+		require.NoError(t, err)
+		accessed, err := lm.LastAccess(mustParseRef(t, "oci.jarosik.online/testrepo/b:v1"))
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now(), accessed, time.Minute)
+	})
+}
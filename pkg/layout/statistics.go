@@ -13,6 +13,8 @@ type Statistics struct {
 	BytesClonedCount     atomic.Int64
 	CompressedBytesCount atomic.Int64
 	MatchedSegmentsCount atomic.Int64
+	// IdenticalFilesCount counts files cloned from identical files of local images, which skipped verification
+	IdenticalFilesCount atomic.Int64
 }
 
 func (s *Statistics) Add(other *Statistics) {
@@ -22,6 +24,7 @@ func (s *Statistics) Add(other *Statistics) {
 	s.BytesClonedCount.Add(other.BytesClonedCount.Load())
 	s.CompressedBytesCount.Add(other.CompressedBytesCount.Load())
 	s.MatchedSegmentsCount.Add(other.MatchedSegmentsCount.Load())
+	s.IdenticalFilesCount.Add(other.IdenticalFilesCount.Load())
 	s.SourceBytesCount.Add(other.SourceBytesCount.Load())
 }
 
@@ -32,6 +35,7 @@ func (s *Statistics) Clear() {
 	s.BytesClonedCount.Store(0)
 	s.CompressedBytesCount.Store(0)
 	s.MatchedSegmentsCount.Store(0)
+	s.IdenticalFilesCount.Store(0)
 }
 
 // String formats the Statistics struct for human-readable output
@@ -43,14 +47,16 @@ func (s *Statistics) String() string {
 		"BytesReadCount: %d\n"+
 		"BytesClonedCount: %d\n"+
 		"CompressedBytesCount: %d\n"+
-		"MatchedSegmentsCount: %d\n",
+		"MatchedSegmentsCount: %d\n"+
+		"IdenticalFilesCount: %d\n",
 		s.SourceBytesCount.Load(),
 		s.BytesWrittenCount.Load(),
 		s.BytesSkippedCount.Load(),
 		s.BytesReadCount.Load(),
 		s.BytesClonedCount.Load(),
 		s.CompressedBytesCount.Load(),
-		s.MatchedSegmentsCount.Load())
+		s.MatchedSegmentsCount.Load(),
+		s.IdenticalFilesCount.Load())
 }
 
 // ImmutableStatistics holds the immutable copy of statistics
@@ -62,4 +68,7 @@ type ImmutableStatistics struct {
 	BytesClonedCount     int64
 	CompressedBytesCount int64
 	MatchedSegmentsCount int64
+	IdenticalFilesCount  int64
+	// CloneStrategies counts files cloned with each duplicator strategy, by its name
+	CloneStrategies map[string]int64
 }
@@ -0,0 +1,50 @@
+package layout
+
+import (
+	"context"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayoutMapper_CandidateRoots(t *testing.T) {
+	ctx := context.Background()
+	archiveDir, scratchDir := t.TempDir(), t.TempDir()
+	src := mustParseRef(t, "oci.jarosik.online/testrepo/a:v1")
+	archive := NewMapper(archiveDir, dirimage.WithChunkSize(1024))
+	require.NoError(t, os.MkdirAll(archive.refToDir(src), os.ModePerm))
+	require.NoError(t, generateRandomFile(filepath.Join(archive.refToDir(src), "disk.img"), 8*1024))
+	img, err := archive.Read(ctx, src)
+	require.NoError(t, err)
+	require.NoError(t, img.(*dirimage.DirImage).WriteConfigAndManifest(archive.refToDir(src)))
+
+	t.Run("pulled image is cloned from another store", func(t *testing.T) {
+		scratch := NewMapper(scratchDir, dirimage.WithChunkSize(1024))
+		scratch.AddCandidateRoots(scratchDir, archiveDir)
+		dst := mustParseRef(t, "oci.jarosik.online/testrepo/a:v2")
+		require.NoError(t, scratch.Write(ctx, img, dst))
+		st := scratch.Stats()
+		assert.Equal(t, int64(8*1024), st.BytesClonedCount)
+		assert.Equal(t, int64(0), st.BytesWrittenCount)
+		assert.Equal(t, hashFromFile(t, filepath.Join(archive.refToDir(src), "disk.img")), hashFromFile(t, filepath.Join(scratch.refToDir(dst), "disk.img")))
+	})
+
+	t.Run("clone from another store", func(t *testing.T) {
+		scratch := NewMapper(scratchDir)
+		dst := mustParseRef(t, "oci.jarosik.online/testrepo/b:v1")
+		require.NoError(t, scratch.CloneFrom(ctx, archive, src, dst))
+		assert.FileExists(t, filepath.Join(scratch.refToDir(dst), "disk.img"))
+		assert.NoDirExists(t, archive.refToDir(dst))
+	})
+
+	t.Run("unavailable store is skipped", func(t *testing.T) {
+		scratch := NewMapper(t.TempDir(), dirimage.WithChunkSize(1024))
+		missing := filepath.Join(t.TempDir(), "unmounted")
+		scratch.AddCandidateRoots(missing)
+		require.NoError(t, scratch.Write(ctx, img, mustParseRef(t, "oci.jarosik.online/testrepo/a:v3")))
+		assert.NoDirExists(t, missing)
+	})
+}
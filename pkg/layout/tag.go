@@ -0,0 +1,136 @@
+package layout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/macvmio/geranos/pkg/duplicator"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// Tag makes dst refer to the same image as src without copying its content, like docker tag. Files are cloned
+// sharing extents with Copy-on-Write, or hard linked where the filesystem can not share them, in which case
+// neither image may be modified afterwards. Existing image of dst is replaced only once the new one is complete.
+// It reports whether any file was hard linked.
+func (lm *Mapper) Tag(ctx context.Context, src name.Reference, dst name.Reference) (bool, error) {
+	src, err := lm.Resolve(src)
+	if err != nil {
+		return false, err
+	}
+	srcDir, dstDir := lm.refToDir(src), lm.refToDir(dst)
+	if srcDir == dstDir {
+		return false, fmt.Errorf("%v is already tagged as %v", src, dst)
+	}
+	if info, err := os.Stat(srcDir); err != nil || !info.IsDir() {
+		return false, fmt.Errorf("image %v not found", src)
+	}
+	pinned, err := lm.IsPinned(dst)
+	if err != nil {
+		return false, err
+	}
+	if pinned {
+		return false, fmt.Errorf("unable to replace %v: %w, unpin it first", dst, ErrPinned)
+	}
+
+	sharing := duplicator.SharingStrategies()
+	var cloner *duplicator.Cloner
+	if len(sharing) > 0 {
+		cloner = duplicator.NewCloner(sharing...)
+	}
+	linked := atomic.Bool{}
+	cloneFile := func(srcFile, dstFile string) error {
+		if cloner != nil {
+			err := cloner.CloneFile(srcFile, dstFile)
+			if err == nil {
+				return nil
+			}
+			_ = os.Remove(dstFile)
+			if linkErr := os.Link(srcFile, dstFile); linkErr != nil {
+				return errors.Join(err, linkErr)
+			}
+		} else if err := os.Link(srcFile, dstFile); err != nil {
+			return err
+		}
+		linked.Store(true)
+		return nil
+	}
+
+	stagingDir := hiddenSibling(dstDir, "staging")
+	if err := os.MkdirAll(filepath.Dir(stagingDir), os.ModePerm); err != nil {
+		return false, fmt.Errorf("unable to create directory for tagging: %w", err)
+	}
+	err = duplicator.CloneDirectory(ctx, srcDir, stagingDir, true,
+		duplicator.WithCloneFunction(cloneFile), lm.reportCloned())
+	if err == nil {
+		err = replaceDir(dstDir, stagingDir)
+	}
+	if err != nil {
+		_ = os.RemoveAll(stagingDir)
+		return false, fmt.Errorf("unable to tag %v as %v: %w", src, dst, err)
+	}
+	lm.touch(dstDir)
+	lm.updateIndex(dstDir)
+	return linked.Load(), nil
+}
+
+// hiddenSibling returns a hidden directory name next to dir. Names starting with a dot are never valid
+// references, so such directories are not visible as images, and CollectGarbage removes stale ones by kind.
+func hiddenSibling(dir string, kind string) string {
+	suffix := strconv.FormatInt(sysenv.SystemRand.Int63(), 36)
+	return filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+"."+kind+"-"+suffix)
+}
+
+// replaceDir atomically replaces dir with newDir. Previous content is moved aside first,
+// and restored if newDir could not be moved into place.
+func replaceDir(dir string, newDir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return os.Rename(newDir, dir)
+	}
+	oldDir := hiddenSibling(dir, "old")
+	if err := os.Rename(dir, oldDir); err != nil {
+		return fmt.Errorf("unable to move previous image aside: %w", err)
+	}
+	if err := os.Rename(newDir, dir); err != nil {
+		if restoreErr := os.Rename(oldDir, dir); restoreErr != nil {
+			fmt.Printf("unable to restore previous image from '%v': %v\n", oldDir, restoreErr)
+		}
+		return fmt.Errorf("unable to move new image into place: %w", err)
+	}
+	if err := os.RemoveAll(oldDir); err != nil {
+		fmt.Printf("unable to remove previous image at '%v': %v\n", oldDir, err)
+	}
+	return nil
+}
+
+// Tags returns sorted tags of local images of repo, which are directories next to each other.
+func (lm *Mapper) Tags(repo name.Repository) ([]string, error) {
+	dir := filepath.Dir(lm.refToDir(repo.Tag(name.DefaultTag)))
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0)
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		ref, err := lm.dirToRef(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		if tag, ok := ref.(name.Tag); ok && tag.Context().String() == repo.String() {
+			res = append(res, tag.TagStr())
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
@@ -0,0 +1,59 @@
+package layout
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayoutMapper_Tag(t *testing.T) {
+	ctx := context.Background()
+	lm := NewMapper(t.TempDir())
+	src := mustParseRef(t, "oci.jarosik.online/testrepo/a:v1")
+	dst := mustParseRef(t, "oci.jarosik.online/testrepo/b:latest")
+	srcDir, dstDir := lm.refToDir(src), lm.refToDir(dst)
+	require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "sub"), os.ModePerm))
+	require.NoError(t, generateRandomFile(filepath.Join(srcDir, "disk.img"), 1024))
+	require.NoError(t, generateRandomFile(filepath.Join(srcDir, "sub", "nvram.bin"), 100))
+	// previous image of dst is replaced
+	require.NoError(t, os.MkdirAll(dstDir, os.ModePerm))
+	require.NoError(t, generateRandomFile(filepath.Join(dstDir, "stale.img"), 100))
+
+	_, err := lm.Tag(ctx, src, dst)
+	require.NoError(t, err)
+	assert.Equal(t, hashFromFile(t, filepath.Join(srcDir, "disk.img")), hashFromFile(t, filepath.Join(dstDir, "disk.img")))
+	assert.Equal(t, hashFromFile(t, filepath.Join(srcDir, "sub", "nvram.bin")), hashFromFile(t, filepath.Join(dstDir, "sub", "nvram.bin")))
+	assert.NoFileExists(t, filepath.Join(dstDir, "stale.img"))
+	entries, err := os.ReadDir(filepath.Dir(dstDir))
+	require.NoError(t, err)
+	assert.Len(t, entries, 2, "no staging directories are left")
+
+	t.Run("pinned destination is not replaced", func(t *testing.T) {
+		require.NoError(t, lm.Pin(dst))
+		_, err := lm.Tag(ctx, src, dst)
+		assert.ErrorIs(t, err, ErrPinned)
+	})
+
+	t.Run("missing source", func(t *testing.T) {
+		_, err := lm.Tag(ctx, mustParseRef(t, "oci.jarosik.online/testrepo/a:missing"), mustParseRef(t, "oci.jarosik.online/testrepo/c:v1"))
+		assert.Error(t, err)
+	})
+}
+
+func TestLayoutMapper_Tags(t *testing.T) {
+	lm := NewMapper(t.TempDir())
+	for _, ref := range []string{"oci.jarosik.online/testrepo/a:v2", "oci.jarosik.online/testrepo/a:v1",
+		"oci.jarosik.online/testrepo/ab:v3", "oci.jarosik.online/testrepo/a/nested:v4"} {
+		require.NoError(t, os.MkdirAll(lm.refToDir(mustParseRef(t, ref)), os.ModePerm))
+	}
+	tags, err := lm.Tags(mustParseRef(t, "oci.jarosik.online/testrepo/a:v1").Context())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v1", "v2"}, tags)
+
+	tags, err = lm.Tags(mustParseRef(t, "oci.jarosik.online/other/a:v1").Context())
+	require.NoError(t, err)
+	assert.Empty(t, tags)
+}
@@ -0,0 +1,165 @@
+package layout
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ImageUsage is how much disk space a local image takes, see Mapper.DiskUsage.
+type ImageUsage struct {
+	Ref name.Reference
+	// LogicalSize is the apparent size of files of the image
+	LogicalSize int64
+	// AllocatedSize is the size of blocks allocated to files of the image, holes of sparse files take none
+	AllocatedSize int64
+	// ExclusiveSize is allocated bytes nothing else shares, which removing the image would reclaim
+	ExclusiveSize int64
+	// SharedSize is allocated bytes shared with other images or files, through reflinks or hard links
+	SharedSize int64
+	// Estimated reports that extents of files could not be inspected, so only hard links count as shared
+	Estimated bool
+}
+
+// physicalExtent is a range of blocks of a device holding data of a file.
+type physicalExtent struct {
+	Physical int64
+	Length   int64
+	// Shared reports the filesystem knows the blocks are used by other files as well
+	Shared bool
+}
+
+// usageExtent is physicalExtent of a file of the image with index image.
+type usageExtent struct {
+	physicalExtent
+	image int
+}
+
+// DiskUsage returns disk usage of all local images, sorted by reference. Blocks shared between images, or with
+// the content store, are found by inspecting physical extents of their files (FIEMAP on Linux). Where extents
+// are not available, only hard links are known to be shared, and ImageUsage.Estimated is set.
+func (lm *Mapper) DiskUsage() ([]ImageUsage, error) {
+	dirs, err := lm.imageDirs()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]ImageUsage, len(dirs))
+	// images by inode, so hard links are counted once per image
+	inodes := make(map[fileID]map[int]struct{})
+	// allocated size of inodes of every image whose extents are not available
+	withoutExtents := make(map[fileID]map[int]int64)
+	extents := make(map[uint64][]usageExtent)
+	for i, dir := range dirs {
+		ref, err := lm.dirToRef(dir)
+		if err != nil {
+			return nil, err
+		}
+		res[i].Ref = ref
+		err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && path != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := os.Lstat(path)
+			if err != nil {
+				return err
+			}
+			id, allocated := fileUsage(path, info)
+			res[i].LogicalSize += info.Size()
+			res[i].AllocatedSize += allocated
+			if _, ok := inodes[id]; !ok {
+				inodes[id] = make(map[int]struct{})
+			}
+			if _, seen := inodes[id][i]; seen {
+				return nil
+			}
+			inodes[id][i] = struct{}{}
+			fileExtents, ok, err := physicalExtents(path)
+			if err != nil {
+				return fmt.Errorf("unable to get extents of '%v': %w", path, err)
+			}
+			if !ok {
+				res[i].Estimated = true
+				if _, ok := withoutExtents[id]; !ok {
+					withoutExtents[id] = make(map[int]int64)
+				}
+				withoutExtents[id][i] = allocated
+				return nil
+			}
+			for _, e := range fileExtents {
+				extents[id.dev] = append(extents[id.dev], usageExtent{physicalExtent: e, image: i})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to get disk usage of %v: %w", ref, err)
+		}
+	}
+	for _, devExtents := range extents {
+		sweepExtents(devExtents, res)
+	}
+	for id, images := range withoutExtents {
+		for i, allocated := range images {
+			if len(inodes[id]) > 1 {
+				res[i].SharedSize += allocated
+			} else {
+				res[i].ExclusiveSize += allocated
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Ref.String() < res[j].Ref.String()
+	})
+	return res, nil
+}
+
+// sweepExtents adds bytes of extents of one device to ExclusiveSize or SharedSize of their images. A range
+// is exclusive when all extents covering it belong to a single image, and none of them is known to be shared.
+func sweepExtents(extents []usageExtent, res []ImageUsage) {
+	type event struct {
+		offset int64
+		delta  int
+		usageExtent
+	}
+	events := make([]event, 0, 2*len(extents))
+	for _, e := range extents {
+		if e.Length <= 0 {
+			continue
+		}
+		events = append(events, event{e.Physical, 1, e}, event{e.Physical + e.Length, -1, e})
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].offset < events[j].offset
+	})
+	active := make(map[int]int)
+	sharedActive := 0
+	for i, ev := range events {
+		active[ev.image] += ev.delta
+		if active[ev.image] == 0 {
+			delete(active, ev.image)
+		}
+		if ev.Shared {
+			sharedActive += ev.delta
+		}
+		if i+1 == len(events) || len(active) == 0 {
+			continue
+		}
+		length := events[i+1].offset - ev.offset
+		for image := range active {
+			if len(active) == 1 && sharedActive == 0 {
+				res[image].ExclusiveSize += length
+			} else {
+				res[image].SharedSize += length
+			}
+		}
+	}
+}
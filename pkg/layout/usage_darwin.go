@@ -0,0 +1,6 @@
+package layout
+
+// physicalExtents reports false, as APFS does not tell where blocks of files are.
+func physicalExtents(path string) ([]physicalExtent, bool, error) {
+	return nil, false, nil
+}
@@ -0,0 +1,79 @@
+package layout
+
+import (
+	"errors"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// constants and structures of linux/fiemap.h, which golang.org/x/sys/unix does not provide
+const (
+	fsIocFiemap          = 0xC020660B
+	fiemapFlagSync       = 0x1
+	fiemapExtentLast     = 0x1
+	fiemapExtentUnknown  = 0x2
+	fiemapExtentInline   = 0x200
+	fiemapExtentShared   = 0x2000
+	fiemapExtentsPerCall = 256
+)
+
+type fiemapExtent struct {
+	Logical    uint64
+	Physical   uint64
+	Length     uint64
+	reserved64 [2]uint64
+	Flags      uint32
+	reserved   [3]uint32
+}
+
+type fiemap struct {
+	Start         uint64
+	Length        uint64
+	Flags         uint32
+	MappedExtents uint32
+	ExtentCount   uint32
+	reserved      uint32
+	Extents       [fiemapExtentsPerCall]fiemapExtent
+}
+
+// physicalExtents returns extents of the file at path with FIEMAP. It reports false when the filesystem
+// does not support it, or locations of some extents are unknown.
+func physicalExtents(path string) ([]physicalExtent, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	res := make([]physicalExtent, 0)
+	fm := &fiemap{}
+	for start := uint64(0); ; {
+		*fm = fiemap{Start: start, Length: ^uint64(0) - start, Flags: fiemapFlagSync, ExtentCount: fiemapExtentsPerCall}
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(fm)))
+		if errno != 0 {
+			if errors.Is(errno, unix.EOPNOTSUPP) || errors.Is(errno, unix.ENOTTY) || errors.Is(errno, unix.EINVAL) {
+				return nil, false, nil
+			}
+			return nil, false, errno
+		}
+		if fm.MappedExtents == 0 {
+			return res, true, nil
+		}
+		for _, e := range fm.Extents[:fm.MappedExtents] {
+			if e.Flags&(fiemapExtentUnknown|fiemapExtentInline) != 0 {
+				return nil, false, nil
+			}
+			res = append(res, physicalExtent{
+				Physical: int64(e.Physical),
+				Length:   int64(e.Length),
+				Shared:   e.Flags&fiemapExtentShared != 0,
+			})
+			if e.Flags&fiemapExtentLast != 0 {
+				return res, true, nil
+			}
+			start = e.Logical + e.Length
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package layout
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestLayoutMapper_DiskUsage(t *testing.T) {
+	if runtime.GOOS == OSWindows {
+		t.Skip("hard links and sparse files are not reported on windows")
+	}
+	tempDir := t.TempDir()
+	lm := NewMapper(tempDir)
+	dirA := lm.refToDir(mustParseRef(t, "oci.jarosik.online/testrepo/a:v1"))
+	dirB := lm.refToDir(mustParseRef(t, "oci.jarosik.online/testrepo/b:v1"))
+	require.NoError(t, os.MkdirAll(dirA, os.ModePerm))
+	require.NoError(t, os.MkdirAll(dirB, os.ModePerm))
+	require.NoError(t, generateRandomFile(filepath.Join(dirA, "disk.img"), 1024*1024))
+	require.NoError(t, generateRandomFile(filepath.Join(dirA, "own.img"), 64*1024))
+	require.NoError(t, os.Link(filepath.Join(dirA, "disk.img"), filepath.Join(dirB, "disk.img")))
+	// sparse file allocates nothing
+	f, err := os.Create(filepath.Join(dirB, "sparse.img"))
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(10*1024*1024))
+	require.NoError(t, f.Close())
+
+	usage, err := lm.DiskUsage()
+	require.NoError(t, err)
+	require.Len(t, usage, 2)
+	a, b := usage[0], usage[1]
+	assert.Equal(t, "oci.jarosik.online/testrepo/a:v1", a.Ref.String())
+	assert.Equal(t, int64(1024*1024+64*1024), a.LogicalSize)
+	assert.Equal(t, int64(1024*1024+10*1024*1024), b.LogicalSize)
+	assert.Less(t, b.AllocatedSize, int64(2*1024*1024), "holes must not count as allocated")
+
+	assert.Equal(t, a.AllocatedSize, a.ExclusiveSize+a.SharedSize)
+	assert.GreaterOrEqual(t, a.SharedSize, int64(1024*1024), "hard link is shared with b")
+	assert.GreaterOrEqual(t, a.ExclusiveSize, int64(64*1024))
+	assert.Equal(t, int64(0), b.ExclusiveSize)
+	assert.Equal(t, b.AllocatedSize, b.SharedSize)
+}
@@ -0,0 +1,23 @@
+//go:build linux || darwin
+
+package layout
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID identifies a file by its inode, so hard links of it are recognized.
+type fileID struct {
+	dev, ino uint64
+	path     string
+}
+
+// fileUsage returns identity of the file at path and how many bytes of blocks are allocated to it.
+func fileUsage(path string, info os.FileInfo) (fileID, int64) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{path: path}, info.Size()
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, int64(st.Blocks) * 512
+}
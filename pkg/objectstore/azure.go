@@ -0,0 +1,48 @@
+package objectstore
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const azureAPIVersion = "2021-08-06"
+
+// newAzureBucket returns bucket of container of Azure Blob Storage account, given as
+// azblob://account/container/prefix, and the prefix.
+func newAzureBucket(u *url.URL, o *options) (Bucket, string, error) {
+	account := u.Host
+	container, prefix, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if account == "" || container == "" {
+		return nil, "", fmt.Errorf("expected azblob://account/container, got '%v'", u)
+	}
+	base := fmt.Sprintf("https://%v.blob.core.windows.net", account)
+	if endpoint := u.Query().Get("endpoint"); endpoint != "" {
+		base = strings.TrimSuffix(endpoint, "/")
+	}
+	base += "/" + container
+	sas, err := url.ParseQuery(strings.TrimPrefix(o.getenv("AZURE_STORAGE_SAS_TOKEN"), "?"))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid AZURE_STORAGE_SAS_TOKEN: %w", err)
+	}
+	b := &httpBucket{
+		client: o.client,
+		objectURL: func(key string) string {
+			return base + "/" + escapePath(key)
+		},
+		authorize: func(req *http.Request) error {
+			q := req.URL.Query()
+			for k, vs := range sas {
+				q[k] = vs
+			}
+			req.URL.RawQuery = q.Encode()
+			req.Header.Set("x-ms-version", azureAPIVersion)
+			if req.Method == http.MethodPut {
+				req.Header.Set("x-ms-blob-type", "BlockBlob")
+			}
+			return nil
+		},
+	}
+	return b, prefix, nil
+}
@@ -0,0 +1,122 @@
+// Package objectstore keeps images in object storage buckets, for teams without a registry able to hold blobs
+// of VM images. Buckets are addressed by URLs: file:///path, s3://bucket/prefix, gs://bucket/prefix and
+// azblob://account/container/prefix.
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ErrNotFound is returned by Bucket.Get for missing objects.
+var ErrNotFound = errors.New("object not found")
+
+// Bucket is a flat namespace of objects addressed by slash-separated keys.
+type Bucket interface {
+	// Get returns content of object key, ErrNotFound when it does not exist.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Put stores size bytes of r as object key, replacing existing one.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Exists reports whether object key exists.
+	Exists(ctx context.Context, key string) (bool, error)
+}
+
+type options struct {
+	client *http.Client
+	getenv func(string) string
+}
+
+type Option func(o *options)
+
+// WithHTTPClient sets client used by remote buckets, http.DefaultClient by default.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.client = client
+	}
+}
+
+// WithGetenv sets function reading credentials from environment, os.Getenv by default.
+func WithGetenv(getenv func(string) string) Option {
+	return func(o *options) {
+		o.getenv = getenv
+	}
+}
+
+// Open returns bucket of rawURL. Keys are relative to the path of the URL, so many stores can share a bucket.
+//
+// s3:// and gs:// buckets are signed with AWS Signature Version 4, using AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, HMAC keys for gs://, and AWS_REGION for s3://.
+// S3-compatible servers, like MinIO, are given with endpoint query parameter and addressed path-style.
+// azblob:// buckets are authorized with AZURE_STORAGE_SAS_TOKEN, endpoint overrides the blob service URL.
+func Open(rawURL string, opt ...Option) (Bucket, error) {
+	o := &options{client: http.DefaultClient, getenv: osGetenv}
+	for _, f := range opt {
+		f(o)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bucket URL '%v': %w", rawURL, err)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	var b Bucket
+	switch u.Scheme {
+	case "file":
+		return &dirBucket{root: u.Path}, nil
+	case "s3":
+		b, err = newS3Bucket(u, o)
+	case "gs":
+		b, err = newGCSBucket(u, o)
+	case "azblob":
+		b, prefix, err = newAzureBucket(u, o)
+	default:
+		return nil, fmt.Errorf("unsupported bucket URL scheme '%v'", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if prefix == "" {
+		return b, nil
+	}
+	return &prefixedBucket{Bucket: b, prefix: prefix}, nil
+}
+
+// prefixedBucket stores objects of Bucket under prefix.
+type prefixedBucket struct {
+	Bucket
+	prefix string
+}
+
+func (b *prefixedBucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	return b.Bucket.Get(ctx, path.Join(b.prefix, key))
+}
+
+func (b *prefixedBucket) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	return b.Bucket.Put(ctx, path.Join(b.prefix, key), r, size)
+}
+
+func (b *prefixedBucket) Exists(ctx context.Context, key string) (bool, error) {
+	if err := validateKey(key); err != nil {
+		return false, err
+	}
+	return b.Bucket.Exists(ctx, path.Join(b.prefix, key))
+}
+
+// validateKey rejects keys escaping the bucket, or its prefix.
+func validateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.HasPrefix(key, "..") {
+		return fmt.Errorf("invalid object key '%v'", key)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package objectstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// httpBucket is a bucket of an object storage service with REST API, where objects are read with GET,
+// written with PUT and checked with HEAD of their URLs.
+type httpBucket struct {
+	client *http.Client
+	// objectURL returns URL of object key
+	objectURL func(key string) string
+	// authorize adds credentials to request
+	authorize func(req *http.Request) error
+}
+
+func (b *httpBucket) do(ctx context.Context, method string, key string, body io.Reader, size int64) (*http.Response, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, b.objectURL(key), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if err := b.authorize(req); err != nil {
+		return nil, fmt.Errorf("unable to authorize request: %w", err)
+	}
+	return b.client.Do(req)
+}
+
+// checkResponse returns error for unsuccessful responses, ErrNotFound for missing objects.
+func checkResponse(resp *http.Response, key string) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%v: %w", key, ErrNotFound)
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("unexpected status %v for %v: %v", resp.Status, key, strings.TrimSpace(string(msg)))
+}
+
+func (b *httpBucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := b.do(ctx, http.MethodGet, key, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp, key); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b *httpBucket) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	resp, err := b.do(ctx, http.MethodPut, key, r, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp, key)
+}
+
+func (b *httpBucket) Exists(ctx context.Context, key string) (bool, error) {
+	resp, err := b.do(ctx, http.MethodHead, key, nil, 0)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err := checkResponse(resp, key); err != nil {
+		return false, err
+	}
+	return true, nil
+}
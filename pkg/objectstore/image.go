@@ -0,0 +1,273 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"golang.org/x/sync/errgroup"
+	"hash"
+	"io"
+	"path"
+	"strings"
+)
+
+// Images are kept in buckets like in OCI image layouts: blobs, manifests included, are objects
+// blobs/<algorithm>/<hex> shared by all repositories, and tags are objects <repository>/tags/<tag>
+// holding digest of the manifest they refer to.
+const blobsPrefix = "blobs"
+
+func blobKey(h v1.Hash) string {
+	return path.Join(blobsPrefix, h.Algorithm, h.Hex)
+}
+
+func tagKey(tag name.Tag) string {
+	return path.Join(tag.RepositoryStr(), "tags", tag.TagStr())
+}
+
+// WriteImage uploads blobs of img the bucket does not have yet, up to concurrency at the same time, then
+// its manifest, and then points tag of ref at it, so an image is never visible before it is complete.
+func WriteImage(ctx context.Context, b Bucket, ref name.Reference, img v1.Image, concurrency int) error {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(concurrency, 1))
+	seen := make(map[v1.Hash]struct{})
+	for _, desc := range manifest.Layers {
+		if _, ok := seen[desc.Digest]; ok {
+			continue
+		}
+		seen[desc.Digest] = struct{}{}
+		g.Go(func() error {
+			return writeLayer(gctx, b, img, desc)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	if err := putBlob(ctx, b, manifest.Config.Digest, rawConfig); err != nil {
+		return err
+	}
+	rawManifest, err := img.RawManifest()
+	if err != nil {
+		return err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	if err := putBlob(ctx, b, digest, rawManifest); err != nil {
+		return err
+	}
+	if tag, ok := ref.(name.Tag); ok {
+		data := []byte(digest.String())
+		if err := b.Put(ctx, tagKey(tag), bytes.NewReader(data), int64(len(data))); err != nil {
+			return fmt.Errorf("unable to tag %v: %w", ref, err)
+		}
+	}
+	return nil
+}
+
+func writeLayer(ctx context.Context, b Bucket, img v1.Image, desc v1.Descriptor) error {
+	exists, err := b.Exists(ctx, blobKey(desc.Digest))
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	l, err := img.LayerByDigest(desc.Digest)
+	if err != nil {
+		return err
+	}
+	rc, err := l.Compressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	vr, err := newVerifiedBlob(rc, desc.Digest)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(ctx, blobKey(desc.Digest), vr, desc.Size); err != nil {
+		return fmt.Errorf("unable to upload layer %v: %w", desc.Digest, err)
+	}
+	return nil
+}
+
+// BlobExists reports whether the bucket has blob of digest h.
+func BlobExists(ctx context.Context, b Bucket, h v1.Hash) (bool, error) {
+	return b.Exists(ctx, blobKey(h))
+}
+
+func putBlob(ctx context.Context, b Bucket, h v1.Hash, data []byte) error {
+	if err := b.Put(ctx, blobKey(h), bytes.NewReader(data), int64(len(data))); err != nil {
+		return fmt.Errorf("unable to upload %v: %w", h, err)
+	}
+	return nil
+}
+
+// ReadImage returns image of ref in the bucket. Layers are downloaded, and verified, when they are read.
+func ReadImage(ctx context.Context, b Bucket, ref name.Reference) (v1.Image, error) {
+	var digest v1.Hash
+	switch r := ref.(type) {
+	case name.Digest:
+		h, err := v1.NewHash(r.DigestStr())
+		if err != nil {
+			return nil, err
+		}
+		digest = h
+	case name.Tag:
+		data, err := readAll(ctx, b, tagKey(r))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read tag %v: %w", ref, err)
+		}
+		h, err := v1.NewHash(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %v: %w", ref, err)
+		}
+		digest = h
+	default:
+		return nil, fmt.Errorf("unsupported reference %v", ref)
+	}
+	rawManifest, err := readBlob(ctx, b, digest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read manifest of %v: %w", ref, err)
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(rawManifest))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse manifest of %v: %w", ref, err)
+	}
+	rawConfig, err := readBlob(ctx, b, manifest.Config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config of %v: %w", ref, err)
+	}
+	return partial.CompressedToImage(&bucketImage{
+		ctx:         ctx,
+		bucket:      b,
+		rawManifest: rawManifest,
+		rawConfig:   rawConfig,
+		manifest:    manifest,
+	})
+}
+
+func readAll(ctx context.Context, b Bucket, key string) ([]byte, error) {
+	rc, err := b.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func readBlob(ctx context.Context, b Bucket, h v1.Hash) ([]byte, error) {
+	rc, err := b.Get(ctx, blobKey(h))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	vr, err := newVerifiedBlob(rc, h)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(vr)
+}
+
+type bucketImage struct {
+	ctx         context.Context
+	bucket      Bucket
+	rawManifest []byte
+	rawConfig   []byte
+	manifest    *v1.Manifest
+}
+
+func (i *bucketImage) RawConfigFile() ([]byte, error) {
+	return i.rawConfig, nil
+}
+
+func (i *bucketImage) MediaType() (types.MediaType, error) {
+	return i.manifest.MediaType, nil
+}
+
+func (i *bucketImage) RawManifest() ([]byte, error) {
+	return i.rawManifest, nil
+}
+
+func (i *bucketImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	for _, desc := range i.manifest.Layers {
+		if desc.Digest == h {
+			return &bucketLayer{image: i, desc: desc}, nil
+		}
+	}
+	return nil, fmt.Errorf("layer %v not found in manifest", h)
+}
+
+type bucketLayer struct {
+	image *bucketImage
+	desc  v1.Descriptor
+}
+
+func (l *bucketLayer) Digest() (v1.Hash, error) {
+	return l.desc.Digest, nil
+}
+
+func (l *bucketLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.image.bucket.Get(l.image.ctx, blobKey(l.desc.Digest))
+	if err != nil {
+		return nil, err
+	}
+	vr, err := newVerifiedBlob(rc, l.desc.Digest)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{vr, rc}, nil
+}
+
+func (l *bucketLayer) Size() (int64, error) {
+	return l.desc.Size, nil
+}
+
+func (l *bucketLayer) MediaType() (types.MediaType, error) {
+	return l.desc.MediaType, nil
+}
+
+// verifiedBlob fails at the end of r when its content does not have digest expected.
+type verifiedBlob struct {
+	r        io.Reader
+	h        hash.Hash
+	expected v1.Hash
+}
+
+func newVerifiedBlob(r io.Reader, expected v1.Hash) (io.Reader, error) {
+	h, err := v1.Hasher(expected.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &verifiedBlob{r: r, h: h, expected: expected}, nil
+}
+
+func (vb *verifiedBlob) Read(p []byte) (int, error) {
+	n, err := vb.r.Read(p)
+	vb.h.Write(p[:n])
+	if errors.Is(err, io.EOF) {
+		if actual := hex.EncodeToString(vb.h.Sum(nil)); actual != vb.expected.Hex {
+			return n, fmt.Errorf("digest mismatch of %v: got %v:%v", vb.expected, vb.expected.Algorithm, actual)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,51 @@
+package objectstore
+
+import (
+	"context"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteReadImage(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	b, err := Open("file://" + filepath.ToSlash(dir))
+	require.NoError(t, err)
+	img, err := random.Image(1024, 3)
+	require.NoError(t, err)
+	ref, err := name.ParseReference("example.com/vms/macos:14")
+	require.NoError(t, err)
+
+	require.NoError(t, WriteImage(ctx, b, ref, img, 2))
+	assert.FileExists(t, filepath.Join(dir, "vms", "macos", "tags", "14"))
+
+	read, err := ReadImage(ctx, b, ref)
+	require.NoError(t, err)
+	expected, err := img.Digest()
+	require.NoError(t, err)
+	actual, err := read.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+	byDigest, err := ReadImage(ctx, b, ref.Context().Digest(expected.String()))
+	require.NoError(t, err)
+	layers, err := byDigest.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 3)
+
+	t.Run("corrupted layer", func(t *testing.T) {
+		d, err := layers[0].Digest()
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "blobs", d.Algorithm, d.Hex), []byte("corrupted"), 0o644))
+		rc, err := layers[0].Compressed()
+		require.NoError(t, err)
+		defer rc.Close()
+		_, err = io.ReadAll(rc)
+		assert.ErrorContains(t, err, "digest mismatch")
+	})
+}
@@ -0,0 +1,184 @@
+package objectstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// unsignedPayload lets bodies of PUT stream, without hashing them before the request
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	amzDateFormat   = "20060102T150405Z"
+	defaultS3Region = "us-east-1"
+)
+
+// s3Signer signs requests with AWS Signature Version 4.
+type s3Signer struct {
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	now          func() time.Time
+}
+
+func newS3Signer(region string, o *options) *s3Signer {
+	return &s3Signer{
+		region:       region,
+		accessKey:    o.getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    o.getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: o.getenv("AWS_SESSION_TOKEN"),
+		now:          time.Now,
+	}
+}
+
+func newS3Bucket(u *url.URL, o *options) (Bucket, error) {
+	bucket := u.Host
+	if bucket == "" {
+		return nil, fmt.Errorf("missing bucket name in '%v'", u)
+	}
+	region := u.Query().Get("region")
+	if region == "" {
+		region = o.getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = defaultS3Region
+	}
+	base := fmt.Sprintf("https://%v.s3.%v.amazonaws.com", bucket, region)
+	if endpoint := u.Query().Get("endpoint"); endpoint != "" {
+		base = strings.TrimSuffix(endpoint, "/") + "/" + bucket
+	}
+	return newSignedBucket(base, newS3Signer(region, o), o), nil
+}
+
+// newGCSBucket returns bucket of XML API of Google Cloud Storage, which accepts S3 signatures made with HMAC keys.
+func newGCSBucket(u *url.URL, o *options) (Bucket, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing bucket name in '%v'", u)
+	}
+	base := "https://storage.googleapis.com/" + u.Host
+	if endpoint := u.Query().Get("endpoint"); endpoint != "" {
+		base = strings.TrimSuffix(endpoint, "/") + "/" + u.Host
+	}
+	return newSignedBucket(base, newS3Signer("auto", o), o), nil
+}
+
+func newSignedBucket(base string, signer *s3Signer, o *options) Bucket {
+	return &httpBucket{
+		client: o.client,
+		objectURL: func(key string) string {
+			return base + "/" + escapePath(key)
+		},
+		authorize: func(req *http.Request) error {
+			signer.sign(req, unsignedPayload)
+			return nil
+		},
+	}
+}
+
+// sign adds Authorization header to req, leaving it anonymous without credentials, for public buckets.
+func (s *s3Signer) sign(req *http.Request, payloadHash string) {
+	if s.accessKey == "" {
+		return
+	}
+	t := s.now().UTC()
+	amzDate := t.Format(amzDateFormat)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "range" || lk == "content-type" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := strings.Builder{}
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	date := t.Format("20060102")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		vs := append([]string{}, values[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, escape(k)+"="+escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// escape encodes s the way AWS signatures expect, everything but unreserved characters.
+func escape(s string) string {
+	res := strings.Builder{}
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			res.WriteByte(c)
+		} else {
+			fmt.Fprintf(&res, "%%%02X", c)
+		}
+	}
+	return res.String()
+}
+
+// escapePath is escape keeping slashes of key.
+func escapePath(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = escape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
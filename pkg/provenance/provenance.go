@@ -0,0 +1,178 @@
+// Package provenance describes how images were produced with SLSA provenance, in in-toto statements about
+// the image manifest, which are attached to images as attestations.
+package provenance
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// MediaType is media type of in-toto statements, and artifact type of attestations without signature
+	MediaType = "application/vnd.in-toto+json"
+
+	StatementType = "https://in-toto.io/Statement/v1"
+	PredicateType = "https://slsa.dev/provenance/v1"
+	// BuildType is the kind of build recorded by geranos: packaging a directory into an image on push
+	BuildType = "https://github.com/macvmio/geranos/push@v1"
+
+	// PredicateTypeAnnotation names predicate type of attestation layers, like cosign does
+	PredicateTypeAnnotation = "predicateType"
+
+	defaultBuilderID = "https://github.com/macvmio/geranos"
+)
+
+// ResourceDescriptor refers to an artifact by URI and digests of its content.
+type ResourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Provenance is the SLSA provenance predicate.
+type Provenance struct {
+	BuildDefinition struct {
+		BuildType            string               `json:"buildType"`
+		ExternalParameters   map[string]any       `json:"externalParameters"`
+		ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies,omitempty"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID      string            `json:"id"`
+			Version map[string]string `json:"version,omitempty"`
+		} `json:"builder"`
+		Metadata struct {
+			InvocationID string     `json:"invocationId,omitempty"`
+			StartedOn    *time.Time `json:"startedOn,omitempty"`
+			FinishedOn   *time.Time `json:"finishedOn,omitempty"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+// Statement is an in-toto statement about subject images.
+type Statement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     Provenance           `json:"predicate"`
+}
+
+// Build describes how an image was produced.
+type Build struct {
+	// BuilderID is URI of the builder, e.g. the CI workflow, see DefaultBuilderID
+	BuilderID string
+	// BuilderVersion is version of geranos which built the image
+	BuilderVersion string
+	// InvocationID identifies the build run, e.g. URI of the CI job
+	InvocationID string
+	// Parameters are invocation parameters, e.g. flags of push
+	Parameters map[string]any
+	// Source is the directory packaged into the image, and SourceDigest hash of its content, see SourceDigest
+	Source       string
+	SourceDigest v1.Hash
+	StartedOn    time.Time
+	FinishedOn   time.Time
+}
+
+// NewStatement returns in-toto statement with provenance of image manifest of digest in repository name.
+func NewStatement(name string, digest v1.Hash, b Build) ([]byte, error) {
+	var p Provenance
+	p.BuildDefinition.BuildType = BuildType
+	p.BuildDefinition.ExternalParameters = b.Parameters
+	if p.BuildDefinition.ExternalParameters == nil {
+		p.BuildDefinition.ExternalParameters = map[string]any{}
+	}
+	if b.Source != "" {
+		p.BuildDefinition.ResolvedDependencies = []ResourceDescriptor{{
+			Name:   "source",
+			URI:    "file://" + b.Source,
+			Digest: map[string]string{b.SourceDigest.Algorithm: b.SourceDigest.Hex},
+		}}
+	}
+	p.RunDetails.Builder.ID = b.BuilderID
+	if p.RunDetails.Builder.ID == "" {
+		p.RunDetails.Builder.ID = defaultBuilderID
+	}
+	if b.BuilderVersion != "" {
+		p.RunDetails.Builder.Version = map[string]string{"geranos": b.BuilderVersion}
+	}
+	p.RunDetails.Metadata.InvocationID = b.InvocationID
+	if !b.StartedOn.IsZero() {
+		started := b.StartedOn.UTC()
+		p.RunDetails.Metadata.StartedOn = &started
+	}
+	if !b.FinishedOn.IsZero() {
+		finished := b.FinishedOn.UTC()
+		p.RunDetails.Metadata.FinishedOn = &finished
+	}
+	s := Statement{
+		Type: StatementType,
+		Subject: []ResourceDescriptor{{
+			Name:   name,
+			Digest: map[string]string{digest.Algorithm: digest.Hex},
+		}},
+		PredicateType: PredicateType,
+		Predicate:     p,
+	}
+	return json.Marshal(s)
+}
+
+// SourceDigest returns hash of content of the directory img was read from: SHA-256 of sorted lines with name,
+// byte range and digest of uncompressed content of every segment. Unlike the manifest digest, it does not depend
+// on compression or segment size settings of push, only on how files are split into segments.
+func SourceDigest(img v1.Image) (v1.Hash, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	if len(manifest.Layers) != len(cfg.RootFS.DiffIDs) {
+		return v1.Hash{}, fmt.Errorf("manifest has %d layers, but config %d diff IDs", len(manifest.Layers), len(cfg.RootFS.DiffIDs))
+	}
+	lines := make([]string, 0, len(manifest.Layers))
+	for i, l := range manifest.Layers {
+		d, err := filesegment.ParseDescriptor(l, cfg.RootFS.DiffIDs[i])
+		if err != nil {
+			return v1.Hash{}, err
+		}
+		lines = append(lines, fmt.Sprintf("%v %d-%d %v\n", d.Filename(), d.Start(), d.Stop(), d.DiffID()))
+	}
+	sort.Strings(lines)
+	h := sha256.New()
+	for _, l := range lines {
+		h.Write([]byte(l))
+	}
+	return v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// DefaultBuilderID returns URI of the GitHub Actions workflow running geranos, or URI of geranos elsewhere.
+func DefaultBuilderID() string {
+	server, workflow := os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_WORKFLOW_REF")
+	if server != "" && workflow != "" {
+		return server + "/" + workflow
+	}
+	return defaultBuilderID
+}
+
+// DefaultInvocationID returns URI of the GitHub Actions run attempt running geranos, if any.
+func DefaultInvocationID() string {
+	server, repo, run := os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_RUN_ID")
+	if server == "" || repo == "" || run == "" {
+		return ""
+	}
+	res := fmt.Sprintf("%v/%v/actions/runs/%v", server, repo, run)
+	if attempt := os.Getenv("GITHUB_RUN_ATTEMPT"); attempt != "" {
+		res += "/attempts/" + attempt
+	}
+	return res
+}
@@ -0,0 +1,69 @@
+package provenance
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewStatement(t *testing.T) {
+	digest := v1.Hash{Algorithm: "sha256", Hex: "4e07408562bedb8b60ce05c1decfe3ad16b72230967de01f640b7e4729b49fce"}
+	source := v1.Hash{Algorithm: "sha256", Hex: "abcd"}
+	started := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	b, err := NewStatement("ghcr.io/macvmio/macos-sonoma", digest, Build{
+		BuilderVersion: "v1.2.3",
+		Parameters:     map[string]any{"compression": "gzip"},
+		Source:         "/images/ghcr.io/macvmio/macos-sonoma:14",
+		SourceDigest:   source,
+		StartedOn:      started,
+		FinishedOn:     started.Add(time.Minute),
+	})
+	require.NoError(t, err)
+
+	var s Statement
+	require.NoError(t, json.Unmarshal(b, &s))
+	assert.Equal(t, StatementType, s.Type)
+	assert.Equal(t, PredicateType, s.PredicateType)
+	assert.Equal(t, []ResourceDescriptor{{Name: "ghcr.io/macvmio/macos-sonoma", Digest: map[string]string{"sha256": digest.Hex}}}, s.Subject)
+	assert.Equal(t, BuildType, s.Predicate.BuildDefinition.BuildType)
+	assert.Equal(t, map[string]any{"compression": "gzip"}, s.Predicate.BuildDefinition.ExternalParameters)
+	assert.Equal(t, []ResourceDescriptor{{Name: "source", URI: "file:///images/ghcr.io/macvmio/macos-sonoma:14", Digest: map[string]string{"sha256": "abcd"}}},
+		s.Predicate.BuildDefinition.ResolvedDependencies)
+	assert.Equal(t, defaultBuilderID, s.Predicate.RunDetails.Builder.ID)
+	assert.Equal(t, map[string]string{"geranos": "v1.2.3"}, s.Predicate.RunDetails.Builder.Version)
+	assert.Equal(t, started, *s.Predicate.RunDetails.Metadata.StartedOn)
+	assert.Equal(t, started.Add(time.Minute), *s.Predicate.RunDetails.Metadata.FinishedOn)
+}
+
+func TestSourceDigest(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "disk.img"), []byte("some fake image data"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"disk_size": 123}`), 0o644))
+
+	digestOf := func(opt ...dirimage.Option) (v1.Hash, v1.Hash) {
+		img, err := dirimage.Read(context.Background(), dir, opt...)
+		require.NoError(t, err)
+		manifestDigest, err := img.Digest()
+		require.NoError(t, err)
+		sourceDigest, err := SourceDigest(img)
+		require.NoError(t, err)
+		return manifestDigest, sourceDigest
+	}
+	zstdManifest, zstdSource := digestOf(dirimage.WithCompression(filesegment.CompressionZstd))
+	gzipManifest, gzipSource := digestOf(dirimage.WithCompression(filesegment.CompressionGzip))
+	assert.NotEqual(t, zstdManifest, gzipManifest)
+	assert.Equal(t, zstdSource, gzipSource)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "disk.img"), []byte("other fake image data"), 0o644))
+	_, changedSource := digestOf(dirimage.WithCompression(filesegment.CompressionZstd))
+	assert.NotEqual(t, zstdSource, changedSource)
+}
@@ -0,0 +1,78 @@
+package selfupdate
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"runtime"
+)
+
+type options struct {
+	channel    string
+	publicKey  ed25519.PublicKey
+	client     *http.Client
+	executable string
+	platform   string
+	force      bool
+	printf     func(fmt string, args ...any)
+}
+
+type Option func(opts *options)
+
+func makeOptions(opts ...Option) *options {
+	res := &options{
+		channel:  ChannelStable,
+		client:   http.DefaultClient,
+		platform: runtime.GOOS + "/" + runtime.GOARCH,
+		printf:   func(fmt string, args ...any) {},
+	}
+	for _, o := range opts {
+		o(res)
+	}
+	return res
+}
+
+func WithChannel(channel string) Option {
+	return func(o *options) {
+		o.channel = channel
+	}
+}
+
+// WithPublicKey sets ed25519 key used to verify signatures of released binaries.
+func WithPublicKey(key ed25519.PublicKey) Option {
+	return func(o *options) {
+		o.publicKey = key
+	}
+}
+
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.client = client
+	}
+}
+
+// WithExecutable sets path of the binary to replace, which defaults to the running executable.
+func WithExecutable(path string) Option {
+	return func(o *options) {
+		o.executable = path
+	}
+}
+
+// WithPlatform overrides "os/arch" key used to select the release asset.
+func WithPlatform(platform string) Option {
+	return func(o *options) {
+		o.platform = platform
+	}
+}
+
+// WithForce installs the release even if its version equals the current one, or is older.
+func WithForce(force bool) Option {
+	return func(o *options) {
+		o.force = force
+	}
+}
+
+func WithLogFunction(log func(fmt string, args ...any)) Option {
+	return func(o *options) {
+		o.printf = log
+	}
+}
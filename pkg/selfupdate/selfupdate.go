@@ -0,0 +1,268 @@
+package selfupdate
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/semver"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	ChannelStable = "stable"
+	ChannelBeta   = "beta"
+)
+
+var (
+	ErrNoPublicKey = errors.New("no public key configured to verify release signature")
+	// ErrDowngrade is returned when the latest release of the channel is older than the current version.
+	ErrDowngrade = errors.New("release is older than the current version")
+)
+
+// Asset is a released binary for single platform. Signature is base64 encoded ed25519 signature
+// of SignedMessage of the binary, see NewAsset.
+type Asset struct {
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+// Release is published by the release endpoint as <endpoint>/<channel>.json.
+// Assets are keyed by "os/arch", e.g. "darwin/arm64".
+type Release struct {
+	Version string           `json:"version"`
+	Assets  map[string]Asset `json:"assets"`
+}
+
+type Result struct {
+	PreviousVersion string
+	Version         string
+	Updated         bool
+}
+
+func ParsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode public key: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key size: %d", len(key))
+	}
+	return key, nil
+}
+
+// SignedMessage returns what is signed for binary of release version in channel for platform, with SHA256 digest.
+// It binds the binary to its version and channel, so signed binary of an old release or of the beta channel
+// cannot be served as the latest stable one.
+func SignedMessage(version, channel, platform string, digest []byte) []byte {
+	return []byte(fmt.Sprintf("geranos release\nversion: %v\nchannel: %v\nplatform: %v\nsha256: %x\n",
+		version, channel, platform, digest))
+}
+
+// NewAsset returns asset of binary of release version in channel for platform, downloaded from url, signed with key.
+func NewAsset(key ed25519.PrivateKey, version, channel, platform, url string, binary io.Reader) (Asset, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, binary); err != nil {
+		return Asset{}, fmt.Errorf("unable to hash release binary: %w", err)
+	}
+	digest := h.Sum(nil)
+	return Asset{
+		URL:       url,
+		SHA256:    hex.EncodeToString(digest),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, SignedMessage(version, channel, platform, digest))),
+	}, nil
+}
+
+func validChannel(channel string) bool {
+	return channel == ChannelStable || channel == ChannelBeta
+}
+
+func get(ctx context.Context, client *http.Client, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status fetching '%v': %v", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// Check fetches the latest release of the channel from endpoint.
+func Check(ctx context.Context, endpoint string, opt ...Option) (*Release, error) {
+	opts := makeOptions(opt...)
+	if !validChannel(opts.channel) {
+		return nil, fmt.Errorf("unknown channel '%v', expected '%v' or '%v'", opts.channel, ChannelStable, ChannelBeta)
+	}
+	body, err := get(ctx, opts.client, strings.TrimSuffix(endpoint, "/")+"/"+opts.channel+".json")
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch release information: %w", err)
+	}
+	defer body.Close()
+	var release Release
+	if err := json.NewDecoder(body).Decode(&release); err != nil {
+		return nil, fmt.Errorf("unable to parse release information: %w", err)
+	}
+	if release.Version == "" {
+		return nil, errors.New("release information does not contain version")
+	}
+	return &release, nil
+}
+
+// Update replaces the executable with the latest release of the channel, unless it is already current.
+// Releases older than currentVersion are refused with ErrDowngrade, unless forced with WithForce.
+// The binary is downloaded next to the executable and moved into place only after its digest and signature
+// were verified.
+func Update(ctx context.Context, endpoint string, currentVersion string, opt ...Option) (*Result, error) {
+	opts := makeOptions(opt...)
+	if opts.publicKey == nil {
+		return nil, ErrNoPublicKey
+	}
+	release, err := Check(ctx, endpoint, opt...)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{PreviousVersion: currentVersion, Version: release.Version}
+	if !opts.force {
+		switch compareVersions(release.Version, currentVersion) {
+		case 0:
+			return res, nil
+		case -1:
+			return nil, fmt.Errorf("%w: latest %v release is %v, current version is %v", ErrDowngrade, opts.channel, release.Version, currentVersion)
+		}
+	}
+	asset, ok := release.Assets[opts.platform]
+	if !ok {
+		return nil, fmt.Errorf("release %v has no binary for platform '%v'", release.Version, opts.platform)
+	}
+	executable := opts.executable
+	if executable == "" {
+		executable, err = os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("unable to locate executable: %w", err)
+		}
+		executable, err = filepath.EvalSymlinks(executable)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve executable: %w", err)
+		}
+	}
+	opts.printf("downloading %v from %v\n", release.Version, asset.URL)
+	message := func(digest []byte) []byte {
+		return SignedMessage(release.Version, opts.channel, opts.platform, digest)
+	}
+	tmpPath, err := download(ctx, opts.client, asset, executable, opts.publicKey, message)
+	if err != nil {
+		return nil, err
+	}
+	if err := replaceExecutable(tmpPath, executable); err != nil {
+		_ = os.Remove(tmpPath)
+		return nil, err
+	}
+	res.Updated = true
+	return res, nil
+}
+
+// compareVersions compares release version with current one, like semver.Version.Compare. Versions which
+// are not semantic, like of development builds, are only told apart from equal ones.
+func compareVersions(release, current string) int {
+	if release == current {
+		return 0
+	}
+	r, err := semver.Parse(release)
+	if err != nil {
+		return 1
+	}
+	c, err := semver.Parse(current)
+	if err != nil {
+		return 1
+	}
+	return r.Compare(c)
+}
+
+// download stores verified asset in a temporary file in the directory of executable, so it can be renamed into place.
+// Signature of the asset must be of message of its digest.
+func download(ctx context.Context, client *http.Client, asset Asset, executable string, publicKey ed25519.PublicKey,
+	message func(digest []byte) []byte) (tmpPath string, err error) {
+	expectedDigest, err := hex.DecodeString(asset.SHA256)
+	if err != nil || len(expectedDigest) != sha256.Size {
+		return "", fmt.Errorf("invalid sha256 of release binary: '%v'", asset.SHA256)
+	}
+	signature, err := base64.StdEncoding.DecodeString(asset.Signature)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode signature: %w", err)
+	}
+	body, err := get(ctx, client, asset.URL)
+	if err != nil {
+		return "", fmt.Errorf("unable to download release binary: %w", err)
+	}
+	defer body.Close()
+
+	f, err := os.CreateTemp(filepath.Dir(executable), "."+filepath.Base(executable)+".update-*")
+	if err != nil {
+		return "", fmt.Errorf("unable to create temporary file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to download release binary: %w", err)
+	}
+	digest := h.Sum(nil)
+	if hex.EncodeToString(digest) != strings.ToLower(asset.SHA256) {
+		return "", fmt.Errorf("digest mismatch of release binary: expected %v, got %x", asset.SHA256, digest)
+	}
+	if !ed25519.Verify(publicKey, message(digest), signature) {
+		return "", errors.New("invalid signature of release binary")
+	}
+	if err = os.Chmod(f.Name(), 0o755); err != nil {
+		return "", fmt.Errorf("unable to make release binary executable: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// replaceExecutable atomically renames new binary over the executable. Windows does not allow
+// overwriting running executable, so there it is moved aside first.
+func replaceExecutable(newPath string, executable string) error {
+	if runtime.GOOS != "windows" {
+		if err := os.Rename(newPath, executable); err != nil {
+			return fmt.Errorf("unable to move new executable into place: %w", err)
+		}
+		return nil
+	}
+	oldPath := filepath.Join(filepath.Dir(executable), "."+filepath.Base(executable)+".old")
+	_ = os.Remove(oldPath)
+	if err := os.Rename(executable, oldPath); err != nil {
+		return fmt.Errorf("unable to move current executable aside: %w", err)
+	}
+	if err := os.Rename(newPath, executable); err != nil {
+		if restoreErr := os.Rename(oldPath, executable); restoreErr != nil {
+			return fmt.Errorf("unable to restore executable from '%v' after failed update: %w", oldPath, restoreErr)
+		}
+		return fmt.Errorf("unable to move new executable into place: %w", err)
+	}
+	// removing fails on Windows while the old binary is running, it gets cleaned up on next update
+	_ = os.Remove(oldPath)
+	return nil
+}
@@ -0,0 +1,104 @@
+package selfupdate
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newReleaseServer serves release version of the beta channel, with binary signed as release signedVersion.
+func newReleaseServer(t *testing.T, version string, signedVersion string, binary []byte, signingKey ed25519.PrivateKey) *httptest.Server {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	asset, err := NewAsset(signingKey, signedVersion, ChannelBeta, "darwin/arm64", srv.URL+"/geranos", bytes.NewReader(binary))
+	require.NoError(t, err)
+	mux.HandleFunc("/beta.json", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(Release{
+			Version: version,
+			Assets:  map[string]Asset{"darwin/arm64": asset},
+		})
+	})
+	mux.HandleFunc("/geranos", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(binary)
+	})
+	return srv
+}
+
+func TestUpdate(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	binary := []byte("new geranos binary")
+	srv := newReleaseServer(t, "v2.0.0-beta", "v2.0.0-beta", binary, privateKey)
+
+	executable := filepath.Join(t.TempDir(), "geranos")
+	require.NoError(t, os.WriteFile(executable, []byte("old geranos binary"), 0o755))
+	opts := []Option{WithChannel(ChannelBeta), WithExecutable(executable), WithPlatform("darwin/arm64")}
+
+	t.Run("rejects invalid signature", func(t *testing.T) {
+		otherKey, _, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+		_, err = Update(context.Background(), srv.URL, "v1.0.0", append(opts, WithPublicKey(otherKey))...)
+		require.Error(t, err)
+		content, err := os.ReadFile(executable)
+		require.NoError(t, err)
+		assert.Equal(t, "old geranos binary", string(content))
+		entries, err := os.ReadDir(filepath.Dir(executable))
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+	})
+
+	t.Run("rejects signature of other release", func(t *testing.T) {
+		replayed := newReleaseServer(t, "v2.0.0-beta", "v1.1.0-beta", binary, privateKey)
+		_, err := Update(context.Background(), replayed.URL, "v1.0.0", append(opts, WithPublicKey(publicKey))...)
+		require.ErrorContains(t, err, "invalid signature")
+		content, err := os.ReadFile(executable)
+		require.NoError(t, err)
+		assert.Equal(t, "old geranos binary", string(content))
+	})
+
+	t.Run("requires public key", func(t *testing.T) {
+		_, err := Update(context.Background(), srv.URL, "v1.0.0", opts...)
+		assert.ErrorIs(t, err, ErrNoPublicKey)
+	})
+
+	t.Run("replaces executable", func(t *testing.T) {
+		res, err := Update(context.Background(), srv.URL, "v1.0.0", append(opts, WithPublicKey(publicKey))...)
+		require.NoError(t, err)
+		assert.True(t, res.Updated)
+		assert.Equal(t, "v2.0.0-beta", res.Version)
+		content, err := os.ReadFile(executable)
+		require.NoError(t, err)
+		assert.Equal(t, binary, content)
+	})
+
+	t.Run("skips current version", func(t *testing.T) {
+		res, err := Update(context.Background(), srv.URL, "v2.0.0-beta", append(opts, WithPublicKey(publicKey))...)
+		require.NoError(t, err)
+		assert.False(t, res.Updated)
+	})
+
+	t.Run("refuses downgrade", func(t *testing.T) {
+		_, err := Update(context.Background(), srv.URL, "v2.1.0", append(opts, WithPublicKey(publicKey))...)
+		assert.ErrorIs(t, err, ErrDowngrade)
+		_, err = Update(context.Background(), srv.URL, "2.0.0", append(opts, WithPublicKey(publicKey))...)
+		assert.ErrorIs(t, err, ErrDowngrade, "prerelease is older than release")
+
+		res, err := Update(context.Background(), srv.URL, "v2.1.0", append(opts, WithPublicKey(publicKey), WithForce(true))...)
+		require.NoError(t, err)
+		assert.True(t, res.Updated)
+	})
+
+	t.Run("fails for unknown platform", func(t *testing.T) {
+		_, err := Update(context.Background(), srv.URL, "v1.0.0", append(opts, WithPublicKey(publicKey), WithPlatform("plan9/386"))...)
+		assert.Error(t, err)
+	})
+}
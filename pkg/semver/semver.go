@@ -0,0 +1,128 @@
+// Package semver parses tags which are semantic versions, like v1.2.3 or 14.4-beta, and matches them
+// against constraints like ">=1.2, <2".
+package semver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version. Missing minor and patch numbers are 0.
+type Version struct {
+	Major, Minor, Patch int
+	Prerelease          string
+}
+
+// Parse parses s as major[.minor[.patch]][-prerelease][+build], with optional "v" prefix.
+// Build metadata is ignored.
+func Parse(s string) (Version, error) {
+	v := Version{}
+	rest, _, _ := strings.Cut(strings.TrimPrefix(s, "v"), "+")
+	rest, v.Prerelease, _ = strings.Cut(rest, "-")
+	parts := strings.Split(rest, ".")
+	if len(parts) > 3 {
+		return v, fmt.Errorf("invalid version '%v'", s)
+	}
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return v, fmt.Errorf("invalid version '%v'", s)
+		}
+		*nums[i] = n
+	}
+	return v, nil
+}
+
+// Compare returns -1, 0 or 1 when v is lower, equal or greater than o. Prereleases are lower than releases
+// of the same version and are compared as strings.
+func (v Version) Compare(o Version) int {
+	for _, c := range [][2]int{{v.Major, o.Major}, {v.Minor, o.Minor}, {v.Patch, o.Patch}} {
+		if c[0] != c[1] {
+			if c[0] < c[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case v.Prerelease == o.Prerelease:
+		return 0
+	case v.Prerelease == "":
+		return 1
+	case o.Prerelease == "":
+		return -1
+	}
+	return strings.Compare(v.Prerelease, o.Prerelease)
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Prerelease != "" {
+		s += "-" + v.Prerelease
+	}
+	return s
+}
+
+type comparison struct {
+	op      string
+	version Version
+}
+
+// Constraint is a list of comparisons a version must all satisfy.
+type Constraint []comparison
+
+// operators are ordered so that longer ones are matched first
+var operators = []string{">=", "<=", "!=", ">", "<", "="}
+
+// ParseConstraint parses comparisons separated by commas or spaces, e.g. ">=1.2, <2" or "14.4".
+// A version without operator must be equal.
+func ParseConstraint(s string) (Constraint, error) {
+	var c Constraint
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		op := "="
+		for _, o := range operators {
+			if strings.HasPrefix(f, o) {
+				op = o
+				f = strings.TrimPrefix(f, o)
+				break
+			}
+		}
+		v, err := Parse(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid constraint '%v': %w", s, err)
+		}
+		c = append(c, comparison{op: op, version: v})
+	}
+	if len(c) == 0 {
+		return nil, fmt.Errorf("empty constraint")
+	}
+	return c, nil
+}
+
+// Check reports whether v satisfies every comparison of c.
+func (c Constraint) Check(v Version) bool {
+	for _, cmp := range c {
+		r := v.Compare(cmp.version)
+		var ok bool
+		switch cmp.op {
+		case "=":
+			ok = r == 0
+		case "!=":
+			ok = r != 0
+		case ">":
+			ok = r > 0
+		case ">=":
+			ok = r >= 0
+		case "<":
+			ok = r < 0
+		case "<=":
+			ok = r <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
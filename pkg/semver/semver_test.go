@@ -0,0 +1,62 @@
+package semver
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	v, err := Parse("v14.4")
+	require.NoError(t, err)
+	assert.Equal(t, Version{Major: 14, Minor: 4}, v)
+
+	v, err = Parse("1.2.3-beta.1+build5")
+	require.NoError(t, err)
+	assert.Equal(t, Version{Major: 1, Minor: 2, Patch: 3, Prerelease: "beta.1"}, v)
+
+	for _, s := range []string{"", "latest", "1.2.3.4", "1..2", "v-1", "1.+2"} {
+		_, err := Parse(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestVersion_Compare(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0", 0},
+		{"1.2.0", "1.10.0", -1},
+		{"2", "1.99.99", 1},
+		{"1.0.0-rc1", "1.0.0", -1},
+		{"1.0.0-rc2", "1.0.0-rc1", 1},
+	}
+	for _, c := range cases {
+		a, err := Parse(c.a)
+		require.NoError(t, err)
+		b, err := Parse(c.b)
+		require.NoError(t, err)
+		assert.Equal(t, c.want, a.Compare(b), "%v vs %v", c.a, c.b)
+	}
+}
+
+func TestConstraint_Check(t *testing.T) {
+	c, err := ParseConstraint(">=1.2, <2")
+	require.NoError(t, err)
+	for s, want := range map[string]bool{"1.1.9": false, "1.2": true, "v1.9.9": true, "2.0.0": false, "2.0.0-rc1": true} {
+		v, err := Parse(s)
+		require.NoError(t, err)
+		assert.Equal(t, want, c.Check(v), s)
+	}
+
+	c, err = ParseConstraint("14.4")
+	require.NoError(t, err)
+	assert.True(t, c.Check(Version{Major: 14, Minor: 4}))
+	assert.False(t, c.Check(Version{Major: 14, Minor: 5}))
+
+	_, err = ParseConstraint("")
+	assert.Error(t, err)
+	_, err = ParseConstraint(">=x")
+	assert.Error(t, err)
+}
@@ -0,0 +1,52 @@
+package signing
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+)
+
+// EnvelopeMediaType is media type of DSSE envelopes, in which cosign attaches signed attestations.
+const EnvelopeMediaType = "application/vnd.dsse.envelope.v1+json"
+
+// Envelope is a DSSE envelope: payload of payloadType with signatures over both of them.
+type Envelope struct {
+	PayloadType string              `json:"payloadType"`
+	Payload     []byte              `json:"payload"`
+	Signatures  []EnvelopeSignature `json:"signatures"`
+}
+
+type EnvelopeSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   []byte `json:"sig"`
+}
+
+// pae is the pre-authentication encoding of payload, which DSSE signatures sign.
+func pae(payloadType string, payload []byte) []byte {
+	return append([]byte(fmt.Sprintf("DSSEv1 %d %s %d ", len(payloadType), payloadType, len(payload))), payload...)
+}
+
+// SignEnvelope signs payload of payloadType like Sign does, and returns envelope with it. The returned signature
+// carries certificate and transparency log entry of the envelope signature.
+func SignEnvelope(ctx context.Context, cfg Config, payloadType string, payload []byte) (*Envelope, *Signature, error) {
+	sig, err := Sign(ctx, cfg, pae(payloadType, payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	env := &Envelope{
+		PayloadType: payloadType,
+		Payload:     payload,
+		Signatures:  []EnvelopeSignature{{Sig: sig.Signature}},
+	}
+	return env, sig, nil
+}
+
+// VerifyEnvelope returns payload of env when one of its signatures is made by key.
+func VerifyEnvelope(env *Envelope, key crypto.PublicKey) ([]byte, error) {
+	for _, s := range env.Signatures {
+		if verifyDigest(key, pae(env.PayloadType, env.Payload), s.Sig) == nil {
+			return env.Payload, nil
+		}
+	}
+	return nil, fmt.Errorf("envelope is not signed by the key")
+}
@@ -0,0 +1,115 @@
+package signing
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type fulcioRequest struct {
+	Credentials struct {
+		OIDCIdentityToken string `json:"oidcIdentityToken"`
+	} `json:"credentials"`
+	PublicKeyRequest struct {
+		PublicKey struct {
+			Algorithm string `json:"algorithm"`
+			Content   string `json:"content"`
+		} `json:"publicKey"`
+		ProofOfPossession []byte `json:"proofOfPossession"`
+	} `json:"publicKeyRequest"`
+}
+
+type certificateChain struct {
+	Chain struct {
+		Certificates []string `json:"certificates"`
+	} `json:"chain"`
+}
+
+type fulcioResponse struct {
+	EmbeddedSCT *certificateChain `json:"signedCertificateEmbeddedSct"`
+	DetachedSCT *certificateChain `json:"signedCertificateDetachedSct"`
+}
+
+// tokenSubject returns identity claimed by OIDC token: email, or subject when there is no email.
+// The token is verified by Fulcio, it is only parsed here.
+func tokenSubject(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("identity token is not a JWT")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid identity token: %w", err)
+	}
+	var claims struct {
+		Email   string `json:"email"`
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return "", fmt.Errorf("invalid identity token: %w", err)
+	}
+	if claims.Email != "" {
+		return claims.Email, nil
+	}
+	return claims.Subject, nil
+}
+
+// requestCertificate asks Fulcio for a certificate of key issued to the identity of token, proving possession
+// of key by signing the identity. It returns PEM encoded certificate and its chain.
+func requestCertificate(ctx context.Context, client *http.Client, fulcioURL string, token string, key *ecdsa.PrivateKey) ([]byte, []byte, error) {
+	subject, err := tokenSubject(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	proof, err := signDigest(key, []byte(subject))
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := MarshalPublicKey(key.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	var body fulcioRequest
+	body.Credentials.OIDCIdentityToken = token
+	body.PublicKeyRequest.PublicKey.Algorithm = "ECDSA"
+	body.PublicKeyRequest.PublicKey.Content = string(pub)
+	body.PublicKeyRequest.ProofOfPossession = proof
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(fulcioURL, "/")+"/api/v2/signingCert", bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, nil, fmt.Errorf("fulcio responded with %v: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var res fulcioResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, nil, fmt.Errorf("invalid fulcio response: %w", err)
+	}
+	chain := res.EmbeddedSCT
+	if chain == nil {
+		chain = res.DetachedSCT
+	}
+	if chain == nil || len(chain.Chain.Certificates) == 0 {
+		return nil, nil, fmt.Errorf("fulcio responded without certificate")
+	}
+	certs := chain.Chain.Certificates
+	return []byte(certs[0]), []byte(strings.Join(certs[1:], "")), nil
+}
@@ -0,0 +1,96 @@
+package signing
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"os"
+)
+
+// encryptedKey is the format of private keys generated by cosign, encrypted with a password.
+type encryptedKey struct {
+	KDF struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// LoadPrivateKey reads PEM encoded private key from path: PKCS#8, EC, or encrypted with password like keys
+// generated by cosign.
+func LoadPrivateKey(path string, password []byte) (crypto.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %v", path)
+	}
+	der := block.Bytes
+	switch block.Type {
+	case "ENCRYPTED SIGSTORE PRIVATE KEY", "ENCRYPTED COSIGN PRIVATE KEY":
+		if der, err = decryptKey(block.Bytes, password); err != nil {
+			return nil, fmt.Errorf("unable to decrypt %v: %w", path, err)
+		}
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(der)
+	case "PRIVATE KEY":
+	default:
+		return nil, fmt.Errorf("unsupported key type %v in %v", block.Type, path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key %v: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key %T in %v", key, path)
+	}
+	return signer, nil
+}
+
+func decryptKey(data []byte, password []byte) ([]byte, error) {
+	var k encryptedKey
+	if err := json.Unmarshal(data, &k); err != nil {
+		return nil, err
+	}
+	if k.KDF.Name != "scrypt" || k.Cipher.Name != "nacl/secretbox" || len(k.Cipher.Nonce) != 24 {
+		return nil, fmt.Errorf("unsupported encryption %v with %v", k.KDF.Name, k.Cipher.Name)
+	}
+	secret, err := scrypt.Key(password, k.KDF.Salt, k.KDF.Params.N, k.KDF.Params.R, k.KDF.Params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	var key [32]byte
+	copy(nonce[:], k.Cipher.Nonce)
+	copy(key[:], secret)
+	plain, ok := secretbox.Open(nil, k.Ciphertext, &nonce, &key)
+	if !ok {
+		return nil, fmt.Errorf("wrong password")
+	}
+	return plain, nil
+}
+
+// MarshalPublicKey returns PEM encoded public key.
+func MarshalPublicKey(key crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
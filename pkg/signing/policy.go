@@ -0,0 +1,155 @@
+package signing
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+)
+
+// Identity is a keyless signer: OIDC issuer and subject certified by Fulcio, e.g. email or URI of CI workflow.
+type Identity struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject,omitempty"`
+	// SubjectRegExp matches subjects instead of Subject, e.g. every workflow of an organization
+	SubjectRegExp string `json:"subjectRegExp,omitempty"`
+
+	subjectRegExp *regexp.Regexp
+}
+
+func (id *Identity) matches(issuer, subject string) bool {
+	if id.Issuer != issuer {
+		return false
+	}
+	if id.subjectRegExp != nil {
+		return id.subjectRegExp.MatchString(subject)
+	}
+	return id.Subject == subject
+}
+
+// RepositoryPolicy lists signers trusted for repositories matching Repository.
+type RepositoryPolicy struct {
+	// Repository is a pattern like ghcr.io/macvmio/*, matched with path.Match
+	Repository string `json:"repository"`
+	// Keys are paths of PEM encoded public keys, relative to the policy file
+	Keys       []string   `json:"keys,omitempty"`
+	Identities []Identity `json:"identities,omitempty"`
+
+	keys []crypto.PublicKey
+}
+
+// Policy decides which signatures are trusted for images of a repository. It is read from JSON file like:
+//
+//	{
+//	  "fulcioRoots": "fulcio.crt.pem",
+//	  "rekorKey": "rekor.pub",
+//	  "repositories": [
+//	    {"repository": "ghcr.io/macvmio/*", "keys": ["cosign.pub"]},
+//	    {"repository": "registry.example.com/vms/*", "identities": [{"issuer": "https://accounts.google.com", "subject": "ci@example.com"}]}
+//	  ]
+//	}
+type Policy struct {
+	// FulcioRoots is path of PEM encoded certificates of Fulcio, which certify identities of keyless signatures
+	FulcioRoots string `json:"fulcioRoots,omitempty"`
+	// RekorKey is path of PEM encoded public key of Rekor, which signs bundles of keyless signatures proving
+	// when they were made. Keyless signatures are verified only against bundles signed with it.
+	RekorKey     string             `json:"rekorKey,omitempty"`
+	Repositories []RepositoryPolicy `json:"repositories"`
+
+	roots    *x509.CertPool
+	rekorKey crypto.PublicKey
+}
+
+// LoadPolicy reads policy from JSON file at policyPath, with the keys and certificates it refers to.
+func LoadPolicy(policyPath string) (*Policy, error) {
+	b, err := os.ReadFile(policyPath)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("invalid policy %v: %w", policyPath, err)
+	}
+	resolve := func(file string) string {
+		if filepath.IsAbs(file) {
+			return file
+		}
+		return filepath.Join(filepath.Dir(policyPath), file)
+	}
+	if p.FulcioRoots != "" {
+		pemCerts, err := os.ReadFile(resolve(p.FulcioRoots))
+		if err != nil {
+			return nil, err
+		}
+		p.roots = x509.NewCertPool()
+		if !p.roots.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("no certificates in %v", p.FulcioRoots)
+		}
+	}
+	if p.RekorKey != "" {
+		if p.rekorKey, err = LoadPublicKey(resolve(p.RekorKey)); err != nil {
+			return nil, err
+		}
+	}
+	for i := range p.Repositories {
+		rp := &p.Repositories[i]
+		if _, err := path.Match(rp.Repository, ""); err != nil {
+			return nil, fmt.Errorf("invalid repository pattern '%v': %w", rp.Repository, err)
+		}
+		for _, k := range rp.Keys {
+			key, err := LoadPublicKey(resolve(k))
+			if err != nil {
+				return nil, err
+			}
+			rp.keys = append(rp.keys, key)
+		}
+		for j := range rp.Identities {
+			id := &rp.Identities[j]
+			if id.SubjectRegExp == "" {
+				continue
+			}
+			if id.subjectRegExp, err = regexp.Compile(id.SubjectRegExp); err != nil {
+				return nil, fmt.Errorf("invalid subject regexp '%v': %w", id.SubjectRegExp, err)
+			}
+		}
+		if len(rp.Identities) > 0 && p.roots == nil {
+			return nil, fmt.Errorf("identities of %v need fulcioRoots to verify certificates", rp.Repository)
+		}
+		if len(rp.Identities) > 0 && p.rekorKey == nil {
+			return nil, fmt.Errorf("identities of %v need rekorKey to verify transparency log bundles", rp.Repository)
+		}
+	}
+	return &p, nil
+}
+
+// LoadPublicKey reads PEM encoded public key from path.
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %v", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse public key %v: %w", path, err)
+	}
+	return key, nil
+}
+
+// repository returns policy of the first entry matching repository, like ghcr.io/macvmio/macos-sonoma.
+func (p *Policy) repository(repository string) *RepositoryPolicy {
+	for i := range p.Repositories {
+		if ok, _ := path.Match(p.Repositories[i].Repository, repository); ok {
+			return &p.Repositories[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package signing
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// hashedRekord is transparency log entry of a signature over SHA-256 digest of data.
+type hashedRekord struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Signature struct {
+			Content   []byte `json:"content"`
+			PublicKey struct {
+				Content []byte `json:"content"`
+			} `json:"publicKey"`
+		} `json:"signature"`
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+	} `json:"spec"`
+}
+
+type logEntry struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+	Verification   struct {
+		SignedEntryTimestamp []byte `json:"signedEntryTimestamp"`
+	} `json:"verification"`
+}
+
+// rekorBundle is the log entry in the format cosign attaches to signatures.
+type rekorBundle struct {
+	SignedEntryTimestamp []byte `json:"SignedEntryTimestamp"`
+	Payload              struct {
+		Body           string `json:"body"`
+		IntegratedTime int64  `json:"integratedTime"`
+		LogIndex       int64  `json:"logIndex"`
+		LogID          string `json:"logID"`
+	} `json:"Payload"`
+}
+
+// uploadEntry records signature sig in Rekor, with PEM encoded verifier, certificate or public key, of it.
+// It returns bundle of the created entry.
+func uploadEntry(ctx context.Context, client *http.Client, rekorURL string, sig *Signature, verifier []byte) ([]byte, error) {
+	var entry hashedRekord
+	entry.APIVersion = "0.0.1"
+	entry.Kind = "hashedrekord"
+	entry.Spec.Signature.Content = sig.Signature
+	entry.Spec.Signature.PublicKey.Content = verifier
+	digest := sha256.Sum256(sig.Payload)
+	entry.Spec.Data.Hash.Algorithm = "sha256"
+	entry.Spec.Data.Hash.Value = hex.EncodeToString(digest[:])
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(rekorURL, "/")+"/api/v1/log/entries", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("rekor responded with %v: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var entries map[string]logEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("invalid rekor response: %w", err)
+	}
+	for _, e := range entries {
+		var bundle rekorBundle
+		bundle.SignedEntryTimestamp = e.Verification.SignedEntryTimestamp
+		bundle.Payload.Body = e.Body
+		bundle.Payload.IntegratedTime = e.IntegratedTime
+		bundle.Payload.LogIndex = e.LogIndex
+		bundle.Payload.LogID = e.LogID
+		return json.Marshal(bundle)
+	}
+	return nil, fmt.Errorf("rekor responded without entry")
+}
@@ -0,0 +1,159 @@
+// Package signing signs image manifests with signatures compatible with sigstore cosign: a simple signing
+// payload naming the manifest digest, signed with a key pair or keylessly with a short-lived Fulcio certificate
+// for an OIDC identity, and optionally recorded in the Rekor transparency log.
+package signing
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"net/http"
+)
+
+const (
+	DefaultFulcioURL = "https://fulcio.sigstore.dev"
+	DefaultRekorURL  = "https://rekor.sigstore.dev"
+
+	// ArtifactType is type of artifacts holding signatures, attached to signed images as referrers
+	ArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	// PayloadMediaType is media type of the layer holding the signed payload
+	PayloadMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+	SignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	CertificateAnnotation = "dev.sigstore.cosign/certificate"
+	ChainAnnotation       = "dev.sigstore.cosign/chain"
+	BundleAnnotation      = "dev.sigstore.cosign/bundle"
+
+	payloadType = "cosign container image signature"
+)
+
+// Payload is the simple signing payload, claiming the manifest of digest is an image of repository reference.
+type Payload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]any `json:"optional"`
+}
+
+// NewPayload returns payload signing manifest digest of image in repository reference, like "ghcr.io/macvmio/macos-sonoma".
+func NewPayload(reference string, digest v1.Hash) ([]byte, error) {
+	var p Payload
+	p.Critical.Identity.DockerReference = reference
+	p.Critical.Image.DockerManifestDigest = digest.String()
+	p.Critical.Type = payloadType
+	return json.Marshal(p)
+}
+
+// SignatureTag returns tag of the image cosign keeps signatures of manifest digest in, like sha256-<hex>.sig,
+// where it looks for them unless told to use referrers.
+func SignatureTag(digest v1.Hash) string {
+	return fmt.Sprintf("%v-%v.sig", digest.Algorithm, digest.Hex)
+}
+
+// Signature is a signed payload, with certificate of the signing key and transparency log entry when present.
+type Signature struct {
+	Payload   []byte
+	Signature []byte
+	// Certificate and Chain are PEM encoded, for keyless signatures
+	Certificate []byte
+	Chain       []byte
+	// Bundle is the Rekor entry of the signature, proving when it was made
+	Bundle []byte
+}
+
+// Annotations returns annotations of the payload layer, which carry the signature.
+func (s *Signature) Annotations() map[string]string {
+	res := map[string]string{SignatureAnnotation: base64.StdEncoding.EncodeToString(s.Signature)}
+	if len(s.Certificate) > 0 {
+		res[CertificateAnnotation] = string(s.Certificate)
+	}
+	if len(s.Chain) > 0 {
+		res[ChainAnnotation] = string(s.Chain)
+	}
+	if len(s.Bundle) > 0 {
+		res[BundleAnnotation] = string(s.Bundle)
+	}
+	return res
+}
+
+// Config configures Sign.
+type Config struct {
+	// Key signs payloads, keyless signing with a short-lived Fulcio certificate is used when nil
+	Key crypto.Signer
+	// IdentityToken is OIDC token of the identity keyless signatures are issued for
+	IdentityToken string
+	FulcioURL     string
+	// RekorURL is transparency log signatures are recorded in, none when empty
+	RekorURL   string
+	HTTPClient *http.Client
+}
+
+func (c *Config) client() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Sign signs payload with cfg.Key, or keylessly with an ephemeral key certified by Fulcio for cfg.IdentityToken.
+func Sign(ctx context.Context, cfg Config, payload []byte) (*Signature, error) {
+	res := &Signature{Payload: payload}
+	key := cfg.Key
+	if key == nil {
+		if cfg.IdentityToken == "" {
+			return nil, fmt.Errorf("keyless signing needs OIDC identity token")
+		}
+		ephemeral, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key = ephemeral
+		fulcioURL := cfg.FulcioURL
+		if fulcioURL == "" {
+			fulcioURL = DefaultFulcioURL
+		}
+		res.Certificate, res.Chain, err = requestCertificate(ctx, cfg.client(), fulcioURL, cfg.IdentityToken, ephemeral)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get signing certificate: %w", err)
+		}
+	}
+	var err error
+	if res.Signature, err = signDigest(key, payload); err != nil {
+		return nil, fmt.Errorf("unable to sign: %w", err)
+	}
+	if cfg.RekorURL != "" {
+		verifier := res.Certificate
+		if verifier == nil {
+			if verifier, err = MarshalPublicKey(key.Public()); err != nil {
+				return nil, err
+			}
+		}
+		if res.Bundle, err = uploadEntry(ctx, cfg.client(), cfg.RekorURL, res, verifier); err != nil {
+			return nil, fmt.Errorf("unable to record signature in transparency log: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// signDigest signs SHA-256 digest of data, or data itself with ed25519 keys, which hash it on their own.
+func signDigest(key crypto.Signer, data []byte) ([]byte, error) {
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		return key.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(data)
+	return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
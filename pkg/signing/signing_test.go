@@ -0,0 +1,122 @@
+package signing
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+func writeKey(t *testing.T, blockType string, der []byte) string {
+	path := filepath.Join(t.TempDir(), "cosign.key")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+	return path
+}
+
+// encryptKey encrypts der like cosign generate-key-pair does.
+func encryptKey(t *testing.T, der []byte, password []byte) []byte {
+	var k encryptedKey
+	k.KDF.Name = "scrypt"
+	k.KDF.Params.N, k.KDF.Params.R, k.KDF.Params.P = 1024, 8, 1
+	k.KDF.Salt = make([]byte, 32)
+	_, _ = rand.Read(k.KDF.Salt)
+	k.Cipher.Name = "nacl/secretbox"
+	k.Cipher.Nonce = make([]byte, 24)
+	_, _ = rand.Read(k.Cipher.Nonce)
+	secret, err := scrypt.Key(password, k.KDF.Salt, k.KDF.Params.N, k.KDF.Params.R, k.KDF.Params.P, 32)
+	require.NoError(t, err)
+	var nonce [24]byte
+	var key [32]byte
+	copy(nonce[:], k.Cipher.Nonce)
+	copy(key[:], secret)
+	k.Ciphertext = secretbox.Seal(nil, der, &nonce, &key)
+	b, err := json.Marshal(k)
+	require.NoError(t, err)
+	return b
+}
+
+func TestLoadPrivateKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	ec, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	for _, path := range []string{
+		writeKey(t, "PRIVATE KEY", pkcs8),
+		writeKey(t, "EC PRIVATE KEY", ec),
+		writeKey(t, "ENCRYPTED SIGSTORE PRIVATE KEY", encryptKey(t, pkcs8, []byte("secret"))),
+	} {
+		signer, err := LoadPrivateKey(path, []byte("secret"))
+		require.NoError(t, err)
+		assert.True(t, key.PublicKey.Equal(signer.Public()))
+	}
+
+	_, err = LoadPrivateKey(writeKey(t, "ENCRYPTED COSIGN PRIVATE KEY", encryptKey(t, pkcs8, []byte("secret"))), []byte("wrong"))
+	assert.ErrorContains(t, err, "wrong password")
+}
+
+func TestSign_keyless(t *testing.T) {
+	// identity token with email claim, Fulcio is faked so it is not signed
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"1234","email":"ci@example.com"}`))
+	token := "e30." + claims + ".c2ln"
+
+	var certified *ecdsa.PublicKey
+	fulcio := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v2/signingCert", r.URL.Path)
+		var req fulcioRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, token, req.Credentials.OIDCIdentityToken)
+		block, _ := pem.Decode([]byte(req.PublicKeyRequest.PublicKey.Content))
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		require.NoError(t, err)
+		certified = pub.(*ecdsa.PublicKey)
+		digest := sha256.Sum256([]byte("ci@example.com"))
+		assert.True(t, ecdsa.VerifyASN1(certified, digest[:], req.PublicKeyRequest.ProofOfPossession))
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"signedCertificateEmbeddedSct":{"chain":{"certificates":["LEAF\n","INTERMEDIATE\n","ROOT\n"]}}}`))
+	}))
+	defer fulcio.Close()
+
+	rekor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v1/log/entries", r.URL.Path)
+		var entry hashedRekord
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&entry))
+		assert.Equal(t, "hashedrekord", entry.Kind)
+		assert.Equal(t, "LEAF\n", string(entry.Spec.Signature.PublicKey.Content))
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"24296fb24b8ad77a":{"body":"e30=","integratedTime":1700000000,"logID":"c0d23d6a","logIndex":42,"verification":{"signedEntryTimestamp":"c2V0"}}}`))
+	}))
+	defer rekor.Close()
+
+	payload, err := NewPayload("ghcr.io/macvmio/macos-sonoma", v1.Hash{Algorithm: "sha256", Hex: "abcd"})
+	require.NoError(t, err)
+	sig, err := Sign(context.Background(), Config{IdentityToken: token, FulcioURL: fulcio.URL, RekorURL: rekor.URL}, payload)
+	require.NoError(t, err)
+
+	digest := sha256.Sum256(payload)
+	require.NotNil(t, certified)
+	assert.True(t, ecdsa.VerifyASN1(certified, digest[:], sig.Signature))
+	annotations := sig.Annotations()
+	assert.Equal(t, "LEAF\n", annotations[CertificateAnnotation])
+	assert.Equal(t, "INTERMEDIATE\nROOT\n", annotations[ChainAnnotation])
+	assert.JSONEq(t, `{"SignedEntryTimestamp":"c2V0","Payload":{"body":"e30=","integratedTime":1700000000,"logIndex":42,"logID":"c0d23d6a"}}`,
+		annotations[BundleAnnotation])
+}
@@ -0,0 +1,221 @@
+package signing
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"time"
+)
+
+var (
+	// oidIssuer and oidIssuerV2 are extensions of Fulcio certificates naming OIDC issuer of the identity
+	oidIssuer   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// ParseSignature returns signature of payload carried by annotations of its layer, the inverse of Annotations.
+func ParseSignature(payload []byte, annotations map[string]string) (*Signature, error) {
+	encoded, ok := annotations[SignatureAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("no %v annotation", SignatureAnnotation)
+	}
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	return &Signature{
+		Payload:     payload,
+		Signature:   sig,
+		Certificate: []byte(annotations[CertificateAnnotation]),
+		Chain:       []byte(annotations[ChainAnnotation]),
+		Bundle:      []byte(annotations[BundleAnnotation]),
+	}, nil
+}
+
+// Verify returns nil when one of sigs signs manifest digest of an image in repository, like
+// ghcr.io/macvmio/macos-sonoma, and is made by a signer p trusts for the repository.
+func (p *Policy) Verify(repository string, digest v1.Hash, sigs []*Signature) error {
+	rp := p.repository(repository)
+	if rp == nil {
+		return fmt.Errorf("no policy for repository %v", repository)
+	}
+	if len(sigs) == 0 {
+		return fmt.Errorf("%v@%v is not signed", repository, digest)
+	}
+	var errs []error
+	for _, s := range sigs {
+		err := p.verify(rp, repository, digest, s)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return fmt.Errorf("no trusted signature of %v@%v: %w", repository, digest, errors.Join(errs...))
+}
+
+func (p *Policy) verify(rp *RepositoryPolicy, repository string, digest v1.Hash, s *Signature) error {
+	var payload Payload
+	if err := json.Unmarshal(s.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+	if payload.Critical.Type != payloadType {
+		return fmt.Errorf("unsupported payload type '%v'", payload.Critical.Type)
+	}
+	if payload.Critical.Image.DockerManifestDigest != digest.String() {
+		return fmt.Errorf("signature of other image %v", payload.Critical.Image.DockerManifestDigest)
+	}
+	if payload.Critical.Identity.DockerReference != repository {
+		return fmt.Errorf("signature of image in other repository %v", payload.Critical.Identity.DockerReference)
+	}
+	if len(s.Certificate) > 0 {
+		return p.verifyKeyless(rp, s)
+	}
+	for _, key := range rp.keys {
+		if verifyDigest(key, s.Payload, s.Signature) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("signed with untrusted key")
+}
+
+// verifyKeyless verifies certificate of s was issued by Fulcio to identity trusted by rp, while it was valid.
+func (p *Policy) verifyKeyless(rp *RepositoryPolicy, s *Signature) error {
+	if len(rp.Identities) == 0 {
+		return fmt.Errorf("keyless signatures are not trusted")
+	}
+	block, _ := pem.Decode(s.Certificate)
+	if block == nil {
+		return fmt.Errorf("invalid certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("invalid certificate: %w", err)
+	}
+	// certificates are short-lived, so they are verified at the time the transparency log recorded the signature
+	signedAt, err := p.verifyBundle(s)
+	if err != nil {
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AppendCertsFromPEM(s.Chain)
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         p.roots,
+		Intermediates: intermediates,
+		CurrentTime:   signedAt,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return fmt.Errorf("untrusted certificate: %w", err)
+	}
+	issuer, subject := certificateIdentity(cert)
+	trusted := false
+	for i := range rp.Identities {
+		if rp.Identities[i].matches(issuer, subject) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return fmt.Errorf("signed by untrusted identity %v of %v", subject, issuer)
+	}
+	if err := verifyDigest(cert.PublicKey, s.Payload, s.Signature); err != nil {
+		return err
+	}
+	return nil
+}
+
+// verifyBundle verifies the transparency log entry of s records it, and returns when it was recorded.
+func (p *Policy) verifyBundle(s *Signature) (time.Time, error) {
+	if len(s.Bundle) == 0 {
+		return time.Time{}, fmt.Errorf("keyless signature is not recorded in transparency log")
+	}
+	var bundle rekorBundle
+	if err := json.Unmarshal(s.Bundle, &bundle); err != nil {
+		return time.Time{}, fmt.Errorf("invalid bundle: %w", err)
+	}
+	// time of the bundle decides whether the certificate was valid, so it is trusted only when signed by Rekor
+	if p.rekorKey == nil {
+		return time.Time{}, fmt.Errorf("keyless signatures need rekorKey to verify bundle")
+	}
+	// Rekor signs the entry in canonical JSON, with keys sorted
+	canonical, err := json.Marshal(map[string]any{
+		"body":           bundle.Payload.Body,
+		"integratedTime": bundle.Payload.IntegratedTime,
+		"logIndex":       bundle.Payload.LogIndex,
+		"logID":          bundle.Payload.LogID,
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := verifyDigest(p.rekorKey, canonical, bundle.SignedEntryTimestamp); err != nil {
+		return time.Time{}, fmt.Errorf("invalid bundle: %w", err)
+	}
+	body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid bundle: %w", err)
+	}
+	var entry hashedRekord
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, fmt.Errorf("invalid bundle: %w", err)
+	}
+	digest := sha256.Sum256(s.Payload)
+	if !bytes.Equal(entry.Spec.Signature.Content, s.Signature) ||
+		!bytes.Equal(entry.Spec.Signature.PublicKey.Content, s.Certificate) ||
+		entry.Spec.Data.Hash.Value != hex.EncodeToString(digest[:]) {
+		return time.Time{}, fmt.Errorf("bundle records other signature")
+	}
+	return time.Unix(bundle.Payload.IntegratedTime, 0), nil
+}
+
+// certificateIdentity returns OIDC issuer and subject, email or URI, certified by Fulcio certificate.
+func certificateIdentity(cert *x509.Certificate) (string, string) {
+	var issuer, subject string
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidIssuerV2):
+			_, _ = asn1.Unmarshal(ext.Value, &issuer)
+		case ext.Id.Equal(oidIssuer) && issuer == "":
+			issuer = string(ext.Value)
+		}
+	}
+	if len(cert.EmailAddresses) > 0 {
+		subject = cert.EmailAddresses[0]
+	} else if len(cert.URIs) > 0 {
+		subject = cert.URIs[0].String()
+	}
+	return issuer, subject
+}
+
+// verifyDigest verifies sig is a signature of data by key, the inverse of signDigest.
+func verifyDigest(key crypto.PublicKey, data []byte, sig []byte) error {
+	digest := sha256.Sum256(data)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(k, digest[:], sig) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if ed25519.Verify(k, data, sig) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported public key %T", key)
+	}
+	return fmt.Errorf("invalid signature")
+}
@@ -0,0 +1,204 @@
+package signing
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRepository = "ghcr.io/macvmio/macos-sonoma"
+
+var testDigest = v1.Hash{Algorithm: "sha256", Hex: "4e07408562bedb8b60ce05c1decfe3ad16b72230967de01f640b7e4729b49fce"}
+
+func writePublicKey(t *testing.T, dir string, name string, key crypto.PublicKey) {
+	b, err := MarshalPublicKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), b, 0o644))
+}
+
+func writePolicy(t *testing.T, dir string, policy string) *Policy {
+	path := filepath.Join(dir, "policy.json")
+	require.NoError(t, os.WriteFile(path, []byte(policy), 0o644))
+	p, err := LoadPolicy(path)
+	require.NoError(t, err)
+	return p
+}
+
+func signWithKey(t *testing.T, key crypto.Signer, reference string, digest v1.Hash) *Signature {
+	payload, err := NewPayload(reference, digest)
+	require.NoError(t, err)
+	sig, err := Sign(context.Background(), Config{Key: key}, payload)
+	require.NoError(t, err)
+	return sig
+}
+
+func TestPolicy_Verify_key(t *testing.T) {
+	dir := t.TempDir()
+	trusted, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	writePublicKey(t, dir, "cosign.pub", trusted.Public())
+	p := writePolicy(t, dir, `{"repositories": [{"repository": "ghcr.io/macvmio/*", "keys": ["cosign.pub"]}]}`)
+
+	assert.NoError(t, p.Verify(testRepository, testDigest, []*Signature{
+		signWithKey(t, other, testRepository, testDigest),
+		signWithKey(t, trusted, testRepository, testDigest),
+	}))
+	assert.ErrorContains(t, p.Verify(testRepository, testDigest, nil), "is not signed")
+	assert.ErrorContains(t, p.Verify(testRepository, testDigest, []*Signature{signWithKey(t, other, testRepository, testDigest)}),
+		"signed with untrusted key")
+	otherDigest := v1.Hash{Algorithm: "sha256", Hex: "0000000000000000000000000000000000000000000000000000000000000000"}
+	assert.ErrorContains(t, p.Verify(testRepository, testDigest, []*Signature{signWithKey(t, trusted, testRepository, otherDigest)}),
+		"signature of other image")
+	assert.ErrorContains(t, p.Verify(testRepository, testDigest, []*Signature{signWithKey(t, trusted, "ghcr.io/macvmio/other", testDigest)}),
+		"signature of image in other repository")
+	assert.ErrorContains(t, p.Verify("docker.io/library/ubuntu", testDigest, nil), "no policy for repository")
+
+	// signature survives round trip through annotations of the artifact
+	sig := signWithKey(t, trusted, testRepository, testDigest)
+	parsed, err := ParseSignature(sig.Payload, sig.Annotations())
+	require.NoError(t, err)
+	assert.NoError(t, p.Verify(testRepository, testDigest, []*Signature{parsed}))
+}
+
+// keylessSignature returns signature made with certificate for email issued by ca, like Fulcio does, and
+// recorded at signedAt in log signing its entries with rekorKey.
+func keylessSignature(t *testing.T, ca *x509.Certificate, caKey crypto.Signer, rekorKey crypto.Signer, email string, signedAt time.Time) *Signature {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	issuer, err := asn1.Marshal("https://accounts.example.com")
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       signedAt.Add(-time.Minute),
+		NotAfter:        signedAt.Add(10 * time.Minute),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses:  []string{email},
+		ExtraExtensions: []pkix.Extension{{Id: oidIssuerV2, Value: issuer}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	require.NoError(t, err)
+	payload, err := NewPayload(testRepository, testDigest)
+	require.NoError(t, err)
+	sig := &Signature{Payload: payload, Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+	sig.Signature, err = signDigest(key, payload)
+	require.NoError(t, err)
+
+	var entry hashedRekord
+	entry.Spec.Signature.Content = sig.Signature
+	entry.Spec.Signature.PublicKey.Content = sig.Certificate
+	entry.Spec.Data.Hash.Algorithm = "sha256"
+	digest := sha256.Sum256(payload)
+	entry.Spec.Data.Hash.Value = hex.EncodeToString(digest[:])
+	body, err := json.Marshal(entry)
+	require.NoError(t, err)
+	var bundle rekorBundle
+	bundle.Payload.Body = base64.StdEncoding.EncodeToString(body)
+	bundle.Payload.IntegratedTime = signedAt.Unix()
+	bundle.Payload.LogIndex = 42
+	bundle.Payload.LogID = "c0d23d6a"
+	canonical, err := json.Marshal(map[string]any{
+		"body":           bundle.Payload.Body,
+		"integratedTime": bundle.Payload.IntegratedTime,
+		"logIndex":       bundle.Payload.LogIndex,
+		"logID":          bundle.Payload.LogID,
+	})
+	require.NoError(t, err)
+	bundle.SignedEntryTimestamp, err = signDigest(rekorKey, canonical)
+	require.NoError(t, err)
+	sig.Bundle, err = json.Marshal(bundle)
+	require.NoError(t, err)
+	return sig
+}
+
+// writeFulcioRoot writes certificate of CA standing in for Fulcio to fulcio.pem in dir.
+func writeFulcioRoot(t *testing.T, dir string) (*x509.Certificate, crypto.Signer) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fulcio"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "fulcio.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0o644))
+	return ca, caKey
+}
+
+func TestPolicy_Verify_keyless(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeFulcioRoot(t, dir)
+	rekorKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	writePublicKey(t, dir, "rekor.pub", rekorKey.Public())
+	p := writePolicy(t, dir, `{
+		"fulcioRoots": "fulcio.pem",
+		"rekorKey": "rekor.pub",
+		"repositories": [{"repository": "ghcr.io/macvmio/*", "identities": [{"issuer": "https://accounts.example.com", "subjectRegExp": "@example.com$"}]}]
+	}`)
+
+	// the certificate expired long ago, but was valid when the signature was recorded
+	signedAt := time.Now().Add(-time.Hour)
+	sig := keylessSignature(t, ca, caKey, rekorKey, "ci@example.com", signedAt)
+	assert.NoError(t, p.Verify(testRepository, testDigest, []*Signature{sig}))
+
+	untrusted := keylessSignature(t, ca, caKey, rekorKey, "someone@example.org", signedAt)
+	assert.ErrorContains(t, p.Verify(testRepository, testDigest, []*Signature{untrusted}), "untrusted identity someone@example.org")
+
+	otherLog, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	forged := keylessSignature(t, ca, caKey, otherLog, "ci@example.com", signedAt)
+	assert.ErrorContains(t, p.Verify(testRepository, testDigest, []*Signature{forged}), "invalid bundle")
+
+	// signature made with expired certificate, backdated to when the certificate was valid
+	expired := keylessSignature(t, ca, caKey, rekorKey, "ci@example.com", signedAt)
+	var bundle rekorBundle
+	require.NoError(t, json.Unmarshal(expired.Bundle, &bundle))
+	bundle.Payload.IntegratedTime = signedAt.Add(-time.Hour).Unix()
+	expired.Bundle, err = json.Marshal(bundle)
+	require.NoError(t, err)
+	assert.ErrorContains(t, p.Verify(testRepository, testDigest, []*Signature{expired}), "invalid bundle")
+
+	sig.Bundle = nil
+	assert.ErrorContains(t, p.Verify(testRepository, testDigest, []*Signature{sig}), "not recorded in transparency log")
+}
+
+func TestLoadPolicy_identitiesWithoutRekorKey(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "policy.json")
+	writeFulcioRoot(t, dir)
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"fulcioRoots": "fulcio.pem",
+		"repositories": [{"repository": "ghcr.io/macvmio/*", "identities": [{"issuer": "https://accounts.example.com", "subject": "ci@example.com"}]}]
+	}`), 0o644))
+	_, err := LoadPolicy(path)
+	assert.ErrorContains(t, err, "need rekorKey")
+}
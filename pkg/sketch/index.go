@@ -0,0 +1,450 @@
+package sketch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"golang.org/x/sync/errgroup"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// IndexDirectory is the hidden directory of the root directory holding the candidate index, see WithCandidateIndex.
+// Names starting with a dot are never valid references, so it is not visible as an image.
+const IndexDirectory = ".geranos"
+
+const (
+	candidateIndexFilename = "candidates.json"
+	candidateIndexVersion  = 2
+)
+
+// candidateIndex lists segments of every local image by the manifest describing them, so clone candidates
+// are found without walking the root directory and parsing every manifest. It remembers modification times
+// of directories and manifests it was built from: a new or removed image changes one of them, which makes
+// the index stale.
+type candidateIndex struct {
+	Version     int                        `json:"version"`
+	Directories map[string]int64           `json:"directories"`
+	Manifests   map[string]indexedManifest `json:"manifests"`
+}
+
+type indexedManifest struct {
+	ModTime int64 `json:"modTime"`
+	Size    int64 `json:"size"`
+	// Digest is the digest of the manifest, which images pulled from a registry share with it
+	Digest   string           `json:"digest"`
+	Segments []indexedSegment `json:"segments"`
+}
+
+// indexedSegment tells where a segment with given digest lives: in File of the image, at Start-Stop.
+type indexedSegment struct {
+	Digest string `json:"digest"`
+	File   string `json:"file"`
+	Start  int64  `json:"start"`
+	Stop   int64  `json:"stop"`
+}
+
+// WithCandidateIndex makes Sketcher keep an index of clone candidates in IndexDirectory of the root directory.
+// The root directory is walked again only when the index is missing or stale, so images changed in place
+// should be reported with UpdateIndex.
+func WithCandidateIndex(enabled bool) Option {
+	return func(sc *Sketcher) {
+		sc.candidateIndex = enabled
+	}
+}
+
+func (sc *Sketcher) indexPath() string {
+	return filepath.Join(sc.rootDirectory, IndexDirectory, candidateIndexFilename)
+}
+
+// modTime returns modification time and size of path, or -1 when it does not exist.
+func modTime(fsys sysenv.FS, path string) (int64, int64) {
+	info, err := fsys.Stat(path)
+	if err != nil {
+		return -1, -1
+	}
+	return info.ModTime().UnixNano(), info.Size()
+}
+
+func (sc *Sketcher) loadIndex() (*candidateIndex, error) {
+	data, err := sc.fs.ReadFile(sc.indexPath())
+	if err != nil {
+		return nil, err
+	}
+	var idx candidateIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("invalid candidate index: %w", err)
+	}
+	if idx.Version != candidateIndexVersion {
+		return nil, fmt.Errorf("unsupported candidate index version %d", idx.Version)
+	}
+	return &idx, nil
+}
+
+func (sc *Sketcher) saveIndex(idx *candidateIndex) error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return fmt.Errorf("unable to marshal candidate index: %w", err)
+	}
+	if err := sc.fs.MkdirAll(filepath.Dir(sc.indexPath()), os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create index directory: %w", err)
+	}
+	// write to temporary file first, so concurrent readers never see it truncated, and concurrent
+	// writers each have their own
+	f, err := sysenv.CreateTemp(sc.fs, filepath.Dir(sc.indexPath()), filepath.Base(sc.indexPath())+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to write candidate index: %w", err)
+	}
+	tmpPath := f.Name()
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = sc.fs.Chmod(tmpPath, 0o644)
+	}
+	if err != nil {
+		_ = sc.fs.Remove(tmpPath)
+		return fmt.Errorf("unable to write candidate index: %w", err)
+	}
+	if err := sc.fs.Rename(tmpPath, sc.indexPath()); err != nil {
+		_ = sc.fs.Remove(tmpPath)
+		return fmt.Errorf("unable to replace candidate index: %w", err)
+	}
+	return nil
+}
+
+// isFresh reports whether nothing the index was built from has changed since.
+func (sc *Sketcher) isFresh(idx *candidateIndex) bool {
+	for rel, recorded := range idx.Directories {
+		if t, _ := modTime(sc.fs, filepath.Join(sc.rootDirectory, filepath.FromSlash(rel))); t != recorded {
+			return false
+		}
+	}
+	for rel, m := range idx.Manifests {
+		t, size := modTime(sc.fs, filepath.Join(sc.rootDirectory, filepath.FromSlash(rel)))
+		if t != m.ModTime || size != m.Size {
+			return false
+		}
+	}
+	return true
+}
+
+// buildIndex walks dir within the root directory, parsing manifests in parallel. Hidden directories,
+// like staging directories or IndexDirectory, are skipped, as are directories which can not be read.
+func (sc *Sketcher) buildIndex(dir string) (*candidateIndex, error) {
+	idx := &candidateIndex{
+		Version:     candidateIndexVersion,
+		Directories: make(map[string]int64),
+		Manifests:   make(map[string]indexedManifest),
+	}
+	manifests := make([]string, 0)
+	err := sysenv.WalkDir(sc.fs, dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, relErr := sc.relPath(path)
+		if relErr != nil {
+			return relErr
+		}
+		if d.IsDir() {
+			if path != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			idx.Directories[rel], _ = modTime(sc.fs, path)
+			return nil
+		}
+		if d.Name() == sc.manifestFileName {
+			manifests = append(manifests, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	g := errgroup.Group{}
+	g.SetLimit(runtime.NumCPU())
+	for _, rel := range manifests {
+		g.Go(func() error {
+			m, err := sc.indexManifest(rel)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			idx.Manifests[rel] = *m
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (sc *Sketcher) relPath(path string) (string, error) {
+	rel, err := filepath.Rel(sc.rootDirectory, path)
+	if err != nil {
+		return "", fmt.Errorf("unable to make '%v' relative to root directory: %w", path, err)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// indexManifest parses manifest at rel, recording its modification time before reading it, so a manifest
+// replaced in the meantime makes the index stale rather than out of date.
+func (sc *Sketcher) indexManifest(rel string) (*indexedManifest, error) {
+	path := filepath.Join(sc.rootDirectory, filepath.FromSlash(rel))
+	t, size := modTime(sc.fs, path)
+	data, err := sc.fs.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse manifest '%v': %w", path, err)
+	}
+	digest, _, err := v1.SHA256(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	res := &indexedManifest{ModTime: t, Size: size, Digest: digest.String(), Segments: make([]indexedSegment, 0, len(manifest.Layers))}
+	for _, l := range manifest.Layers {
+		d, err := filesegment.ParseDescriptor(l, v1.Hash{})
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse descriptor: %w", err)
+		}
+		res.Segments = append(res.Segments, indexedSegment{
+			Digest: d.Digest().String(),
+			File:   d.Filename(),
+			Start:  d.Start(),
+			Stop:   d.Stop(),
+		})
+	}
+	return res, nil
+}
+
+// candidates groups indexed segments by file, in order of manifest paths and filenames,
+// so ties between equally good candidates are broken the same way every time.
+func (idx *candidateIndex) candidates(rootDir string) ([]*cloneCandidate, error) {
+	paths := make([]string, 0, len(idx.Manifests))
+	for rel := range idx.Manifests {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	res := make([]*cloneCandidate, 0)
+	for _, rel := range paths {
+		files := make(map[string][]filesegment.Descriptor)
+		for _, s := range idx.Manifests[rel].Segments {
+			digest, err := v1.NewHash(s.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("invalid digest in candidate index: %w", err)
+			}
+			files[s.File] = append(files[s.File], *filesegment.NewDescriptor(s.File, s.Start, s.Stop, digest))
+		}
+		filenames := make([]string, 0, len(files))
+		for f := range files {
+			filenames = append(filenames, f)
+		}
+		sort.Strings(filenames)
+		for _, f := range filenames {
+			res = append(res, &cloneCandidate{
+				descriptors: files[f],
+				dirPath:     filepath.Dir(filepath.Join(rootDir, filepath.FromSlash(rel))),
+				filename:    f,
+			})
+		}
+	}
+	return res, nil
+}
+
+// currentIndex returns fresh index, loading it when possible, and rebuilding and saving it otherwise.
+func (sc *Sketcher) currentIndex() (*candidateIndex, error) {
+	if !sc.candidateIndex {
+		return sc.buildIndex(sc.rootDirectory)
+	}
+	sc.indexMu.Lock()
+	defer sc.indexMu.Unlock()
+	idx, err := sc.loadIndex()
+	if err == nil && sc.isFresh(idx) {
+		return idx, nil
+	}
+	// index directory is created before the walk, so creating it does not make the new index stale right away
+	if err := sc.fs.MkdirAll(filepath.Dir(sc.indexPath()), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("unable to create index directory: %w", err)
+	}
+	idx, err = sc.buildIndex(sc.rootDirectory)
+	if err != nil {
+		return nil, err
+	}
+	if err := sc.saveIndex(idx); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// UpdateIndex refreshes the candidate index after images in dirs were written, changed, removed or moved from
+// one dir to another, so the next lookup does not walk the root directory. The index is saved once, with all
+// dirs updated. An index which was already stale is dropped instead, as changes made elsewhere would be hidden
+// by the refresh. It does nothing without WithCandidateIndex.
+func (sc *Sketcher) UpdateIndex(dirs ...string) error {
+	if !sc.candidateIndex {
+		return nil
+	}
+	rels := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		rel, err := sc.relPath(dir)
+		if err != nil {
+			return err
+		}
+		if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("'%v' is not an image directory within the root directory", dir)
+		}
+		rels = append(rels, rel)
+	}
+	sc.indexMu.Lock()
+	defer sc.indexMu.Unlock()
+	idx, err := sc.loadIndex()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil || !sc.isFreshExcept(idx, rels) {
+		if err := sc.fs.Remove(sc.indexPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to remove stale candidate index: %w", err)
+		}
+		return nil
+	}
+	for i, dir := range dirs {
+		rel := rels[i]
+		// forget everything under dir, it is indexed again below
+		for r := range idx.Directories {
+			if r == rel || strings.HasPrefix(r, rel+"/") {
+				delete(idx.Directories, r)
+			}
+		}
+		for r := range idx.Manifests {
+			if strings.HasPrefix(r, rel+"/") {
+				delete(idx.Manifests, r)
+			}
+		}
+		if info, err := sc.fs.Stat(dir); err == nil && info.IsDir() {
+			sub, err := sc.buildIndex(dir)
+			if err != nil {
+				return err
+			}
+			for r, t := range sub.Directories {
+				idx.Directories[r] = t
+			}
+			for r, m := range sub.Manifests {
+				idx.Manifests[r] = m
+			}
+		}
+		// parents of dir record its creation or removal
+		for parent := filepath.Dir(dir); ; parent = filepath.Dir(parent) {
+			prel, err := sc.relPath(parent)
+			if err != nil || strings.HasPrefix(prel, "..") {
+				break
+			}
+			idx.Directories[prel], _ = modTime(sc.fs, parent)
+			if prel == "." {
+				break
+			}
+		}
+	}
+	return sc.saveIndex(idx)
+}
+
+// isFreshExcept is isFresh ignoring rels and their subdirectories, which are about to be indexed again.
+// Parents of rels change with their creation or removal, so they only have to list the same subdirectories
+// as recorded, apart from the ones leading to rels.
+func (sc *Sketcher) isFreshExcept(idx *candidateIndex, rels []string) bool {
+	inside := func(r string) bool {
+		for _, rel := range rels {
+			if r == rel || strings.HasPrefix(r, rel+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	isParent := func(r string) bool {
+		for _, rel := range rels {
+			if r == "." || strings.HasPrefix(rel, r+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	filtered := &candidateIndex{Directories: make(map[string]int64), Manifests: make(map[string]indexedManifest)}
+	for r, t := range idx.Directories {
+		if !inside(r) && !isParent(r) {
+			filtered.Directories[r] = t
+		}
+	}
+	for r, m := range idx.Manifests {
+		if !inside(r) {
+			filtered.Manifests[r] = m
+		}
+	}
+	if !sc.isFresh(filtered) {
+		return false
+	}
+	for _, rel := range rels {
+		for parent := path.Dir(rel); ; parent = path.Dir(parent) {
+			if t, _ := modTime(sc.fs, filepath.Join(sc.rootDirectory, filepath.FromSlash(parent))); t != idx.Directories[parent] {
+				if !sc.sameSubdirectories(idx, parent, rels) {
+					return false
+				}
+			}
+			if parent == "." {
+				break
+			}
+		}
+	}
+	return true
+}
+
+// sameSubdirectories reports whether parent has the subdirectories recorded by idx, ignoring hidden ones
+// and the ones leading to rels.
+func (sc *Sketcher) sameSubdirectories(idx *candidateIndex, parent string, rels []string) bool {
+	entries, err := sc.fs.ReadDir(filepath.Join(sc.rootDirectory, filepath.FromSlash(parent)))
+	if err != nil {
+		return false
+	}
+	ignored := func(r string) bool {
+		for _, rel := range rels {
+			if r == rel || strings.HasPrefix(rel, r+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	actual := make(map[string]struct{})
+	for _, e := range entries {
+		r := path.Join(parent, e.Name())
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") && !ignored(r) {
+			actual[r] = struct{}{}
+		}
+	}
+	recorded := 0
+	for r := range idx.Directories {
+		if r == "." || path.Dir(r) != parent || ignored(r) {
+			continue
+		}
+		if _, ok := actual[r]; !ok {
+			return false
+		}
+		recorded++
+	}
+	return recorded == len(actual)
+}
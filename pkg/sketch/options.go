@@ -0,0 +1,73 @@
+package sketch
+
+import (
+	"github.com/macvmio/geranos/pkg/duplicator"
+	"github.com/macvmio/geranos/pkg/sysenv"
+)
+
+type Option func(sc *Sketcher)
+
+func WithFileSystem(fsys sysenv.FS) Option {
+	return func(sc *Sketcher) {
+		sc.fs = fsys
+	}
+}
+
+// WithCloneFunction replaces the function used to clone candidate files into the destination directory.
+// Files cloned with it are reported to progress function only once they are done.
+func WithCloneFunction(cloneFile func(src, dst string) error) Option {
+	return func(sc *Sketcher) {
+		sc.cloneFile = func(src, dst string, _ func(n int64)) error {
+			return cloneFile(src, dst)
+		}
+	}
+}
+
+// WithCloner makes candidate files cloned with given Cloner, reporting progress while they are being copied.
+func WithCloner(c *duplicator.Cloner) Option {
+	return func(sc *Sketcher) {
+		sc.cloneFile = c.CloneFileWithProgress
+	}
+}
+
+// WithProgressFunction sets function called while Sketch clones files, and after every file cloned,
+// with bytes of the file cloned so far, and with the number of bytes cloned so far out of bytes of all files
+// which could have been cloned.
+func WithProgressFunction(progress func(filename string, fileBytesCloned int64, fileSize int64, bytesCloned int64, bytesTotal int64)) Option {
+	return func(sc *Sketcher) {
+		sc.progress = progress
+	}
+}
+
+// WithUnmatchedPenalty lowers score of clone candidates by weight for every byte of theirs the image does not have.
+// Such bytes are copied for nothing without Copy-on-Write, and have to be overwritten by downloads anyway,
+// so a positive weight prefers candidates closer to the image. Weight 0, the default, compares only bytes saved.
+func WithUnmatchedPenalty(weight float64) Option {
+	return func(sc *Sketcher) {
+		sc.unmatchedPenalty = weight
+	}
+}
+
+// WithMultiSource sets whether Sketch fills segments missing in the best candidate of a file from other candidates
+// having them at the same range. It is enabled by default.
+func WithMultiSource(enabled bool) Option {
+	return func(sc *Sketcher) {
+		sc.multiSource = enabled
+	}
+}
+
+// WithRangeCloneFunction replaces the function copying ranges of other candidates into cloned files.
+func WithRangeCloneFunction(cloneRange func(src, dst string, offset, length int64) error) Option {
+	return func(sc *Sketcher) {
+		sc.cloneRange = cloneRange
+	}
+}
+
+// WithCandidateRoots makes images of other root directories, like other stores, clone candidates as well, each found
+// with its own candidate index. Candidates of the root directory come first, so they win ties, as cloning within
+// one filesystem can share extents instead of copying them.
+func WithCandidateRoots(dirs ...string) Option {
+	return func(sc *Sketcher) {
+		sc.candidateRoots = append(sc.candidateRoots, dirs...)
+	}
+}
@@ -5,18 +5,41 @@ import (
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/macvmio/geranos/pkg/duplicator"
 	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/sysenv"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 )
 
-func NewSketcher(rootDir string, manifestFilename string) *Sketcher {
-	return &Sketcher{rootDirectory: rootDir, manifestFileName: manifestFilename}
+func NewSketcher(rootDir string, manifestFilename string, opts ...Option) *Sketcher {
+	sc := &Sketcher{
+		rootDirectory:    rootDir,
+		manifestFileName: manifestFilename,
+		fs:               sysenv.OS,
+		cloneFile:        duplicator.CloneFileWithProgress,
+		cloneRange:       duplicator.CloneRange,
+		multiSource:      true,
+	}
+	for _, o := range opts {
+		o(sc)
+	}
+	return sc
 }
 
 type Sketcher struct {
 	rootDirectory    string
 	manifestFileName string
+	fs               sysenv.FS
+	cloneFile        func(src, dst string, progress func(n int64)) error
+	progress         func(filename string, fileBytesCloned int64, fileSize int64, bytesCloned int64, bytesTotal int64)
+	unmatchedPenalty float64
+	cloneRange       func(src, dst string, offset, length int64) error
+	multiSource      bool
+	candidateIndex   bool
+	candidateRoots   []string
+	indexMu          sync.Mutex
 }
 
 type cloneCandidate struct {
@@ -26,12 +49,12 @@ type cloneCandidate struct {
 }
 
 func (cc *cloneCandidate) FilePath() string {
-	return filepath.Join(cc.dirPath, cc.filename)
+	return filepath.Join(cc.dirPath, filepath.FromSlash(cc.filename))
 }
 
-func resizeFile(filePath string, newSize int64) error {
+func resizeFile(fsys sysenv.FS, filePath string, newSize int64) error {
 	// Open file with read and write permissions
-	file, err := os.OpenFile(filePath, os.O_RDWR, 0644)
+	file, err := fsys.OpenFile(filePath, os.O_RDWR, 0644)
 	if err != nil {
 		return err
 	}
@@ -47,46 +70,125 @@ func resizeFile(filePath string, newSize int64) error {
 }
 
 // fileExists checks if a file exists and is not a directory
-func fileExists(filePath string) bool {
-	info, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
+func fileExists(fsys sysenv.FS, filePath string) bool {
+	info, err := fsys.Stat(filePath)
+	if err != nil {
 		return false
 	}
 	return !info.IsDir()
 }
 
-func (sc *Sketcher) Sketch(dir string, manifest v1.Manifest, diffIDs []v1.Hash) (bytesClonedCount int64, matchedSegmentsCount int64, err error) {
+// ClonePlan names local file which Sketch would clone as file of the image. Descriptors are segments
+// of the source file, as recorded by the manifest of its image. Ranges are segments of the image the source
+// lacks, which other local files have at the same range, and which are copied from them afterwards.
+// Identical is set when the source has exactly the segments of the file, so it needs no resizing or verification.
+type ClonePlan struct {
+	Filename    string
+	Source      string
+	Descriptors []filesegment.Descriptor
+	Ranges      []RangePlan
+	Identical   bool
+
+	blueprint *fileBlueprint
+	score     candidateScore
+}
+
+// RangePlan names local file having segment of the image at the same range.
+type RangePlan struct {
+	Source  string
+	Segment filesegment.Descriptor
+}
+
+// rangeKey identifies segment by its content and place in the file.
+type rangeKey struct {
+	digest      string
+	start, stop int64
+}
+
+func newRangeKey(d *filesegment.Descriptor) rangeKey {
+	return rangeKey{digest: d.Digest().String(), start: d.Start(), stop: d.Stop()}
+}
+
+// Plan returns files Sketch would clone into dir, without changing anything.
+func (sc *Sketcher) Plan(dir string, manifest v1.Manifest, diffIDs []v1.Hash) ([]ClonePlan, error) {
+	plans, _, err := sc.plan(dir, manifest, diffIDs)
+	return plans, err
+}
+
+// plan picks the best clone candidate for every file of the image missing in dir, and returns also
+// total size of the missing files.
+func (sc *Sketcher) plan(dir string, manifest v1.Manifest, diffIDs []v1.Hash) ([]ClonePlan, int64, error) {
 	fileBlueprints, err := createBlueprintsFromManifest(manifest, diffIDs)
 	if err != nil {
-		return 0, 0, err
+		return nil, 0, err
 	}
 
 	cloneCandidates, err := sc.findCloneCandidates()
 	if err != nil {
-		return 0, 0, fmt.Errorf("encountered error while looking for manifests: %w", err)
-	}
-	err = os.MkdirAll(dir, os.ModePerm)
-	if err != nil {
-		return 0, 0, fmt.Errorf("unable to create directory '%v': %w", dir, err)
+		return nil, 0, fmt.Errorf("encountered error while looking for manifests: %w", err)
 	}
 
+	missing := make([]*fileBlueprint, 0)
+	bytesTotal := int64(0)
 	for _, fr := range fileBlueprints {
-		if fileExists(filepath.Join(dir, fr.Filename)) {
+		if fileExists(sc.fs, filepath.Join(dir, filepath.FromSlash(fr.Filename))) {
 			continue
 		}
+		missing = append(missing, fr)
+		bytesTotal += fr.Size()
+	}
+
+	// segments every candidate has, by their range, so segments the best candidate lacks can be found elsewhere
+	rangeSources := make(map[rangeKey]string)
+	if sc.multiSource {
+		for _, cc := range cloneCandidates {
+			for i := range cc.descriptors {
+				if _, ok := rangeSources[newRangeKey(&cc.descriptors[i])]; !ok {
+					rangeSources[newRangeKey(&cc.descriptors[i])] = cc.FilePath()
+				}
+			}
+		}
+	}
+
+	// candidates by digests of their segments, so only candidates sharing a segment with the file are scored
+	candidatesByDigest := make(map[string][]int)
+	for i, cc := range cloneCandidates {
+		for _, d := range cc.descriptors {
+			digest := d.Digest().String()
+			if n := len(candidatesByDigest[digest]); n == 0 || candidatesByDigest[digest][n-1] != i {
+				candidatesByDigest[digest] = append(candidatesByDigest[digest], i)
+			}
+		}
+	}
+
+	plans := make([]ClonePlan, 0)
+	for _, fr := range missing {
 		// we will process each FR exactly once
 		// fr can easily have 1000 layers,
 		// each manifest can also have more than 1000 layers
 		// we need to compute best score in expected linear time
 		segmentsDigestMap := make(map[string]filesegment.Descriptor)
+		matching := make(map[int]struct{})
 		for _, seg := range fr.Segments {
 			segmentsDigestMap[seg.Digest().String()] = *seg
+			for _, i := range candidatesByDigest[seg.Digest().String()] {
+				matching[i] = struct{}{}
+			}
+		}
+		// candidates are compared in their original order, so ties are broken as before
+		order := make([]int, 0, len(matching))
+		for i := range matching {
+			order = append(order, i)
 		}
-		bestScore := 0
+		sort.Ints(order)
+		bestValue := int64(0)
+		var bestScore candidateScore
 		var bestCloneCandidate *cloneCandidate
-		for _, cc := range cloneCandidates {
+		for _, i := range order {
+			cc := cloneCandidates[i]
 			score := sc.computeScore(segmentsDigestMap, cc)
-			if score > bestScore {
+			if value := score.value(sc.unmatchedPenalty); value > bestValue {
+				bestValue = value
 				bestScore = score
 				bestCloneCandidate = cc
 			}
@@ -94,92 +196,199 @@ func (sc *Sketcher) Sketch(dir string, manifest v1.Manifest, diffIDs []v1.Hash)
 		if bestCloneCandidate == nil {
 			continue
 		}
-		bytesClonedCount += fr.Size()
-		matchedSegmentsCount += int64(bestScore)
-		src := bestCloneCandidate.FilePath()
-		dest := filepath.Join(dir, fr.Filename)
-		if src == dest {
+		plan := ClonePlan{
+			Filename:    fr.Filename,
+			Source:      bestCloneCandidate.FilePath(),
+			Descriptors: bestCloneCandidate.descriptors,
+			Identical:   isIdentical(fr, bestCloneCandidate),
+			blueprint:   fr,
+			score:       bestScore,
+		}
+		if !plan.Identical {
+			plan.Ranges = planRanges(fr, bestCloneCandidate, rangeSources)
+		}
+		plans = append(plans, plan)
+	}
+	return plans, bytesTotal, nil
+}
+
+// isIdentical reports whether candidate has exactly the segments of fr, at the same ranges.
+func isIdentical(fr *fileBlueprint, cc *cloneCandidate) bool {
+	if len(fr.Segments) != len(cc.descriptors) {
+		return false
+	}
+	segments := make(map[rangeKey]struct{}, len(fr.Segments))
+	for _, seg := range fr.Segments {
+		segments[newRangeKey(seg)] = struct{}{}
+	}
+	for i := range cc.descriptors {
+		if _, ok := segments[newRangeKey(&cc.descriptors[i])]; !ok {
+			return false
+		}
+	}
+	return len(segments) == len(cc.descriptors)
+}
+
+// planRanges returns segments of fr which base does not have at their range, but other candidates do.
+func planRanges(fr *fileBlueprint, base *cloneCandidate, rangeSources map[rangeKey]string) []RangePlan {
+	if len(rangeSources) == 0 {
+		return nil
+	}
+	covered := make(map[rangeKey]struct{})
+	for i := range base.descriptors {
+		covered[newRangeKey(&base.descriptors[i])] = struct{}{}
+	}
+	res := make([]RangePlan, 0)
+	for _, seg := range fr.Segments {
+		key := newRangeKey(seg)
+		if _, ok := covered[key]; ok {
 			continue
 		}
-		log.Printf("cloning file %s -> %s\n", src, dest)
-		err = duplicator.CloneFile(src, dest)
-		if err != nil {
-			return bytesClonedCount, matchedSegmentsCount, fmt.Errorf("unable to clone source file '%v' to destination '%v': %w", src, dest, err)
+		if src, ok := rangeSources[key]; ok && src != base.FilePath() {
+			res = append(res, RangePlan{Source: src, Segment: *seg})
 		}
-		err = resizeFile(dest, fr.Size())
-		if err != nil {
-			return bytesClonedCount, matchedSegmentsCount, fmt.Errorf("error occured while resizing file '%v' to its new size '%v': %w", dest, fr.Size(), err)
+	}
+	return res
+}
+
+// cloneRanges copies planned ranges into dest, merging adjacent ones coming from the same source.
+func (sc *Sketcher) cloneRanges(dest string, ranges []RangePlan) error {
+	for i := 0; i < len(ranges); {
+		src := ranges[i].Source
+		start, stop := ranges[i].Segment.Start(), ranges[i].Segment.Stop()
+		j := i + 1
+		for ; j < len(ranges) && ranges[j].Source == src && ranges[j].Segment.Start() == stop+1; j++ {
+			stop = ranges[j].Segment.Stop()
+		}
+		log.Printf("cloning range %d-%d %s -> %s\n", start, stop, src, dest)
+		if err := sc.cloneRange(src, dest, start, stop-start+1); err != nil {
+			return fmt.Errorf("unable to clone range %d-%d of '%v' to '%v': %w", start, stop, src, dest, err)
 		}
+		i = j
 	}
-	return bytesClonedCount, matchedSegmentsCount, nil
+	return nil
 }
 
-// parseManifestFile represents a placeholder for your actual parsing logic.
-func (sc *Sketcher) findCloneCandidates() ([]*cloneCandidate, error) {
-	type Job struct {
-		path string
+// Sketch clones best local candidates of files of the image missing in dir. Besides the numbers of bytes cloned
+// and segments matched, it returns files cloned from identical ones, whose segments need no verification.
+func (sc *Sketcher) Sketch(dir string, manifest v1.Manifest, diffIDs []v1.Hash) (bytesClonedCount int64, matchedSegmentsCount int64, identicalFiles []string, err error) {
+	plans, bytesTotal, err := sc.plan(dir, manifest, diffIDs)
+	if err != nil {
+		return 0, 0, nil, err
 	}
-	jobs := make(chan Job, 8)
+	err = sc.fs.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("unable to create directory '%v': %w", dir, err)
+	}
+	identicalFiles = make([]string, 0)
 
-	go func() {
-		filepath.Walk(sc.rootDirectory, func(path string, info os.FileInfo, err error) error {
+	for _, p := range plans {
+		fr := p.blueprint
+		bytesClonedBefore := bytesClonedCount
+		bytesClonedCount += fr.Size()
+		matchedSegmentsCount += int64(p.score.matchedSegments + len(p.Ranges))
+		src := p.Source
+		dest := filepath.Join(dir, filepath.FromSlash(fr.Filename))
+		if src == dest {
+			continue
+		}
+		err = sc.fs.MkdirAll(filepath.Dir(dest), os.ModePerm)
+		if err != nil {
+			return bytesClonedCount, matchedSegmentsCount, identicalFiles, fmt.Errorf("unable to create directory for '%v': %w", dest, err)
+		}
+		log.Printf("cloning file %s -> %s\n", src, dest)
+		fileBytesCloned := int64(0)
+		err = sc.cloneFile(src, dest, func(n int64) {
+			// source may be larger than the file it is cloned for, it gets resized afterwards
+			fileBytesCloned = min(fileBytesCloned+n, fr.Size())
+			if sc.progress != nil {
+				sc.progress(fr.Filename, fileBytesCloned, fr.Size(), bytesClonedBefore+fileBytesCloned, bytesTotal)
+			}
+		})
+		if err != nil {
+			return bytesClonedCount, matchedSegmentsCount, identicalFiles, fmt.Errorf("unable to clone source file '%v' to destination '%v': %w", src, dest, err)
+		}
+		if p.Identical {
+			// the size is already right, as the source ends with the same segment
+			identicalFiles = append(identicalFiles, fr.Filename)
+		} else {
+			err = resizeFile(sc.fs, dest, fr.Size())
 			if err != nil {
-				return fmt.Errorf("error accessing path %q: %w", path, err)
+				return bytesClonedCount, matchedSegmentsCount, identicalFiles, fmt.Errorf("error occured while resizing file '%v' to its new size '%v': %w", dest, fr.Size(), err)
 			}
-			if !info.IsDir() && info.Name() == sc.manifestFileName {
-				jobs <- Job{path: path}
+			if err := sc.cloneRanges(dest, p.Ranges); err != nil {
+				return bytesClonedCount, matchedSegmentsCount, identicalFiles, err
 			}
-			return nil
-		})
-		close(jobs) // Close the jobs channel when done walking the directory
-	}()
+		}
+		if sc.progress != nil {
+			sc.progress(fr.Filename, fr.Size(), fr.Size(), bytesClonedCount, bytesTotal)
+		}
+	}
+	return bytesClonedCount, matchedSegmentsCount, identicalFiles, nil
+}
 
-	candidates := make([]*cloneCandidate, 0)
-	for job := range jobs {
-		f, err := os.Open(job.path)
+// findCloneCandidates lists files of local images, as recorded by their manifests, those of the root directory
+// first, followed by those of WithCandidateRoots.
+func (sc *Sketcher) findCloneCandidates() ([]*cloneCandidate, error) {
+	idx, err := sc.currentIndex()
+	if err != nil {
+		return nil, err
+	}
+	res, err := idx.candidates(sc.rootDirectory)
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range sc.candidateRoots {
+		// other roots only add candidates, an unavailable one, like an unmounted disk, is skipped
+		if _, err := sc.fs.Stat(root); err != nil {
+			log.Printf("skipping clone candidates of '%v': %v\n", root, err)
+			continue
+		}
+		other := NewSketcher(root, sc.manifestFileName, WithFileSystem(sc.fs), WithCandidateIndex(sc.candidateIndex))
+		otherIdx, err := other.currentIndex()
 		if err != nil {
-			return nil, err
+			log.Printf("skipping clone candidates of '%v': %v\n", root, err)
+			continue
 		}
-		defer f.Close()
-		manifest, err := v1.ParseManifest(f)
+		candidates, err := otherIdx.candidates(root)
 		if err != nil {
 			return nil, err
 		}
-		// Map to group descriptors by filename
-		fileDescriptorMap := make(map[string][]filesegment.Descriptor)
+		res = append(res, candidates...)
+	}
+	return res, nil
+}
 
-		// Parse each layer and group by filename
-		for _, l := range manifest.Layers {
-			segmentDescriptor, err := filesegment.ParseDescriptor(l, v1.Hash{})
-			if err != nil {
-				return nil, fmt.Errorf("unable to parse descriptor: %w", err)
-			}
-			filename := segmentDescriptor.Filename()
-			fileDescriptorMap[filename] = append(fileDescriptorMap[filename], *segmentDescriptor)
-		}
+// candidateScore rates clone candidate for a file of the image by bytes it saves from downloading.
+type candidateScore struct {
+	// matchedBytes is the length of segments of the image the candidate has, counting every digest once
+	matchedBytes    int64
+	matchedSegments int
+	// unmatchedBytes is the length of segments of the candidate the image does not have
+	unmatchedBytes int64
+}
 
-		// Create clone candidates for each file
-		for filename, descriptors := range fileDescriptorMap {
-			candidates = append(candidates, &cloneCandidate{
-				descriptors: descriptors,            // All descriptors from the same file
-				dirPath:     filepath.Dir(job.path), // Directory path from the job
-				filename:    filename,
-			})
-		}
-	}
-	return candidates, nil
+// value is the score compared between candidates, with unmatched bytes weighted by penalty.
+func (cs candidateScore) value(penalty float64) int64 {
+	return cs.matchedBytes - int64(penalty*float64(cs.unmatchedBytes))
 }
 
-func (sc *Sketcher) computeScore(segmentDigestMap map[string]filesegment.Descriptor, m *cloneCandidate) int {
-	score := 0
+// computeScore weights matching segments by their length, so a few large matching segments beat
+// many tiny ones, and the best candidate leaves the fewest bytes to download.
+func (sc *Sketcher) computeScore(segmentDigestMap map[string]filesegment.Descriptor, m *cloneCandidate) candidateScore {
+	score := candidateScore{}
 	seenDigests := make(map[string]struct{})
 	for _, descriptor := range m.descriptors {
 		digestStr := descriptor.Digest().String()
+		segment, ok := segmentDigestMap[digestStr]
+		if !ok {
+			score.unmatchedBytes += descriptor.Length()
+			continue
+		}
 		if _, alreadySeen := seenDigests[digestStr]; !alreadySeen {
 			seenDigests[digestStr] = struct{}{}
-			if _, ok := segmentDigestMap[digestStr]; ok {
-				score += 1
-			}
+			score.matchedBytes += segment.Length()
+			score.matchedSegments++
 		}
 	}
 	return score
@@ -5,11 +5,14 @@ import (
 	"fmt"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/duplicator"
 	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/sysenv"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -128,7 +131,7 @@ func TestDefaultSketchConstructor_ConstructConstruct(t *testing.T) {
 			descriptors := tt.prepareCloneCandidates(t, sc.rootDirectory)
 			manifest := tt.prepareManifest(descriptors)
 			fakeDiffIDs := make([]v1.Hash, len(manifest.Layers))
-			bytesClonedCount, matchedSegmentsCount, err := sc.Sketch(filepath.Join(rootDir, "some/dir"), manifest, fakeDiffIDs)
+			bytesClonedCount, matchedSegmentsCount, _, err := sc.Sketch(filepath.Join(rootDir, "some/dir"), manifest, fakeDiffIDs)
 
 			if tt.expectedErr != nil {
 				assert.EqualError(t, err, tt.expectedErr.Error())
@@ -240,6 +243,84 @@ func TestSketchConstructor_FindCloneCandidates(t *testing.T) {
 	}
 }
 
+func TestSketcher_CandidateIndex(t *testing.T) {
+	rootDir := t.TempDir()
+	prepare5CloneCandidatesWith10Layers(t, rootDir)
+	sc := NewSketcher(rootDir, testManifestName, WithCandidateIndex(true))
+
+	candidates, err := sc.findCloneCandidates()
+	require.NoError(t, err)
+	assert.Len(t, candidates, 10)
+	require.FileExists(t, sc.indexPath())
+
+	t.Run("unchanged manifests are not parsed again", func(t *testing.T) {
+		manifestPath := filepath.Join(rootDir, "v0", testManifestName)
+		original, err := os.ReadFile(manifestPath)
+		require.NoError(t, err)
+		info, err := os.Stat(manifestPath)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(manifestPath, make([]byte, len(original)), 0o777))
+		require.NoError(t, os.Chtimes(manifestPath, info.ModTime(), info.ModTime()))
+
+		candidates, err := sc.findCloneCandidates()
+		require.NoError(t, err)
+		assert.Len(t, candidates, 10)
+
+		require.NoError(t, os.WriteFile(manifestPath, original, 0o777))
+		require.NoError(t, os.Chtimes(manifestPath, info.ModTime(), info.ModTime()))
+	})
+
+	t.Run("new image makes the index stale", func(t *testing.T) {
+		localDir := filepath.Join(rootDir, "v9")
+		require.NoError(t, os.MkdirAll(localDir, os.ModePerm))
+		for _, f := range []string{"disk.img", "disk2.img", testManifestName} {
+			data, err := os.ReadFile(filepath.Join(rootDir, "v1", f))
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(filepath.Join(localDir, f), data, 0o777))
+		}
+
+		candidates, err := sc.findCloneCandidates()
+		require.NoError(t, err)
+		assert.Len(t, candidates, 12)
+	})
+
+	t.Run("updated index stays fresh", func(t *testing.T) {
+		localDir := filepath.Join(rootDir, "v9")
+		require.NoError(t, os.RemoveAll(localDir))
+		require.NoError(t, sc.UpdateIndex(localDir))
+
+		idx, err := sc.loadIndex()
+		require.NoError(t, err)
+		assert.True(t, sc.isFresh(idx))
+		candidates, err := idx.candidates(rootDir)
+		require.NoError(t, err)
+		assert.Len(t, candidates, 10)
+	})
+
+	t.Run("concurrent pulls save the index each with own temporary file", func(t *testing.T) {
+		idx, err := sc.loadIndex()
+		require.NoError(t, err)
+		var wg sync.WaitGroup
+		errs := make([]error, 8)
+		for i := range errs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = NewSketcher(rootDir, testManifestName, WithCandidateIndex(true)).saveIndex(idx)
+			}()
+		}
+		wg.Wait()
+		for _, err := range errs {
+			assert.NoError(t, err)
+		}
+		_, err = sc.loadIndex()
+		require.NoError(t, err)
+		leftovers, err := filepath.Glob(sc.indexPath() + ".*.tmp")
+		require.NoError(t, err)
+		assert.Empty(t, leftovers)
+	})
+}
+
 func TestSketchConstructor_ComputeScore(t *testing.T) {
 	// Define test cases
 	// Define test cases
@@ -344,11 +425,85 @@ func TestSketchConstructor_ComputeScore(t *testing.T) {
 			}
 			// Pass segmentDescriptors map instead of sortedSegments slice
 			score := sc.computeScore(tt.segmentDescriptors, &cc)
-			assert.Equal(t, tt.expectedScore, score)
+			// every segment is one byte long
+			assert.Equal(t, tt.expectedScore, score.matchedSegments)
+			assert.Equal(t, int64(tt.expectedScore), score.matchedBytes)
 		})
 	}
 }
 
+func TestSketchConstructor_ComputeScore_WeightedByLength(t *testing.T) {
+	const largeSegment = 64 << 20
+	image := make(map[string]filesegment.Descriptor)
+	tiny := make([]filesegment.Descriptor, 0)
+	large := make([]filesegment.Descriptor, 0)
+	for i := 0; i < 1000; i++ {
+		d := filesegment.NewDescriptor("disk.img", int64(i), int64(i), v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("tiny%d", i)})
+		image[d.Digest().String()] = *d
+		tiny = append(tiny, *d)
+	}
+	for i := 0; i < 10; i++ {
+		start := int64(1000 + i*largeSegment)
+		d := filesegment.NewDescriptor("disk.img", start, start+largeSegment-1, v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("large%d", i)})
+		image[d.Digest().String()] = *d
+		large = append(large, *d)
+	}
+
+	sc := Sketcher{}
+	tinyScore := sc.computeScore(image, &cloneCandidate{descriptors: tiny})
+	largeScore := sc.computeScore(image, &cloneCandidate{descriptors: large})
+	assert.Equal(t, 1000, tinyScore.matchedSegments)
+	assert.Equal(t, 10, largeScore.matchedSegments)
+	assert.Greater(t, largeScore.value(0), tinyScore.value(0))
+
+	// candidate carrying a lot of bytes the image does not have loses once they are penalized
+	unmatched := filesegment.NewDescriptor("disk.img", 0, 100*largeSegment-1, v1.Hash{Algorithm: "sha256", Hex: "other"})
+	bloated := sc.computeScore(image, &cloneCandidate{descriptors: append([]filesegment.Descriptor{*unmatched}, large[0])})
+	assert.Equal(t, int64(largeSegment), bloated.value(0))
+	assert.Less(t, bloated.value(0.5), int64(0))
+}
+
+func TestSketch_MultiSource(t *testing.T) {
+	rootDir := t.TempDir()
+	segments := make(map[string][]*filesegment.Descriptor)
+	for name, content := range map[string]string{"a": "AAxx", "b": "yyBB"} {
+		localDir := filepath.Join(rootDir, name)
+		require.NoError(t, os.MkdirAll(localDir, os.ModePerm))
+		require.NoError(t, os.WriteFile(filepath.Join(localDir, "disk.img"), []byte(content), 0o644))
+		img, err := dirimage.Read(context.Background(), localDir, dirimage.WithChunkSize(2))
+		require.NoError(t, err)
+		manifest, err := img.Manifest()
+		require.NoError(t, err)
+		for _, d := range manifest.Layers {
+			fd, err := filesegment.ParseDescriptor(d, v1.Hash{})
+			require.NoError(t, err)
+			segments[name] = append(segments[name], fd)
+		}
+		manifestBytes, err := img.RawManifest()
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(localDir, testManifestName), manifestBytes, 0o644))
+	}
+	// the image has the first segment of a and the second one of b
+	manifest := makeManifestFromSegments(segments["a"][0], segments["b"][1])
+	diffIDs := make([]v1.Hash, len(manifest.Layers))
+
+	dir := filepath.Join(rootDir, "c")
+	_, matchedSegmentsCount, _, err := NewSketcher(rootDir, testManifestName).Sketch(dir, manifest, diffIDs)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), matchedSegmentsCount)
+	content, err := os.ReadFile(filepath.Join(dir, "disk.img"))
+	require.NoError(t, err)
+	assert.Equal(t, "AABB", string(content))
+
+	dir = filepath.Join(rootDir, "d")
+	_, matchedSegmentsCount, _, err = NewSketcher(rootDir, testManifestName, WithMultiSource(false)).Sketch(dir, manifest, diffIDs)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), matchedSegmentsCount)
+	content, err = os.ReadFile(filepath.Join(dir, "disk.img"))
+	require.NoError(t, err)
+	assert.Contains(t, []string{"AAxx", "yyBB"}, string(content))
+}
+
 func TestSketch_DoesNotOverwriteExistingFile(t *testing.T) {
 	const existingFileName = "disk.img"
 	const existingFileContent = "original content"
@@ -380,7 +535,7 @@ func TestSketch_DoesNotOverwriteExistingFile(t *testing.T) {
 	manifest := prepareManifest(descriptors[0])
 
 	// Run Sketch and check that the existing file is not overwritten
-	_, _, err = sc.Sketch(destDir, manifest, []v1.Hash{v1.Hash{Algorithm: "sha256", Hex: "fake"}})
+	_, _, _, err = sc.Sketch(destDir, manifest, []v1.Hash{v1.Hash{Algorithm: "sha256", Hex: "fake"}})
 	assert.NoError(t, err)
 
 	// Verify that the existing file content remains unchanged
@@ -388,3 +543,26 @@ func TestSketch_DoesNotOverwriteExistingFile(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, existingFileContent, string(content), "The existing file should not be overwritten")
 }
+
+func TestSketch_UsesInjectedCloneFunction(t *testing.T) {
+	rootDir := t.TempDir()
+	destDir := filepath.Join(rootDir, "dest")
+
+	clonedPairs := make([]string, 0)
+	sc := NewSketcher(rootDir, testManifestName,
+		WithFileSystem(sysenv.OS),
+		WithCloneFunction(func(src, dst string) error {
+			clonedPairs = append(clonedPairs, filepath.Base(dst))
+			return duplicator.CopyFile(sysenv.OS, src, dst)
+		}))
+	descriptors := prepare5CloneCandidatesWith10Layers(t, rootDir)
+	manifest := makeManifestFromSegments(descriptors[0])
+
+	_, _, _, err := sc.Sketch(destDir, manifest, []v1.Hash{{Algorithm: "sha256", Hex: "fake"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"disk.img"}, clonedPairs)
+
+	content, err := os.ReadFile(filepath.Join(destDir, "disk.img"))
+	require.NoError(t, err)
+	assert.Equal(t, "0", string(content))
+}
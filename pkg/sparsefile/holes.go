@@ -0,0 +1,36 @@
+package sparsefile
+
+import "io"
+
+// Extent is a range of file content holding data, as opposed to a hole.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// DataExtents returns ranges of f between start (inclusive) and end (exclusive) which hold data, skipping holes
+// (with SEEK_DATA and SEEK_HOLE, or FSCTL_QUERY_ALLOCATED_RANGES on Windows), so mostly empty files are not read
+// to find out they are zero. Files on filesystems without hole support, and files of virtual filesystems,
+// report the whole range as data. Offset of f is restored before returning.
+func DataExtents(f io.Seeker, start, end int64) ([]Extent, error) {
+	if start >= end {
+		return nil, nil
+	}
+	res, ok, err := dataExtents(f, start, end)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return []Extent{{Offset: start, Length: end - start}}, nil
+	}
+	return res, nil
+}
+
+// IsHole reports whether range of f between start (inclusive) and end (exclusive) is a hole, and reads as zeros.
+func IsHole(f io.Seeker, start, end int64) (bool, error) {
+	extents, err := DataExtents(f, start, end)
+	if err != nil {
+		return false, err
+	}
+	return len(extents) == 0 && start < end, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !windows
+
+package sparsefile
+
+import "io"
+
+func dataExtents(f io.Seeker, start, end int64) ([]Extent, bool, error) {
+	return nil, false, nil
+}
+
+// SetSparse marks f as sparse, which is not supported here.
+func SetSparse(f any) error {
+	return nil
+}
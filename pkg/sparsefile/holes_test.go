@@ -0,0 +1,82 @@
+package sparsefile
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestDataExtents(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "sparse.img"))
+	require.NoError(t, err)
+	defer f.Close()
+	const size = 4 << 20
+	data := bytes.Repeat([]byte{1}, 64*1024)
+	require.NoError(t, f.Truncate(size))
+	_, err = f.WriteAt(data, 2<<20)
+	require.NoError(t, err)
+	_, err = f.Seek(123, io.SeekStart)
+	require.NoError(t, err)
+
+	extents, err := DataExtents(f, 0, size)
+	require.NoError(t, err)
+	offset, err := f.Seek(0, io.SeekCurrent)
+	require.NoError(t, err)
+	assert.Equal(t, int64(123), offset)
+
+	// written data is always reported, the rest may be reported as well by filesystems without holes
+	covered := false
+	for _, e := range extents {
+		covered = covered || (e.Offset <= 2<<20 && e.Offset+e.Length >= 2<<20+int64(len(data)))
+	}
+	assert.True(t, covered, "extents %v do not cover data", extents)
+	content := make([]byte, size)
+	_, err = f.ReadAt(content, 0)
+	require.NoError(t, err)
+	for _, e := range extents {
+		clear(content[e.Offset : e.Offset+e.Length])
+	}
+	assert.Equal(t, make([]byte, size), content, "data outside of extents")
+
+	hole, err := IsHole(f, 2<<20, 2<<20+1)
+	require.NoError(t, err)
+	assert.False(t, hole)
+	hole, err = IsHole(f, 0, 0)
+	require.NoError(t, err)
+	assert.False(t, hole)
+}
+
+type noHoles struct {
+	io.Seeker
+}
+
+func (noHoles) Seek(offset int64, whence int) (int64, error) {
+	if whence > io.SeekEnd {
+		return 0, os.ErrInvalid
+	}
+	return offset, nil
+}
+
+func TestDataExtents_fallback(t *testing.T) {
+	extents, err := DataExtents(noHoles{}, 10, 100)
+	require.NoError(t, err)
+	assert.Equal(t, []Extent{{Offset: 10, Length: 90}}, extents)
+}
+
+func TestSetSparse(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "sparse.img"))
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, SetSparse(f))
+	require.NoError(t, f.Truncate(1<<20))
+	if runtime.GOOS == "linux" || runtime.GOOS == "windows" {
+		hole, err := IsHole(f, 0, 1<<20)
+		require.NoError(t, err)
+		assert.True(t, hole, "truncated file is allocated")
+	}
+}
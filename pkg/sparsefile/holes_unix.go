@@ -0,0 +1,48 @@
+//go:build linux || darwin
+
+package sparsefile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/sys/unix"
+)
+
+// dataExtents iterates data of f with SEEK_DATA and SEEK_HOLE. It reports false when they are not supported.
+func dataExtents(f io.Seeker, start, end int64) ([]Extent, bool, error) {
+	current, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to seek current: %w", err)
+	}
+	defer f.Seek(current, io.SeekStart)
+
+	res := make([]Extent, 0)
+	for offset := start; offset < end; {
+		data, err := f.Seek(offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// no data after offset, the rest is a hole
+			break
+		}
+		if err != nil {
+			return nil, false, nil
+		}
+		if data >= end {
+			break
+		}
+		hole, err := f.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, false, nil
+		}
+		hole = min(hole, end)
+		res = append(res, Extent{Offset: data, Length: hole - data})
+		offset = hole
+	}
+	return res, true, nil
+}
+
+// SetSparse marks f as sparse. Files are sparse by default here, so it does nothing.
+func SetSparse(f any) error {
+	return nil
+}
@@ -0,0 +1,36 @@
+package sparsefile
+
+type options struct {
+	punchHoles bool
+	blockSize  int
+}
+
+// Option configures Overwrite.
+type Option func(o *options)
+
+func makeOptions(opt ...Option) *options {
+	res := &options{blockSize: DefaultBlockSize}
+	for _, o := range opt {
+		o(res)
+	}
+	return res
+}
+
+// WithHolePunching makes Overwrite deallocate blocks of dst where zeros replace existing data, instead of
+// writing the zeros, so space zeroed in the image is reclaimed on disk. It needs dst backed by a file
+// descriptor, like *os.File, and a filesystem supporting it; zeros are written otherwise.
+func WithHolePunching() Option {
+	return func(o *options) {
+		o.punchHoles = true
+	}
+}
+
+// WithBlockSize sets size of blocks Overwrite reads and compares at once. Larger blocks take fewer system calls
+// on huge sparse images, smaller ones skip unchanged data at finer granularity. Sizes below 1 are ignored.
+func WithBlockSize(size int) Option {
+	return func(o *options) {
+		if size > 0 {
+			o.blockSize = size
+		}
+	}
+}
@@ -6,22 +6,32 @@ import (
 	"io"
 )
 
-const maxBufSize = 64 * 1024
+// DefaultBlockSize is the size of blocks Overwrite compares, unless set with WithBlockSize.
+const DefaultBlockSize = 64 * 1024
 
-func Overwrite(dst io.ReadWriteSeeker, src io.Reader) (written int64, skipped int64, err error) {
-	srcBuf := make([]byte, maxBufSize)
-	dstBuf := make([]byte, maxBufSize)
-	return overwriteBuffer(dst, src, srcBuf, dstBuf)
+// Overwrite writes src to dst from its current offset, skipping blocks dst holds already, which keeps
+// unchanged blocks shared with clones and holes unallocated. It returns numbers of bytes written and skipped.
+func Overwrite(dst io.ReadWriteSeeker, src io.Reader, opt ...Option) (written int64, skipped int64, err error) {
+	opts := makeOptions(opt...)
+	srcBuf := make([]byte, opts.blockSize)
+	dstBuf := make([]byte, opts.blockSize)
+	return overwriteBuffer(dst, src, srcBuf, dstBuf, opts)
 }
 
-func overwriteBuffer(dst io.ReadWriteSeeker, src io.Reader, srcBuf, dstBuf []byte) (written int64, skipped int64, err error) {
+func overwriteBuffer(dst io.ReadWriteSeeker, src io.Reader, srcBuf, dstBuf []byte, opts *options) (written int64, skipped int64, err error) {
 	var shiftedSrc []byte
 	dstPos, err := dst.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return 0, 0, fmt.Errorf("unable to seek current: %w", err)
 	}
+	fd, punch := dst.(hasFd)
+	punch = punch && opts.punchHoles
 	for {
-		nrSrc, er1 := src.Read(srcBuf)
+		// full blocks, as decompressing readers return much less at once
+		nrSrc, er1 := io.ReadFull(src, srcBuf)
+		if er1 == io.ErrUnexpectedEOF {
+			er1 = io.EOF
+		}
 		if nrSrc == 0 && er1 == io.EOF {
 			break
 		}
@@ -31,6 +41,17 @@ func overwriteBuffer(dst io.ReadWriteSeeker, src io.Reader, srcBuf, dstBuf []byt
 			dstPos += int64(nrMin)
 			skipped += int64(nrMin)
 			shiftedSrc = srcBuf[nrMin:nrSrc]
+		} else if punch && nrDst == nrSrc && IsZero(srcBuf[:nrSrc]) {
+			// zeros replace existing data, deallocate its blocks instead of writing zeros
+			if perr := punchHole(fd.Fd(), dstPos, int64(nrSrc)); perr == nil {
+				dstPos += int64(nrSrc)
+				written += int64(nrSrc)
+				shiftedSrc = nil
+			} else {
+				// not supported by the filesystem, or range not aligned as it requires
+				punch = false
+				shiftedSrc = srcBuf[0:nrSrc]
+			}
 		} else {
 			shiftedSrc = srcBuf[0:nrSrc]
 		}
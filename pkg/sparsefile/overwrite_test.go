@@ -1,11 +1,14 @@
 package sparsefile
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/require"
 	"io"
 	"os"
 	"path"
+	"runtime"
 	"testing"
+	"testing/iotest"
 )
 
 func TestOverwrite(t *testing.T) {
@@ -148,7 +151,7 @@ func TestOverwrite(t *testing.T) {
 			defer closerDst()
 			defer closerSrc()
 
-			written, skipped, err := overwriteBuffer(dst, src, make([]byte, tt.srcBufSize), make([]byte, tt.dstBufSize))
+			written, skipped, err := overwriteBuffer(dst, src, make([]byte, tt.srcBufSize), make([]byte, tt.dstBufSize), makeOptions())
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Overwrite() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -171,3 +174,61 @@ func TestOverwrite(t *testing.T) {
 		})
 	}
 }
+
+func TestOverwrite_HolePunching(t *testing.T) {
+	const size = 256 * 1024
+	dst, err := os.Create(path.Join(t.TempDir(), "dst.img"))
+	require.NoError(t, err)
+	defer dst.Close()
+	_, err = dst.Write(bytes.Repeat([]byte{1}, size))
+	require.NoError(t, err)
+	_, err = dst.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	written, skipped, err := Overwrite(dst, bytes.NewReader(make([]byte, size)), WithHolePunching())
+	require.NoError(t, err)
+	require.Equal(t, int64(size), written)
+	require.Equal(t, int64(0), skipped)
+
+	content, err := os.ReadFile(dst.Name())
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, size), content)
+	if runtime.GOOS == "linux" {
+		hole, err := IsHole(dst, 0, size)
+		require.NoError(t, err)
+		require.True(t, hole, "zeroed blocks were not deallocated")
+	}
+}
+
+func TestOverwrite_BlockSize(t *testing.T) {
+	dst, err := os.Create(path.Join(t.TempDir(), "dst.img"))
+	require.NoError(t, err)
+	defer dst.Close()
+	initial := bytes.Repeat([]byte("0123456789"), 1000)
+	_, err = dst.Write(initial)
+	require.NoError(t, err)
+	_, err = dst.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	src := bytes.Clone(initial)
+	src[5000] = 'x'
+	// reader returning a byte at a time still compares whole blocks
+	written, skipped, err := Overwrite(dst, iotest.OneByteReader(bytes.NewReader(src)), WithBlockSize(1000))
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), written)
+	require.Equal(t, int64(9000), skipped)
+	content, err := os.ReadFile(dst.Name())
+	require.NoError(t, err)
+	require.Equal(t, src, content)
+}
+
+func TestIsZero(t *testing.T) {
+	require.True(t, IsZero(nil))
+	require.True(t, IsZero(make([]byte, 7)))
+	require.True(t, IsZero(make([]byte, 200*1024)))
+	for _, i := range []int{0, 7, 8, 65535, 65536, 200*1024 - 1} {
+		b := make([]byte, 200*1024)
+		b[i] = 1
+		require.False(t, IsZero(b), "non-zero byte at %d", i)
+	}
+}
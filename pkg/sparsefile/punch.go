@@ -0,0 +1,5 @@
+package sparsefile
+
+type hasFd interface {
+	Fd() uintptr
+}
@@ -0,0 +1,28 @@
+//go:build darwin
+
+package sparsefile
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fpunchhole is fpunchhole_t of fcntl F_PUNCHHOLE.
+type fpunchhole struct {
+	flags    uint32
+	reserved uint32
+	offset   int64
+	length   int64
+}
+
+// punchHole deallocates blocks of length bytes at offset, keeping size of the file.
+// APFS requires both to be multiples of the block size.
+func punchHole(fd uintptr, offset, length int64) error {
+	arg := fpunchhole{offset: offset, length: length}
+	_, _, errno := unix.Syscall(unix.SYS_FCNTL, fd, unix.F_PUNCHHOLE, uintptr(unsafe.Pointer(&arg)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build linux
+
+package sparsefile
+
+import "golang.org/x/sys/unix"
+
+// punchHole deallocates blocks of length bytes at offset, keeping size of the file.
+func punchHole(fd uintptr, offset, length int64) error {
+	return unix.Fallocate(int(fd), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+
+package sparsefile
+
+import "errors"
+
+func punchHole(fd uintptr, offset, length int64) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,86 @@
+//go:build windows
+
+package sparsefile
+
+import (
+	"io"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// fileZeroDataInformation is FILE_ZERO_DATA_INFORMATION of FSCTL_SET_ZERO_DATA.
+type fileZeroDataInformation struct {
+	FileOffset      int64
+	BeyondFinalZero int64
+}
+
+// fileAllocatedRangeBuffer is FILE_ALLOCATED_RANGE_BUFFER of FSCTL_QUERY_ALLOCATED_RANGES.
+type fileAllocatedRangeBuffer struct {
+	FileOffset int64
+	Length     int64
+}
+
+func deviceIoControl(fd uintptr, code uint32, in unsafe.Pointer, inSize uint32, out unsafe.Pointer, outSize uint32) (uint32, error) {
+	var returned uint32
+	err := windows.DeviceIoControl(windows.Handle(fd), code, (*byte)(in), inSize, (*byte)(out), outSize, &returned, nil)
+	return returned, err
+}
+
+// SetSparse marks f as sparse with FSCTL_SET_SPARSE, so NTFS allocates only ranges written with data.
+// f not backed by a file handle is left as is.
+func SetSparse(f any) error {
+	h, ok := f.(hasFd)
+	if !ok {
+		return nil
+	}
+	_, err := deviceIoControl(h.Fd(), windows.FSCTL_SET_SPARSE, nil, 0, nil, 0)
+	if err != nil {
+		return os.NewSyscallError("FSCTL_SET_SPARSE", err)
+	}
+	return nil
+}
+
+// punchHole deallocates blocks of length bytes at offset of sparse file with FSCTL_SET_ZERO_DATA.
+// Files which are not sparse get zeros written instead, which is still correct.
+func punchHole(fd uintptr, offset, length int64) error {
+	info := fileZeroDataInformation{FileOffset: offset, BeyondFinalZero: offset + length}
+	_, err := deviceIoControl(fd, windows.FSCTL_SET_ZERO_DATA, unsafe.Pointer(&info), uint32(unsafe.Sizeof(info)), nil, 0)
+	return err
+}
+
+// dataExtents lists allocated ranges of f with FSCTL_QUERY_ALLOCATED_RANGES. Files which are not sparse
+// report everything as allocated.
+func dataExtents(f io.Seeker, start, end int64) ([]Extent, bool, error) {
+	h, ok := f.(hasFd)
+	if !ok {
+		return nil, false, nil
+	}
+	res := make([]Extent, 0)
+	query := fileAllocatedRangeBuffer{FileOffset: start, Length: end - start}
+	ranges := make([]fileAllocatedRangeBuffer, 64)
+	for query.Length > 0 {
+		returned, err := deviceIoControl(h.Fd(), windows.FSCTL_QUERY_ALLOCATED_RANGES,
+			unsafe.Pointer(&query), uint32(unsafe.Sizeof(query)),
+			unsafe.Pointer(&ranges[0]), uint32(len(ranges))*uint32(unsafe.Sizeof(ranges[0])))
+		more := err == windows.ERROR_MORE_DATA
+		if err != nil && !more {
+			return nil, false, nil
+		}
+		count := int(returned / uint32(unsafe.Sizeof(ranges[0])))
+		for _, r := range ranges[:count] {
+			from, to := max(r.FileOffset, start), min(r.FileOffset+r.Length, end)
+			if from < to {
+				res = append(res, Extent{Offset: from, Length: to - from})
+			}
+		}
+		if !more || count == 0 {
+			break
+		}
+		last := ranges[count-1]
+		query.FileOffset = last.FileOffset + last.Length
+		query.Length = end - query.FileOffset
+	}
+	return res, true, nil
+}
@@ -0,0 +1,25 @@
+package sparsefile
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// zeroBlock is compared against in bulk, bytes.Equal being vectorized on common architectures.
+var zeroBlock = make([]byte, 64*1024)
+
+// IsZero reports whether all bytes of b are zero. Data typically differs from zero early on, so the first word
+// is checked on its own before comparing the rest in large blocks.
+func IsZero(b []byte) bool {
+	if len(b) >= 8 && binary.LittleEndian.Uint64(b) != 0 {
+		return false
+	}
+	for len(b) > 0 {
+		n := min(len(b), len(zeroBlock))
+		if !bytes.Equal(b[:n], zeroBlock[:n]) {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
@@ -0,0 +1,26 @@
+package sysenv
+
+// fdFile is implemented by files backed by a file descriptor, like *os.File.
+type fdFile interface {
+	Fd() uintptr
+}
+
+// NoCache asks the kernel to not keep data of f in the page cache, where it is supported
+// without alignment requirements (F_NOCACHE on macOS). Files without a descriptor are left as they are.
+func NoCache(f File) error {
+	fd, ok := f.(fdFile)
+	if !ok {
+		return nil
+	}
+	return noCache(fd.Fd())
+}
+
+// DropCache writes data of given range of f to disk and evicts it from the page cache, on systems where
+// NoCache is not available (POSIX_FADV_DONTNEED on Linux).
+func DropCache(f File, offset, length int64) error {
+	fd, ok := f.(fdFile)
+	if !ok {
+		return nil
+	}
+	return dropCache(fd.Fd(), offset, length)
+}
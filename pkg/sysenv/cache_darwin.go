@@ -0,0 +1,14 @@
+//go:build darwin
+
+package sysenv
+
+import "golang.org/x/sys/unix"
+
+func noCache(fd uintptr) error {
+	_, err := unix.FcntlInt(fd, unix.F_NOCACHE, 1)
+	return err
+}
+
+func dropCache(fd uintptr, offset, length int64) error {
+	return nil
+}
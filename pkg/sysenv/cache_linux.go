@@ -0,0 +1,18 @@
+//go:build linux
+
+package sysenv
+
+import "golang.org/x/sys/unix"
+
+func noCache(fd uintptr) error {
+	// O_DIRECT would need aligned buffers and offsets, dropCache is used instead
+	return nil
+}
+
+func dropCache(fd uintptr, offset, length int64) error {
+	// dirty pages are not dropped, so they have to reach the disk first
+	if err := unix.Fdatasync(int(fd)); err != nil {
+		return err
+	}
+	return unix.Fadvise(int(fd), offset, length, unix.FADV_DONTNEED)
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package sysenv
+
+func noCache(fd uintptr) error {
+	return nil
+}
+
+func dropCache(fd uintptr, offset, length int64) error {
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build darwin
+
+package sysenv
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+	"unsafe"
+)
+
+// renameSwap is RENAME_SWAP flag of renameatx_np.
+const renameSwap = 0x2
+
+var _ ExchangeFS = osFS{}
+
+func (osFS) Exchange(oldpath, newpath string) error {
+	from, err := unix.BytePtrFromString(oldpath)
+	if err != nil {
+		return err
+	}
+	to, err := unix.BytePtrFromString(newpath)
+	if err != nil {
+		return err
+	}
+	// AT_FDCWD is negative, so it is converted at run time
+	fdcwd := unix.AT_FDCWD
+	_, _, errno := unix.Syscall6(unix.SYS_RENAMEATX_NP,
+		uintptr(fdcwd), uintptr(unsafe.Pointer(from)),
+		uintptr(fdcwd), uintptr(unsafe.Pointer(to)), renameSwap, 0)
+	if errno != 0 {
+		return &os.LinkError{Op: "renameatx_np", Old: oldpath, New: newpath, Err: errno}
+	}
+	return nil
+}
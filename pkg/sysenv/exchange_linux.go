@@ -0,0 +1,18 @@
+//go:build linux
+
+package sysenv
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+var _ ExchangeFS = osFS{}
+
+func (osFS) Exchange(oldpath, newpath string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, oldpath, unix.AT_FDCWD, newpath, unix.RENAME_EXCHANGE)
+	if err != nil {
+		return &os.LinkError{Op: "renameat2", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package sysenv
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File is the subset of *os.File used by geranos when reading and writing images.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FS abstracts filesystem operations, so they can be redirected to a virtual filesystem
+// (for tests or when embedding geranos in a sandbox).
+type FS interface {
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	Rename(oldpath, newpath string) error
+	Truncate(name string, size int64) error
+	Chmod(name string, mode os.FileMode) error
+	Chown(name string, uid, gid int) error
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+	Readlink(name string) (string, error)
+	Symlink(oldname, newname string) error
+}
+
+// XattrFS is implemented by filesystems supporting extended attributes.
+type XattrFS interface {
+	ListXattrs(name string) (map[string][]byte, error)
+	SetXattr(name string, attr string, value []byte) error
+}
+
+// SpaceFS is implemented by filesystems able to tell how much space is left.
+type SpaceFS interface {
+	// FreeSpace returns number of bytes available to the current user on filesystem holding path.
+	FreeSpace(path string) (int64, error)
+}
+
+// PreallocateFS is implemented by filesystems able to reserve blocks for a file ahead of writing it.
+type PreallocateFS interface {
+	// Preallocate allocates blocks for first size bytes of file name, so later writes in any order do not fragment it.
+	Preallocate(name string, size int64) error
+}
+
+// LinkFS is implemented by filesystems supporting hard links.
+type LinkFS interface {
+	// Link creates newname as a hard link to oldname, sharing its content and metadata.
+	Link(oldname, newname string) error
+}
+
+// ExchangeFS is implemented by filesystems able to swap two paths atomically.
+type ExchangeFS interface {
+	// Exchange swaps oldpath and newpath, both of which must exist, in a single step, so there is
+	// no moment when either of them is missing.
+	Exchange(oldpath, newpath string) error
+}
+
+// OS is the FS backed by the real filesystem of the host.
+var OS FS = osFS{}
+
+type osFS struct{}
+
+var _ File = (*os.File)(nil)
+
+func (osFS) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (osFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Truncate(name string, size int64) error {
+	return os.Truncate(name, size)
+}
+
+func (osFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (osFS) Chown(name string, uid, gid int) error {
+	return os.Chown(name, uid, gid)
+}
+
+func (osFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (osFS) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (osFS) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+var _ LinkFS = osFS{}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+// CreateTemp works like os.CreateTemp, but creates the file through provided FS. The last "*" in pattern
+// is replaced with random string, so concurrent writers in the same directory never share the file.
+func CreateTemp(fsys FS, dir, pattern string) (File, error) {
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+	for try := 0; ; try++ {
+		name := filepath.Join(dir, prefix+strconv.FormatInt(SystemRand.Int63(), 36)+suffix)
+		f, err := fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, fs.ErrExist) && try < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// WalkDir works like filepath.WalkDir, but reads directories through provided FS.
+func WalkDir(fsys FS, root string, fn fs.WalkDirFunc) error {
+	info, err := fsys.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDir(fsys, root, fs.FileInfoToDirEntry(info), fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func walkDir(fsys FS, path string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(path, d, nil); err != nil || !d.IsDir() {
+		if err == filepath.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		err = fn(path, d, err)
+		if err != nil {
+			if err == filepath.SkipDir && d.IsDir() {
+				err = nil
+			}
+			return err
+		}
+	}
+	for _, entry := range entries {
+		if err := walkDir(fsys, filepath.Join(path, entry.Name()), entry, fn); err != nil {
+			if err == filepath.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build darwin
+
+package sysenv
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+var _ PreallocateFS = osFS{}
+
+func (osFS) Preallocate(name string, size int64) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+		return err
+	}
+	// F_PREALLOCATE allocates given length after blocks the file already has
+	length := size - st.Blocks*512
+	if length <= 0 {
+		return nil
+	}
+	fstore := unix.Fstore_t{Flags: unix.F_ALLOCATECONTIG | unix.F_ALLOCATEALL, Posmode: unix.F_PEOFPOSMODE, Length: length}
+	if err := unix.FcntlFstore(f.Fd(), unix.F_PREALLOCATE, &fstore); err == nil {
+		return nil
+	}
+	// contiguous space may not be available, any will do
+	fstore.Flags = unix.F_ALLOCATEALL
+	return unix.FcntlFstore(f.Fd(), unix.F_PREALLOCATE, &fstore)
+}
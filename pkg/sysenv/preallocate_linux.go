@@ -0,0 +1,22 @@
+//go:build linux
+
+package sysenv
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+var _ PreallocateFS = osFS{}
+
+func (osFS) Preallocate(name string, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return unix.Fallocate(int(f.Fd()), 0, 0, size)
+}
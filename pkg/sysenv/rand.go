@@ -0,0 +1,19 @@
+package sysenv
+
+import (
+	"math/rand"
+)
+
+// Rand is a source of randomness used e.g. for naming temporary directories and jittering retries.
+type Rand interface {
+	Int63() int64
+}
+
+// SystemRand is the Rand backed by the global, concurrency safe, math/rand source.
+var SystemRand Rand = systemRand{}
+
+type systemRand struct{}
+
+func (systemRand) Int63() int64 {
+	return rand.Int63()
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin
+
+package sysenv
+
+import "golang.org/x/sys/unix"
+
+var _ SpaceFS = osFS{}
+
+func (osFS) FreeSpace(path string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
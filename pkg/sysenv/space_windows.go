@@ -0,0 +1,19 @@
+//go:build windows
+
+package sysenv
+
+import "golang.org/x/sys/windows"
+
+var _ SpaceFS = osFS{}
+
+func (osFS) FreeSpace(path string) (int64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &available, &total, &free); err != nil {
+		return 0, err
+	}
+	return int64(available), nil
+}
@@ -0,0 +1,52 @@
+//go:build linux || darwin
+
+package sysenv
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/sys/unix"
+)
+
+var _ XattrFS = osFS{}
+
+func (osFS) ListXattrs(name string) (map[string][]byte, error) {
+	size, err := unix.Listxattr(name, nil)
+	if err != nil || size == 0 {
+		return map[string][]byte{}, ignoreUnsupported(err)
+	}
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(name, buf)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string][]byte)
+	for _, attr := range bytes.Split(buf[:size], []byte{0}) {
+		if len(attr) == 0 {
+			continue
+		}
+		valueSize, err := unix.Getxattr(name, string(attr), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, valueSize)
+		valueSize, err = unix.Getxattr(name, string(attr), value)
+		if err != nil {
+			return nil, err
+		}
+		res[string(attr)] = value[:valueSize]
+	}
+	return res, nil
+}
+
+func (osFS) SetXattr(name string, attr string, value []byte) error {
+	return unix.Setxattr(name, attr, value, 0)
+}
+
+// ignoreUnsupported treats filesystems without xattr support as having no attributes.
+func ignoreUnsupported(err error) error {
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) {
+		return nil
+	}
+	return err
+}
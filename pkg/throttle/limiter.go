@@ -0,0 +1,83 @@
+package throttle
+
+import (
+	"context"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket limiting the rate of bytes going through all readers it wraps together.
+// The bucket holds up to one second worth of bytes, so short bursts are allowed after idle time.
+type Limiter struct {
+	mu             sync.Mutex
+	clock          sysenv.Clock
+	bytesPerSecond int64
+	tokens         float64
+	last           time.Time
+}
+
+func NewLimiter(bytesPerSecond int64, clock sysenv.Clock) *Limiter {
+	return &Limiter{
+		clock:          clock,
+		bytesPerSecond: bytesPerSecond,
+		tokens:         float64(bytesPerSecond),
+		last:           clock.Now(),
+	}
+}
+
+// reserve takes n tokens from the bucket, going into debt if needed, and returns how long to wait for the debt to be paid.
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(l.bytesPerSecond), float64(l.bytesPerSecond))
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.bytesPerSecond) * float64(time.Second))
+}
+
+// WaitN blocks until n bytes are allowed to pass, or ctx is done.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	return sysenv.Sleep(ctx, l.clock, l.reserve(n))
+}
+
+// chunkSize limits single read, so a large buffer does not turn into one long pause.
+func (l *Limiter) chunkSize() int {
+	return int(max(l.bytesPerSecond/10, 1))
+}
+
+// Reader returns rc with reads limited by l. Nil limiter returns rc unchanged.
+func (l *Limiter) Reader(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	if l == nil {
+		return rc
+	}
+	return &reader{ctx: ctx, rc: rc, limiter: l}
+}
+
+type reader struct {
+	ctx     context.Context
+	rc      io.ReadCloser
+	limiter *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > r.limiter.chunkSize() {
+		p = p[:r.limiter.chunkSize()]
+	}
+	n, err := r.rc.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (r *reader) Close() error {
+	return r.rc.Close()
+}
@@ -0,0 +1,61 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// manualClock advances time only when somebody waits on it.
+type manualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func TestLimiter_Reader(t *testing.T) {
+	clock := &manualClock{now: time.Unix(0, 0)}
+	limiter := NewLimiter(1000, clock)
+	data := bytes.Repeat([]byte{7}, 5000)
+
+	r := limiter.Reader(context.Background(), io.NopCloser(bytes.NewReader(data)))
+	read, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, read)
+	// first second worth of bytes passes immediately, the rest at 1000 bytes per second
+	assert.InDelta(t, 4*time.Second, clock.Now().Sub(time.Unix(0, 0)), float64(10*time.Millisecond))
+}
+
+func TestLimiter_ContextCancelled(t *testing.T) {
+	limiter := NewLimiter(10, &manualClock{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := limiter.Reader(ctx, io.NopCloser(bytes.NewReader(make([]byte, 100))))
+	_, err := io.ReadAll(r)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestLimiter_NilLeavesReaderUnchanged(t *testing.T) {
+	var limiter *Limiter
+	rc := io.NopCloser(bytes.NewReader(nil))
+	assert.Equal(t, rc, limiter.Reader(context.Background(), rc))
+}
@@ -3,15 +3,37 @@ package transporter
 import (
 	"fmt"
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/macvmio/geranos/pkg/duplicator"
 	"github.com/macvmio/geranos/pkg/layout"
 )
 
+// Adopt makes directory src the local image of dst, cloning it into the images directory, or moving it there
+// with WithAdoptByRename. Files are then hashed in place and the manifest and config written, unless
+// disabled with WithHashing, so the image can be pushed and becomes a clone candidate of other images.
 func Adopt(src string, dst string, opt ...Option) error {
 	opts := makeOptions(opt...)
 	dstRef, err := name.ParseReference(dst, name.StrictValidation)
 	if err != nil {
 		return fmt.Errorf("unable to parse reference: %w", err)
 	}
-	lm := layout.NewMapper(opts.imagesPath)
-	return lm.Adopt(src, dstRef, false)
+	lm := layout.NewMapper(opts.imagesPath, opts.dirimageOptions...)
+	if opts.adoptByRename {
+		err = lm.AdoptByRename(src, dstRef)
+	} else {
+		err = lm.Adopt(opts.ctx, src, dstRef, false,
+			duplicator.WithConcurrency(opts.workersCount),
+			duplicator.WithXattrs(opts.xattrs),
+			duplicator.WithVerification(opts.verifyClones),
+		)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.skipHashing {
+		return nil
+	}
+	if err := lm.Rehash(opts.ctx, dstRef); err != nil {
+		return fmt.Errorf("unable to hash adopted image: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,50 @@
+package transporter
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/objectstore"
+	"net/http"
+)
+
+// openBucket opens bucket of WithBackend, sharing transport of the registry client.
+func openBucket(opts *options) (objectstore.Bucket, error) {
+	client := &http.Client{Transport: opts.transport}
+	b, err := objectstore.Open(opts.backend, objectstore.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open bucket: %w", err)
+	}
+	return b, nil
+}
+
+func pushToBucket(ref name.Reference, img v1.Image, opts *options) error {
+	b, err := openBucket(opts)
+	if err != nil {
+		return err
+	}
+	if err := objectstore.WriteImage(opts.ctx, b, ref, img, opts.workersCount); err != nil {
+		return fmt.Errorf("unable to push image to bucket: %w", err)
+	}
+	return nil
+}
+
+func readFromBucket(ref name.Reference, opts *options) (v1.Image, error) {
+	b, err := openBucket(opts)
+	if err != nil {
+		return nil, err
+	}
+	img, err := objectstore.ReadImage(opts.ctx, b, ref)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read image from bucket: %w", err)
+	}
+	return img, nil
+}
+
+// sourceImage returns image of ref pulled from bucket of WithBackend, or from the registry.
+func sourceImage(ref name.Reference, opts *options) (v1.Image, error) {
+	if opts.backend != "" {
+		return readFromBucket(ref, opts)
+	}
+	return remoteImage(ref, opts)
+}
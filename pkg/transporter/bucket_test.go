@@ -0,0 +1,93 @@
+package transporter
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/provenance"
+	"github.com/macvmio/geranos/pkg/signing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPushPull_Backend(t *testing.T) {
+	tempDir, opts := optionsForTesting(t)
+	defer os.RemoveAll(tempDir)
+	ref := "oci.jarosik.online/testrepo/a:v1"
+	sha := makeTestVMAt(t, tempDir, ref)
+	bucketOpts := append(opts, WithBackend("file://"+filepath.ToSlash(filepath.Join(tempDir, "bucket"))))
+
+	require.NoError(t, Push(ref, bucketOpts...))
+	assert.FileExists(t, filepath.Join(tempDir, "bucket", "testrepo", "a", "tags", "v1"))
+
+	pullOpts := append(bucketOpts, WithImagesPath(filepath.Join(tempDir, "other")))
+	require.NoError(t, Pull(ref, pullOpts...))
+	assert.Equal(t, sha, hashFromFile(t, filepath.Join(tempDir, "other", portableRef(ref), "disk.img")))
+}
+
+func TestPush_BackendSign(t *testing.T) {
+	tempDir, opts := optionsForTesting(t)
+	defer os.RemoveAll(tempDir)
+	ref := "oci.jarosik.online/testrepo/a:v1"
+	makeTestVMAt(t, tempDir, ref)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	bucket := filepath.Join(tempDir, "bucket")
+	opts = append(opts, WithBackend("file://"+filepath.ToSlash(bucket)), WithSigning(signing.Config{Key: key}))
+
+	assert.ErrorContains(t, Push(ref, opts...), "signing is not supported with backend")
+	assert.NoDirExists(t, bucket)
+}
+
+func TestPush_BackendProvenance(t *testing.T) {
+	tempDir, opts := optionsForTesting(t)
+	defer os.RemoveAll(tempDir)
+	ref := "oci.jarosik.online/testrepo/a:v1"
+	makeTestVMAt(t, tempDir, ref)
+	bucket := filepath.Join(tempDir, "bucket")
+	opts = append(opts, WithBackend("file://"+filepath.ToSlash(bucket)), WithProvenance(provenance.Build{}))
+
+	assert.ErrorContains(t, Push(ref, opts...), "provenance is not supported with backend")
+	assert.NoDirExists(t, bucket)
+}
+
+func TestPlan_Backend(t *testing.T) {
+	tempDir, opts := optionsForTesting(t)
+	defer os.RemoveAll(tempDir)
+	ref := "oci.jarosik.online/testrepo/a:v1"
+	makeTestVMAt(t, tempDir, ref)
+	bucketOpts := append(opts, WithBackend("file://"+filepath.ToSlash(filepath.Join(tempDir, "bucket"))))
+
+	plan, err := PlanPush(ref, bucketOpts...)
+	require.NoError(t, err)
+	blobs, _ := plan.Count(BlobUpload)
+	assert.Equal(t, len(plan.Blobs), blobs)
+
+	require.NoError(t, Push(ref, bucketOpts...))
+	plan, err = PlanPush(ref, bucketOpts...)
+	require.NoError(t, err)
+	// config records when the image was read, so only layers are the same
+	for _, b := range plan.Blobs[1:] {
+		assert.Equal(t, BlobExists, b.Action, b.Filename)
+	}
+
+	pullPlan, err := PlanPull(ref, append(bucketOpts, WithImagesPath(filepath.Join(tempDir, "other")))...)
+	require.NoError(t, err)
+	segments, _ := pullPlan.Count(dirimage.SegmentDownload)
+	assert.Equal(t, len(pullPlan.Segments), segments)
+}
+
+func TestPush_BackendIncremental(t *testing.T) {
+	tempDir, opts := optionsForTesting(t)
+	defer os.RemoveAll(tempDir)
+	ref := "oci.jarosik.online/testrepo/a:v1"
+	makeTestVMAt(t, tempDir, ref)
+	opts = append(opts, WithBackend("file://"+filepath.ToSlash(filepath.Join(tempDir, "bucket"))), WithIncrementalRehash(true))
+
+	require.NoError(t, Push(ref, opts...))
+	assert.FileExists(t, filepath.Join(tempDir, "images", portableRef(ref), dirimage.LocalManifestFilename))
+}
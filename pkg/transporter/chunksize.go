@@ -0,0 +1,52 @@
+package transporter
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// defaultUploadChunkSize is size of the first chunk of tuned uploads, layers not larger than that
+	// are uploaded at once
+	defaultUploadChunkSize = 16 << 20
+	minUploadChunkSize     = 4 << 20
+	maxUploadChunkSize     = 2 << 30
+	// targetChunkDuration is how long uploading a tuned chunk should take
+	targetChunkDuration = 15 * time.Second
+)
+
+// chunkSizer picks size of upload chunks, fixed or tuned to the throughput measured on previous chunks.
+// Tuned chunks grow on fast links, where requests per chunk dominate, and shrink on slow ones,
+// where less is uploaded again after an interruption.
+type chunkSizer struct {
+	mu    sync.Mutex
+	size  int64
+	tuned bool
+}
+
+// newChunkSizer returns sizer of chunks of size bytes, or tuned chunks when size is 0.
+func newChunkSizer(size int64) *chunkSizer {
+	if size > 0 {
+		return &chunkSizer{size: size}
+	}
+	return &chunkSizer{size: defaultUploadChunkSize, tuned: true}
+}
+
+// next returns size of the next chunk.
+func (cs *chunkSizer) next() int64 {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.size
+}
+
+// observe moves the size halfway toward what would be uploaded in targetChunkDuration at throughput of chunk
+// of n bytes uploaded in d, so a single slow chunk does not shrink the next ones too much.
+func (cs *chunkSizer) observe(n int64, d time.Duration) {
+	if !cs.tuned || d <= 0 {
+		return
+	}
+	target := int64(float64(n) / d.Seconds() * targetChunkDuration.Seconds())
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.size = min(max((cs.size+target)/2, minUploadChunkSize), maxUploadChunkSize)
+}
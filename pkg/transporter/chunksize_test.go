@@ -0,0 +1,31 @@
+package transporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkSizer(t *testing.T) {
+	fixed := newChunkSizer(1 << 20)
+	fixed.observe(1<<20, time.Millisecond)
+	assert.Equal(t, int64(1<<20), fixed.next())
+
+	tuned := newChunkSizer(0)
+	assert.Equal(t, int64(defaultUploadChunkSize), tuned.next())
+
+	// 16MiB in 1s is far below the target duration, so chunks grow
+	tuned.observe(defaultUploadChunkSize, time.Second)
+	assert.Equal(t, int64(defaultUploadChunkSize/2+defaultUploadChunkSize*15/2), tuned.next())
+	for range 20 {
+		tuned.observe(tuned.next(), time.Second)
+	}
+	assert.Equal(t, int64(maxUploadChunkSize), tuned.next())
+
+	// a slow link shrinks them down to the minimum
+	for range 20 {
+		tuned.observe(tuned.next(), time.Hour)
+	}
+	assert.Equal(t, int64(minUploadChunkSize), tuned.next())
+}
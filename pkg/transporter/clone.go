@@ -2,6 +2,7 @@ package transporter
 
 import (
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/macvmio/geranos/pkg/duplicator"
 	"github.com/macvmio/geranos/pkg/layout"
 )
 
@@ -16,6 +17,16 @@ func Clone(src string, dst string, opt ...Option) error {
 		return err
 	}
 
-	lm := layout.NewMapper(opts.imagesPath)
-	return lm.Clone(srcRef, dstRef)
+	lm := layout.NewMapper(opts.imagesPath, opts.dirimageOptions...)
+	from := lm
+	if opts.sourceImagesPath != "" {
+		from = layout.NewMapper(opts.sourceImagesPath, opts.dirimageOptions...)
+	}
+	return lm.CloneFrom(opts.ctx, from, srcRef, dstRef,
+		duplicator.WithConcurrency(opts.workersCount),
+		duplicator.WithXattrs(opts.xattrs),
+		duplicator.WithVerification(opts.verifyClones),
+		duplicator.WithHardlinks(opts.hardlinks),
+		duplicator.WithFileFilter(opts.fileFilter.Include, opts.fileFilter.Exclude),
+	)
 }
@@ -0,0 +1,83 @@
+package transporter
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// CopyResult is what Copy did.
+type CopyResult struct {
+	// Digest is the digest of the copied manifest, the same in both registries
+	Digest v1.Hash
+	// BytesUploaded is how many bytes of blobs were uploaded, blobs the destination already had are skipped
+	BytesUploaded int64
+}
+
+// Copy copies image, or index of images, src to dst registry, streaming blobs from one to the other without
+// storing them locally, for promotion between registries. Blobs are verified against their digests while
+// they are read, blobs present at dst are skipped, or mounted when both are in the same registry, and
+// the manifest digest at dst is checked to be the one of src once it is written.
+func Copy(src, dst string, opt ...Option) (*CopyResult, error) {
+	opts := makeOptions(opt...)
+	srcRef, err := name.ParseReference(src, name.StrictValidation)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse reference '%v': %w", src, err)
+	}
+	dstRef, err := name.ParseReference(dst, name.StrictValidation)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse reference '%v': %w", dst, err)
+	}
+	desc, err := remote.Get(srcRef, opts.remoteOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch %v: %w", srcRef, err)
+	}
+
+	var write func(opts ...remote.Option) error
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		write = func(opts ...remote.Option) error {
+			return remote.WriteIndex(dstRef, idx, opts...)
+		}
+	} else {
+		img, err := desc.Image()
+		if err != nil {
+			return nil, err
+		}
+		write = func(opts ...remote.Option) error {
+			return remote.Write(dstRef, img, opts...)
+		}
+	}
+
+	// remote closes updates once writing is done
+	updates := make(chan v1.Update, 16)
+	uploaded := make(chan int64)
+	go func() {
+		last := int64(0)
+		for u := range updates {
+			if u.Error == nil {
+				last = u.Complete
+			}
+		}
+		uploaded <- last
+	}()
+	err = write(append(append([]remote.Option{}, opts.remoteOptions...),
+		remote.WithJobs(max(opts.workersCount, 1)), remote.WithProgress(updates))...)
+	res := &CopyResult{Digest: desc.Digest, BytesUploaded: <-uploaded}
+	if err != nil {
+		return nil, fmt.Errorf("unable to copy %v to %v: %w", srcRef, dstRef, err)
+	}
+
+	written, err := remote.Head(dstRef, opts.remoteOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to check %v: %w", dstRef, err)
+	}
+	if written.Digest != desc.Digest {
+		return nil, fmt.Errorf("digest of %v is %v, expected %v", dstRef, written.Digest, desc.Digest)
+	}
+	return res, nil
+}
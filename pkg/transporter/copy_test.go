@@ -0,0 +1,40 @@
+package transporter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopy(t *testing.T) {
+	srcRequests := make([]http.Request, 0)
+	srcServer := httptest.NewServer(prepareRegistryWithRecorder(&srcRequests))
+	defer srcServer.Close()
+	dstServer := httptest.NewServer(prepareRegistry())
+	defer dstServer.Close()
+	tempDir, opts := optionsForTesting(t)
+	defer os.RemoveAll(tempDir)
+
+	src := refOnServer(srcServer.URL, "vms/a:v1")
+	dst := refOnServer(dstServer.URL, "promoted/a:v1")
+	sha := makeTestVMAt(t, tempDir, src)
+	require.NoError(t, Push(src, opts...))
+	srcRequests = srcRequests[:0]
+
+	res, err := Copy(src, dst, opts...)
+	require.NoError(t, err)
+	assert.Greater(t, res.BytesUploaded, int64(0))
+	assert.Equal(t, 0, calculateAccessed(srcRequests, "PUT", "/manifests"), "source is only read")
+
+	pullOpts := append(opts, WithImagesPath(filepath.Join(tempDir, "other")))
+	require.NoError(t, Pull(dst, pullOpts...))
+	assert.Equal(t, sha, hashFromFile(t, filepath.Join(tempDir, "other", portableRef(dst), "disk.img")))
+
+	res, err = Copy(src, dst, opts...)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), res.BytesUploaded, "blobs already at the destination are skipped")
+}
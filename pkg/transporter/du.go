@@ -0,0 +1,47 @@
+package transporter
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/macvmio/geranos/pkg/layout"
+)
+
+// DiskUsage prints disk usage of local images refs, or of all of them when refs are empty,
+// see layout.Mapper.DiskUsage.
+func DiskUsage(refs []string, opt ...Option) error {
+	opts := makeOptions(opt...)
+	lm := layout.NewMapper(opts.imagesPath)
+	selected := make(map[string]struct{})
+	for _, src := range refs {
+		ref, err := name.ParseReference(src, name.StrictValidation)
+		if err != nil {
+			return fmt.Errorf("unable to parse reference: %w", err)
+		}
+		ref, err = lm.Resolve(ref)
+		if err != nil {
+			return err
+		}
+		selected[ref.String()] = struct{}{}
+	}
+	usage, err := lm.DiskUsage()
+	if err != nil {
+		return fmt.Errorf("unable to get disk usage: %w", err)
+	}
+	fmt.Printf("%-60s %15s %15s %15s %15s\n", "IMAGE", "LOGICAL", "ALLOCATED", "EXCLUSIVE", "SHARED")
+	found := 0
+	for _, u := range usage {
+		if _, ok := selected[u.Ref.String()]; len(selected) > 0 && !ok {
+			continue
+		}
+		found++
+		estimated := ""
+		if u.Estimated {
+			estimated = " (estimated)"
+		}
+		fmt.Printf("%-60s %15d %15d %15d %15d%s\n", u.Ref, u.LogicalSize, u.AllocatedSize, u.ExclusiveSize, u.SharedSize, estimated)
+	}
+	if found < len(selected) {
+		return fmt.Errorf("%d of given images not found", len(selected)-found)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package transporter
+
+import (
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/macvmio/geranos/pkg/duplicator"
+	"github.com/macvmio/geranos/pkg/layout"
+)
+
+// Export clones files of local image src into directory dst without metadata files, see layout.Mapper.Export.
+func Export(src string, dst string, opt ...Option) error {
+	opts := makeOptions(opt...)
+	srcRef, err := name.ParseReference(src, name.StrictValidation)
+	if err != nil {
+		return err
+	}
+	lm := layout.NewMapper(opts.imagesPath, opts.dirimageOptions...)
+	return lm.Export(opts.ctx, srcRef, dst,
+		duplicator.WithConcurrency(opts.workersCount),
+		duplicator.WithXattrs(opts.xattrs),
+		duplicator.WithVerification(opts.verifyClones),
+	)
+}
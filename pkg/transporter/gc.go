@@ -0,0 +1,28 @@
+package transporter
+
+import (
+	"fmt"
+	"github.com/macvmio/geranos/pkg/layout"
+)
+
+// GC removes garbage of the images directory, see layout.Mapper.CollectGarbage, printing what was removed.
+// With WithDryRun it only prints what would be removed.
+func GC(opt ...Option) error {
+	opts := makeOptions(opt...)
+	lm := layout.NewMapper(opts.imagesPath)
+	garbage, err := lm.CollectGarbage(opts.dryRun, opts.gcGracePeriod)
+	if err != nil {
+		return fmt.Errorf("unable to collect garbage: %w", err)
+	}
+	total := int64(0)
+	for _, g := range garbage {
+		fmt.Printf("%-20s %15d %s\n", g.Reason, g.Size, g.Path)
+		total += g.Size
+	}
+	if opts.dryRun {
+		fmt.Printf("reclaimable: %d bytes in %d entries\n", total, len(garbage))
+	} else {
+		fmt.Printf("reclaimed: %d bytes in %d entries\n", total, len(garbage))
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package transporter
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"runtime"
+	"strings"
+)
+
+// addToIndex puts img, already pushed by digest, into index of ref as variant of platform. Variant previously
+// pushed for the same platform is replaced, and the index is created when ref does not exist.
+func addToIndex(ref name.Reference, img v1.Image, platform v1.Platform, opts *options) error {
+	idx := mutate.IndexMediaType(empty.Index, types.OCIImageIndex)
+	desc, err := remote.Get(ref, opts.remoteOptions...)
+	switch {
+	case err == nil && desc.MediaType.IsIndex():
+		if idx, err = desc.ImageIndex(); err != nil {
+			return err
+		}
+	case err == nil:
+		return fmt.Errorf("%v is an image without platform, it can be replaced by pushing without --platform", ref)
+	case !isNotFound(err):
+		return fmt.Errorf("unable to get %v: %w", ref, err)
+	}
+	idx = mutate.RemoveManifests(idx, match.Platforms(platform))
+	idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+		Add:        img,
+		Descriptor: v1.Descriptor{Platform: &platform},
+	})
+	opts.logf("pushing index %v with %v", ref, platform)
+	return remote.WriteIndex(ref, idx, opts.remoteOptions...)
+}
+
+// pullPlatform returns platform of variants picked from indexes, given with WithPlatform or the current one.
+func pullPlatform(opts *options) v1.Platform {
+	if opts.platform != nil {
+		return *opts.platform
+	}
+	return v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+}
+
+// remoteImage returns image of ref, or its variant of pullPlatform when ref is an index.
+func remoteImage(ref name.Reference, opts *options) (v1.Image, error) {
+	desc, err := remote.Get(ref, opts.remoteOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return pickImage(ref, desc, opts)
+}
+
+// pickImage returns image of desc fetched for ref, or its variant of pullPlatform when desc is an index.
+func pickImage(ref name.Reference, desc *remote.Descriptor, opts *options) (v1.Image, error) {
+	if !desc.MediaType.IsIndex() {
+		return desc.Image()
+	}
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	platform := pullPlatform(opts)
+	for _, m := range manifest.Manifests {
+		if m.Platform != nil && m.MediaType.IsImage() && m.Platform.Satisfies(platform) {
+			opts.logf("picked %v of %v", m.Platform, ref)
+			return idx.Image(m.Digest)
+		}
+	}
+	return nil, fmt.Errorf("%v has no image of platform %v, available platforms: %v",
+		ref, platform, strings.Join(platformsOf(manifest), ", "))
+}
+
+// platformsOf returns platforms of images in index manifest.
+func platformsOf(manifest *v1.IndexManifest) []string {
+	res := make([]string, 0, len(manifest.Manifests))
+	for _, m := range manifest.Manifests {
+		if m.Platform != nil {
+			res = append(res, m.Platform.String())
+		}
+	}
+	return res
+}
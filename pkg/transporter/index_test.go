@@ -0,0 +1,87 @@
+package transporter
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPush_platform(t *testing.T) {
+	s := httptest.NewServer(prepareRegistry())
+	defer s.Close()
+
+	tempDir, opts := optionsForTesting(t)
+	ref := refOnServer(s.URL, "test-vm:multi")
+	parsed, err := name.ParseReference(ref)
+	require.NoError(t, err)
+	arm64 := &v1.Platform{OS: "darwin", Architecture: "arm64"}
+	amd64 := &v1.Platform{OS: "darwin", Architecture: "amd64"}
+
+	platforms := func() map[string]v1.Hash {
+		idx, err := remote.Index(parsed)
+		require.NoError(t, err)
+		manifest, err := idx.IndexManifest()
+		require.NoError(t, err)
+		res := make(map[string]v1.Hash)
+		for _, m := range manifest.Manifests {
+			require.NotNil(t, m.Platform)
+			res[m.Platform.String()] = m.Digest
+		}
+		assert.Len(t, res, len(manifest.Manifests), "each platform is in the index once")
+		return res
+	}
+
+	makeTestVMWithContent(t, tempDir, ref, "arm64 disk")
+	require.NoError(t, Push(ref, append(opts, WithPlatform(arm64))...))
+	makeTestVMWithContent(t, tempDir, ref, "amd64 disk")
+	require.NoError(t, Push(ref, append(opts, WithPlatform(amd64))...))
+	before := platforms()
+	assert.Len(t, before, 2)
+
+	makeTestVMWithContent(t, tempDir, ref, "new arm64 disk")
+	require.NoError(t, Push(ref, append(opts, WithPlatform(arm64))...))
+	after := platforms()
+	assert.Len(t, after, 2)
+	assert.Equal(t, before["darwin/amd64"], after["darwin/amd64"])
+	assert.NotEqual(t, before["darwin/arm64"], after["darwin/arm64"])
+
+	single := refOnServer(s.URL, "test-vm:single")
+	makeTestVMAt(t, tempDir, single)
+	require.NoError(t, Push(single, opts...))
+	assert.ErrorContains(t, Push(single, append(opts, WithPlatform(arm64))...), "without platform")
+}
+
+func TestPull_platform(t *testing.T) {
+	s := httptest.NewServer(prepareRegistry())
+	defer s.Close()
+
+	tempDir, opts := optionsForTesting(t)
+	ref := refOnServer(s.URL, "test-vm:multi")
+	arm64 := &v1.Platform{OS: "darwin", Architecture: "arm64"}
+	amd64 := &v1.Platform{OS: "darwin", Architecture: "amd64"}
+	armSha := makeTestVMWithContent(t, tempDir, ref, "arm64 disk")
+	require.NoError(t, Push(ref, append(opts, WithPlatform(arm64))...))
+	amdSha := makeTestVMWithContent(t, tempDir, ref, "amd64 disk")
+	require.NoError(t, Push(ref, append(opts, WithPlatform(amd64))...))
+
+	for platform, sha := range map[*v1.Platform]string{arm64: armSha, amd64: amdSha} {
+		imagesPath := filepath.Join(tempDir, platform.Architecture)
+		require.NoError(t, Pull(ref, append(opts, WithImagesPath(imagesPath), WithPlatform(platform))...))
+		assert.Equal(t, sha, hashFromFile(t, filepath.Join(imagesPath, portableRef(ref), "disk.img")))
+	}
+
+	linux := &v1.Platform{OS: "linux", Architecture: "arm64"}
+	err := Pull(ref, append(opts, WithImagesPath(filepath.Join(tempDir, "linux")), WithPlatform(linux))...)
+	assert.ErrorContains(t, err, "available platforms: darwin/arm64, darwin/amd64")
+
+	out, err := InspectRemote(ref, append(opts, WithPlatform(amd64))...)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out, "platforms: darwin/arm64, darwin/amd64\n"), out)
+}
@@ -1,10 +1,14 @@
 package transporter
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/macvmio/geranos/pkg/layout"
+	"strings"
 )
 
 func Inspect(rawRef string, opt ...Option) (string, error) {
@@ -18,6 +22,38 @@ func Inspect(rawRef string, opt ...Option) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("unable to read from ref %v: %w", ref, err)
 	}
+	return describeImage(img)
+}
+
+// InspectRemote describes image of rawRef in the registry like Inspect. When rawRef is an index, its platforms
+// are listed first, followed by the variant Pull would pick.
+func InspectRemote(rawRef string, opt ...Option) (string, error) {
+	opts := makeOptions(opt...)
+	ref, err := name.ParseReference(rawRef, name.StrictValidation)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse reference: %w", err)
+	}
+	desc, err := remote.Get(ref, opts.remoteOptions...)
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch %v: %w", ref, err)
+	}
+	header := ""
+	if desc.MediaType.IsIndex() {
+		manifest, err := v1.ParseIndexManifest(bytes.NewReader(desc.Manifest))
+		if err != nil {
+			return "", fmt.Errorf("unable to parse index: %w", err)
+		}
+		header = "platforms: " + strings.Join(platformsOf(manifest), ", ") + "\n"
+	}
+	img, err := pickImage(ref, desc, opts)
+	if err != nil {
+		return "", err
+	}
+	out, err := describeImage(img)
+	return header + out, err
+}
+
+func describeImage(img v1.Image) (string, error) {
 	cfg, err := img.ConfigFile()
 	if err != nil {
 		return "", fmt.Errorf("unable to get config file: %w", err)
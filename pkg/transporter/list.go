@@ -13,16 +13,49 @@ func List(opt ...Option) error {
 		return fmt.Errorf("unable to list images: %w", err)
 	}
 	// Print header
-	fmt.Printf("%-45s %-25s %-15s %-12s %-10s\n", "REPOSITORY", "TAG", "SIZE", "DISK USAGE", "MANIFEST")
+	digestHeader := ""
+	if opts.showDigests {
+		digestHeader = " DIGEST"
+	}
+	fmt.Printf("%-45s %-25s %-15s %-12s %-10s %-6s%s\n", "REPOSITORY", "TAG", "SIZE", "DISK USAGE", "MANIFEST", "PINNED", digestHeader)
 
 	for _, p := range props {
 		manifestStatus := "Missing"
 		if p.HasManifest {
 			manifestStatus = "Present"
 		}
+		pinned := "No"
+		if p.Pinned {
+			pinned = "Yes"
+		}
+
+		digest := ""
+		if opts.showDigests && p.HasManifest {
+			digest = " " + p.Digest.String()
+		}
 
-		fmt.Printf("%-50s %-15s %-15s %-12s %-10s\n", p.Ref.Context(), p.Ref.Identifier(),
-			fmt.Sprintf("%d", p.Size), p.DiskUsage, manifestStatus)
+		fmt.Printf("%-50s %-15s %-15s %-12s %-10s %-6s%s\n", p.Ref.Context(), p.Ref.Identifier(),
+			fmt.Sprintf("%d", p.Size), p.DiskUsage, manifestStatus, pinned, digest)
+	}
+	return nil
+}
+
+// PrintDedupStats prints how much content local images share.
+func PrintDedupStats(opt ...Option) error {
+	opts := makeOptions(opt...)
+	lm := layout.NewMapper(opts.imagesPath)
+	db, err := lm.DigestDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	st, err := db.Stats()
+	if err != nil {
+		return fmt.Errorf("unable to compute deduplication statistics: %w", err)
 	}
+	fmt.Printf("images: %d\n", st.ImagesCount)
+	fmt.Printf("segments: %d (%d bytes)\n", st.SegmentsCount, st.BytesCount)
+	fmt.Printf("unique segments: %d (%d bytes)\n", st.UniqueSegmentsCount, st.UniqueBytesCount)
+	fmt.Printf("shared segments: %d (%d bytes)\n", st.SharedSegmentsCount, st.SharedBytesCount)
 	return nil
 }
@@ -0,0 +1,44 @@
+package transporter
+
+import (
+	"errors"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/layout"
+)
+
+// Migrate upgrades layout of the images directory, see layout.Mapper.Migrate, printing what was done to every
+// image. With WithDryRun it only prints what would be done.
+func Migrate(opt ...Option) error {
+	opts := makeOptions(opt...)
+	lm := layout.NewMapper(opts.imagesPath, opts.dirimageOptions...)
+	res, err := lm.Migrate(opts.ctx, opts.dryRun)
+	if err != nil {
+		return fmt.Errorf("unable to migrate: %w", err)
+	}
+	if res.From == layout.CurrentLayoutVersion {
+		fmt.Printf("layout version %d is up to date\n", res.From)
+		return nil
+	}
+	for _, img := range res.Images {
+		for _, f := range img.Renamed {
+			fmt.Printf("%v: rename %v\n", img.Ref, f)
+		}
+		switch {
+		case img.Err != nil:
+			fmt.Printf("%v: %v\n", img.Ref, img.Err)
+		case img.NoManifest:
+			fmt.Printf("%v: no manifest, skipped\n", img.Ref)
+		case img.Verification != nil && opts.verbose:
+			fmt.Printf("%v: checked %d segments\n", img.Ref, img.Verification.SegmentsChecked)
+		}
+	}
+	if opts.dryRun {
+		fmt.Printf("would migrate from layout version %d to %d\n", res.From, layout.CurrentLayoutVersion)
+		return nil
+	}
+	if !res.OK() {
+		return errors.New("some images could not be migrated, repair or remove them and run migration again")
+	}
+	fmt.Printf("migrated from layout version %d to %d\n", res.From, res.To)
+	return nil
+}
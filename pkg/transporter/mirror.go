@@ -0,0 +1,136 @@
+package transporter
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"golang.org/x/sync/errgroup"
+	"net/http"
+	"path"
+	"sort"
+)
+
+// MirroredTag is what Mirror did to a tag.
+type MirroredTag struct {
+	Tag    string
+	Digest v1.Hash
+	// UpToDate reports the destination tag already had the digest, so it was skipped
+	UpToDate      bool
+	BytesUploaded int64
+	Err           error
+}
+
+// MirrorReport is the result of Mirror.
+type MirrorReport struct {
+	Tags []MirroredTag
+}
+
+// OK reports whether every tag was mirrored.
+func (r *MirrorReport) OK() bool {
+	for _, t := range r.Tags {
+		if t.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Copied returns number of tags copied to the destination.
+func (r *MirrorReport) Copied() int {
+	n := 0
+	for _, t := range r.Tags {
+		if t.Err == nil && !t.UpToDate {
+			n++
+		}
+	}
+	return n
+}
+
+// BytesUploaded returns number of bytes of blobs uploaded for all tags.
+func (r *MirrorReport) BytesUploaded() int64 {
+	n := int64(0)
+	for _, t := range r.Tags {
+		n += t.BytesUploaded
+	}
+	return n
+}
+
+// Mirror copies tags of srcRepo matching filter, a path.Match pattern where empty matches every tag, to dstRepo.
+// Tags pointing at the same digest in both repositories are skipped, the rest is copied with Copy, up to
+// workers count tags at the same time. A failure of a tag does not stop others, it is recorded in the report.
+// With WithDryRun tags are only compared.
+func Mirror(srcRepo, dstRepo string, filter string, opt ...Option) (*MirrorReport, error) {
+	opts := makeOptions(opt...)
+	if filter == "" {
+		filter = "*"
+	}
+	if _, err := path.Match(filter, ""); err != nil {
+		return nil, fmt.Errorf("invalid filter '%v': %w", filter, err)
+	}
+	src, err := name.NewRepository(srcRepo, name.StrictValidation)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse repository '%v': %w", srcRepo, err)
+	}
+	dst, err := name.NewRepository(dstRepo, name.StrictValidation)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse repository '%v': %w", dstRepo, err)
+	}
+	tags, err := remote.List(src, opts.remoteOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tags of %v: %w", src, err)
+	}
+	sort.Strings(tags)
+
+	res := &MirrorReport{}
+	for _, tag := range tags {
+		if ok, _ := path.Match(filter, tag); ok {
+			res.Tags = append(res.Tags, MirroredTag{Tag: tag})
+		}
+	}
+	g, ctx := errgroup.WithContext(opts.ctx)
+	g.SetLimit(max(opts.workersCount, 1))
+	// tags are copied concurrently, so blobs of each one are copied one at a time
+	copyOpts := append(append([]Option{}, opt...), WithContext(ctx), WithWorkersCount(1))
+	for i := range res.Tags {
+		t := &res.Tags[i]
+		g.Go(func() error {
+			t.Digest, t.UpToDate, t.BytesUploaded, t.Err = mirrorTag(src.Tag(t.Tag), dst.Tag(t.Tag), opts, copyOpts)
+			return nil
+		})
+	}
+	_ = g.Wait()
+	return res, nil
+}
+
+func mirrorTag(src, dst name.Tag, opts *options, copyOpts []Option) (v1.Hash, bool, int64, error) {
+	srcDesc, err := remote.Head(src, opts.remoteOptions...)
+	if err != nil {
+		return v1.Hash{}, false, 0, fmt.Errorf("unable to fetch %v: %w", src, err)
+	}
+	dstDesc, err := remote.Head(dst, opts.remoteOptions...)
+	if err != nil && !isNotFound(err) {
+		return srcDesc.Digest, false, 0, fmt.Errorf("unable to fetch %v: %w", dst, err)
+	}
+	if err == nil && dstDesc.Digest == srcDesc.Digest {
+		return srcDesc.Digest, true, 0, nil
+	}
+	if opts.dryRun {
+		return srcDesc.Digest, false, 0, nil
+	}
+	res, err := Copy(src.String(), dst.String(), copyOpts...)
+	if err != nil {
+		return srcDesc.Digest, false, 0, err
+	}
+	return res.Digest, false, res.BytesUploaded, nil
+}
+
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		return terr.StatusCode == http.StatusNotFound
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package transporter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestMirror(t *testing.T) {
+	srcServer := httptest.NewServer(prepareRegistry())
+	defer srcServer.Close()
+	dstServer := httptest.NewServer(prepareRegistry())
+	defer dstServer.Close()
+	tempDir, opts := optionsForTesting(t)
+	defer os.RemoveAll(tempDir)
+
+	srcRepo := refOnServer(srcServer.URL, "vms/a")
+	dstRepo := refOnServer(dstServer.URL, "mirror/a")
+	for _, tag := range []string{"v1.0", "v1.1", "v2.0"} {
+		makeTestVMAt(t, tempDir, srcRepo+":"+tag)
+		require.NoError(t, Push(srcRepo+":"+tag, opts...))
+	}
+
+	res, err := Mirror(srcRepo, dstRepo, "v1.*", append(opts, WithDryRun(true))...)
+	require.NoError(t, err)
+	require.Len(t, res.Tags, 2)
+	assert.Equal(t, 2, res.Copied())
+	assert.Equal(t, int64(0), res.BytesUploaded())
+
+	res, err = Mirror(srcRepo, dstRepo, "v1.*", opts...)
+	require.NoError(t, err)
+	require.True(t, res.OK())
+	assert.Equal(t, "v1.0", res.Tags[0].Tag)
+	assert.Equal(t, "v1.1", res.Tags[1].Tag)
+	assert.Equal(t, 2, res.Copied())
+
+	res, err = Mirror(srcRepo, dstRepo, "", opts...)
+	require.NoError(t, err)
+	require.Len(t, res.Tags, 3)
+	assert.True(t, res.Tags[0].UpToDate)
+	assert.True(t, res.Tags[1].UpToDate)
+	assert.False(t, res.Tags[2].UpToDate)
+	assert.Equal(t, 1, res.Copied())
+
+	_, err = Mirror(srcRepo, dstRepo, "[", opts...)
+	assert.Error(t, err)
+}
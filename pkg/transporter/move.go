@@ -0,0 +1,22 @@
+package transporter
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/macvmio/geranos/pkg/layout"
+)
+
+// Move renames local image src to dst, see layout.Mapper.Move.
+func Move(src, dst string, opt ...Option) error {
+	opts := makeOptions(opt...)
+	srcRef, err := name.ParseReference(src, name.StrictValidation)
+	if err != nil {
+		return fmt.Errorf("unable to parse reference '%v': %w", src, err)
+	}
+	dstRef, err := name.ParseReference(dst, name.StrictValidation)
+	if err != nil {
+		return fmt.Errorf("unable to parse reference '%v': %w", dst, err)
+	}
+	lm := layout.NewMapper(opts.imagesPath)
+	return lm.Move(srcRef, dstRef)
+}
@@ -0,0 +1,99 @@
+package transporter
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	ocilayout "github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/macvmio/geranos/pkg/layout"
+	"os"
+)
+
+// annotationRefName is the annotation of index.json of OCI image layouts naming images, tags usually.
+const annotationRefName = "org.opencontainers.image.ref.name"
+
+// ExportLayout writes local image src to OCI image layout in directory dst, named by tag of src, so it can be
+// copied with tools like skopeo or oras. Layout which already exists gets the image added, replacing one of
+// the same name, and blobs it already has are not written again.
+func ExportLayout(src string, dst string, opt ...Option) error {
+	opts := makeOptions(opt...)
+	ref, err := name.ParseReference(src, name.StrictValidation)
+	if err != nil {
+		return err
+	}
+	lm := layout.NewMapper(opts.imagesPath, opts.dirimageOptions...)
+	img, err := lm.Read(opts.ctx, ref)
+	if err != nil {
+		return fmt.Errorf("unable to read image from disk: %w", err)
+	}
+	p, err := ocilayout.FromPath(dst)
+	if errors.Is(err, os.ErrNotExist) {
+		p, err = ocilayout.Write(dst, empty.Index)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to open OCI image layout '%v': %w", dst, err)
+	}
+	refName := ref.Identifier()
+	err = p.ReplaceImage(img, match.Name(refName),
+		ocilayout.WithAnnotations(map[string]string{annotationRefName: refName}))
+	if err != nil {
+		return fmt.Errorf("unable to write %v to OCI image layout '%v': %w", ref, dst, err)
+	}
+	return nil
+}
+
+// ImportLayout writes image of OCI image layout in directory src as local image dst. The image is the one
+// named refName in index.json, or the only image of the layout when refName is empty.
+func ImportLayout(src string, dst string, refName string, opt ...Option) error {
+	opts := makeOptions(opt...)
+	ref, err := name.ParseReference(dst, name.StrictValidation)
+	if err != nil {
+		return err
+	}
+	idx, err := ocilayout.ImageIndexFromPath(src)
+	if err != nil {
+		return fmt.Errorf("unable to open OCI image layout '%v': %w", src, err)
+	}
+	desc, err := findLayoutImage(idx, refName)
+	if err != nil {
+		return err
+	}
+	img, err := idx.Image(desc.Digest)
+	if err != nil {
+		return fmt.Errorf("unable to read image %v of OCI image layout: %w", desc.Digest, err)
+	}
+	lm := layout.NewMapper(opts.imagesPath, opts.dirimageOptions...)
+	lm.AddCandidateRoots(opts.candidateRoots...)
+	return lm.Write(opts.ctx, img, ref)
+}
+
+// findLayoutImage returns descriptor of image named refName in idx, of its only image when refName is empty.
+func findLayoutImage(idx v1.ImageIndex, refName string) (*v1.Descriptor, error) {
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read index of OCI image layout: %w", err)
+	}
+	var found *v1.Descriptor
+	for i, desc := range manifest.Manifests {
+		if !desc.MediaType.IsImage() {
+			continue
+		}
+		if refName != "" && !match.Name(refName)(desc) {
+			continue
+		}
+		if found != nil {
+			return nil, errors.New("OCI image layout has many images, choose one by name")
+		}
+		found = &manifest.Manifests[i]
+	}
+	if found == nil {
+		if refName != "" {
+			return nil, fmt.Errorf("image '%v' not found in OCI image layout", refName)
+		}
+		return nil, errors.New("OCI image layout has no images")
+	}
+	return found, nil
+}
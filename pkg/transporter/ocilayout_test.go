@@ -0,0 +1,36 @@
+package transporter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportImportLayout(t *testing.T) {
+	tempDir, opts := optionsForTesting(t)
+	defer os.RemoveAll(tempDir)
+	src := "oci.jarosik.online/testrepo/a:v1"
+	other := "oci.jarosik.online/testrepo/b:v2"
+	sha := makeTestVMAt(t, tempDir, src)
+	makeTestVMWithContent(t, tempDir, other, "other content")
+	require.NoError(t, Rehash(src, opts...))
+	require.NoError(t, Rehash(other, opts...))
+
+	layoutDir := filepath.Join(tempDir, "layout")
+	require.NoError(t, ExportLayout(src, layoutDir, opts...))
+	assert.FileExists(t, filepath.Join(layoutDir, "index.json"))
+	assert.DirExists(t, filepath.Join(layoutDir, "blobs", "sha256"))
+
+	dst := "oci.jarosik.online/imported/a:v1"
+	require.NoError(t, ImportLayout(layoutDir, dst, "", opts...))
+	assert.Equal(t, sha, hashFromFile(t, filepath.Join(tempDir, "images", portableRef(dst), "disk.img")))
+
+	require.NoError(t, ExportLayout(other, layoutDir, opts...))
+	assert.Error(t, ImportLayout(layoutDir, dst, "", opts...), "many images need a name")
+	require.NoError(t, ImportLayout(layoutDir, dst, "v2", opts...))
+	content, err := os.ReadFile(filepath.Join(tempDir, "images", portableRef(dst), "disk.img"))
+	require.NoError(t, err)
+	assert.Equal(t, "other content", string(content))
+}
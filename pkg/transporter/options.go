@@ -2,11 +2,20 @@ package transporter
 
 import (
 	"context"
+	"crypto"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/layout"
+	"github.com/macvmio/geranos/pkg/provenance"
+	"github.com/macvmio/geranos/pkg/signing"
 	"log"
+	"net/http"
+	"os"
+	"time"
 )
 
 type options struct {
@@ -16,10 +25,39 @@ type options struct {
 	insecure         bool
 	remoteOptions    []remote.Option
 	dirimageOptions  []dirimage.Option
+	streaming        bool
 	refValidation    name.Option
 	workersCount     int
+	existenceWorkers int
+	uploadChunkSize  int64
+	platform         *v1.Platform
+	signing          *signing.Config
+	signaturePolicy  *signing.Policy
+	provenance       *provenance.Build
+	recipients       []crypto.PublicKey
+	decryptionKeys   []crypto.PrivateKey
+	xattrs           bool
+	verifyClones     bool
+	hardlinks        bool
+	contentStore     bool
+	gcGracePeriod    time.Duration
+	prunePolicy      layout.PrunePolicy
+	showDigests      bool
+	candidateRoots   []string
+	sourceImagesPath string
 	verbose          bool
 	force            bool
+	fileFilter       dirimage.FileFilter
+	maxBandwidth     int64
+	rateLimitWait    time.Duration
+	maxRangeResumes  int
+	dryRun           bool
+	adoptByRename    bool
+	backend          string
+	skipHashing      bool
+	incremental      bool
+	transport        http.RoundTripper
+	logf             func(format string, args ...any)
 	ctx              context.Context
 }
 
@@ -55,6 +93,67 @@ func WithWorkersCount(workersCount int) Option {
 	}
 }
 
+// WithExistenceCheckWorkers sets number of HEAD requests checking which blobs are in the registry already,
+// sent at the same time before uploading.
+func WithExistenceCheckWorkers(n int) Option {
+	return func(o *options) {
+		o.existenceWorkers = n
+	}
+}
+
+// WithUploadChunkSize sets size of chunks layers larger than it are uploaded in, resuming interrupted pushes
+// from the last chunk. By default the size is tuned to the measured throughput, starting at 16MiB.
+func WithUploadChunkSize(size int64) Option {
+	return func(o *options) {
+		o.uploadChunkSize = size
+	}
+}
+
+// WithPlatform makes Push add the image to index of the reference as variant of platform, creating the index
+// when the reference does not exist yet, and Pull pick variant of platform from indexes instead of the current one.
+func WithPlatform(platform *v1.Platform) Option {
+	return func(o *options) {
+		o.platform = platform
+	}
+}
+
+// WithSigning makes Push sign the pushed image like cosign does, and attach the signature to it as referrer.
+func WithSigning(cfg signing.Config) Option {
+	return func(o *options) {
+		o.signing = &cfg
+	}
+}
+
+// WithSignaturePolicy makes Pull refuse images without signature by signer trusted by policy, before writing
+// anything to disk.
+func WithSignaturePolicy(policy *signing.Policy) Option {
+	return func(o *options) {
+		o.signaturePolicy = policy
+	}
+}
+
+// WithProvenance makes Push attach SLSA provenance of the image to it as attestation, describing build with hash
+// of the pushed directory and times of the push. It is signed when WithSigning is set as well.
+func WithProvenance(build provenance.Build) Option {
+	return func(o *options) {
+		o.provenance = &build
+	}
+}
+
+// WithEncryption makes Push encrypt layers for recipients, RSA or EC public keys, like ocicrypt does.
+func WithEncryption(recipients ...crypto.PublicKey) Option {
+	return func(o *options) {
+		o.recipients = append(o.recipients, recipients...)
+	}
+}
+
+// WithDecryptionKeys sets private keys Pull decrypts encrypted layers with.
+func WithDecryptionKeys(keys ...crypto.PrivateKey) Option {
+	return func(o *options) {
+		o.decryptionKeys = append(o.decryptionKeys, keys...)
+	}
+}
+
 func WithContext(ctx context.Context) Option {
 	return func(o *options) {
 		o.ctx = ctx
@@ -86,6 +185,181 @@ func WithForce(force bool) Option {
 	}
 }
 
+func WithResume(resume bool) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithResume(resume))
+	}
+}
+
+func WithStaging(staging bool) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithStaging(staging))
+	}
+}
+
+// WithBackend makes Push and Pull use object storage bucket of URL instead of the registry of the reference,
+// see objectstore.Open.
+func WithBackend(bucketURL string) Option {
+	return func(o *options) {
+		o.backend = bucketURL
+	}
+}
+
+// WithAdoptByRename makes Adopt move the directory into the images directory instead of cloning it.
+func WithAdoptByRename(rename bool) Option {
+	return func(o *options) {
+		o.adoptByRename = rename
+	}
+}
+
+// WithHashing makes Adopt hash files of the adopted image and write its manifest and config, which it does
+// by default, so the image can be pushed and becomes a clone candidate.
+func WithHashing(enabled bool) Option {
+	return func(o *options) {
+		o.skipHashing = !enabled
+	}
+}
+
+// WithFileFilter makes Pull download only files matching include patterns and not matching exclude patterns,
+// and Clone skip the others.
+func WithFileFilter(include []string, exclude []string) Option {
+	return func(o *options) {
+		o.fileFilter = dirimage.FileFilter{Include: include, Exclude: exclude}
+	}
+}
+
+// WithStallTimeout reports stalls when no bytes have moved for given duration, optionally retrying stalled segments.
+func WithStallTimeout(timeout time.Duration, retry bool) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithStallTimeout(timeout, retry))
+	}
+}
+
+// WithTOC makes Push upload segments with geranos table of contents, see filesegment.WithTOC.
+func WithTOC(toc bool) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithTOC(toc))
+	}
+}
+
+// WithRecursive makes Push include subdirectories of the image directory, including empty ones.
+func WithRecursive(recursive bool) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithRecursive(recursive))
+	}
+}
+
+// WithExcludePatterns makes Push leave out files matching any of the glob patterns.
+func WithExcludePatterns(patterns ...string) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithExcludePatterns(patterns...))
+	}
+}
+
+// WithZeroElision makes Push upload segments containing only zeros as empty zero segment blobs.
+func WithZeroElision(enabled bool) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithZeroElision(enabled))
+	}
+}
+
+// WithFileMetadata makes Push record file modes, modification times and optionally extended attributes.
+func WithFileMetadata(enabled bool, xattrs bool) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithFileMetadata(enabled, xattrs))
+	}
+}
+
+// WithXattrs makes Clone and Adopt copy extended attributes of files as well.
+func WithXattrs(enabled bool) Option {
+	return func(o *options) {
+		o.xattrs = enabled
+	}
+}
+
+// WithCloneVerification makes Clone and Adopt compare every cloned file with its source.
+func WithCloneVerification(enabled bool) Option {
+	return func(o *options) {
+		o.verifyClones = enabled
+	}
+}
+
+// WithHardlinks makes Clone hard link files instead of cloning them, see duplicator.WithHardlinks.
+// Neither image may be modified afterwards.
+func WithHardlinks(enabled bool) Option {
+	return func(o *options) {
+		o.hardlinks = enabled
+	}
+}
+
+// WithContentStore makes Pull create the content store of the images directory, see layout.Mapper.EnableContentStore.
+// The store is used by all later operations, with or without this option.
+func WithContentStore(enabled bool) Option {
+	return func(o *options) {
+		o.contentStore = enabled
+	}
+}
+
+// WithGCGracePeriod sets how old temporary files must be for GC to remove them, see layout.Mapper.CollectGarbage.
+func WithGCGracePeriod(gracePeriod time.Duration) Option {
+	return func(o *options) {
+		o.gcGracePeriod = gracePeriod
+	}
+}
+
+// WithPrunePolicy sets which images Prune removes.
+func WithPrunePolicy(policy layout.PrunePolicy) Option {
+	return func(o *options) {
+		o.prunePolicy = policy
+	}
+}
+
+// WithCandidateRoots makes images of other images directories, like other stores, clone candidates of pulled images.
+// The images directory itself is ignored, so directories of all stores can be given.
+func WithCandidateRoots(dirs ...string) Option {
+	return func(o *options) {
+		o.candidateRoots = append(o.candidateRoots, dirs...)
+	}
+}
+
+// WithSourceImagesPath makes Clone take the source image from another images directory, like another store.
+func WithSourceImagesPath(imagesPath string) Option {
+	return func(o *options) {
+		o.sourceImagesPath = imagesPath
+	}
+}
+
+// WithDigests makes List print manifest digests of images, which refer to them as repository@digest.
+func WithDigests(show bool) Option {
+	return func(o *options) {
+		o.showDigests = show
+	}
+}
+
+func WithFsync(fsync bool) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithFsync(fsync))
+	}
+}
+
+func WithMetadataFileMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithMetadataFileMode(mode))
+	}
+}
+
+func WithDataFileMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithDataFileMode(mode))
+	}
+}
+
+func WithOwner(uid, gid int) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithOwner(uid, gid))
+	}
+}
+
 func WithProgressChannel(c chan<- ProgressUpdate) Option {
 	return func(o *options) {
 		// Create a new dirimage channel to be used internally
@@ -95,16 +369,219 @@ func WithProgressChannel(c chan<- ProgressUpdate) Option {
 		go func() {
 			for progress := range dirimageChan {
 				// Convert ProgressUpdate to dirimage.ProgressUpdate and send it
-				c <- ProgressUpdate{
-					BytesProcessed: progress.BytesProcessed,
-					BytesTotal:     progress.BytesTotal,
-				}
+				c <- ProgressUpdate(progress)
 			}
 		}()
 		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithProgressChannel(dirimageChan))
 	}
 }
 
+// WithProgressFunc sets function receiving every progress update, one at a time; none are dropped.
+func WithProgressFunc(progress func(ProgressUpdate)) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithProgressFunc(func(u dirimage.ProgressUpdate) {
+			progress(ProgressUpdate(u))
+		}))
+	}
+}
+
+// WithMaxBandwidth limits transfer rate of Pull and Push, in bytes per second. Zero means no limit.
+func WithMaxBandwidth(bytesPerSecond int64) Option {
+	return func(o *options) {
+		o.maxBandwidth = bytesPerSecond
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithMaxBandwidth(bytesPerSecond))
+	}
+}
+
+// WithRetryPolicy controls how failed segment downloads are retried during Pull.
+func WithRetryPolicy(policy dirimage.RetryPolicy) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithRetryPolicy(policy))
+	}
+}
+
+// WithRateLimitWait sets how long a request may wait in total when registry rate limits it (HTTP 429,
+// or 503 with Retry-After), before the error is returned. Zero turns waiting off.
+func WithRateLimitWait(maxWait time.Duration) Option {
+	return func(o *options) {
+		o.rateLimitWait = maxWait
+	}
+}
+
+// WithRangeResume sets how many times an interrupted blob download of Pull continues from the byte
+// where it stopped, using HTTP Range requests, before the error is returned. Zero turns resuming off.
+func WithRangeResume(maxResumes int) Option {
+	return func(o *options) {
+		o.maxRangeResumes = maxResumes
+	}
+}
+
+// WithDryRun makes Pull and Push print what they would do, see PlanPull and PlanPush, instead of transferring the image,
+// and GC and Prune print what they would remove.
+func WithDryRun(dryRun bool) Option {
+	return func(o *options) {
+		o.dryRun = dryRun
+	}
+}
+
+// WithDiskSpaceCheck controls whether Pull fails early when the images directory lacks space for the image.
+func WithDiskSpaceCheck(enabled bool) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithDiskSpaceCheck(enabled))
+	}
+}
+
+// WithPreallocation makes Pull reserve blocks for whole files before downloading, see dirimage.WithPreallocation.
+func WithPreallocation(enabled bool) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithPreallocation(enabled))
+	}
+}
+
+// WithDirectIO keeps segments written by Pull out of the page cache, see dirimage.WithDirectIO.
+func WithDirectIO(enabled bool) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithDirectIO(enabled))
+	}
+}
+
+// WithHolePunching makes Pull deallocate blocks of local files where the image has zeros now,
+// see dirimage.WithHolePunching.
+func WithHolePunching(enabled bool) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithHolePunching(enabled))
+	}
+}
+
+// WithSparseBlockSize sets size of blocks Pull compares with existing content of local files,
+// see dirimage.WithSparseBlockSize.
+func WithSparseBlockSize(size int) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithSparseBlockSize(size))
+	}
+}
+
+// WithHashWorkersCount sets how many segments are hashed at the same time while reading the image for Push.
+func WithHashWorkersCount(count int) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithHashWorkersCount(count))
+	}
+}
+
+// WithDigestCache makes Push reuse digests of unchanged files computed by previous push of the same directory.
+func WithDigestCache(enabled bool) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithDigestCache(enabled))
+	}
+}
+
+// WithIncrementalRehash makes Push hash only files changed since the directory was last pulled or pushed,
+// reusing hashes of the local manifest for the rest. After a successful push the local manifest is updated.
+func WithIncrementalRehash(enabled bool) Option {
+	return func(o *options) {
+		o.incremental = enabled
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithIncrementalRehash(enabled))
+	}
+}
+
+// WithChunkSizeRules sets sizes of segments for files matching patterns, when reading the image for Push.
+func WithChunkSizeRules(rules ...dirimage.ChunkSizeRule) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithChunkSizeRules(rules...))
+	}
+}
+
+// WithAdaptiveChunkSize limits number of segments of a single file when reading the image for Push,
+// by growing their size for large files.
+func WithAdaptiveChunkSize(maxSegments int) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithAdaptiveChunkSize(maxSegments))
+	}
+}
+
+// WithDigestAlgorithm selects algorithm of segment digests when reading the image for Push.
+func WithDigestAlgorithm(algorithm string) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithDigestAlgorithm(algorithm))
+	}
+}
+
+// WithCompression sets compression of segments when reading the image for Push, and rules overriding it
+// for files matching patterns.
+func WithCompression(c filesegment.Compression, rules ...dirimage.CompressionRule) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithCompression(c), dirimage.WithCompressionRules(rules...))
+	}
+}
+
+// WithSkipIncompressible makes Push upload segments uncompressed, when compression would save less than
+// minSavings fraction of their size.
+func WithSkipIncompressible(minSavings float64) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithSkipIncompressible(minSavings))
+	}
+}
+
+// WithCompressionLevel sets level of zstd compression when reading the image for Push.
+func WithCompressionLevel(level int) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithCompressionLevel(level))
+	}
+}
+
+// WithEncoderConcurrency sets how many goroutines compress each segment when reading the image for Push.
+func WithEncoderConcurrency(n int) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithEncoderConcurrency(n))
+	}
+}
+
+// WithCompressionCPUBudget spreads given number of CPUs among segments compressed at the same time for Push.
+func WithCompressionCPUBudget(cpus int) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithCompressionCPUBudget(cpus))
+	}
+}
+
+// WithDecoderLimits limits zstd window and memory of decompressing segments on Pull, see dirimage.WithDecoderLimits.
+func WithDecoderLimits(maxWindow, maxMemory uint64) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithDecoderLimits(maxWindow, maxMemory))
+	}
+}
+
+// WithSeekableZstd compresses segments as seekable zstd with frames of frameSize bytes when reading the image for Push.
+func WithSeekableZstd(frameSize int) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithSeekableZstd(frameSize))
+	}
+}
+
+// WithZstdWindowSize sets window of zstd compression when reading the image for Push.
+func WithZstdWindowSize(size int) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithZstdWindowSize(size))
+	}
+}
+
+// WithStreamingPush makes Push hash segments while uploading them, instead of reading and compressing each one
+// once more before. Blobs are then uploaded without checking whether the registry has them already,
+// unless their digests are known from WithDigestCache or WithIncrementalRehash.
+func WithStreamingPush(enabled bool) Option {
+	return func(o *options) {
+		o.streaming = enabled
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithDeferredDigests(enabled))
+	}
+}
+
+// WithZstdDictionary compresses files up to maxFileSize bytes with zstd dictionary trained on them,
+// when reading the image for Push. Pull uses the dictionary shipped in the manifest.
+func WithZstdDictionary(maxFileSize int64) Option {
+	return func(o *options) {
+		o.dirimageOptions = append(o.dirimageOptions, dirimage.WithZstdDictionary(maxFileSize))
+	}
+}
+
 func makeOptions(opts ...Option) *options {
 	res := options{
 		imagesPath:       mustExpandUser("~/.geranos/images"),
@@ -114,14 +591,27 @@ func makeOptions(opts ...Option) *options {
 		remoteOptions: []remote.Option{
 			remote.WithAuthFromKeychain(authn.DefaultKeychain),
 		},
-		dirimageOptions: []dirimage.Option{},
-		refValidation:   name.StrictValidation,
-		workersCount:    8,
-		verbose:         false,
-		ctx:             context.Background(),
+		dirimageOptions:  []dirimage.Option{},
+		refValidation:    name.StrictValidation,
+		workersCount:     8,
+		existenceWorkers: 32,
+		verbose:          false,
+		rateLimitWait:    5 * time.Minute,
+		maxRangeResumes:  5,
+		gcGracePeriod:    layout.DefaultGCGracePeriod,
+		transport:        remote.DefaultTransport,
+		ctx:              context.Background(),
 	}
 	for _, o := range opts {
 		o(&res)
 	}
+	res.logf = func(format string, args ...any) {}
+	if res.verbose {
+		res.logf = log.Printf
+	}
+	if res.rateLimitWait > 0 {
+		res.transport = newRateLimitTransport(res.transport, res.rateLimitWait, res.logf)
+		res.remoteOptions = append(res.remoteOptions, remote.WithTransport(res.transport))
+	}
 	return &res
 }
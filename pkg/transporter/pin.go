@@ -0,0 +1,29 @@
+package transporter
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/macvmio/geranos/pkg/layout"
+)
+
+// Pin protects local image src from Remove and Prune.
+func Pin(src string, opt ...Option) error {
+	opts := makeOptions(opt...)
+	ref, err := name.ParseReference(src, name.StrictValidation)
+	if err != nil {
+		return fmt.Errorf("unable to parse reference: %w", err)
+	}
+	lm := layout.NewMapper(opts.imagesPath)
+	return lm.Pin(ref)
+}
+
+// Unpin lets Remove and Prune remove local image src again.
+func Unpin(src string, opt ...Option) error {
+	opts := makeOptions(opt...)
+	ref, err := name.ParseReference(src, name.StrictValidation)
+	if err != nil {
+		return fmt.Errorf("unable to parse reference: %w", err)
+	}
+	lm := layout.NewMapper(opts.imagesPath)
+	return lm.Unpin(ref)
+}
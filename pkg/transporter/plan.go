@@ -0,0 +1,46 @@
+package transporter
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/layout"
+	"io"
+)
+
+// PlanPull reports what Pull would do with local copy of src, fetching only manifest and config of the image.
+func PlanPull(src string, opt ...Option) (*dirimage.WritePlan, error) {
+	opts := makeOptions(opt...)
+	ref, err := name.ParseReference(src, name.StrictValidation)
+	if err != nil {
+		return nil, err
+	}
+	img, err := sourceImage(ref, opts)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.fileFilter.IsEmpty() {
+		img, err = dirimage.FilterFiles(img, opts.fileFilter)
+		if err != nil {
+			return nil, err
+		}
+	}
+	lm := layout.NewMapper(opts.imagesPath, opts.dirimageOptions...)
+	lm.AddCandidateRoots(opts.candidateRoots...)
+	return lm.Plan(opts.ctx, img, ref)
+}
+
+// PrintPlan writes every segment of the plan with its action, followed by totals per action.
+func PrintPlan(w io.Writer, plan *dirimage.WritePlan) {
+	for _, s := range plan.Segments {
+		line := fmt.Sprintf("%v %v[%d-%d]: %v", s.ID, s.Filename, s.Start, s.Stop, s.Action)
+		if s.Source != "" {
+			line += fmt.Sprintf(" from '%v'", s.Source)
+		}
+		fmt.Fprintln(w, line)
+	}
+	for _, action := range []dirimage.SegmentAction{dirimage.SegmentPresent, dirimage.SegmentCloned, dirimage.SegmentZero, dirimage.SegmentDownload} {
+		segments, bytes := plan.Count(action)
+		fmt.Fprintf(w, "%-9s %d segments, %d bytes\n", string(action)+":", segments, bytes)
+	}
+}
@@ -0,0 +1,143 @@
+package transporter
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPull_dryRun(t *testing.T) {
+	recordedRequests := make([]http.Request, 0)
+	s := httptest.NewServer(prepareRegistryWithRecorder(&recordedRequests))
+	defer s.Close()
+
+	tempDir, opts := optionsForTesting(t)
+	refA := refOnServer(s.URL, "test-vm:a")
+	dirA := filepath.Join(tempDir, "images", portableRef(refA))
+	require.NoError(t, os.MkdirAll(dirA, os.ModePerm))
+	makeFileAt(t, filepath.Join(dirA, "disk.img"), "disk content")
+	makeFileAt(t, filepath.Join(dirA, "extra.img"), "old extra content")
+	require.NoError(t, Push(refA, opts...))
+	// pulled image has local manifest, so its files can be cloned
+	deleteTestVMAt(t, tempDir, refA)
+	require.NoError(t, Pull(refA, opts...))
+
+	refB := refOnServer(s.URL, "test-vm:b")
+	dirB := filepath.Join(tempDir, "images", portableRef(refB))
+	require.NoError(t, os.MkdirAll(dirB, os.ModePerm))
+	makeFileAt(t, filepath.Join(dirB, "disk.img"), "disk content")
+	makeFileAt(t, filepath.Join(dirB, "extra.img"), "new extra content")
+	makeFileAt(t, filepath.Join(dirB, "new.img"), "brand new content")
+	require.NoError(t, os.WriteFile(filepath.Join(dirB, "zero.img"), make([]byte, 4096), 0o644))
+	require.NoError(t, Push(refB, append(opts, WithZeroElision(true))...))
+
+	// only extra.img is in place locally
+	require.NoError(t, os.Remove(filepath.Join(dirB, "disk.img")))
+	require.NoError(t, os.Remove(filepath.Join(dirB, "new.img")))
+	require.NoError(t, os.Remove(filepath.Join(dirB, "zero.img")))
+	clear(recordedRequests)
+
+	plan, err := PlanPull(refB, opts...)
+	require.NoError(t, err)
+	actions := make(map[string]dirimage.SegmentAction)
+	for _, s := range plan.Segments {
+		actions[s.Filename] = s.Action
+	}
+	assert.Equal(t, map[string]dirimage.SegmentAction{
+		"disk.img":  dirimage.SegmentCloned,
+		"extra.img": dirimage.SegmentPresent,
+		"new.img":   dirimage.SegmentDownload,
+		"zero.img":  dirimage.SegmentZero,
+	}, actions)
+	segments, bytesToDownload := plan.Count(dirimage.SegmentDownload)
+	assert.Equal(t, 1, segments)
+	assert.Equal(t, int64(len("brand new content")), bytesToDownload)
+	// config is the only blob accessed
+	assert.Equal(t, 1, calculateAccessed(recordedRequests, "GET", "/blobs"))
+
+	out := &bytes.Buffer{}
+	PrintPlan(out, plan)
+	assert.Contains(t, out.String(), "download: 1 segments, 17 bytes")
+	assert.Contains(t, out.String(), "from '"+filepath.Join(dirA, "disk.img")+"'")
+
+	require.NoError(t, Pull(refB, append(opts, WithDryRun(true))...))
+	assert.NoFileExists(t, filepath.Join(dirB, "disk.img"))
+	assert.NoFileExists(t, filepath.Join(dirB, dirimage.LocalManifestFilename))
+}
+
+func TestPush_dryRun(t *testing.T) {
+	recordedRequests := make([]http.Request, 0)
+	s := httptest.NewServer(prepareRegistryWithRecorder(&recordedRequests))
+	defer s.Close()
+
+	tempDir, opts := optionsForTesting(t)
+	refA := refOnServer(s.URL, "test-vm:a")
+	dirA := filepath.Join(tempDir, "images", portableRef(refA))
+	require.NoError(t, os.MkdirAll(dirA, os.ModePerm))
+	makeFileAt(t, filepath.Join(dirA, "disk.img"), "disk content")
+	require.NoError(t, Push(refA, opts...))
+
+	refB := refOnServer(s.URL, "test-vm:b")
+	dirB := filepath.Join(tempDir, "images", portableRef(refB))
+	require.NoError(t, os.MkdirAll(dirB, os.ModePerm))
+	makeFileAt(t, filepath.Join(dirB, "disk.img"), "disk content")
+	makeFileAt(t, filepath.Join(dirB, "new.img"), "brand new content")
+	makeFileAt(t, filepath.Join(dirB, "same.img"), "brand new content")
+	clear(recordedRequests)
+
+	plan, err := PlanPush(refB, opts...)
+	require.NoError(t, err)
+	actions := make(map[string]BlobAction)
+	for _, b := range plan.Blobs {
+		actions[b.Filename] = b.Action
+	}
+	assert.Equal(t, map[string]BlobAction{
+		"":         BlobUpload, // config
+		"disk.img": BlobExists,
+		"new.img":  BlobUpload,
+		"same.img": BlobDuplicate,
+	}, actions)
+	blobs, _ := plan.Count(BlobUpload)
+	assert.Equal(t, 2, blobs)
+
+	require.NoError(t, Push(refB, append(opts, WithDryRun(true))...))
+	assert.Equal(t, 0, calculateAccessed(recordedRequests, "PUT", "/"))
+	assert.Equal(t, 0, calculateAccessed(recordedRequests, "POST", "/"))
+}
+
+func TestPush_existingBlobsAreCheckedOnce(t *testing.T) {
+	recordedRequests := make([]http.Request, 0)
+	s := httptest.NewServer(prepareRegistryWithRecorder(&recordedRequests))
+	defer s.Close()
+
+	tempDir, opts := optionsForTesting(t)
+	refA := refOnServer(s.URL, "test-vm:a")
+	makeTestVMAt(t, tempDir, refA)
+	require.NoError(t, Push(refA, opts...))
+
+	refB := refOnServer(s.URL, "test-vm:b")
+	dirB := filepath.Join(tempDir, "images", portableRef(refB))
+	require.NoError(t, os.MkdirAll(dirB, os.ModePerm))
+	makeFileAt(t, filepath.Join(dirB, "disk.img"), "some fake image data")
+	makeFileAt(t, filepath.Join(dirB, "config.json"), `{"disk_size"": 123}`)
+	recordedRequests = recordedRequests[:0]
+
+	require.NoError(t, Push(refB, append(opts, WithExistenceCheckWorkers(4))...))
+	// config and two layers are checked together, the config differs from the first image and is
+	// checked once more by its upload
+	assert.Equal(t, 4, calculateAccessed(recordedRequests, "HEAD", "/blobs/"))
+	assert.Equal(t, 1, calculateAccessed(recordedRequests, "POST", "/blobs/"))
+	assert.Equal(t, 1, calculateAccessed(recordedRequests, "PUT", "/manifests/"))
+
+	pullOpts := append(opts, WithImagesPath(filepath.Join(tempDir, "other")))
+	require.NoError(t, Pull(refB, pullOpts...))
+	assert.Equal(t, hashFromFile(t, filepath.Join(dirB, "disk.img")),
+		hashFromFile(t, filepath.Join(tempDir, "other", portableRef(refB), "disk.img")))
+}
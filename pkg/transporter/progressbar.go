@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"github.com/macvmio/geranos/pkg/bitarray"
 	"github.com/macvmio/geranos/pkg/dirimage"
+	"strings"
+	"time"
 )
 
 type ProgressUpdate dirimage.ProgressUpdate
@@ -11,14 +13,39 @@ type ProgressUpdate dirimage.ProgressUpdate
 func PrintProgress(progress <-chan ProgressUpdate) {
 	const maxSize = 800
 	ba := bitarray.New(maxSize)
+	phase := dirimage.Phase("")
 	updateProgress := func(progress int64) {
 		ba.Fill(int(progress))
-		fmt.Printf("\rProgress: %s %d%%", ba, progress/8)
+		label := "Progress"
+		if phase != "" {
+			label = strings.ToUpper(string(phase[:1])) + string(phase[1:])
+		}
+		fmt.Printf("\r%-12s %s %d%%", label+":", ba, progress/8)
 	}
 	last := int64(0)
+	lastTotal := int64(0)
 	for p := range progress {
+		if p.Stalled {
+			what := "transfer"
+			if p.StalledSegmentID != nil {
+				what = p.StalledSegmentID.String()
+			}
+			fmt.Printf("\nNo progress for %v on %s\n", p.StalledFor.Round(time.Second), what)
+			updateProgress(last)
+			continue
+		}
+		if p.BytesTotal == 0 {
+			continue
+		}
 		current := maxSize * p.BytesProcessed / p.BytesTotal
-		if current != last {
+		if lastTotal != 0 && p.BytesTotal != lastTotal {
+			// next operation (e.g. cloning, then verifying and downloading) starts on its own line
+			fmt.Printf("\n")
+			ba = bitarray.New(maxSize)
+		}
+		lastTotal = p.BytesTotal
+		if current != last || p.Phase != phase {
+			phase = p.Phase
 			updateProgress(current)
 		}
 		last = current
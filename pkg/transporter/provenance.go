@@ -0,0 +1,69 @@
+package transporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/macvmio/geranos/pkg/provenance"
+	"github.com/macvmio/geranos/pkg/signing"
+	"net/http"
+	"time"
+)
+
+// attachProvenance attaches provenance of img pushed to ref as attestation, made of src read from directory
+// source. The statement is signed in DSSE envelope, like cosign attest does, when signing is configured.
+func attachProvenance(ref name.Reference, img v1.Image, src v1.Image, source string, opts *options) (v1.Hash, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	size, err := img.Size()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	build := *opts.provenance
+	build.Source = source
+	if build.SourceDigest, err = provenance.SourceDigest(src); err != nil {
+		return v1.Hash{}, fmt.Errorf("unable to hash source directory: %w", err)
+	}
+	build.FinishedOn = time.Now()
+	statement, err := provenance.NewStatement(ref.Context().Name(), digest, build)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+
+	artifactType := provenance.MediaType
+	content := statement
+	annotations := map[string]string{provenance.PredicateTypeAnnotation: provenance.PredicateType}
+	if opts.signing != nil {
+		cfg := *opts.signing
+		if cfg.HTTPClient == nil {
+			cfg.HTTPClient = &http.Client{Transport: opts.transport}
+		}
+		env, sig, err := signing.SignEnvelope(opts.ctx, cfg, provenance.MediaType, statement)
+		if err != nil {
+			return v1.Hash{}, fmt.Errorf("unable to sign provenance: %w", err)
+		}
+		if content, err = json.Marshal(env); err != nil {
+			return v1.Hash{}, err
+		}
+		artifactType = signing.EnvelopeMediaType
+		for k, v := range sig.Annotations() {
+			annotations[k] = v
+		}
+	}
+	layer := mutate.Addendum{
+		Layer:       static.NewLayer(content, types.MediaType(artifactType)),
+		Annotations: annotations,
+	}
+	subject := v1.Descriptor{MediaType: mediaType, Digest: digest, Size: size}
+	return pushArtifact(ref.Context().Digest(digest.String()), subject, artifactType, []mutate.Addendum{layer}, nil, opts)
+}
@@ -0,0 +1,185 @@
+package transporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/distribution"
+	"github.com/macvmio/geranos/pkg/layout"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyStore serves images of upstream registry, pulling them into the local store first, so each
+// version of an image crosses the network to upstream once, however many clients pull it.
+type proxyStore struct {
+	// upstream is registry, optionally with namespace, repositories are requested from
+	upstream string
+	lm       *layout.Mapper
+	opt      []Option
+	opts     *options
+	locks    refLocks
+}
+
+func newProxyStore(upstream string, opt ...Option) (*proxyStore, error) {
+	opts := makeOptions(opt...)
+	upstream = strings.TrimSuffix(upstream, "/")
+	if _, err := name.NewRepository(upstream+"/proxy", opts.refValidation); err != nil {
+		return nil, fmt.Errorf("invalid upstream '%v': %w", upstream, err)
+	}
+	return &proxyStore{
+		upstream: upstream,
+		lm:       newServingMapper(opts),
+		opt:      opt,
+		opts:     opts,
+	}, nil
+}
+
+// newServingMapper returns mapper reading images with hashes of their local manifests, so serving an image
+// hashes only files changed since it was pulled or pushed.
+func newServingMapper(opts *options) *layout.Mapper {
+	return layout.NewMapper(opts.imagesPath, append(opts.dirimageOptions, dirimage.WithIncrementalRehash(true))...)
+}
+
+// parseRepoReference returns reference of repo by tag or digest.
+func parseRepoReference(repo string, reference string, opts *options) (name.Reference, error) {
+	if _, err := v1.NewHash(reference); err == nil {
+		return name.NewDigest(repo+"@"+reference, opts.refValidation)
+	}
+	return name.NewTag(repo+":"+reference, opts.refValidation)
+}
+
+// refLocks serializes writes and reads of images served to clients.
+type refLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock locks ref and returns function unlocking it.
+func (rl *refLocks) lock(ref name.Reference) func() {
+	rl.mu.Lock()
+	if rl.locks == nil {
+		rl.locks = make(map[string]*sync.Mutex)
+	}
+	l, ok := rl.locks[ref.String()]
+	if !ok {
+		l = &sync.Mutex{}
+		rl.locks[ref.String()] = l
+	}
+	rl.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// localImages returns local images of repository repo, locking each while it is read. Images which
+// cannot be read, like ones without manifest, are left out.
+func localImages(ctx context.Context, lm *layout.Mapper, locks *refLocks, repo name.Repository) ([]v1.Image, error) {
+	tags, err := lm.Tags(repo)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]v1.Image, 0, len(tags))
+	for _, tag := range tags {
+		ref := repo.Tag(tag)
+		unlock := locks.lock(ref)
+		img, err := lm.Read(ctx, ref)
+		unlock()
+		if err == nil {
+			res = append(res, img)
+		}
+	}
+	return res, nil
+}
+
+func (ps *proxyStore) Image(ctx context.Context, repo string, reference string) (v1.Image, error) {
+	ref, err := parseRepoReference(ps.upstream+"/"+repo, reference, ps.opts)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, distribution.ErrNotFound)
+	}
+	defer ps.locks.lock(ref)()
+	local, localErr := ps.lm.Read(ctx, ref)
+	desc, err := remote.Head(ref, append(ps.opts.remoteOptions, remote.WithContext(ctx))...)
+	switch {
+	case err != nil && isNotFound(err):
+		return nil, fmt.Errorf("%v: %w", ref, distribution.ErrNotFound)
+	case err != nil && localErr == nil:
+		ps.opts.logf("serving local %v, upstream is unavailable: %v", ref, err)
+		return local, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to fetch %v: %w", ref, err)
+	}
+	if localErr == nil {
+		if digest, err := local.Digest(); err == nil && digest == desc.Digest {
+			return local, nil
+		}
+	}
+	ps.opts.logf("pulling %v", ref)
+	// the pull continues when the client disconnects, so the next one does not start over
+	if err := Pull(ref.String(), ps.opt...); err != nil {
+		return nil, fmt.Errorf("unable to pull %v: %w", ref, err)
+	}
+	return ps.lm.Read(ctx, ref)
+}
+
+func (ps *proxyStore) Tags(ctx context.Context, repo string) ([]string, error) {
+	r, err := name.NewRepository(ps.upstream+"/"+repo, ps.opts.refValidation)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, distribution.ErrNotFound)
+	}
+	tags, err := remote.List(r, append(ps.opts.remoteOptions, remote.WithContext(ctx))...)
+	if isNotFound(err) {
+		return nil, fmt.Errorf("%v: %w", r, distribution.ErrNotFound)
+	}
+	return tags, err
+}
+
+// Images returns images of repository repo pulled from upstream before, nothing is pulled.
+func (ps *proxyStore) Images(ctx context.Context, repo string) ([]v1.Image, error) {
+	r, err := name.NewRepository(ps.upstream+"/"+repo, ps.opts.refValidation)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, distribution.ErrNotFound)
+	}
+	return localImages(ctx, ps.lm, &ps.locks, r)
+}
+
+// Proxy serves images of upstream registry on addr with the OCI distribution API, pulling them into the images
+// directory when they are requested for the first time, or changed upstream. upstream may include namespace:
+// clients pull "ghcr.io/macvmio/macos-sonoma" as "<addr>/macvmio/macos-sonoma" with upstream "ghcr.io",
+// or as "<addr>/macos-sonoma" with upstream "ghcr.io/macvmio". When upstream is
+// unavailable images present locally are served as they are. Proxy runs until the context is done.
+func Proxy(addr string, upstream string, opt ...Option) error {
+	opts := makeOptions(opt...)
+	store, err := newProxyStore(upstream, opt...)
+	if err != nil {
+		return err
+	}
+	return listenAndServe(opts.ctx, addr, distribution.NewServer(store, distribution.WithLogFunction(opts.logf)))
+}
+
+// listenAndServe serves handler on addr until ctx is done.
+func listenAndServe(ctx context.Context, addr string, handler http.Handler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %v: %w", addr, err)
+	}
+	log.Printf("listening on %v", l.Addr())
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: time.Minute}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package transporter
+
+import (
+	"github.com/macvmio/geranos/pkg/distribution"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProxy_pullsFromUpstreamOnce(t *testing.T) {
+	upstreamRequests := make([]http.Request, 0)
+	upstream := httptest.NewServer(prepareRegistryWithRecorder(&upstreamRequests))
+	defer upstream.Close()
+	tempDir, opts := optionsForTesting(t)
+	defer os.RemoveAll(tempDir)
+
+	upstreamRef := refOnServer(upstream.URL, "vms/a:v1")
+	sha := makeBigTestVMAt(t, tempDir, upstreamRef)
+	require.NoError(t, Push(upstreamRef, opts...))
+	upstreamRequests = upstreamRequests[:0]
+
+	store, err := newProxyStore(strings.TrimPrefix(upstream.URL, "http://"),
+		append(opts, WithImagesPath(filepath.Join(tempDir, "proxy")))...)
+	require.NoError(t, err)
+	proxy := httptest.NewServer(distribution.NewServer(store))
+	defer proxy.Close()
+
+	proxiedRef := refOnServer(proxy.URL, "vms/a:v1")
+	for _, client := range []string{"client1", "client2"} {
+		require.NoError(t, Pull(proxiedRef, append(opts, WithImagesPath(filepath.Join(tempDir, client)))...))
+		assert.Equal(t, sha, hashFromFile(t, filepath.Join(tempDir, client, portableRef(proxiedRef), "disk.img")))
+	}
+	downloaded := calculateAccessed(upstreamRequests, "GET", "/blobs/")
+	assert.Greater(t, downloaded, 0)
+
+	upstreamRequests = upstreamRequests[:0]
+	require.NoError(t, Pull(proxiedRef, append(opts, WithImagesPath(filepath.Join(tempDir, "client3")))...))
+	assert.Equal(t, 0, calculateAccessed(upstreamRequests, "GET", "/blobs/"), "blobs are served from the local store")
+
+	sha = makeTestVMWithContent(t, tempDir, upstreamRef, "updated content")
+	require.NoError(t, Push(upstreamRef, opts...))
+	require.NoError(t, Pull(proxiedRef, append(opts, WithImagesPath(filepath.Join(tempDir, "client1")))...))
+	assert.Equal(t, sha, hashFromFile(t, filepath.Join(tempDir, "client1", portableRef(proxiedRef), "disk.img")))
+
+	err = Pull(refOnServer(proxy.URL, "vms/missing:v1"), append(opts, WithImagesPath(filepath.Join(tempDir, "client1")))...)
+	assert.Error(t, err)
+}
@@ -0,0 +1,33 @@
+package transporter
+
+import (
+	"errors"
+	"fmt"
+	"github.com/macvmio/geranos/pkg/layout"
+	"time"
+)
+
+// Prune removes local images selected by WithPrunePolicy, printing them. With WithDryRun it only prints
+// what would be removed.
+func Prune(opt ...Option) error {
+	opts := makeOptions(opt...)
+	if opts.prunePolicy == (layout.PrunePolicy{}) {
+		return errors.New("no prune policy given")
+	}
+	lm := layout.NewMapper(opts.imagesPath)
+	pruned, err := lm.Prune(opts.prunePolicy, opts.dryRun)
+	total := int64(0)
+	for _, p := range pruned {
+		fmt.Printf("%-60s %-20s %15d %s\n", p.Ref, p.LastAccess.Format(time.DateTime), p.Size, p.Reason)
+		total += p.Size
+	}
+	if err != nil {
+		return fmt.Errorf("unable to prune: %w", err)
+	}
+	if opts.dryRun {
+		fmt.Printf("would remove %d images of %d bytes\n", len(pruned), total)
+	} else {
+		fmt.Printf("removed %d images of %d bytes, run gc to remove their blobs from content store\n", len(pruned), total)
+	}
+	return nil
+}
@@ -1,24 +1,67 @@
 package transporter
 
 import (
+	"fmt"
 	"github.com/google/go-containerregistry/pkg/name"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/encryption"
 	"github.com/macvmio/geranos/pkg/layout"
+	"os"
+	"path/filepath"
 )
 
 func Pull(src string, opt ...Option) error {
 	opts := makeOptions(opt...)
+	if opts.dryRun {
+		plan, err := PlanPull(src, opt...)
+		if err != nil {
+			return err
+		}
+		PrintPlan(os.Stdout, plan)
+		return nil
+	}
 	ref, err := name.ParseReference(src, name.StrictValidation)
 	if err != nil {
 		return err
 	}
-	img, err := remote.Image(ref, opts.remoteOptions...)
+	img, err := sourceImage(ref, opts)
 	if err != nil {
 		return err
 	}
+	if opts.signaturePolicy != nil {
+		if opts.backend != "" {
+			return fmt.Errorf("verifying signatures is not supported with backend")
+		}
+		if err := verifySignature(ref, img, opts); err != nil {
+			return fmt.Errorf("refusing to pull %v: %w", ref, err)
+		}
+	}
+	if opts.maxRangeResumes > 0 && opts.backend == "" {
+		img = newResumableImage(img, ref.Context(), opts)
+	}
+	lm := layout.NewMapper(opts.imagesPath, opts.dirimageOptions...)
+	// segments are buffered next to the image until verified, rather than filling the temporary directory
+	img, err = encryption.DecryptImage(img, opts.decryptionKeys,
+		encryption.WithFileSystem(dirimage.FileSystem(opts.dirimageOptions...)),
+		encryption.WithBufferDir(filepath.Dir(lm.Dir(ref))))
+	if err != nil {
+		return fmt.Errorf("unable to decrypt %v: %w", ref, err)
+	}
+	if !opts.fileFilter.IsEmpty() {
+		// filter before sketching, so only selected files are cloned and compared with local manifest
+		img, err = dirimage.FilterFiles(img, opts.fileFilter)
+		if err != nil {
+			return err
+		}
+	}
 	// Cache is not important if Sketch is working properly
 	//img = cache.Image(img, diskcache.NewFilesystemCache(opts.cachePath))
-	lm := layout.NewMapper(opts.imagesPath, opts.dirimageOptions...)
+	lm.AddCandidateRoots(opts.candidateRoots...)
+	if opts.contentStore {
+		if err := lm.EnableContentStore(); err != nil {
+			return err
+		}
+	}
 	if opts.force {
 		return lm.Write(opts.ctx, img, ref)
 	}
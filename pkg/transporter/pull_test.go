@@ -1,10 +1,23 @@
 package transporter
 
 import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/encryption"
+	"github.com/macvmio/geranos/pkg/filesegment"
 	"github.com/macvmio/geranos/pkg/layout"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -232,3 +245,211 @@ func TestPull_WithForceOption(t *testing.T) {
 		assert.Equal(t, shaBefore, shaAfter)
 	})
 }
+
+func TestPullAndPush_zeroElision(t *testing.T) {
+	recordedRequests := make([]http.Request, 0)
+	s := httptest.NewServer(prepareRegistryWithRecorder(&recordedRequests))
+	defer s.Close()
+
+	tempDir, opts := optionsForTesting(t)
+	ref := refOnServer(s.URL, "test-vm:zeros")
+	d := filepath.Join(tempDir, "images", portableRef(ref))
+	require.NoError(t, os.MkdirAll(d, os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(d, "disk.img"), make([]byte, 4096), 0o644))
+	makeFileAt(t, filepath.Join(d, "config.json"), `{"disk_size": 4096}`)
+	shaBefore := hashFromFile(t, filepath.Join(d, "disk.img"))
+
+	require.NoError(t, Push(ref, append(opts, WithZeroElision(true))...))
+	deleteTestVMAt(t, tempDir, ref)
+	clear(recordedRequests)
+
+	require.NoError(t, Pull(ref, opts...))
+	assert.Equal(t, shaBefore, hashFromFile(t, filepath.Join(d, "disk.img")))
+	// only config and config.json segment are downloaded, zero segment is materialized locally
+	assert.Equal(t, 2, calculateAccessed(recordedRequests, "GET", "/blobs"))
+}
+
+func TestPullAndPush_compression(t *testing.T) {
+	s := httptest.NewServer(prepareRegistry())
+	defer s.Close()
+
+	tempDir, opts := optionsForTesting(t)
+	ref := refOnServer(s.URL, "test-vm:compression")
+	d := filepath.Join(tempDir, "images", portableRef(ref))
+	require.NoError(t, os.MkdirAll(d, os.ModePerm))
+	// raw segment starting like gzip stream has to be stored as it is
+	require.NoError(t, os.WriteFile(filepath.Join(d, "disk.qcow2"), append([]byte{0x1f, 0x8b}, make([]byte, 4096)...), 0o644))
+	makeFileAt(t, filepath.Join(d, "config.json"), `{"disk_size": 4096}`)
+	shaDisk := hashFromFile(t, filepath.Join(d, "disk.qcow2"))
+	shaConfig := hashFromFile(t, filepath.Join(d, "config.json"))
+
+	rules := []dirimage.CompressionRule{{Pattern: "*.qcow2", Compression: filesegment.CompressionNone}}
+	require.NoError(t, Push(ref, append(opts, WithCompression(filesegment.CompressionGzip, rules...))...))
+	deleteTestVMAt(t, tempDir, ref)
+
+	require.NoError(t, Pull(ref, opts...))
+	assert.Equal(t, shaDisk, hashFromFile(t, filepath.Join(d, "disk.qcow2")))
+	assert.Equal(t, shaConfig, hashFromFile(t, filepath.Join(d, "config.json")))
+}
+
+func TestPullAndPush_sha512(t *testing.T) {
+	s := httptest.NewServer(prepareRegistry())
+	defer s.Close()
+
+	tempDir, opts := optionsForTesting(t)
+	ref := refOnServer(s.URL, "test-vm:sha512")
+	shaBefore := makeTestVMAt(t, tempDir, ref)
+
+	require.NoError(t, Push(ref, append(opts, WithDigestAlgorithm("sha512"))...))
+	parsed, err := name.ParseReference(ref)
+	require.NoError(t, err)
+	img, err := remote.Image(parsed)
+	require.NoError(t, err)
+	manifest, err := img.Manifest()
+	require.NoError(t, err)
+	for _, l := range manifest.Layers {
+		assert.Equal(t, "sha512", l.Digest.Algorithm)
+	}
+	deleteTestVMAt(t, tempDir, ref)
+
+	require.NoError(t, Pull(ref, opts...))
+	assert.Equal(t, shaBefore, hashFromFile(t, filepath.Join(tempDir, "images", portableRef(ref), "disk.img")))
+
+	// diff IDs recorded locally keep the algorithm, so later pulls and verify check segments with sha512
+	local, err := dirimage.Read(context.Background(), filepath.Join(tempDir, "images", portableRef(ref)), dirimage.WithOmitLayersContent())
+	require.NoError(t, err)
+	configFile, err := local.ConfigFile()
+	require.NoError(t, err)
+	for _, diffID := range configFile.RootFS.DiffIDs {
+		assert.Equal(t, "sha512", diffID.Algorithm)
+	}
+}
+
+func TestPullAndPush_streaming(t *testing.T) {
+	recordedRequests := make([]http.Request, 0)
+	s := httptest.NewServer(prepareRegistryWithRecorder(&recordedRequests))
+	defer s.Close()
+
+	tempDir, opts := optionsForTesting(t)
+	ref := refOnServer(s.URL, "test-vm:streaming")
+	shaBefore := makeTestVMAt(t, tempDir, ref)
+
+	require.NoError(t, Push(ref, append(opts, WithStreamingPush(true))...))
+	// streamed segments are found in the registry afterwards, so none of the blobs is uploaded twice
+	assert.Equal(t, 3, calculateAccessed(recordedRequests, "PATCH", "/blobs/uploads"))
+	deleteTestVMAt(t, tempDir, ref)
+
+	require.NoError(t, Pull(ref, opts...))
+	assert.Equal(t, shaBefore, hashFromFile(t, filepath.Join(tempDir, "images", portableRef(ref), "disk.img")))
+}
+
+func TestPull_encrypted(t *testing.T) {
+	s := httptest.NewServer(prepareRegistry())
+	defer s.Close()
+
+	tempDir, opts := optionsForTesting(t)
+	ref := refOnServer(s.URL, "test-vm:encrypted")
+	sha := makeTestVMAt(t, tempDir, ref)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	require.NoError(t, Push(ref, append(opts, WithEncryption(key.Public()))...))
+
+	parsed, err := name.ParseReference(ref)
+	require.NoError(t, err)
+	remoteImg, err := remote.Image(parsed)
+	require.NoError(t, err)
+	manifest, err := remoteImg.Manifest()
+	require.NoError(t, err)
+	for _, l := range manifest.Layers {
+		assert.True(t, encryption.IsEncrypted(l.MediaType), l.MediaType)
+		assert.Contains(t, l.Annotations, encryption.KeysAnnotation)
+	}
+
+	imagesPath := filepath.Join(tempDir, "pulled")
+	err = Pull(ref, append(opts, WithImagesPath(imagesPath))...)
+	assert.ErrorIs(t, err, encryption.ErrEncrypted)
+
+	require.NoError(t, Pull(ref, append(opts, WithImagesPath(imagesPath), WithDecryptionKeys(key))...))
+	assert.Equal(t, sha, hashFromFile(t, filepath.Join(imagesPath, portableRef(ref), "disk.img")))
+
+	// decrypted layers are the ones pushed without encryption
+	plain := refOnServer(s.URL, "test-vm:plain")
+	makeTestVMAt(t, tempDir, plain)
+	require.NoError(t, Push(plain, opts...))
+	parsedPlain, err := name.ParseReference(plain)
+	require.NoError(t, err)
+	plainImg, err := remote.Image(parsedPlain)
+	require.NoError(t, err)
+	plainManifest, err := plainImg.Manifest()
+	require.NoError(t, err)
+	decrypted, err := encryption.DecryptImage(remoteImg, []crypto.PrivateKey{key})
+	require.NoError(t, err)
+	decryptedManifest, err := decrypted.Manifest()
+	require.NoError(t, err)
+	assert.Equal(t, plainManifest.Layers, decryptedManifest.Layers)
+}
+
+// rawManifest is manifest pushed as it is.
+type rawManifest []byte
+
+func (rm rawManifest) RawManifest() ([]byte, error) {
+	return rm, nil
+}
+
+func TestPull_encryptedTampered(t *testing.T) {
+	s := httptest.NewServer(prepareRegistry())
+	defer s.Close()
+
+	tempDir, opts := optionsForTesting(t)
+	defer os.RemoveAll(tempDir)
+	ref := refOnServer(s.URL, "test-vm:encrypted")
+	makeTestVMAt(t, tempDir, ref)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	require.NoError(t, Push(ref, append(opts, WithEncryption(key.Public()))...))
+
+	// registry serves blob modified by somebody without the key, under manifest updated to match it
+	parsed, err := name.ParseReference(ref)
+	require.NoError(t, err)
+	remoteImg, err := remote.Image(parsed)
+	require.NoError(t, err)
+	manifest, err := remoteImg.Manifest()
+	require.NoError(t, err)
+	for i, d := range manifest.Layers {
+		l, err := remoteImg.LayerByDigest(d.Digest)
+		require.NoError(t, err)
+		rc, err := l.Compressed()
+		require.NoError(t, err)
+		blob, err := io.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		blob[0] ^= 1
+		tampered := static.NewLayer(blob, d.MediaType)
+		require.NoError(t, remote.WriteLayer(parsed.Context(), tampered))
+		manifest.Layers[i].Digest, err = tampered.Digest()
+		require.NoError(t, err)
+	}
+	raw, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	require.NoError(t, remote.Put(parsed, rawManifest(raw)))
+
+	imagesPath := filepath.Join(tempDir, "pulled")
+	err = Pull(ref, append(opts, WithImagesPath(imagesPath), WithDecryptionKeys(key))...)
+	assert.ErrorIs(t, err, encryption.ErrHMACMismatch)
+
+	// local image, changed since, stays as it was, nothing of the modified one is written over it
+	localDir := filepath.Join(tempDir, "images", portableRef(ref))
+	f, err := os.OpenFile(filepath.Join(localDir, "disk.img"), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("changed"), 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	shaBefore := hashFromFile(t, filepath.Join(localDir, "disk.img"))
+	err = Pull(ref, append(opts, WithForce(true), WithDecryptionKeys(key))...)
+	assert.ErrorIs(t, err, encryption.ErrHMACMismatch)
+	assert.Equal(t, shaBefore, hashFromFile(t, filepath.Join(localDir, "disk.img")))
+	// and neither are buffers of segments left behind
+	tmp, err := filepath.Glob(filepath.Join(filepath.Dir(localDir), ".decrypt-*"))
+	require.NoError(t, err)
+	assert.Empty(t, tmp)
+}
@@ -5,32 +5,91 @@ import (
 	"github.com/google/go-containerregistry/pkg/logs"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/encryption"
 	"github.com/macvmio/geranos/pkg/layout"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"github.com/macvmio/geranos/pkg/throttle"
 	"golang.org/x/sync/errgroup"
 	"log"
 	"os"
+	"time"
 )
 
+// existingBlobs checks which of digests are present in repo already, with HEAD requests sent by
+// opts.existenceWorkers workers at the same time.
+func existingBlobs(repo name.Repository, digests []v1.Hash, opts *options) (map[v1.Hash]bool, error) {
+	fetcher := newBlobFetcher(repo, opts)
+	exists := make([]bool, len(digests))
+	g, _ := errgroup.WithContext(opts.ctx)
+	g.SetLimit(max(opts.existenceWorkers, 1))
+	for i, h := range digests {
+		g.Go(func() error {
+			ok, err := fetcher.exists(h)
+			if err != nil {
+				return fmt.Errorf("unable to check blob %v: %w", h, err)
+			}
+			exists[i] = ok
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	res := make(map[v1.Hash]bool, len(digests))
+	for i, h := range digests {
+		if exists[i] {
+			res[h] = true
+		}
+	}
+	return res, nil
+}
+
+// prePushConcurrently uploads config and layers of img missing in repo. Existence of all of them is checked
+// up front, so the manifest can be put on its own afterward. Layers larger than an upload chunk are uploaded
+// in resumable chunks.
 func prePushConcurrently(repo name.Repository, img v1.Image, opts *options) error {
 	layers, err := img.Layers()
 	if err != nil {
 		return fmt.Errorf("unable to extract layers from image: %w", err)
 	}
-	g, ctx := errgroup.WithContext(opts.ctx)
-	g.SetLimit(opts.workersCount)
+	config, err := partial.ConfigLayer(img)
+	if err != nil {
+		return fmt.Errorf("unable to get config of image: %w", err)
+	}
 
-	seen := make(map[string]bool, 0)
-	for _, l := range layers {
-		currentLayer := l
-		h, err := currentLayer.Digest()
+	seen := make(map[v1.Hash]bool, 0)
+	unique := make([]v1.Layer, 0, len(layers)+1)
+	digests := make([]v1.Hash, 0, len(layers)+1)
+	for _, l := range append([]v1.Layer{config}, layers...) {
+		h, err := l.Digest()
 		if err != nil {
 			return err
 		}
-		if _, ok := seen[h.String()]; ok {
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		unique = append(unique, l)
+		digests = append(digests, h)
+	}
+	existing, err := existingBlobs(repo, digests, opts)
+	if err != nil {
+		return err
+	}
+	opts.logf("%d of %d blobs exist in %v already", len(existing), len(digests), repo)
+
+	uploader := newBlobUploader(repo, nil, opts)
+	g, ctx := errgroup.WithContext(opts.ctx)
+	g.SetLimit(opts.workersCount)
+	for i, l := range unique {
+		h := digests[i]
+		if existing[h] {
 			continue
 		}
-		seen[h.String()] = true
 		g.Go(func() error {
 			select {
 			case <-ctx.Done():
@@ -38,7 +97,15 @@ func prePushConcurrently(repo name.Repository, img v1.Image, opts *options) erro
 			default:
 			}
 			log.Printf("pushing layer: %v", h)
-			return remote.WriteLayer(repo, currentLayer, opts.remoteOptions...)
+			size, err := l.Size()
+			if err != nil {
+				return err
+			}
+			// mounting needs the upload of go-containerregistry
+			if size > uploader.chunks.next() && opts.mountedReference == nil {
+				return uploader.uploadResumable(ctx, l)
+			}
+			return remote.WriteLayer(repo, l, opts.remoteOptions...)
 		})
 	}
 	err = g.Wait()
@@ -48,34 +115,136 @@ func prePushConcurrently(repo name.Repository, img v1.Image, opts *options) erro
 	return nil
 }
 
+// manifestOnly is the manifest of an image without its blobs, so putting it does not check them again.
+type manifestOnly struct {
+	img v1.Image
+}
+
+func (m manifestOnly) RawManifest() ([]byte, error) {
+	return m.img.RawManifest()
+}
+
+func (m manifestOnly) MediaType() (types.MediaType, error) {
+	return m.img.MediaType()
+}
+
 func Push(imageRef string, opt ...Option) error {
 	logs.Progress = log.New(os.Stdout, "", log.LstdFlags)
 	opts := makeOptions(opt...)
+	startedOn := time.Now()
+	// buckets have no referrers, signatures and attestations would not be attached to anything
+	if opts.backend != "" && opts.signing != nil {
+		return fmt.Errorf("signing is not supported with backend")
+	}
+	if opts.backend != "" && opts.provenance != nil {
+		return fmt.Errorf("provenance is not supported with backend")
+	}
+	if opts.dryRun {
+		plan, err := PlanPush(imageRef, opt...)
+		if err != nil {
+			return err
+		}
+		PrintPushPlan(os.Stdout, plan)
+		return nil
+	}
 
 	ref, err := name.ParseReference(imageRef)
 	if err != nil {
 		return fmt.Errorf("unable to parse reference '%v': %w", imageRef, err)
 	}
 
-	lm := layout.NewMapper(opts.imagesPath)
+	lm := layout.NewMapper(opts.imagesPath, opts.dirimageOptions...)
 
 	img, err := lm.Read(opts.ctx, ref)
 	if err != nil {
 		return fmt.Errorf("unable to read image from disk: %w", err)
 	}
+	read := img
+	if len(opts.recipients) > 0 {
+		if opts.streaming {
+			return fmt.Errorf("streaming push is not supported with encryption")
+		}
+		img, err = encryption.EncryptImage(opts.ctx, img, opts.recipients, opts.workersCount)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.backend != "" {
+		if opts.platform != nil {
+			return fmt.Errorf("pushing platforms of an index is not supported with backend")
+		}
+		if err := pushToBucket(ref, img, opts); err != nil {
+			return err
+		}
+		return recordManifest(read, opts)
+	}
+	var limiter *throttle.Limiter
+	if opts.maxBandwidth > 0 {
+		limiter = throttle.NewLimiter(opts.maxBandwidth, sysenv.SystemClock)
+		img = &throttledImage{Image: img, ctx: opts.ctx, limiter: limiter}
+	}
+	if di, ok := read.(*dirimage.DirImage); ok && opts.streaming {
+		if err := streamLayers(ref.Context(), di, limiter, opts); err != nil {
+			return fmt.Errorf("error occured while streaming layers: %w", err)
+		}
+	}
 	if opts.mountedReference != nil {
 		img = layout.NewMountableImage(img, opts.mountedReference)
 	}
 
+	// variant of a platform is pushed by digest, and the index is tagged instead
+	target := ref
+	if opts.platform != nil {
+		digest, err := img.Digest()
+		if err != nil {
+			return err
+		}
+		target = ref.Context().Digest(digest.String())
+	}
 	if opts.workersCount > 0 {
 		err := prePushConcurrently(ref.Context(), img, opts)
 		if err != nil {
 			return err
 		}
+		// every blob is in the registry now, checking them again would double the requests
+		if err := remote.Put(target, manifestOnly{img}, opts.remoteOptions...); err != nil {
+			return fmt.Errorf("unable to push image to registry: %w", err)
+		}
+	} else if err := remote.Write(target, img, opts.remoteOptions...); err != nil {
+		return fmt.Errorf("unable to push image to registry: %w", err)
+	}
+	if opts.platform != nil {
+		if err := addToIndex(ref, img, *opts.platform, opts); err != nil {
+			return fmt.Errorf("unable to push index: %w", err)
+		}
+	}
+	if opts.signing != nil {
+		digest, err := signImage(ref, img, opts)
+		if err != nil {
+			return fmt.Errorf("unable to sign image: %w", err)
+		}
+		logs.Progress.Printf("signed %v with %v", ref, digest)
+	}
+	if opts.provenance != nil {
+		if opts.provenance.StartedOn.IsZero() {
+			opts.provenance.StartedOn = startedOn
+		}
+		digest, err := attachProvenance(ref, img, read, lm.Dir(ref), opts)
+		if err != nil {
+			return fmt.Errorf("unable to attach provenance: %w", err)
+		}
+		logs.Progress.Printf("attached provenance of %v with %v", ref, digest)
 	}
+	return recordManifest(read, opts)
+}
 
-	if err := remote.Write(ref, img, opts.remoteOptions...); err != nil {
-		return fmt.Errorf("unable to push image to registry: %w", err)
+// recordManifest updates local manifest of pushed image read from disk, so WithIncrementalRehash
+// of the next push hashes only files changed since.
+func recordManifest(read v1.Image, opts *options) error {
+	if di, ok := read.(*dirimage.DirImage); ok && opts.incremental {
+		if err := di.RecordManifest(opts.dirimageOptions...); err != nil {
+			return fmt.Errorf("unable to update local manifest: %w", err)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,156 @@
+package transporter
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/layout"
+	"github.com/macvmio/geranos/pkg/objectstore"
+	"golang.org/x/sync/errgroup"
+	"io"
+)
+
+// BlobAction says what Push would do with a blob of the image.
+type BlobAction string
+
+const (
+	// BlobUpload blobs are missing in the registry and would be uploaded.
+	BlobUpload BlobAction = "upload"
+	// BlobExists blobs are already in the repository.
+	BlobExists BlobAction = "exists"
+	// BlobMount blobs would be mounted from the repository given by WithMountedReference.
+	BlobMount BlobAction = "mount"
+	// BlobDuplicate blobs appear earlier in the same image, so they are uploaded only once.
+	BlobDuplicate BlobAction = "duplicate"
+)
+
+// PlannedBlob describes single blob of PushPlan. Filename is empty for config blob.
+type PlannedBlob struct {
+	Digest   v1.Hash    `json:"digest"`
+	Size     int64      `json:"size"`
+	Filename string     `json:"filename,omitempty"`
+	Action   BlobAction `json:"action"`
+}
+
+// PushPlan lists blobs of the image with what Push would do with each of them.
+type PushPlan struct {
+	Blobs []PlannedBlob `json:"blobs"`
+}
+
+// Count returns number of blobs and their total size for given action.
+func (pp *PushPlan) Count(action BlobAction) (blobs int, bytes int64) {
+	for _, b := range pp.Blobs {
+		if b.Action == action {
+			blobs++
+			bytes += b.Size
+		}
+	}
+	return blobs, bytes
+}
+
+// PlanPush hashes the image directory and checks which blobs the registry already has, reporting what Push
+// would upload without uploading anything.
+func PlanPush(imageRef string, opt ...Option) (*PushPlan, error) {
+	opts := makeOptions(opt...)
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse reference '%v': %w", imageRef, err)
+	}
+	lm := layout.NewMapper(opts.imagesPath, opts.dirimageOptions...)
+	img, err := lm.Read(opts.ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read image from disk: %w", err)
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get manifest: %w", err)
+	}
+
+	res := &PushPlan{Blobs: make([]PlannedBlob, 0, len(manifest.Layers)+1)}
+	res.Blobs = append(res.Blobs, PlannedBlob{Digest: manifest.Config.Digest, Size: manifest.Config.Size})
+	seen := make(map[v1.Hash]bool)
+	seen[manifest.Config.Digest] = true
+	for _, l := range manifest.Layers {
+		b := PlannedBlob{Digest: l.Digest, Size: l.Size}
+		if d, err := filesegment.ParseDescriptor(l, v1.Hash{}); err == nil {
+			b.Filename = d.Filename()
+		}
+		if seen[l.Digest] {
+			b.Action = BlobDuplicate
+		}
+		seen[l.Digest] = true
+		res.Blobs = append(res.Blobs, b)
+	}
+
+	targetExists := newBlobFetcher(ref.Context(), opts).exists
+	var mountable *blobFetcher
+	if opts.backend != "" {
+		// blobs of all repositories share the bucket, there is nothing to mount
+		b, err := openBucket(opts)
+		if err != nil {
+			return nil, err
+		}
+		targetExists = func(h v1.Hash) (bool, error) {
+			return objectstore.BlobExists(opts.ctx, b, h)
+		}
+	} else if opts.mountedReference != nil {
+		mountable = newBlobFetcher(opts.mountedReference.Context(), opts)
+	}
+	g, _ := errgroup.WithContext(opts.ctx)
+	g.SetLimit(max(opts.existenceWorkers, 1))
+	for i := range res.Blobs {
+		b := &res.Blobs[i]
+		if b.Action == BlobDuplicate {
+			continue
+		}
+		g.Go(func() error {
+			exists, err := targetExists(b.Digest)
+			if err != nil {
+				return fmt.Errorf("unable to check blob %v: %w", b.Digest, err)
+			}
+			switch {
+			case exists:
+				b.Action = BlobExists
+			case mountable != nil:
+				if exists, err = mountable.exists(b.Digest); err != nil {
+					return fmt.Errorf("unable to check blob %v in mounted repository: %w", b.Digest, err)
+				}
+				b.Action = BlobUpload
+				if exists {
+					b.Action = BlobMount
+				}
+			default:
+				b.Action = BlobUpload
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// PrintPushPlan writes blobs which would be uploaded, followed by totals of uploaded and deduplicated bytes.
+func PrintPushPlan(w io.Writer, plan *PushPlan) {
+	for _, b := range plan.Blobs {
+		if b.Action != BlobUpload {
+			continue
+		}
+		what := b.Filename
+		if what == "" {
+			what = "config"
+		}
+		fmt.Fprintf(w, "upload %v (%v, %d bytes)\n", b.Digest, what, b.Size)
+	}
+	blobs, bytes := plan.Count(BlobUpload)
+	fmt.Fprintf(w, "would upload: %d blobs, %d bytes\n", blobs, bytes)
+	deduplicated := int64(0)
+	for _, action := range []BlobAction{BlobExists, BlobMount, BlobDuplicate} {
+		blobs, bytes := plan.Count(action)
+		deduplicated += bytes
+		fmt.Fprintf(w, "%-10s %d blobs, %d bytes\n", string(action)+":", blobs, bytes)
+	}
+	fmt.Fprintf(w, "deduplicated: %d bytes\n", deduplicated)
+}
@@ -0,0 +1,120 @@
+package transporter
+
+import (
+	"context"
+	"github.com/macvmio/geranos/pkg/sysenv"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRateLimitDelay is used when registry responds with 429 but does not say how long to wait.
+const defaultRateLimitDelay = 5 * time.Second
+
+// rateLimitTransport honors rate limiting of registries. It retries requests answered with 429, or with 503
+// carrying Retry-After, once the registry allows it. The pause is shared, so all workers talking to the registry
+// wait together instead of each one burning its retries and failing the whole transfer.
+type rateLimitTransport struct {
+	inner http.RoundTripper
+	clock sysenv.Clock
+	logf  func(format string, args ...any)
+	// maxWait is the longest a single request waits for the registry in total, before response is returned as is.
+	maxWait time.Duration
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+}
+
+func newRateLimitTransport(inner http.RoundTripper, maxWait time.Duration, logf func(format string, args ...any)) *rateLimitTransport {
+	return &rateLimitTransport{inner: inner, clock: sysenv.SystemClock, logf: logf, maxWait: maxWait}
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var waited time.Duration
+	for {
+		if err := t.waitForPause(req.Context()); err != nil {
+			return nil, err
+		}
+		resp, err := t.inner.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		delay, limited := rateLimitDelay(resp, t.clock.Now())
+		if !limited || waited+delay > t.maxWait || !rewindable(req) {
+			return resp, nil
+		}
+		// drain, so the connection can be reused
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		_ = resp.Body.Close()
+		t.logf("registry responded with %v to %v %v, pausing requests for %v\n", resp.Status, req.Method, req.URL.Path, delay)
+		t.pause(delay)
+		waited += delay
+		if req, err = rewind(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (t *rateLimitTransport) pause(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until := t.clock.Now().Add(d); until.After(t.pausedUntil) {
+		t.pausedUntil = until
+	}
+}
+
+func (t *rateLimitTransport) waitForPause(ctx context.Context) error {
+	t.mu.Lock()
+	d := t.pausedUntil.Sub(t.clock.Now())
+	t.mu.Unlock()
+	return sysenv.Sleep(ctx, t.clock, d)
+}
+
+// rateLimitDelay reports whether response asks to slow down, and for how long.
+func rateLimitDelay(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok {
+		// 503 without Retry-After is a plain server error, left to the regular retries
+		return defaultRateLimitDelay, resp.StatusCode == http.StatusTooManyRequests
+	}
+	return delay, true
+}
+
+// parseRetryAfter parses value of Retry-After header, which is either number of seconds or HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+func rewindable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// rewind returns request which can be sent again, with a fresh body.
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	res := req.Clone(req.Context())
+	res.Body = body
+	return res, nil
+}
@@ -0,0 +1,121 @@
+package transporter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	d, ok := parseRetryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, d)
+
+	d, ok = parseRetryAfter(now.Add(30*time.Second).Format(http.TimeFormat), now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, d)
+
+	_, ok = parseRetryAfter("soon", now)
+	assert.False(t, ok)
+	_, ok = parseRetryAfter("", now)
+	assert.False(t, ok)
+}
+
+// recordingClock does not wait, it only records requested delays.
+type recordingClock struct {
+	now    time.Time
+	delays []time.Duration
+}
+
+func (c *recordingClock) Now() time.Time {
+	return c.now
+}
+
+func (c *recordingClock) After(d time.Duration) <-chan time.Time {
+	c.delays = append(c.delays, d)
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	var calls atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 3:
+			// plain server error is not rate limiting
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer s.Close()
+
+	clock := &recordingClock{now: time.Now()}
+	rt := newRateLimitTransport(http.DefaultTransport, time.Minute, t.Logf)
+	rt.clock = clock
+	client := &http.Client{Transport: rt}
+
+	resp, err := client.Get(s.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, []time.Duration{3 * time.Second, time.Second}, clock.delays)
+
+	t.Run("gives up after max wait", func(t *testing.T) {
+		calls.Store(0)
+		clock.delays = nil
+		rt.maxWait = 2 * time.Second
+		resp, err := client.Get(s.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.Empty(t, clock.delays)
+	})
+}
+
+func TestPull_rateLimitedBlobs(t *testing.T) {
+	registry := prepareRegistry()
+	var limited atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") && limited.Add(1) <= 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		registry.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	tempDir, opts := optionsForTesting(t)
+	ref := refOnServer(s.URL, "test-vm:limited")
+	d := filepath.Join(tempDir, "images", portableRef(ref))
+	require.NoError(t, os.MkdirAll(d, os.ModePerm))
+	makeFileAt(t, filepath.Join(d, "disk.img"), "some disk content")
+	makeFileAt(t, filepath.Join(d, "config.json"), `{"disk_size": 17}`)
+	shaBefore := hashFromFile(t, filepath.Join(d, "disk.img"))
+
+	require.NoError(t, Push(ref, opts...))
+	deleteTestVMAt(t, tempDir, ref)
+	limited.Store(0)
+
+	require.NoError(t, Pull(ref, opts...))
+	assert.Equal(t, shaBefore, hashFromFile(t, filepath.Join(d, "disk.img")))
+	assert.Greater(t, limited.Load(), int32(3))
+}
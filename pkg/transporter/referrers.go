@@ -0,0 +1,128 @@
+package transporter
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"os"
+	"path/filepath"
+)
+
+// defaultArtifactFileMediaType is media type of attached files without one.
+const defaultArtifactFileMediaType = "application/octet-stream"
+
+// ArtifactFile is a file attached to an image as layer of an artifact.
+type ArtifactFile struct {
+	Path string
+	// MediaType of the layer, application/octet-stream when empty
+	MediaType string
+}
+
+// subjectOf returns descriptor of the manifest src refers to, which artifacts are attached to.
+func subjectOf(src string, opts *options) (name.Digest, v1.Descriptor, error) {
+	ref, err := name.ParseReference(src, opts.refValidation)
+	if err != nil {
+		return name.Digest{}, v1.Descriptor{}, fmt.Errorf("unable to parse reference '%v': %w", src, err)
+	}
+	desc, err := remote.Head(ref, opts.remoteOptions...)
+	if err != nil {
+		return name.Digest{}, v1.Descriptor{}, fmt.Errorf("unable to fetch %v: %w", ref, err)
+	}
+	subject := v1.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: desc.Size}
+	return ref.Context().Digest(desc.Digest.String()), subject, nil
+}
+
+// fileAddenda returns layers of artifact holding files, titled with their names.
+func fileAddenda(files []ArtifactFile) ([]mutate.Addendum, error) {
+	res := make([]mutate.Addendum, 0, len(files))
+	for _, f := range files {
+		content, err := os.ReadFile(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		mediaType := f.MediaType
+		if mediaType == "" {
+			mediaType = defaultArtifactFileMediaType
+		}
+		res = append(res, mutate.Addendum{
+			Layer:       static.NewLayer(content, types.MediaType(mediaType)),
+			Annotations: map[string]string{"org.opencontainers.image.title": filepath.Base(f.Path)},
+		})
+	}
+	return res, nil
+}
+
+// newArtifact returns artifact image of artifactType with layers, referring to subject.
+func newArtifact(subject v1.Descriptor, artifactType string, layers []mutate.Addendum, annotations map[string]string) (v1.Image, error) {
+	img := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	// the config media type is the artifact type for registries and clients predating the artifactType field
+	img = mutate.ConfigMediaType(img, types.MediaType(artifactType))
+	img, err := mutate.Append(img, layers...)
+	if err != nil {
+		return nil, err
+	}
+	if len(annotations) > 0 {
+		img = mutate.Annotations(img, annotations).(v1.Image)
+	}
+	return mutate.Subject(img, subject).(v1.Image), nil
+}
+
+// pushArtifact pushes artifact of artifactType with layers, referring to subject in the repository of subjectRef,
+// and returns its digest.
+func pushArtifact(subjectRef name.Digest, subject v1.Descriptor, artifactType string, layers []mutate.Addendum, annotations map[string]string, opts *options) (v1.Hash, error) {
+	artifact, err := newArtifact(subject, artifactType, layers, annotations)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("unable to create artifact: %w", err)
+	}
+	digest, err := artifact.Digest()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	if err := remote.Write(subjectRef.Context().Digest(digest.String()), artifact, opts.remoteOptions...); err != nil {
+		return v1.Hash{}, fmt.Errorf("unable to push artifact: %w", err)
+	}
+	return digest, nil
+}
+
+// Attach pushes artifact of artifactType with files, e.g. signature or SBOM, referring to image src, and returns
+// digest of the artifact. Registries without the OCI 1.1 referrers API list it in the index tagged with
+// digest of src, like sha256-<hex>, which is updated on every attach.
+func Attach(src string, artifactType string, files []ArtifactFile, annotations map[string]string, opt ...Option) (v1.Hash, error) {
+	opts := makeOptions(opt...)
+	subjectRef, subject, err := subjectOf(src, opts)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	layers, err := fileAddenda(files)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("unable to create artifact: %w", err)
+	}
+	return pushArtifact(subjectRef, subject, artifactType, layers, annotations, opts)
+}
+
+// ListReferrers returns descriptors of artifacts referring to image src, only of artifactType unless it is empty.
+func ListReferrers(src string, artifactType string, opt ...Option) ([]v1.Descriptor, error) {
+	opts := makeOptions(opt...)
+	subjectRef, _, err := subjectOf(src, opts)
+	if err != nil {
+		return nil, err
+	}
+	remoteOpts := opts.remoteOptions
+	if artifactType != "" {
+		remoteOpts = append(remoteOpts, remote.WithFilter("artifactType", artifactType))
+	}
+	idx, err := remote.Referrers(subjectRef, remoteOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list referrers of %v: %w", subjectRef, err)
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Manifests, nil
+}
@@ -0,0 +1,228 @@
+package transporter
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/macvmio/geranos/pkg/provenance"
+	"github.com/macvmio/geranos/pkg/signing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttach(t *testing.T) {
+	for _, referrersAPI := range []bool{true, false} {
+		t.Run(fmt.Sprintf("referrersAPI=%v", referrersAPI), func(t *testing.T) {
+			s := httptest.NewServer(registry.New(registry.WithReferrersSupport(referrersAPI)))
+			defer s.Close()
+
+			tempDir, opts := optionsForTesting(t)
+			ref := refOnServer(s.URL, "test-vm:attach")
+			makeTestVMAt(t, tempDir, ref)
+			require.NoError(t, Push(ref, opts...))
+
+			sbom := filepath.Join(tempDir, "sbom.json")
+			makeFileAt(t, sbom, `{"spdxVersion": "SPDX-2.3"}`)
+			sbomDigest, err := Attach(ref, "application/spdx+json", []ArtifactFile{{Path: sbom, MediaType: "application/spdx+json"}},
+				map[string]string{"org.example.tool": "test"}, opts...)
+			require.NoError(t, err)
+			notes := filepath.Join(tempDir, "notes.txt")
+			makeFileAt(t, notes, "release notes")
+			_, err = Attach(ref, "text/plain", []ArtifactFile{{Path: notes}}, nil, opts...)
+			require.NoError(t, err)
+
+			referrers, err := ListReferrers(ref, "", opts...)
+			require.NoError(t, err)
+			assert.Len(t, referrers, 2)
+
+			referrers, err = ListReferrers(ref, "application/spdx+json", opts...)
+			require.NoError(t, err)
+			require.Len(t, referrers, 1)
+			assert.Equal(t, sbomDigest, referrers[0].Digest)
+			assert.Equal(t, "application/spdx+json", referrers[0].ArtifactType)
+		})
+	}
+}
+
+func TestPush_sign(t *testing.T) {
+	s := httptest.NewServer(registry.New(registry.WithReferrersSupport(true)))
+	defer s.Close()
+
+	tempDir, opts := optionsForTesting(t)
+	ref := refOnServer(s.URL, "test-vm:signed")
+	makeTestVMAt(t, tempDir, ref)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	require.NoError(t, Push(ref, append(opts, WithSigning(signing.Config{Key: key}))...))
+
+	signatures, err := ListReferrers(ref, signing.ArtifactType, opts...)
+	require.NoError(t, err)
+	require.Len(t, signatures, 1)
+
+	parsed, err := name.ParseReference(ref)
+	require.NoError(t, err)
+	desc, err := remote.Head(parsed)
+	require.NoError(t, err)
+	artifact, err := remote.Image(parsed.Context().Digest(signatures[0].Digest.String()))
+	require.NoError(t, err)
+	manifest, err := artifact.Manifest()
+	require.NoError(t, err)
+	require.Len(t, manifest.Layers, 1)
+	assert.Equal(t, signing.PayloadMediaType, string(manifest.Layers[0].MediaType))
+	layers, err := artifact.Layers()
+	require.NoError(t, err)
+	rc, err := layers[0].Uncompressed()
+	require.NoError(t, err)
+	defer rc.Close()
+	payload, err := io.ReadAll(rc)
+	require.NoError(t, err)
+
+	var p signing.Payload
+	require.NoError(t, json.Unmarshal(payload, &p))
+	assert.Equal(t, parsed.Context().Name(), p.Critical.Identity.DockerReference)
+	assert.Equal(t, desc.Digest.String(), p.Critical.Image.DockerManifestDigest)
+	sig, err := base64.StdEncoding.DecodeString(manifest.Layers[0].Annotations[signing.SignatureAnnotation])
+	require.NoError(t, err)
+	digest := sha256.Sum256(payload)
+	assert.True(t, ecdsa.VerifyASN1(&key.PublicKey, digest[:], sig))
+
+	// cosign verify without --experimental-oci11 looks for signatures in the image tagged sha256-<hex>.sig
+	tagged, err := remote.Image(parsed.Context().Tag(strings.Replace(desc.Digest.String(), ":", "-", 1) + ".sig"))
+	require.NoError(t, err)
+	taggedManifest, err := tagged.Manifest()
+	require.NoError(t, err)
+	require.Len(t, taggedManifest.Layers, 1)
+	assert.Equal(t, manifest.Layers[0].Digest, taggedManifest.Layers[0].Digest)
+	assert.Equal(t, manifest.Layers[0].Annotations, taggedManifest.Layers[0].Annotations)
+}
+
+func TestPull_verifySignature(t *testing.T) {
+	s := httptest.NewServer(registry.New(registry.WithReferrersSupport(true)))
+	defer s.Close()
+
+	tempDir, opts := optionsForTesting(t)
+	signed := refOnServer(s.URL, "test-vm:signed")
+	unsigned := refOnServer(s.URL, "other-vm:unsigned")
+	sha := makeTestVMAt(t, tempDir, signed)
+	makeTestVMAt(t, tempDir, unsigned)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	require.NoError(t, Push(signed, append(opts, WithSigning(signing.Config{Key: key}))...))
+	require.NoError(t, Push(unsigned, opts...))
+
+	writePolicy := func(key *ecdsa.PrivateKey) *signing.Policy {
+		pub, err := signing.MarshalPublicKey(key.Public())
+		require.NoError(t, err)
+		makeFileAt(t, filepath.Join(tempDir, "cosign.pub"), string(pub))
+		makeFileAt(t, filepath.Join(tempDir, "policy.json"), `{"repositories": [{"repository": "*/*", "keys": ["cosign.pub"]}]}`)
+		policy, err := signing.LoadPolicy(filepath.Join(tempDir, "policy.json"))
+		require.NoError(t, err)
+		return policy
+	}
+	imagesPath := filepath.Join(tempDir, "pulled")
+	pullOpts := append(opts, WithImagesPath(imagesPath), WithSignaturePolicy(writePolicy(key)))
+
+	require.NoError(t, Pull(signed, pullOpts...))
+	assert.Equal(t, sha, hashFromFile(t, filepath.Join(imagesPath, portableRef(signed), "disk.img")))
+
+	err = Pull(unsigned, pullOpts...)
+	assert.ErrorContains(t, err, "is not signed")
+	assert.NoDirExists(t, filepath.Join(imagesPath, portableRef(unsigned)))
+
+	t.Run("signed by cosign", func(t *testing.T) {
+		// cosign sign keeps signatures only in the image tagged sha256-<hex>.sig, with payload written by it
+		parsed, err := name.ParseReference(unsigned)
+		require.NoError(t, err)
+		desc, err := remote.Head(parsed)
+		require.NoError(t, err)
+		payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"%v"},"image":{"docker-manifest-digest":"%v"},`+
+			`"type":"cosign container image signature"},"optional":null}`, parsed.Context().Name(), desc.Digest))
+		digest := sha256.Sum256(payload)
+		sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+		require.NoError(t, err)
+		img, err := mutate.Append(empty.Image, mutate.Addendum{
+			Layer:       static.NewLayer(payload, "application/vnd.dev.cosign.simplesigning.v1+json"),
+			Annotations: map[string]string{"dev.cosignproject.cosign/signature": base64.StdEncoding.EncodeToString(sig)},
+		})
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(parsed.Context().Tag(strings.Replace(desc.Digest.String(), ":", "-", 1)+".sig"), img))
+
+		require.NoError(t, Pull(unsigned, pullOpts...))
+		assert.DirExists(t, filepath.Join(imagesPath, portableRef(unsigned)))
+	})
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherPath := filepath.Join(tempDir, "other")
+	err = Pull(signed, append(opts, WithImagesPath(otherPath), WithSignaturePolicy(writePolicy(otherKey)))...)
+	assert.ErrorContains(t, err, "signed with untrusted key")
+	assert.NoDirExists(t, filepath.Join(otherPath, portableRef(signed)))
+}
+
+func TestPush_provenance(t *testing.T) {
+	s := httptest.NewServer(registry.New(registry.WithReferrersSupport(true)))
+	defer s.Close()
+
+	tempDir, opts := optionsForTesting(t)
+	ref := refOnServer(s.URL, "test-vm:attested")
+	makeTestVMAt(t, tempDir, ref)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	build := provenance.Build{BuilderID: "https://ci.example.com/build", Parameters: map[string]any{"compression": "zstd"}}
+	require.NoError(t, Push(ref, append(opts, WithSigning(signing.Config{Key: key}), WithProvenance(build))...))
+
+	attestations, err := ListReferrers(ref, signing.EnvelopeMediaType, opts...)
+	require.NoError(t, err)
+	require.Len(t, attestations, 1)
+	parsed, err := name.ParseReference(ref)
+	require.NoError(t, err)
+	desc, err := remote.Head(parsed)
+	require.NoError(t, err)
+	artifact, err := remote.Image(parsed.Context().Digest(attestations[0].Digest.String()))
+	require.NoError(t, err)
+	manifest, err := artifact.Manifest()
+	require.NoError(t, err)
+	require.Len(t, manifest.Layers, 1)
+	assert.Equal(t, provenance.PredicateType, manifest.Layers[0].Annotations[provenance.PredicateTypeAnnotation])
+	content, err := readBlob(artifact, manifest.Layers[0].Digest)
+	require.NoError(t, err)
+
+	var env signing.Envelope
+	require.NoError(t, json.Unmarshal(content, &env))
+	assert.Equal(t, provenance.MediaType, env.PayloadType)
+	payload, err := signing.VerifyEnvelope(&env, key.Public())
+	require.NoError(t, err)
+	var statement provenance.Statement
+	require.NoError(t, json.Unmarshal(payload, &statement))
+	require.Len(t, statement.Subject, 1)
+	assert.Equal(t, desc.Digest.Hex, statement.Subject[0].Digest["sha256"])
+	assert.Equal(t, "https://ci.example.com/build", statement.Predicate.RunDetails.Builder.ID)
+	assert.Equal(t, map[string]any{"compression": "zstd"}, statement.Predicate.BuildDefinition.ExternalParameters)
+	require.Len(t, statement.Predicate.BuildDefinition.ResolvedDependencies, 1)
+	assert.Equal(t, "file://"+filepath.Join(tempDir, "images", portableRef(ref)), statement.Predicate.BuildDefinition.ResolvedDependencies[0].URI)
+	assert.NotNil(t, statement.Predicate.RunDetails.Metadata.StartedOn)
+
+	// without signing the statement is attached as it is
+	unsigned := refOnServer(s.URL, "test-vm:unsigned")
+	makeTestVMAt(t, tempDir, unsigned)
+	require.NoError(t, Push(unsigned, append(opts, WithProvenance(build))...))
+	attestations, err = ListReferrers(unsigned, provenance.MediaType, opts...)
+	require.NoError(t, err)
+	assert.Len(t, attestations, 1)
+}
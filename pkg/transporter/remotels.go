@@ -0,0 +1,107 @@
+package transporter
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/macvmio/geranos/pkg/semver"
+	"regexp"
+	"sort"
+)
+
+// NameFilter selects tags, or repositories, listed remotely. Empty filter selects everything.
+type NameFilter struct {
+	// Regexp selects names it matches
+	Regexp string
+	// Semver selects names which are semantic versions satisfying the constraint, e.g. ">=14, <15",
+	// and sorts them by version
+	Semver string
+}
+
+type nameMatcher struct {
+	re         *regexp.Regexp
+	constraint semver.Constraint
+}
+
+func (f NameFilter) compile() (*nameMatcher, error) {
+	m := &nameMatcher{}
+	if f.Regexp != "" {
+		re, err := regexp.Compile(f.Regexp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp filter: %w", err)
+		}
+		m.re = re
+	}
+	if f.Semver != "" {
+		c, err := semver.ParseConstraint(f.Semver)
+		if err != nil {
+			return nil, fmt.Errorf("invalid semver filter: %w", err)
+		}
+		m.constraint = c
+	}
+	return m, nil
+}
+
+// apply returns names matching m, sorted by name, or by version for semver filter.
+func (m *nameMatcher) apply(names []string) []string {
+	res := make([]string, 0, len(names))
+	versions := make(map[string]semver.Version)
+	for _, n := range names {
+		if m.re != nil && !m.re.MatchString(n) {
+			continue
+		}
+		if m.constraint != nil {
+			v, err := semver.Parse(n)
+			if err != nil || !m.constraint.Check(v) {
+				continue
+			}
+			versions[n] = v
+		}
+		res = append(res, n)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if m.constraint != nil {
+			if c := versions[res[i]].Compare(versions[res[j]]); c != 0 {
+				return c < 0
+			}
+		}
+		return res[i] < res[j]
+	})
+	return res
+}
+
+// ListRemoteTags returns tags of remote repository repo selected by filter.
+func ListRemoteTags(repo string, filter NameFilter, opt ...Option) ([]string, error) {
+	opts := makeOptions(opt...)
+	m, err := filter.compile()
+	if err != nil {
+		return nil, err
+	}
+	r, err := name.NewRepository(repo, opts.refValidation)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse repository '%v': %w", repo, err)
+	}
+	tags, err := remote.List(r, opts.remoteOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tags of %v: %w", r, err)
+	}
+	return m.apply(tags), nil
+}
+
+// ListRemoteRepos returns repositories of registry selected by filter, for registries supporting catalog API.
+func ListRemoteRepos(registry string, filter NameFilter, opt ...Option) ([]string, error) {
+	opts := makeOptions(opt...)
+	m, err := filter.compile()
+	if err != nil {
+		return nil, err
+	}
+	reg, err := name.NewRegistry(registry, opts.refValidation)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse registry '%v': %w", registry, err)
+	}
+	repos, err := remote.Catalog(opts.ctx, reg, opts.remoteOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list repositories of %v: %w", reg, err)
+	}
+	return m.apply(repos), nil
+}
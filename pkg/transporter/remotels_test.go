@@ -0,0 +1,42 @@
+package transporter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestListRemoteTags(t *testing.T) {
+	s := httptest.NewServer(prepareRegistry())
+	defer s.Close()
+	tempDir, opts := optionsForTesting(t)
+	defer os.RemoveAll(tempDir)
+
+	repo := refOnServer(s.URL, "vms/macos")
+	for _, tag := range []string{"latest", "v14.10", "v14.2", "v15.0-beta", "v15.0"} {
+		makeTestVMAt(t, tempDir, repo+":"+tag)
+		require.NoError(t, Push(repo+":"+tag, opts...))
+	}
+
+	tags, err := ListRemoteTags(repo, NameFilter{}, opts...)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"latest", "v14.10", "v14.2", "v15.0", "v15.0-beta"}, tags)
+
+	tags, err = ListRemoteTags(repo, NameFilter{Semver: ">=14.2"}, opts...)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v14.2", "v14.10", "v15.0-beta", "v15.0"}, tags)
+
+	tags, err = ListRemoteTags(repo, NameFilter{Semver: "<15", Regexp: `\.10$`}, opts...)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v14.10"}, tags)
+
+	_, err = ListRemoteTags(repo, NameFilter{Regexp: "("}, opts...)
+	assert.Error(t, err)
+
+	repos, err := ListRemoteRepos(strings.TrimPrefix(s.URL, "http://"), NameFilter{Regexp: "^vms/"}, opts...)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vms/macos"}, repos)
+}
@@ -0,0 +1,31 @@
+package transporter
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// RemoveRemotely deletes ref from its registry with the manifest DELETE API and returns digest of the
+// manifest ref pointed at. A tag is deleted alone, unless byDigest is set: then the manifest it points at is
+// deleted, together with every other tag of it. Not all registries support deleting tags, or deleting at all.
+func RemoveRemotely(src string, byDigest bool, opt ...Option) (v1.Hash, error) {
+	opts := makeOptions(opt...)
+	ref, err := name.ParseReference(src, opts.refValidation)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("unable to parse reference '%v': %w", src, err)
+	}
+	desc, err := remote.Head(ref, opts.remoteOptions...)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("unable to fetch %v: %w", ref, err)
+	}
+	target := ref
+	if byDigest {
+		target = ref.Context().Digest(desc.Digest.String())
+	}
+	if err := remote.Delete(target, opts.remoteOptions...); err != nil {
+		return v1.Hash{}, fmt.Errorf("unable to delete %v: %w", target, err)
+	}
+	return desc.Digest, nil
+}
@@ -0,0 +1,38 @@
+package transporter
+
+import (
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestRemoveRemotely(t *testing.T) {
+	s := httptest.NewServer(prepareRegistry())
+	defer s.Close()
+	tempDir, opts := optionsForTesting(t)
+	defer os.RemoveAll(tempDir)
+
+	ref := refOnServer(s.URL, "vms/a:v1")
+	makeTestVMAt(t, tempDir, ref)
+	require.NoError(t, Push(ref, opts...))
+
+	digest, err := RemoveRemotely(ref, true, opts...)
+	require.NoError(t, err)
+	byDigest, err := name.NewDigest(refOnServer(s.URL, "vms/a@"+digest.String()))
+	require.NoError(t, err)
+	_, err = remote.Head(byDigest)
+	assert.Error(t, err, "manifest is deleted")
+
+	_, err = RemoveRemotely(ref, false, opts...)
+	require.NoError(t, err)
+	tags, err := ListRemoteTags(refOnServer(s.URL, "vms/a"), NameFilter{}, opts...)
+	require.NoError(t, err)
+	assert.Empty(t, tags)
+
+	_, err = RemoveRemotely(ref, false, opts...)
+	assert.Error(t, err, "tag does not exist anymore")
+}
@@ -0,0 +1,22 @@
+package transporter
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/layout"
+)
+
+func Repair(src string, opt ...Option) (*dirimage.RepairResult, error) {
+	opts := makeOptions(opt...)
+	ref, err := name.ParseReference(src, name.StrictValidation)
+	if err != nil {
+		return nil, fmt.Errorf("parse ref %s: %v", src, err)
+	}
+	img, err := remoteImage(ref, opts)
+	if err != nil {
+		return nil, err
+	}
+	lm := layout.NewMapper(opts.imagesPath, opts.dirimageOptions...)
+	return lm.Repair(opts.ctx, img, ref)
+}
@@ -0,0 +1,248 @@
+package transporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// resumableImage makes downloads of its layers continue where they stopped when the connection breaks,
+// instead of starting the segment from the beginning.
+type resumableImage struct {
+	v1.Image
+	fetcher *blobFetcher
+}
+
+func newResumableImage(img v1.Image, repo name.Repository, opts *options) *resumableImage {
+	return &resumableImage{
+		Image:   img,
+		fetcher: newBlobFetcher(repo, opts),
+	}
+}
+
+func (ri *resumableImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := ri.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	return partial.CompressedToLayer(&resumableLayer{Layer: l, fetcher: ri.fetcher})
+}
+
+type resumableLayer struct {
+	v1.Layer
+	fetcher *blobFetcher
+}
+
+func (rl *resumableLayer) Compressed() (io.ReadCloser, error) {
+	digest, err := rl.Digest()
+	if err != nil {
+		return nil, err
+	}
+	rc, err := rl.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	hasher, err := v1.Hasher(digest.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &resumableReader{fetcher: rl.fetcher, digest: digest, rc: rc, hash: hasher}, nil
+}
+
+// blobFetcher talks directly to the blob endpoint of the registry, for requests go-containerregistry does not offer.
+type blobFetcher struct {
+	ctx        context.Context
+	repo       name.Repository
+	inner      http.RoundTripper
+	maxResumes int
+	logf       func(format string, args ...any)
+	// scope is requested when authenticating, pull unless set otherwise
+	scope string
+
+	once   sync.Once
+	client *http.Client
+	err    error
+}
+
+func newBlobFetcher(repo name.Repository, opts *options) *blobFetcher {
+	return &blobFetcher{
+		ctx:        opts.ctx,
+		repo:       repo,
+		inner:      opts.transport,
+		maxResumes: opts.maxRangeResumes,
+		logf:       opts.logf,
+	}
+}
+
+// httpClient authenticates with the registry on first use, so nothing is requested unless needed.
+func (bf *blobFetcher) httpClient() (*http.Client, error) {
+	bf.once.Do(func() {
+		auth, err := authn.DefaultKeychain.Resolve(bf.repo)
+		if err != nil {
+			bf.err = fmt.Errorf("unable to resolve credentials: %w", err)
+			return
+		}
+		scope := bf.scope
+		if scope == "" {
+			scope = transport.PullScope
+		}
+		rt, err := transport.NewWithContext(bf.ctx, bf.repo.Registry, auth, bf.inner, []string{bf.repo.Scope(scope)})
+		if err != nil {
+			bf.err = err
+			return
+		}
+		bf.client = &http.Client{Transport: rt}
+	})
+	return bf.client, bf.err
+}
+
+func (bf *blobFetcher) blobURL(h v1.Hash) string {
+	u := url.URL{
+		Scheme: bf.repo.Registry.Scheme(),
+		Host:   bf.repo.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/blobs/%s", bf.repo.RepositoryStr(), h),
+	}
+	return u.String()
+}
+
+// exists reports whether the repository has blob h.
+func (bf *blobFetcher) exists(h v1.Hash) (bool, error) {
+	client, err := bf.httpClient()
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(bf.ctx, http.MethodHead, bf.blobURL(h), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// fetchFrom returns content of blob h starting at offset. Registries which ignore the Range header
+// send the whole blob, in which case the bytes already received are skipped.
+func (bf *blobFetcher) fetchFrom(h v1.Hash, offset int64) (io.ReadCloser, error) {
+	client, err := bf.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(bf.ctx, http.MethodGet, bf.blobURL(h), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := transport.CheckError(resp, http.StatusOK, http.StatusPartialContent); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		if contentRange := resp.Header.Get("Content-Range"); !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-", offset)) {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected content range '%v', requested bytes from %d", contentRange, offset)
+		}
+		return resp.Body, nil
+	}
+	if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unable to skip %d bytes already received: %w", offset, err)
+	}
+	return resp.Body, nil
+}
+
+// resumableReader reads compressed blob, requesting the rest of it again when reading fails with
+// a transient error. As the bytes may come from several responses, it verifies the digest itself.
+type resumableReader struct {
+	fetcher *blobFetcher
+	digest  v1.Hash
+	offset  int64
+	resumes int
+	hash    hash.Hash
+
+	mu     sync.Mutex
+	rc     io.ReadCloser
+	closed bool
+}
+
+func (rr *resumableReader) Read(p []byte) (int, error) {
+	for {
+		rr.mu.Lock()
+		rc := rr.rc
+		rr.mu.Unlock()
+		n, err := rc.Read(p)
+		rr.offset += int64(n)
+		rr.hash.Write(p[:n])
+		switch {
+		case err == nil:
+			return n, nil
+		case errors.Is(err, io.EOF):
+			return n, rr.verify()
+		case !rr.resume(err):
+			return n, err
+		case n > 0:
+			return n, nil
+		}
+	}
+}
+
+func (rr *resumableReader) verify() error {
+	if got := fmt.Sprintf("%x", rr.hash.Sum(nil)); got != rr.digest.Hex {
+		return fmt.Errorf("error verifying %v checksum after reading %d bytes; got %q, want %q", rr.digest.Algorithm, rr.offset, got, rr.digest.Hex)
+	}
+	return io.EOF
+}
+
+// resume replaces the failed response with one continuing at current offset, and reports whether it succeeded.
+func (rr *resumableReader) resume(cause error) bool {
+	if rr.resumes >= rr.fetcher.maxResumes || !dirimage.IsRetryableError(cause) || rr.fetcher.ctx.Err() != nil {
+		return false
+	}
+	rr.resumes++
+	rr.fetcher.logf("download of %v interrupted after %d bytes: %v, resuming\n", rr.digest, rr.offset, cause)
+	rc, err := rr.fetcher.fetchFrom(rr.digest, rr.offset)
+	if err != nil {
+		rr.fetcher.logf("unable to resume download of %v: %v\n", rr.digest, err)
+		return false
+	}
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if rr.closed {
+		rc.Close()
+		return false
+	}
+	_ = rr.rc.Close()
+	rr.rc = rc
+	return true
+}
+
+func (rr *resumableReader) Close() error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.closed = true
+	return rr.rc.Close()
+}
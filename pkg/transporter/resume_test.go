@@ -0,0 +1,178 @@
+package transporter
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// interruptingRegistry breaks the first download of every large blob halfway through.
+// Range requests are served only when supportsRange is set.
+type interruptingRegistry struct {
+	registry      http.Handler
+	supportsRange bool
+
+	mu            sync.Mutex
+	interrupted   map[string]bool
+	rangeRequests int
+}
+
+func (ir *interruptingRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || !strings.Contains(r.URL.Path, "/blobs/") {
+		ir.registry.ServeHTTP(w, r)
+		return
+	}
+	// the whole blob is fetched, whether registry supports ranges or not
+	whole := r.Clone(r.Context())
+	whole.Header.Del("Range")
+	rec := httptest.NewRecorder()
+	ir.registry.ServeHTTP(rec, whole)
+	body := rec.Body.Bytes()
+	if rec.Code != http.StatusOK || len(body) < 1024 {
+		ir.registry.ServeHTTP(w, r)
+		return
+	}
+	ir.mu.Lock()
+	first := !ir.interrupted[r.URL.Path]
+	ir.interrupted[r.URL.Path] = true
+	if r.Header.Get("Range") != "" {
+		ir.rangeRequests++
+	}
+	ir.mu.Unlock()
+	switch {
+	case first:
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body[:len(body)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	case ir.supportsRange:
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	default:
+		_, _ = w.Write(body)
+	}
+}
+
+func TestPull_resumesInterruptedDownloads(t *testing.T) {
+	for _, supportsRange := range []bool{true, false} {
+		t.Run(fmt.Sprintf("supportsRange=%v", supportsRange), func(t *testing.T) {
+			ir := &interruptingRegistry{registry: prepareRegistry(), supportsRange: supportsRange, interrupted: map[string]bool{}}
+			s := httptest.NewServer(ir)
+			defer s.Close()
+
+			tempDir, opts := optionsForTesting(t)
+			ref := refOnServer(s.URL, "test-vm:resume")
+			d := filepath.Join(tempDir, "images", portableRef(ref))
+			require.NoError(t, os.MkdirAll(d, os.ModePerm))
+			content := make([]byte, 256*1024)
+			_, err := rand.Read(content)
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(filepath.Join(d, "disk.img"), content, 0o644))
+			makeFileAt(t, filepath.Join(d, "config.json"), `{"disk_size": 262144}`)
+
+			require.NoError(t, Push(ref, opts...))
+			deleteTestVMAt(t, tempDir, ref)
+
+			// without retries of whole segments, only resuming can complete the pull
+			require.NoError(t, Pull(ref, append(opts, WithRetryPolicy(dirimage.RetryPolicy{MaxAttempts: 1}))...))
+			written, err := os.ReadFile(filepath.Join(d, "disk.img"))
+			require.NoError(t, err)
+			assert.Equal(t, content, written)
+			assert.Greater(t, ir.rangeRequests, 0)
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		ir := &interruptingRegistry{registry: prepareRegistry(), supportsRange: true, interrupted: map[string]bool{}}
+		s := httptest.NewServer(ir)
+		defer s.Close()
+
+		tempDir, opts := optionsForTesting(t)
+		ref := refOnServer(s.URL, "test-vm:resume")
+		d := filepath.Join(tempDir, "images", portableRef(ref))
+		require.NoError(t, os.MkdirAll(d, os.ModePerm))
+		content := make([]byte, 256*1024)
+		_, err := rand.Read(content)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(d, "disk.img"), content, 0o644))
+
+		require.NoError(t, Push(ref, opts...))
+		deleteTestVMAt(t, tempDir, ref)
+
+		err = Pull(ref, append(opts, WithRangeResume(0), WithRetryPolicy(dirimage.RetryPolicy{MaxAttempts: 1}))...)
+		assert.Error(t, err)
+		assert.Zero(t, ir.rangeRequests)
+	})
+}
+
+// interruptingUploads breaks the first upload of a chunk which does not start the blob.
+type interruptingUploads struct {
+	registry http.Handler
+
+	mu          sync.Mutex
+	interrupted bool
+	ranges      []string
+}
+
+func (iu *interruptingUploads) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPatch {
+		iu.mu.Lock()
+		contentRange := r.Header.Get("Content-Range")
+		iu.ranges = append(iu.ranges, contentRange)
+		interrupt := !iu.interrupted && contentRange != "" && !strings.HasPrefix(contentRange, "0-")
+		iu.interrupted = iu.interrupted || interrupt
+		iu.mu.Unlock()
+		if interrupt {
+			panic(http.ErrAbortHandler)
+		}
+	}
+	iu.registry.ServeHTTP(w, r)
+}
+
+func TestPush_resumesInterruptedUploads(t *testing.T) {
+	iu := &interruptingUploads{registry: prepareRegistry()}
+	s := httptest.NewServer(iu)
+	defer s.Close()
+
+	tempDir, opts := optionsForTesting(t)
+	opts = append(opts, WithUploadChunkSize(64*1024))
+	ref := refOnServer(s.URL, "test-vm:resume")
+	d := filepath.Join(tempDir, "images", portableRef(ref))
+	require.NoError(t, os.MkdirAll(d, os.ModePerm))
+	content := make([]byte, 256*1024)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(d, "disk.img"), content, 0o644))
+
+	require.Error(t, Push(ref, opts...))
+	sessions, err := os.ReadDir(filepath.Join(tempDir, "cache", "upload-sessions"))
+	require.NoError(t, err)
+	assert.Len(t, sessions, 1)
+
+	iu.ranges = iu.ranges[:0]
+	require.NoError(t, Push(ref, opts...))
+	require.NotEmpty(t, iu.ranges)
+	assert.Equal(t, "65536-131071", iu.ranges[0], "upload continues after the committed chunk")
+	sessions, err = os.ReadDir(filepath.Join(tempDir, "cache", "upload-sessions"))
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+
+	deleteTestVMAt(t, tempDir, ref)
+	require.NoError(t, Pull(ref, opts...))
+	written, err := os.ReadFile(filepath.Join(d, "disk.img"))
+	require.NoError(t, err)
+	assert.Equal(t, content, written)
+}
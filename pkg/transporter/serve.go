@@ -0,0 +1,125 @@
+package transporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/distribution"
+	"github.com/macvmio/geranos/pkg/layout"
+	"os"
+	"slices"
+	"strings"
+)
+
+// localStore serves images of the images directory, and writes pushed ones to it.
+type localStore struct {
+	// namespace is prepended to requested repositories, to get local ones
+	namespace string
+	lm        *layout.Mapper
+	opts      *options
+	locks     refLocks
+}
+
+func newLocalStore(namespace string, opt ...Option) *localStore {
+	opts := makeOptions(opt...)
+	return &localStore{
+		namespace: strings.TrimSuffix(namespace, "/"),
+		lm:        newServingMapper(opts),
+		opts:      opts,
+	}
+}
+
+func (ls *localStore) repository(repo string) string {
+	if ls.namespace == "" {
+		return repo
+	}
+	return ls.namespace + "/" + repo
+}
+
+func (ls *localStore) Image(ctx context.Context, repo string, reference string) (v1.Image, error) {
+	ref, err := parseRepoReference(ls.repository(repo), reference, ls.opts)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, distribution.ErrNotFound)
+	}
+	switch r := ref.(type) {
+	case name.Digest:
+		if _, err := ls.lm.Resolve(r); errors.Is(err, layout.ErrImageNotFound) {
+			return nil, fmt.Errorf("%v: %w", err, distribution.ErrNotFound)
+		}
+	case name.Tag:
+		tags, err := ls.lm.Tags(r.Context())
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(tags, r.TagStr()) {
+			return nil, fmt.Errorf("%v: %w", ref, distribution.ErrNotFound)
+		}
+	}
+	defer ls.locks.lock(ref)()
+	return ls.lm.Read(ctx, ref)
+}
+
+func (ls *localStore) Tags(_ context.Context, repo string) ([]string, error) {
+	r, err := name.NewRepository(ls.repository(repo), ls.opts.refValidation)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, distribution.ErrNotFound)
+	}
+	tags, err := ls.lm.Tags(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("%v: %w", r, distribution.ErrNotFound)
+	}
+	return tags, nil
+}
+
+func (ls *localStore) Images(ctx context.Context, repo string) ([]v1.Image, error) {
+	r, err := name.NewRepository(ls.repository(repo), ls.opts.refValidation)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, distribution.ErrNotFound)
+	}
+	return localImages(ctx, ls.lm, &ls.locks, r)
+}
+
+func (ls *localStore) WriteImage(ctx context.Context, repo string, reference string, img v1.Image) error {
+	ref, err := parseRepoReference(ls.repository(repo), reference, ls.opts)
+	if err != nil {
+		return err
+	}
+	defer ls.locks.lock(ref)()
+	lm := layout.NewMapper(ls.opts.imagesPath, ls.opts.dirimageOptions...)
+	lm.AddCandidateRoots(ls.opts.candidateRoots...)
+	if ls.opts.contentStore {
+		if err := lm.EnableContentStore(); err != nil {
+			return err
+		}
+	}
+	ls.opts.logf("writing %v", ref)
+	return lm.Write(ctx, img, ref)
+}
+
+// Serve serves images of the images directory on addr with the OCI distribution API, so peers can pull them
+// without a central registry, until the context is done. Repositories are requested without namespace,
+// e.g. local "ghcr.io/macvmio/macos-sonoma:14" is pulled as "<addr>/macvmio/macos-sonoma:14" with namespace
+// "ghcr.io", or as "<addr>/ghcr.io/macvmio/macos-sonoma:14" without one. With readWrite set pushed images
+// are written to the images directory, their blobs are kept in the cache directory until then.
+func Serve(addr string, namespace string, readWrite bool, opt ...Option) error {
+	opts := makeOptions(opt...)
+	serverOpts := []distribution.Option{distribution.WithLogFunction(opts.logf)}
+	if readWrite {
+		if err := os.MkdirAll(opts.cachePath, 0o755); err != nil {
+			return err
+		}
+		uploadDir, err := os.MkdirTemp(opts.cachePath, "uploads-")
+		if err != nil {
+			return fmt.Errorf("unable to create upload directory: %w", err)
+		}
+		serverOpts = append(serverOpts, distribution.WithUploads(uploadDir))
+	}
+	srv := distribution.NewServer(newLocalStore(namespace, opt...), serverOpts...)
+	defer srv.Close()
+	return listenAndServe(opts.ctx, addr, srv)
+}
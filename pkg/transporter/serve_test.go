@@ -0,0 +1,78 @@
+package transporter
+
+import (
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/macvmio/geranos/pkg/distribution"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServe(t *testing.T) {
+	tempDir, opts := optionsForTesting(t)
+	defer os.RemoveAll(tempDir)
+	sha := makeTestVMAt(t, tempDir, "local.test/vms/a:v1")
+
+	srv := distribution.NewServer(newLocalStore("local.test", opts...),
+		distribution.WithUploads(filepath.Join(tempDir, "uploads")))
+	defer srv.Close()
+	s := httptest.NewServer(srv)
+	defer s.Close()
+
+	served := refOnServer(s.URL, "vms/a:v1")
+	peerOpts := append(opts, WithImagesPath(filepath.Join(tempDir, "peer")))
+	require.NoError(t, Pull(served, peerOpts...))
+	assert.Equal(t, sha, hashFromFile(t, filepath.Join(tempDir, "peer", portableRef(served), "disk.img")))
+
+	tags, err := ListRemoteTags(refOnServer(s.URL, "vms/a"), NameFilter{}, opts...)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v1"}, tags)
+
+	t.Run("push", func(t *testing.T) {
+		pushed := refOnServer(s.URL, "vms/b:v2")
+		peerSha := makeTestVMWithContent(t, filepath.Join(tempDir, "peer"), pushed, "pushed by peer")
+		require.NoError(t, Push(pushed, append(opts, WithImagesPath(filepath.Join(tempDir, "peer", "images")))...))
+		assert.Equal(t, peerSha, hashFromFile(t, filepath.Join(tempDir, "images", portableRef("local.test/vms/b:v2"), "disk.img")))
+	})
+
+	t.Run("blobs after restart", func(t *testing.T) {
+		ref, err := name.ParseReference(served)
+		require.NoError(t, err)
+		img, err := remote.Image(ref)
+		require.NoError(t, err)
+		layers, err := img.Layers()
+		require.NoError(t, err)
+		digest, err := layers[0].Digest()
+		require.NoError(t, err)
+
+		restarted := httptest.NewServer(distribution.NewServer(newLocalStore("local.test", opts...)))
+		defer restarted.Close()
+		req, err := http.NewRequest(http.MethodGet, restarted.URL+"/v2/vms/a/blobs/"+digest.String(), nil)
+		require.NoError(t, err)
+		req.Header.Set("Range", "bytes=1-")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	})
+
+	t.Run("missing image", func(t *testing.T) {
+		assert.Error(t, Pull(refOnServer(s.URL, "vms/a:v3"), peerOpts...))
+	})
+}
+
+func TestServe_readOnly(t *testing.T) {
+	tempDir, opts := optionsForTesting(t)
+	defer os.RemoveAll(tempDir)
+	s := httptest.NewServer(distribution.NewServer(newLocalStore("", opts...)))
+	defer s.Close()
+
+	pushed := refOnServer(s.URL, "vms/b:v2")
+	makeTestVMAt(t, tempDir, pushed)
+	assert.Error(t, Push(pushed, opts...))
+}
@@ -0,0 +1,168 @@
+package transporter
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/macvmio/geranos/pkg/signing"
+	"io"
+	"net/http"
+)
+
+// signImage signs manifest of img pushed to ref, and attaches the signature to it in the layout cosign uses:
+// artifact with the signed payload as layer, annotated with the signature and its certificate. It is pushed
+// both as a referrer and into the image of signing.SignatureTag, which cosign reads by default.
+func signImage(ref name.Reference, img v1.Image, opts *options) (v1.Hash, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	size, err := img.Size()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	payload, err := signing.NewPayload(ref.Context().Name(), digest)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	cfg := *opts.signing
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Transport: opts.transport}
+	}
+	sig, err := signing.Sign(opts.ctx, cfg, payload)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	layer := mutate.Addendum{
+		Layer:       static.NewLayer(payload, signing.PayloadMediaType),
+		Annotations: sig.Annotations(),
+	}
+	subject := v1.Descriptor{MediaType: mediaType, Digest: digest, Size: size}
+	res, err := pushArtifact(ref.Context().Digest(digest.String()), subject, signing.ArtifactType, []mutate.Addendum{layer}, nil, opts)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	if err := tagSignature(ref.Context(), digest, layer, opts); err != nil {
+		return v1.Hash{}, err
+	}
+	return res, nil
+}
+
+// tagSignature appends layer with signature of manifest digest to the image of signing.SignatureTag, keeping
+// signatures already there, like cosign sign does.
+func tagSignature(repo name.Repository, digest v1.Hash, layer mutate.Addendum, opts *options) error {
+	tag := repo.Tag(signing.SignatureTag(digest))
+	base, err := remote.Image(tag, opts.remoteOptions...)
+	if isNotFound(err) {
+		base = mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), types.OCIConfigJSON)
+	} else if err != nil {
+		return fmt.Errorf("unable to fetch signatures of %v: %w", digest, err)
+	}
+	img, err := mutate.Append(base, layer)
+	if err != nil {
+		return err
+	}
+	if err := remote.Write(tag, img, opts.remoteOptions...); err != nil {
+		return fmt.Errorf("unable to push %v: %w", tag, err)
+	}
+	return nil
+}
+
+// maxSignaturePayloadSize limits payloads read from signature artifacts, real ones are few hundred bytes.
+const maxSignaturePayloadSize = 1 << 20
+
+// signaturesOf returns signatures of manifest of digest in repo, attached as referrers like signImage does,
+// or kept in the image of signing.SignatureTag like cosign does by default.
+func signaturesOf(repo name.Repository, digest v1.Hash, opts *options) ([]*signing.Signature, error) {
+	idx, err := remote.Referrers(repo.Digest(digest.String()), append(opts.remoteOptions, remote.WithFilter("artifactType", signing.ArtifactType))...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list signatures: %w", err)
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	artifacts := make([]v1.Image, 0, len(manifest.Manifests)+1)
+	for _, desc := range manifest.Manifests {
+		artifact, err := remote.Image(repo.Digest(desc.Digest.String()), opts.remoteOptions...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch signature %v: %w", desc.Digest, err)
+		}
+		artifacts = append(artifacts, artifact)
+	}
+	tagged, err := remote.Image(repo.Tag(signing.SignatureTag(digest)), opts.remoteOptions...)
+	if err == nil {
+		artifacts = append(artifacts, tagged)
+	} else if !isNotFound(err) {
+		return nil, fmt.Errorf("unable to fetch signatures of %v: %w", digest, err)
+	}
+
+	var res []*signing.Signature
+	// signatures made by signImage are in both places
+	seen := make(map[string]struct{})
+	for _, artifact := range artifacts {
+		artifactDigest, err := artifact.Digest()
+		if err != nil {
+			return nil, err
+		}
+		m, err := artifact.Manifest()
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range m.Layers {
+			if l.MediaType != signing.PayloadMediaType || l.Size > maxSignaturePayloadSize {
+				continue
+			}
+			if _, ok := seen[l.Annotations[signing.SignatureAnnotation]]; ok {
+				continue
+			}
+			payload, err := readBlob(artifact, l.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("unable to fetch signature %v: %w", artifactDigest, err)
+			}
+			sig, err := signing.ParseSignature(payload, l.Annotations)
+			if err != nil {
+				opts.logf("skipping signature %v: %v", artifactDigest, err)
+				continue
+			}
+			seen[l.Annotations[signing.SignatureAnnotation]] = struct{}{}
+			res = append(res, sig)
+		}
+	}
+	return res, nil
+}
+
+func readBlob(img v1.Image, digest v1.Hash) ([]byte, error) {
+	l, err := img.LayerByDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := l.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, maxSignaturePayloadSize))
+}
+
+// verifySignature returns error unless img pulled from ref is signed by signer trusted by opts.signaturePolicy.
+func verifySignature(ref name.Reference, img v1.Image, opts *options) error {
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	sigs, err := signaturesOf(ref.Context(), digest, opts)
+	if err != nil {
+		return err
+	}
+	return opts.signaturePolicy.Verify(ref.Context().Name(), digest, sigs)
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/google/go-containerregistry/pkg/logs"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/macvmio/geranos/pkg/layout"
 	"log"
 	"os"
 )
@@ -38,3 +39,25 @@ func RetagRemotely(oldImageRef, newImageRef string, opt ...Option) error {
 
 	return nil
 }
+
+// TagLocally makes local image dst refer to the same content as src without copying it, see layout.Mapper.Tag.
+func TagLocally(src, dst string, opt ...Option) error {
+	opts := makeOptions(opt...)
+	srcRef, err := name.ParseReference(src, name.StrictValidation)
+	if err != nil {
+		return fmt.Errorf("unable to parse reference '%v': %w", src, err)
+	}
+	dstRef, err := name.ParseReference(dst, name.StrictValidation)
+	if err != nil {
+		return fmt.Errorf("unable to parse reference '%v': %w", dst, err)
+	}
+	lm := layout.NewMapper(opts.imagesPath, opts.dirimageOptions...)
+	linked, err := lm.Tag(opts.ctx, srcRef, dstRef)
+	if err != nil {
+		return err
+	}
+	if linked {
+		fmt.Printf("warning: filesystem does not support Copy-on-Write, %v and %v share hard linked files and must not be modified\n", src, dst)
+	}
+	return nil
+}
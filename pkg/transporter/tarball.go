@@ -0,0 +1,296 @@
+package transporter
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/layout"
+	"hash"
+	"io"
+	"path"
+	"sync"
+)
+
+// Archives of Save are OCI image layouts in tar, with entries in the order Load needs them: oci-layout,
+// index.json, the manifest, the config, and blobs of all layers in manifest order. Blobs of repeated layers are
+// repeated as well, so Load consumes the archive in one pass, and it never has to be staged on disk.
+const (
+	ociLayoutFilename = "oci-layout"
+	ociIndexFilename  = "index.json"
+	ociBlobsDirectory = "blobs"
+)
+
+func blobEntryName(h v1.Hash) string {
+	return path.Join(ociBlobsDirectory, h.Algorithm, h.Hex)
+}
+
+// Save writes local image src to w as a tar archive, see Load. Blobs are verified against the manifest
+// as they are written.
+func Save(src string, w io.Writer, opt ...Option) error {
+	opts := makeOptions(opt...)
+	ref, err := name.ParseReference(src, name.StrictValidation)
+	if err != nil {
+		return err
+	}
+	lm := layout.NewMapper(opts.imagesPath, opts.dirimageOptions...)
+	img, err := lm.Read(opts.ctx, ref)
+	if err != nil {
+		return fmt.Errorf("unable to read image from disk: %w", err)
+	}
+	rawManifest, err := img.RawManifest()
+	if err != nil {
+		return err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	manifestDesc, err := partial.Descriptor(img)
+	if err != nil {
+		return err
+	}
+	manifestDesc.Annotations = map[string]string{annotationRefName: ref.Identifier()}
+	rawIndex, err := json.Marshal(v1.IndexManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIImageIndex,
+		Manifests:     []v1.Descriptor{*manifestDesc},
+	})
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{ociLayoutFilename, []byte(`{"imageLayoutVersion":"1.0.0"}`)},
+		{ociIndexFilename, rawIndex},
+		{blobEntryName(manifestDesc.Digest), rawManifest},
+		{blobEntryName(manifest.Config.Digest), rawConfig},
+	}
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0o644, Size: int64(len(f.data))}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return err
+		}
+	}
+	for _, desc := range manifest.Layers {
+		if err := opts.ctx.Err(); err != nil {
+			return err
+		}
+		if err := saveBlob(tw, img, desc); err != nil {
+			return fmt.Errorf("unable to save layer %v: %w", desc.Digest, err)
+		}
+	}
+	return tw.Close()
+}
+
+func saveBlob(tw *tar.Writer, img v1.Image, desc v1.Descriptor) error {
+	l, err := img.LayerByDigest(desc.Digest)
+	if err != nil {
+		return err
+	}
+	rc, err := l.Compressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := tw.WriteHeader(&tar.Header{Name: blobEntryName(desc.Digest), Mode: 0o644, Size: desc.Size}); err != nil {
+		return err
+	}
+	vr, err := newVerifyingReader(rc, desc.Digest)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, vr)
+	return err
+}
+
+// Load writes image of tar archive of Save read from r as local image dst. The archive is consumed as it is
+// read, and layers are verified against the manifest, so r can be a pipe. Segments already matching
+// local content are skipped, and images of candidate roots are cloned from, like for Pull.
+func Load(r io.Reader, dst string, opt ...Option) error {
+	opts := makeOptions(opt...)
+	ref, err := name.ParseReference(dst, name.StrictValidation)
+	if err != nil {
+		return err
+	}
+	img, err := readArchiveHeader(tar.NewReader(r))
+	if err != nil {
+		return fmt.Errorf("unable to read archive: %w", err)
+	}
+	// layers are requested in manifest order by a single worker, which the archive follows
+	dirimageOptions := append(append([]dirimage.Option{}, opts.dirimageOptions...), dirimage.WithWorkersCount(1))
+	lm := layout.NewMapper(opts.imagesPath, dirimageOptions...)
+	lm.AddCandidateRoots(opts.candidateRoots...)
+	return lm.Write(opts.ctx, img, ref)
+}
+
+// readArchiveHeader reads entries of the archive preceding layer blobs, and returns the image they describe.
+func readArchiveHeader(tr *tar.Reader) (v1.Image, error) {
+	stream := &blobStream{tr: tr}
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name == ociLayoutFilename {
+		if hdr, err = tr.Next(); err != nil {
+			return nil, err
+		}
+	}
+	if hdr.Name != ociIndexFilename {
+		return nil, fmt.Errorf("expected %v, got '%v'", ociIndexFilename, hdr.Name)
+	}
+	index, err := v1.ParseIndexManifest(tr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse index: %w", err)
+	}
+	if len(index.Manifests) != 1 {
+		return nil, fmt.Errorf("expected a single image, got %d", len(index.Manifests))
+	}
+	rawManifest, err := stream.readAll(index.Manifests[0].Digest)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(rawManifest))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse manifest: %w", err)
+	}
+	rawConfig, err := stream.readAll(manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return partial.CompressedToImage(&streamedImage{
+		rawManifest: rawManifest,
+		rawConfig:   rawConfig,
+		manifest:    manifest,
+		stream:      stream,
+	})
+}
+
+// blobStream hands out blobs of the archive in its order, skipping ones nobody asked for, like layers
+// of segments which already match local content.
+type blobStream struct {
+	mu sync.Mutex
+	tr *tar.Reader
+}
+
+func (s *blobStream) next(h v1.Hash) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		hdr, err := s.tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("blob %v not found in archive, or requested out of order", h)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == blobEntryName(h) {
+			vr, err := newVerifyingReader(s.tr, h)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(vr), nil
+		}
+	}
+}
+
+func (s *blobStream) readAll(h v1.Hash) ([]byte, error) {
+	rc, err := s.next(h)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+type streamedImage struct {
+	rawManifest []byte
+	rawConfig   []byte
+	manifest    *v1.Manifest
+	stream      *blobStream
+}
+
+func (i *streamedImage) RawConfigFile() ([]byte, error) {
+	return i.rawConfig, nil
+}
+
+func (i *streamedImage) MediaType() (types.MediaType, error) {
+	return i.manifest.MediaType, nil
+}
+
+func (i *streamedImage) RawManifest() ([]byte, error) {
+	return i.rawManifest, nil
+}
+
+func (i *streamedImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	for _, desc := range i.manifest.Layers {
+		if desc.Digest == h {
+			return &streamedLayer{desc: desc, stream: i.stream}, nil
+		}
+	}
+	return nil, fmt.Errorf("layer %v not found in manifest", h)
+}
+
+type streamedLayer struct {
+	desc   v1.Descriptor
+	stream *blobStream
+}
+
+func (l *streamedLayer) Digest() (v1.Hash, error) {
+	return l.desc.Digest, nil
+}
+
+func (l *streamedLayer) Compressed() (io.ReadCloser, error) {
+	return l.stream.next(l.desc.Digest)
+}
+
+func (l *streamedLayer) Size() (int64, error) {
+	return l.desc.Size, nil
+}
+
+func (l *streamedLayer) MediaType() (types.MediaType, error) {
+	return l.desc.MediaType, nil
+}
+
+// verifyingReader fails at the end of r when its content does not have digest expected.
+type verifyingReader struct {
+	r        io.Reader
+	h        hash.Hash
+	expected v1.Hash
+}
+
+func newVerifyingReader(r io.Reader, expected v1.Hash) (io.Reader, error) {
+	h, err := v1.Hasher(expected.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{r: r, h: h, expected: expected}, nil
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	n, err := vr.r.Read(p)
+	vr.h.Write(p[:n])
+	if errors.Is(err, io.EOF) {
+		if actual := hex.EncodeToString(vr.h.Sum(nil)); actual != vr.expected.Hex {
+			return n, fmt.Errorf("digest mismatch of %v: got %v:%v", vr.expected, vr.expected.Algorithm, actual)
+		}
+	}
+	return n, err
+}
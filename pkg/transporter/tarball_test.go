@@ -0,0 +1,64 @@
+package transporter
+
+import (
+	"archive/tar"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	tempDir, opts := optionsForTesting(t)
+	defer os.RemoveAll(tempDir)
+	src := "oci.jarosik.online/testrepo/a:v1"
+	d := filepath.Join(tempDir, "images", portableRef(src))
+	require.NoError(t, os.MkdirAll(d, os.ModePerm))
+	require.NoError(t, makeRandomFile(t, filepath.Join(d, "disk.img"), 3*1024*1024))
+	makeFileAt(t, filepath.Join(d, "config.json"), `{"cpus": 2}`)
+	sha := hashFromFile(t, filepath.Join(d, "disk.img"))
+	require.NoError(t, Rehash(src, opts...))
+
+	archive := &bytes.Buffer{}
+	require.NoError(t, Save(src, archive, opts...))
+
+	// loaded into another images directory, so nothing can be cloned, and the archive is read through a pipe
+	loadOpts := append(opts, WithImagesPath(filepath.Join(tempDir, "other")))
+	dst := "oci.jarosik.online/loaded/a:v1"
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := io.Copy(pw, bytes.NewReader(archive.Bytes()))
+		pw.CloseWithError(err)
+	}()
+	require.NoError(t, Load(pr, dst, loadOpts...))
+	dstDir := filepath.Join(tempDir, "other", portableRef(dst))
+	assert.Equal(t, sha, hashFromFile(t, filepath.Join(dstDir, "disk.img")))
+	assert.FileExists(t, filepath.Join(dstDir, "config.json"))
+
+	t.Run("corrupted blob", func(t *testing.T) {
+		corrupted := &bytes.Buffer{}
+		tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+		tw := tar.NewWriter(corrupted)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			data, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			if hdr.Size > 1024 {
+				data[0] ^= 0xff
+			}
+			require.NoError(t, tw.WriteHeader(hdr))
+			_, err = tw.Write(data)
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		corruptedOpts := append(opts, WithImagesPath(filepath.Join(tempDir, "corrupted")))
+		assert.Error(t, Load(corrupted, dst, corruptedOpts...))
+	})
+}
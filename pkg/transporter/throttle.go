@@ -0,0 +1,55 @@
+package transporter
+
+import (
+	"context"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/macvmio/geranos/pkg/throttle"
+	"io"
+)
+
+// throttledImage limits the rate at which compressed content of its layers is read while uploading.
+type throttledImage struct {
+	v1.Image
+	ctx     context.Context
+	limiter *throttle.Limiter
+}
+
+func (ti *throttledImage) wrap(l v1.Layer, err error) (v1.Layer, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &throttledLayer{Layer: l, image: ti}, nil
+}
+
+func (ti *throttledImage) Layers() ([]v1.Layer, error) {
+	ls, err := ti.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]v1.Layer, 0, len(ls))
+	for _, l := range ls {
+		res = append(res, &throttledLayer{Layer: l, image: ti})
+	}
+	return res, nil
+}
+
+func (ti *throttledImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	return ti.wrap(ti.Image.LayerByDigest(h))
+}
+
+func (ti *throttledImage) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	return ti.wrap(ti.Image.LayerByDiffID(h))
+}
+
+type throttledLayer struct {
+	v1.Layer
+	image *throttledImage
+}
+
+func (tl *throttledLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := tl.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	return tl.image.limiter.Reader(tl.image.ctx, rc), nil
+}
@@ -0,0 +1,148 @@
+package transporter
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/filesegment"
+	"github.com/macvmio/geranos/pkg/throttle"
+	"golang.org/x/sync/errgroup"
+	"net/http"
+	"net/url"
+)
+
+// blobUploader uploads blobs with chunked upload of the registry, which takes the digest only when finalizing it.
+type blobUploader struct {
+	fetcher  *blobFetcher
+	limiter  *throttle.Limiter
+	sessions *uploadSessions
+	chunks   *chunkSizer
+}
+
+func newBlobUploader(repo name.Repository, limiter *throttle.Limiter, opts *options) *blobUploader {
+	fetcher := newBlobFetcher(repo, opts)
+	fetcher.scope = transport.PushScope
+	return &blobUploader{
+		fetcher:  fetcher,
+		limiter:  limiter,
+		sessions: newUploadSessions(opts.cachePath),
+		chunks:   newChunkSizer(opts.uploadChunkSize),
+	}
+}
+
+// location returns upload location sent by the registry, resolved against the request when relative.
+func (bu *blobUploader) location(resp *http.Response) (*url.URL, error) {
+	loc, err := resp.Location()
+	if err != nil {
+		return nil, fmt.Errorf("missing upload location: %w", err)
+	}
+	return loc, nil
+}
+
+// start starts an upload and returns its location.
+func (bu *blobUploader) start(ctx context.Context, client *http.Client) (*url.URL, error) {
+	u := url.URL{
+		Scheme: bu.fetcher.repo.Registry.Scheme(),
+		Host:   bu.fetcher.repo.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/blobs/uploads/", bu.fetcher.repo.RepositoryStr()),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if err := transport.CheckError(resp, http.StatusAccepted); err != nil {
+		return nil, err
+	}
+	return bu.location(resp)
+}
+
+// commit finalizes upload at loc as blob digest.
+func (bu *blobUploader) commit(ctx context.Context, client *http.Client, loc *url.URL, digest v1.Hash) error {
+	query := loc.Query()
+	query.Set("digest", digest.String())
+	loc.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, loc.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return transport.CheckError(resp, http.StatusCreated)
+}
+
+// upload streams compressed content of l to the registry, hashing it on the way, and commits the blob
+// with the digest computed at the end. The content is read only once.
+func (bu *blobUploader) upload(ctx context.Context, l *filesegment.Layer) error {
+	client, err := bu.fetcher.httpClient()
+	if err != nil {
+		return err
+	}
+	loc, err := bu.start(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	rc, err := l.StreamCompressed()
+	if err != nil {
+		return err
+	}
+	rc = bu.limiter.Reader(ctx, rc)
+	defer rc.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, loc.String(), rc)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if err := transport.CheckError(resp, http.StatusNoContent, http.StatusAccepted, http.StatusCreated); err != nil {
+		return err
+	}
+	loc, err = bu.location(resp)
+	if err != nil {
+		return err
+	}
+
+	digest, err := l.Digest()
+	if err != nil {
+		return err
+	}
+	return bu.commit(ctx, client, loc, digest)
+}
+
+// streamLayers uploads segments of di whose digests are not known yet, computing them while uploading.
+// Segments with known digests are left to the regular upload, which skips blobs the registry already has.
+func streamLayers(repo name.Repository, di *dirimage.DirImage, limiter *throttle.Limiter, opts *options) error {
+	uploader := newBlobUploader(repo, limiter, opts)
+	g, ctx := errgroup.WithContext(opts.ctx)
+	g.SetLimit(max(opts.workersCount, 1))
+	for _, l := range di.DeferredLayers() {
+		g.Go(func() error {
+			if err := uploader.upload(ctx, l); err != nil {
+				return fmt.Errorf("unable to stream %v: %w", l, err)
+			}
+			digest, err := l.Digest()
+			if err != nil {
+				return err
+			}
+			opts.logf("streamed layer: %v\n", digest)
+			return nil
+		})
+	}
+	return g.Wait()
+}
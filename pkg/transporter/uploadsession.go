@@ -0,0 +1,254 @@
+package transporter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// uploadSession is a chunked upload of a blob in progress. It is saved after every chunk accepted by the registry,
+// so a push interrupted in the middle of a huge layer continues from the last committed chunk.
+type uploadSession struct {
+	Location string `json:"location"`
+	Offset   int64  `json:"offset"`
+}
+
+// uploadSessions keeps upload sessions in the cache directory, one file per repository and blob.
+type uploadSessions struct {
+	dir string
+}
+
+func newUploadSessions(cachePath string) *uploadSessions {
+	return &uploadSessions{dir: filepath.Join(cachePath, "upload-sessions")}
+}
+
+func (us *uploadSessions) path(repo name.Repository, digest v1.Hash) string {
+	key := sha256.Sum256([]byte(repo.Name() + "@" + digest.String()))
+	return filepath.Join(us.dir, hex.EncodeToString(key[:])+".json")
+}
+
+// load returns saved session of blob digest in repo, nil when there is none.
+func (us *uploadSessions) load(repo name.Repository, digest v1.Hash) (*uploadSession, error) {
+	b, err := os.ReadFile(us.path(repo, digest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s uploadSession
+	if err := json.Unmarshal(b, &s); err != nil || s.Location == "" {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+func (us *uploadSessions) save(repo name.Repository, digest v1.Hash, s *uploadSession) error {
+	if err := os.MkdirAll(us.dir, 0o755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	// each push writes its own temporary file, so concurrent ones never write to the same
+	path := us.path(repo, digest)
+	f, err := os.CreateTemp(us.dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+func (us *uploadSessions) remove(repo name.Repository, digest v1.Hash) {
+	_ = os.Remove(us.path(repo, digest))
+}
+
+// isSessionLost reports whether err means the registry no longer has the upload, or has other part of it
+// than the saved session.
+func isSessionLost(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	switch terr.StatusCode {
+	case http.StatusNotFound, http.StatusRequestedRangeNotSatisfiable, http.StatusBadRequest:
+		return true
+	}
+	return false
+}
+
+// uploadResumable uploads l in chunks sized by bu.chunks, saving the upload session after each of them. Upload
+// interrupted by an earlier push is resumed from its last committed chunk, the part before it is only read from
+// disk again. When the registry lost the session the upload starts over.
+func (bu *blobUploader) uploadResumable(ctx context.Context, l v1.Layer) error {
+	digest, err := l.Digest()
+	if err != nil {
+		return err
+	}
+	client, err := bu.fetcher.httpClient()
+	if err != nil {
+		return err
+	}
+	for {
+		s, resumed, err := bu.startSession(ctx, client, digest)
+		if err != nil {
+			return err
+		}
+		err = bu.uploadChunks(ctx, client, l, digest, s)
+		if err == nil {
+			bu.sessions.remove(bu.fetcher.repo, digest)
+			return nil
+		}
+		// the session is kept for the next push, unless it cannot be resumed anymore
+		if !resumed || !isSessionLost(err) {
+			return err
+		}
+		bu.fetcher.logf("upload session of %v was lost, starting over: %v", digest, err)
+		bu.sessions.remove(bu.fetcher.repo, digest)
+	}
+}
+
+// startSession returns saved upload session of digest when the registry still has it, or starts a new one.
+func (bu *blobUploader) startSession(ctx context.Context, client *http.Client, digest v1.Hash) (*uploadSession, bool, error) {
+	s, err := bu.sessions.load(bu.fetcher.repo, digest)
+	if err != nil {
+		return nil, false, err
+	}
+	if s != nil {
+		ok, err := bu.sessionStatus(ctx, client, s)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			return s, true, nil
+		}
+		bu.sessions.remove(bu.fetcher.repo, digest)
+	}
+	loc, err := bu.start(ctx, client)
+	if err != nil {
+		return nil, false, err
+	}
+	s = &uploadSession{Location: loc.String()}
+	if err := bu.sessions.save(bu.fetcher.repo, digest, s); err != nil {
+		return nil, false, err
+	}
+	return s, false, nil
+}
+
+// sessionStatus asks the registry for offset of upload s, reporting false when the upload is gone. Registries which
+// do not report status of uploads are trusted to have the saved offset, they reject the next chunk otherwise.
+func (bu *blobUploader) sessionStatus(ctx context.Context, client *http.Client, s *uploadSession) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Location, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return false, nil
+	case http.StatusNoContent:
+		var start, end int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Range"), "%d-%d", &start, &end); err == nil {
+			s.Offset = end + 1
+		} else {
+			s.Offset = 0
+		}
+		if loc, err := bu.location(resp); err == nil {
+			s.Location = loc.String()
+		}
+	}
+	return true, nil
+}
+
+// uploadChunks uploads content of l from offset of s, and commits it as blob digest.
+func (bu *blobUploader) uploadChunks(ctx context.Context, client *http.Client, l v1.Layer, digest v1.Hash, s *uploadSession) error {
+	rc, err := l.Compressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if s.Offset > 0 {
+		if _, err := io.CopyN(io.Discard, rc, s.Offset); err != nil {
+			return fmt.Errorf("unable to skip uploaded part of %v: %w", digest, err)
+		}
+		bu.fetcher.logf("resuming upload of %v at %d bytes", digest, s.Offset)
+	}
+	size, err := l.Size()
+	if err != nil {
+		return err
+	}
+	for s.Offset < size {
+		chunkSize := bu.chunks.next()
+		n := min(chunkSize, size-s.Offset)
+		started := time.Now()
+		if err := bu.uploadChunk(ctx, client, s, io.LimitReader(rc, n), n); err != nil {
+			return err
+		}
+		// the last chunk is usually shorter, its throughput is dominated by latency
+		if n == chunkSize {
+			bu.chunks.observe(n, time.Since(started))
+		}
+		if err := bu.sessions.save(bu.fetcher.repo, digest, s); err != nil {
+			return err
+		}
+	}
+	loc, err := url.Parse(s.Location)
+	if err != nil {
+		return err
+	}
+	return bu.commit(ctx, client, loc, digest)
+}
+
+// uploadChunk appends n bytes of r to upload s at its offset, and advances s past them.
+func (bu *blobUploader) uploadChunk(ctx context.Context, client *http.Client, s *uploadSession, r io.Reader, n int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, s.Location, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", s.Offset, s.Offset+n-1))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if err := transport.CheckError(resp, http.StatusNoContent, http.StatusAccepted); err != nil {
+		return err
+	}
+	loc, err := bu.location(resp)
+	if err != nil {
+		return err
+	}
+	s.Location = loc.String()
+	s.Offset += n
+	return nil
+}
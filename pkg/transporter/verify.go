@@ -0,0 +1,18 @@
+package transporter
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/macvmio/geranos/pkg/dirimage"
+	"github.com/macvmio/geranos/pkg/layout"
+)
+
+func Verify(src string, opt ...Option) (*dirimage.VerificationResult, error) {
+	opts := makeOptions(opt...)
+	ref, err := name.ParseReference(src, name.StrictValidation)
+	if err != nil {
+		return nil, fmt.Errorf("parse ref %s: %v", src, err)
+	}
+	lm := layout.NewMapper(opts.imagesPath, opts.dirimageOptions...)
+	return lm.Verify(opts.ctx, ref)
+}
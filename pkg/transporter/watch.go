@@ -0,0 +1,207 @@
+package transporter
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// WatchEventType tells what happened to a watched tag.
+type WatchEventType string
+
+const (
+	// WatchEventPulled is sent when a new digest of the tag was pulled
+	WatchEventPulled WatchEventType = "pulled"
+	// WatchEventError is sent when checking or pulling the tag failed, it is tried again in the next round
+	WatchEventError WatchEventType = "error"
+)
+
+// WatchEvent is sent by Watch for every change of a watched tag.
+type WatchEvent struct {
+	Type   WatchEventType `json:"type"`
+	Time   time.Time      `json:"time"`
+	Ref    string         `json:"ref"`
+	Digest string         `json:"digest,omitempty"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// manifestAccept lists manifest media types geranos understands, sent when checking manifests directly.
+var manifestAccept = strings.Join([]string{
+	string(types.OCIManifestSchema1),
+	string(types.DockerManifestSchema2),
+	string(types.OCIImageIndex),
+	string(types.DockerManifestList),
+}, ",")
+
+// watchedTag is what watcher remembers of a tag between rounds.
+type watchedTag struct {
+	etag   string
+	digest v1.Hash
+}
+
+type watcher struct {
+	repo    name.Repository
+	pattern string
+	fetcher *blobFetcher
+	tags    map[string]*watchedTag
+	onEvent func(WatchEvent)
+	opt     []Option
+	opts    *options
+}
+
+// Watch polls the registry every interval for new digests of pattern and pulls them, calling onEvent for every
+// pulled digest and every error, until the context given with WithContext is done. pattern is a reference
+// whose tag may be a path.Match pattern, e.g. "macos-sonoma:14.*", watching every matching tag.
+// Manifests are checked with HEAD requests sending ETag of the previous response, so registries can answer
+// 304 Not Modified. The first round pulls every tag, which is cheap for images already present locally.
+func Watch(pattern string, interval time.Duration, onEvent func(WatchEvent), opt ...Option) error {
+	w, err := newWatcher(pattern, onEvent, opt...)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		w.poll()
+		select {
+		case <-w.opts.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func newWatcher(pattern string, onEvent func(WatchEvent), opt ...Option) (*watcher, error) {
+	opts := makeOptions(opt...)
+	repoStr, tag := pattern, name.DefaultTag
+	if i := strings.LastIndex(pattern, ":"); i > strings.LastIndex(pattern, "/") {
+		repoStr, tag = pattern[:i], pattern[i+1:]
+	}
+	if _, err := path.Match(tag, ""); err != nil {
+		return nil, fmt.Errorf("invalid tag pattern '%v': %w", tag, err)
+	}
+	repo, err := name.NewRepository(repoStr, opts.refValidation)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse repository '%v': %w", repoStr, err)
+	}
+	return &watcher{
+		repo:    repo,
+		pattern: tag,
+		fetcher: newBlobFetcher(repo, opts),
+		tags:    make(map[string]*watchedTag),
+		onEvent: onEvent,
+		opt:     opt,
+		opts:    opts,
+	}, nil
+}
+
+// poll checks every watched tag once and pulls the ones with new digests.
+func (w *watcher) poll() {
+	tags := []string{w.pattern}
+	if strings.ContainsAny(w.pattern, "*?[\\") {
+		all, err := remote.List(w.repo, w.opts.remoteOptions...)
+		if err != nil {
+			w.emitError(w.repo.String(), v1.Hash{}, fmt.Errorf("unable to list tags: %w", err))
+			return
+		}
+		tags = tags[:0]
+		for _, t := range all {
+			if ok, _ := path.Match(w.pattern, t); ok {
+				tags = append(tags, t)
+			}
+		}
+	}
+	for _, t := range tags {
+		if w.opts.ctx.Err() != nil {
+			return
+		}
+		w.check(w.repo.Tag(t))
+	}
+}
+
+func (w *watcher) check(tag name.Tag) {
+	seen, ok := w.tags[tag.TagStr()]
+	if !ok {
+		seen = &watchedTag{}
+		w.tags[tag.TagStr()] = seen
+	}
+	digest, etag, err := w.fetcher.headManifest(tag.TagStr(), seen.etag)
+	if err != nil {
+		w.emitError(tag.String(), v1.Hash{}, err)
+		return
+	}
+	if digest == nil || *digest == seen.digest {
+		return
+	}
+	if err := Pull(tag.String(), w.opt...); err != nil {
+		w.emitError(tag.String(), *digest, fmt.Errorf("unable to pull: %w", err))
+		return
+	}
+	seen.etag, seen.digest = etag, *digest
+	w.emit(WatchEventPulled, tag.String(), *digest, nil)
+}
+
+func (w *watcher) emit(typ WatchEventType, ref string, digest v1.Hash, err error) {
+	e := WatchEvent{Type: typ, Time: time.Now(), Ref: ref}
+	if digest != (v1.Hash{}) {
+		e.Digest = digest.String()
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	w.onEvent(e)
+}
+
+// emitError sends error event, unless the error comes from stopping the watch.
+func (w *watcher) emitError(ref string, digest v1.Hash, err error) {
+	if w.opts.ctx.Err() != nil {
+		return
+	}
+	w.emit(WatchEventError, ref, digest, err)
+}
+
+// headManifest returns digest and ETag of manifest of reference, or nil digest when it was not modified
+// since the response with etag.
+func (bf *blobFetcher) headManifest(reference string, etag string) (*v1.Hash, string, error) {
+	client, err := bf.httpClient()
+	if err != nil {
+		return nil, "", err
+	}
+	u := url.URL{
+		Scheme: bf.repo.Registry.Scheme(),
+		Host:   bf.repo.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/manifests/%s", bf.repo.RepositoryStr(), reference),
+	}
+	req, err := http.NewRequestWithContext(bf.ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", manifestAccept)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, etag, nil
+	}
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		return nil, "", err
+	}
+	h, err := v1.NewHash(resp.Header.Get("Docker-Content-Digest"))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid digest of manifest %v: %w", reference, err)
+	}
+	return &h, resp.Header.Get("ETag"), nil
+}
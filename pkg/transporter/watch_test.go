@@ -0,0 +1,76 @@
+package transporter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withETags adds ETags to manifest responses of registry and answers 304 when they match If-None-Match.
+func withETags(h http.Handler, notModified *int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || !strings.Contains(r.URL.Path, "/manifests/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		etag := `"` + rec.Header().Get("Docker-Content-Digest") + `"`
+		if rec.Code == http.StatusOK && r.Header.Get("If-None-Match") == etag {
+			*notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		if rec.Code == http.StatusOK {
+			w.Header().Set("ETag", etag)
+		}
+		w.WriteHeader(rec.Code)
+	})
+}
+
+func TestWatch_pullsNewDigests(t *testing.T) {
+	notModified := 0
+	s := httptest.NewServer(withETags(prepareRegistry(), &notModified))
+	defer s.Close()
+	tempDir, opts := optionsForTesting(t)
+	defer os.RemoveAll(tempDir)
+
+	repo := refOnServer(s.URL, "vms/a")
+	for _, tag := range []string{"14.1", "14.2", "15.0"} {
+		makeTestVMAt(t, tempDir, repo+":"+tag)
+		require.NoError(t, Push(repo+":"+tag, opts...))
+	}
+
+	events := make([]WatchEvent, 0)
+	pullOpts := append(opts, WithImagesPath(filepath.Join(tempDir, "watched")))
+	w, err := newWatcher(repo+":14.*", func(e WatchEvent) { events = append(events, e) }, pullOpts...)
+	require.NoError(t, err)
+
+	w.poll()
+	require.Len(t, events, 2)
+	assert.Equal(t, WatchEventPulled, events[0].Type)
+	assert.Equal(t, repo+":14.1", events[0].Ref)
+	assert.Equal(t, repo+":14.2", events[1].Ref)
+	assert.FileExists(t, filepath.Join(tempDir, "watched", portableRef(repo+":14.2"), "disk.img"))
+
+	w.poll()
+	assert.Len(t, events, 2, "nothing changed")
+	assert.Equal(t, 2, notModified)
+
+	sha := makeTestVMWithContent(t, tempDir, repo+":14.2", "new content")
+	require.NoError(t, Push(repo+":14.2", opts...))
+	w.poll()
+	require.Len(t, events, 3)
+	assert.Equal(t, WatchEventPulled, events[2].Type)
+	assert.Equal(t, repo+":14.2", events[2].Ref)
+	assert.NotEqual(t, events[1].Digest, events[2].Digest)
+	assert.Equal(t, sha, hashFromFile(t, filepath.Join(tempDir, "watched", portableRef(repo+":14.2"), "disk.img")))
+}
@@ -0,0 +1,74 @@
+package zstd
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type decoderConfig struct {
+	dictionary *Dictionary
+	maxWindow  uint64
+	maxMemory  uint64
+}
+
+// DecoderOption configures the decoder used by NewReader.
+type DecoderOption func(*decoderConfig)
+
+// WithDecoderDictionary lets the decoder decompress frames referring to given dictionary. Nil is ignored.
+func WithDecoderDictionary(d *Dictionary) DecoderOption {
+	return func(c *decoderConfig) {
+		c.dictionary = d
+	}
+}
+
+// WithMaxWindow rejects frames declaring back-reference window larger than size bytes, before memory for it
+// is allocated. Zero keeps the decoder default of MaxWindowSize.
+func WithMaxWindow(size uint64) DecoderOption {
+	return func(c *decoderConfig) {
+		c.maxWindow = size
+	}
+}
+
+// WithMaxMemory limits memory the decoder allocates for decoding a stream to about n bytes. Zero keeps the
+// decoder default of 64GiB.
+func WithMaxMemory(n uint64) DecoderOption {
+	return func(c *decoderConfig) {
+		c.maxMemory = n
+	}
+}
+
+// NewReader returns reader of data decompressed from r. Closing it closes r.
+func NewReader(r io.ReadCloser, opts ...DecoderOption) (io.ReadCloser, error) {
+	var cfg decoderConfig
+	for _, o := range opts {
+		o(&cfg)
+	}
+	decoderOptions := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+	if cfg.dictionary != nil {
+		decoderOptions = append(decoderOptions, zstd.WithDecoderDictRaw(cfg.dictionary.ID, cfg.dictionary.Content))
+	}
+	if cfg.maxWindow > 0 {
+		decoderOptions = append(decoderOptions, zstd.WithDecoderMaxWindow(max(cfg.maxWindow, MinWindowSize)))
+	}
+	if cfg.maxMemory > 0 {
+		decoderOptions = append(decoderOptions, zstd.WithDecoderMaxMemory(cfg.maxMemory))
+	}
+	zr, err := zstd.NewReader(r, decoderOptions...)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("unable to create zstd decoder: %w", err)
+	}
+	return &decoderReadCloser{Decoder: zr, rc: r}, nil
+}
+
+type decoderReadCloser struct {
+	*zstd.Decoder
+	rc io.ReadCloser
+}
+
+func (d *decoderReadCloser) Close() error {
+	d.Decoder.Close()
+	return d.rc.Close()
+}
@@ -0,0 +1,62 @@
+package zstd
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// MaxDictionarySize is the size of dictionaries built by TrainDictionary, unless asked for less.
+// It matches the default of zstd --train.
+const MaxDictionarySize = 112640
+
+// minDictionaryID is the first ID not reserved by the zstd format for registered dictionaries.
+const minDictionaryID = 32768
+
+// Dictionary is a raw zstd dictionary: content both encoder and decoder start with as history,
+// so small inputs can reference it instead of repeating it.
+type Dictionary struct {
+	ID      uint32
+	Content []byte
+}
+
+// NewDictionary returns dictionary of content. Its ID is derived from the content,
+// so the same content always gets the same ID, and compressing with it stays reproducible.
+func NewDictionary(content []byte) *Dictionary {
+	sum := sha256.Sum256(content)
+	id := minDictionaryID + binary.BigEndian.Uint32(sum[:4])%(1<<31-minDictionaryID)
+	return &Dictionary{ID: id, Content: content}
+}
+
+// TrainDictionary builds dictionary of at most maxSize bytes out of samples, taking the same share of each
+// of them, starting from their beginning. It is deterministic, and returns nil when samples are empty.
+func TrainDictionary(samples [][]byte, maxSize int) *Dictionary {
+	var available []int
+	total := 0
+	for i, s := range samples {
+		if len(s) > 0 {
+			available = append(available, i)
+			total += len(s)
+		}
+	}
+	if len(available) == 0 || maxSize <= 0 {
+		return nil
+	}
+	content := make([]byte, 0, min(total, maxSize))
+	// shorter samples leave their unused share to the ones after them
+	for n, i := range available {
+		share := (maxSize - len(content)) / (len(available) - n)
+		content = append(content, samples[i][:min(len(samples[i]), share)]...)
+	}
+	if len(content) == 0 {
+		return nil
+	}
+	return NewDictionary(content)
+}
+
+// WithDictionary makes the encoder compress with given dictionary, which decoding then needs as well.
+// Nil dictionary is ignored.
+func WithDictionary(d *Dictionary) Option {
+	return func(c *encoderConfig) {
+		c.dictionary = d
+	}
+}
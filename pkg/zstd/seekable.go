@@ -0,0 +1,165 @@
+package zstd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Seekable zstd format splits content into independent frames and appends a seek table in a skippable frame,
+// see https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md.
+// Any zstd decoder reads the whole stream, while readers of the seek table can decompress byte ranges
+// by fetching only the frames covering them.
+const (
+	seekTableMagic  = 0x184D2A5E
+	seekableMagic   = 0x8F92EAB1
+	seekFooterSize  = 9
+	seekEntrySize   = 8
+	maxSeekableSize = 1<<32 - 1
+)
+
+// SeekableReadCloser reads uncompressed input data from the io.ReadCloser and returns an io.ReadCloser
+// from which data compressed in seekable format may be read, with frames of frameSize uncompressed bytes.
+func SeekableReadCloser(r io.ReadCloser, frameSize int, opts ...Option) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer r.Close()
+		pw.CloseWithError(writeSeekable(pw, r, frameSize, encoderOptions(opts)))
+	}()
+	return pr
+}
+
+// ValidateSeekableFrameSize reports frame sizes not representable in the seek table.
+func ValidateSeekableFrameSize(frameSize int) error {
+	if frameSize <= 0 || int64(frameSize) > maxSeekableSize {
+		return fmt.Errorf("invalid seekable frame size %d", frameSize)
+	}
+	return nil
+}
+
+func writeSeekable(w io.Writer, r io.Reader, frameSize int, encoderOptions []zstd.EOption) error {
+	if err := ValidateSeekableFrameSize(frameSize); err != nil {
+		return err
+	}
+	zw, err := zstd.NewWriter(nil, encoderOptions...)
+	if err != nil {
+		return err
+	}
+	defer zw.Close()
+	bw := bufio.NewWriterSize(w, 1<<20)
+	buf := make([]byte, frameSize)
+	var compressed []byte
+	table := make([]byte, 0)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			compressed = zw.EncodeAll(buf[:n], compressed[:0])
+			if len(compressed) > maxSeekableSize {
+				return errors.New("seekable frame too large")
+			}
+			if _, err := bw.Write(compressed); err != nil {
+				return err
+			}
+			table = binary.LittleEndian.AppendUint32(table, uint32(len(compressed)))
+			table = binary.LittleEndian.AppendUint32(table, uint32(n))
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	frames := len(table) / seekEntrySize
+	table = binary.LittleEndian.AppendUint32(table, uint32(frames))
+	table = append(table, 0) // descriptor: no checksums
+	table = binary.LittleEndian.AppendUint32(table, seekableMagic)
+	header := binary.LittleEndian.AppendUint32(nil, seekTableMagic)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(table)))
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+	if _, err := bw.Write(table); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// SeekFrame locates one frame of seekable zstd stream.
+type SeekFrame struct {
+	CompressedOffset   int64
+	CompressedSize     int64
+	DecompressedOffset int64
+	DecompressedSize   int64
+}
+
+// SeekTable lists frames of seekable zstd stream, in order.
+type SeekTable struct {
+	Frames []SeekFrame
+}
+
+// ReadSeekTable reads seek table from the end of seekable zstd stream of given size.
+func ReadSeekTable(r io.ReaderAt, size int64) (*SeekTable, error) {
+	if size < seekFooterSize {
+		return nil, errors.New("stream too short for seek table")
+	}
+	footer := make([]byte, seekFooterSize)
+	if _, err := r.ReadAt(footer, size-seekFooterSize); err != nil {
+		return nil, fmt.Errorf("unable to read seek table footer: %w", err)
+	}
+	if binary.LittleEndian.Uint32(footer[5:9]) != seekableMagic {
+		return nil, errors.New("not a seekable zstd stream")
+	}
+	if footer[4]&0x7c != 0 {
+		return nil, errors.New("unsupported seek table descriptor")
+	}
+	entrySize := int64(seekEntrySize)
+	if footer[4]&0x80 != 0 {
+		entrySize += 4
+	}
+	frames := int64(binary.LittleEndian.Uint32(footer[0:4]))
+	tableSize := frames*entrySize + seekFooterSize
+	if tableSize+8 > size {
+		return nil, errors.New("seek table larger than stream")
+	}
+	raw := make([]byte, tableSize+8)
+	if _, err := r.ReadAt(raw, size-tableSize-8); err != nil {
+		return nil, fmt.Errorf("unable to read seek table: %w", err)
+	}
+	if binary.LittleEndian.Uint32(raw[0:4]) != seekTableMagic || int64(binary.LittleEndian.Uint32(raw[4:8])) != tableSize {
+		return nil, errors.New("invalid seek table header")
+	}
+	res := &SeekTable{Frames: make([]SeekFrame, 0, frames)}
+	var compressedOffset, decompressedOffset int64
+	for i := int64(0); i < frames; i++ {
+		entry := raw[8+i*entrySize:]
+		f := SeekFrame{
+			CompressedOffset:   compressedOffset,
+			CompressedSize:     int64(binary.LittleEndian.Uint32(entry[0:4])),
+			DecompressedOffset: decompressedOffset,
+			DecompressedSize:   int64(binary.LittleEndian.Uint32(entry[4:8])),
+		}
+		res.Frames = append(res.Frames, f)
+		compressedOffset += f.CompressedSize
+		decompressedOffset += f.DecompressedSize
+	}
+	if compressedOffset > size-tableSize-8 {
+		return nil, errors.New("seek table does not match stream")
+	}
+	return res, nil
+}
+
+// Locate returns frames covering length decompressed bytes starting at offset.
+func (t *SeekTable) Locate(offset, length int64) []SeekFrame {
+	res := make([]SeekFrame, 0)
+	for _, f := range t.Frames {
+		if f.DecompressedOffset+f.DecompressedSize > offset && f.DecompressedOffset < offset+length {
+			res = append(res, f)
+		}
+	}
+	return res
+}
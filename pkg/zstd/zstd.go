@@ -2,6 +2,8 @@ package zstd
 
 import (
 	"bufio"
+	"encoding/binary"
+	"fmt"
 	"io"
 
 	"github.com/klauspost/compress/zstd"
@@ -20,6 +22,99 @@ func ReadCloser(r io.ReadCloser) io.ReadCloser {
 // ReadCloserLevel reads uncompressed input data from the io.ReadCloser and
 // returns an io.ReadCloser from which compressed data may be read.
 func ReadCloserLevel(r io.ReadCloser, level int) io.ReadCloser {
+	return ReadCloserWithOptions(r, WithLevel(level))
+}
+
+type encoderConfig struct {
+	level       int
+	windowSize  int
+	dictionary  *Dictionary
+	concurrency int
+}
+
+// Option configures the encoder used by ReadCloserWithOptions.
+type Option func(*encoderConfig)
+
+// DefaultLevel is the compression level used unless WithLevel is given.
+const DefaultLevel = 1
+
+// MaxLevel is the highest level accepted by ValidateLevel. Levels are mapped to the closest level
+// the encoder implements, so neighbouring levels can compress the same.
+const MaxLevel = 22
+
+// WithLevel sets zstd compression level, DefaultLevel is used by default.
+func WithLevel(level int) Option {
+	return func(c *encoderConfig) {
+		c.level = level
+	}
+}
+
+// WithConcurrency sets how many goroutines compress blocks of the stream at the same time, 1 by default.
+// Compressed output does not depend on it.
+func WithConcurrency(n int) Option {
+	return func(c *encoderConfig) {
+		c.concurrency = n
+	}
+}
+
+// ValidateLevel reports levels outside of 1 to MaxLevel.
+func ValidateLevel(level int) error {
+	if level < 1 || level > MaxLevel {
+		return fmt.Errorf("invalid zstd compression level %d, expected 1 to %d", level, MaxLevel)
+	}
+	return nil
+}
+
+// WithWindowSize sets the maximum distance of back-references, like long distance matching of zstd --long.
+// Larger windows find repetitions further apart, at the cost of memory of both compression and decompression.
+// Zero keeps the default window of the level.
+func WithWindowSize(size int) Option {
+	return func(c *encoderConfig) {
+		c.windowSize = size
+	}
+}
+
+// ValidateWindowSize reports window sizes rejected by the encoder: it has to be a power of two
+// between MinWindowSize and MaxWindowSize, or zero.
+func ValidateWindowSize(size int) error {
+	if size == 0 {
+		return nil
+	}
+	if size < MinWindowSize || size > MaxWindowSize || size&(size-1) != 0 {
+		return fmt.Errorf("invalid zstd window size %d, expected power of two between %d and %d", size, MinWindowSize, MaxWindowSize)
+	}
+	return nil
+}
+
+const (
+	MinWindowSize = zstd.MinWindowSize
+	MaxWindowSize = zstd.MaxWindowSize
+)
+
+// encoderOptions translates opts to options of the encoder.
+func encoderOptions(opts []Option) []zstd.EOption {
+	cfg := encoderConfig{level: DefaultLevel, concurrency: 1}
+	for _, o := range opts {
+		o(&cfg)
+	}
+	res := []zstd.EOption{
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(cfg.level)),
+		zstd.WithEncoderConcurrency(max(cfg.concurrency, 1)),
+		zstd.WithZeroFrames(true),
+	}
+	if cfg.windowSize > 0 {
+		res = append(res, zstd.WithWindowSize(cfg.windowSize))
+	}
+	if cfg.dictionary != nil {
+		res = append(res, zstd.WithEncoderDictRaw(cfg.dictionary.ID, cfg.dictionary.Content))
+	}
+	return res
+}
+
+// ReadCloserWithOptions reads uncompressed input data from the io.ReadCloser and
+// returns an io.ReadCloser from which compressed data may be read.
+func ReadCloserWithOptions(r io.ReadCloser, opts ...Option) io.ReadCloser {
+	encoderOptions := encoderOptions(opts)
 	pr, pw := io.Pipe()
 
 	// For highly compressible layers, zstd.Writer will output a very small
@@ -33,11 +128,7 @@ func ReadCloserLevel(r io.ReadCloser, level int) io.ReadCloser {
 	go func() error {
 		// TODO(go1.14): Just defer {pw,zw,r}.Close like you'd expect.
 		// Context: https://golang.org/issue/24283
-		zw, err := zstd.NewWriter(bw,
-			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
-			zstd.WithEncoderConcurrency(1),
-			zstd.WithZeroFrames(true),
-		)
+		zw, err := zstd.NewWriter(bw, encoderOptions...)
 		if err != nil {
 			return pw.CloseWithError(err)
 		}
@@ -68,3 +159,25 @@ func ReadCloserLevel(r io.ReadCloser, level int) io.ReadCloser {
 
 	return pr
 }
+
+// skippableFrameMagic is the magic number of zstd skippable frames, which decoders ignore.
+const skippableFrameMagic = 0x184D2A50
+
+// Compress returns data compressed as a single zstd frame.
+func Compress(data []byte) ([]byte, error) {
+	zw, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer zw.Close()
+	return zw.EncodeAll(data, nil), nil
+}
+
+// SkippableFrame wraps payload into zstd skippable frame, so it can be appended to a zstd stream
+// without affecting decompressed content.
+func SkippableFrame(payload []byte) []byte {
+	res := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint32(res[0:4], skippableFrameMagic)
+	binary.LittleEndian.PutUint32(res[4:8], uint32(len(payload)))
+	return append(res, payload...)
+}
@@ -25,9 +25,9 @@ func Test_ReadCloser(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, v1.Hash{
 		Algorithm: "sha256",
-		Hex:       "ffc1459590bc9dee536a1fb0a6fee5b31beefa35348488541c343c1d3af41f5d",
+		Hex:       "cace4fc537166e9f89f4f96a17b29ffc9e0bdde610b173711a0d8e3cc22de4fb",
 	}, h)
-	assert.Equal(t, int64(78), n)
+	assert.Equal(t, int64(69), n)
 }
 
 type TestInputData struct {
@@ -212,3 +212,102 @@ func Test_CompressionStability(t *testing.T) {
 		})
 	}
 }
+
+func TestReadCloserWithOptions_windowSize(t *testing.T) {
+	block := make([]byte, 10<<20)
+	rand.New(rand.NewSource(1)).Read(block)
+	input := append(append([]byte{}, block...), block...)
+
+	compressedSize := func(opts ...Option) int64 {
+		n, err := io.Copy(io.Discard, ReadCloserWithOptions(io.NopCloser(bytes.NewReader(input)), opts...))
+		require.NoError(t, err)
+		return n
+	}
+	// repetition 10 MiB apart is out of reach of the default window
+	assert.Greater(t, compressedSize(), int64(len(input))*9/10)
+	assert.Less(t, compressedSize(WithWindowSize(16<<20)), int64(len(input))*6/10)
+
+	assert.NoError(t, ValidateWindowSize(0))
+	assert.NoError(t, ValidateWindowSize(128<<20))
+	assert.Error(t, ValidateWindowSize(3<<20))
+	assert.Error(t, ValidateWindowSize(MaxWindowSize*2))
+}
+
+func TestReadCloserWithOptions_dictionary(t *testing.T) {
+	samples := [][]byte{
+		[]byte(`{"cpuCount": 4, "memorySize": 8589934592, "displays": [{"width": 1920, "height": 1080}]}`),
+		[]byte(`{"hardwareModel": "YnBsaXN0MDDTAQIDBAUGXxAZRGF0YVJlcHJlc2VudGF0aW9uVmVyc2lvbg=="}`),
+	}
+	dict := TrainDictionary(samples, MaxDictionarySize)
+	require.NotNil(t, dict)
+	assert.Equal(t, dict, TrainDictionary(samples, MaxDictionarySize))
+	assert.Len(t, TrainDictionary(samples, 64).Content, 64)
+	assert.Nil(t, TrainDictionary([][]byte{{}}, MaxDictionarySize))
+
+	input := []byte(`{"cpuCount": 8, "memorySize": 17179869184, "displays": [{"width": 2560, "height": 1440}]}`)
+	compress := func(opts ...Option) []byte {
+		data, err := io.ReadAll(ReadCloserWithOptions(io.NopCloser(bytes.NewReader(input)), opts...))
+		require.NoError(t, err)
+		return data
+	}
+	withDict := compress(WithDictionary(dict))
+	assert.Less(t, len(withDict), len(compress()))
+
+	rc, err := NewReader(io.NopCloser(bytes.NewReader(withDict)), WithDecoderDictionary(dict))
+	require.NoError(t, err)
+	decompressed, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, input, decompressed)
+
+	rc, err = NewReader(io.NopCloser(bytes.NewReader(withDict)))
+	require.NoError(t, err)
+	_, err = io.ReadAll(rc)
+	assert.Error(t, err, "decoding without the dictionary has to fail")
+}
+
+func TestReadCloserWithOptions_concurrency(t *testing.T) {
+	input := make([]byte, 4<<20)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < len(input); i += 3 {
+		input[i] = byte(r.Intn(4))
+	}
+	compress := func(opts ...Option) []byte {
+		data, err := io.ReadAll(ReadCloserWithOptions(io.NopCloser(bytes.NewReader(input)), opts...))
+		require.NoError(t, err)
+		return data
+	}
+	assert.Equal(t, compress(), compress(WithConcurrency(4)), "output must not depend on concurrency")
+}
+
+func TestSeekableReadCloser(t *testing.T) {
+	input := make([]byte, 3*1024+500)
+	rand.New(rand.NewSource(1)).Read(input[:1024])
+	compressed, err := io.ReadAll(SeekableReadCloser(io.NopCloser(bytes.NewReader(input)), 1024, WithLevel(3)))
+	require.NoError(t, err)
+
+	// regular decoders read the whole stream, skipping the seek table
+	rc, err := NewReader(io.NopCloser(bytes.NewReader(compressed)))
+	require.NoError(t, err)
+	decompressed, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.Equal(t, input, decompressed)
+
+	table, err := ReadSeekTable(bytes.NewReader(compressed), int64(len(compressed)))
+	require.NoError(t, err)
+	require.Len(t, table.Frames, 4)
+	assert.Equal(t, int64(500), table.Frames[3].DecompressedSize)
+
+	frames := table.Locate(1500, 100)
+	require.Len(t, frames, 1)
+	f := frames[0]
+	assert.Equal(t, int64(1024), f.DecompressedOffset)
+	rc, err = NewReader(io.NopCloser(bytes.NewReader(compressed[f.CompressedOffset : f.CompressedOffset+f.CompressedSize])))
+	require.NoError(t, err)
+	frame, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, input[1024:2048], frame)
+
+	_, err = ReadSeekTable(bytes.NewReader(compressed[:len(compressed)-1]), int64(len(compressed)-1))
+	assert.Error(t, err)
+}